@@ -0,0 +1,175 @@
+package account
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"github.com/zenvisjr/building-scalable-microservices/logger"
+)
+
+// maxAddressesPerAccount keeps the address book of one account small
+const maxAddressesPerAccount = 20
+
+var (
+	errAddressNotFound   = errors.New("address not found")
+	errTooManyAddresses  = errors.New("address book is full, delete an address first")
+	errIncompleteAddress = errors.New("recipient, line1, city, postal code and country are required")
+)
+
+// Address is a shipping address of an account. Orders keep a copy of the address they are
+// shipped to, so changing it does not rewrite past orders
+type Address struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"user_id"`
+	Label      string    `json:"label"`
+	Recipient  string    `json:"recipient"`
+	Line1      string    `json:"line1"`
+	Line2      string    `json:"line2"`
+	City       string    `json:"city"`
+	State      string    `json:"state"`
+	PostalCode string    `json:"postal_code"`
+	Country    string    `json:"country"` // ISO 3166-1 alpha-2
+	Phone      string    `json:"phone"`
+	IsDefault  bool      `json:"is_default"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// normalize trims the fields and checks the ones a parcel cannot be delivered without
+func (a *Address) normalize() error {
+	for _, field := range []*string{&a.Label, &a.Recipient, &a.Line1, &a.Line2, &a.City, &a.State, &a.PostalCode, &a.Country, &a.Phone} {
+		*field = strings.TrimSpace(*field)
+	}
+	a.Country = strings.ToUpper(a.Country)
+	if a.Recipient == "" || a.Line1 == "" || a.City == "" || a.PostalCode == "" || len(a.Country) != 2 {
+		return errIncompleteAddress
+	}
+	return nil
+}
+
+func (a *accountService) AddAddress(ctx context.Context, userID string, address Address) (*Address, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Got add address request in service for user: " + userID)
+
+	if err := address.normalize(); err != nil {
+		return nil, err
+	}
+
+	// Step 1: Check the size of the address book, the first address becomes the default
+	existing, err := a.repo.ListAddresses(ctx, userID)
+	if err != nil {
+		Logs.Error(ctx, "Failed to list addresses: "+err.Error())
+		return nil, err
+	}
+	if len(existing) >= maxAddressesPerAccount {
+		return nil, errTooManyAddresses
+	}
+
+	// Step 2: Store it, a new default takes the flag from the previous one
+	now := time.Now().UTC()
+	address.ID = ksuid.New().String()
+	address.UserID = userID
+	address.IsDefault = address.IsDefault || len(existing) == 0
+	address.CreatedAt = now
+	address.UpdatedAt = now
+	if err := a.repo.CreateAddress(ctx, address); err != nil {
+		Logs.Error(ctx, "Failed to store address: "+err.Error())
+		return nil, err
+	}
+
+	Logs.Info(ctx, "Added address "+address.ID+" for user: "+userID)
+	return &address, nil
+}
+
+func (a *accountService) ListAddresses(ctx context.Context, userID string) ([]Address, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Got list addresses request in service for user: " + userID)
+
+	return a.repo.ListAddresses(ctx, userID)
+}
+
+// GetAddress returns an address of the user, or the default address when id is empty.
+// Without a default address it returns nil and no error
+func (a *accountService) GetAddress(ctx context.Context, userID string, id string) (*Address, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Got get address request in service for user: " + userID)
+
+	var address *Address
+	var err error
+	if id == "" {
+		address, err = a.repo.GetDefaultAddress(ctx, userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+	} else {
+		address, err = a.repo.GetAddress(ctx, userID, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errAddressNotFound
+		}
+	}
+	if err != nil {
+		Logs.Error(ctx, "Failed to get address: "+err.Error())
+		return nil, err
+	}
+	return address, nil
+}
+
+// UpdateAddress replaces the fields of an address. IsDefault set makes it the default,
+// unset leaves the default as it is
+func (a *accountService) UpdateAddress(ctx context.Context, userID string, address Address) (*Address, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Got update address request in service for user: " + userID)
+
+	if err := address.normalize(); err != nil {
+		return nil, err
+	}
+	address.UserID = userID
+	address.UpdatedAt = time.Now().UTC()
+	if err := a.repo.UpdateAddress(ctx, address); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errAddressNotFound
+		}
+		Logs.Error(ctx, "Failed to update address: "+err.Error())
+		return nil, err
+	}
+
+	Logs.Info(ctx, "Updated address "+address.ID+" for user: "+userID)
+	return a.GetAddress(ctx, userID, address.ID)
+}
+
+// DeleteAddress removes an address, deleting the default leaves the account without one
+func (a *accountService) DeleteAddress(ctx context.Context, userID string, id string) error {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Got delete address request in service for user: " + userID)
+
+	if err := a.repo.DeleteAddress(ctx, userID, id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errAddressNotFound
+		}
+		Logs.Error(ctx, "Failed to delete address: "+err.Error())
+		return err
+	}
+
+	Logs.Info(ctx, "Deleted address "+id+" for user: "+userID)
+	return nil
+}
+
+func (a *accountService) SetDefaultAddress(ctx context.Context, userID string, id string) (*Address, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Got set default address request in service for user: " + userID)
+
+	if err := a.repo.SetDefaultAddress(ctx, userID, id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errAddressNotFound
+		}
+		Logs.Error(ctx, "Failed to set default address: "+err.Error())
+		return nil, err
+	}
+
+	Logs.Info(ctx, "Address "+id+" is now the default for user: "+userID)
+	return a.GetAddress(ctx, userID, id)
+}
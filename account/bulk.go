@@ -0,0 +1,328 @@
+package account
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zenvisjr/building-scalable-microservices/internal/validation"
+	"github.com/zenvisjr/building-scalable-microservices/logger"
+)
+
+// Formats of the files ImportAccounts reads and ExportAccounts writes
+const (
+	BulkFormatCSV   = "csv"
+	BulkFormatJSONL = "jsonl"
+)
+
+const (
+	// maxImportRows caps one import, larger files have to be split
+	maxImportRows = 5000
+	// maxImportLineSize caps one JSONL line
+	maxImportLineSize = 64 * 1024
+	// exportPageSize is how many accounts an export reads from the database at a time
+	exportPageSize = 500
+	// bulkChunkSize is how many bytes of a file go in one stream message
+	bulkChunkSize = 32 * 1024
+)
+
+var (
+	errUnknownBulkFormat  = errors.New("format must be csv or jsonl")
+	errMissingCSVColumns  = errors.New("CSV header needs name, email and password columns")
+	errMalformedRow       = errors.New("malformed row")
+	errDuplicateImportRow = errors.New("email appears more than once in the file")
+	errRoleNotAllowed     = errors.New("only callers allowed to assign roles can import accounts with a role other than user")
+	errTooManyImportRows  = errors.New("file has more than " + strconv.Itoa(maxImportRows) + " rows, the rest was not read")
+	errNoImportOptions    = errors.New("the first message of an import has to carry the options")
+)
+
+// exportColumns are the CSV columns of an export. Password hashes and 2FA secrets are never
+// exported, restored accounts have to reset their password
+var exportColumns = []string{"id", "name", "email", "role", "is_active", "email_verified", "phone", "created_at"}
+
+// ImportOptions controls ImportAccounts
+type ImportOptions struct {
+	Format     string // BulkFormatCSV or BulkFormatJSONL
+	DryRun     bool   // check every row without creating accounts
+	AllowRoles bool   // rows may ask for a role other than user
+}
+
+// ImportRowError tells why a row was not imported. Row 1 is the first row after the CSV
+// header or the first JSONL line
+type ImportRowError struct {
+	Row   int
+	Email string
+	Error string
+}
+
+// ImportReport is the outcome of ImportAccounts. Rows that fail do not stop the import
+type ImportReport struct {
+	Rows     int
+	Imported int // accounts created, or that would be created on a dry run
+	DryRun   bool
+	Errors   []ImportRowError
+	Created  []*Account // empty on a dry run
+}
+
+// importRow is one account of an import file
+type importRow struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+// validate applies the rules of the gateway's signup input
+func (r importRow) validate() error {
+	return validation.ValidateStruct(validation.AccountInput{
+		Name:     r.Name,
+		Email:    r.Email,
+		Password: r.Password,
+		Role:     r.Role,
+	})
+}
+
+// exportedAccountRow is one line of a JSONL export
+type exportedAccountRow struct {
+	ID            string    `json:"id"`
+	Name          string    `json:"name"`
+	Email         string    `json:"email"`
+	Role          string    `json:"role"`
+	IsActive      bool      `json:"is_active"`
+	EmailVerified bool      `json:"email_verified"`
+	Phone         string    `json:"phone"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// newImportRowReader returns a function yielding the rows of r one at a time and io.EOF after
+// the last. Rows that cannot be parsed come back as errMalformedRow, reading can go on after them
+func newImportRowReader(r io.Reader, format string) (func() (importRow, error), error) {
+	switch format {
+	case BulkFormatCSV:
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = -1
+		reader.TrimLeadingSpace = true
+		header, err := reader.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, errMissingCSVColumns
+			}
+			return nil, err
+		}
+		columns := map[string]int{}
+		for i, name := range header {
+			columns[strings.ToLower(strings.TrimSpace(name))] = i
+		}
+		for _, required := range []string{"name", "email", "password"} {
+			if _, ok := columns[required]; !ok {
+				return nil, errMissingCSVColumns
+			}
+		}
+		field := func(record []string, name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return record[i]
+			}
+			return ""
+		}
+		return func() (importRow, error) {
+			record, err := reader.Read()
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				return importRow{}, fmt.Errorf("%w: %v", errMalformedRow, parseErr.Err)
+			}
+			if err != nil {
+				return importRow{}, err
+			}
+			return importRow{
+				Name:     field(record, "name"),
+				Email:    field(record, "email"),
+				Password: field(record, "password"),
+				Role:     field(record, "role"),
+			}, nil
+		}, nil
+
+	case BulkFormatJSONL:
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 0, 4096), maxImportLineSize)
+		return func() (importRow, error) {
+			for scanner.Scan() {
+				line := strings.TrimSpace(scanner.Text())
+				if line == "" {
+					continue
+				}
+				var row importRow
+				if err := json.Unmarshal([]byte(line), &row); err != nil {
+					return importRow{}, fmt.Errorf("%w: %v", errMalformedRow, err)
+				}
+				return row, nil
+			}
+			if err := scanner.Err(); err != nil {
+				return importRow{}, err
+			}
+			return importRow{}, io.EOF
+		}, nil
+	}
+	return nil, errUnknownBulkFormat
+}
+
+// ImportAccounts creates an account for every valid row of r. Each row is checked like a
+// signup, rows that fail are reported and skipped, so a failing row never undoes the others
+func (a *accountService) ImportAccounts(ctx context.Context, r io.Reader, opts ImportOptions) (*ImportReport, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("ImportAccounts called with format: " + opts.Format)
+
+	next, err := newImportRowReader(r, opts.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ImportReport{DryRun: opts.DryRun}
+	seen := map[string]bool{}
+	for {
+		row, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil && !errors.Is(err, errMalformedRow) {
+			Logs.Error(ctx, "Failed to read import: "+err.Error())
+			return nil, err
+		}
+		report.Rows++
+		fail := func(err error) {
+			report.Errors = append(report.Errors, ImportRowError{Row: report.Rows, Email: row.Email, Error: err.Error()})
+		}
+		if report.Rows > maxImportRows {
+			fail(errTooManyImportRows)
+			report.Rows--
+			break
+		}
+		if err != nil {
+			fail(err)
+			continue
+		}
+
+		// Step 1: The same rules as a signup
+		row.Name = strings.TrimSpace(row.Name)
+		row.Email = strings.TrimSpace(row.Email)
+		row.Role = strings.TrimSpace(row.Role)
+		if err := row.validate(); err != nil {
+			fail(err)
+			continue
+		}
+		if row.Role == "" {
+			row.Role = "user"
+		}
+		if row.Role != "user" && !opts.AllowRoles {
+			fail(errRoleNotAllowed)
+			continue
+		}
+
+		// Step 2: Emails have to be new, in the file and in the database
+		key := strings.ToLower(row.Email)
+		if seen[key] {
+			fail(errDuplicateImportRow)
+			continue
+		}
+		seen[key] = true
+		if _, err := a.repo.GetAccountForAuth(ctx, row.Email); err == nil {
+			fail(errEmailTaken)
+			continue
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			Logs.Error(ctx, "Failed to look up email: "+err.Error())
+			return nil, err
+		}
+
+		// Step 3: Create the account, unless this is a dry run
+		if opts.DryRun {
+			report.Imported++
+			continue
+		}
+		acc, err := a.PostAccount(ctx, row.Name, row.Email, row.Password, row.Role)
+		if err != nil {
+			fail(err)
+			continue
+		}
+		report.Imported++
+		report.Created = append(report.Created, acc)
+	}
+
+	Logs.Info(ctx, fmt.Sprintf("Imported %d of %d accounts (dry run: %t)", report.Imported, report.Rows, opts.DryRun))
+	return report, nil
+}
+
+// ExportAccounts writes every account matching the filter to w, newest first, and returns how
+// many it wrote. Accounts are read page by page so the export never holds them all in memory
+func (a *accountService) ExportAccounts(ctx context.Context, filter AccountFilter, format string, w io.Writer) (int, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("ExportAccounts called with format: " + format)
+
+	var write func(acc Account) error
+	var flush func() error
+	switch format {
+	case BulkFormatCSV:
+		writer := csv.NewWriter(w)
+		if err := writer.Write(exportColumns); err != nil {
+			return 0, err
+		}
+		write = func(acc Account) error {
+			return writer.Write([]string{acc.ID, acc.Name, acc.Email, acc.Role, strconv.FormatBool(acc.IsActive),
+				strconv.FormatBool(acc.EmailVerified), acc.Phone, acc.CreatedAt.UTC().Format(time.RFC3339)})
+		}
+		flush = func() error {
+			writer.Flush()
+			return writer.Error()
+		}
+	case BulkFormatJSONL:
+		encoder := json.NewEncoder(w)
+		write = func(acc Account) error {
+			return encoder.Encode(exportedAccountRow{
+				ID:            acc.ID,
+				Name:          acc.Name,
+				Email:         acc.Email,
+				Role:          acc.Role,
+				IsActive:      acc.IsActive,
+				EmailVerified: acc.EmailVerified,
+				Phone:         acc.Phone,
+				CreatedAt:     acc.CreatedAt.UTC(),
+			})
+		}
+		flush = func() error { return nil }
+	default:
+		return 0, errUnknownBulkFormat
+	}
+
+	count := 0
+	var cursor *accountCursor
+	for {
+		accounts, err := a.repo.SearchAccounts(ctx, filter, cursor, exportPageSize)
+		if err != nil {
+			Logs.Error(ctx, "Failed to read accounts: "+err.Error())
+			return count, err
+		}
+		for _, acc := range accounts {
+			if err := write(acc); err != nil {
+				return count, err
+			}
+			count++
+		}
+		if len(accounts) < exportPageSize {
+			break
+		}
+		last := accounts[len(accounts)-1]
+		cursor = &accountCursor{CreatedAt: last.CreatedAt, ID: last.ID}
+	}
+	if err := flush(); err != nil {
+		return count, err
+	}
+
+	Logs.Info(ctx, "Exported "+logger.IntToStr(count)+" accounts")
+	return count, nil
+}
@@ -2,12 +2,17 @@ package account
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 
 	"github.com/zenvisjr/building-scalable-microservices/account/pb"
 	"github.com/zenvisjr/building-scalable-microservices/logger"
+	"github.com/zenvisjr/building-scalable-microservices/svcauth"
+	"github.com/zenvisjr/building-scalable-microservices/tlsconfig"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // var logs = logger.GetGlobalLogger()
@@ -17,12 +22,19 @@ type Client struct {
 	service pb.AccountServiceClient
 }
 
-// Connects to gRPC server and initializes service client
-func NewClient(address string) (*Client, error) {
+// Connects to gRPC server and initializes service client, opts are added to the TLS and
+// service token options, tests pass an in-memory dialer this way
+func NewClient(address string, opts ...grpc.DialOption) (*Client, error) {
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("Connecting to Account gRPC service at " + address)
 
-	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	creds, err := tlsconfig.DialOption()
+	if err != nil {
+		Logs.Warn(context.Background(), "Failed to load TLS config for Account gRPC: "+err.Error())
+		return nil, err
+	}
+
+	conn, err := grpc.NewClient(address, append([]grpc.DialOption{creds, svcauth.DialOption(), svcauth.StreamDialOption()}, opts...)...)
 	if err != nil {
 		Logs.Warn(context.Background(), "Failed to connect to Account gRPC: "+err.Error())
 		return nil, err
@@ -79,13 +91,7 @@ func (c *Client) GetAccount(ctx context.Context, id string) (*Account, error) {
 	}
 
 	Logs.Info(ctx, "Fetched account: "+resp.Account.Name)
-	return &Account{
-		ID:   resp.Account.Id,
-		Name: resp.Account.Name,
-		Email: resp.Account.Email,
-		Role: resp.Account.Role,
-		IsActive: resp.Account.IsActive,
-	}, nil
+	return fromAccountProto(resp.Account), nil
 }
 
 func (c *Client) GetAccounts(ctx context.Context, skip uint64, take uint64) ([]Account, error) {
@@ -102,17 +108,51 @@ func (c *Client) GetAccounts(ctx context.Context, skip uint64, take uint64) ([]A
 
 	accounts := make([]Account, len(resp.Accounts))
 	for i, acc := range resp.Accounts {
-		accounts[i] = Account{
-			ID:   acc.Id,
-			Name: acc.Name,
-			Email: acc.Email,
-			Role: acc.Role,
-			IsActive: acc.IsActive,
-		}
+		accounts[i] = *fromAccountProto(acc)
 	}
 	return accounts, nil
 }
 
+// SearchAccounts returns a page of the accounts matching the filter, newest first. Pass the
+// EndCursor of a page as after to get the next one
+func (c *Client) SearchAccounts(ctx context.Context, filter AccountFilter, first int, after string) (*AccountPage, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo(fmt.Sprintf("Searching accounts: first=%d", first))
+
+	req := &pb.SearchAccountsRequest{
+		Id:       filter.ID,
+		Name:     filter.Name,
+		Email:    filter.Email,
+		Role:     filter.Role,
+		IsActive: filter.IsActive,
+		First:    uint32(first),
+		After:    after,
+	}
+	if !filter.CreatedAfter.IsZero() {
+		req.CreatedAfter = timestamppb.New(filter.CreatedAfter)
+	}
+	if !filter.CreatedBefore.IsZero() {
+		req.CreatedBefore = timestamppb.New(filter.CreatedBefore)
+	}
+
+	resp, err := c.service.SearchAccounts(ctx, req)
+	if err != nil {
+		Logs.Error(ctx, "SearchAccounts RPC failed: "+err.Error())
+		return nil, err
+	}
+
+	page := &AccountPage{
+		Edges:       make([]AccountEdge, len(resp.GetEdges())),
+		EndCursor:   resp.GetEndCursor(),
+		HasNextPage: resp.GetHasNextPage(),
+		TotalCount:  resp.GetTotalCount(),
+	}
+	for i, edge := range resp.GetEdges() {
+		page.Edges[i] = AccountEdge{Account: *fromAccountProto(edge.GetAccount()), Cursor: edge.GetCursor()}
+	}
+	return page, nil
+}
+
 func (c *Client) GetEmail(ctx context.Context, name string) (*Account, error) {
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("Fetching email for account with name: " + name)
@@ -149,6 +189,8 @@ func (c *Client) GetEmailForAuth(ctx context.Context, email string) (*Account, e
 		Role: resp.Role,
 		TokenVersion: resp.TokenVersion,
 		IsActive: resp.IsActive,
+		TOTPEnabled: resp.TotpEnabled,
+		EmailVerified: resp.EmailVerified,
 	}, nil
 }
 
@@ -217,4 +259,335 @@ func(c *Client) DeleteAccount(ctx context.Context, userID string) error {
 	}
 	Logs.Info(ctx, "Deleted account for user ID: "+userID)
 	return nil
-}
\ No newline at end of file
+}
+
+// EraseAccount anonymizes the account, it succeeds for accounts that no longer exist
+func (c *Client) EraseAccount(ctx context.Context, userID string) error {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Erasing account for user ID: " + userID)
+
+	_, err := c.service.EraseAccount(ctx, &pb.UpdateAccountRequest{UserId: userID})
+	if err != nil {
+		Logs.Error(ctx, "EraseAccount RPC failed: "+err.Error())
+		return err
+	}
+	Logs.Info(ctx, "Erased account for user ID: "+userID)
+	return nil
+}
+
+// GetTOTP returns the encrypted TOTP secret and whether two-factor login is enabled
+func (c *Client) GetTOTP(ctx context.Context, userID string) (string, bool, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Fetching TOTP for user ID: " + userID)
+
+	resp, err := c.service.GetTOTP(ctx, &pb.UpdateAccountRequest{UserId: userID})
+	if err != nil {
+		Logs.Error(ctx, "GetTOTP RPC failed: "+err.Error())
+		return "", false, err
+	}
+	return resp.TotpSecret, resp.TotpEnabled, nil
+}
+
+func (c *Client) UpdateTOTP(ctx context.Context, userID string, encryptedSecret string, enabled bool) error {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Updating TOTP for user ID: " + userID)
+
+	_, err := c.service.UpdateTOTP(ctx, &pb.UpdateTOTPRequest{
+		UserId:      userID,
+		TotpSecret:  encryptedSecret,
+		TotpEnabled: enabled,
+	})
+	if err != nil {
+		Logs.Error(ctx, "UpdateTOTP RPC failed: "+err.Error())
+		return err
+	}
+	return nil
+}
+
+func (c *Client) MarkEmailVerified(ctx context.Context, userID string, email string) error {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Marking email verified for user ID: " + userID)
+
+	_, err := c.service.MarkEmailVerified(ctx, &pb.MarkEmailVerifiedRequest{
+		UserId: userID,
+		Email:  email,
+	})
+	if err != nil {
+		Logs.Error(ctx, "MarkEmailVerified RPC failed: "+err.Error())
+		return err
+	}
+	return nil
+}
+
+// GetRolePermissions returns the permissions granted to a role
+func (c *Client) GetRolePermissions(ctx context.Context, role string) ([]string, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Fetching permissions for role: " + role)
+
+	resp, err := c.service.GetRolePermissions(ctx, &pb.GetRolePermissionsRequest{Role: role})
+	if err != nil {
+		Logs.Error(ctx, "GetRolePermissions RPC failed: "+err.Error())
+		return nil, err
+	}
+	return resp.GetPermissions(), nil
+}
+
+func fromAccountProto(acc *pb.Account) *Account {
+	result := &Account{
+		ID:            acc.Id,
+		Name:          acc.Name,
+		Email:         acc.Email,
+		Role:          acc.Role,
+		IsActive:      acc.IsActive,
+		EmailVerified: acc.EmailVerified,
+		PendingEmail:  acc.PendingEmail,
+		Phone:         acc.Phone,
+	}
+	if acc.GetCreatedAt() != nil {
+		result.CreatedAt = acc.GetCreatedAt().AsTime()
+	}
+	return result
+}
+
+// UpdateProfile changes the given fields, a new email is returned as PendingEmail until verified
+func (c *Client) UpdateProfile(ctx context.Context, userID string, update ProfileUpdate) (*Account, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Updating profile for user ID: " + userID)
+
+	resp, err := c.service.UpdateProfile(ctx, &pb.UpdateProfileRequest{
+		UserId: userID,
+		Name:   update.Name,
+		Email:  update.Email,
+		Phone:  update.Phone,
+	})
+	if err != nil {
+		Logs.Error(ctx, "UpdateProfile RPC failed: "+err.Error())
+		return nil, err
+	}
+	return fromAccountProto(resp.GetAccount()), nil
+}
+
+func (c *Client) ChangeRole(ctx context.Context, userID string, role string) (*Account, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Changing role of user ID: " + userID)
+
+	resp, err := c.service.ChangeRole(ctx, &pb.ChangeRoleRequest{UserId: userID, Role: role})
+	if err != nil {
+		Logs.Error(ctx, "ChangeRole RPC failed: "+err.Error())
+		return nil, err
+	}
+	return fromAccountProto(resp.GetAccount()), nil
+}
+
+// GetAccountHistory returns the latest events of the account, newest first. Before and After
+// are left nil when the event has none
+func (c *Client) GetAccountHistory(ctx context.Context, userID string, limit int) ([]AccountEvent, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Fetching account history for user ID: " + userID)
+
+	resp, err := c.service.GetAccountHistory(ctx, &pb.GetAccountHistoryRequest{UserId: userID, Limit: uint32(limit)})
+	if err != nil {
+		Logs.Error(ctx, "GetAccountHistory RPC failed: "+err.Error())
+		return nil, err
+	}
+	events := make([]AccountEvent, len(resp.GetEvents()))
+	for i, e := range resp.GetEvents() {
+		events[i] = AccountEvent{
+			ID:           e.GetId(),
+			AccountID:    e.GetAccountId(),
+			Action:       e.GetAction(),
+			ActorID:      e.GetActorId(),
+			ActorService: e.GetActorService(),
+			RequestID:    e.GetRequestId(),
+			CreatedAt:    e.GetCreatedAt().AsTime(),
+		}
+		if e.GetBefore() != "" {
+			if err := json.Unmarshal([]byte(e.GetBefore()), &events[i].Before); err != nil {
+				return nil, err
+			}
+		}
+		if e.GetAfter() != "" {
+			if err := json.Unmarshal([]byte(e.GetAfter()), &events[i].After); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return events, nil
+}
+
+func (c *Client) AddAddress(ctx context.Context, userID string, address Address) (*Address, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Adding address for user ID: " + userID)
+
+	resp, err := c.service.AddAddress(ctx, &pb.AddressRequest{UserId: userID, Address: toAddressProto(&address)})
+	if err != nil {
+		Logs.Error(ctx, "AddAddress RPC failed: "+err.Error())
+		return nil, err
+	}
+	return addressFromResponse(resp), nil
+}
+
+func (c *Client) ListAddresses(ctx context.Context, userID string) ([]Address, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Listing addresses for user ID: " + userID)
+
+	resp, err := c.service.ListAddresses(ctx, &pb.UpdateAccountRequest{UserId: userID})
+	if err != nil {
+		Logs.Error(ctx, "ListAddresses RPC failed: "+err.Error())
+		return nil, err
+	}
+	addresses := make([]Address, len(resp.GetAddresses()))
+	for i, address := range resp.GetAddresses() {
+		addresses[i] = fromAddressProto(address)
+	}
+	return addresses, nil
+}
+
+// GetAddress returns an address of the user, or the default one when id is empty. It returns
+// nil and no error if the user has no default address
+func (c *Client) GetAddress(ctx context.Context, userID string, id string) (*Address, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Fetching address for user ID: " + userID)
+
+	resp, err := c.service.GetAddress(ctx, &pb.AddressIDRequest{UserId: userID, Id: id})
+	if err != nil {
+		Logs.Error(ctx, "GetAddress RPC failed: "+err.Error())
+		return nil, err
+	}
+	return addressFromResponse(resp), nil
+}
+
+func (c *Client) UpdateAddress(ctx context.Context, userID string, address Address) (*Address, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Updating address " + address.ID + " for user ID: " + userID)
+
+	resp, err := c.service.UpdateAddress(ctx, &pb.AddressRequest{UserId: userID, Address: toAddressProto(&address)})
+	if err != nil {
+		Logs.Error(ctx, "UpdateAddress RPC failed: "+err.Error())
+		return nil, err
+	}
+	return addressFromResponse(resp), nil
+}
+
+func (c *Client) DeleteAddress(ctx context.Context, userID string, id string) error {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Deleting address " + id + " for user ID: " + userID)
+
+	if _, err := c.service.DeleteAddress(ctx, &pb.AddressIDRequest{UserId: userID, Id: id}); err != nil {
+		Logs.Error(ctx, "DeleteAddress RPC failed: "+err.Error())
+		return err
+	}
+	return nil
+}
+
+func (c *Client) SetDefaultAddress(ctx context.Context, userID string, id string) (*Address, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Setting default address " + id + " for user ID: " + userID)
+
+	resp, err := c.service.SetDefaultAddress(ctx, &pb.AddressIDRequest{UserId: userID, Id: id})
+	if err != nil {
+		Logs.Error(ctx, "SetDefaultAddress RPC failed: "+err.Error())
+		return nil, err
+	}
+	return addressFromResponse(resp), nil
+}
+
+func addressFromResponse(resp *pb.AddressResponse) *Address {
+	if resp.GetAddress() == nil {
+		return nil
+	}
+	address := fromAddressProto(resp.GetAddress())
+	return &address
+}
+
+// ImportAccounts streams the file in r to the account service in chunks and returns the
+// report once every row is handled. sendWelcomeEmail queues a welcome email for every
+// account created
+func (c *Client) ImportAccounts(ctx context.Context, r io.Reader, opts ImportOptions, sendWelcomeEmail bool) (*ImportReport, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Calling ImportAccounts on account service with format: " + opts.Format)
+
+	stream, err := c.service.ImportAccounts(ctx)
+	if err != nil {
+		Logs.Error(ctx, "ImportAccounts gRPC failed: "+err.Error())
+		return nil, err
+	}
+
+	// Step 1: The first message carries the options, every message a chunk of the file
+	req := &pb.ImportAccountsRequest{Options: &pb.ImportOptions{
+		Format:           opts.Format,
+		DryRun:           opts.DryRun,
+		SendWelcomeEmail: sendWelcomeEmail,
+		AllowRoles:       opts.AllowRoles,
+	}}
+	buf := make([]byte, bulkChunkSize)
+	for {
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 || req.Options != nil {
+			req.Data = buf[:n]
+			err := stream.Send(req)
+			// io.EOF means the server stopped reading, CloseAndRecv tells why
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				Logs.Error(ctx, "ImportAccounts gRPC failed: "+err.Error())
+				return nil, err
+			}
+			req = &pb.ImportAccountsRequest{}
+		}
+		if errors.Is(readErr, io.EOF) || errors.Is(readErr, io.ErrUnexpectedEOF) {
+			break
+		}
+		if readErr != nil {
+			return nil, readErr
+		}
+	}
+
+	// Step 2: Wait for the report
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		Logs.Error(ctx, "ImportAccounts gRPC failed: "+err.Error())
+		return nil, err
+	}
+	report := &ImportReport{
+		Rows:     int(resp.GetRows()),
+		Imported: int(resp.GetImported()),
+		DryRun:   resp.GetDryRun(),
+		Errors:   make([]ImportRowError, len(resp.GetErrors())),
+	}
+	for i, rowErr := range resp.GetErrors() {
+		report.Errors[i] = ImportRowError{Row: int(rowErr.GetRow()), Email: rowErr.GetEmail(), Error: rowErr.GetError()}
+	}
+	return report, nil
+}
+
+// ExportAccounts writes the accounts matching the role and isActive filter to w in the given
+// format as the account service streams them
+func (c *Client) ExportAccounts(ctx context.Context, filter AccountFilter, format string, w io.Writer) error {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Calling ExportAccounts on account service with format: " + format)
+
+	stream, err := c.service.ExportAccounts(ctx, &pb.ExportAccountsRequest{
+		Format:   format,
+		Role:     filter.Role,
+		IsActive: filter.IsActive,
+	})
+	if err != nil {
+		Logs.Error(ctx, "ExportAccounts gRPC failed: "+err.Error())
+		return err
+	}
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			Logs.Error(ctx, "ExportAccounts gRPC failed: "+err.Error())
+			return err
+		}
+		if _, err := w.Write(chunk.GetData()); err != nil {
+			return err
+		}
+	}
+}
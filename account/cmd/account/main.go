@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/avast/retry-go"
@@ -11,11 +12,14 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/zenvisjr/building-scalable-microservices/account"
 	"github.com/zenvisjr/building-scalable-microservices/logger"
+	"github.com/zenvisjr/building-scalable-microservices/migrate"
+	"github.com/zenvisjr/building-scalable-microservices/svcauth"
 )
 
 type Config struct {
-	DatabaseURL string `envconfig:"DATABASE_URL"`
-	MailURL     string `envconfig:"MAIL_SERVICE_URL"`
+	DatabaseURL    string `envconfig:"DATABASE_URL"`
+	MigrateOnStart bool   `envconfig:"MIGRATE_ON_START" default:"true"`
+	MailURL        string `envconfig:"MAIL_SERVICE_URL"`
 }
 
 var (
@@ -34,6 +38,11 @@ func main() {
 	}
 	defer Logs.Close()
 
+	// Identify this service to the others it calls
+	if err := svcauth.Init("account"); err != nil {
+		Logs.Fatal(ctx, "Failed to initialize service authentication: "+err.Error())
+	}
+
 	// Local trace of service start
 	Logs.LocalOnlyInfo("Account service bootstrapping...")
 
@@ -49,6 +58,14 @@ func main() {
 		Logs.Fatal(ctx, "Failed to load configuration: "+err.Error())
 	}
 
+	// "app migrate ..." only migrates the database and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate.Run(ctx, config.DatabaseURL, account.Migrations, os.Args[2:]); err != nil {
+			Logs.Fatal(ctx, "Migration failed: "+err.Error())
+		}
+		return
+	}
+
 	var r account.Repository
 
 	// Retry DB connection
@@ -75,6 +92,13 @@ func main() {
 	}
 	defer r.Close()
 
+	// Bring the schema up to date before serving
+	if config.MigrateOnStart {
+		if err := migrate.Run(ctx, config.DatabaseURL, account.Migrations, []string{"up"}); err != nil {
+			Logs.Fatal(ctx, "Failed to migrate database: "+err.Error())
+		}
+	}
+
 	Logs.LocalOnlyInfo("Launching gRPC server...")
 	Logs.Info(ctx, "Starting gRPC server for account service on port 8080")
 
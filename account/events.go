@@ -0,0 +1,11 @@
+package account
+
+// TokenVersionChangedSubject is published on NATS whenever something happens to an account
+// that makes its issued access tokens invalid, services caching token versions drop the entry
+const TokenVersionChangedSubject = "account.token_version.changed"
+
+// TokenVersionChanged is the payload of TokenVersionChangedSubject
+type TokenVersionChanged struct {
+	UserID string `json:"user_id"`
+	Reason string `json:"reason"` // e.g. "token_version_incremented" or "account_deleted"
+}
@@ -0,0 +1,99 @@
+package account
+
+import (
+	"context"
+	"time"
+
+	"github.com/zenvisjr/building-scalable-microservices/logger"
+	"github.com/zenvisjr/building-scalable-microservices/svcauth"
+)
+
+// Actions recorded in the history of an account
+const (
+	AccountEventCreated           = "created"
+	AccountEventDeactivated       = "deactivated"
+	AccountEventReactivated       = "reactivated"
+	AccountEventRoleChanged       = "role_changed"
+	AccountEventPasswordChanged   = "password_changed"
+	AccountEventTokensRevoked     = "tokens_revoked"
+	AccountEventProfileUpdated    = "profile_updated"
+	AccountEventEmailVerified     = "email_verified"
+	AccountEventEmailChanged      = "email_changed"
+	AccountEventTwoFactorEnabled  = "two_factor_enabled"
+	AccountEventTwoFactorDisabled = "two_factor_disabled"
+	AccountEventErased            = "erased"
+	AccountEventDeleted           = "deleted"
+)
+
+const (
+	// defaultHistoryLimit is used when the caller does not ask for a number of events
+	defaultHistoryLimit = 50
+	// maxHistoryLimit caps how many events one GetAccountHistory call returns
+	maxHistoryLimit = 500
+)
+
+// AccountEvent is one entry of the append-only history of an account. Before and After hold the
+// fields the change touched. Personal data such as the name, email or phone is never copied into
+// them, a profile update only lists the fields it changed, so erasing an account leaves nothing
+// personal behind in its history
+type AccountEvent struct {
+	ID           int64                  `json:"id"`
+	AccountID    string                 `json:"account_id"`
+	Action       string                 `json:"action"`
+	ActorID      string                 `json:"actor_id"`      // user the change was made by, empty for anonymous flows like a password reset
+	ActorService string                 `json:"actor_service"` // service that called the account service
+	RequestID    string                 `json:"request_id"`
+	Before       map[string]interface{} `json:"before,omitempty"`
+	After        map[string]interface{} `json:"after,omitempty"`
+	CreatedAt    time.Time              `json:"created_at"`
+}
+
+// accountState is the part of an account the history records, read with the row locked
+type accountState struct {
+	Role          string
+	IsActive      bool
+	EmailVerified bool
+	TOTPEnabled   bool
+	TokenVersion  int32
+}
+
+// newAccountEvent fills in who made the change from the user and request ID the calling service
+// forwarded
+func newAccountEvent(ctx context.Context, accountID string, action string, before, after map[string]interface{}) AccountEvent {
+	event := AccountEvent{
+		AccountID:    accountID,
+		Action:       action,
+		ActorService: svcauth.CallerFromContext(ctx),
+		RequestID:    svcauth.RequestIDFromContext(ctx),
+		Before:       before,
+		After:        after,
+		CreatedAt:    time.Now().UTC(),
+	}
+	if user, ok := svcauth.UserFromContext(ctx); ok {
+		event.ActorID = user.ID
+	}
+	return event
+}
+
+// GetAccountHistory returns the latest events of the account, newest first. The history outlives
+// the account, so deleted accounts still have one
+func (a *accountService) GetAccountHistory(ctx context.Context, userID string, limit int) ([]AccountEvent, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Got account history request in service for user: " + userID)
+
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+	if limit > maxHistoryLimit {
+		limit = maxHistoryLimit
+	}
+
+	events, err := a.repo.ListAccountEvents(ctx, userID, limit)
+	if err != nil {
+		Logs.Error(ctx, "Failed to list account events: "+err.Error())
+		return nil, err
+	}
+
+	Logs.Info(ctx, "Fetched "+logger.IntToStr(len(events))+" events for user: "+userID)
+	return events, nil
+}
@@ -1,3 +1,5 @@
+-- Schema from before migrations. It keeps IF NOT EXISTS so databases created then record it
+-- as applied without changes, and take every later version like a new database
 CREATE TABLE IF NOT EXISTS accounts (
   id CHAR(27) PRIMARY KEY,
   name VARCHAR(24) NOT NULL,
@@ -6,4 +8,4 @@ CREATE TABLE IF NOT EXISTS accounts (
   role TEXT NOT NULL DEFAULT 'user' CHECK (role IN ('user', 'admin')),
   token_version INT DEFAULT 1,
   is_active BOOLEAN DEFAULT TRUE
-);
\ No newline at end of file
+);
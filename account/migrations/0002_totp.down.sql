@@ -0,0 +1,3 @@
+ALTER TABLE accounts
+  DROP COLUMN totp_secret,
+  DROP COLUMN totp_enabled;
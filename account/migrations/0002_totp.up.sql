@@ -0,0 +1,3 @@
+ALTER TABLE accounts
+  ADD COLUMN totp_secret TEXT,                  -- encrypted by the auth service, never stored in plain text
+  ADD COLUMN totp_enabled BOOLEAN DEFAULT FALSE; -- false while an enrollment is waiting for confirmation
@@ -0,0 +1,4 @@
+-- Accounts from before verification existed never got a link, they are grandfathered as
+-- verified. New accounts start unverified until the link sent on signup is opened
+ALTER TABLE accounts ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE accounts ALTER COLUMN email_verified SET DEFAULT FALSE;
@@ -0,0 +1,8 @@
+-- fails while any account has a role other than user or admin
+ALTER TABLE accounts
+  DROP CONSTRAINT accounts_role_fkey,
+  ADD CONSTRAINT accounts_role_check CHECK (role IN ('user', 'admin'));
+
+DROP TABLE role_permissions;
+DROP TABLE permissions;
+DROP TABLE roles;
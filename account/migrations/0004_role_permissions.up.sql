@@ -0,0 +1,48 @@
+-- Roles are granted to accounts, permissions to roles. Tokens carry the permissions of the
+-- account's role, so changing a mapping takes effect the next time a token is issued or refreshed
+CREATE TABLE roles (
+  name TEXT PRIMARY KEY,
+  description TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE permissions (
+  name TEXT PRIMARY KEY,             -- resource:action[:scope], e.g. order:read:any
+  description TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE role_permissions (
+  role TEXT NOT NULL REFERENCES roles(name) ON DELETE CASCADE,
+  permission TEXT NOT NULL REFERENCES permissions(name) ON DELETE CASCADE,
+  PRIMARY KEY (role, permission)
+);
+
+INSERT INTO roles (name, description) VALUES
+  ('user', 'Customer account'),
+  ('admin', 'Store administrator');
+
+INSERT INTO permissions (name, description) VALUES
+  ('product:write', 'Create, delete and restock products'),
+  ('order:create', 'Place orders for the own account'),
+  ('order:create:any', 'Place orders for any account'),
+  ('order:read:own', 'List the orders of the own account'),
+  ('order:read:any', 'List the orders of any account'),
+  ('account:read:any', 'List and look up all accounts and logged in users'),
+  ('role:assign', 'Sign up accounts with a role other than user'),
+  ('account:deactivate', 'Deactivate and reactivate any account'),
+  ('account:delete:own', 'Delete the own account'),
+  ('account:delete:any', 'Delete any account'),
+  ('account:unlock', 'Lift a failed login lockout'),
+  ('session:revoke:any', 'Log out other users or everyone');
+
+INSERT INTO role_permissions (role, permission) VALUES
+  ('user', 'order:create'),
+  ('user', 'order:read:own'),
+  ('user', 'account:delete:own');
+
+INSERT INTO role_permissions (role, permission)
+  SELECT 'admin', name FROM permissions;
+
+-- the roles table replaces the fixed list of roles
+ALTER TABLE accounts
+  DROP CONSTRAINT accounts_role_check,
+  ADD CONSTRAINT accounts_role_fkey FOREIGN KEY (role) REFERENCES roles(name);
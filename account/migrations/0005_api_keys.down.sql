@@ -0,0 +1,2 @@
+-- role_permissions rows go with it through ON DELETE CASCADE
+DELETE FROM permissions WHERE name = 'apikey:manage';
@@ -0,0 +1,7 @@
+INSERT INTO permissions (name, description) VALUES
+  ('apikey:manage', 'Create, list, rotate and revoke API keys')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO role_permissions (role, permission) VALUES
+  ('admin', 'apikey:manage')
+ON CONFLICT DO NOTHING;
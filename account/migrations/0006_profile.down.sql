@@ -0,0 +1,5 @@
+DROP TABLE addresses;
+
+ALTER TABLE accounts
+  DROP COLUMN pending_email,
+  DROP COLUMN phone;
@@ -0,0 +1,26 @@
+ALTER TABLE accounts
+  ADD COLUMN pending_email VARCHAR(30), -- requested new email, swapped in once its link is opened
+  ADD COLUMN phone VARCHAR(20) NOT NULL DEFAULT '';
+
+-- Shipping addresses of an account, orders keep a copy so editing or deleting one later
+-- does not change past orders
+CREATE TABLE addresses (
+  id CHAR(27) PRIMARY KEY,
+  user_id CHAR(27) NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+  label VARCHAR(32) NOT NULL DEFAULT '',
+  recipient VARCHAR(64) NOT NULL,
+  line1 VARCHAR(128) NOT NULL,
+  line2 VARCHAR(128) NOT NULL DEFAULT '',
+  city VARCHAR(64) NOT NULL,
+  state VARCHAR(64) NOT NULL DEFAULT '',
+  postal_code VARCHAR(20) NOT NULL,
+  country CHAR(2) NOT NULL,
+  phone VARCHAR(20) NOT NULL DEFAULT '',
+  is_default BOOLEAN NOT NULL DEFAULT FALSE,
+  created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX addresses_user_id_idx ON addresses (user_id);
+-- at most one default address per account
+CREATE UNIQUE INDEX addresses_default_idx ON addresses (user_id) WHERE is_default;
@@ -0,0 +1,6 @@
+-- pg_trgm stays, other schemas may use it
+DROP INDEX accounts_email_trgm_idx;
+DROP INDEX accounts_name_trgm_idx;
+DROP INDEX accounts_role_created_at_idx;
+DROP INDEX accounts_created_at_idx;
+ALTER TABLE accounts DROP COLUMN created_at;
@@ -0,0 +1,10 @@
+-- Accounts from before get the time of the migration as their creation time
+ALTER TABLE accounts ADD COLUMN created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW();
+
+-- SearchAccounts pages through (created_at, id) newest first, optionally within one role.
+-- Partial name and email matches use trigram indexes
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+CREATE INDEX accounts_created_at_idx ON accounts (created_at DESC, id DESC);
+CREATE INDEX accounts_role_created_at_idx ON accounts (role, created_at DESC, id DESC);
+CREATE INDEX accounts_name_trgm_idx ON accounts USING GIN (name gin_trgm_ops);
+CREATE INDEX accounts_email_trgm_idx ON accounts USING GIN (email gin_trgm_ops);
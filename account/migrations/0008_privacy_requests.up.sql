@@ -0,0 +1,7 @@
+INSERT INTO permissions (name, description) VALUES
+  ('privacy:manage', 'Export, erase and review the privacy requests of any account')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO role_permissions (role, permission) VALUES
+  ('admin', 'privacy:manage')
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,6 @@
+DROP TABLE account_events;
+DROP FUNCTION account_events_append_only();
+
+UPDATE permissions
+  SET description = 'Sign up accounts with a role other than user'
+  WHERE name = 'role:assign';
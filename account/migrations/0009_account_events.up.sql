@@ -0,0 +1,29 @@
+UPDATE permissions
+  SET description = 'Sign up accounts with a role other than user and change the role of any account'
+  WHERE name = 'role:assign';
+
+-- Append-only history of account changes, written in the same transaction as the change.
+-- There is no foreign key so the history of a deleted account stays, and no personal data
+-- is copied into before/after so an erased account leaves nothing personal behind
+CREATE TABLE account_events (
+  id BIGSERIAL PRIMARY KEY,
+  account_id CHAR(27) NOT NULL,
+  action VARCHAR(32) NOT NULL,              -- created, deactivated, role_changed, deleted, ...
+  actor_id VARCHAR(64) NOT NULL DEFAULT '', -- user the change was made by, empty for anonymous flows
+  actor_service VARCHAR(32) NOT NULL DEFAULT '',
+  request_id VARCHAR(64) NOT NULL DEFAULT '', -- X-Request-ID of the gateway request
+  before JSONB,
+  after JSONB,
+  created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX account_events_account_id_idx ON account_events (account_id, id DESC);
+
+CREATE FUNCTION account_events_append_only() RETURNS trigger AS $$
+BEGIN
+  RAISE EXCEPTION 'account_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER account_events_append_only BEFORE UPDATE OR DELETE ON account_events
+  FOR EACH ROW EXECUTE FUNCTION account_events_append_only();
@@ -0,0 +1,4 @@
+-- fails while any account has an email longer than 30 characters
+ALTER TABLE accounts
+  ALTER COLUMN email TYPE VARCHAR(30),
+  ALTER COLUMN pending_email TYPE VARCHAR(30);
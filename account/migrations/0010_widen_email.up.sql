@@ -0,0 +1,4 @@
+-- 30 characters is too short for many real addresses, 254 is the most SMTP allows
+ALTER TABLE accounts
+  ALTER COLUMN email TYPE VARCHAR(254),
+  ALTER COLUMN pending_email TYPE VARCHAR(254);
@@ -0,0 +1,2 @@
+-- role_permissions rows go with them through ON DELETE CASCADE
+DELETE FROM permissions WHERE name IN ('account:import', 'account:export');
@@ -0,0 +1,10 @@
+-- permissions of the bulk account import and export, granted to admins
+INSERT INTO permissions (name, description) VALUES
+  ('account:import', 'Create accounts in bulk from a CSV or JSONL file'),
+  ('account:export', 'Download all accounts as a CSV or JSONL backup')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO role_permissions (role, permission) VALUES
+  ('admin', 'account:import'),
+  ('admin', 'account:export')
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,33 @@
+package account
+
+import "errors"
+
+// Actions that can be restricted for accounts that did not verify their email yet
+const (
+	ActionPlaceOrder = "place_order"
+)
+
+var ErrEmailNotVerified = errors.New("please verify your email address to do this")
+
+// UnverifiedPolicy lists what accounts may do before their email is verified, services
+// check it with the account they fetched from the account service
+type UnverifiedPolicy struct {
+	AllowedActions []string
+}
+
+// Check returns ErrEmailNotVerified if the account is unverified and the action is not allowed
+func (p UnverifiedPolicy) Check(acc *Account, action string) error {
+	if acc.EmailVerified {
+		return nil
+	}
+	for _, allowed := range p.AllowedActions {
+		if allowed == action {
+			return nil
+		}
+	}
+	return ErrEmailNotVerified
+}
+
+func (p UnverifiedPolicy) CheckPlaceOrder(acc *Account) error {
+	return p.Check(acc, ActionPlaceOrder)
+}
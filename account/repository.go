@@ -3,7 +3,10 @@ package account
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 
 	_ "github.com/lib/pq"
 	"github.com/zenvisjr/building-scalable-microservices/logger"
@@ -20,6 +23,8 @@ type Repository interface {
 	CreateAccount(ctx context.Context, acc Account) error
 	GetAccountByID(ctx context.Context, id string) (*Account, error)
 	ListAccounts(ctx context.Context, skip uint64, limit uint64) ([]Account, error)
+	SearchAccounts(ctx context.Context, filter AccountFilter, after *accountCursor, limit int) ([]Account, error)
+	CountAccounts(ctx context.Context, filter AccountFilter) (uint64, error)
 	GetEmailByName(ctx context.Context, name string) (string, error)
 	GetAccountForAuth(ctx context.Context, email string) (*Account, error)
 	IncrementTokenVersion(ctx context.Context, userID string) error
@@ -27,6 +32,22 @@ type Repository interface {
 	DeactivateAccount(ctx context.Context, userID string) error
 	ReactivateAccount(ctx context.Context, userID string) error
 	DeleteAccount(ctx context.Context, userID string) error
+	EraseAccount(ctx context.Context, userID string) error
+	GetTOTP(ctx context.Context, userID string) (string, bool, error)
+	UpdateTOTP(ctx context.Context, userID string, encryptedSecret string, enabled bool) error
+	MarkEmailVerified(ctx context.Context, userID string, email string) error
+	GetRolePermissions(ctx context.Context, role string) ([]string, error)
+	UpdateProfile(ctx context.Context, acc Account) error
+	ConfirmEmailChange(ctx context.Context, userID string, email string) error
+	ChangeRole(ctx context.Context, userID string, role string) error
+	ListAccountEvents(ctx context.Context, userID string, limit int) ([]AccountEvent, error)
+	CreateAddress(ctx context.Context, address Address) error
+	ListAddresses(ctx context.Context, userID string) ([]Address, error)
+	GetAddress(ctx context.Context, userID string, id string) (*Address, error)
+	GetDefaultAddress(ctx context.Context, userID string) (*Address, error)
+	UpdateAddress(ctx context.Context, address Address) error
+	DeleteAddress(ctx context.Context, userID string, id string) error
+	SetDefaultAddress(ctx context.Context, userID string, id string) error
 }
 
 type postgresRepository struct {
@@ -66,24 +87,30 @@ func (p *postgresRepository) CreateAccount(ctx context.Context, acc Account) err
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("Inserting new account into DB")
 
-	_, err := p.db.ExecContext(ctx,
-		"INSERT INTO accounts(id, name, email, password_hash, role, token_version) VALUES($1, $2, $3, $4, $5, $6)",
-		acc.ID, acc.Name, acc.Email, acc.PasswordHash, acc.Role, acc.TokenVersion)
-	if err != nil {
-		Logs.Error(ctx, "Failed to insert account: "+err.Error())
-		return err
-	}
+	return p.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx,
+			"INSERT INTO accounts(id, name, email, password_hash, role, token_version, created_at) VALUES($1, $2, $3, $4, $5, $6, $7)",
+			acc.ID, acc.Name, acc.Email, acc.PasswordHash, acc.Role, acc.TokenVersion, acc.CreatedAt)
+		if err != nil {
+			Logs.Error(ctx, "Failed to insert account: "+err.Error())
+			return err
+		}
+		after := map[string]interface{}{"role": acc.Role, "is_active": true, "email_verified": false}
+		if err := insertAccountEvent(ctx, tx, newAccountEvent(ctx, acc.ID, AccountEventCreated, nil, after)); err != nil {
+			return err
+		}
 
-	Logs.Info(ctx, "Inserted account with ID: "+acc.ID)
-	return nil
+		Logs.Info(ctx, "Inserted account with ID: "+acc.ID)
+		return nil
+	})
 }
 
 func (p *postgresRepository) GetAccountByID(ctx context.Context, id string) (*Account, error) {
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("Fetching account by ID: " + id)
-	row := p.db.QueryRowContext(ctx, "SELECT id, name, email, role, is_active FROM accounts WHERE id = $1", id)
+	row := p.db.QueryRowContext(ctx, "SELECT id, name, email, role, is_active, email_verified, COALESCE(pending_email, ''), phone, created_at FROM accounts WHERE id = $1", id)
 	a := &Account{}
-	err := row.Scan(&a.ID, &a.Name, &a.Email, &a.Role, &a.IsActive)
+	err := row.Scan(&a.ID, &a.Name, &a.Email, &a.Role, &a.IsActive, &a.EmailVerified, &a.PendingEmail, &a.Phone, &a.CreatedAt)
 	if err != nil {
 		Logs.Error(ctx, "Account fetch failed: "+err.Error())
 		return nil, err
@@ -96,7 +123,7 @@ func (p *postgresRepository) ListAccounts(ctx context.Context, skip uint64, limi
 	Logs := logger.GetGlobalLogger()
 	// Logs.LocalOnlyInfo("Listing accounts with limit and skip")
 
-	rows, err := p.db.QueryContext(ctx, "SELECT id, name, email, role, is_active FROM accounts ORDER BY id DESC LIMIT $1 OFFSET $2", limit, skip)
+	rows, err := p.db.QueryContext(ctx, "SELECT id, name, email, role, is_active, email_verified, COALESCE(pending_email, ''), phone, created_at FROM accounts ORDER BY id DESC LIMIT $1 OFFSET $2", limit, skip)
 	if err != nil {
 		Logs.Error(ctx, "Failed to list accounts: "+err.Error())
 		return nil, err
@@ -106,7 +133,7 @@ func (p *postgresRepository) ListAccounts(ctx context.Context, skip uint64, limi
 	accounts := []Account{}
 	for rows.Next() {
 		a := &Account{}
-		if err := rows.Scan(&a.ID, &a.Name, &a.Email, &a.Role, &a.IsActive); err != nil {
+		if err := rows.Scan(&a.ID, &a.Name, &a.Email, &a.Role, &a.IsActive, &a.EmailVerified, &a.PendingEmail, &a.Phone, &a.CreatedAt); err != nil {
 			Logs.Error(ctx, "Failed to scan account row: "+err.Error())
 			return nil, err
 		}
@@ -117,6 +144,99 @@ func (p *postgresRepository) ListAccounts(ctx context.Context, skip uint64, limi
 	return accounts, nil
 }
 
+// likePattern matches value anywhere in a column, wildcards typed by the user match literally
+func likePattern(value string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+	return "%" + escaped + "%"
+}
+
+// accountFilterClause builds the WHERE clause of SearchAccounts and CountAccounts
+func accountFilterClause(filter AccountFilter) ([]string, []interface{}) {
+	conditions := []string{}
+	args := []interface{}{}
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.ID != "" {
+		add("id = $%d", filter.ID)
+	}
+	if filter.Name != "" {
+		add(`name ILIKE $%d ESCAPE '\'`, likePattern(filter.Name))
+	}
+	if filter.Email != "" {
+		add(`email ILIKE $%d ESCAPE '\'`, likePattern(filter.Email))
+	}
+	if filter.Role != "" {
+		add("role = $%d", filter.Role)
+	}
+	if filter.IsActive != nil {
+		add("COALESCE(is_active, TRUE) = $%d", *filter.IsActive)
+	}
+	if !filter.CreatedAfter.IsZero() {
+		add("created_at >= $%d", filter.CreatedAfter)
+	}
+	if !filter.CreatedBefore.IsZero() {
+		add("created_at < $%d", filter.CreatedBefore)
+	}
+	return conditions, args
+}
+
+func whereClause(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conditions, " AND ")
+}
+
+// SearchAccounts returns up to limit accounts matching the filter, newest first, starting
+// after the cursor. The (created_at, id) comparison is served by the created_at indexes
+func (p *postgresRepository) SearchAccounts(ctx context.Context, filter AccountFilter, after *accountCursor, limit int) ([]Account, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Searching accounts in DB")
+
+	conditions, args := accountFilterClause(filter)
+	if after != nil {
+		args = append(args, after.CreatedAt, after.ID)
+		conditions = append(conditions, fmt.Sprintf("(created_at, id) < ($%d, $%d)", len(args)-1, len(args)))
+	}
+	args = append(args, limit)
+	query := "SELECT id, name, email, role, COALESCE(is_active, TRUE), email_verified, COALESCE(pending_email, ''), phone, created_at FROM accounts" +
+		whereClause(conditions) + fmt.Sprintf(" ORDER BY created_at DESC, id DESC LIMIT $%d", len(args))
+
+	rows, err := p.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		Logs.Error(ctx, "Failed to search accounts: "+err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []Account{}
+	for rows.Next() {
+		a := Account{}
+		if err := rows.Scan(&a.ID, &a.Name, &a.Email, &a.Role, &a.IsActive, &a.EmailVerified, &a.PendingEmail, &a.Phone, &a.CreatedAt); err != nil {
+			Logs.Error(ctx, "Failed to scan account row: "+err.Error())
+			return nil, err
+		}
+		accounts = append(accounts, a)
+	}
+	return accounts, rows.Err()
+}
+
+func (p *postgresRepository) CountAccounts(ctx context.Context, filter AccountFilter) (uint64, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Counting accounts in DB")
+
+	conditions, args := accountFilterClause(filter)
+	var count uint64
+	if err := p.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM accounts"+whereClause(conditions), args...).Scan(&count); err != nil {
+		Logs.Error(ctx, "Failed to count accounts: "+err.Error())
+		return 0, err
+	}
+	return count, nil
+}
+
 // used by email service
 func (p *postgresRepository) GetEmailByName(ctx context.Context, name string) (string, error) {
 	Logs := logger.GetGlobalLogger()
@@ -138,9 +258,9 @@ func (p *postgresRepository) GetEmailByName(ctx context.Context, name string) (s
 func (p *postgresRepository) GetAccountForAuth(ctx context.Context, email string) (*Account, error) {
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("Fetching account for auth with email: " + email)
-	row := p.db.QueryRowContext(ctx, "SELECT id, name, email, password_hash, role, token_version, is_active FROM accounts WHERE email = $1", email)
+	row := p.db.QueryRowContext(ctx, "SELECT id, name, email, password_hash, role, token_version, is_active, COALESCE(totp_enabled, false), email_verified FROM accounts WHERE email = $1", email)
 	a := &Account{}
-	err := row.Scan(&a.ID, &a.Name, &a.Email, &a.PasswordHash, &a.Role, &a.TokenVersion, &a.IsActive)
+	err := row.Scan(&a.ID, &a.Name, &a.Email, &a.PasswordHash, &a.Role, &a.TokenVersion, &a.IsActive, &a.TOTPEnabled, &a.EmailVerified)
 	if err != nil {
 		Logs.Error(ctx, "Account fetch failed: "+err.Error())
 		return nil, err
@@ -154,54 +274,601 @@ func (p *postgresRepository) GetAccountForAuth(ctx context.Context, email string
 	return a, nil
 }
 
+// IncrementTokenVersion, DeactivateAccount, ReactivateAccount and DeleteAccount leave an unknown
+// account alone without an error, logging everyone out may still list users deleted since
 func (r *postgresRepository) IncrementTokenVersion(ctx context.Context, userID string) error {
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("Incrementing token version in DB")
-	query := `UPDATE accounts SET token_version = token_version + 1 WHERE id = $1`
-	_, err := r.db.ExecContext(ctx, query, userID)
-	return err
+
+	return r.inTx(ctx, func(tx *sql.Tx) error {
+		state, err := lockAccountState(ctx, tx, userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		query := `UPDATE accounts SET token_version = token_version + 1 WHERE id = $1`
+		if _, err := tx.ExecContext(ctx, query, userID); err != nil {
+			return err
+		}
+		before := map[string]interface{}{"token_version": state.TokenVersion}
+		after := map[string]interface{}{"token_version": state.TokenVersion + 1}
+		return insertAccountEvent(ctx, tx, newAccountEvent(ctx, userID, AccountEventTokensRevoked, before, after))
+	})
 }
 
 func (p *postgresRepository) UpdatePassword(ctx context.Context, email string, password_hash string) error {
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("Updating password for email in DB: " + email)
 
-	query := `UPDATE accounts SET password_hash = $1 WHERE email = $2`
-	res, err := p.db.ExecContext(ctx, query, password_hash, email)
-	count, _ := res.RowsAffected()
-	Logs.LocalOnlyInfo(fmt.Sprintf("Password update affected %d row(s)", count))
-
-	if err != nil {
-		Logs.Error(ctx, "Password update failed: "+err.Error())
-		return err
-	}
-
-	return nil
+	return p.inTx(ctx, func(tx *sql.Tx) error {
+		var userID string
+		query := `UPDATE accounts SET password_hash = $1 WHERE email = $2 RETURNING id`
+		err := tx.QueryRowContext(ctx, query, password_hash, email).Scan(&userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			Logs.LocalOnlyInfo("Password update affected 0 row(s)")
+			return err
+		}
+		if err != nil {
+			Logs.Error(ctx, "Password update failed: "+err.Error())
+			return err
+		}
+		// the hash itself is never recorded
+		return insertAccountEvent(ctx, tx, newAccountEvent(ctx, userID, AccountEventPasswordChanged, nil, nil))
+	})
 }
 
 func (p *postgresRepository) DeactivateAccount(ctx context.Context, userID string) error {
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("Deactivating account for user: " + userID)
 
-	query := `UPDATE accounts SET is_active = false WHERE id = $1`
-	_, err := p.db.ExecContext(ctx, query, userID)
-	return err
+	return p.setActive(ctx, userID, false)
 }
 
 func (p *postgresRepository) ReactivateAccount(ctx context.Context, userID string) error {
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("Reactivating account for user: " + userID)
 
-	query := `UPDATE accounts SET is_active = true WHERE id = $1`
-	_, err := p.db.ExecContext(ctx, query, userID)
-	return err
+	return p.setActive(ctx, userID, true)
 }
 
+// setActive records a deactivation or reactivation only when it changes the account
+func (p *postgresRepository) setActive(ctx context.Context, userID string, active bool) error {
+	return p.inTx(ctx, func(tx *sql.Tx) error {
+		state, err := lockAccountState(ctx, tx, userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if state.IsActive == active {
+			return nil
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE accounts SET is_active = $2 WHERE id = $1`, userID, active); err != nil {
+			return err
+		}
+		action := AccountEventDeactivated
+		if active {
+			action = AccountEventReactivated
+		}
+		before := map[string]interface{}{"is_active": state.IsActive}
+		after := map[string]interface{}{"is_active": active}
+		return insertAccountEvent(ctx, tx, newAccountEvent(ctx, userID, action, before, after))
+	})
+}
+
+// DeleteAccount removes the account, its history stays
 func (p *postgresRepository) DeleteAccount(ctx context.Context, userID string) error {
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("Deleting account for user: " + userID)
 
-	query := `DELETE FROM accounts WHERE id = $1`
-	_, err := p.db.ExecContext(ctx, query, userID)
+	return p.inTx(ctx, func(tx *sql.Tx) error {
+		state, err := lockAccountState(ctx, tx, userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM accounts WHERE id = $1`, userID); err != nil {
+			return err
+		}
+		before := map[string]interface{}{"role": state.Role, "is_active": state.IsActive}
+		return insertAccountEvent(ctx, tx, newAccountEvent(ctx, userID, AccountEventDeleted, before, nil))
+	})
+}
+
+// ChangeRole returns sql.ErrNoRows for an unknown account and errUnknownRole for an unknown role.
+// The token version is bumped since issued tokens carry the permissions of the old role
+func (p *postgresRepository) ChangeRole(ctx context.Context, userID string, role string) error {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Changing role of user: " + userID + " to " + role)
+
+	return p.inTx(ctx, func(tx *sql.Tx) error {
+		state, err := lockAccountState(ctx, tx, userID)
+		if err != nil {
+			return err
+		}
+		if state.Role == role {
+			return nil
+		}
+		var known bool
+		if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM roles WHERE name = $1)`, role).Scan(&known); err != nil {
+			return err
+		}
+		if !known {
+			return errUnknownRole
+		}
+		query := `UPDATE accounts SET role = $2, token_version = token_version + 1 WHERE id = $1`
+		if _, err := tx.ExecContext(ctx, query, userID, role); err != nil {
+			Logs.Error(ctx, "Role change failed: "+err.Error())
+			return err
+		}
+		before := map[string]interface{}{"role": state.Role, "token_version": state.TokenVersion}
+		after := map[string]interface{}{"role": role, "token_version": state.TokenVersion + 1}
+		return insertAccountEvent(ctx, tx, newAccountEvent(ctx, userID, AccountEventRoleChanged, before, after))
+	})
+}
+
+// EraseAccount overwrites the personal data of the account and deletes its addresses. The row
+// stays so orders and audit records keep pointing to an account, its email becomes the ID which
+// keeps it unique and no password matches the empty hash
+func (p *postgresRepository) EraseAccount(ctx context.Context, userID string) error {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Erasing account for user: " + userID)
+
+	return p.inTx(ctx, func(tx *sql.Tx) error {
+		state, err := lockAccountState(ctx, tx, userID)
+		if err != nil {
+			return err
+		}
+		query := `UPDATE accounts SET name = $2, email = id, password_hash = '', pending_email = NULL, phone = '',
+			totp_secret = NULL, totp_enabled = FALSE, email_verified = FALSE, is_active = FALSE,
+			token_version = token_version + 1 WHERE id = $1`
+		if _, err := tx.ExecContext(ctx, query, userID, erasedAccountName); err != nil {
+			Logs.Error(ctx, "Account erase failed: "+err.Error())
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM addresses WHERE user_id = $1`, userID); err != nil {
+			Logs.Error(ctx, "Address delete failed: "+err.Error())
+			return err
+		}
+		before := map[string]interface{}{"is_active": state.IsActive, "token_version": state.TokenVersion}
+		after := map[string]interface{}{"is_active": false, "token_version": state.TokenVersion + 1}
+		return insertAccountEvent(ctx, tx, newAccountEvent(ctx, userID, AccountEventErased, before, after))
+	})
+}
+
+// used by auth service, the secret is stored exactly as auth encrypted it
+func (p *postgresRepository) GetTOTP(ctx context.Context, userID string) (string, bool, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Fetching TOTP secret for user: " + userID)
+
+	var secret sql.NullString
+	var enabled sql.NullBool
+	row := p.db.QueryRowContext(ctx, "SELECT totp_secret, totp_enabled FROM accounts WHERE id = $1", userID)
+	if err := row.Scan(&secret, &enabled); err != nil {
+		Logs.Error(ctx, "TOTP fetch failed: "+err.Error())
+		return "", false, err
+	}
+	return secret.String, enabled.Bool, nil
+}
+
+func (p *postgresRepository) UpdateTOTP(ctx context.Context, userID string, encryptedSecret string, enabled bool) error {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Updating TOTP for user: " + userID)
+
+	return p.inTx(ctx, func(tx *sql.Tx) error {
+		state, err := lockAccountState(ctx, tx, userID)
+		if err != nil {
+			return err
+		}
+		query := `UPDATE accounts SET totp_secret = NULLIF($1, ''), totp_enabled = $2 WHERE id = $3`
+		if _, err := tx.ExecContext(ctx, query, encryptedSecret, enabled, userID); err != nil {
+			Logs.Error(ctx, "TOTP update failed: "+err.Error())
+			return err
+		}
+		// a new enrollment only changes the secret, the history records when 2FA is turned on or off
+		if state.TOTPEnabled == enabled {
+			return nil
+		}
+		action := AccountEventTwoFactorDisabled
+		if enabled {
+			action = AccountEventTwoFactorEnabled
+		}
+		before := map[string]interface{}{"totp_enabled": state.TOTPEnabled}
+		after := map[string]interface{}{"totp_enabled": enabled}
+		return insertAccountEvent(ctx, tx, newAccountEvent(ctx, userID, action, before, after))
+	})
+}
+
+// MarkEmailVerified only succeeds while the account still has the email the link was sent to
+func (p *postgresRepository) MarkEmailVerified(ctx context.Context, userID string, email string) error {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Marking email verified for user: " + userID)
+
+	return p.inTx(ctx, func(tx *sql.Tx) error {
+		var verified bool
+		query := `SELECT email_verified FROM accounts WHERE id = $1 AND email = $2 FOR UPDATE`
+		if err := tx.QueryRowContext(ctx, query, userID, email).Scan(&verified); err != nil {
+			return err
+		}
+		if verified {
+			return nil
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE accounts SET email_verified = TRUE WHERE id = $1`, userID); err != nil {
+			Logs.Error(ctx, "Mark email verified failed: "+err.Error())
+			return err
+		}
+		before := map[string]interface{}{"email_verified": false}
+		after := map[string]interface{}{"email_verified": true}
+		return insertAccountEvent(ctx, tx, newAccountEvent(ctx, userID, AccountEventEmailVerified, before, after))
+	})
+}
+
+// GetRolePermissions returns the permissions granted to role, none for an unknown role
+func (p *postgresRepository) GetRolePermissions(ctx context.Context, role string) ([]string, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Fetching permissions for role: " + role)
+
+	rows, err := p.db.QueryContext(ctx, "SELECT permission FROM role_permissions WHERE role = $1 ORDER BY permission", role)
+	if err != nil {
+		Logs.Error(ctx, "Role permissions fetch failed: "+err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := []string{}
+	for rows.Next() {
+		var permission string
+		if err := rows.Scan(&permission); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	return permissions, rows.Err()
+}
+
+// UpdateProfile records which fields changed but not their values, they are personal data
+func (p *postgresRepository) UpdateProfile(ctx context.Context, acc Account) error {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Updating profile for user: " + acc.ID)
+
+	return p.inTx(ctx, func(tx *sql.Tx) error {
+		var name, phone, pendingEmail string
+		query := `SELECT name, phone, COALESCE(pending_email, '') FROM accounts WHERE id = $1 FOR UPDATE`
+		if err := tx.QueryRowContext(ctx, query, acc.ID).Scan(&name, &phone, &pendingEmail); err != nil {
+			return err
+		}
+		query = `UPDATE accounts SET name = $1, phone = $2, pending_email = NULLIF($3, '') WHERE id = $4`
+		if _, err := tx.ExecContext(ctx, query, acc.Name, acc.Phone, acc.PendingEmail, acc.ID); err != nil {
+			Logs.Error(ctx, "Profile update failed: "+err.Error())
+			return err
+		}
+
+		changed := []string{}
+		if name != acc.Name {
+			changed = append(changed, "name")
+		}
+		if phone != acc.Phone {
+			changed = append(changed, "phone")
+		}
+		if pendingEmail != acc.PendingEmail {
+			changed = append(changed, "pending_email")
+		}
+		if len(changed) == 0 {
+			return nil
+		}
+		after := map[string]interface{}{"changed": changed}
+		return insertAccountEvent(ctx, tx, newAccountEvent(ctx, acc.ID, AccountEventProfileUpdated, nil, after))
+	})
+}
+
+// ConfirmEmailChange swaps in the pending email the link was sent to. The token version is
+// bumped since issued tokens carry the old email, the unique constraint on email fails the
+// swap if another account took the address in the meantime
+func (p *postgresRepository) ConfirmEmailChange(ctx context.Context, userID string, email string) error {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Confirming email change for user: " + userID)
+
+	return p.inTx(ctx, func(tx *sql.Tx) error {
+		var verified bool
+		var tokenVersion int32
+		query := `SELECT email_verified, COALESCE(token_version, 1) FROM accounts WHERE id = $1 AND pending_email = $2 FOR UPDATE`
+		if err := tx.QueryRowContext(ctx, query, userID, email).Scan(&verified, &tokenVersion); err != nil {
+			return err
+		}
+		query = `UPDATE accounts SET email = pending_email, pending_email = NULL, email_verified = TRUE,
+			token_version = token_version + 1 WHERE id = $1`
+		if _, err := tx.ExecContext(ctx, query, userID); err != nil {
+			Logs.Error(ctx, "Email change failed: "+err.Error())
+			return err
+		}
+		before := map[string]interface{}{"email_verified": verified, "token_version": tokenVersion}
+		after := map[string]interface{}{"email_verified": true, "token_version": tokenVersion + 1}
+		return insertAccountEvent(ctx, tx, newAccountEvent(ctx, userID, AccountEventEmailChanged, before, after))
+	})
+}
+
+// inTx runs fn in a transaction, committed when fn returns nil and rolled back otherwise
+func (p *postgresRepository) inTx(ctx context.Context, fn func(tx *sql.Tx) error) (err error) {
+	Logs := logger.GetGlobalLogger()
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		Logs.Error(ctx, "Failed to begin transaction: "+err.Error())
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+	return fn(tx)
+}
+
+// lockAccountState reads the fields the history records and locks the row until the
+// transaction ends, so the before values are the ones the change replaced
+func lockAccountState(ctx context.Context, tx *sql.Tx, userID string) (*accountState, error) {
+	state := &accountState{}
+	query := `SELECT role, COALESCE(is_active, TRUE), email_verified, COALESCE(totp_enabled, FALSE), COALESCE(token_version, 1)
+		FROM accounts WHERE id = $1 FOR UPDATE`
+	err := tx.QueryRowContext(ctx, query, userID).Scan(&state.Role, &state.IsActive, &state.EmailVerified, &state.TOTPEnabled, &state.TokenVersion)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// insertAccountEvent appends to the history in the transaction of the change it records, so
+// there is no change without its event and no event without its change
+func insertAccountEvent(ctx context.Context, tx *sql.Tx, event AccountEvent) error {
+	Logs := logger.GetGlobalLogger()
+
+	before, err := eventFieldsJSON(event.Before)
+	if err != nil {
+		return err
+	}
+	after, err := eventFieldsJSON(event.After)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO account_events(account_id, action, actor_id, actor_service, request_id, before, after, created_at)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8)`,
+		event.AccountID, event.Action, event.ActorID, event.ActorService, event.RequestID, before, after, event.CreatedAt)
+	if err != nil {
+		Logs.Error(ctx, "Failed to record account event: "+err.Error())
+		return err
+	}
+	return nil
+}
+
+// eventFieldsJSON stores no fields as NULL rather than an empty object
+func eventFieldsJSON(fields map[string]interface{}) (interface{}, error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	raw, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	return string(raw), nil
+}
+
+// ListAccountEvents returns the newest events of the account first
+func (p *postgresRepository) ListAccountEvents(ctx context.Context, userID string, limit int) ([]AccountEvent, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Listing account events for user: " + userID)
+
+	rows, err := p.db.QueryContext(ctx,
+		`SELECT id, account_id, action, actor_id, actor_service, request_id, before, after, created_at
+		FROM account_events WHERE account_id = $1 ORDER BY id DESC LIMIT $2`, userID, limit)
+	if err != nil {
+		Logs.Error(ctx, "Account events query failed: "+err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []AccountEvent{}
+	for rows.Next() {
+		var e AccountEvent
+		var before, after []byte
+		if err := rows.Scan(&e.ID, &e.AccountID, &e.Action, &e.ActorID, &e.ActorService, &e.RequestID, &before, &after, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if len(before) > 0 {
+			if err := json.Unmarshal(before, &e.Before); err != nil {
+				return nil, err
+			}
+		}
+		if len(after) > 0 {
+			if err := json.Unmarshal(after, &e.After); err != nil {
+				return nil, err
+			}
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+const addressColumns = "id, user_id, label, recipient, line1, line2, city, state, postal_code, country, phone, is_default, created_at, updated_at"
+
+func scanAddress(row interface{ Scan(...interface{}) error }) (*Address, error) {
+	a := &Address{}
+	err := row.Scan(&a.ID, &a.UserID, &a.Label, &a.Recipient, &a.Line1, &a.Line2, &a.City, &a.State, &a.PostalCode, &a.Country, &a.Phone, &a.IsDefault, &a.CreatedAt, &a.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// clearDefaultAddress runs in the transaction making another address the default, the partial
+// unique index on user_id allows only one
+func clearDefaultAddress(ctx context.Context, tx *sql.Tx, userID string) error {
+	_, err := tx.ExecContext(ctx, `UPDATE addresses SET is_default = FALSE WHERE user_id = $1 AND is_default`, userID)
 	return err
-}
\ No newline at end of file
+}
+
+func (p *postgresRepository) CreateAddress(ctx context.Context, address Address) (err error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Inserting address for user: " + address.UserID)
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		Logs.Error(ctx, "Failed to begin transaction: "+err.Error())
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	if address.IsDefault {
+		if err = clearDefaultAddress(ctx, tx, address.UserID); err != nil {
+			Logs.Error(ctx, "Failed to clear default address: "+err.Error())
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO addresses("+addressColumns+") VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)",
+		address.ID, address.UserID, address.Label, address.Recipient, address.Line1, address.Line2, address.City,
+		address.State, address.PostalCode, address.Country, address.Phone, address.IsDefault, address.CreatedAt, address.UpdatedAt)
+	if err != nil {
+		Logs.Error(ctx, "Failed to insert address: "+err.Error())
+		return err
+	}
+	return nil
+}
+
+// ListAddresses returns the default address first, then the others from newest to oldest
+func (p *postgresRepository) ListAddresses(ctx context.Context, userID string) ([]Address, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Listing addresses for user: " + userID)
+
+	rows, err := p.db.QueryContext(ctx, "SELECT "+addressColumns+" FROM addresses WHERE user_id = $1 ORDER BY is_default DESC, created_at DESC", userID)
+	if err != nil {
+		Logs.Error(ctx, "Failed to list addresses: "+err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	addresses := []Address{}
+	for rows.Next() {
+		a, err := scanAddress(rows)
+		if err != nil {
+			Logs.Error(ctx, "Failed to scan address row: "+err.Error())
+			return nil, err
+		}
+		addresses = append(addresses, *a)
+	}
+	return addresses, rows.Err()
+}
+
+func (p *postgresRepository) GetAddress(ctx context.Context, userID string, id string) (*Address, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Fetching address " + id + " for user: " + userID)
+
+	return scanAddress(p.db.QueryRowContext(ctx, "SELECT "+addressColumns+" FROM addresses WHERE id = $1 AND user_id = $2", id, userID))
+}
+
+func (p *postgresRepository) GetDefaultAddress(ctx context.Context, userID string) (*Address, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Fetching default address for user: " + userID)
+
+	return scanAddress(p.db.QueryRowContext(ctx, "SELECT "+addressColumns+" FROM addresses WHERE user_id = $1 AND is_default", userID))
+}
+
+func (p *postgresRepository) UpdateAddress(ctx context.Context, address Address) (err error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Updating address " + address.ID + " for user: " + address.UserID)
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		Logs.Error(ctx, "Failed to begin transaction: "+err.Error())
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	if address.IsDefault {
+		if err = clearDefaultAddress(ctx, tx, address.UserID); err != nil {
+			Logs.Error(ctx, "Failed to clear default address: "+err.Error())
+			return err
+		}
+	}
+	query := `UPDATE addresses SET label = $1, recipient = $2, line1 = $3, line2 = $4, city = $5, state = $6,
+		postal_code = $7, country = $8, phone = $9, is_default = is_default OR $10, updated_at = $11
+		WHERE id = $12 AND user_id = $13`
+	res, err := tx.ExecContext(ctx, query, address.Label, address.Recipient, address.Line1, address.Line2, address.City,
+		address.State, address.PostalCode, address.Country, address.Phone, address.IsDefault, address.UpdatedAt, address.ID, address.UserID)
+	if err != nil {
+		Logs.Error(ctx, "Address update failed: "+err.Error())
+		return err
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		err = sql.ErrNoRows
+		return err
+	}
+	return nil
+}
+
+func (p *postgresRepository) DeleteAddress(ctx context.Context, userID string, id string) error {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Deleting address " + id + " for user: " + userID)
+
+	res, err := p.db.ExecContext(ctx, `DELETE FROM addresses WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		Logs.Error(ctx, "Address delete failed: "+err.Error())
+		return err
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (p *postgresRepository) SetDefaultAddress(ctx context.Context, userID string, id string) (err error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Setting default address " + id + " for user: " + userID)
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		Logs.Error(ctx, "Failed to begin transaction: "+err.Error())
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	if err = clearDefaultAddress(ctx, tx, userID); err != nil {
+		Logs.Error(ctx, "Failed to clear default address: "+err.Error())
+		return err
+	}
+	res, err := tx.ExecContext(ctx, `UPDATE addresses SET is_default = TRUE, updated_at = NOW() WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		Logs.Error(ctx, "Set default address failed: "+err.Error())
+		return err
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		err = sql.ErrNoRows
+		return err
+	}
+	return nil
+}
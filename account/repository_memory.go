@@ -0,0 +1,600 @@
+package account
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errDuplicateID stands in for the primary key constraints of the accounts and addresses tables,
+// errEmailTaken for the unique constraint on email
+var errDuplicateID = errors.New("a row with this ID already exists")
+
+// memoryRolePermissions are the roles and grants the migrations seed
+var memoryRolePermissions = map[string][]string{
+	"user": {"account:delete:own", "order:create", "order:read:own"},
+	"admin": {
+		"account:deactivate", "account:delete:any", "account:delete:own", "account:export", "account:import",
+		"account:read:any", "account:unlock", "apikey:manage", "order:create", "order:create:any",
+		"order:read:any", "order:read:own", "privacy:manage", "product:write", "role:assign", "session:revoke:any",
+	},
+}
+
+// inMemoryRepository keeps accounts in process memory, for tests and local runs. It behaves
+// like the postgres repository, down to which columns each query returns
+type inMemoryRepository struct {
+	mu          sync.RWMutex
+	accounts    map[string]*Account
+	addresses   map[string]*Address
+	events      []AccountEvent
+	lastEventID int64
+}
+
+func NewInMemoryRepository() Repository {
+	return &inMemoryRepository{
+		accounts:  make(map[string]*Account),
+		addresses: make(map[string]*Address),
+	}
+}
+
+func (r *inMemoryRepository) Close() {}
+
+// publicColumns returns the columns GetAccountByID, ListAccounts and SearchAccounts select
+func publicColumns(a *Account) Account {
+	return Account{
+		ID:            a.ID,
+		Name:          a.Name,
+		Email:         a.Email,
+		Role:          a.Role,
+		IsActive:      a.IsActive,
+		EmailVerified: a.EmailVerified,
+		PendingEmail:  a.PendingEmail,
+		Phone:         a.Phone,
+		CreatedAt:     a.CreatedAt,
+	}
+}
+
+func (r *inMemoryRepository) findByEmail(email string) *Account {
+	for _, acc := range r.accounts {
+		if acc.Email == email {
+			return acc
+		}
+	}
+	return nil
+}
+
+// record appends to the history, before and after come back the way the JSONB columns
+// return them
+func (r *inMemoryRepository) record(ctx context.Context, accountID string, action string, before, after map[string]interface{}) error {
+	event := newAccountEvent(ctx, accountID, action, nil, nil)
+	for _, fields := range []struct {
+		in  map[string]interface{}
+		out *map[string]interface{}
+	}{{before, &event.Before}, {after, &event.After}} {
+		raw, err := eventFieldsJSON(fields.in)
+		if err != nil {
+			return err
+		}
+		if raw == nil {
+			continue
+		}
+		if err := json.Unmarshal([]byte(raw.(string)), fields.out); err != nil {
+			return err
+		}
+	}
+	r.lastEventID++
+	event.ID = r.lastEventID
+	r.events = append(r.events, event)
+	return nil
+}
+
+func (r *inMemoryRepository) CreateAccount(ctx context.Context, acc Account) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := memoryRolePermissions[acc.Role]; !ok {
+		return errUnknownRole
+	}
+	if _, ok := r.accounts[acc.ID]; ok {
+		return errDuplicateID
+	}
+	if r.findByEmail(acc.Email) != nil {
+		return errEmailTaken
+	}
+	stored := Account{
+		ID:           acc.ID,
+		Name:         acc.Name,
+		Email:        acc.Email,
+		PasswordHash: acc.PasswordHash,
+		Role:         acc.Role,
+		TokenVersion: acc.TokenVersion,
+		IsActive:     true,
+		CreatedAt:    acc.CreatedAt,
+	}
+	r.accounts[acc.ID] = &stored
+	return r.record(ctx, acc.ID, AccountEventCreated, nil, map[string]interface{}{"role": acc.Role, "is_active": true, "email_verified": false})
+}
+
+func (r *inMemoryRepository) GetAccountByID(ctx context.Context, id string) (*Account, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	acc, ok := r.accounts[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	public := publicColumns(acc)
+	return &public, nil
+}
+
+func (r *inMemoryRepository) ListAccounts(ctx context.Context, skip uint64, limit uint64) ([]Account, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	all := make([]Account, 0, len(r.accounts))
+	for _, acc := range r.accounts {
+		all = append(all, publicColumns(acc))
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].ID > all[j].ID })
+	return pageAccounts(all, skip, limit), nil
+}
+
+func pageAccounts(accounts []Account, skip uint64, limit uint64) []Account {
+	if skip >= uint64(len(accounts)) {
+		return []Account{}
+	}
+	accounts = accounts[skip:]
+	if limit < uint64(len(accounts)) {
+		accounts = accounts[:limit]
+	}
+	return accounts
+}
+
+// matches applies the filter the way accountFilterClause does in SQL
+func (f AccountFilter) matches(acc *Account) bool {
+	switch {
+	case f.ID != "" && acc.ID != f.ID:
+		return false
+	case f.Name != "" && !strings.Contains(strings.ToLower(acc.Name), strings.ToLower(f.Name)):
+		return false
+	case f.Email != "" && !strings.Contains(strings.ToLower(acc.Email), strings.ToLower(f.Email)):
+		return false
+	case f.Role != "" && acc.Role != f.Role:
+		return false
+	case f.IsActive != nil && acc.IsActive != *f.IsActive:
+		return false
+	case !f.CreatedAfter.IsZero() && acc.CreatedAt.Before(f.CreatedAfter):
+		return false
+	case !f.CreatedBefore.IsZero() && !acc.CreatedAt.Before(f.CreatedBefore):
+		return false
+	}
+	return true
+}
+
+// newerThan is the (created_at, id) DESC order of SearchAccounts
+func newerThan(a, b Account) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.After(b.CreatedAt)
+	}
+	return a.ID > b.ID
+}
+
+func (r *inMemoryRepository) SearchAccounts(ctx context.Context, filter AccountFilter, after *accountCursor, limit int) ([]Account, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	accounts := []Account{}
+	for _, acc := range r.accounts {
+		if !filter.matches(acc) {
+			continue
+		}
+		if after != nil && !newerThan(Account{CreatedAt: after.CreatedAt, ID: after.ID}, *acc) {
+			continue
+		}
+		accounts = append(accounts, publicColumns(acc))
+	}
+	sort.Slice(accounts, func(i, j int) bool { return newerThan(accounts[i], accounts[j]) })
+	if limit < len(accounts) {
+		accounts = accounts[:limit]
+	}
+	return accounts, nil
+}
+
+func (r *inMemoryRepository) CountAccounts(ctx context.Context, filter AccountFilter) (uint64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var count uint64
+	for _, acc := range r.accounts {
+		if filter.matches(acc) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (r *inMemoryRepository) GetEmailByName(ctx context.Context, name string) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, acc := range r.accounts {
+		if acc.Name == name {
+			return acc.Email, nil
+		}
+	}
+	return "", sql.ErrNoRows
+}
+
+func (r *inMemoryRepository) GetAccountForAuth(ctx context.Context, email string) (*Account, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	acc := r.findByEmail(email)
+	if acc == nil {
+		return nil, sql.ErrNoRows
+	}
+	return &Account{
+		ID:            acc.ID,
+		Name:          acc.Name,
+		Email:         acc.Email,
+		PasswordHash:  acc.PasswordHash,
+		Role:          acc.Role,
+		TokenVersion:  acc.TokenVersion,
+		IsActive:      acc.IsActive,
+		TOTPEnabled:   acc.TOTPEnabled,
+		EmailVerified: acc.EmailVerified,
+	}, nil
+}
+
+func (r *inMemoryRepository) IncrementTokenVersion(ctx context.Context, userID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	acc, ok := r.accounts[userID]
+	if !ok {
+		return nil
+	}
+	acc.TokenVersion++
+	return r.record(ctx, userID, AccountEventTokensRevoked,
+		map[string]interface{}{"token_version": acc.TokenVersion - 1}, map[string]interface{}{"token_version": acc.TokenVersion})
+}
+
+func (r *inMemoryRepository) UpdatePassword(ctx context.Context, email string, password_hash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	acc := r.findByEmail(email)
+	if acc == nil {
+		return sql.ErrNoRows
+	}
+	acc.PasswordHash = password_hash
+	return r.record(ctx, acc.ID, AccountEventPasswordChanged, nil, nil)
+}
+
+func (r *inMemoryRepository) DeactivateAccount(ctx context.Context, userID string) error {
+	return r.setActive(ctx, userID, false)
+}
+
+func (r *inMemoryRepository) ReactivateAccount(ctx context.Context, userID string) error {
+	return r.setActive(ctx, userID, true)
+}
+
+func (r *inMemoryRepository) setActive(ctx context.Context, userID string, active bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	acc, ok := r.accounts[userID]
+	if !ok || acc.IsActive == active {
+		return nil
+	}
+	acc.IsActive = active
+	action := AccountEventDeactivated
+	if active {
+		action = AccountEventReactivated
+	}
+	return r.record(ctx, userID, action, map[string]interface{}{"is_active": !active}, map[string]interface{}{"is_active": active})
+}
+
+func (r *inMemoryRepository) DeleteAccount(ctx context.Context, userID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	acc, ok := r.accounts[userID]
+	if !ok {
+		return nil
+	}
+	delete(r.accounts, userID)
+	r.deleteAddressesOf(userID)
+	return r.record(ctx, userID, AccountEventDeleted, map[string]interface{}{"role": acc.Role, "is_active": acc.IsActive}, nil)
+}
+
+func (r *inMemoryRepository) deleteAddressesOf(userID string) {
+	for id, address := range r.addresses {
+		if address.UserID == userID {
+			delete(r.addresses, id)
+		}
+	}
+}
+
+func (r *inMemoryRepository) EraseAccount(ctx context.Context, userID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	acc, ok := r.accounts[userID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	before := map[string]interface{}{"is_active": acc.IsActive, "token_version": acc.TokenVersion}
+	acc.Name = erasedAccountName
+	acc.Email = acc.ID
+	acc.PasswordHash = ""
+	acc.PendingEmail = ""
+	acc.Phone = ""
+	acc.TOTPSecret = ""
+	acc.TOTPEnabled = false
+	acc.EmailVerified = false
+	acc.IsActive = false
+	acc.TokenVersion++
+	r.deleteAddressesOf(userID)
+	return r.record(ctx, userID, AccountEventErased, before, map[string]interface{}{"is_active": false, "token_version": acc.TokenVersion})
+}
+
+func (r *inMemoryRepository) GetTOTP(ctx context.Context, userID string) (string, bool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	acc, ok := r.accounts[userID]
+	if !ok {
+		return "", false, sql.ErrNoRows
+	}
+	return acc.TOTPSecret, acc.TOTPEnabled, nil
+}
+
+func (r *inMemoryRepository) UpdateTOTP(ctx context.Context, userID string, encryptedSecret string, enabled bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	acc, ok := r.accounts[userID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	wasEnabled := acc.TOTPEnabled
+	acc.TOTPSecret = encryptedSecret
+	acc.TOTPEnabled = enabled
+	if wasEnabled == enabled {
+		return nil
+	}
+	action := AccountEventTwoFactorDisabled
+	if enabled {
+		action = AccountEventTwoFactorEnabled
+	}
+	return r.record(ctx, userID, action, map[string]interface{}{"totp_enabled": wasEnabled}, map[string]interface{}{"totp_enabled": enabled})
+}
+
+func (r *inMemoryRepository) MarkEmailVerified(ctx context.Context, userID string, email string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	acc, ok := r.accounts[userID]
+	if !ok || acc.Email != email {
+		return sql.ErrNoRows
+	}
+	if acc.EmailVerified {
+		return nil
+	}
+	acc.EmailVerified = true
+	return r.record(ctx, userID, AccountEventEmailVerified, map[string]interface{}{"email_verified": false}, map[string]interface{}{"email_verified": true})
+}
+
+func (r *inMemoryRepository) GetRolePermissions(ctx context.Context, role string) ([]string, error) {
+	permissions := append([]string{}, memoryRolePermissions[role]...)
+	sort.Strings(permissions)
+	return permissions, nil
+}
+
+func (r *inMemoryRepository) UpdateProfile(ctx context.Context, acc Account) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.accounts[acc.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	changed := []string{}
+	if stored.Name != acc.Name {
+		changed = append(changed, "name")
+	}
+	if stored.Phone != acc.Phone {
+		changed = append(changed, "phone")
+	}
+	if stored.PendingEmail != acc.PendingEmail {
+		changed = append(changed, "pending_email")
+	}
+	stored.Name = acc.Name
+	stored.Phone = acc.Phone
+	stored.PendingEmail = acc.PendingEmail
+	if len(changed) == 0 {
+		return nil
+	}
+	return r.record(ctx, acc.ID, AccountEventProfileUpdated, nil, map[string]interface{}{"changed": changed})
+}
+
+func (r *inMemoryRepository) ConfirmEmailChange(ctx context.Context, userID string, email string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	acc, ok := r.accounts[userID]
+	if !ok || acc.PendingEmail == "" || acc.PendingEmail != email {
+		return sql.ErrNoRows
+	}
+	if other := r.findByEmail(email); other != nil && other.ID != userID {
+		return errEmailTaken
+	}
+	before := map[string]interface{}{"email_verified": acc.EmailVerified, "token_version": acc.TokenVersion}
+	acc.Email = acc.PendingEmail
+	acc.PendingEmail = ""
+	acc.EmailVerified = true
+	acc.TokenVersion++
+	return r.record(ctx, userID, AccountEventEmailChanged, before, map[string]interface{}{"email_verified": true, "token_version": acc.TokenVersion})
+}
+
+func (r *inMemoryRepository) ChangeRole(ctx context.Context, userID string, role string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	acc, ok := r.accounts[userID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if acc.Role == role {
+		return nil
+	}
+	if _, ok := memoryRolePermissions[role]; !ok {
+		return errUnknownRole
+	}
+	before := map[string]interface{}{"role": acc.Role, "token_version": acc.TokenVersion}
+	acc.Role = role
+	acc.TokenVersion++
+	return r.record(ctx, userID, AccountEventRoleChanged, before, map[string]interface{}{"role": role, "token_version": acc.TokenVersion})
+}
+
+func (r *inMemoryRepository) ListAccountEvents(ctx context.Context, userID string, limit int) ([]AccountEvent, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	events := []AccountEvent{}
+	for i := len(r.events) - 1; i >= 0 && len(events) < limit; i-- {
+		if r.events[i].AccountID == userID {
+			events = append(events, r.events[i])
+		}
+	}
+	return events, nil
+}
+
+// clearDefault mirrors clearDefaultAddress, only one address of an account is the default
+func (r *inMemoryRepository) clearDefault(userID string) {
+	for _, address := range r.addresses {
+		if address.UserID == userID {
+			address.IsDefault = false
+		}
+	}
+}
+
+func (r *inMemoryRepository) CreateAddress(ctx context.Context, address Address) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.accounts[address.UserID]; !ok {
+		return sql.ErrNoRows
+	}
+	if _, ok := r.addresses[address.ID]; ok {
+		return errDuplicateID
+	}
+	if address.IsDefault {
+		r.clearDefault(address.UserID)
+	}
+	stored := address
+	r.addresses[address.ID] = &stored
+	return nil
+}
+
+func (r *inMemoryRepository) ListAddresses(ctx context.Context, userID string) ([]Address, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	addresses := []Address{}
+	for _, address := range r.addresses {
+		if address.UserID == userID {
+			addresses = append(addresses, *address)
+		}
+	}
+	sort.Slice(addresses, func(i, j int) bool {
+		if addresses[i].IsDefault != addresses[j].IsDefault {
+			return addresses[i].IsDefault
+		}
+		return addresses[i].CreatedAt.After(addresses[j].CreatedAt)
+	})
+	return addresses, nil
+}
+
+func (r *inMemoryRepository) GetAddress(ctx context.Context, userID string, id string) (*Address, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	address, ok := r.addresses[id]
+	if !ok || address.UserID != userID {
+		return nil, sql.ErrNoRows
+	}
+	copied := *address
+	return &copied, nil
+}
+
+func (r *inMemoryRepository) GetDefaultAddress(ctx context.Context, userID string) (*Address, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, address := range r.addresses {
+		if address.UserID == userID && address.IsDefault {
+			copied := *address
+			return &copied, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (r *inMemoryRepository) UpdateAddress(ctx context.Context, address Address) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.addresses[address.ID]
+	if !ok || stored.UserID != address.UserID {
+		return sql.ErrNoRows
+	}
+	isDefault := stored.IsDefault || address.IsDefault
+	if address.IsDefault {
+		r.clearDefault(address.UserID)
+	}
+	stored.Label = address.Label
+	stored.Recipient = address.Recipient
+	stored.Line1 = address.Line1
+	stored.Line2 = address.Line2
+	stored.City = address.City
+	stored.State = address.State
+	stored.PostalCode = address.PostalCode
+	stored.Country = address.Country
+	stored.Phone = address.Phone
+	stored.IsDefault = isDefault
+	stored.UpdatedAt = address.UpdatedAt
+	return nil
+}
+
+func (r *inMemoryRepository) DeleteAddress(ctx context.Context, userID string, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	address, ok := r.addresses[id]
+	if !ok || address.UserID != userID {
+		return sql.ErrNoRows
+	}
+	delete(r.addresses, id)
+	return nil
+}
+
+func (r *inMemoryRepository) SetDefaultAddress(ctx context.Context, userID string, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	address, ok := r.addresses[id]
+	if !ok || address.UserID != userID {
+		return sql.ErrNoRows
+	}
+	r.clearDefault(userID)
+	address.IsDefault = true
+	address.UpdatedAt = time.Now().UTC()
+	return nil
+}
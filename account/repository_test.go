@@ -0,0 +1,507 @@
+package account
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"github.com/zenvisjr/building-scalable-microservices/migrate"
+)
+
+// TestInMemoryRepository and TestPostgresRepository run the same contract, so both
+// implementations stay interchangeable
+func TestInMemoryRepository(t *testing.T) {
+	testRepository(t, NewInMemoryRepository())
+}
+
+// TestPostgresRepository needs a database, ACCOUNT_TEST_DATABASE_URL points to one. Every test
+// creates accounts with new IDs and emails, so it can share a database with other runs
+func TestPostgresRepository(t *testing.T) {
+	url := os.Getenv("ACCOUNT_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("ACCOUNT_TEST_DATABASE_URL is not set")
+	}
+	if err := migrate.Run(context.Background(), url, Migrations, []string{"up"}); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	repo, err := NewPostgresRepository(url)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer repo.Close()
+	testRepository(t, repo)
+}
+
+// newTestAccount returns an account with a unique ID and email, postgres keeps timestamps to
+// the microsecond so CreatedAt is truncated to compare equal after a round trip
+func newTestAccount(name string) Account {
+	id := ksuid.New().String()
+	return Account{
+		ID:           id,
+		Name:         name,
+		Email:        id + "@example.com",
+		PasswordHash: "hash",
+		Role:         "user",
+		TokenVersion: 1,
+		CreatedAt:    time.Now().UTC().Truncate(time.Microsecond),
+	}
+}
+
+func mustCreate(t *testing.T, repo Repository, acc Account) Account {
+	t.Helper()
+	if err := repo.CreateAccount(context.Background(), acc); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	return acc
+}
+
+func actions(events []AccountEvent) []string {
+	list := make([]string, len(events))
+	for i, event := range events {
+		list[i] = event.Action
+	}
+	return list
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func testRepository(t *testing.T, repo Repository) {
+	ctx := context.Background()
+
+	t.Run("CreateAndGet", func(t *testing.T) {
+		acc := mustCreate(t, repo, newTestAccount("alice"))
+
+		got, err := repo.GetAccountByID(ctx, acc.ID)
+		if err != nil {
+			t.Fatalf("GetAccountByID: %v", err)
+		}
+		if got.Name != acc.Name || got.Email != acc.Email || got.Role != "user" || !got.IsActive || got.EmailVerified {
+			t.Errorf("GetAccountByID = %+v", got)
+		}
+		if got.PasswordHash != "" || !got.CreatedAt.Equal(acc.CreatedAt) {
+			t.Errorf("GetAccountByID returned hash %q and created_at %v", got.PasswordHash, got.CreatedAt)
+		}
+
+		auth, err := repo.GetAccountForAuth(ctx, acc.Email)
+		if err != nil {
+			t.Fatalf("GetAccountForAuth: %v", err)
+		}
+		if auth.ID != acc.ID || auth.PasswordHash != "hash" || auth.TokenVersion != 1 {
+			t.Errorf("GetAccountForAuth = %+v", auth)
+		}
+
+		if _, err := repo.GetAccountByID(ctx, ksuid.New().String()); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetAccountByID of an unknown ID = %v, want sql.ErrNoRows", err)
+		}
+		if _, err := repo.GetAccountForAuth(ctx, "nobody-"+acc.Email); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetAccountForAuth of an unknown email = %v, want sql.ErrNoRows", err)
+		}
+
+		duplicate := newTestAccount("alice2")
+		duplicate.Email = acc.Email
+		if err := repo.CreateAccount(ctx, duplicate); err == nil {
+			t.Error("CreateAccount with a taken email succeeded")
+		}
+		unknownRole := newTestAccount("carol")
+		unknownRole.Role = "superuser"
+		if err := repo.CreateAccount(ctx, unknownRole); err == nil {
+			t.Error("CreateAccount with an unknown role succeeded")
+		}
+	})
+
+	t.Run("History", func(t *testing.T) {
+		acc := mustCreate(t, repo, newTestAccount("bob"))
+
+		// deactivating twice and reactivating an active account record nothing the second time
+		for _, step := range []func(context.Context, string) error{
+			repo.DeactivateAccount, repo.DeactivateAccount, repo.ReactivateAccount, repo.ReactivateAccount,
+		} {
+			if err := step(ctx, acc.ID); err != nil {
+				t.Fatalf("activation change: %v", err)
+			}
+		}
+		if err := repo.ChangeRole(ctx, acc.ID, "admin"); err != nil {
+			t.Fatalf("ChangeRole: %v", err)
+		}
+		if err := repo.ChangeRole(ctx, acc.ID, "admin"); err != nil {
+			t.Fatalf("ChangeRole to the same role: %v", err)
+		}
+		if err := repo.ChangeRole(ctx, acc.ID, "superuser"); !errors.Is(err, errUnknownRole) {
+			t.Errorf("ChangeRole to an unknown role = %v, want errUnknownRole", err)
+		}
+		if err := repo.ChangeRole(ctx, ksuid.New().String(), "admin"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("ChangeRole of an unknown account = %v, want sql.ErrNoRows", err)
+		}
+		if err := repo.IncrementTokenVersion(ctx, acc.ID); err != nil {
+			t.Fatalf("IncrementTokenVersion: %v", err)
+		}
+		if err := repo.UpdatePassword(ctx, acc.Email, "new hash"); err != nil {
+			t.Fatalf("UpdatePassword: %v", err)
+		}
+		if err := repo.UpdatePassword(ctx, ksuid.New().String()+"@example.com", "new hash"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("UpdatePassword of an unknown email = %v, want sql.ErrNoRows", err)
+		}
+
+		events, err := repo.ListAccountEvents(ctx, acc.ID, 10)
+		if err != nil {
+			t.Fatalf("ListAccountEvents: %v", err)
+		}
+		want := []string{
+			AccountEventPasswordChanged, AccountEventTokensRevoked, AccountEventRoleChanged,
+			AccountEventReactivated, AccountEventDeactivated, AccountEventCreated,
+		}
+		if !equalStrings(actions(events), want) {
+			t.Fatalf("events = %v, want %v", actions(events), want)
+		}
+		roleChange := events[2]
+		if roleChange.Before["role"] != "user" || roleChange.After["role"] != "admin" {
+			t.Errorf("role_changed event = %+v", roleChange)
+		}
+
+		auth, err := repo.GetAccountForAuth(ctx, acc.Email)
+		if err != nil {
+			t.Fatalf("GetAccountForAuth: %v", err)
+		}
+		if auth.Role != "admin" || auth.TokenVersion != 3 || auth.PasswordHash != "new hash" {
+			t.Errorf("after the changes account = %+v", auth)
+		}
+
+		limited, err := repo.ListAccountEvents(ctx, acc.ID, 2)
+		if err != nil || len(limited) != 2 || limited[0].Action != AccountEventPasswordChanged {
+			t.Errorf("ListAccountEvents with limit 2 = %v, %v", actions(limited), err)
+		}
+
+		// changes to unknown accounts are ignored, logging everyone out may list deleted users
+		unknown := ksuid.New().String()
+		if err := repo.IncrementTokenVersion(ctx, unknown); err != nil {
+			t.Errorf("IncrementTokenVersion of an unknown account: %v", err)
+		}
+		if err := repo.DeactivateAccount(ctx, unknown); err != nil {
+			t.Errorf("DeactivateAccount of an unknown account: %v", err)
+		}
+		if err := repo.DeleteAccount(ctx, unknown); err != nil {
+			t.Errorf("DeleteAccount of an unknown account: %v", err)
+		}
+	})
+
+	t.Run("Search", func(t *testing.T) {
+		// a marker in every name keeps other tests and runs out of the results
+		marker := ksuid.New().String()[:8]
+		base := time.Now().UTC().Truncate(time.Microsecond)
+		created := make([]Account, 5)
+		for i := range created {
+			acc := newTestAccount(marker + "-" + string(rune('a'+i)))
+			acc.CreatedAt = base.Add(time.Duration(i) * time.Second)
+			created[i] = mustCreate(t, repo, acc)
+		}
+		if err := repo.DeactivateAccount(ctx, created[1].ID); err != nil {
+			t.Fatalf("DeactivateAccount: %v", err)
+		}
+
+		filter := AccountFilter{Name: marker}
+		count, err := repo.CountAccounts(ctx, filter)
+		if err != nil || count != 5 {
+			t.Fatalf("CountAccounts = %d, %v, want 5", count, err)
+		}
+
+		first, err := repo.SearchAccounts(ctx, filter, nil, 3)
+		if err != nil {
+			t.Fatalf("SearchAccounts: %v", err)
+		}
+		if len(first) != 3 || first[0].ID != created[4].ID || first[2].ID != created[2].ID {
+			t.Fatalf("first page = %v", first)
+		}
+		last := first[len(first)-1]
+		second, err := repo.SearchAccounts(ctx, filter, &accountCursor{CreatedAt: last.CreatedAt, ID: last.ID}, 3)
+		if err != nil {
+			t.Fatalf("SearchAccounts after cursor: %v", err)
+		}
+		if len(second) != 2 || second[0].ID != created[1].ID || second[1].ID != created[0].ID {
+			t.Fatalf("second page = %v", second)
+		}
+
+		inactive := false
+		filter.IsActive = &inactive
+		matches, err := repo.SearchAccounts(ctx, filter, nil, 10)
+		if err != nil || len(matches) != 1 || matches[0].ID != created[1].ID {
+			t.Errorf("inactive accounts = %v, %v", matches, err)
+		}
+
+		window := AccountFilter{Name: marker, CreatedAfter: created[1].CreatedAt, CreatedBefore: created[3].CreatedAt}
+		if count, err := repo.CountAccounts(ctx, window); err != nil || count != 2 {
+			t.Errorf("CountAccounts in [created[1], created[3]) = %d, %v, want 2", count, err)
+		}
+		byEmail := AccountFilter{Name: marker, Email: created[0].ID[:20]}
+		if count, err := repo.CountAccounts(ctx, byEmail); err != nil || count != 1 {
+			t.Errorf("CountAccounts by part of the email = %d, %v, want 1", count, err)
+		}
+
+		email, err := repo.GetEmailByName(ctx, created[3].Name)
+		if err != nil || email != created[3].Email {
+			t.Errorf("GetEmailByName = %q, %v", email, err)
+		}
+	})
+
+	t.Run("TwoFactorAndVerification", func(t *testing.T) {
+		acc := mustCreate(t, repo, newTestAccount("dave"))
+
+		if err := repo.UpdateTOTP(ctx, acc.ID, "pending secret", false); err != nil {
+			t.Fatalf("UpdateTOTP enrollment: %v", err)
+		}
+		if err := repo.UpdateTOTP(ctx, acc.ID, "pending secret", true); err != nil {
+			t.Fatalf("UpdateTOTP confirm: %v", err)
+		}
+		secret, enabled, err := repo.GetTOTP(ctx, acc.ID)
+		if err != nil || secret != "pending secret" || !enabled {
+			t.Errorf("GetTOTP = %q, %t, %v", secret, enabled, err)
+		}
+		if err := repo.UpdateTOTP(ctx, acc.ID, "", false); err != nil {
+			t.Fatalf("UpdateTOTP disable: %v", err)
+		}
+		if secret, enabled, err := repo.GetTOTP(ctx, acc.ID); err != nil || secret != "" || enabled {
+			t.Errorf("GetTOTP after disable = %q, %t, %v", secret, enabled, err)
+		}
+		if _, _, err := repo.GetTOTP(ctx, ksuid.New().String()); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetTOTP of an unknown account = %v, want sql.ErrNoRows", err)
+		}
+
+		if err := repo.MarkEmailVerified(ctx, acc.ID, "other@example.com"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("MarkEmailVerified with another email = %v, want sql.ErrNoRows", err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := repo.MarkEmailVerified(ctx, acc.ID, acc.Email); err != nil {
+				t.Fatalf("MarkEmailVerified: %v", err)
+			}
+		}
+
+		events, err := repo.ListAccountEvents(ctx, acc.ID, 10)
+		if err != nil {
+			t.Fatalf("ListAccountEvents: %v", err)
+		}
+		want := []string{AccountEventEmailVerified, AccountEventTwoFactorDisabled, AccountEventTwoFactorEnabled, AccountEventCreated}
+		if !equalStrings(actions(events), want) {
+			t.Errorf("events = %v, want %v", actions(events), want)
+		}
+	})
+
+	t.Run("ProfileAndEmailChange", func(t *testing.T) {
+		acc := mustCreate(t, repo, newTestAccount("erin"))
+		taken := mustCreate(t, repo, newTestAccount("frank"))
+
+		update := acc
+		update.Name = "erin2"
+		update.Phone = "+4915112345678"
+		update.PendingEmail = taken.Email
+		if err := repo.UpdateProfile(ctx, update); err != nil {
+			t.Fatalf("UpdateProfile: %v", err)
+		}
+		if err := repo.UpdateProfile(ctx, update); err != nil {
+			t.Fatalf("UpdateProfile without changes: %v", err)
+		}
+		if err := repo.ConfirmEmailChange(ctx, acc.ID, taken.Email); err == nil {
+			t.Error("ConfirmEmailChange to a taken email succeeded")
+		}
+
+		newEmail := ksuid.New().String() + "@example.com"
+		update.PendingEmail = newEmail
+		if err := repo.UpdateProfile(ctx, update); err != nil {
+			t.Fatalf("UpdateProfile: %v", err)
+		}
+		if err := repo.ConfirmEmailChange(ctx, acc.ID, "other@example.com"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("ConfirmEmailChange of another email = %v, want sql.ErrNoRows", err)
+		}
+		if err := repo.ConfirmEmailChange(ctx, acc.ID, newEmail); err != nil {
+			t.Fatalf("ConfirmEmailChange: %v", err)
+		}
+
+		got, err := repo.GetAccountByID(ctx, acc.ID)
+		if err != nil {
+			t.Fatalf("GetAccountByID: %v", err)
+		}
+		if got.Name != "erin2" || got.Phone != update.Phone || got.Email != newEmail || got.PendingEmail != "" || !got.EmailVerified {
+			t.Errorf("after the email change account = %+v", got)
+		}
+
+		events, err := repo.ListAccountEvents(ctx, acc.ID, 10)
+		if err != nil {
+			t.Fatalf("ListAccountEvents: %v", err)
+		}
+		want := []string{AccountEventEmailChanged, AccountEventProfileUpdated, AccountEventProfileUpdated, AccountEventCreated}
+		if !equalStrings(actions(events), want) {
+			t.Fatalf("events = %v, want %v", actions(events), want)
+		}
+		if changed, _ := events[2].After["changed"].([]interface{}); len(changed) != 3 {
+			t.Errorf("first profile_updated event = %+v", events[2].After)
+		}
+		if err := repo.UpdateProfile(ctx, Account{ID: ksuid.New().String()}); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("UpdateProfile of an unknown account = %v, want sql.ErrNoRows", err)
+		}
+	})
+
+	t.Run("EraseAndDelete", func(t *testing.T) {
+		acc := mustCreate(t, repo, newTestAccount("gina"))
+		address := newTestAddress(acc.ID, true)
+		if err := repo.CreateAddress(ctx, address); err != nil {
+			t.Fatalf("CreateAddress: %v", err)
+		}
+
+		if err := repo.EraseAccount(ctx, acc.ID); err != nil {
+			t.Fatalf("EraseAccount: %v", err)
+		}
+		got, err := repo.GetAccountByID(ctx, acc.ID)
+		if err != nil {
+			t.Fatalf("GetAccountByID: %v", err)
+		}
+		if got.Name != erasedAccountName || got.Email != acc.ID || got.IsActive || got.Phone != "" {
+			t.Errorf("erased account = %+v", got)
+		}
+		if addresses, err := repo.ListAddresses(ctx, acc.ID); err != nil || len(addresses) != 0 {
+			t.Errorf("addresses of an erased account = %v, %v", addresses, err)
+		}
+		if err := repo.EraseAccount(ctx, ksuid.New().String()); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("EraseAccount of an unknown account = %v, want sql.ErrNoRows", err)
+		}
+
+		if err := repo.DeleteAccount(ctx, acc.ID); err != nil {
+			t.Fatalf("DeleteAccount: %v", err)
+		}
+		if _, err := repo.GetAccountByID(ctx, acc.ID); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetAccountByID after delete = %v, want sql.ErrNoRows", err)
+		}
+		events, err := repo.ListAccountEvents(ctx, acc.ID, 10)
+		if err != nil {
+			t.Fatalf("ListAccountEvents: %v", err)
+		}
+		want := []string{AccountEventDeleted, AccountEventErased, AccountEventCreated}
+		if !equalStrings(actions(events), want) {
+			t.Errorf("history of a deleted account = %v, want %v", actions(events), want)
+		}
+	})
+
+	t.Run("Addresses", func(t *testing.T) {
+		acc := mustCreate(t, repo, newTestAccount("hank"))
+		home := newTestAddress(acc.ID, true)
+		work := newTestAddress(acc.ID, false)
+		work.CreatedAt = home.CreatedAt.Add(time.Second)
+		for _, address := range []Address{home, work} {
+			if err := repo.CreateAddress(ctx, address); err != nil {
+				t.Fatalf("CreateAddress: %v", err)
+			}
+		}
+
+		list, err := repo.ListAddresses(ctx, acc.ID)
+		if err != nil || len(list) != 2 || list[0].ID != home.ID {
+			t.Fatalf("ListAddresses = %v, %v, want the default first", list, err)
+		}
+
+		if err := repo.SetDefaultAddress(ctx, acc.ID, work.ID); err != nil {
+			t.Fatalf("SetDefaultAddress: %v", err)
+		}
+		def, err := repo.GetDefaultAddress(ctx, acc.ID)
+		if err != nil || def.ID != work.ID {
+			t.Fatalf("GetDefaultAddress = %v, %v", def, err)
+		}
+		if got, err := repo.GetAddress(ctx, acc.ID, home.ID); err != nil || got.IsDefault {
+			t.Errorf("the old default = %+v, %v", got, err)
+		}
+
+		// an update can make an address the default but not take that away
+		home.City = "Hamburg"
+		home.IsDefault = false
+		home.UpdatedAt = time.Now().UTC().Truncate(time.Microsecond)
+		if err := repo.UpdateAddress(ctx, home); err != nil {
+			t.Fatalf("UpdateAddress: %v", err)
+		}
+		work.IsDefault = false
+		if err := repo.UpdateAddress(ctx, work); err != nil {
+			t.Fatalf("UpdateAddress: %v", err)
+		}
+		if got, err := repo.GetAddress(ctx, acc.ID, work.ID); err != nil || !got.IsDefault {
+			t.Errorf("default after an update without is_default = %+v, %v", got, err)
+		}
+		if got, err := repo.GetAddress(ctx, acc.ID, home.ID); err != nil || got.City != "Hamburg" || !got.UpdatedAt.Equal(home.UpdatedAt) {
+			t.Errorf("updated address = %+v, %v", got, err)
+		}
+
+		other := ksuid.New().String()
+		if _, err := repo.GetAddress(ctx, other, home.ID); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetAddress of another account = %v, want sql.ErrNoRows", err)
+		}
+		if err := repo.UpdateAddress(ctx, newTestAddress(acc.ID, false)); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("UpdateAddress of an unknown address = %v, want sql.ErrNoRows", err)
+		}
+		if err := repo.SetDefaultAddress(ctx, acc.ID, ksuid.New().String()); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("SetDefaultAddress of an unknown address = %v, want sql.ErrNoRows", err)
+		}
+		if def, err := repo.GetDefaultAddress(ctx, acc.ID); err != nil || def.ID != work.ID {
+			t.Errorf("a failed SetDefaultAddress changed the default to %v, %v", def, err)
+		}
+
+		if err := repo.DeleteAddress(ctx, acc.ID, work.ID); err != nil {
+			t.Fatalf("DeleteAddress: %v", err)
+		}
+		if err := repo.DeleteAddress(ctx, acc.ID, work.ID); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("second DeleteAddress = %v, want sql.ErrNoRows", err)
+		}
+		if _, err := repo.GetDefaultAddress(ctx, acc.ID); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("GetDefaultAddress without a default = %v, want sql.ErrNoRows", err)
+		}
+		if err := repo.CreateAddress(ctx, newTestAddress(other, false)); err == nil {
+			t.Error("CreateAddress for an unknown account succeeded")
+		}
+	})
+
+	t.Run("RolePermissions", func(t *testing.T) {
+		user, err := repo.GetRolePermissions(ctx, "user")
+		if err != nil {
+			t.Fatalf("GetRolePermissions: %v", err)
+		}
+		if want := []string{"account:delete:own", "order:create", "order:read:own"}; !equalStrings(user, want) {
+			t.Errorf("user permissions = %v, want %v", user, want)
+		}
+		admin, err := repo.GetRolePermissions(ctx, "admin")
+		if err != nil || len(admin) < len(user) {
+			t.Errorf("admin permissions = %v, %v", admin, err)
+		}
+		for i := 1; i < len(admin); i++ {
+			if admin[i-1] > admin[i] {
+				t.Errorf("admin permissions are not sorted: %v", admin)
+				break
+			}
+		}
+		if none, err := repo.GetRolePermissions(ctx, "superuser"); err != nil || len(none) != 0 {
+			t.Errorf("permissions of an unknown role = %v, %v", none, err)
+		}
+	})
+}
+
+func newTestAddress(userID string, isDefault bool) Address {
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	return Address{
+		ID:         ksuid.New().String(),
+		UserID:     userID,
+		Label:      "home",
+		Recipient:  "Test Recipient",
+		Line1:      "Main Street 1",
+		City:       "Berlin",
+		PostalCode: "10115",
+		Country:    "DE",
+		IsDefault:  isDefault,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+}
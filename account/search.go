@@ -0,0 +1,124 @@
+package account
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/zenvisjr/building-scalable-microservices/logger"
+)
+
+const (
+	// defaultSearchPageSize is used when the caller does not ask for a page size
+	defaultSearchPageSize = 20
+	// maxSearchPageSize caps how many accounts one SearchAccounts page can hold
+	maxSearchPageSize = 100
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// AccountFilter narrows SearchAccounts, zero fields match every account
+type AccountFilter struct {
+	ID            string
+	Name          string // part of the name, case insensitive
+	Email         string // part of the email, case insensitive
+	Role          string
+	IsActive      *bool
+	CreatedAfter  time.Time // inclusive
+	CreatedBefore time.Time // exclusive
+}
+
+// AccountEdge is an account of a page and the cursor to continue after it
+type AccountEdge struct {
+	Account Account
+	Cursor  string
+}
+
+// AccountPage is one page of SearchAccounts, newest accounts first
+type AccountPage struct {
+	Edges       []AccountEdge
+	EndCursor   string // empty for an empty page
+	HasNextPage bool
+	TotalCount  uint64 // accounts matching the filter on all pages
+}
+
+// accountCursor is the position of an account in the (created_at, id) order of SearchAccounts
+type accountCursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+// encodeAccountCursor keeps cursors opaque to clients, they are only ever passed back as is
+func encodeAccountCursor(acc Account) string {
+	raw := acc.CreatedAt.UTC().Format(time.RFC3339Nano) + "|" + acc.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeAccountCursor(cursor string) (*accountCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	createdAt, id, ok := strings.Cut(string(raw), "|")
+	if !ok || id == "" {
+		return nil, errInvalidCursor
+	}
+	t, err := time.Parse(time.RFC3339Nano, createdAt)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	return &accountCursor{CreatedAt: t, ID: id}, nil
+}
+
+func (a *accountService) SearchAccounts(ctx context.Context, filter AccountFilter, first int, after string) (*AccountPage, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("SearchAccounts called with first=" + logger.IntToStr(first))
+
+	if first <= 0 {
+		first = defaultSearchPageSize
+	}
+	if first > maxSearchPageSize {
+		first = maxSearchPageSize
+	}
+	filter.Name = strings.TrimSpace(filter.Name)
+	filter.Email = strings.TrimSpace(filter.Email)
+
+	// Step 1: Continue after the cursor, if one was given
+	var cursor *accountCursor
+	if after != "" {
+		var err error
+		if cursor, err = decodeAccountCursor(after); err != nil {
+			return nil, err
+		}
+	}
+
+	// Step 2: One row more than asked for tells whether there is a next page
+	accounts, err := a.repo.SearchAccounts(ctx, filter, cursor, first+1)
+	if err != nil {
+		Logs.Error(ctx, "Failed to search accounts: "+err.Error())
+		return nil, err
+	}
+	total, err := a.repo.CountAccounts(ctx, filter)
+	if err != nil {
+		Logs.Error(ctx, "Failed to count accounts: "+err.Error())
+		return nil, err
+	}
+
+	page := &AccountPage{TotalCount: total}
+	if len(accounts) > first {
+		accounts = accounts[:first]
+		page.HasNextPage = true
+	}
+	page.Edges = make([]AccountEdge, len(accounts))
+	for i, acc := range accounts {
+		page.Edges[i] = AccountEdge{Account: acc, Cursor: encodeAccountCursor(acc)}
+	}
+	if len(page.Edges) > 0 {
+		page.EndCursor = page.Edges[len(page.Edges)-1].Cursor
+	}
+
+	Logs.Info(ctx, "Found "+logger.IntToStr(len(page.Edges))+" accounts of "+logger.Uint64ToStr(total))
+	return page, nil
+}
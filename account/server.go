@@ -1,23 +1,70 @@
 package account
 
 import (
+	"bufio"
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 
 	"github.com/nats-io/nats.go"
 	"github.com/zenvisjr/building-scalable-microservices/account/pb"
 	"github.com/zenvisjr/building-scalable-microservices/logger"
+	"github.com/zenvisjr/building-scalable-microservices/svcauth"
+	"github.com/zenvisjr/building-scalable-microservices/tlsconfig"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type grpcServer struct {
 	service Service
 	// mailClient *mail.Mail
 	pb.UnimplementedAccountServiceServer
-	netScan *nats.Conn
+	netScan Publisher
+}
+
+// Publisher sends the welcome email jobs and the token version changes of accounts, in
+// production it is the NATS connection
+type Publisher interface {
+	Publish(subject string, data []byte) error
+}
+
+// callers lists the services allowed to call each RPC, password hashes and token
+// versions are only handed out to the auth service
+var callers = svcauth.Allowlist{
+	pb.AccountService_PostAccount_FullMethodName:           {"auth"},
+	pb.AccountService_GetAccount_FullMethodName:            {"auth", "order", "gateway"},
+	pb.AccountService_GetAccounts_FullMethodName:           {"auth", "gateway"},
+	pb.AccountService_SearchAccounts_FullMethodName:        {"gateway"},
+	pb.AccountService_GetEmail_FullMethodName:              {"gateway"},
+	pb.AccountService_GetEmailForAuth_FullMethodName:       {"auth"},
+	pb.AccountService_IncrementTokenVersion_FullMethodName: {"auth"},
+	pb.AccountService_UpdatePassword_FullMethodName:        {"auth"},
+	pb.AccountService_DeactivateAccount_FullMethodName:     {"auth"},
+	pb.AccountService_ReactivateAccount_FullMethodName:     {"auth"},
+	pb.AccountService_DeleteAccount_FullMethodName:         {"auth"},
+	pb.AccountService_EraseAccount_FullMethodName:          {"auth"},
+	pb.AccountService_GetTOTP_FullMethodName:               {"auth"},
+	pb.AccountService_UpdateTOTP_FullMethodName:            {"auth"},
+	pb.AccountService_MarkEmailVerified_FullMethodName:     {"auth"},
+	pb.AccountService_GetRolePermissions_FullMethodName:    {"auth"},
+	pb.AccountService_UpdateProfile_FullMethodName:         {"auth"},
+	pb.AccountService_ChangeRole_FullMethodName:            {"gateway"},
+	pb.AccountService_GetAccountHistory_FullMethodName:     {"gateway"},
+	pb.AccountService_AddAddress_FullMethodName:            {"gateway"},
+	pb.AccountService_ListAddresses_FullMethodName:         {"gateway", "auth"},
+	pb.AccountService_GetAddress_FullMethodName:            {"gateway", "order"},
+	pb.AccountService_UpdateAddress_FullMethodName:         {"gateway"},
+	pb.AccountService_DeleteAddress_FullMethodName:         {"gateway"},
+	pb.AccountService_SetDefaultAddress_FullMethodName:     {"gateway"},
+	pb.AccountService_ImportAccounts_FullMethodName:        {"gateway"},
+	pb.AccountService_ExportAccounts_FullMethodName:        {"gateway"},
 }
 
 func ListenGRPC(s Service, mailURL string, port int) error {
@@ -47,9 +94,24 @@ func ListenGRPC(s Service, mailURL string, port int) error {
 		return err
 	}
 	Logs.LocalOnlyInfo("Connected to NATS")
-	server := grpc.NewServer(
-		grpc.UnaryInterceptor(logger.UnaryLoggingInterceptor()),
-	)
+	creds, err := tlsconfig.ServerOption()
+	if err != nil {
+		Logs.Error(context.Background(), "Failed to load TLS config: "+err.Error())
+		return err
+	}
+	server := NewGRPCServer(s, nc, creds)
+
+	Logs.LocalOnlyInfo("gRPC server for account microservice registered and starting...")
+	return server.Serve(lis)
+}
+
+// NewGRPCServer builds the account gRPC server. Callers are checked on streaming RPCs too,
+// bulk import and export stream their rows
+func NewGRPCServer(s Service, nc Publisher, opts ...grpc.ServerOption) *grpc.Server {
+	server := grpc.NewServer(append(opts,
+		grpc.ChainUnaryInterceptor(logger.UnaryLoggingInterceptor(), svcauth.UnaryServerInterceptor(callers)),
+		grpc.ChainStreamInterceptor(svcauth.StreamServerInterceptor(callers)),
+	)...)
 
 	pb.RegisterAccountServiceServer(server, &grpcServer{
 		service: s,
@@ -57,9 +119,7 @@ func ListenGRPC(s Service, mailURL string, port int) error {
 		netScan: nc,
 	})
 	reflection.Register(server)
-
-	Logs.LocalOnlyInfo("gRPC server for account microservice registered and starting...")
-	return server.Serve(lis)
+	return server
 }
 
 func (g *grpcServer) PostAccount(ctx context.Context, req *pb.PostAccountRequest) (*pb.PostAccountResponse, error) {
@@ -85,6 +145,25 @@ func (g *grpcServer) PostAccount(ctx context.Context, req *pb.PostAccountRequest
 	// }
 
 	//now using pub sub model
+	if err := g.publishWelcomeEmail(ctx, acc); err != nil {
+		return nil, err
+	}
+
+	return &pb.PostAccountResponse{
+		Account: &pb.Account{
+			Id:    acc.ID,
+			Name:  acc.Name,
+			Email: acc.Email,
+			Role: acc.Role,
+			TokenVersion: acc.TokenVersion,
+		},
+	}, nil
+}
+
+// publishWelcomeEmail queues the welcome email of a new account on the mail queue
+func (g *grpcServer) publishWelcomeEmail(ctx context.Context, acc *Account) error {
+	Logs := logger.GetGlobalLogger()
+
 	emailJob := map[string]interface{}{
 		"to":           acc.Email,
 		"subject":      "Welcome to Zenvis!",
@@ -98,26 +177,17 @@ func (g *grpcServer) PostAccount(ctx context.Context, req *pb.PostAccountRequest
 	payload, err := json.Marshal(emailJob)
 	if err != nil {
 		Logs.Error(ctx, "Failed to marshal email job: "+err.Error())
-		return nil, err
+		return err
 	}
 
 	Logs.Info(ctx, "Email job publishing to NATS")
 	err = g.netScan.Publish("emails.send", payload)
 	if err != nil {
 		Logs.Error(ctx, "Failed to publish email job: "+err.Error())
-		return nil, err
+		return err
 	}
 	Logs.Info(ctx, "Email job published to NATS")
-
-	return &pb.PostAccountResponse{
-		Account: &pb.Account{
-			Id:    acc.ID,
-			Name:  acc.Name,
-			Email: acc.Email,
-			Role: acc.Role,
-			TokenVersion: acc.TokenVersion,
-		},
-	}, nil
+	return nil
 }
 
 func (g *grpcServer) GetAccount(ctx context.Context, req *pb.GetAccountRequest) (*pb.GetAccountResponse, error) {
@@ -127,18 +197,16 @@ func (g *grpcServer) GetAccount(ctx context.Context, req *pb.GetAccountRequest)
 	acc, err := g.service.GetAccount(ctx, req.GetId())
 	if err != nil {
 		Logs.Error(ctx, "GetAccount service error: "+err.Error())
+		// callers such as the erasures of auth tell a missing account from a failed lookup
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, status.Error(codes.NotFound, "account not found")
+		}
 		return nil, err
 	}
 	Logs.Info(ctx, "Fetched account with ID: "+acc.ID)
 
 	return &pb.GetAccountResponse{
-		Account: &pb.Account{
-			Id:    acc.ID,
-			Name:  acc.Name,
-			Email: acc.Email,
-			Role: acc.Role,
-			IsActive: acc.IsActive,
-		},
+		Account: toAccountProto(acc),
 	}, nil
 }
 
@@ -156,13 +224,7 @@ func (g *grpcServer) GetAccounts(ctx context.Context, req *pb.GetAccountsRequest
 
 	grpcAccs := make([]*pb.Account, len(accs))
 	for i, acc := range accs {
-		grpcAccs[i] = &pb.Account{
-			Id:    acc.ID,
-			Name:  acc.Name,
-			Email: acc.Email,
-			Role: acc.Role,
-			IsActive: acc.IsActive,
-		}
+		grpcAccs[i] = toAccountProto(&acc)
 	}
 
 	return &pb.GetAccountsResponse{
@@ -170,6 +232,42 @@ func (g *grpcServer) GetAccounts(ctx context.Context, req *pb.GetAccountsRequest
 	}, nil
 }
 
+func (g *grpcServer) SearchAccounts(ctx context.Context, req *pb.SearchAccountsRequest) (*pb.SearchAccountsResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo(fmt.Sprintf("Received SearchAccounts request: first=%d", req.GetFirst()))
+
+	filter := AccountFilter{
+		ID:       req.GetId(),
+		Name:     req.GetName(),
+		Email:    req.GetEmail(),
+		Role:     req.GetRole(),
+		IsActive: req.IsActive,
+	}
+	if req.GetCreatedAfter() != nil {
+		filter.CreatedAfter = req.GetCreatedAfter().AsTime()
+	}
+	if req.GetCreatedBefore() != nil {
+		filter.CreatedBefore = req.GetCreatedBefore().AsTime()
+	}
+
+	page, err := g.service.SearchAccounts(ctx, filter, int(req.GetFirst()), req.GetAfter())
+	if err != nil {
+		Logs.Error(ctx, "SearchAccounts service error: "+err.Error())
+		return nil, err
+	}
+
+	resp := &pb.SearchAccountsResponse{
+		Edges:       make([]*pb.AccountEdge, len(page.Edges)),
+		EndCursor:   page.EndCursor,
+		HasNextPage: page.HasNextPage,
+		TotalCount:  page.TotalCount,
+	}
+	for i, edge := range page.Edges {
+		resp.Edges[i] = &pb.AccountEdge{Account: toAccountProto(&edge.Account), Cursor: edge.Cursor}
+	}
+	return resp, nil
+}
+
 func (g *grpcServer) GetEmail(ctx context.Context, req *pb.GetEmailRequest) (*pb.GetEmailResponse, error) {
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("Received GetEmail gRPC request for name: " + req.GetName())
@@ -205,6 +303,8 @@ func (g *grpcServer) GetEmailForAuth(ctx context.Context, req *pb.GetEmailForAut
 		Role: email.Role,
 		TokenVersion: email.TokenVersion,
 		IsActive: email.IsActive,
+		TotpEnabled: email.TOTPEnabled,
+		EmailVerified: email.EmailVerified,
 	}, nil
 }
 
@@ -217,6 +317,7 @@ func (g *grpcServer) IncrementTokenVersion(ctx context.Context, req *pb.Incremen
 		return nil, err
 	}
 	Logs.Info(ctx, "Incremented token version for user ID: "+req.GetUserId())
+	g.publishTokenVersionChanged(ctx, req.GetUserId(), "token_version_incremented")
 
 	return &pb.IncrementTokenVersionResponse{Ok: true}, nil
 }
@@ -228,6 +329,9 @@ func(g *grpcServer) UpdatePassword(ctx context.Context, req *pb.UpdatePasswordRe
 
 	if err := g.service.UpdatePassword(ctx, req.GetEmail(), req.GetPassword()); err != nil {
 		Logs.Error(ctx, "UpdatePassword service error: "+err.Error())
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, status.Error(codes.NotFound, "account not found")
+		}
 		return nil, err
 	}
 	Logs.Info(ctx, "Updated password for email in server: "+req.GetEmail())
@@ -243,6 +347,7 @@ func(g *grpcServer) DeactivateAccount(ctx context.Context, req *pb.UpdateAccount
 		Logs.Error(ctx, "DeactivateAccount service error: "+err.Error())
 		return nil, err
 	}
+	g.publishTokenVersionChanged(ctx, req.GetUserId(), "account_deactivated")
 
 	return &pb.UpdateAccountResponse{Ok: true}, nil
 }
@@ -255,6 +360,7 @@ func(g *grpcServer) ReactivateAccount(ctx context.Context, req *pb.UpdateAccount
 		Logs.Error(ctx, "ReactivateAccount service error: "+err.Error())
 		return nil, err
 	}
+	g.publishTokenVersionChanged(ctx, req.GetUserId(), "account_reactivated")
 	return &pb.UpdateAccountResponse{Ok: true}, nil
 }
 
@@ -266,6 +372,378 @@ func(g *grpcServer) DeleteAccount(ctx context.Context, req *pb.UpdateAccountRequ
 		Logs.Error(ctx, "DeleteAccount service error: "+err.Error())
 		return nil, err
 	}
+	g.publishTokenVersionChanged(ctx, req.GetUserId(), "account_deleted")
+	return &pb.UpdateAccountResponse{Ok: true}, nil
+}
+
+func (g *grpcServer) EraseAccount(ctx context.Context, req *pb.UpdateAccountRequest) (*pb.UpdateAccountResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Received EraseAccount gRPC request for user ID: " + req.GetUserId())
+
+	if err := g.service.EraseAccount(ctx, req.GetUserId()); err != nil {
+		Logs.Error(ctx, "EraseAccount service error: "+err.Error())
+		return nil, err
+	}
+	g.publishTokenVersionChanged(ctx, req.GetUserId(), "account_erased")
+	return &pb.UpdateAccountResponse{Ok: true}, nil
+}
+
+// publishTokenVersionChanged tells services caching token versions to drop the user. The change
+// itself is already stored, a lost event only delays it until their cache entry expires
+func (g *grpcServer) publishTokenVersionChanged(ctx context.Context, userID string, reason string) {
+	Logs := logger.GetGlobalLogger()
+
+	payload, err := json.Marshal(TokenVersionChanged{UserID: userID, Reason: reason})
+	if err != nil {
+		Logs.Error(ctx, "Failed to marshal token version event: "+err.Error())
+		return
+	}
+	if err := g.netScan.Publish(TokenVersionChangedSubject, payload); err != nil {
+		Logs.Error(ctx, "Failed to publish token version event: "+err.Error())
+	}
+}
+	
+
+func (g *grpcServer) GetTOTP(ctx context.Context, req *pb.UpdateAccountRequest) (*pb.GetTOTPResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Received GetTOTP gRPC request for user ID: " + req.GetUserId())
+
+	secret, enabled, err := g.service.GetTOTP(ctx, req.GetUserId())
+	if err != nil {
+		Logs.Error(ctx, "GetTOTP service error: "+err.Error())
+		return nil, err
+	}
+	return &pb.GetTOTPResponse{TotpSecret: secret, TotpEnabled: enabled}, nil
+}
+
+func (g *grpcServer) UpdateTOTP(ctx context.Context, req *pb.UpdateTOTPRequest) (*pb.UpdateAccountResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Received UpdateTOTP gRPC request for user ID: " + req.GetUserId())
+
+	if err := g.service.UpdateTOTP(ctx, req.GetUserId(), req.GetTotpSecret(), req.GetTotpEnabled()); err != nil {
+		Logs.Error(ctx, "UpdateTOTP service error: "+err.Error())
+		return nil, err
+	}
+	return &pb.UpdateAccountResponse{Ok: true}, nil
+}
+
+func (g *grpcServer) MarkEmailVerified(ctx context.Context, req *pb.MarkEmailVerifiedRequest) (*pb.UpdateAccountResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Received MarkEmailVerified gRPC request for user ID: " + req.GetUserId())
+
+	emailChanged, err := g.service.MarkEmailVerified(ctx, req.GetUserId(), req.GetEmail())
+	if err != nil {
+		Logs.Error(ctx, "MarkEmailVerified service error: "+err.Error())
+		return nil, err
+	}
+	if emailChanged {
+		g.publishTokenVersionChanged(ctx, req.GetUserId(), "email_changed")
+	}
+	return &pb.UpdateAccountResponse{Ok: true}, nil
+}
+
+func (g *grpcServer) GetRolePermissions(ctx context.Context, req *pb.GetRolePermissionsRequest) (*pb.GetRolePermissionsResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Received GetRolePermissions gRPC request for role: " + req.GetRole())
+
+	permissions, err := g.service.GetRolePermissions(ctx, req.GetRole())
+	if err != nil {
+		Logs.Error(ctx, "GetRolePermissions service error: "+err.Error())
+		return nil, err
+	}
+	return &pb.GetRolePermissionsResponse{Permissions: permissions}, nil
+}
+
+func toAccountProto(acc *Account) *pb.Account {
+	return &pb.Account{
+		Id:            acc.ID,
+		Name:          acc.Name,
+		Email:         acc.Email,
+		Role:          acc.Role,
+		IsActive:      acc.IsActive,
+		EmailVerified: acc.EmailVerified,
+		PendingEmail:  acc.PendingEmail,
+		Phone:         acc.Phone,
+		CreatedAt:     timestamppb.New(acc.CreatedAt),
+	}
+}
+
+func (g *grpcServer) UpdateProfile(ctx context.Context, req *pb.UpdateProfileRequest) (*pb.UpdateProfileResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Received UpdateProfile gRPC request for user ID: " + req.GetUserId())
+
+	acc, err := g.service.UpdateProfile(ctx, req.GetUserId(), ProfileUpdate{
+		Name:  req.Name,
+		Email: req.Email,
+		Phone: req.Phone,
+	})
+	if err != nil {
+		Logs.Error(ctx, "UpdateProfile service error: "+err.Error())
+		return nil, err
+	}
+	return &pb.UpdateProfileResponse{Account: toAccountProto(acc)}, nil
+}
+
+func (g *grpcServer) ChangeRole(ctx context.Context, req *pb.ChangeRoleRequest) (*pb.UpdateProfileResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Received ChangeRole gRPC request for user ID: " + req.GetUserId())
+
+	acc, err := g.service.ChangeRole(ctx, req.GetUserId(), req.GetRole())
+	if err != nil {
+		Logs.Error(ctx, "ChangeRole service error: "+err.Error())
+		return nil, err
+	}
+	g.publishTokenVersionChanged(ctx, req.GetUserId(), "role_changed")
+	return &pb.UpdateProfileResponse{Account: toAccountProto(acc)}, nil
+}
+
+func (g *grpcServer) GetAccountHistory(ctx context.Context, req *pb.GetAccountHistoryRequest) (*pb.GetAccountHistoryResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Received GetAccountHistory gRPC request for user ID: " + req.GetUserId())
+
+	events, err := g.service.GetAccountHistory(ctx, req.GetUserId(), int(req.GetLimit()))
+	if err != nil {
+		Logs.Error(ctx, "GetAccountHistory service error: "+err.Error())
+		return nil, err
+	}
+	resp := &pb.GetAccountHistoryResponse{Events: make([]*pb.AccountEvent, len(events))}
+	for i, event := range events {
+		if resp.Events[i], err = toAccountEventProto(event); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+func toAccountEventProto(event AccountEvent) (*pb.AccountEvent, error) {
+	e := &pb.AccountEvent{
+		Id:           event.ID,
+		AccountId:    event.AccountID,
+		Action:       event.Action,
+		ActorId:      event.ActorID,
+		ActorService: event.ActorService,
+		RequestId:    event.RequestID,
+		CreatedAt:    timestamppb.New(event.CreatedAt),
+	}
+	if event.Before != nil {
+		before, err := json.Marshal(event.Before)
+		if err != nil {
+			return nil, err
+		}
+		e.Before = string(before)
+	}
+	if event.After != nil {
+		after, err := json.Marshal(event.After)
+		if err != nil {
+			return nil, err
+		}
+		e.After = string(after)
+	}
+	return e, nil
+}
+
+func toAddressProto(address *Address) *pb.Address {
+	if address == nil {
+		return nil
+	}
+	return &pb.Address{
+		Id:         address.ID,
+		UserId:     address.UserID,
+		Label:      address.Label,
+		Recipient:  address.Recipient,
+		Line1:      address.Line1,
+		Line2:      address.Line2,
+		City:       address.City,
+		State:      address.State,
+		PostalCode: address.PostalCode,
+		Country:    address.Country,
+		Phone:      address.Phone,
+		IsDefault:  address.IsDefault,
+	}
+}
+
+func fromAddressProto(address *pb.Address) Address {
+	return Address{
+		ID:         address.GetId(),
+		UserID:     address.GetUserId(),
+		Label:      address.GetLabel(),
+		Recipient:  address.GetRecipient(),
+		Line1:      address.GetLine1(),
+		Line2:      address.GetLine2(),
+		City:       address.GetCity(),
+		State:      address.GetState(),
+		PostalCode: address.GetPostalCode(),
+		Country:    address.GetCountry(),
+		Phone:      address.GetPhone(),
+		IsDefault:  address.GetIsDefault(),
+	}
+}
+
+func (g *grpcServer) AddAddress(ctx context.Context, req *pb.AddressRequest) (*pb.AddressResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Received AddAddress gRPC request for user ID: " + req.GetUserId())
+
+	address, err := g.service.AddAddress(ctx, req.GetUserId(), fromAddressProto(req.GetAddress()))
+	if err != nil {
+		Logs.Error(ctx, "AddAddress service error: "+err.Error())
+		return nil, err
+	}
+	return &pb.AddressResponse{Address: toAddressProto(address)}, nil
+}
+
+func (g *grpcServer) ListAddresses(ctx context.Context, req *pb.UpdateAccountRequest) (*pb.ListAddressesResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Received ListAddresses gRPC request for user ID: " + req.GetUserId())
+
+	addresses, err := g.service.ListAddresses(ctx, req.GetUserId())
+	if err != nil {
+		Logs.Error(ctx, "ListAddresses service error: "+err.Error())
+		return nil, err
+	}
+	resp := &pb.ListAddressesResponse{Addresses: make([]*pb.Address, len(addresses))}
+	for i := range addresses {
+		resp.Addresses[i] = toAddressProto(&addresses[i])
+	}
+	return resp, nil
+}
+
+func (g *grpcServer) GetAddress(ctx context.Context, req *pb.AddressIDRequest) (*pb.AddressResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Received GetAddress gRPC request for user ID: " + req.GetUserId())
+
+	address, err := g.service.GetAddress(ctx, req.GetUserId(), req.GetId())
+	if err != nil {
+		Logs.Error(ctx, "GetAddress service error: "+err.Error())
+		return nil, err
+	}
+	return &pb.AddressResponse{Address: toAddressProto(address)}, nil
+}
+
+func (g *grpcServer) UpdateAddress(ctx context.Context, req *pb.AddressRequest) (*pb.AddressResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Received UpdateAddress gRPC request for user ID: " + req.GetUserId())
+
+	address, err := g.service.UpdateAddress(ctx, req.GetUserId(), fromAddressProto(req.GetAddress()))
+	if err != nil {
+		Logs.Error(ctx, "UpdateAddress service error: "+err.Error())
+		return nil, err
+	}
+	return &pb.AddressResponse{Address: toAddressProto(address)}, nil
+}
+
+func (g *grpcServer) DeleteAddress(ctx context.Context, req *pb.AddressIDRequest) (*pb.UpdateAccountResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Received DeleteAddress gRPC request for user ID: " + req.GetUserId())
+
+	if err := g.service.DeleteAddress(ctx, req.GetUserId(), req.GetId()); err != nil {
+		Logs.Error(ctx, "DeleteAddress service error: "+err.Error())
+		return nil, err
+	}
 	return &pb.UpdateAccountResponse{Ok: true}, nil
 }
-	
\ No newline at end of file
+
+func (g *grpcServer) SetDefaultAddress(ctx context.Context, req *pb.AddressIDRequest) (*pb.AddressResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Received SetDefaultAddress gRPC request for user ID: " + req.GetUserId())
+
+	address, err := g.service.SetDefaultAddress(ctx, req.GetUserId(), req.GetId())
+	if err != nil {
+		Logs.Error(ctx, "SetDefaultAddress service error: "+err.Error())
+		return nil, err
+	}
+	return &pb.AddressResponse{Address: toAddressProto(address)}, nil
+}
+
+// importStreamReader reads the file an ImportAccounts stream carries, pending starts with the
+// data of the first message
+type importStreamReader struct {
+	stream  grpc.ClientStreamingServer[pb.ImportAccountsRequest, pb.ImportAccountsResponse]
+	pending []byte
+}
+
+func (r *importStreamReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		msg, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		r.pending = msg.GetData()
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// exportStreamWriter sends everything written to it as ExportAccounts chunks
+type exportStreamWriter struct {
+	stream grpc.ServerStreamingServer[pb.ExportAccountsChunk]
+}
+
+func (w *exportStreamWriter) Write(p []byte) (int, error) {
+	if err := w.stream.Send(&pb.ExportAccountsChunk{Data: p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (g *grpcServer) ImportAccounts(stream grpc.ClientStreamingServer[pb.ImportAccountsRequest, pb.ImportAccountsResponse]) error {
+	Logs := logger.GetGlobalLogger()
+	ctx := stream.Context()
+	Logs.LocalOnlyInfo("Received ImportAccounts gRPC stream")
+
+	// Step 1: The options come with the first message
+	first, err := stream.Recv()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return errNoImportOptions
+		}
+		return err
+	}
+	options := first.GetOptions()
+	if options == nil {
+		return errNoImportOptions
+	}
+
+	// Step 2: Import the rows while they stream in
+	report, err := g.service.ImportAccounts(ctx, &importStreamReader{stream: stream, pending: first.GetData()}, ImportOptions{
+		Format:     options.GetFormat(),
+		DryRun:     options.GetDryRun(),
+		AllowRoles: options.GetAllowRoles(),
+	})
+	if err != nil {
+		Logs.Error(ctx, "ImportAccounts service error: "+err.Error())
+		return err
+	}
+
+	// Step 3: Welcome the new accounts, a failed email does not undo the import
+	if options.GetSendWelcomeEmail() {
+		for _, acc := range report.Created {
+			_ = g.publishWelcomeEmail(ctx, acc)
+		}
+	}
+
+	resp := &pb.ImportAccountsResponse{
+		Rows:     uint32(report.Rows),
+		Imported: uint32(report.Imported),
+		DryRun:   report.DryRun,
+		Errors:   make([]*pb.ImportRowError, len(report.Errors)),
+	}
+	for i, rowErr := range report.Errors {
+		resp.Errors[i] = &pb.ImportRowError{Row: uint32(rowErr.Row), Email: rowErr.Email, Error: rowErr.Error}
+	}
+	return stream.SendAndClose(resp)
+}
+
+func (g *grpcServer) ExportAccounts(req *pb.ExportAccountsRequest, stream grpc.ServerStreamingServer[pb.ExportAccountsChunk]) error {
+	Logs := logger.GetGlobalLogger()
+	ctx := stream.Context()
+	Logs.LocalOnlyInfo("Received ExportAccounts gRPC request with format: " + req.GetFormat())
+
+	filter := AccountFilter{Role: req.GetRole(), IsActive: req.IsActive}
+	w := bufio.NewWriterSize(&exportStreamWriter{stream: stream}, bulkChunkSize)
+	if _, err := g.service.ExportAccounts(ctx, filter, req.GetFormat(), w); err != nil {
+		Logs.Error(ctx, "ExportAccounts service error: "+err.Error())
+		return err
+	}
+	return w.Flush()
+}
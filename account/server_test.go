@@ -0,0 +1,217 @@
+package account
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/zenvisjr/building-scalable-microservices/internal/servicetest"
+	"github.com/zenvisjr/building-scalable-microservices/internal/svcauthtest"
+	"github.com/zenvisjr/building-scalable-microservices/svcauth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMain(m *testing.M) {
+	servicetest.Main(m, "account")
+}
+
+// startServer serves a fresh in-memory account service over bufconn and returns a client
+// connected to it
+func startServer(t *testing.T) (*Client, *servicetest.Publisher) {
+	t.Helper()
+	publisher := &servicetest.Publisher{}
+	dialer := servicetest.Serve(t, NewGRPCServer(NewAccountService(NewInMemoryRepository()), publisher))
+	client, err := NewClient("passthrough:///account", dialer)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(client.Close)
+	return client, publisher
+}
+
+func TestPostAccount(t *testing.T) {
+	client, publisher := startServer(t)
+	ctx := context.Background()
+	svcauthtest.CallAs(t, "auth")
+
+	acc, err := client.PostAccount(ctx, "alice", "alice@example.com", "secret123", "user")
+	if err != nil {
+		t.Fatalf("PostAccount: %v", err)
+	}
+	if acc.ID == "" || acc.Role != "user" || acc.TokenVersion != 1 {
+		t.Errorf("PostAccount = %+v", acc)
+	}
+	if got := publisher.Count("emails.send"); got != 1 {
+		t.Errorf("welcome emails published = %d, want 1", got)
+	}
+
+	auth, err := client.GetEmailForAuth(ctx, "alice@example.com")
+	if err != nil {
+		t.Fatalf("GetEmailForAuth: %v", err)
+	}
+	if auth.ID != acc.ID || auth.PasswordHash == "" || auth.PasswordHash == "secret123" {
+		t.Errorf("GetEmailForAuth = %+v", auth)
+	}
+
+	if _, err := client.PostAccount(ctx, "alice", "alice@example.com", "secret123", "user"); err == nil {
+		t.Error("PostAccount with a taken email succeeded")
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	client, _ := startServer(t)
+	ctx := context.Background()
+
+	// only the auth service creates accounts
+	svcauthtest.CallAs(t, "order")
+	_, err := client.PostAccount(ctx, "mallory", "mallory@example.com", "secret123", "admin")
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("PostAccount from order = %v, want PermissionDenied", err)
+	}
+
+	// streams are checked like unary calls
+	var out bytes.Buffer
+	err = client.ExportAccounts(ctx, AccountFilter{}, BulkFormatCSV, &out)
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("ExportAccounts from order = %v, want PermissionDenied", err)
+	}
+}
+
+func TestChangeRoleHistory(t *testing.T) {
+	client, publisher := startServer(t)
+	svcauthtest.CallAs(t, "auth")
+	acc, err := client.PostAccount(context.Background(), "bob", "bob@example.com", "secret123", "user")
+	if err != nil {
+		t.Fatalf("PostAccount: %v", err)
+	}
+
+	// the gateway forwards the admin making the change, the history records them as the actor
+	svcauthtest.Use("gateway")
+	ctx := svcauth.ContextWithUser(context.Background(), &svcauth.User{ID: "admin-id", Role: "admin"})
+	ctx = svcauth.ContextWithRequestID(ctx, "request-1")
+	changed, err := client.ChangeRole(ctx, acc.ID, "admin")
+	if err != nil {
+		t.Fatalf("ChangeRole: %v", err)
+	}
+	if changed.Role != "admin" {
+		t.Errorf("ChangeRole = %+v", changed)
+	}
+	if got := publisher.Count(TokenVersionChangedSubject); got != 1 {
+		t.Errorf("token version events published = %d, want 1", got)
+	}
+
+	events, err := client.GetAccountHistory(ctx, acc.ID, 10)
+	if err != nil {
+		t.Fatalf("GetAccountHistory: %v", err)
+	}
+	if len(events) != 2 || events[0].Action != AccountEventRoleChanged || events[1].Action != AccountEventCreated {
+		t.Fatalf("history = %+v", events)
+	}
+	if events[0].ActorID != "admin-id" || events[0].ActorService != "gateway" || events[0].RequestID != "request-1" {
+		t.Errorf("role change actor = %+v", events[0])
+	}
+	if events[1].ActorService != "auth" {
+		t.Errorf("signup actor service = %q, want auth", events[1].ActorService)
+	}
+
+	if _, err := client.ChangeRole(ctx, acc.ID, "superuser"); err == nil {
+		t.Error("ChangeRole to an unknown role succeeded")
+	}
+}
+
+func TestImportExport(t *testing.T) {
+	client, publisher := startServer(t)
+	ctx := context.Background()
+
+	csv := strings.Join([]string{
+		"name,email,password,role",
+		"carol,carol@example.com,secret123,",
+		"dave,dave@example.com,secret123,admin",
+		"erin,not-an-email,secret123,",
+		"carol2,carol@example.com,secret123,",
+	}, "\n")
+
+	dryRun, err := client.ImportAccounts(ctx, strings.NewReader(csv), ImportOptions{Format: BulkFormatCSV, DryRun: true}, true)
+	if err != nil {
+		t.Fatalf("ImportAccounts dry run: %v", err)
+	}
+	if dryRun.Rows != 4 || dryRun.Imported != 1 || len(dryRun.Errors) != 3 || !dryRun.DryRun {
+		t.Fatalf("dry run report = %+v", dryRun)
+	}
+
+	report, err := client.ImportAccounts(ctx, strings.NewReader(csv), ImportOptions{Format: BulkFormatCSV, AllowRoles: true}, true)
+	if err != nil {
+		t.Fatalf("ImportAccounts: %v", err)
+	}
+	if report.Rows != 4 || report.Imported != 2 || len(report.Errors) != 2 {
+		t.Fatalf("report = %+v", report)
+	}
+	if report.Errors[0].Row != 3 || report.Errors[1].Row != 4 {
+		t.Errorf("failed rows = %+v, want rows 3 and 4", report.Errors)
+	}
+	if got := publisher.Count("emails.send"); got != 2 {
+		t.Errorf("welcome emails published = %d, want 2", got)
+	}
+
+	var out bytes.Buffer
+	if err := client.ExportAccounts(ctx, AccountFilter{Role: "user"}, BulkFormatJSONL, &out); err != nil {
+		t.Fatalf("ExportAccounts: %v", err)
+	}
+	scanner := bufio.NewScanner(&out)
+	var rows []exportedAccountRow
+	for scanner.Scan() {
+		var row exportedAccountRow
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			t.Fatalf("export line %q: %v", scanner.Text(), err)
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) != 1 || rows[0].Email != "carol@example.com" || rows[0].Role != "user" {
+		t.Errorf("exported users = %+v", rows)
+	}
+}
+
+func TestAddresses(t *testing.T) {
+	client, _ := startServer(t)
+	svcauthtest.CallAs(t, "auth")
+	acc, err := client.PostAccount(context.Background(), "frank", "frank@example.com", "secret123", "user")
+	if err != nil {
+		t.Fatalf("PostAccount: %v", err)
+	}
+
+	svcauthtest.Use("gateway")
+	ctx := context.Background()
+	first, err := client.AddAddress(ctx, acc.ID, Address{Recipient: "Frank", Line1: "Main Street 1", City: "Berlin", PostalCode: "10115", Country: "de"})
+	if err != nil {
+		t.Fatalf("AddAddress: %v", err)
+	}
+	second, err := client.AddAddress(ctx, acc.ID, Address{Recipient: "Frank", Line1: "Side Street 2", City: "Hamburg", PostalCode: "20095", Country: "DE", IsDefault: true})
+	if err != nil {
+		t.Fatalf("AddAddress: %v", err)
+	}
+
+	list, err := client.ListAddresses(ctx, acc.ID)
+	if err != nil {
+		t.Fatalf("ListAddresses: %v", err)
+	}
+	if len(list) != 2 || list[0].ID != second.ID || !list[0].IsDefault || list[1].IsDefault {
+		t.Errorf("ListAddresses = %+v, want the new default first", list)
+	}
+
+	if _, err := client.SetDefaultAddress(ctx, acc.ID, first.ID); err != nil {
+		t.Fatalf("SetDefaultAddress: %v", err)
+	}
+	if err := client.DeleteAddress(ctx, acc.ID, second.ID); err != nil {
+		t.Fatalf("DeleteAddress: %v", err)
+	}
+	if _, err := client.GetAddress(ctx, acc.ID, second.ID); err == nil {
+		t.Error("GetAddress of a deleted address succeeded")
+	}
+	if _, err := client.AddAddress(ctx, acc.ID, Address{Recipient: "Frank"}); err == nil {
+		t.Error("AddAddress without a street succeeded")
+	}
+}
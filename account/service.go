@@ -2,26 +2,59 @@ package account
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/segmentio/ksuid"
 	"github.com/zenvisjr/building-scalable-microservices/logger"
 	"golang.org/x/crypto/bcrypt"
 )
 
+const (
+	// maxNameLength matches the name column of the accounts table
+	maxNameLength = 24
+	// erasedAccountName replaces the name of an erased account
+	erasedAccountName = "Erased user"
+)
+
+var (
+	errInvalidName = errors.New("name must be between 1 and 24 characters")
+	errEmailTaken  = errors.New("an account with this email already exists")
+	errUnknownRole = errors.New("role does not exist")
+)
+
 type Account struct {
-	ID           string `json:"id"`
-	Name         string `json:"name"`
-	Email        string `json:"email"`
-	PasswordHash string `json:"password_hash"`
-	Role         string `json:"role"`
-	TokenVersion int32  `json:"token_version"`
-	IsActive     bool   `json:"is_active"`
+	ID            string    `json:"id"`
+	Name          string    `json:"name"`
+	Email         string    `json:"email"`
+	PasswordHash  string    `json:"password_hash"`
+	Role          string    `json:"role"`
+	TokenVersion  int32     `json:"token_version"`
+	IsActive      bool      `json:"is_active"`
+	TOTPSecret    string    `json:"-"` // encrypted by the auth service
+	TOTPEnabled   bool      `json:"totp_enabled"`
+	EmailVerified bool      `json:"email_verified"`
+	PendingEmail  string    `json:"pending_email"` // empty unless an email change waits for verification
+	Phone         string    `json:"phone"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// ProfileUpdate lists the profile fields to change, nil fields are left as they are
+type ProfileUpdate struct {
+	Name  *string
+	Email *string
+	Phone *string
 }
 
 type Service interface {
 	PostAccount(ctx context.Context, name string, email string, passwordHash string, role string) (*Account, error)
 	GetAccount(ctx context.Context, id string) (*Account, error)
 	GetAccounts(ctx context.Context, skip uint64, take uint64) ([]Account, error)
+	SearchAccounts(ctx context.Context, filter AccountFilter, first int, after string) (*AccountPage, error)
 	GetEmail(ctx context.Context, id string) (string, error)
 	GetEmailForAuth(ctx context.Context, email string) (*Account, error)
 	IncrementTokenVersion(ctx context.Context, userID string) error
@@ -29,6 +62,22 @@ type Service interface {
 	DeactivateAccount(ctx context.Context, userID string) error
 	ReactivateAccount(ctx context.Context, userID string) error
 	DeleteAccount(ctx context.Context, userID string) error
+	EraseAccount(ctx context.Context, userID string) error
+	GetTOTP(ctx context.Context, userID string) (string, bool, error)
+	UpdateTOTP(ctx context.Context, userID string, encryptedSecret string, enabled bool) error
+	MarkEmailVerified(ctx context.Context, userID string, email string) (bool, error)
+	GetRolePermissions(ctx context.Context, role string) ([]string, error)
+	UpdateProfile(ctx context.Context, userID string, update ProfileUpdate) (*Account, error)
+	ChangeRole(ctx context.Context, userID string, role string) (*Account, error)
+	GetAccountHistory(ctx context.Context, userID string, limit int) ([]AccountEvent, error)
+	AddAddress(ctx context.Context, userID string, address Address) (*Address, error)
+	ListAddresses(ctx context.Context, userID string) ([]Address, error)
+	GetAddress(ctx context.Context, userID string, id string) (*Address, error)
+	UpdateAddress(ctx context.Context, userID string, address Address) (*Address, error)
+	DeleteAddress(ctx context.Context, userID string, id string) error
+	SetDefaultAddress(ctx context.Context, userID string, id string) (*Address, error)
+	ImportAccounts(ctx context.Context, r io.Reader, opts ImportOptions) (*ImportReport, error)
+	ExportAccounts(ctx context.Context, filter AccountFilter, format string, w io.Writer) (int, error)
 }
 
 type accountService struct {
@@ -67,6 +116,7 @@ func (a *accountService) PostAccount(ctx context.Context, name string, email, pl
 		PasswordHash: hashedPassword,
 		Role:         role,
 		TokenVersion: 1,
+		CreatedAt:    time.Now().UTC(),
 	}
 	err = a.repo.CreateAccount(ctx, *account)
 	if err != nil {
@@ -98,7 +148,7 @@ func (a *accountService) GetAccounts(ctx context.Context, skip uint64, take uint
 		logger.Uint64ToStr(skip) + ", take=" +
 		logger.Uint64ToStr(take))
 
-	if skip > 100 || (take == 0 && skip == 0) {
+	if take == 0 || take > 100 {
 		take = 100
 	}
 
@@ -181,7 +231,6 @@ func (a *accountService) ReactivateAccount(ctx context.Context, userID string) e
 	return a.repo.ReactivateAccount(ctx, userID)
 }
 
-
 func (a *accountService) DeleteAccount(ctx context.Context, userID string) error {
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("Got delete account request in service for user: " + userID)
@@ -189,4 +238,128 @@ func (a *accountService) DeleteAccount(ctx context.Context, userID string) error
 	return a.repo.DeleteAccount(ctx, userID)
 }
 
+// EraseAccount anonymizes the account on a right to erasure request. An account that no longer
+// exists has nothing left to erase, so a retried erasure does not fail
+func (a *accountService) EraseAccount(ctx context.Context, userID string) error {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Got erase account request in service for user: " + userID)
+
+	if err := a.repo.EraseAccount(ctx, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			Logs.Info(ctx, "Account to erase does not exist: "+userID)
+			return nil
+		}
+		Logs.Error(ctx, "Failed to erase account: "+err.Error())
+		return err
+	}
+
+	Logs.Info(ctx, "Erased account: "+userID)
+	return nil
+}
+
+func (a *accountService) GetTOTP(ctx context.Context, userID string) (string, bool, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Got TOTP request in service for user: " + userID)
+
+	return a.repo.GetTOTP(ctx, userID)
+}
+
+func (a *accountService) UpdateTOTP(ctx context.Context, userID string, encryptedSecret string, enabled bool) error {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Got update TOTP request in service for user: " + userID)
+
+	return a.repo.UpdateTOTP(ctx, userID, encryptedSecret, enabled)
+}
+
+// MarkEmailVerified reports whether the link confirmed a pending email change, the email
+// then differs from the one in tokens issued before
+func (a *accountService) MarkEmailVerified(ctx context.Context, userID string, email string) (bool, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Got mark email verified request in service for user: " + userID)
+
+	// Step 1: The usual case, the link was sent to the current email
+	err := a.repo.MarkEmailVerified(ctx, userID, email)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+
+	// Step 2: Otherwise it may have been sent to the email the user asked to change to
+	if err := a.repo.ConfirmEmailChange(ctx, userID, email); err != nil {
+		return false, err
+	}
+	Logs.Info(ctx, "Email changed for user: "+userID)
+	return true, nil
+}
+
+func (a *accountService) GetRolePermissions(ctx context.Context, role string) ([]string, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Got role permissions request in service for role: " + role)
+
+	return a.repo.GetRolePermissions(ctx, role)
+}
+
+func (a *accountService) UpdateProfile(ctx context.Context, userID string, update ProfileUpdate) (*Account, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Got update profile request in service for user: " + userID)
+
+	acc, err := a.repo.GetAccountByID(ctx, userID)
+	if err != nil {
+		Logs.Error(ctx, "Failed to get account by ID: "+err.Error())
+		return nil, err
+	}
+
+	// Step 1: Name and phone are changed straight away
+	if update.Name != nil {
+		name := strings.TrimSpace(*update.Name)
+		if name == "" || utf8.RuneCountInString(name) > maxNameLength {
+			return nil, errInvalidName
+		}
+		acc.Name = name
+	}
+	if update.Phone != nil {
+		acc.Phone = strings.TrimSpace(*update.Phone)
+	}
+
+	// Step 2: A new email only becomes the login once its owner opens the verification link,
+	// asking for the current email again cancels a pending change
+	if update.Email != nil {
+		email := strings.TrimSpace(*update.Email)
+		switch {
+		case email == acc.Email:
+			acc.PendingEmail = ""
+		case email != acc.PendingEmail:
+			if _, err := a.repo.GetAccountForAuth(ctx, email); err == nil {
+				return nil, errEmailTaken
+			} else if !errors.Is(err, sql.ErrNoRows) {
+				return nil, err
+			}
+			acc.PendingEmail = email
+		}
+	}
+
+	if err := a.repo.UpdateProfile(ctx, *acc); err != nil {
+		Logs.Error(ctx, "Failed to update profile: "+err.Error())
+		return nil, err
+	}
+
+	Logs.Info(ctx, "Updated profile of user: "+userID)
+	return acc, nil
+}
+
+// ChangeRole grants the account another role, tokens issued before no longer verify
+func (a *accountService) ChangeRole(ctx context.Context, userID string, role string) (*Account, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Got change role request in service for user: " + userID)
 
+	role = strings.TrimSpace(role)
+	if role == "" {
+		return nil, errUnknownRole
+	}
+	if err := a.repo.ChangeRole(ctx, userID, role); err != nil {
+		Logs.Error(ctx, "Failed to change role: "+err.Error())
+		return nil, err
+	}
+
+	Logs.Info(ctx, "Changed role of user "+userID+" to "+role)
+	return a.repo.GetAccountByID(ctx, userID)
+}
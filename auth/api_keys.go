@@ -0,0 +1,242 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"github.com/zenvisjr/building-scalable-microservices/account"
+	"github.com/zenvisjr/building-scalable-microservices/auth/pb"
+	"github.com/zenvisjr/building-scalable-microservices/logger"
+)
+
+const (
+	// ServiceAccountRole is the role of every principal authenticated with an API key
+	ServiceAccountRole = "service_account"
+
+	// apiKeyPrefix marks our keys so secret scanners and humans can recognise them
+	apiKeyPrefix = "zk_"
+	// apiKeyDisplayLength is how much of a key is kept in plain text to tell keys apart
+	apiKeyDisplayLength = 10
+	// apiKeyManagePermission cannot be granted to a key, keys must not mint more keys
+	apiKeyManagePermission = "apikey:manage"
+)
+
+var (
+	errAPIKeyNotFound = errors.New("API key not found, revoked or expired")
+	errInvalidAPIKey  = errors.New("invalid API key")
+)
+
+// APIKeyConfig controls the lifetime of API keys
+type APIKeyConfig struct {
+	DefaultTTL    time.Duration // expiry of keys created without one
+	MaxTTL        time.Duration // longest expiry a key can be created with
+	RotationGrace time.Duration // how long the previous key keeps working after a rotation
+}
+
+// APIKey is a key of a service account. The key itself is only known when it is created or rotated
+type APIKey struct {
+	ID         string
+	Name       string
+	Prefix     string
+	Scopes     []string
+	CreatedBy  string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	LastUsedAt time.Time // zero if the key was never used
+	RevokedAt  time.Time // zero unless revoked
+}
+
+func generateAPIKey() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// hashAPIKey is what gets stored, a leaked table cannot be used to call the API
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// creatorPermissions returns the permissions the creator of a key holds right now, none when
+// their account is deactivated
+func creatorPermissions(ctx context.Context, userId string, ac *account.Client) (map[string]bool, error) {
+	acc, err := ac.GetAccount(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	if !acc.IsActive {
+		return map[string]bool{}, nil
+	}
+	granted, err := ac.GetRolePermissions(ctx, acc.Role)
+	if err != nil {
+		return nil, err
+	}
+	allowed := make(map[string]bool, len(granted))
+	for _, permission := range granted {
+		allowed[permission] = true
+	}
+	return allowed, nil
+}
+
+// checkScopes makes sure the creator only hands out permissions they hold themselves
+func (s *authService) checkScopes(ctx context.Context, userId string, scopes []string, ac *account.Client) error {
+	if len(scopes) == 0 {
+		return errors.New("an API key needs at least one scope")
+	}
+
+	allowed, err := creatorPermissions(ctx, userId, ac)
+	if err != nil {
+		return err
+	}
+
+	for _, scope := range scopes {
+		if scope == apiKeyManagePermission {
+			return errors.New("API keys cannot be granted " + apiKeyManagePermission)
+		}
+		if !allowed[scope] {
+			return errors.New("cannot grant scope " + scope + ", you do not have that permission")
+		}
+	}
+	return nil
+}
+
+func (s *authService) CreateAPIKey(ctx context.Context, userId string, name string, scopes []string, ttl time.Duration, ac *account.Client) (*APIKey, string, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.Info(ctx, "CreateAPIKey called by user: "+userId+" for service account: "+name)
+
+	// Step 1: Every key expires
+	if ttl <= 0 {
+		ttl = s.apiKeys.DefaultTTL
+	}
+	if ttl > s.apiKeys.MaxTTL {
+		return nil, "", errors.New("API key expiry is longer than allowed, the maximum is " + s.apiKeys.MaxTTL.String())
+	}
+
+	// Step 2: Scopes can not exceed the permissions of the creator
+	if err := s.checkScopes(ctx, userId, scopes, ac); err != nil {
+		Logs.Warn(ctx, "API key scopes rejected: "+err.Error())
+		return nil, "", err
+	}
+
+	// Step 3: Generate the key, only its hash is stored
+	secret, err := generateAPIKey()
+	if err != nil {
+		Logs.Error(ctx, "Failed to generate API key: "+err.Error())
+		return nil, "", err
+	}
+	now := time.Now()
+	key := &APIKey{
+		ID:        ksuid.New().String(),
+		Name:      name,
+		Prefix:    secret[:apiKeyDisplayLength],
+		Scopes:    scopes,
+		CreatedBy: userId,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	if err := s.repository.CreateAPIKey(ctx, key, hashAPIKey(secret)); err != nil {
+		Logs.Error(ctx, "Failed to store API key: "+err.Error())
+		return nil, "", err
+	}
+
+	if err := s.repository.RecordSecurityEvent(ctx, userId, "api_key_created", "API key "+key.ID+" for "+name); err != nil {
+		Logs.Error(ctx, "Failed to record security event: "+err.Error())
+	}
+	return key, secret, nil
+}
+
+func (s *authService) ListAPIKeys(ctx context.Context) ([]*APIKey, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("ListAPIKeys called")
+
+	keys, err := s.repository.ListAPIKeys(ctx)
+	if err != nil {
+		Logs.Error(ctx, "Failed to list API keys: "+err.Error())
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *authService) RotateAPIKey(ctx context.Context, userId string, id string) (*APIKey, string, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.Info(ctx, "RotateAPIKey called by user: "+userId+" for key: "+id)
+
+	// Step 1: Generate the successor, the old key keeps working for the grace period
+	secret, err := generateAPIKey()
+	if err != nil {
+		Logs.Error(ctx, "Failed to generate API key: "+err.Error())
+		return nil, "", err
+	}
+	key, err := s.repository.RotateAPIKey(ctx, id, secret[:apiKeyDisplayLength], hashAPIKey(secret), time.Now().Add(s.apiKeys.RotationGrace))
+	if err != nil {
+		Logs.Error(ctx, "Failed to rotate API key: "+err.Error())
+		return nil, "", err
+	}
+
+	// Step 2: Audit
+	if err := s.repository.RecordSecurityEvent(ctx, userId, "api_key_rotated", "API key "+id); err != nil {
+		Logs.Error(ctx, "Failed to record security event: "+err.Error())
+	}
+	return key, secret, nil
+}
+
+func (s *authService) RevokeAPIKey(ctx context.Context, userId string, id string) (*pb.UpdateAccountResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.Info(ctx, "RevokeAPIKey called by user: "+userId+" for key: "+id)
+
+	if err := s.repository.RevokeAPIKey(ctx, id); err != nil {
+		Logs.Error(ctx, "Failed to revoke API key: "+err.Error())
+		return nil, err
+	}
+	if err := s.repository.RecordSecurityEvent(ctx, userId, "api_key_revoked", "API key "+id); err != nil {
+		Logs.Error(ctx, "Failed to record security event: "+err.Error())
+	}
+	return &pb.UpdateAccountResponse{Message: "API key revoked successfully"}, nil
+}
+
+// VerifyAPIKey turns a key into the claims of its service account. The permissions of the
+// principal are the scopes of the key its creator still holds, so a key loses what its creator
+// loses with a role change, and stops working once they are deactivated or deleted
+func (s *authService) VerifyAPIKey(ctx context.Context, secret string, ac *account.Client) (*UserClaims, error) {
+	Logs := logger.GetGlobalLogger()
+
+	// Step 1: The key itself
+	key, err := s.repository.UseAPIKey(ctx, hashAPIKey(secret))
+	if err != nil {
+		Logs.Warn(ctx, "API key rejected: "+err.Error())
+		return nil, errInvalidAPIKey
+	}
+
+	// Step 2: What its creator may do today
+	allowed, err := creatorPermissions(ctx, key.CreatedBy, ac)
+	if err != nil {
+		Logs.Warn(ctx, "API key "+key.ID+" rejected, its creator could not be loaded: "+err.Error())
+		return nil, errInvalidAPIKey
+	}
+	permissions := []string{}
+	for _, scope := range key.Scopes {
+		if allowed[scope] {
+			permissions = append(permissions, scope)
+		}
+	}
+	if len(permissions) == 0 {
+		Logs.Warn(ctx, "API key "+key.ID+" rejected, its creator "+key.CreatedBy+" no longer holds any of its scopes")
+		return nil, errInvalidAPIKey
+	}
+
+	return &UserClaims{
+		ID:             key.ID,
+		Role:           ServiceAccountRole,
+		Permissions:    permissions,
+		ServiceAccount: key.Name,
+	}, nil
+}
@@ -3,11 +3,14 @@ package auth
 import (
 	"context"
 	"errors"
+	"time"
 
+	"github.com/zenvisjr/building-scalable-microservices/account"
 	"github.com/zenvisjr/building-scalable-microservices/auth/pb"
 	"github.com/zenvisjr/building-scalable-microservices/logger"
+	"github.com/zenvisjr/building-scalable-microservices/svcauth"
+	"github.com/zenvisjr/building-scalable-microservices/tlsconfig"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
 type Client struct {
@@ -15,11 +18,17 @@ type Client struct {
 	service pb.AuthServiceClient
 }
 
-func NewClient(address string) (*Client, error) {
+func NewClient(address string, opts ...grpc.DialOption) (*Client, error) {
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("Connecting to Auth gRPC service at " + address)
 
-	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	creds, err := tlsconfig.DialOption()
+	if err != nil {
+		Logs.Warn(context.Background(), "Failed to load TLS config for Auth gRPC: "+err.Error())
+		return nil, err
+	}
+
+	conn, err := grpc.NewClient(address, append([]grpc.DialOption{creds, svcauth.DialOption()}, opts...)...)
 	if err != nil {
 		Logs.Error(context.Background(), "Failed to connect to Auth service: "+err.Error())
 		return nil, err
@@ -38,31 +47,37 @@ func (c *Client) Close() {
 	c.conn.Close()
 }
 
-func (c *Client) Signup(ctx context.Context, name string, email string, password string, role string) (*pb.AuthResponse, error) {
+func (c *Client) Signup(ctx context.Context, name string, email string, password string, role string, info SessionInfo) (*pb.AuthResponse, error) {
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("Calling Auth gRPC service")
 	return c.service.Signup(ctx, &pb.SignupRequest{
-		Name:     name,
-		Email:    email,
-		Password: password,
-		Role:     role,
+		Name:      name,
+		Email:     email,
+		Password:  password,
+		Role:      role,
+		ClientIp:  info.IPAddress,
+		UserAgent: info.UserAgent,
+		Device:    info.Device,
 	})
 }
 
-func (c *Client) Login(ctx context.Context, email string, password string) (*pb.AuthResponse, error) {
+func (c *Client) Login(ctx context.Context, email string, password string, info SessionInfo) (*pb.LoginResponse, error) {
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("Calling Auth gRPC service")
 	return c.service.Login(ctx, &pb.LoginRequest{
-		Email:    email,
-		Password: password,
+		Email:     email,
+		Password:  password,
+		ClientIp:  info.IPAddress,
+		UserAgent: info.UserAgent,
+		Device:    info.Device,
 	})
 }
 
-func (c *Client) RefreshToken(ctx context.Context, userId string) (*pb.AuthResponse, error) {
+func (c *Client) RefreshToken(ctx context.Context, refreshToken string) (*pb.AuthResponse, error) {
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("Calling Auth gRPC service")
 	return c.service.RefreshToken(ctx, &pb.RefreshRequest{
-		UserId: userId,
+		RefreshToken: refreshToken,
 	})
 }
 
@@ -73,9 +88,23 @@ type UserClaims struct {
 	Email string
 	Role  string
 	TokenVersion int32
+	SessionID string
+	Permissions  []string
+	// ServiceAccount is the name of the service account of an API key, empty for users
+	ServiceAccount string
 	// Name  string // optional
 }
 
+// HasPermission reports whether the token grants permission
+func (u *UserClaims) HasPermission(permission string) bool {
+	for _, granted := range u.Permissions {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Client) VerifyToken(ctx context.Context, token string) (*UserClaims, error) {
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("Verifying token in auth client...")
@@ -96,10 +125,70 @@ func (c *Client) VerifyToken(ctx context.Context, token string) (*UserClaims, er
 		ID:    resp.UserId,
 		Email: resp.Email,
 		Role:  resp.Role,
+		SessionID: resp.SessionId,
+		Permissions: resp.Permissions,
 				// Name: resp.Name, // only if your proto includes it
 	}, nil
 }
 
+// Introspect reports whether a token is active and what it grants, without failing on bad tokens
+func (c *Client) Introspect(ctx context.Context, token string) (*TokenIntrospection, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Introspecting token in auth client...")
+	resp, err := c.service.Introspect(ctx, &pb.IntrospectRequest{Token: token})
+	if err != nil {
+		Logs.Error(ctx, "Failed to introspect token: "+err.Error())
+		return nil, err
+	}
+	if !resp.Active {
+		return &TokenIntrospection{Active: false}, nil
+	}
+
+	introspection := &TokenIntrospection{
+		Active: true,
+		Claims: &UserClaims{
+			ID:          resp.Sub,
+			Email:       resp.Email,
+			Role:        resp.Role,
+			SessionID:   resp.SessionId,
+			Permissions: resp.Scopes,
+		},
+		TokenType: resp.TokenType,
+		ExpiresAt: resp.Exp.AsTime(),
+	}
+	if resp.Iat != nil {
+		introspection.IssuedAt = resp.Iat.AsTime()
+	}
+	return introspection, nil
+}
+
+// VerifyBatch verifies many tokens in one call, results are in the order of tokens
+func (c *Client) VerifyBatch(ctx context.Context, tokens []string) ([]*TokenVerification, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Verifying token batch in auth client...")
+	resp, err := c.service.VerifyBatch(ctx, &pb.VerifyBatchRequest{AccessTokens: tokens})
+	if err != nil {
+		Logs.Error(ctx, "Failed to verify token batch: "+err.Error())
+		return nil, err
+	}
+
+	verifications := make([]*TokenVerification, 0, len(resp.Results))
+	for _, result := range resp.Results {
+		if !result.Valid {
+			verifications = append(verifications, &TokenVerification{Err: errors.New(result.Error)})
+			continue
+		}
+		verifications = append(verifications, &TokenVerification{Claims: &UserClaims{
+			ID:          result.User.UserId,
+			Email:       result.User.Email,
+			Role:        result.User.Role,
+			SessionID:   result.User.SessionId,
+			Permissions: result.User.Permissions,
+		}})
+	}
+	return verifications, nil
+}
+
 func (c *Client) Logout(ctx context.Context, userId string) (*pb.LogoutResponse, error) {
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("Calling Auth gRPC service for logout")
@@ -180,4 +269,357 @@ func (c *Client) DeleteAccount(ctx context.Context, userId string) (*pb.UpdateAc
 		return nil, err
 	}
 	return resp, nil
-}
\ No newline at end of file
+}
+
+func (c *Client) UnlockAccount(ctx context.Context, email string) (*pb.UpdateAccountResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Calling Auth gRPC service for unlock account: " + email)
+	resp, err := c.service.UnlockAccount(ctx, &pb.UnlockAccountRequest{
+		Email: email,
+	})
+	if err != nil {
+		Logs.Error(ctx, "Failed to unlock account: "+err.Error())
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *Client) GetJWKS(ctx context.Context) (*JWKS, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Calling Auth gRPC service for JWKS")
+	resp, err := c.service.GetJWKS(ctx, &pb.GetJWKSRequest{})
+	if err != nil {
+		Logs.Error(ctx, "Failed to fetch JWKS: "+err.Error())
+		return nil, err
+	}
+
+	jwks := &JWKS{Keys: make([]JWK, 0, len(resp.Keys))}
+	for _, key := range resp.Keys {
+		jwks.Keys = append(jwks.Keys, JWK{
+			Kid: key.Kid,
+			Kty: key.Kty,
+			Alg: key.Alg,
+			Use: key.Use,
+			N:   key.N,
+			E:   key.E,
+			Crv: key.Crv,
+			X:   key.X,
+		})
+	}
+	return jwks, nil
+}
+
+func (c *Client) ListSessions(ctx context.Context, userId string) ([]*Session, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Calling Auth gRPC service for sessions")
+	resp, err := c.service.ListSessions(ctx, &pb.ListSessionsRequest{
+		UserId: userId,
+	})
+	if err != nil {
+		Logs.Error(ctx, "Failed to list sessions: "+err.Error())
+		return nil, err
+	}
+
+	sessions := make([]*Session, 0, len(resp.Sessions))
+	for _, session := range resp.Sessions {
+		sessions = append(sessions, &Session{
+			ID:         session.Id,
+			UserID:     userId,
+			Device:     session.Device,
+			IPAddress:  session.IpAddress,
+			UserAgent:  session.UserAgent,
+			CreatedAt:  session.CreatedAt.AsTime(),
+			LastSeenAt: session.LastSeenAt.AsTime(),
+			ExpiresAt:  session.ExpiresAt.AsTime(),
+		})
+	}
+	return sessions, nil
+}
+
+func (c *Client) RevokeSession(ctx context.Context, userId string, sessionId string) (*pb.UpdateAccountResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Calling Auth gRPC service to revoke session")
+	return c.service.RevokeSession(ctx, &pb.RevokeSessionRequest{
+		UserId:    userId,
+		SessionId: sessionId,
+	})
+}
+
+func (c *Client) EnrollTOTP(ctx context.Context, userId string) (*pb.EnrollTOTPResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Calling Auth gRPC service to enroll TOTP")
+	return c.service.EnrollTOTP(ctx, &pb.EnrollTOTPRequest{
+		UserId: userId,
+	})
+}
+
+func (c *Client) ConfirmTOTP(ctx context.Context, userId string, code string) (*pb.ConfirmTOTPResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Calling Auth gRPC service to confirm TOTP")
+	return c.service.ConfirmTOTP(ctx, &pb.ConfirmTOTPRequest{
+		UserId: userId,
+		Code:   code,
+	})
+}
+
+func (c *Client) VerifyLoginChallenge(ctx context.Context, challengeToken string, code string, info SessionInfo) (*pb.AuthResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Calling Auth gRPC service to verify login challenge")
+	return c.service.VerifyLoginChallenge(ctx, &pb.VerifyLoginChallengeRequest{
+		ChallengeToken: challengeToken,
+		Code:           code,
+		ClientIp:       info.IPAddress,
+		UserAgent:      info.UserAgent,
+		Device:         info.Device,
+	})
+}
+
+func (c *Client) RequestPasswordReset(ctx context.Context, email string) (*pb.UpdateAccountResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Calling Auth gRPC service to request password reset")
+	return c.service.RequestPasswordReset(ctx, &pb.RequestPasswordResetRequest{
+		Email: email,
+	})
+}
+
+func (c *Client) ConfirmPasswordReset(ctx context.Context, token string, newPassword string) (*pb.UpdateAccountResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Calling Auth gRPC service to confirm password reset")
+	return c.service.ConfirmPasswordReset(ctx, &pb.ConfirmPasswordResetRequest{
+		Token:       token,
+		NewPassword: newPassword,
+	})
+}
+
+func (c *Client) VerifyEmail(ctx context.Context, token string) (*pb.UpdateAccountResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Calling Auth gRPC service to verify email")
+	return c.service.VerifyEmail(ctx, &pb.VerifyEmailRequest{
+		Token: token,
+	})
+}
+
+func (c *Client) ResendVerificationEmail(ctx context.Context, userId string) (*pb.UpdateAccountResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Calling Auth gRPC service to resend verification email: " + userId)
+	return c.service.ResendVerificationEmail(ctx, &pb.UpdateAccountRequest{
+		UserId: userId,
+	})
+}
+
+// UpdateProfile changes the given fields of the user's profile, a new email has to be verified first
+func (c *Client) UpdateProfile(ctx context.Context, userId string, update account.ProfileUpdate) (*pb.UpdateAccountResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Calling Auth gRPC service to update profile: " + userId)
+	return c.service.UpdateProfile(ctx, &pb.UpdateProfileRequest{
+		UserId: userId,
+		Name:   update.Name,
+		Email:  update.Email,
+		Phone:  update.Phone,
+	})
+}
+
+// CreateAPIKey returns the new key and its secret, the secret cannot be retrieved again
+func (c *Client) CreateAPIKey(ctx context.Context, userId string, name string, scopes []string, ttl time.Duration) (*APIKey, string, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Calling Auth gRPC service to create API key")
+	resp, err := c.service.CreateAPIKey(ctx, &pb.CreateAPIKeyRequest{
+		UserId:     userId,
+		Name:       name,
+		Scopes:     scopes,
+		TtlSeconds: int64(ttl.Seconds()),
+	})
+	if err != nil {
+		Logs.Error(ctx, "Failed to create API key: "+err.Error())
+		return nil, "", err
+	}
+	return apiKeyFromProto(resp.ApiKey), resp.Key, nil
+}
+
+func (c *Client) ListAPIKeys(ctx context.Context) ([]*APIKey, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Calling Auth gRPC service to list API keys")
+	resp, err := c.service.ListAPIKeys(ctx, &pb.ListAPIKeysRequest{})
+	if err != nil {
+		Logs.Error(ctx, "Failed to list API keys: "+err.Error())
+		return nil, err
+	}
+
+	keys := make([]*APIKey, 0, len(resp.ApiKeys))
+	for _, key := range resp.ApiKeys {
+		keys = append(keys, apiKeyFromProto(key))
+	}
+	return keys, nil
+}
+
+func (c *Client) RotateAPIKey(ctx context.Context, userId string, id string) (*APIKey, string, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Calling Auth gRPC service to rotate API key")
+	resp, err := c.service.RotateAPIKey(ctx, &pb.APIKeyRequest{
+		UserId: userId,
+		Id:     id,
+	})
+	if err != nil {
+		Logs.Error(ctx, "Failed to rotate API key: "+err.Error())
+		return nil, "", err
+	}
+	return apiKeyFromProto(resp.ApiKey), resp.Key, nil
+}
+
+func (c *Client) RevokeAPIKey(ctx context.Context, userId string, id string) (*pb.UpdateAccountResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Calling Auth gRPC service to revoke API key")
+	return c.service.RevokeAPIKey(ctx, &pb.APIKeyRequest{
+		UserId: userId,
+		Id:     id,
+	})
+}
+
+// VerifyAPIKey returns the claims of the service account the key belongs to
+func (c *Client) VerifyAPIKey(ctx context.Context, key string) (*UserClaims, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Verifying API key in auth client...")
+	resp, err := c.service.VerifyAPIKey(ctx, &pb.VerifyAPIKeyRequest{Key: key})
+	if err != nil {
+		Logs.Error(ctx, "Failed to verify API key: "+err.Error())
+		return nil, err
+	}
+
+	return &UserClaims{
+		ID:             resp.UserId,
+		Role:           resp.Role,
+		Permissions:    resp.Permissions,
+		ServiceAccount: resp.ServiceAccount,
+	}, nil
+}
+
+// StartOIDCLogin returns the provider URL to send the browser to and the state it will come back with
+func (c *Client) StartOIDCLogin(ctx context.Context, provider string) (*OIDCAuthorization, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Starting OIDC login with " + provider + " in auth client...")
+	resp, err := c.service.StartOIDCLogin(ctx, &pb.StartOIDCLoginRequest{Provider: provider})
+	if err != nil {
+		Logs.Error(ctx, "Failed to start OIDC login: "+err.Error())
+		return nil, err
+	}
+	return &OIDCAuthorization{URL: resp.AuthorizationUrl, State: resp.State}, nil
+}
+
+// CompleteOIDCLogin finishes the login with the code the provider redirected back with
+func (c *Client) CompleteOIDCLogin(ctx context.Context, provider string, state string, code string, info SessionInfo) (*pb.LoginResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Completing OIDC login with " + provider + " in auth client...")
+	return c.service.CompleteOIDCLogin(ctx, &pb.CompleteOIDCLoginRequest{
+		Provider:  provider,
+		State:     state,
+		Code:      code,
+		ClientIp:  info.IPAddress,
+		UserAgent: info.UserAgent,
+		Device:    info.Device,
+	})
+}
+
+func apiKeyFromProto(key *pb.APIKey) *APIKey {
+	apiKey := &APIKey{
+		ID:        key.Id,
+		Name:      key.Name,
+		Prefix:    key.Prefix,
+		Scopes:    key.Scopes,
+		CreatedBy: key.CreatedBy,
+		CreatedAt: key.CreatedAt.AsTime(),
+		ExpiresAt: key.ExpiresAt.AsTime(),
+	}
+	if key.LastUsedAt != nil {
+		apiKey.LastUsedAt = key.LastUsedAt.AsTime()
+	}
+	if key.RevokedAt != nil {
+		apiKey.RevokedAt = key.RevokedAt.AsTime()
+	}
+	return apiKey
+}
+
+// ExportAccountData returns the record of the export and the JSON archive with the data of the user
+func (c *Client) ExportAccountData(ctx context.Context, userId string, requestedBy string) (*PrivacyRequest, []byte, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Calling Auth gRPC service to export account data")
+	resp, err := c.service.ExportAccountData(ctx, &pb.PrivacyActionRequest{
+		UserId:      userId,
+		RequestedBy: requestedBy,
+	})
+	if err != nil {
+		Logs.Error(ctx, "Failed to export account data: "+err.Error())
+		return nil, nil, err
+	}
+	return privacyRequestFromProto(resp.Request), resp.Archive, nil
+}
+
+func (c *Client) RequestErasure(ctx context.Context, userId string, requestedBy string) (*PrivacyRequest, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Calling Auth gRPC service to request account erasure")
+	resp, err := c.service.RequestErasure(ctx, &pb.PrivacyActionRequest{
+		UserId:      userId,
+		RequestedBy: requestedBy,
+	})
+	if err != nil {
+		Logs.Error(ctx, "Failed to request account erasure: "+err.Error())
+		return nil, err
+	}
+	return privacyRequestFromProto(resp.Request), nil
+}
+
+func (c *Client) CancelErasure(ctx context.Context, userId string, cancelledBy string) (*PrivacyRequest, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Calling Auth gRPC service to cancel account erasure")
+	resp, err := c.service.CancelErasure(ctx, &pb.PrivacyActionRequest{
+		UserId:      userId,
+		RequestedBy: cancelledBy,
+	})
+	if err != nil {
+		Logs.Error(ctx, "Failed to cancel account erasure: "+err.Error())
+		return nil, err
+	}
+	return privacyRequestFromProto(resp.Request), nil
+}
+
+func (c *Client) ListPrivacyRequests(ctx context.Context, userId string) ([]*PrivacyRequest, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Calling Auth gRPC service to list privacy requests")
+	resp, err := c.service.ListPrivacyRequests(ctx, &pb.UpdateAccountRequest{UserId: userId})
+	if err != nil {
+		Logs.Error(ctx, "Failed to list privacy requests: "+err.Error())
+		return nil, err
+	}
+
+	requests := make([]*PrivacyRequest, 0, len(resp.Requests))
+	for _, request := range resp.Requests {
+		requests = append(requests, privacyRequestFromProto(request))
+	}
+	return requests, nil
+}
+
+func privacyRequestFromProto(request *pb.PrivacyRequest) *PrivacyRequest {
+	result := &PrivacyRequest{
+		ID:          request.Id,
+		UserID:      request.UserId,
+		Kind:        request.Kind,
+		Status:      request.Status,
+		RequestedBy: request.RequestedBy,
+		CreatedAt:   request.CreatedAt.AsTime(),
+		Steps:       make([]*PrivacyRequestStep, 0, len(request.Steps)),
+	}
+	if request.ScheduledFor != nil {
+		result.ScheduledFor = request.ScheduledFor.AsTime()
+	}
+	if request.CompletedAt != nil {
+		result.CompletedAt = request.CompletedAt.AsTime()
+	}
+	for _, step := range request.Steps {
+		result.Steps = append(result.Steps, &PrivacyRequestStep{
+			Step:      step.Step,
+			Status:    step.Status,
+			Details:   step.Details,
+			CreatedAt: step.CreatedAt.AsTime(),
+		})
+	}
+	return result
+}
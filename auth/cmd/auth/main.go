@@ -2,16 +2,54 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/avast/retry-go"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/zenvisjr/building-scalable-microservices/auth"
 	"github.com/zenvisjr/building-scalable-microservices/logger"
+	"github.com/zenvisjr/building-scalable-microservices/migrate"
+	"github.com/zenvisjr/building-scalable-microservices/svcauth"
 )
 
 type Config struct {
-	DatabaseURL string `envconfig:"DATABASE_URL"`
+	DatabaseURL         string            `envconfig:"DATABASE_URL"`
+	MigrateOnStart      bool              `envconfig:"MIGRATE_ON_START" default:"true"`
+	MaxFailedAttempts   int               `envconfig:"LOGIN_MAX_FAILED_ATTEMPTS" default:"5"`
+	MaxIPFailedAttempts int               `envconfig:"LOGIN_MAX_IP_FAILED_ATTEMPTS" default:"20"`
+	FailureWindow       time.Duration     `envconfig:"LOGIN_FAILURE_WINDOW" default:"15m"`
+	BaseLockout         time.Duration     `envconfig:"LOGIN_BASE_LOCKOUT" default:"1m"`
+	MaxLockout          time.Duration     `envconfig:"LOGIN_MAX_LOCKOUT" default:"24h"`
+	SigningKeyFile      string            `envconfig:"JWT_SIGNING_KEY_FILE"`
+	SigningKeyID        string            `envconfig:"JWT_SIGNING_KEY_ID"`
+	EphemeralKeyDev     bool              `envconfig:"JWT_EPHEMERAL_KEY_DEV" default:"false"`
+	VerificationKeys    map[string]string `envconfig:"JWT_VERIFICATION_KEY_FILES"` // kid:path of retired keys still accepted
+	JWKSPort            int               `envconfig:"JWKS_HTTP_PORT" default:"8081"`
+	AccessTokenTTL      time.Duration     `envconfig:"ACCESS_TOKEN_TTL" default:"15m"`
+	RefreshTokenTTL     time.Duration     `envconfig:"REFRESH_TOKEN_TTL" default:"168h"`
+	TOTPIssuer          string            `envconfig:"TOTP_ISSUER" default:"zenvis"`
+	TOTPEnrollmentRoles []string          `envconfig:"TOTP_ENROLLMENT_ROLES" default:"admin"`
+	TOTPEncryptionKey   string            `envconfig:"TOTP_ENCRYPTION_KEY"` // base64 encoded 32 byte key
+	PasswordResetTTL    time.Duration     `envconfig:"PASSWORD_RESET_TTL" default:"30m"`
+	PasswordResetURL    string            `envconfig:"PASSWORD_RESET_URL" default:"http://localhost:3000/reset-password"`
+	EmailVerifyTTL      time.Duration     `envconfig:"EMAIL_VERIFICATION_TTL" default:"24h"`
+	EmailVerifyURL      string            `envconfig:"EMAIL_VERIFICATION_URL" default:"http://localhost:3000/verify-email"`
+	EmailVerifyInterval time.Duration     `envconfig:"EMAIL_VERIFICATION_RESEND_INTERVAL" default:"1m"`
+	EmailVerifyPerDay   int               `envconfig:"EMAIL_VERIFICATION_MAX_PER_DAY" default:"5"`
+	APIKeyDefaultTTL    time.Duration     `envconfig:"API_KEY_DEFAULT_TTL" default:"2160h"`
+	APIKeyMaxTTL        time.Duration     `envconfig:"API_KEY_MAX_TTL" default:"8760h"`
+	APIKeyRotationGrace time.Duration     `envconfig:"API_KEY_ROTATION_GRACE" default:"24h"`
+	OIDCProviders       []string          `envconfig:"OIDC_PROVIDERS"` // names, each configured through OIDC_<NAME>_*
+	OIDCStateTTL        time.Duration     `envconfig:"OIDC_STATE_TTL" default:"10m"`
+	TokenVersionTTL     time.Duration     `envconfig:"TOKEN_VERSION_CACHE_TTL" default:"5m"`
+	ErasureGracePeriod  time.Duration     `envconfig:"ERASURE_GRACE_PERIOD" default:"720h"`
+	ErasureInterval     time.Duration     `envconfig:"ERASURE_CHECK_INTERVAL" default:"10m"`
+	ErasureRetryDelay   time.Duration     `envconfig:"ERASURE_RETRY_DELAY" default:"1h"`
+	ErasureMaxAttempts  int               `envconfig:"ERASURE_MAX_ATTEMPTS" default:"5"`
 }
 
 func main() {
@@ -25,9 +63,12 @@ func main() {
 		panic("Failed to initialize logger: " + err.Error())
 	}
 	defer Logs.Close()
-	Logs.LocalOnlyInfo("Starting Auth Service...")
 
-	jwtManager := auth.NewJWTManager("a-string-secret-at-least-256-bits-long", "refresh-secret-key")
+	// Identify this service to the others it calls
+	if err := svcauth.Init("auth"); err != nil {
+		Logs.Fatal(ctx, "Failed to initialize service authentication: "+err.Error())
+	}
+	Logs.LocalOnlyInfo("Starting Auth Service...")
 
 	// Load configuration
 	var config Config
@@ -35,13 +76,58 @@ func main() {
 		Logs.Fatal(ctx, "Failed to load configuration: "+err.Error())
 	}
 
+	// "app migrate ..." only migrates the database and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate.Run(ctx, config.DatabaseURL, auth.Migrations, os.Args[2:]); err != nil {
+			Logs.Fatal(ctx, "Migration failed: "+err.Error())
+		}
+		return
+	}
+
+	// Load the signing key and the retired keys that may still have valid tokens out there
+	var signingKey *auth.SigningKey
+	if config.SigningKeyFile != "" {
+		signingKey, err = auth.LoadSigningKey(config.SigningKeyID, config.SigningKeyFile)
+	} else if config.EphemeralKeyDev {
+		// only for a single replica in development
+		// every replica would sign with its own key and reject the tokens of the others
+		Logs.Warn(ctx, "JWT_EPHEMERAL_KEY_DEV is set, using an ephemeral key, tokens will not survive a restart or work across replicas")
+		signingKey, err = auth.GenerateSigningKey()
+	} else {
+		Logs.Fatal(ctx, "JWT_SIGNING_KEY_FILE is required unless JWT_EPHEMERAL_KEY_DEV is set")
+	}
+	if err != nil {
+		Logs.Fatal(ctx, "Failed to load JWT signing key: "+err.Error())
+	}
+
+	var verificationKeys []*auth.SigningKey
+	for kid, path := range config.VerificationKeys {
+		key, err := auth.LoadSigningKey(kid, path)
+		if err != nil {
+			Logs.Fatal(ctx, "Failed to load JWT verification key: "+err.Error())
+		}
+		verificationKeys = append(verificationKeys, key)
+	}
+
+	jwtManager, err := auth.NewJWTManager(config.AccessTokenTTL, config.RefreshTokenTTL, signingKey, verificationKeys...)
+	if err != nil {
+		Logs.Fatal(ctx, "Failed to create JWT manager: "+err.Error())
+	}
+	Logs.Info(ctx, "Signing tokens with key: "+signingKey.ID)
+
 	var r auth.Repository
+	var sessions auth.SessionRepository
 
 	// Retry DB connection
 	err = retry.Do(
 		func() error {
 			var err error
 			r, err = auth.NewPostgresRepository(config.DatabaseURL)
+			if err == nil {
+				if sessions, err = auth.NewPostgresSessionRepository(config.DatabaseURL); err != nil {
+					r.Close()
+				}
+			}
 			if err != nil {
 				Logs.Warn(ctx, "Failed to connect to refresh_tokens database: "+err.Error())
 			} else {
@@ -58,9 +144,111 @@ func main() {
 		Logs.Fatal(ctx, "Unrecoverable refresh_tokens DB error: "+err.Error())
 	}
 	defer r.Close()
+	defer sessions.Close()
+
+	// Bring the schema up to date before serving
+	if config.MigrateOnStart {
+		if err := migrate.Run(ctx, config.DatabaseURL, auth.Migrations, []string{"up"}); err != nil {
+			Logs.Fatal(ctx, "Failed to migrate database: "+err.Error())
+		}
+	}
+
+	// Failed login lockout, exponential backoff between BaseLockout and MaxLockout
+	lockoutPolicy := auth.LockoutPolicy{
+		MaxFailedAttempts:   config.MaxFailedAttempts,
+		MaxIPFailedAttempts: config.MaxIPFailedAttempts,
+		FailureWindow:       config.FailureWindow,
+		BaseLockout:         config.BaseLockout,
+		MaxLockout:          config.MaxLockout,
+	}
+
+	// Two-factor secrets are encrypted before they are stored in the accounts table
+	totpKey := make([]byte, 32)
+	if config.TOTPEncryptionKey != "" {
+		totpKey, err = base64.StdEncoding.DecodeString(config.TOTPEncryptionKey)
+		if err != nil {
+			Logs.Fatal(ctx, "Invalid TOTP_ENCRYPTION_KEY: "+err.Error())
+		}
+	} else {
+		Logs.Warn(ctx, "TOTP_ENCRYPTION_KEY not set, using an ephemeral key, enrolled authenticators will stop working after a restart")
+		if _, err := rand.Read(totpKey); err != nil {
+			Logs.Fatal(ctx, "Failed to generate TOTP encryption key: "+err.Error())
+		}
+	}
+	secretBox, err := auth.NewSecretBox(totpKey)
+	if err != nil {
+		Logs.Fatal(ctx, "Failed to create TOTP secret box: "+err.Error())
+	}
+	totpConfig := auth.TOTPConfig{
+		Issuer:          config.TOTPIssuer,
+		EnrollmentRoles: config.TOTPEnrollmentRoles,
+		SecretBox:       secretBox,
+	}
+
+	passwordResetConfig := auth.PasswordResetConfig{
+		TokenTTL: config.PasswordResetTTL,
+		ResetURL: config.PasswordResetURL,
+	}
+
+	emailVerificationConfig := auth.EmailVerificationConfig{
+		TokenTTL:       config.EmailVerifyTTL,
+		VerifyURL:      config.EmailVerifyURL,
+		ResendInterval: config.EmailVerifyInterval,
+		MaxPerDay:      config.EmailVerifyPerDay,
+	}
+
+	apiKeyConfig := auth.APIKeyConfig{
+		DefaultTTL:    config.APIKeyDefaultTTL,
+		MaxTTL:        config.APIKeyMaxTTL,
+		RotationGrace: config.APIKeyRotationGrace,
+	}
+
+	// Sign in with external OpenID Connect providers, e.g. OIDC_GOOGLE_ISSUER for the provider "google"
+	oidcConfig := auth.OIDCConfig{
+		Providers: make(map[string]*auth.OIDCProvider),
+		StateTTL:  config.OIDCStateTTL,
+	}
+	for _, name := range config.OIDCProviders {
+		var providerConfig auth.OIDCProviderConfig
+		if err := envconfig.Process("OIDC_"+strings.ToUpper(name), &providerConfig); err != nil {
+			Logs.Fatal(ctx, "Invalid configuration of OIDC provider "+name+": "+err.Error())
+		}
+		oidcConfig.Providers[name] = auth.NewOIDCProvider(name, providerConfig, nil)
+		Logs.Info(ctx, "Sign in with OIDC provider enabled: "+name)
+	}
+
+	// Token versions are cached between account events, the TTL bounds how long a missed event matters
+	tokenVersions := auth.NewTokenVersionCache(config.TokenVersionTTL)
+
+	// Requested erasures can be cancelled during the grace period, after it they run in the background
+	privacyConfig := auth.PrivacyConfig{
+		ErasureGracePeriod: config.ErasureGracePeriod,
+		CheckInterval:      config.ErasureInterval,
+		RetryDelay:         config.ErasureRetryDelay,
+		MaxAttempts:        config.ErasureMaxAttempts,
+	}
 
 	// Create the core AuthService
-	service := auth.NewAuthService(jwtManager, r)
+	service := auth.NewAuthService(auth.ServiceOptions{
+		JWTManager:        jwtManager,
+		Repository:        r,
+		Sessions:          sessions,
+		LockoutPolicy:     lockoutPolicy,
+		TOTP:              totpConfig,
+		PasswordReset:     passwordResetConfig,
+		EmailVerification: emailVerificationConfig,
+		APIKeys:           apiKeyConfig,
+		OIDC:              oidcConfig,
+		TokenVersions:     tokenVersions,
+		Privacy:           privacyConfig,
+	})
+
+	// Publish the public keys for services that verify tokens locally
+	go func() {
+		if err := auth.ListenJWKSHTTP(service, config.JWKSPort); err != nil {
+			Logs.Error(ctx, "JWKS HTTP server stopped: "+err.Error())
+		}
+	}()
 
 	// Start gRPC server
 	Logs.Info(ctx, "Starting gRPC server for auth service on port 8080")
@@ -0,0 +1,48 @@
+// Command fakeoidc runs a local OpenID Connect issuer that signs every user in without a
+// login page. Point an auth provider at it for development, never deploy it.
+//
+//	OIDC_PROVIDERS=fake
+//	OIDC_FAKE_ISSUER=http://localhost:9000
+//	OIDC_FAKE_CLIENT_ID=zenvis
+//	OIDC_FAKE_REDIRECT_URL=http://localhost:3000/oidc/callback
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/zenvisjr/building-scalable-microservices/auth/fakeoidc"
+)
+
+type Config struct {
+	Port          int    `envconfig:"FAKE_OIDC_PORT" default:"9000"`
+	Issuer        string `envconfig:"FAKE_OIDC_ISSUER" default:"http://localhost:9000"`
+	ClientID      string `envconfig:"FAKE_OIDC_CLIENT_ID" default:"zenvis"`
+	ClientSecret  string `envconfig:"FAKE_OIDC_CLIENT_SECRET"`
+	Subject       string `envconfig:"FAKE_OIDC_SUBJECT" default:"fake|naruto"`
+	Email         string `envconfig:"FAKE_OIDC_EMAIL" default:"naruto@leaf.com"`
+	EmailVerified bool   `envconfig:"FAKE_OIDC_EMAIL_VERIFIED" default:"true"`
+	Name          string `envconfig:"FAKE_OIDC_NAME" default:"Naruto"`
+}
+
+func main() {
+	var config Config
+	if err := envconfig.Process("", &config); err != nil {
+		log.Fatal("Failed to load configuration: " + err.Error())
+	}
+
+	issuer, err := fakeoidc.New(config.Issuer, config.ClientID, config.ClientSecret, fakeoidc.Identity{
+		Subject:       config.Subject,
+		Email:         config.Email,
+		EmailVerified: config.EmailVerified,
+		Name:          config.Name,
+	})
+	if err != nil {
+		log.Fatal("Failed to create issuer: " + err.Error())
+	}
+
+	log.Printf("Fake OIDC issuer %s signing in %s, add ?login_hint=<email> to sign in someone else", config.Issuer, config.Email)
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", config.Port), issuer.Handler()))
+}
@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/zenvisjr/building-scalable-microservices/account"
+	"github.com/zenvisjr/building-scalable-microservices/auth/pb"
+	"github.com/zenvisjr/building-scalable-microservices/logger"
+)
+
+var (
+	errEmailAlreadyVerified     = errors.New("email is already verified")
+	errInvalidVerificationToken = errors.New("invalid or expired verification link")
+	errVerificationRateLimited  = errors.New("a verification email was sent recently, please wait before requesting another")
+)
+
+// EmailVerificationConfig controls the verification link sent on signup and how often it can be resent
+type EmailVerificationConfig struct {
+	TokenTTL       time.Duration // how long a verification link stays valid
+	VerifyURL      string        // page of the frontend that takes the token, ?token= is appended
+	ResendInterval time.Duration // minimum time between two emails to the same user
+	MaxPerDay      int           // emails a user can request within 24 hours
+}
+
+// EmailVerification is the email job handed to the server for publishing
+type EmailVerification struct {
+	Name      string
+	Email     string
+	Link      string
+	ExpiresAt time.Time
+}
+
+// newEmailVerification signs a verification link for the account, the caller reserved the email
+// with reserveVerificationEmail
+func (s *authService) newEmailVerification(ctx context.Context, acc *account.Account) (*EmailVerification, error) {
+	Logs := logger.GetGlobalLogger()
+
+	token, expiresAt, err := s.jwtManager.GenerateEmailVerificationToken(acc.ID, acc.Email, acc.Role, s.emailVerification.TokenTTL)
+	if err != nil {
+		Logs.Error(ctx, "Failed to generate email verification token: "+err.Error())
+		return nil, err
+	}
+
+	link, err := url.Parse(s.emailVerification.VerifyURL)
+	if err != nil {
+		Logs.Error(ctx, "Invalid email verification URL: "+err.Error())
+		return nil, err
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	return &EmailVerification{
+		Name:      acc.Name,
+		Email:     acc.Email,
+		Link:      link.String(),
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+func (s *authService) SendVerificationEmail(ctx context.Context, userId string, ac *account.Client) (*EmailVerification, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.Info(ctx, "SendVerificationEmail called for user: "+userId)
+
+	// Step 1: Nothing to do for verified accounts, unless they wait to confirm a new email
+	acc, err := ac.GetAccount(ctx, userId)
+	if err != nil {
+		Logs.Error(ctx, "Failed to fetch account: "+err.Error())
+		return nil, err
+	}
+	if acc.PendingEmail != "" {
+		acc.Email = acc.PendingEmail
+	} else if acc.EmailVerified {
+		return nil, errEmailAlreadyVerified
+	}
+
+	// Step 2: Rate limit
+	if err := s.reserveVerificationEmail(ctx, userId); err != nil {
+		return nil, err
+	}
+
+	// Step 3: Sign a fresh link
+	return s.newEmailVerification(ctx, acc)
+}
+
+// reserveVerificationEmail records a verification email to the user if both the minimum gap
+// between verification emails and the daily cap allow one
+func (s *authService) reserveVerificationEmail(ctx context.Context, userId string) error {
+	Logs := logger.GetGlobalLogger()
+
+	reserved, err := s.repository.ReserveVerificationEmail(ctx, userId, s.emailVerification.ResendInterval, s.emailVerification.MaxPerDay)
+	if err != nil {
+		Logs.Error(ctx, "Failed to record verification email: "+err.Error())
+		return err
+	}
+	if !reserved {
+		Logs.Warn(ctx, "Verification email rate limited for user: "+userId)
+		return errVerificationRateLimited
+	}
+	return nil
+}
+
+func (s *authService) VerifyEmail(ctx context.Context, token string, ac *account.Client) (*pb.UpdateAccountResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("VerifyEmail called")
+
+	// Step 1: Check the signature and expiry of the link
+	claims, err := s.jwtManager.VerifyEmailVerificationToken(token)
+	if err != nil {
+		Logs.Warn(ctx, "Invalid email verification token: "+err.Error())
+		return nil, errInvalidVerificationToken
+	}
+	userId := claims["sub"].(string)
+	email := claims["email"].(string)
+	current, err := ac.GetAccount(ctx, userId)
+	if err != nil {
+		Logs.Error(ctx, "Failed to fetch account: "+err.Error())
+		return nil, errInvalidVerificationToken
+	}
+
+	// Step 2: Mark the address verified, or swap it in if it is a pending email change. Fails
+	// if the account has neither email anymore
+	if err := ac.MarkEmailVerified(ctx, userId, email); err != nil {
+		Logs.Error(ctx, "Failed to mark email verified: "+err.Error())
+		return nil, errInvalidVerificationToken
+	}
+	// an email change bumps the token version, the account service also announces it on NATS
+	s.tokenVersions.Invalidate(userId)
+
+	// Step 3: Reset links went to the old address, they must not outlive the change
+	if current.Email != email {
+		if err := s.repository.InvalidatePasswordResetTokens(ctx, userId); err != nil {
+			Logs.Error(ctx, "Failed to invalidate password reset tokens: "+err.Error())
+		}
+	}
+
+	Logs.Info(ctx, "Email verified for user: "+userId)
+	return &pb.UpdateAccountResponse{Message: "Email verified successfully"}, nil
+}
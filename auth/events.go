@@ -0,0 +1,11 @@
+package auth
+
+// SessionRevokedSubject is published on NATS when a single session is revoked. Logouts and
+// password changes bump the token version instead, see account.TokenVersionChangedSubject
+const SessionRevokedSubject = "auth.session.revoked"
+
+// SessionRevoked is the payload of SessionRevokedSubject
+type SessionRevoked struct {
+	UserID    string `json:"user_id"`
+	SessionID string `json:"session_id"`
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zenvisjr/building-scalable-microservices/account"
+	"github.com/zenvisjr/building-scalable-microservices/logger"
+)
+
+const (
+	// maxVerifyBatchSize caps how many tokens one VerifyBatch call can check
+	maxVerifyBatchSize = 100
+	// verifyBatchWorkers is how many tokens of a batch are checked at the same time
+	verifyBatchWorkers = 8
+)
+
+// TokenIntrospection describes a token the way RFC 7662 does. Only Active is set for tokens
+// that are invalid, expired or revoked, callers learn nothing about why
+type TokenIntrospection struct {
+	Active    bool
+	Claims    *UserClaims
+	TokenType string
+	IssuedAt  time.Time // zero for tokens issued before iat was added
+	ExpiresAt time.Time
+}
+
+// TokenVerification is the outcome of one token of a VerifyBatch call
+type TokenVerification struct {
+	Claims *UserClaims // nil when Err is set
+	Err    error
+}
+
+func (s *authService) Introspect(ctx context.Context, token string, ac *account.Client) *TokenIntrospection {
+	Logs := logger.GetGlobalLogger()
+
+	claims, raw, err := s.verifyAccessToken(ctx, token, ac)
+	if err != nil {
+		Logs.LocalOnlyInfo("Introspected inactive token: " + err.Error())
+		return &TokenIntrospection{Active: false}
+	}
+
+	introspection := &TokenIntrospection{
+		Active:    true,
+		Claims:    claims,
+		TokenType: "access_token",
+	}
+	if exp, ok := raw["exp"].(float64); ok {
+		introspection.ExpiresAt = time.Unix(int64(exp), 0)
+	}
+	if iat, ok := raw["iat"].(float64); ok {
+		introspection.IssuedAt = time.Unix(int64(iat), 0)
+	}
+	return introspection
+}
+
+// VerifyBatch verifies every token on its own, one bad token does not fail the others.
+// Results are in the order of tokens
+func (s *authService) VerifyBatch(ctx context.Context, tokens []string, ac *account.Client) ([]*TokenVerification, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("VerifyBatch called for " + strconv.Itoa(len(tokens)) + " tokens")
+
+	if len(tokens) > maxVerifyBatchSize {
+		return nil, errors.New("too many tokens, at most " + strconv.Itoa(maxVerifyBatchSize) + " can be verified at once")
+	}
+
+	results := make([]*TokenVerification, len(tokens))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < verifyBatchWorkers && w < len(tokens); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				claims, err := s.VerifyToken(ctx, tokens[i], ac)
+				results[i] = &TokenVerification{Claims: claims, Err: err}
+			}
+		}()
+	}
+	for i := range tokens {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return results, nil
+}
+
+// InvalidateTokenVersion drops the cached token version of the user, or of every user when
+// userId is empty. It is called for the account events received over NATS
+func (s *authService) InvalidateTokenVersion(userId string) {
+	s.tokenVersions.Invalidate(userId)
+}
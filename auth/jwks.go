@@ -0,0 +1,191 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/zenvisjr/building-scalable-microservices/account"
+	"github.com/zenvisjr/building-scalable-microservices/logger"
+)
+
+// ListenJWKSHTTP serves the public signing keys on /.well-known/jwks.json for clients
+// that verify tokens locally and do not speak gRPC
+func ListenJWKSHTTP(s Service, port int) error {
+	Logs := logger.GetGlobalLogger()
+	address := fmt.Sprintf(":%d", port)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/jwks.json", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		if err := json.NewEncoder(w).Encode(s.GetJWKS(r.Context())); err != nil {
+			Logs.Error(r.Context(), "Failed to write JWKS: "+err.Error())
+		}
+	})
+
+	Logs.LocalOnlyInfo("Serving JWKS over HTTP on " + address)
+	return http.ListenAndServe(address, mux)
+}
+
+// RemoteKeySet verifies access tokens locally with keys fetched from the auth service.
+// Keys are fetched again when a token names an unknown kid, at most once per minRefreshInterval
+type RemoteKeySet struct {
+	client             *Client
+	minRefreshInterval time.Duration
+	// sessions caches the token version the auth service last confirmed for a session, so
+	// revocation is checked without a call on every request
+	sessions *TokenVersionCache
+
+	mu          sync.RWMutex
+	keys        map[string]*SigningKey
+	lastRefresh time.Time
+}
+
+// NewRemoteKeySet creates a key set. A session is confirmed with the auth service at most once
+// per revocationTTL, or on every request when it is zero. Revocations announced on NATS, see
+// WatchRevocations, take effect right away, otherwise within revocationTTL
+func NewRemoteKeySet(client *Client, minRefreshInterval time.Duration, revocationTTL time.Duration) *RemoteKeySet {
+	return &RemoteKeySet{
+		client:             client,
+		minRefreshInterval: minRefreshInterval,
+		sessions:           NewTokenVersionCache(revocationTTL),
+		keys:               make(map[string]*SigningKey),
+	}
+}
+
+// WatchRevocations drops cached sessions when their account's token version is bumped, on
+// logout, password changes and deactivation, or when they are revoked one by one. Sessions are
+// cached by ID, so a bumped account drops every session, it is rare enough
+func (r *RemoteKeySet) WatchRevocations(nc *nats.Conn) error {
+	// events may have been missed while disconnected
+	nc.SetReconnectHandler(func(*nats.Conn) {
+		r.sessions.Invalidate("")
+	})
+	if _, err := nc.Subscribe(account.TokenVersionChangedSubject, func(msg *nats.Msg) {
+		r.sessions.Invalidate("")
+	}); err != nil {
+		return err
+	}
+	_, err := nc.Subscribe(SessionRevokedSubject, func(msg *nats.Msg) {
+		var event SessionRevoked
+		if err := json.Unmarshal(msg.Data, &event); err != nil || event.SessionID == "" {
+			r.sessions.Invalidate("")
+			return
+		}
+		r.sessions.Invalidate(event.SessionID)
+	})
+	return err
+}
+
+// Refresh replaces the cached keys with the ones currently published by the auth service
+func (r *RemoteKeySet) Refresh(ctx context.Context) error {
+	Logs := logger.GetGlobalLogger()
+
+	jwks, err := r.client.GetJWKS(ctx)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]*SigningKey, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		key, err := SigningKeyFromJWK(jwk)
+		if err != nil {
+			Logs.Warn(ctx, "Skipping invalid JWK: "+err.Error())
+			continue
+		}
+		keys[key.ID] = key
+	}
+
+	r.mu.Lock()
+	r.keys = keys
+	r.lastRefresh = time.Now()
+	r.mu.Unlock()
+
+	Logs.LocalOnlyInfo(fmt.Sprintf("Loaded %d token verification keys", len(keys)))
+	return nil
+}
+
+// VerifyToken checks the signature and expiry of an access token locally. Whether its session
+// was revoked or its token version bumped is asked from the auth service once per session and
+// revocation TTL, forged and expired tokens never get that far
+func (r *RemoteKeySet) VerifyToken(ctx context.Context, token string) (*UserClaims, error) {
+	Logs := logger.GetGlobalLogger()
+
+	// Step 1: Signature and expiry
+	claims, err := parseToken(token, tokenTypeAccess, func(kid string) (*SigningKey, error) {
+		return r.lookupKey(ctx, kid)
+	})
+	if err != nil {
+		Logs.Error(ctx, "Failed to verify token locally: "+err.Error())
+		return nil, err
+	}
+
+	tokenVersion, _ := claims["token_version"].(float64)
+	sessionID, _ := claims["sid"].(string)
+	if sessionID == "" {
+		return nil, errors.New("invalid token claims")
+	}
+
+	// Step 2: Revocation, a cache miss has the auth service check the session and token version.
+	// A token it accepts carries the current version of its account
+	confirmed, err := r.sessions.Lookup(sessionID, func() (int32, error) {
+		if _, err := r.client.VerifyToken(ctx, token); err != nil {
+			return 0, err
+		}
+		return int32(tokenVersion), nil
+	})
+	if err != nil {
+		Logs.Error(ctx, "Token rejected by the auth service: "+err.Error())
+		return nil, err
+	}
+	if confirmed != int32(tokenVersion) {
+		Logs.Error(ctx, "Token version of session "+sessionID+" is outdated")
+		return nil, errors.New("token invalid or expired, please login again")
+	}
+
+	return &UserClaims{
+		ID:           claims["sub"].(string),
+		Email:        claims["email"].(string),
+		Role:         claims["role"].(string),
+		TokenVersion: int32(tokenVersion),
+		SessionID:    sessionID,
+		Permissions:  permissionsFromClaims(claims),
+	}, nil
+}
+
+func (r *RemoteKeySet) lookupKey(ctx context.Context, kid string) (*SigningKey, error) {
+	r.mu.RLock()
+	key, ok := r.keys[kid]
+	canRefresh := time.Since(r.lastRefresh) >= r.minRefreshInterval
+	r.mu.RUnlock()
+
+	if ok {
+		return key, nil
+	}
+	if !canRefresh {
+		return nil, errors.New("unknown signing key: " + kid)
+	}
+
+	// Unknown kid, the auth service may have rotated its signing key
+	if err := r.Refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if key, ok := r.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, errors.New("unknown signing key: " + kid)
+}
@@ -3,23 +3,53 @@ package auth
 import (
 	"context"
 	"errors"
+	"sort"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/segmentio/ksuid"
 	"github.com/zenvisjr/building-scalable-microservices/logger"
 	"golang.org/x/crypto/bcrypt"
 )
 
+const (
+	tokenTypeAccess    = "access"
+	tokenTypeRefresh   = "refresh"
+	tokenTypeChallenge = "mfa_challenge"
+	tokenTypeEmail     = "email_verification"
+
+	// challengeTTL is how long a user has to enter the second factor after the password
+	challengeTTL = 5 * time.Minute
+)
+
+// JWTManager signs tokens with the current signing key and accepts tokens from any of the
+// verification keys, so a retired key keeps working until the tokens it signed expire
 type JWTManager struct {
-	accessSecret  string
-	refreshSecret string
+	signingKey       *SigningKey
+	verificationKeys map[string]*SigningKey
+	accessTTL        time.Duration
+	refreshTTL       time.Duration
 }
 
-func NewJWTManager(accessSecret, refreshSecret string) *JWTManager {
-	return &JWTManager{
-		accessSecret:  accessSecret,
-		refreshSecret: refreshSecret,
+func NewJWTManager(accessTTL, refreshTTL time.Duration, signingKey *SigningKey, verificationKeys ...*SigningKey) (*JWTManager, error) {
+	if signingKey == nil || signingKey.PrivateKey == nil {
+		return nil, errors.New("signing key must contain a private key")
 	}
+
+	keys := map[string]*SigningKey{signingKey.ID: signingKey}
+	for _, key := range verificationKeys {
+		if _, exists := keys[key.ID]; exists {
+			return nil, errors.New("duplicate key id: " + key.ID)
+		}
+		keys[key.ID] = key
+	}
+
+	return &JWTManager{
+		signingKey:       signingKey,
+		verificationKeys: keys,
+		accessTTL:        accessTTL,
+		refreshTTL:       refreshTTL,
+	}, nil
 }
 
 func (j *JWTManager) ValidatePassword(plain, hash string) bool {
@@ -27,59 +57,180 @@ func (j *JWTManager) ValidatePassword(plain, hash string) bool {
 	return err == nil
 }
 
-func (j *JWTManager) GenerateAccessToken(userID, email, role string, tokenVersion int32) (string, error) {
+func (j *JWTManager) GenerateAccessToken(userID, email, role string, permissions []string, tokenVersion int32, sessionID string) (string, error) {
 	claims := jwt.MapClaims{
 		"token_version": tokenVersion,
 		"sub":   userID,
 		"email": email,
 		"role":  role,
-		"exp":   time.Now().Add(15 * time.Minute).Unix(),
+		"perms": permissions,
+		"sid":   sessionID,
+		"typ":   tokenTypeAccess,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(j.accessTTL).Unix(),
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(j.accessSecret))
+	return j.sign(claims)
 }
 
-func (j *JWTManager) GenerateRefreshToken(userID, email, role string, tokenVersion int32) (string, error) {
+// GenerateRefreshToken issues a refresh token in the given token family and returns its expiry,
+// which is stored in the DB next to the token so both always agree
+func (j *JWTManager) GenerateRefreshToken(userID, email, role string, tokenVersion int32, sessionID string, familyID string) (string, time.Time, error) {
+	expiresAt := time.Now().Add(j.refreshTTL)
 	claims := jwt.MapClaims{
 		"token_version": tokenVersion,
 		"sub":   userID,
 		"email": email,
 		"role":  role,
-		"exp":   time.Now().Add(7 * 24 * time.Hour).Unix(),
+		"sid":   sessionID,
+		"typ":   tokenTypeRefresh,
+		"fid":   familyID,
+		"jti":   ksuid.New().String(),
+		"exp":   expiresAt.Unix(),
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(j.refreshSecret))
+	token, err := j.sign(claims)
+	return token, expiresAt, err
 }
 
+// GenerateChallengeToken issues the short-lived token a client trades, together with a TOTP
+// or recovery code, for real tokens when the account has two-factor login enabled
+func (j *JWTManager) GenerateChallengeToken(userID, email, role string, tokenVersion int32) (string, time.Time, error) {
+	expiresAt := time.Now().Add(challengeTTL)
+	claims := jwt.MapClaims{
+		"token_version": tokenVersion,
+		"sub":   userID,
+		"email": email,
+		"role":  role,
+		"typ":   tokenTypeChallenge,
+		"exp":   expiresAt.Unix(),
+	}
+
+	token, err := j.sign(claims)
+	return token, expiresAt, err
+}
+
+// GenerateEmailVerificationToken issues the token carried by the link in the verification email.
+// It is bound to the email so a link stops working once the address changes
+func (j *JWTManager) GenerateEmailVerificationToken(userID, email, role string, ttl time.Duration) (string, time.Time, error) {
+	expiresAt := time.Now().Add(ttl)
+	claims := jwt.MapClaims{
+		"sub":   userID,
+		"email": email,
+		"role":  role,
+		"typ":   tokenTypeEmail,
+		"exp":   expiresAt.Unix(),
+	}
+
+	token, err := j.sign(claims)
+	return token, expiresAt, err
+}
+
+// permissionsFromClaims reads the perms claim of an access token, a token without it grants nothing
+func permissionsFromClaims(claims jwt.MapClaims) []string {
+	raw, _ := claims["perms"].([]interface{})
+	permissions := make([]string, 0, len(raw))
+	for _, value := range raw {
+		if permission, ok := value.(string); ok {
+			permissions = append(permissions, permission)
+		}
+	}
+	return permissions
+}
+
+// sign signs the claims with the current key and records its id in the kid header
+func (j *JWTManager) sign(claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(j.signingKey.Method, claims)
+	token.Header["kid"] = j.signingKey.ID
+	return token.SignedString(j.signingKey.PrivateKey)
+}
 
+// JWKS returns the public part of every key tokens may currently be signed with
+func (j *JWTManager) JWKS() JWKS {
+	jwks := JWKS{Keys: make([]JWK, 0, len(j.verificationKeys))}
+	for _, key := range j.verificationKeys {
+		jwks.Keys = append(jwks.Keys, key.JWK())
+	}
+	sort.Slice(jwks.Keys, func(a, b int) bool { return jwks.Keys[a].Kid < jwks.Keys[b].Kid })
+	return jwks
+}
 
-// VerifyAccessToken parses and validates a JWT using accessSecret
+// VerifyAccessToken parses and validates an access token against the verification keys
 func (j *JWTManager) VerifyAccessToken(tokenString string) (jwt.MapClaims, error) {
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("Verifying access token...")
+
+	claims, err := parseToken(tokenString, tokenTypeAccess, j.lookupKey)
+	if err != nil {
+		Logs.Error(context.Background(), "Failed to parse token: "+err.Error())
+		return nil, err
+	}
+
+	Logs.Info(context.Background(), "claim extracted user = "+claims["sub"].(string)+" | email = "+claims["email"].(string)+" | role = "+claims["role"].(string))
+	Logs.LocalOnlyInfo("Access token verified successfully")
+	return claims, nil
+}
+
+// VerifyChallengeToken parses and validates a two-factor login challenge
+func (j *JWTManager) VerifyChallengeToken(tokenString string) (jwt.MapClaims, error) {
+	return parseToken(tokenString, tokenTypeChallenge, j.lookupKey)
+}
+
+// VerifyEmailVerificationToken parses and validates the token of an email verification link
+func (j *JWTManager) VerifyEmailVerificationToken(tokenString string) (jwt.MapClaims, error) {
+	return parseToken(tokenString, tokenTypeEmail, j.lookupKey)
+}
+
+// VerifyRefreshToken parses and validates a refresh token against the verification keys
+func (j *JWTManager) VerifyRefreshToken(tokenString string) (jwt.MapClaims, error) {
+	return parseToken(tokenString, tokenTypeRefresh, j.lookupKey)
+}
+
+func (j *JWTManager) lookupKey(kid string) (*SigningKey, error) {
+	key, ok := j.verificationKeys[kid]
+	if !ok {
+		return nil, errors.New("unknown signing key: " + kid)
+	}
+	return key, nil
+}
+
+// parseToken validates the signature using the key named by the kid header and checks
+// that the token is of the expected type, so refresh tokens cannot be used as access tokens
+func parseToken(tokenString string, tokenType string, lookup func(kid string) (*SigningKey, error)) (jwt.MapClaims, error) {
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		// Ensure token method is HMAC
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			Logs.Error(context.Background(), "Invalid token method")
+		kid, ok := token.Header["kid"].(string)
+		if !ok || kid == "" {
+			return nil, errors.New("token has no kid header")
+		}
+
+		key, err := lookup(kid)
+		if err != nil {
+			return nil, err
+		}
+
+		// Ensure the token was signed with the algorithm of that key
+		if token.Method.Alg() != key.Method.Alg() {
 			return nil, errors.New("unexpected signing method")
 		}
-		return []byte(j.accessSecret), nil
+		return key.PublicKey, nil
 	})
-
 	if err != nil {
-		Logs.Error(context.Background(), "Failed to parse token: "+err.Error())
 		return nil, err
 	}
 
-	// Extract claims and validate them
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		Logs.Info(context.Background(), "claim extracted user = "+claims["sub"].(string)+" | email = "+claims["email"].(string)+" | role = "+claims["role"].(string))
-		Logs.LocalOnlyInfo("Access token verified successfully")
-		return claims, nil
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+
+	if typ, _ := claims["typ"].(string); typ != tokenType {
+		return nil, errors.New("invalid token type")
 	}
-	Logs.Error(context.Background(), "Invalid token")
-	return nil, errors.New("invalid token")
-}
 
+	for _, name := range []string{"sub", "email", "role"} {
+		if _, ok := claims[name].(string); !ok {
+			return nil, errors.New("invalid token claims")
+		}
+	}
+	return claims, nil
+}
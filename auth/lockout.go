@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/zenvisjr/building-scalable-microservices/logger"
+)
+
+const (
+	LockoutSubjectEmail = "email"
+	LockoutSubjectIP    = "ip"
+)
+
+var errInvalidCredentials = errors.New("invalid email or password")
+
+// LockoutPolicy decides when repeated login failures lock an email or a client IP
+type LockoutPolicy struct {
+	MaxFailedAttempts   int           // failures per email before the account is locked
+	MaxIPFailedAttempts int           // failures per client IP (across all emails) before the IP is locked
+	FailureWindow       time.Duration // failures older than this are forgotten
+	BaseLockout         time.Duration // first lockout duration, doubled on every further lockout
+	MaxLockout          time.Duration // upper bound for the exponential backoff
+}
+
+// lockoutDuration returns BaseLockout * 2^level capped at MaxLockout
+func (p LockoutPolicy) lockoutDuration(level int) time.Duration {
+	d := p.BaseLockout
+	for i := 0; i < level; i++ {
+		d *= 2
+		if d >= p.MaxLockout {
+			return p.MaxLockout
+		}
+	}
+	if d > p.MaxLockout {
+		return p.MaxLockout
+	}
+	return d
+}
+
+func (p LockoutPolicy) maxAttemptsFor(subjectType string) int {
+	if subjectType == LockoutSubjectIP {
+		return p.MaxIPFailedAttempts
+	}
+	return p.MaxFailedAttempts
+}
+
+// checkLockout returns an error if the email or the client IP is currently locked
+func (s *authService) checkLockout(ctx context.Context, email string, clientIP string) error {
+	Logs := logger.GetGlobalLogger()
+
+	subjects := map[string]string{LockoutSubjectEmail: email}
+	if clientIP != "" {
+		subjects[LockoutSubjectIP] = clientIP
+	}
+
+	for subjectType, subject := range subjects {
+		lockout, err := s.repository.GetLockout(ctx, subjectType, subject)
+		if err != nil {
+			Logs.Error(ctx, "Failed to read lockout state: "+err.Error())
+			return err
+		}
+		if remaining := time.Until(lockout.LockedUntil); remaining > 0 {
+			Logs.Warn(ctx, "Login blocked, "+subjectType+" is locked: "+subject)
+			return fmt.Errorf("too many failed login attempts, try again in %s", remaining.Round(time.Second))
+		}
+	}
+	return nil
+}
+
+// registerFailedLogin records the failure for both the email and the client IP and
+// locks whichever of them went over its limit
+func (s *authService) registerFailedLogin(ctx context.Context, email string, clientIP string) {
+	Logs := logger.GetGlobalLogger()
+
+	if err := s.repository.RecordLoginAttempt(ctx, email, clientIP, false); err != nil {
+		Logs.Error(ctx, "Failed to record login attempt: "+err.Error())
+	}
+
+	subjects := map[string]string{LockoutSubjectEmail: email}
+	if clientIP != "" {
+		subjects[LockoutSubjectIP] = clientIP
+	}
+
+	for subjectType, subject := range subjects {
+		lockout, err := s.repository.RegisterFailedLogin(ctx, subjectType, subject, s.lockoutPolicy.FailureWindow)
+		if err != nil {
+			Logs.Error(ctx, "Failed to register failed login: "+err.Error())
+			continue
+		}
+		if lockout.FailedAttempts < s.lockoutPolicy.maxAttemptsFor(subjectType) {
+			continue
+		}
+
+		duration := s.lockoutPolicy.lockoutDuration(lockout.LockoutLevel)
+		if err := s.repository.LockSubject(ctx, subjectType, subject, time.Now().Add(duration)); err != nil {
+			Logs.Error(ctx, "Failed to lock "+subjectType+": "+err.Error())
+			continue
+		}
+		Logs.Warn(ctx, "Locked "+subjectType+" "+subject+" for "+duration.String()+" after repeated failed logins")
+	}
+}
+
+// registerSuccessfulLogin clears the email counter; the IP counter is left to expire on its own
+// so one valid account cannot be used to reset brute-force protection for an IP
+func (s *authService) registerSuccessfulLogin(ctx context.Context, email string, clientIP string) {
+	Logs := logger.GetGlobalLogger()
+
+	if err := s.repository.RecordLoginAttempt(ctx, email, clientIP, true); err != nil {
+		Logs.Error(ctx, "Failed to record login attempt: "+err.Error())
+	}
+	if err := s.repository.ClearLockout(ctx, LockoutSubjectEmail, email); err != nil {
+		Logs.Error(ctx, "Failed to clear lockout: "+err.Error())
+	}
+}
@@ -0,0 +1,9 @@
+package auth
+
+import "embed"
+
+// Migrations holds the schema migrations of the auth database, applied with the migrate
+// package when the service starts or by the migrate subcommand
+//
+//go:embed migrations/*.sql
+var Migrations embed.FS
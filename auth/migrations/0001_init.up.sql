@@ -1,3 +1,5 @@
+-- The refresh_tokens table as it was before migrations. IF NOT EXISTS lets databases from then
+-- record this version without changes
 CREATE TABLE IF NOT EXISTS refresh_tokens (
     id SERIAL PRIMARY KEY,
     user_id VARCHAR(255) NOT NULL,
@@ -10,4 +12,4 @@ CREATE TABLE IF NOT EXISTS refresh_tokens (
 );
 
 -- Create index to speed up queries by user_id
-CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user_id ON refresh_tokens(user_id);
\ No newline at end of file
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user_id ON refresh_tokens(user_id);
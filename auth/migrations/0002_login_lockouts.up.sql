@@ -0,0 +1,22 @@
+-- Every login attempt, kept for auditing and to investigate brute-force attempts
+CREATE TABLE login_attempts (
+    id SERIAL PRIMARY KEY,
+    email VARCHAR(255) NOT NULL,
+    client_ip VARCHAR(64) NOT NULL DEFAULT '',
+    success BOOLEAN NOT NULL,
+    attempted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_login_attempts_email ON login_attempts(email);
+
+-- Failed login counters and lockout state, tracked per email and per client IP
+-- so it survives restarts and is shared by every auth replica
+CREATE TABLE login_lockouts (
+    subject_type VARCHAR(10) NOT NULL CHECK (subject_type IN ('email', 'ip')),
+    subject VARCHAR(255) NOT NULL,
+    failed_attempts INT NOT NULL DEFAULT 0,
+    lockout_level INT NOT NULL DEFAULT 0,
+    last_failed_at TIMESTAMP,
+    locked_until TIMESTAMP,
+    PRIMARY KEY (subject_type, subject)
+);
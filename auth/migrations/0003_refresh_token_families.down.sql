@@ -0,0 +1,12 @@
+DROP TABLE security_events;
+
+-- hashed tokens cannot be turned back into tokens, their holders log in again
+DELETE FROM refresh_tokens;
+
+ALTER TABLE refresh_tokens
+    DROP COLUMN token_hash,
+    DROP COLUMN family_id,
+    DROP COLUMN parent_id,
+    DROP COLUMN rotated_at,
+    DROP COLUMN revoked_at,
+    ADD COLUMN refresh_token TEXT NOT NULL UNIQUE;
@@ -0,0 +1,24 @@
+-- Tokens were stored by value and belong to no family, so they cannot be rotated safely.
+-- They are dropped and their holders log in again
+DELETE FROM refresh_tokens;
+
+ALTER TABLE refresh_tokens
+    DROP COLUMN refresh_token,
+    ADD COLUMN token_hash CHAR(64) NOT NULL UNIQUE, -- sha256 of the token, the token itself is never stored
+    ADD COLUMN family_id VARCHAR(64) NOT NULL,      -- every token rotated from the same login shares a family
+    ADD COLUMN parent_id INT REFERENCES refresh_tokens(id),
+    ADD COLUMN rotated_at TIMESTAMP,                -- set once the token was exchanged, presenting it again is reuse
+    ADD COLUMN revoked_at TIMESTAMP;
+
+CREATE INDEX idx_refresh_tokens_family_id ON refresh_tokens(family_id);
+
+-- Security relevant events such as refresh token reuse
+CREATE TABLE security_events (
+    id SERIAL PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL,
+    event_type VARCHAR(64) NOT NULL,
+    details TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_security_events_user_id ON security_events(user_id);
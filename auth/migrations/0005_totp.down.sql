@@ -0,0 +1,2 @@
+DROP TABLE totp_used_steps;
+DROP TABLE totp_recovery_codes;
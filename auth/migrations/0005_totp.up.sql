@@ -0,0 +1,16 @@
+-- Single-use recovery codes for accounts with two-factor login, stored hashed
+CREATE TABLE totp_recovery_codes (
+    id SERIAL PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL,
+    code_hash CHAR(64) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    used_at TIMESTAMP
+);
+
+CREATE INDEX idx_totp_recovery_codes_user_id ON totp_recovery_codes(user_id);
+
+-- Last accepted TOTP time step per user, a code is only accepted once
+CREATE TABLE totp_used_steps (
+    user_id VARCHAR(255) PRIMARY KEY,
+    last_step BIGINT NOT NULL
+);
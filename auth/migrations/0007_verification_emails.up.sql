@@ -0,0 +1,8 @@
+-- Verification emails sent per user, used to rate limit resends
+CREATE TABLE verification_emails (
+    id SERIAL PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL,
+    sent_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_verification_emails_user_id ON verification_emails(user_id, sent_at);
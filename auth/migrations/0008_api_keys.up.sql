@@ -0,0 +1,18 @@
+-- API keys of service accounts used by partners and batch jobs, stored hashed. Rotating a key
+-- keeps the previous hash valid for a grace period so clients can switch without downtime
+CREATE TABLE api_keys (
+    id VARCHAR(64) PRIMARY KEY,
+    name VARCHAR(64) NOT NULL,            -- name of the service account the key acts as
+    prefix VARCHAR(16) NOT NULL,          -- first characters of the key, shown in listings
+    key_hash CHAR(64) NOT NULL UNIQUE,
+    previous_key_hash CHAR(64),
+    previous_valid_until TIMESTAMP,
+    scopes TEXT[] NOT NULL DEFAULT '{}',  -- permissions granted to the service account
+    created_by VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    last_used_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX idx_api_keys_previous_key_hash ON api_keys(previous_key_hash);
@@ -0,0 +1,2 @@
+DROP TABLE privacy_request_steps;
+DROP TABLE privacy_requests;
@@ -0,0 +1,30 @@
+-- Data exports and right to erasure requests. They outlive the erased data on purpose, together
+-- with their steps they are the record of what was done with the data of an account and when
+CREATE TABLE privacy_requests (
+    id VARCHAR(64) PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL,
+    kind VARCHAR(16) NOT NULL CHECK (kind IN ('export', 'erasure')),
+    status VARCHAR(16) NOT NULL,   -- pending, processing, completed, cancelled or failed
+    requested_by VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    scheduled_for TIMESTAMP,       -- end of the grace period of an erasure
+    locked_until TIMESTAMP,        -- lease of the auth replica running an erasure
+    completed_at TIMESTAMP
+);
+
+CREATE INDEX idx_privacy_requests_user_id ON privacy_requests(user_id);
+CREATE INDEX idx_privacy_requests_due ON privacy_requests(scheduled_for) WHERE status IN ('pending', 'processing');
+-- at most one erasure waiting per account
+CREATE UNIQUE INDEX idx_privacy_requests_open_erasure ON privacy_requests(user_id)
+    WHERE kind = 'erasure' AND status IN ('pending', 'processing');
+
+CREATE TABLE privacy_request_steps (
+    id SERIAL PRIMARY KEY,
+    request_id VARCHAR(64) NOT NULL REFERENCES privacy_requests(id),
+    step VARCHAR(32) NOT NULL,     -- e.g. orders, sessions, account
+    status VARCHAR(16) NOT NULL,   -- completed or failed
+    details TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_privacy_request_steps_request_id ON privacy_request_steps(request_id);
@@ -0,0 +1 @@
+ALTER TABLE privacy_requests DROP COLUMN attempts;
@@ -0,0 +1,2 @@
+-- runs of an erasure so far, it is marked failed after ERASURE_MAX_ATTEMPTS
+ALTER TABLE privacy_requests ADD COLUMN attempts INT NOT NULL DEFAULT 0;
@@ -0,0 +1,350 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/zenvisjr/building-scalable-microservices/logger"
+)
+
+// oidcKeyRefreshInterval limits how often the keys of a provider are fetched for an unknown kid
+const oidcKeyRefreshInterval = time.Minute
+
+// OIDCProviderConfig describes one OpenID Connect provider, read from OIDC_<NAME>_* variables
+type OIDCProviderConfig struct {
+	Issuer       string   `envconfig:"ISSUER" required:"true"`
+	ClientID     string   `envconfig:"CLIENT_ID" required:"true"`
+	ClientSecret string   `envconfig:"CLIENT_SECRET"` // empty for public clients, PKCE protects the code
+	RedirectURL  string   `envconfig:"REDIRECT_URL" required:"true"`
+	Scopes       []string `envconfig:"SCOPES" default:"openid,email,profile"`
+}
+
+// OIDCIdentity is what an ID token says about the user
+type OIDCIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// oidcDiscovery is the part of /.well-known/openid-configuration we use
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// OIDCProvider runs the authorization code flow with PKCE against one provider. The discovery
+// document is fetched on first use, so auth starts even while a provider is unreachable
+type OIDCProvider struct {
+	Name   string
+	config OIDCProviderConfig
+	client *http.Client
+
+	mu          sync.RWMutex
+	discovery   *oidcDiscovery
+	keys        map[string]*SigningKey
+	lastRefresh time.Time
+}
+
+// NewOIDCProvider creates a provider, client may be nil to use a default HTTP client
+func NewOIDCProvider(name string, config OIDCProviderConfig, client *http.Client) *OIDCProvider {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &OIDCProvider{
+		Name:   name,
+		config: config,
+		client: client,
+		keys:   make(map[string]*SigningKey),
+	}
+}
+
+// newPKCE returns a code verifier and its S256 challenge as described in RFC 7636
+func newPKCE() (string, string, error) {
+	verifier, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// randomToken is used for the state, the nonce and the PKCE verifier
+func randomToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// AuthCodeURL is where the browser is sent to sign in with the provider
+func (p *OIDCProvider) AuthCodeURL(ctx context.Context, state string, nonce string, codeChallenge string) (string, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	authURL, err := url.Parse(discovery.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid authorization endpoint of %s: %w", p.Name, err)
+	}
+	query := authURL.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.config.ClientID)
+	query.Set("redirect_uri", p.config.RedirectURL)
+	query.Set("scope", strings.Join(p.config.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", codeChallenge)
+	query.Set("code_challenge_method", "S256")
+	authURL.RawQuery = query.Encode()
+	return authURL.String(), nil
+}
+
+// Exchange trades the authorization code for the ID token of the user
+func (p *OIDCProvider) Exchange(ctx context.Context, code string, codeVerifier string) (string, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("client_id", p.config.ClientID)
+	form.Set("code_verifier", codeVerifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		// client_secret_basic, both parts are form encoded first (RFC 6749 section 2.3.1)
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	var token struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	status, err := p.do(req, &token)
+	if err != nil {
+		return "", err
+	}
+	if status != http.StatusOK || token.Error != "" {
+		return "", fmt.Errorf("token request to %s failed with status %d: %s %s", p.Name, status, token.Error, token.ErrorDescription)
+	}
+	if token.IDToken == "" {
+		return "", fmt.Errorf("token response of %s has no id_token", p.Name)
+	}
+	return token.IDToken, nil
+}
+
+// VerifyIDToken checks the signature, issuer, audience, expiry and nonce of an ID token
+func (p *OIDCProvider) VerifyIDToken(ctx context.Context, rawIDToken string, nonce string) (*OIDCIdentity, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := jwt.Parse(rawIDToken, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := p.lookupKey(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, errors.New("unexpected signing method")
+		}
+		return key.PublicKey, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid ID token")
+	}
+
+	// Step 1: The token must be issued by this provider for this client
+	if !claims.VerifyIssuer(discovery.Issuer, true) {
+		return nil, errors.New("ID token issued by another issuer")
+	}
+	if !claims.VerifyAudience(p.config.ClientID, true) {
+		return nil, errors.New("ID token issued for another client")
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != p.config.ClientID {
+		return nil, errors.New("ID token authorized for another client")
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, errors.New("ID token has no expiry")
+	}
+
+	// Step 2: The nonce ties the token to the login we started
+	if tokenNonce, _ := claims["nonce"].(string); tokenNonce == "" || tokenNonce != nonce {
+		return nil, errors.New("ID token nonce does not match")
+	}
+
+	identity := &OIDCIdentity{}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.Name, _ = claims["name"].(string)
+	// some providers send email_verified as a string
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		identity.EmailVerified = verified
+	case string:
+		identity.EmailVerified = verified == "true"
+	}
+	if identity.Subject == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+	return identity, nil
+}
+
+// discover fetches the provider metadata once and keeps it for the life of the process
+func (p *OIDCProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.RLock()
+	discovery := p.discovery
+	p.mu.RUnlock()
+	if discovery != nil {
+		return discovery, nil
+	}
+
+	wellKnown := strings.TrimSuffix(p.config.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wellKnown, nil)
+	if err != nil {
+		return nil, err
+	}
+	discovery = &oidcDiscovery{}
+	status, err := p.do(req, discovery)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("discovery of %s failed with status %d", p.Name, status)
+	}
+
+	// OpenID Connect Discovery section 4.3, the document must be about the issuer we asked for
+	if discovery.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("discovery of %s returned issuer %s, expected %s", p.Name, discovery.Issuer, p.config.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document of %s is incomplete", p.Name)
+	}
+
+	p.mu.Lock()
+	p.discovery = discovery
+	p.mu.Unlock()
+	logger.GetGlobalLogger().LocalOnlyInfo("Discovered OIDC provider " + p.Name + " at " + p.config.Issuer)
+	return discovery, nil
+}
+
+// lookupKey returns the verification key for kid, fetching the provider keys again when
+// the kid is unknown, at most once per oidcKeyRefreshInterval
+func (p *OIDCProvider) lookupKey(ctx context.Context, kid string) (*SigningKey, error) {
+	p.mu.RLock()
+	key, ok := p.keys[kid]
+	canRefresh := time.Since(p.lastRefresh) >= oidcKeyRefreshInterval
+	p.mu.RUnlock()
+
+	if ok {
+		return key, nil
+	}
+	if !canRefresh {
+		return nil, errors.New("unknown signing key: " + kid)
+	}
+	if err := p.refreshKeys(ctx); err != nil {
+		return nil, err
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	// a provider with a single key may leave kid out of its tokens
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, nil
+		}
+	}
+	return nil, errors.New("unknown signing key: " + kid)
+}
+
+func (p *OIDCProvider) refreshKeys(ctx context.Context) error {
+	Logs := logger.GetGlobalLogger()
+
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discovery.JWKSURI, nil)
+	if err != nil {
+		return err
+	}
+	var jwks JWKS
+	status, err := p.do(req, &jwks)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("fetching keys of %s failed with status %d", p.Name, status)
+	}
+
+	keys := make(map[string]*SigningKey, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := SigningKeyFromJWK(jwk)
+		if err != nil {
+			Logs.Warn(ctx, "Skipping unsupported key of OIDC provider "+p.Name+": "+err.Error())
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.lastRefresh = time.Now()
+	p.mu.Unlock()
+	return nil
+}
+
+// do sends the request and decodes the JSON body into out, whatever the status code
+func (p *OIDCProvider) do(req *http.Request, out interface{}) (int, error) {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("request to OIDC provider %s failed: %w", p.Name, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if err := json.Unmarshal(body, out); err != nil && resp.StatusCode == http.StatusOK {
+		return resp.StatusCode, fmt.Errorf("invalid response from OIDC provider %s: %w", p.Name, err)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,248 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/zenvisjr/building-scalable-microservices/account"
+	"github.com/zenvisjr/building-scalable-microservices/auth/pb"
+	"github.com/zenvisjr/building-scalable-microservices/logger"
+)
+
+// oidcMaxNameLength matches the name column of the accounts table
+const oidcMaxNameLength = 24
+
+var (
+	errUnknownOIDCProvider  = errors.New("unknown sign-in provider")
+	errInvalidOIDCState     = errors.New("sign-in expired or was already completed, please start again")
+	errOIDCIdentityNotFound = errors.New("no account linked to this identity")
+	errOIDCEmailNotVerified = errors.New("the provider has not verified your email address")
+	errOIDCAccountExists    = errors.New("an account with this email already exists, login with your password and verify your email first")
+)
+
+// OIDCConfig lists the OpenID Connect providers users can sign in with
+type OIDCConfig struct {
+	Providers map[string]*OIDCProvider // keyed by the name clients use, e.g. "google"
+	StateTTL  time.Duration            // how long the user has to come back from the provider
+}
+
+// OIDCLoginState is what is kept between sending the user to the provider and their return
+type OIDCLoginState struct {
+	Provider     string
+	Nonce        string
+	CodeVerifier string
+	ExpiresAt    time.Time
+}
+
+// OIDCAuthorization is where to send the browser, the provider sends it back with state and a code
+type OIDCAuthorization struct {
+	URL   string
+	State string
+}
+
+// hashOIDCState is what gets stored, the state itself only travels through the browser
+func hashOIDCState(state string) string {
+	sum := sha256.Sum256([]byte(state))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *authService) StartOIDCLogin(ctx context.Context, providerName string) (*OIDCAuthorization, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("StartOIDCLogin called for provider: " + providerName)
+
+	provider, ok := s.oidc.Providers[providerName]
+	if !ok {
+		return nil, errUnknownOIDCProvider
+	}
+
+	// Step 1: Random state against CSRF, nonce against ID token replay and PKCE against code interception
+	state, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	verifier, challenge, err := newPKCE()
+	if err != nil {
+		return nil, err
+	}
+
+	// Step 2: Build the URL first, it fails if the provider cannot be discovered
+	authURL, err := provider.AuthCodeURL(ctx, state, nonce, challenge)
+	if err != nil {
+		Logs.Error(ctx, "Failed to build authorization URL for "+providerName+": "+err.Error())
+		return nil, errors.New("sign-in provider is unavailable, please try again later")
+	}
+
+	// Step 3: Keep the secrets of this login until the user comes back, the state only as a hash
+	loginState := &OIDCLoginState{
+		Provider:     providerName,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		ExpiresAt:    time.Now().Add(s.oidc.StateTTL),
+	}
+	if err := s.repository.CreateOIDCLoginState(ctx, hashOIDCState(state), loginState); err != nil {
+		Logs.Error(ctx, "Failed to store OIDC login state: "+err.Error())
+		return nil, err
+	}
+
+	return &OIDCAuthorization{URL: authURL, State: state}, nil
+}
+
+func (s *authService) CompleteOIDCLogin(ctx context.Context, providerName string, state string, code string, info SessionInfo, ac *account.Client) (*pb.LoginResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("CompleteOIDCLogin called for provider: " + providerName)
+
+	provider, ok := s.oidc.Providers[providerName]
+	if !ok {
+		return nil, errUnknownOIDCProvider
+	}
+
+	// Step 1: The state must come from a login we started with this provider, and only once
+	loginState, err := s.repository.ConsumeOIDCLoginState(ctx, hashOIDCState(state))
+	if err != nil {
+		Logs.Warn(ctx, "OIDC login with unknown state: "+err.Error())
+		return nil, errInvalidOIDCState
+	}
+	if loginState.Provider != providerName {
+		Logs.Warn(ctx, "OIDC state of "+loginState.Provider+" presented for "+providerName)
+		return nil, errInvalidOIDCState
+	}
+
+	// Step 2: Exchange the code, the provider checks it against the PKCE challenge
+	rawIDToken, err := provider.Exchange(ctx, code, loginState.CodeVerifier)
+	if err != nil {
+		Logs.Error(ctx, "OIDC code exchange failed: "+err.Error())
+		return nil, errors.New("sign-in with " + providerName + " failed, please try again")
+	}
+
+	// Step 3: Validate the ID token
+	identity, err := provider.VerifyIDToken(ctx, rawIDToken, loginState.Nonce)
+	if err != nil {
+		Logs.Warn(ctx, "Rejected ID token from "+providerName+": "+err.Error())
+		return nil, errors.New("sign-in with " + providerName + " failed, please try again")
+	}
+
+	// Step 4: Find or create the account of the external subject
+	acc, err := s.resolveOIDCAccount(ctx, providerName, identity, ac)
+	if err != nil {
+		return nil, err
+	}
+	if !acc.IsActive {
+		Logs.Error(ctx, "Account is not active")
+		return nil, errors.New("account is not active")
+	}
+
+	// Step 5: The provider replaces the password, a second factor still applies
+	if acc.TOTPEnabled {
+		Logs.Info(ctx, "Signed in with "+providerName+", waiting for second factor for user: "+acc.Email)
+		return s.loginChallenge(ctx, acc)
+	}
+	authResponse, err := s.completeLogin(ctx, acc, info, ac)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.LoginResponse{Auth: authResponse}, nil
+}
+
+// resolveOIDCAccount returns the account linked to the identity. On first login the identity is
+// linked to the account with the same email, or a new account is created through PostAccount
+func (s *authService) resolveOIDCAccount(ctx context.Context, providerName string, identity *OIDCIdentity, ac *account.Client) (*account.Account, error) {
+	Logs := logger.GetGlobalLogger()
+
+	// Step 1: Returning users are found by subject, their email may have changed at the provider
+	userId, err := s.repository.GetOIDCIdentity(ctx, providerName, identity.Subject)
+	if err == nil {
+		linked, err := ac.GetAccount(ctx, userId)
+		if err != nil {
+			Logs.Error(ctx, "Failed to fetch linked account: "+err.Error())
+			return nil, err
+		}
+		if err := s.repository.LinkOIDCIdentity(ctx, providerName, identity.Subject, userId, identity.Email); err != nil {
+			Logs.Error(ctx, "Failed to record OIDC login: "+err.Error())
+		}
+		return ac.GetEmailForAuth(ctx, linked.Email)
+	}
+	if !errors.Is(err, errOIDCIdentityNotFound) {
+		Logs.Error(ctx, "Failed to look up OIDC identity: "+err.Error())
+		return nil, err
+	}
+
+	// Step 2: Linking by email is only safe when both sides have proven they own it
+	if identity.Email == "" || !identity.EmailVerified {
+		return nil, errOIDCEmailNotVerified
+	}
+	email := identity.Email
+
+	acc, err := ac.GetEmailForAuth(ctx, email)
+	if err == nil {
+		// an unverified account could have been registered by someone else to take over the address
+		if !acc.EmailVerified {
+			Logs.Warn(ctx, "Refusing to link "+providerName+" identity to unverified account: "+acc.ID)
+			return nil, errOIDCAccountExists
+		}
+		if err := s.linkOIDCIdentity(ctx, providerName, identity, acc, "oidc_identity_linked"); err != nil {
+			return nil, err
+		}
+		return acc, nil
+	}
+
+	// Step 3: First login, create the account with a random password the user never sees.
+	// They can set one later through the forgot-password flow
+	password, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	created, err := ac.PostAccount(ctx, oidcAccountName(identity), email, password, "user")
+	if err != nil {
+		Logs.Error(ctx, "Account creation for "+providerName+" identity failed: "+err.Error())
+		return nil, errors.New("failed to create account")
+	}
+	if err := ac.MarkEmailVerified(ctx, created.ID, email); err != nil {
+		Logs.Error(ctx, "Failed to mark email verified: "+err.Error())
+		return nil, err
+	}
+	acc, err = ac.GetEmailForAuth(ctx, email)
+	if err != nil {
+		Logs.Error(ctx, "Failed to fetch created account: "+err.Error())
+		return nil, err
+	}
+	Logs.Info(ctx, "Created account "+acc.ID+" for "+providerName+" identity")
+	if err := s.linkOIDCIdentity(ctx, providerName, identity, acc, "oidc_account_created"); err != nil {
+		return nil, err
+	}
+	return acc, nil
+}
+
+func (s *authService) linkOIDCIdentity(ctx context.Context, providerName string, identity *OIDCIdentity, acc *account.Account, event string) error {
+	Logs := logger.GetGlobalLogger()
+
+	if err := s.repository.LinkOIDCIdentity(ctx, providerName, identity.Subject, acc.ID, identity.Email); err != nil {
+		Logs.Error(ctx, "Failed to link OIDC identity: "+err.Error())
+		return err
+	}
+	if err := s.repository.RecordSecurityEvent(ctx, acc.ID, event, providerName+" subject "+identity.Subject); err != nil {
+		Logs.Error(ctx, "Failed to record security event: "+err.Error())
+	}
+	return nil
+}
+
+// oidcAccountName uses the name from the provider, or the local part of the email without one
+func oidcAccountName(identity *OIDCIdentity) string {
+	name := strings.TrimSpace(identity.Name)
+	if name == "" {
+		name, _, _ = strings.Cut(identity.Email, "@")
+	}
+	for utf8.RuneCountInString(name) > oidcMaxNameLength {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
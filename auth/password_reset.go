@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/zenvisjr/building-scalable-microservices/account"
+	"github.com/zenvisjr/building-scalable-microservices/auth/pb"
+	"github.com/zenvisjr/building-scalable-microservices/logger"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// passwordResetRequestedMessage is returned whether or not the email exists, so the
+// endpoint cannot be used to find out which emails have an account
+const passwordResetRequestedMessage = "If an account exists for this email, a password reset link has been sent"
+
+var errInvalidResetToken = errors.New("invalid or expired password reset token")
+
+// PasswordResetConfig controls the forgot-password flow
+type PasswordResetConfig struct {
+	TokenTTL time.Duration // how long a reset link stays valid
+	ResetURL string        // page of the frontend that takes the token, ?token= is appended
+}
+
+// PasswordReset is the email job created for an existing account. It is nil when the email is unknown
+type PasswordReset struct {
+	Name      string
+	Email     string
+	Link      string
+	ExpiresAt time.Time
+}
+
+func generateResetToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// hashResetToken is what gets stored, the token itself only travels in the email
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *authService) RequestPasswordReset(ctx context.Context, email string, ac *account.Client) (*PasswordReset, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.Info(ctx, "RequestPasswordReset called for email: "+email)
+
+	// Step 1: Unknown and inactive accounts get no email but the same answer
+	acc, err := ac.GetEmailForAuth(ctx, email)
+	if err != nil {
+		Logs.Warn(ctx, "Password reset requested for unknown email: "+email)
+		return nil, nil
+	}
+	if !acc.IsActive {
+		Logs.Warn(ctx, "Password reset requested for inactive account: "+acc.ID)
+		return nil, nil
+	}
+
+	// Step 2: Create a single-use token, only its hash is stored
+	token, err := generateResetToken()
+	if err != nil {
+		Logs.Error(ctx, "Failed to generate password reset token: "+err.Error())
+		return nil, err
+	}
+	expiresAt := time.Now().Add(s.passwordReset.TokenTTL)
+	if err := s.repository.CreatePasswordResetToken(ctx, acc.ID, acc.Email, hashResetToken(token), expiresAt); err != nil {
+		Logs.Error(ctx, "Failed to store password reset token: "+err.Error())
+		return nil, err
+	}
+
+	// Step 3: Build the link that goes into the email
+	link, err := url.Parse(s.passwordReset.ResetURL)
+	if err != nil {
+		Logs.Error(ctx, "Invalid password reset URL: "+err.Error())
+		return nil, err
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	Logs.Info(ctx, "Password reset token created for user: "+acc.ID)
+	return &PasswordReset{
+		Name:      acc.Name,
+		Email:     acc.Email,
+		Link:      link.String(),
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+func (s *authService) ConfirmPasswordReset(ctx context.Context, token string, newPassword string, ac *account.Client) (*pb.UpdateAccountResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("ConfirmPasswordReset called")
+
+	// Step 1: Look up the token, it fails if it is unknown, expired or already used
+	tokenHash := hashResetToken(token)
+	userId, email, err := s.repository.GetPasswordResetToken(ctx, tokenHash)
+	if err != nil {
+		Logs.Warn(ctx, "Password reset with invalid token: "+err.Error())
+		return nil, errInvalidResetToken
+	}
+
+	// Step 2: The token was sent to the email the account had then. If the user changed it
+	// since, the address may belong to someone else by now, so the token is worthless
+	acc, err := ac.GetAccount(ctx, userId)
+	if err != nil && status.Code(err) != codes.NotFound {
+		Logs.Error(ctx, "Failed to fetch account for password reset: "+err.Error())
+		return nil, err
+	}
+	if err != nil || acc.Email != email {
+		Logs.Warn(ctx, "Password reset token of user "+userId+" was issued for a previous email")
+		if err := s.repository.InvalidatePasswordResetTokens(ctx, userId); err != nil {
+			Logs.Error(ctx, "Failed to invalidate password reset tokens: "+err.Error())
+		}
+		return nil, errInvalidResetToken
+	}
+
+	// Step 3: Set the new password (it is hashed by the account service). The token is only
+	// burnt once this succeeded, so a rejected password does not cost the user the link
+	if err := ac.UpdatePassword(ctx, email, newPassword); err != nil {
+		Logs.Error(ctx, "Password reset failed: "+err.Error())
+		return nil, err
+	}
+	if _, _, err := s.repository.ConsumePasswordResetToken(ctx, tokenHash); err != nil {
+		Logs.Warn(ctx, "Password reset token was used concurrently: "+err.Error())
+		return nil, errInvalidResetToken
+	}
+
+	// Step 4: Increment token version to invalidate access tokens
+	if err := ac.IncrementTokenVersion(ctx, userId); err != nil {
+		Logs.Error(ctx, "Failed to increment token version: "+err.Error())
+		return nil, err
+	}
+	s.tokenVersions.Invalidate(userId)
+
+	// Step 5: Delete all refresh tokens and end every session
+	if err := s.repository.DeleteRefreshToken(ctx, userId); err != nil {
+		Logs.Error(ctx, "Failed to delete refresh token: "+err.Error())
+		return nil, err
+	}
+	if err := s.sessions.RevokeUserSessions(ctx, userId); err != nil {
+		Logs.Error(ctx, "Failed to revoke sessions: "+err.Error())
+		return nil, err
+	}
+
+	// Step 6: Proving access to the mailbox also lifts a failed login lockout
+	if err := s.repository.ClearLockout(ctx, LockoutSubjectEmail, email); err != nil {
+		Logs.Error(ctx, "Failed to clear lockout: "+err.Error())
+	}
+	if err := s.repository.RecordSecurityEvent(ctx, userId, "password_reset", "password reset by email link"); err != nil {
+		Logs.Error(ctx, "Failed to record security event: "+err.Error())
+	}
+
+	Logs.Info(ctx, "Password reset successful for user: "+userId)
+	return &pb.UpdateAccountResponse{Message: "Password reset successfully, please login with your new password"}, nil
+}
@@ -0,0 +1,401 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"github.com/zenvisjr/building-scalable-microservices/account"
+	"github.com/zenvisjr/building-scalable-microservices/logger"
+	"github.com/zenvisjr/building-scalable-microservices/order"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	PrivacyRequestExport  = "export"
+	PrivacyRequestErasure = "erasure"
+
+	PrivacyStatusPending    = "pending"
+	PrivacyStatusProcessing = "processing"
+	PrivacyStatusCompleted  = "completed"
+	PrivacyStatusCancelled  = "cancelled"
+	PrivacyStatusFailed     = "failed"
+
+	// erasureLease is how long a replica may take to run an erasure before another one retries it
+	erasureLease = 10 * time.Minute
+)
+
+var errErasureNotPending = errors.New("no erasure is pending for this account")
+
+// PrivacyConfig controls when requested erasures are carried out
+type PrivacyConfig struct {
+	ErasureGracePeriod time.Duration // how long an erasure can be cancelled after it was requested
+	CheckInterval      time.Duration // how often due erasures are looked for
+	RetryDelay         time.Duration // wait before an erasure that failed a step is tried again
+	MaxAttempts        int           // runs of an erasure before it is marked failed, 0 retries forever
+}
+
+// PrivacyRequest is a data export or an erasure of an account together with the steps taken
+type PrivacyRequest struct {
+	ID           string
+	UserID       string
+	Kind         string
+	Status       string
+	RequestedBy  string
+	CreatedAt    time.Time
+	ScheduledFor time.Time // end of the grace period of an erasure, zero for exports
+	CompletedAt  time.Time // zero until the request completed, failed or was cancelled
+	Attempts     int       // runs of an erasure started so far, including the current one
+	Steps        []*PrivacyRequestStep
+}
+
+type PrivacyRequestStep struct {
+	Step      string
+	Status    string
+	Details   string
+	CreatedAt time.Time
+}
+
+// EmailHistoryEntry is an email auth sent to the user. Verification emails do not record the
+// address they went to
+type EmailHistoryEntry struct {
+	Type   string     `json:"type"`
+	Email  string     `json:"email,omitempty"`
+	SentAt time.Time  `json:"sent_at"`
+	UsedAt *time.Time `json:"used_at,omitempty"`
+}
+
+// DataExport is the archive handed out by ExportAccountData. Credentials such as the password
+// hash and the TOTP secret are left out
+type DataExport struct {
+	RequestID    string              `json:"request_id"`
+	GeneratedAt  time.Time           `json:"generated_at"`
+	Account      exportedAccount     `json:"account"`
+	Addresses    []account.Address   `json:"addresses"`
+	Orders       []order.Order       `json:"orders"`
+	Sessions     []exportedSession   `json:"sessions"`
+	EmailHistory []EmailHistoryEntry `json:"email_history"`
+}
+
+type exportedAccount struct {
+	ID            string    `json:"id"`
+	Name          string    `json:"name"`
+	Email         string    `json:"email"`
+	PendingEmail  string    `json:"pending_email,omitempty"`
+	Phone         string    `json:"phone"`
+	Role          string    `json:"role"`
+	IsActive      bool      `json:"is_active"`
+	EmailVerified bool      `json:"email_verified"`
+	TOTPEnabled   bool      `json:"totp_enabled"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type exportedSession struct {
+	ID         string     `json:"id"`
+	Device     string     `json:"device"`
+	IPAddress  string     `json:"ip_address"`
+	UserAgent  string     `json:"user_agent"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// recordPrivacyStep stores the outcome of a step and adds it to the request. It returns stepErr,
+// or the error of storing the step since a step that is not on record must not count as done
+func (s *authService) recordPrivacyStep(ctx context.Context, request *PrivacyRequest, step string, stepErr error, details string) error {
+	Logs := logger.GetGlobalLogger()
+
+	record := &PrivacyRequestStep{
+		Step:      step,
+		Status:    PrivacyStatusCompleted,
+		Details:   details,
+		CreatedAt: time.Now().UTC(),
+	}
+	if stepErr != nil {
+		record.Status = PrivacyStatusFailed
+		record.Details = stepErr.Error()
+	}
+	if err := s.repository.RecordPrivacyStep(ctx, request.ID, record); err != nil {
+		Logs.Error(ctx, "Failed to record privacy step "+step+" of request "+request.ID+": "+err.Error())
+		return err
+	}
+	request.Steps = append(request.Steps, record)
+	return stepErr
+}
+
+// ExportAccountData gathers everything the services store about the user into a JSON archive
+func (s *authService) ExportAccountData(ctx context.Context, userId string, requestedBy string, ac *account.Client, oc *order.Client) (*PrivacyRequest, []byte, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.Info(ctx, "Exporting data of user "+userId+" for "+requestedBy)
+
+	request := &PrivacyRequest{
+		ID:          ksuid.New().String(),
+		UserID:      userId,
+		Kind:        PrivacyRequestExport,
+		Status:      PrivacyStatusProcessing,
+		RequestedBy: requestedBy,
+		CreatedAt:   time.Now().UTC(),
+	}
+	if err := s.repository.CreatePrivacyRequest(ctx, request); err != nil {
+		Logs.Error(ctx, "Failed to store export request: "+err.Error())
+		return nil, nil, err
+	}
+
+	export, err := s.collectAccountData(ctx, request, ac, oc)
+	var archive []byte
+	if err == nil {
+		archive, err = json.MarshalIndent(export, "", "  ")
+		err = s.recordPrivacyStep(ctx, request, "archive", err, strconv.Itoa(len(archive))+" bytes")
+	}
+
+	request.Status = PrivacyStatusCompleted
+	if err != nil {
+		request.Status = PrivacyStatusFailed
+	}
+	request.CompletedAt = time.Now().UTC()
+	if finishErr := s.repository.FinishPrivacyRequest(ctx, request.ID, request.Status); finishErr != nil {
+		Logs.Error(ctx, "Failed to finish export request: "+finishErr.Error())
+		if err == nil {
+			err = finishErr
+		}
+	}
+	if err != nil {
+		Logs.Error(ctx, "Failed to export data of user "+userId+": "+err.Error())
+		return nil, nil, err
+	}
+
+	Logs.Info(ctx, "Exported data of user "+userId+" in request "+request.ID)
+	return request, archive, nil
+}
+
+func (s *authService) collectAccountData(ctx context.Context, request *PrivacyRequest, ac *account.Client, oc *order.Client) (*DataExport, error) {
+	userId := request.UserID
+	export := &DataExport{RequestID: request.ID, GeneratedAt: request.CreatedAt}
+
+	// Step 1: Profile and address book from the account service
+	acc, err := ac.GetAccount(ctx, userId)
+	if err := s.recordPrivacyStep(ctx, request, "account", err, ""); err != nil {
+		return nil, err
+	}
+	export.Account = exportedAccount{
+		ID:            acc.ID,
+		Name:          acc.Name,
+		Email:         acc.Email,
+		PendingEmail:  acc.PendingEmail,
+		Phone:         acc.Phone,
+		Role:          acc.Role,
+		IsActive:      acc.IsActive,
+		EmailVerified: acc.EmailVerified,
+		TOTPEnabled:   acc.TOTPEnabled,
+		CreatedAt:     acc.CreatedAt,
+	}
+	export.Addresses, err = ac.ListAddresses(ctx, userId)
+	if err := s.recordPrivacyStep(ctx, request, "addresses", err, strconv.Itoa(len(export.Addresses))+" addresses"); err != nil {
+		return nil, err
+	}
+
+	// Step 2: Orders from the order service
+	export.Orders, err = oc.GetOrdersForAccount(ctx, userId)
+	if err := s.recordPrivacyStep(ctx, request, "orders", err, strconv.Itoa(len(export.Orders))+" orders"); err != nil {
+		return nil, err
+	}
+
+	// Step 3: Sessions and sent emails kept by auth itself
+	sessions, err := s.sessions.ListUserSessionHistory(ctx, userId)
+	if err := s.recordPrivacyStep(ctx, request, "sessions", err, strconv.Itoa(len(sessions))+" sessions"); err != nil {
+		return nil, err
+	}
+	export.Sessions = make([]exportedSession, len(sessions))
+	for i, session := range sessions {
+		export.Sessions[i] = exportedSession{
+			ID:         session.ID,
+			Device:     session.Device,
+			IPAddress:  session.IPAddress,
+			UserAgent:  session.UserAgent,
+			CreatedAt:  session.CreatedAt,
+			LastSeenAt: session.LastSeenAt,
+			ExpiresAt:  session.ExpiresAt,
+		}
+		if !session.RevokedAt.IsZero() {
+			export.Sessions[i].RevokedAt = &session.RevokedAt
+		}
+	}
+	export.EmailHistory, err = s.repository.ListEmailHistory(ctx, userId)
+	if err := s.recordPrivacyStep(ctx, request, "email_history", err, strconv.Itoa(len(export.EmailHistory))+" emails"); err != nil {
+		return nil, err
+	}
+
+	return export, nil
+}
+
+// RequestErasure schedules the erasure of the account once the grace period is over. Asking
+// again while one is pending returns the pending erasure
+func (s *authService) RequestErasure(ctx context.Context, userId string, requestedBy string, ac *account.Client) (*PrivacyRequest, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.Info(ctx, "Erasure of user "+userId+" requested by "+requestedBy)
+
+	pending, err := s.repository.GetPendingErasure(ctx, userId)
+	if err == nil {
+		return pending, nil
+	}
+	if !errors.Is(err, errErasureNotPending) {
+		Logs.Error(ctx, "Failed to look up pending erasure: "+err.Error())
+		return nil, err
+	}
+	if _, err := ac.GetAccount(ctx, userId); err != nil {
+		Logs.Error(ctx, "Failed to fetch account to erase: "+err.Error())
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	request := &PrivacyRequest{
+		ID:           ksuid.New().String(),
+		UserID:       userId,
+		Kind:         PrivacyRequestErasure,
+		Status:       PrivacyStatusPending,
+		RequestedBy:  requestedBy,
+		CreatedAt:    now,
+		ScheduledFor: now.Add(s.privacy.ErasureGracePeriod),
+	}
+	if err := s.repository.CreatePrivacyRequest(ctx, request); err != nil {
+		Logs.Error(ctx, "Failed to store erasure request: "+err.Error())
+		return nil, err
+	}
+	if err := s.recordPrivacyStep(ctx, request, "requested", nil, "requested by "+requestedBy); err != nil {
+		return nil, err
+	}
+
+	Logs.Info(ctx, "Erasure of user "+userId+" scheduled for "+request.ScheduledFor.Format(time.RFC3339))
+	return request, nil
+}
+
+// CancelErasure stops a pending erasure, it cannot be cancelled once it started
+func (s *authService) CancelErasure(ctx context.Context, userId string, cancelledBy string) (*PrivacyRequest, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.Info(ctx, "Erasure of user "+userId+" cancelled by "+cancelledBy)
+
+	request, err := s.repository.CancelErasure(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.recordPrivacyStep(ctx, request, "cancelled", nil, "cancelled by "+cancelledBy); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+func (s *authService) ListPrivacyRequests(ctx context.Context, userId string) ([]*PrivacyRequest, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("ListPrivacyRequests called for user: " + userId)
+
+	return s.repository.ListPrivacyRequests(ctx, userId)
+}
+
+// RunErasures carries out erasures whose grace period is over until ctx is done
+func (s *authService) RunErasures(ctx context.Context, ac *account.Client, oc *order.Client) {
+	Logs := logger.GetGlobalLogger()
+	if s.privacy.CheckInterval <= 0 {
+		Logs.Warn(ctx, "Erasure check interval not set, requested erasures will not run")
+		return
+	}
+
+	ticker := time.NewTicker(s.privacy.CheckInterval)
+	defer ticker.Stop()
+	for {
+		s.processDueErasures(ctx, ac, oc)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *authService) processDueErasures(ctx context.Context, ac *account.Client, oc *order.Client) {
+	Logs := logger.GetGlobalLogger()
+
+	for ctx.Err() == nil {
+		request, err := s.repository.ClaimDueErasure(ctx, erasureLease)
+		if err != nil {
+			Logs.Error(ctx, "Failed to claim due erasure: "+err.Error())
+			return
+		}
+		if request == nil {
+			return
+		}
+
+		if err := s.eraseAccountData(ctx, request, ac, oc); err != nil {
+			// an erasure that keeps failing is left to an operator, its steps tell what is missing
+			if s.privacy.MaxAttempts > 0 && request.Attempts >= s.privacy.MaxAttempts {
+				Logs.Error(ctx, "Erasure "+request.ID+" of user "+request.UserID+" failed "+strconv.Itoa(request.Attempts)+" times, giving up: "+err.Error())
+				if err := s.repository.FinishPrivacyRequest(ctx, request.ID, PrivacyStatusFailed); err != nil {
+					Logs.Error(ctx, "Failed to mark erasure "+request.ID+" as failed: "+err.Error())
+				}
+				continue
+			}
+			Logs.Error(ctx, "Erasure "+request.ID+" of user "+request.UserID+" failed, retrying later: "+err.Error())
+			if err := s.repository.RetryErasure(ctx, request.ID, time.Now().Add(s.privacy.RetryDelay)); err != nil {
+				Logs.Error(ctx, "Failed to reschedule erasure "+request.ID+": "+err.Error())
+			}
+			continue
+		}
+		if err := s.repository.FinishPrivacyRequest(ctx, request.ID, PrivacyStatusCompleted); err != nil {
+			Logs.Error(ctx, "Failed to complete erasure "+request.ID+": "+err.Error())
+			continue
+		}
+		Logs.Info(ctx, "Erased data of user "+request.UserID+" in request "+request.ID)
+	}
+}
+
+// eraseAccountData removes the personal data of the user from every service. Each step can run
+// again without harm, a failed erasure is retried from the start
+func (s *authService) eraseAccountData(ctx context.Context, request *PrivacyRequest, ac *account.Client, oc *order.Client) error {
+	userId := request.UserID
+
+	// Step 1: Login attempts are stored by email, read it before the account is anonymized. An
+	// account deleted in the meantime has nothing left to anonymize, the other services may still
+	// hold data of it
+	var emails []string
+	details := ""
+	acc, err := ac.GetAccount(ctx, userId)
+	if status.Code(err) == codes.NotFound {
+		err = nil
+		details = "account already deleted"
+	} else if err == nil {
+		emails = append(emails, acc.Email)
+		if acc.PendingEmail != "" {
+			emails = append(emails, acc.PendingEmail)
+		}
+	}
+	if err := s.recordPrivacyStep(ctx, request, "lookup", err, details); err != nil {
+		return err
+	}
+
+	// Step 2: Shipping addresses copied into orders
+	count, err := oc.AnonymizeOrdersForAccount(ctx, userId)
+	if err := s.recordPrivacyStep(ctx, request, "orders", err, strconv.Itoa(count)+" orders anonymized"); err != nil {
+		return err
+	}
+
+	// Step 3: Tokens, sessions, two-factor codes and login history kept by auth
+	err = s.repository.EraseUserData(ctx, userId, emails)
+	if err == nil {
+		err = s.sessions.DeleteUserSessions(ctx, userId)
+	}
+	if err := s.recordPrivacyStep(ctx, request, "auth", err, "tokens, sessions and login history deleted"); err != nil {
+		return err
+	}
+
+	// Step 4: The account itself, last since the earlier steps need it to exist
+	err = ac.EraseAccount(ctx, userId)
+	if err := s.recordPrivacyStep(ctx, request, "account", err, "profile anonymized and addresses deleted"); err != nil {
+		return err
+	}
+	s.tokenVersions.Invalidate(userId)
+	return nil
+}
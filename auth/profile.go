@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"context"
+
+	"github.com/zenvisjr/building-scalable-microservices/account"
+	"github.com/zenvisjr/building-scalable-microservices/logger"
+)
+
+// UpdateProfile changes the profile of the user. A new email is stored as pending by the account
+// service, the returned verification has to be sent to it and is nil when the email did not change
+func (s *authService) UpdateProfile(ctx context.Context, userId string, update account.ProfileUpdate, ac *account.Client) (*account.Account, *EmailVerification, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("UpdateProfile called for user: " + userId)
+
+	// Step 1: A new email sends a verification email, so it is rate limited like resending one.
+	// The email is reserved up front and counts even if the account service rejects the change
+	emailChanged := false
+	if update.Email != nil {
+		current, err := ac.GetAccount(ctx, userId)
+		if err != nil {
+			Logs.Error(ctx, "Failed to fetch account: "+err.Error())
+			return nil, nil, err
+		}
+		emailChanged = *update.Email != current.Email && *update.Email != current.PendingEmail
+		if emailChanged {
+			if err := s.reserveVerificationEmail(ctx, userId); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	// Step 2: Let the account service apply the change
+	acc, err := ac.UpdateProfile(ctx, userId, update)
+	if err != nil {
+		Logs.Error(ctx, "Failed to update profile: "+err.Error())
+		return nil, nil, err
+	}
+	if !emailChanged || acc.PendingEmail == "" {
+		return acc, nil, nil
+	}
+
+	// Step 3: The change only takes effect once the link sent to the new email is opened
+	pending := *acc
+	pending.Email = acc.PendingEmail
+	verification, err := s.newEmailVerification(ctx, &pending)
+	if err != nil {
+		return nil, nil, err
+	}
+	Logs.Info(ctx, "Email change requested for user: "+userId)
+	return acc, verification, nil
+}
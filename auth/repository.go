@@ -2,17 +2,55 @@ package auth
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"errors"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/zenvisjr/building-scalable-microservices/logger"
 )
 
 type Repository interface {
-	StoreRefreshToken(ctx context.Context, refreshToken string, userId string) error
-	GetRefreshToken(ctx context.Context, id string) (*TokenData, error)
+	StoreRefreshToken(ctx context.Context, refreshToken string, userId string, familyId string, expiresAt time.Time) error
+	GetRefreshToken(ctx context.Context, refreshToken string) (*TokenData, error)
+	RotateRefreshToken(ctx context.Context, oldRefreshToken string, newRefreshToken string, expiresAt time.Time) error
+	RevokeTokenFamily(ctx context.Context, familyId string) error
 	DeleteRefreshToken(ctx context.Context, id string) error
+	RecordSecurityEvent(ctx context.Context, userId string, eventType string, details string) error
+	ReplaceRecoveryCodes(ctx context.Context, userId string, codeHashes []string) error
+	UseRecoveryCode(ctx context.Context, userId string, codeHash string) (bool, error)
+	MarkTOTPStepUsed(ctx context.Context, userId string, step int64) (bool, error)
+	CreatePasswordResetToken(ctx context.Context, userId string, email string, tokenHash string, expiresAt time.Time) error
+	GetPasswordResetToken(ctx context.Context, tokenHash string) (string, string, error)
+	ConsumePasswordResetToken(ctx context.Context, tokenHash string) (string, string, error)
+	InvalidatePasswordResetTokens(ctx context.Context, userId string) error
+	ReserveVerificationEmail(ctx context.Context, userId string, interval time.Duration, maxPerDay int) (bool, error)
+	RecordLoginAttempt(ctx context.Context, email string, clientIP string, success bool) error
+	GetLockout(ctx context.Context, subjectType string, subject string) (*Lockout, error)
+	RegisterFailedLogin(ctx context.Context, subjectType string, subject string, window time.Duration) (*Lockout, error)
+	LockSubject(ctx context.Context, subjectType string, subject string, lockedUntil time.Time) error
+	ClearLockout(ctx context.Context, subjectType string, subject string) error
+	CreateAPIKey(ctx context.Context, key *APIKey, keyHash string) error
+	ListAPIKeys(ctx context.Context) ([]*APIKey, error)
+	RotateAPIKey(ctx context.Context, id string, prefix string, keyHash string, previousValidUntil time.Time) (*APIKey, error)
+	RevokeAPIKey(ctx context.Context, id string) error
+	UseAPIKey(ctx context.Context, keyHash string) (*APIKey, error)
+	CreateOIDCLoginState(ctx context.Context, stateHash string, state *OIDCLoginState) error
+	ConsumeOIDCLoginState(ctx context.Context, stateHash string) (*OIDCLoginState, error)
+	GetOIDCIdentity(ctx context.Context, provider string, subject string) (string, error)
+	LinkOIDCIdentity(ctx context.Context, provider string, subject string, userId string, email string) error
+	CreatePrivacyRequest(ctx context.Context, request *PrivacyRequest) error
+	RecordPrivacyStep(ctx context.Context, requestId string, step *PrivacyRequestStep) error
+	FinishPrivacyRequest(ctx context.Context, requestId string, status string) error
+	ListPrivacyRequests(ctx context.Context, userId string) ([]*PrivacyRequest, error)
+	GetPendingErasure(ctx context.Context, userId string) (*PrivacyRequest, error)
+	CancelErasure(ctx context.Context, userId string) (*PrivacyRequest, error)
+	ClaimDueErasure(ctx context.Context, lease time.Duration) (*PrivacyRequest, error)
+	RetryErasure(ctx context.Context, requestId string, retryAt time.Time) error
+	ListEmailHistory(ctx context.Context, userId string) ([]EmailHistoryEntry, error)
+	EraseUserData(ctx context.Context, userId string, emails []string) error
 	Close()
 	Ping() error
 }
@@ -22,9 +60,33 @@ type postgresRepository struct {
 }
 
 type TokenData struct {
-	UserID       string
-	RefreshToken string
-	ExpiresAt    time.Time
+	UserID    string
+	FamilyID  string
+	ExpiresAt time.Time
+	RotatedAt time.Time // zero until the token is exchanged for a new one
+	RevokedAt time.Time // zero unless the whole family was revoked
+}
+
+var (
+	errRefreshTokenNotFound = errors.New("refresh token not found")
+	// errRefreshTokenReused is returned when a token that was already rotated is presented again
+	errRefreshTokenReused    = errors.New("refresh token already used")
+	errPasswordResetNotFound = errors.New("password reset token not found, expired or already used")
+)
+
+// hashRefreshToken is what gets stored, so a leaked table cannot be replayed as tokens
+func hashRefreshToken(refreshToken string) string {
+	sum := sha256.Sum256([]byte(refreshToken))
+	return hex.EncodeToString(sum[:])
+}
+
+// Lockout is the failed login state of a single email or client IP
+type Lockout struct {
+	SubjectType    string
+	Subject        string
+	FailedAttempts int
+	LockoutLevel   int
+	LockedUntil    time.Time
 }
 
 func NewPostgresRepository(url string) (Repository, error) {
@@ -56,44 +118,640 @@ func (p *postgresRepository) Ping() error {
 	return p.db.Ping()
 }
 
-func (p *postgresRepository) StoreRefreshToken(ctx context.Context, refreshToken string, userId string) error {
+func (p *postgresRepository) StoreRefreshToken(ctx context.Context, refreshToken string, userId string, familyId string, expiresAt time.Time) error {
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("Storing refresh token in DB")
 	query := `
-		INSERT INTO refresh_tokens (user_id, refresh_token, expires_at)
-		VALUES ($1, $2, $3)
+		INSERT INTO refresh_tokens (user_id, token_hash, family_id, expires_at)
+		VALUES ($1, $2, $3, $4)
 	`
-	_, err := p.db.ExecContext(ctx, query, userId, refreshToken, time.Now().Add(15*time.Minute))
+	_, err := p.db.ExecContext(ctx, query, userId, hashRefreshToken(refreshToken), familyId, expiresAt)
 	return err
 }
 
-func (r *postgresRepository) GetRefreshToken(ctx context.Context, id string) (*TokenData, error) {
+func (r *postgresRepository) GetRefreshToken(ctx context.Context, refreshToken string) (*TokenData, error) {
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("Getting refresh token from access_token DB")
 	query := `
-		SELECT user_id, refresh_token, expires_at
+		SELECT user_id, family_id, expires_at, rotated_at, revoked_at
 		FROM refresh_tokens
-		WHERE user_id = $1
-		ORDER BY expires_at DESC
-		LIMIT 1;
+		WHERE token_hash = $1
 	`
 
-	row := r.db.QueryRowContext(ctx, query, id)
+	row := r.db.QueryRowContext(ctx, query, hashRefreshToken(refreshToken))
 
 	var rt TokenData
-	if err := row.Scan(&rt.UserID, &rt.RefreshToken, &rt.ExpiresAt); err != nil {
+	var rotatedAt, revokedAt sql.NullTime
+	if err := row.Scan(&rt.UserID, &rt.FamilyID, &rt.ExpiresAt, &rotatedAt, &revokedAt); err != nil {
 		if err == sql.ErrNoRows {
-			return nil, errors.New("refresh token not found")
+			return nil, errRefreshTokenNotFound
 		}
 		return nil, err
 	}
+	rt.RotatedAt = rotatedAt.Time
+	rt.RevokedAt = revokedAt.Time
 	return &rt, nil
 }
 
+// RotateRefreshToken marks the old token as used and stores its successor in the same family.
+// The conditional update makes two concurrent refreshes with one token fail for the loser
+func (r *postgresRepository) RotateRefreshToken(ctx context.Context, oldRefreshToken string, newRefreshToken string, expiresAt time.Time) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int
+	var userId, familyId string
+	err = tx.QueryRowContext(ctx, `
+		UPDATE refresh_tokens
+		SET rotated_at = NOW()
+		WHERE token_hash = $1 AND rotated_at IS NULL AND revoked_at IS NULL
+		RETURNING id, user_id, family_id
+	`, hashRefreshToken(oldRefreshToken)).Scan(&id, &userId, &familyId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return errRefreshTokenReused
+		}
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO refresh_tokens (user_id, token_hash, family_id, parent_id, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`, userId, hashRefreshToken(newRefreshToken), familyId, id, expiresAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *postgresRepository) RevokeTokenFamily(ctx context.Context, familyId string) error {
+	query := `UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL`
+	_, err := r.db.ExecContext(ctx, query, familyId)
+	return err
+}
+
+func (r *postgresRepository) RecordSecurityEvent(ctx context.Context, userId string, eventType string, details string) error {
+	query := `INSERT INTO security_events (user_id, event_type, details) VALUES ($1, $2, $3)`
+	_, err := r.db.ExecContext(ctx, query, userId, eventType, details)
+	return err
+}
+
 func (r *postgresRepository) DeleteRefreshToken(ctx context.Context, userID string) error {
 	query := `DELETE FROM refresh_tokens WHERE user_id = $1`
 	_, err := r.db.ExecContext(ctx, query, userID)
 	return err
 }
 
+func (r *postgresRepository) RecordLoginAttempt(ctx context.Context, email string, clientIP string, success bool) error {
+	query := `INSERT INTO login_attempts (email, client_ip, success) VALUES ($1, $2, $3)`
+	_, err := r.db.ExecContext(ctx, query, email, clientIP, success)
+	return err
+}
+
+func (r *postgresRepository) GetLockout(ctx context.Context, subjectType string, subject string) (*Lockout, error) {
+	query := `
+		SELECT failed_attempts, lockout_level, locked_until
+		FROM login_lockouts
+		WHERE subject_type = $1 AND subject = $2
+	`
+
+	l := &Lockout{SubjectType: subjectType, Subject: subject}
+	var lockedUntil sql.NullTime
+	err := r.db.QueryRowContext(ctx, query, subjectType, subject).Scan(&l.FailedAttempts, &l.LockoutLevel, &lockedUntil)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// never failed before, nothing is locked
+			return l, nil
+		}
+		return nil, err
+	}
+	l.LockedUntil = lockedUntil.Time
+	return l, nil
+}
+
+// RegisterFailedLogin atomically bumps the failure counter so concurrent replicas never lose a failure.
+// Failures older than window are forgotten and the counter starts again from 1.
+func (r *postgresRepository) RegisterFailedLogin(ctx context.Context, subjectType string, subject string, window time.Duration) (*Lockout, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Registering failed login for " + subjectType + ": " + subject)
+	query := `
+		INSERT INTO login_lockouts (subject_type, subject, failed_attempts, last_failed_at)
+		VALUES ($1, $2, 1, NOW())
+		ON CONFLICT (subject_type, subject) DO UPDATE SET
+			failed_attempts = CASE
+				WHEN login_lockouts.last_failed_at < NOW() - make_interval(secs => $3) THEN 1
+				ELSE login_lockouts.failed_attempts + 1
+			END,
+			last_failed_at = NOW()
+		RETURNING failed_attempts, lockout_level, locked_until
+	`
+
+	l := &Lockout{SubjectType: subjectType, Subject: subject}
+	var lockedUntil sql.NullTime
+	err := r.db.QueryRowContext(ctx, query, subjectType, subject, window.Seconds()).Scan(&l.FailedAttempts, &l.LockoutLevel, &lockedUntil)
+	if err != nil {
+		return nil, err
+	}
+	l.LockedUntil = lockedUntil.Time
+	return l, nil
+}
+
+// LockSubject locks an email or IP until lockedUntil, resets its counter and raises the backoff level
+func (r *postgresRepository) LockSubject(ctx context.Context, subjectType string, subject string, lockedUntil time.Time) error {
+	query := `
+		UPDATE login_lockouts
+		SET failed_attempts = 0, lockout_level = lockout_level + 1, locked_until = $3
+		WHERE subject_type = $1 AND subject = $2
+	`
+	_, err := r.db.ExecContext(ctx, query, subjectType, subject, lockedUntil)
+	return err
+}
+
+func (r *postgresRepository) ClearLockout(ctx context.Context, subjectType string, subject string) error {
+	query := `DELETE FROM login_lockouts WHERE subject_type = $1 AND subject = $2`
+	_, err := r.db.ExecContext(ctx, query, subjectType, subject)
+	return err
+}
+
+// ReplaceRecoveryCodes drops every previous recovery code of the user and stores the new ones
+func (r *postgresRepository) ReplaceRecoveryCodes(ctx context.Context, userId string, codeHashes []string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM totp_recovery_codes WHERE user_id = $1`, userId); err != nil {
+		return err
+	}
+	for _, codeHash := range codeHashes {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO totp_recovery_codes (user_id, code_hash) VALUES ($1, $2)`, userId, codeHash); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UseRecoveryCode burns the code and reports whether it was valid and unused
+func (r *postgresRepository) UseRecoveryCode(ctx context.Context, userId string, codeHash string) (bool, error) {
+	query := `
+		UPDATE totp_recovery_codes
+		SET used_at = NOW()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`
+	res, err := r.db.ExecContext(ctx, query, userId, codeHash)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count == 1, err
+}
+
+// MarkTOTPStepUsed records the time step of an accepted code and returns false when that step
+// (or a later one) was already used, so a code cannot be replayed within its window
+func (r *postgresRepository) MarkTOTPStepUsed(ctx context.Context, userId string, step int64) (bool, error) {
+	query := `
+		INSERT INTO totp_used_steps (user_id, last_step)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET last_step = EXCLUDED.last_step
+		WHERE totp_used_steps.last_step < EXCLUDED.last_step
+		RETURNING user_id
+	`
+	var id string
+	err := r.db.QueryRowContext(ctx, query, userId, step).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// CreatePasswordResetToken stores a new reset token and invalidates the older unused ones of
+// the user, so only the most recent email works
+func (r *postgresRepository) CreatePasswordResetToken(ctx context.Context, userId string, email string, tokenHash string, expiresAt time.Time) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `UPDATE password_reset_tokens SET used_at = NOW() WHERE user_id = $1 AND used_at IS NULL`, userId); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO password_reset_tokens (user_id, email, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`, userId, email, tokenHash, expiresAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetPasswordResetToken returns the user id and email of a token that is still usable, without using it
+func (r *postgresRepository) GetPasswordResetToken(ctx context.Context, tokenHash string) (string, string, error) {
+	query := `
+		SELECT user_id, email FROM password_reset_tokens
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+	`
+	var userId, email string
+	err := r.db.QueryRowContext(ctx, query, tokenHash).Scan(&userId, &email)
+	if err == sql.ErrNoRows {
+		return "", "", errPasswordResetNotFound
+	}
+	return userId, email, err
+}
+
+// ConsumePasswordResetToken marks the token as used and returns the user id and email it was issued for.
+// The conditional update makes a token usable exactly once even with concurrent requests
+func (r *postgresRepository) ConsumePasswordResetToken(ctx context.Context, tokenHash string) (string, string, error) {
+	query := `
+		UPDATE password_reset_tokens
+		SET used_at = NOW()
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_id, email
+	`
+	var userId, email string
+	err := r.db.QueryRowContext(ctx, query, tokenHash).Scan(&userId, &email)
+	if err == sql.ErrNoRows {
+		return "", "", errPasswordResetNotFound
+	}
+	return userId, email, err
+}
+
+// InvalidatePasswordResetTokens marks every unused reset token of the user as used
+func (r *postgresRepository) InvalidatePasswordResetTokens(ctx context.Context, userId string) error {
+	_, err := r.db.ExecContext(ctx, `UPDATE password_reset_tokens SET used_at = NOW() WHERE user_id = $1 AND used_at IS NULL`, userId)
+	return err
+}
+
+// ReserveVerificationEmail records a verification email to the user unless one was sent within
+// interval or maxPerDay were sent within 24 hours, and tells whether it was recorded. The
+// transaction holds an advisory lock on the user, so concurrent requests check the limit one
+// after the other instead of all passing it before any of them is recorded
+func (r *postgresRepository) ReserveVerificationEmail(ctx context.Context, userId string, interval time.Duration, maxPerDay int) (bool, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext('verification_emails:' || $1))`, userId); err != nil {
+		return false, err
+	}
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO verification_emails (user_id)
+		SELECT $1
+		WHERE (SELECT COUNT(*) FROM verification_emails WHERE user_id = $1 AND sent_at >= NOW() - INTERVAL '24 hours') < $2
+		  AND NOT EXISTS (SELECT 1 FROM verification_emails WHERE user_id = $1 AND sent_at > NOW() - make_interval(secs => $3))
+	`, userId, maxPerDay, interval.Seconds())
+	if err != nil {
+		return false, err
+	}
+	recorded, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return recorded == 1, tx.Commit()
+}
+
+// apiKeyColumns is selected by every API key query, in the order scanAPIKey expects
+const apiKeyColumns = `id, name, prefix, scopes, created_by, created_at, expires_at, last_used_at, revoked_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAPIKey(row rowScanner) (*APIKey, error) {
+	key := &APIKey{}
+	var lastUsedAt, revokedAt sql.NullTime
+	if err := row.Scan(&key.ID, &key.Name, &key.Prefix, pq.Array(&key.Scopes), &key.CreatedBy, &key.CreatedAt, &key.ExpiresAt, &lastUsedAt, &revokedAt); err != nil {
+		return nil, err
+	}
+	key.LastUsedAt = lastUsedAt.Time
+	key.RevokedAt = revokedAt.Time
+	return key, nil
+}
+
+func (r *postgresRepository) CreateAPIKey(ctx context.Context, key *APIKey, keyHash string) error {
+	query := `
+		INSERT INTO api_keys (id, name, prefix, key_hash, scopes, created_by, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+	_, err := r.db.ExecContext(ctx, query, key.ID, key.Name, key.Prefix, keyHash, pq.Array(key.Scopes), key.CreatedBy, key.CreatedAt, key.ExpiresAt)
+	return err
+}
+
+func (r *postgresRepository) ListAPIKeys(ctx context.Context) ([]*APIKey, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT `+apiKeyColumns+` FROM api_keys ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// RotateAPIKey replaces the hash of an active key, the old hash keeps working until previousValidUntil
+func (r *postgresRepository) RotateAPIKey(ctx context.Context, id string, prefix string, keyHash string, previousValidUntil time.Time) (*APIKey, error) {
+	query := `
+		UPDATE api_keys
+		SET previous_key_hash = key_hash, previous_valid_until = $4, key_hash = $3, prefix = $2
+		WHERE id = $1 AND revoked_at IS NULL AND expires_at > NOW()
+		RETURNING ` + apiKeyColumns
+	key, err := scanAPIKey(r.db.QueryRowContext(ctx, query, id, prefix, keyHash, previousValidUntil))
+	if err == sql.ErrNoRows {
+		return nil, errAPIKeyNotFound
+	}
+	return key, err
+}
+
+func (r *postgresRepository) RevokeAPIKey(ctx context.Context, id string) error {
+	res, err := r.db.ExecContext(ctx, `UPDATE api_keys SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL`, id)
+	if err != nil {
+		return err
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		return errAPIKeyNotFound
+	}
+	return nil
+}
+
+// UseAPIKey looks up an active key by its current or, during the rotation grace period,
+// its previous hash and records that it was used
+func (r *postgresRepository) UseAPIKey(ctx context.Context, keyHash string) (*APIKey, error) {
+	query := `
+		UPDATE api_keys
+		SET last_used_at = NOW()
+		WHERE (key_hash = $1 OR (previous_key_hash = $1 AND previous_valid_until > NOW()))
+		  AND revoked_at IS NULL AND expires_at > NOW()
+		RETURNING ` + apiKeyColumns
+	key, err := scanAPIKey(r.db.QueryRowContext(ctx, query, keyHash))
+	if err == sql.ErrNoRows {
+		return nil, errAPIKeyNotFound
+	}
+	return key, err
+}
+
+// CreateOIDCLoginState remembers a login started with a provider until the user comes back.
+// Leftovers of logins that were never completed are cleaned up on the way
+func (r *postgresRepository) CreateOIDCLoginState(ctx context.Context, stateHash string, state *OIDCLoginState) error {
+	if _, err := r.db.ExecContext(ctx, `DELETE FROM oidc_login_states WHERE expires_at < NOW() - INTERVAL '1 day'`); err != nil {
+		return err
+	}
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO oidc_login_states (state_hash, provider, nonce, code_verifier, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`, stateHash, state.Provider, state.Nonce, state.CodeVerifier, state.ExpiresAt)
+	return err
+}
+
+// ConsumeOIDCLoginState marks the state as used and returns it, a state works exactly once
+func (r *postgresRepository) ConsumeOIDCLoginState(ctx context.Context, stateHash string) (*OIDCLoginState, error) {
+	query := `
+		UPDATE oidc_login_states
+		SET used_at = NOW()
+		WHERE state_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING provider, nonce, code_verifier, expires_at
+	`
+	state := &OIDCLoginState{}
+	err := r.db.QueryRowContext(ctx, query, stateHash).Scan(&state.Provider, &state.Nonce, &state.CodeVerifier, &state.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, errInvalidOIDCState
+	}
+	return state, err
+}
+
+// GetOIDCIdentity returns the account linked to the subject of a provider
+func (r *postgresRepository) GetOIDCIdentity(ctx context.Context, provider string, subject string) (string, error) {
+	var userId string
+	err := r.db.QueryRowContext(ctx, `SELECT user_id FROM oidc_identities WHERE provider = $1 AND subject = $2`, provider, subject).Scan(&userId)
+	if err == sql.ErrNoRows {
+		return "", errOIDCIdentityNotFound
+	}
+	return userId, err
+}
+
+// LinkOIDCIdentity links the subject to the account, or records another login if it already is
+func (r *postgresRepository) LinkOIDCIdentity(ctx context.Context, provider string, subject string, userId string, email string) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO oidc_identities (provider, subject, user_id, email, last_login_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		ON CONFLICT (provider, subject) DO UPDATE SET email = EXCLUDED.email, last_login_at = NOW()
+	`, provider, subject, userId, email)
+	return err
+}
+
+// privacyRequestColumns is selected by every privacy request query, in the order scanPrivacyRequest expects
+const privacyRequestColumns = `id, user_id, kind, status, requested_by, created_at, scheduled_for, completed_at, attempts`
+
+func scanPrivacyRequest(row rowScanner) (*PrivacyRequest, error) {
+	request := &PrivacyRequest{}
+	var scheduledFor, completedAt sql.NullTime
+	if err := row.Scan(&request.ID, &request.UserID, &request.Kind, &request.Status, &request.RequestedBy, &request.CreatedAt, &scheduledFor, &completedAt, &request.Attempts); err != nil {
+		return nil, err
+	}
+	request.ScheduledFor = scheduledFor.Time
+	request.CompletedAt = completedAt.Time
+	return request, nil
+}
+
+func (r *postgresRepository) CreatePrivacyRequest(ctx context.Context, request *PrivacyRequest) error {
+	var scheduledFor sql.NullTime
+	if !request.ScheduledFor.IsZero() {
+		scheduledFor = sql.NullTime{Time: request.ScheduledFor, Valid: true}
+	}
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO privacy_requests (id, user_id, kind, status, requested_by, created_at, scheduled_for)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, request.ID, request.UserID, request.Kind, request.Status, request.RequestedBy, request.CreatedAt, scheduledFor)
+	return err
+}
+
+func (r *postgresRepository) RecordPrivacyStep(ctx context.Context, requestId string, step *PrivacyRequestStep) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO privacy_request_steps (request_id, step, status, details, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`, requestId, step.Step, step.Status, step.Details, step.CreatedAt)
+	return err
+}
+
+func (r *postgresRepository) FinishPrivacyRequest(ctx context.Context, requestId string, status string) error {
+	query := `UPDATE privacy_requests SET status = $2, completed_at = NOW(), locked_until = NULL WHERE id = $1`
+	_, err := r.db.ExecContext(ctx, query, requestId, status)
+	return err
+}
+
+// ListPrivacyRequests returns the requests of the user newest first, each with its steps in order
+func (r *postgresRepository) ListPrivacyRequests(ctx context.Context, userId string) ([]*PrivacyRequest, error) {
+	query := `SELECT ` + privacyRequestColumns + ` FROM privacy_requests WHERE user_id = $1 ORDER BY created_at DESC`
+	rows, err := r.db.QueryContext(ctx, query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := []*PrivacyRequest{}
+	byID := make(map[string]*PrivacyRequest)
+	for rows.Next() {
+		request, err := scanPrivacyRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		request.Steps = []*PrivacyRequestStep{}
+		requests = append(requests, request)
+		byID[request.ID] = request
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	stepRows, err := r.db.QueryContext(ctx, `
+		SELECT s.request_id, s.step, s.status, s.details, s.created_at
+		FROM privacy_request_steps s
+		JOIN privacy_requests p ON p.id = s.request_id
+		WHERE p.user_id = $1
+		ORDER BY s.id
+	`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer stepRows.Close()
+
+	for stepRows.Next() {
+		var requestId string
+		step := &PrivacyRequestStep{}
+		if err := stepRows.Scan(&requestId, &step.Step, &step.Status, &step.Details, &step.CreatedAt); err != nil {
+			return nil, err
+		}
+		if request, ok := byID[requestId]; ok {
+			request.Steps = append(request.Steps, step)
+		}
+	}
+	return requests, stepRows.Err()
+}
+
+func (r *postgresRepository) GetPendingErasure(ctx context.Context, userId string) (*PrivacyRequest, error) {
+	query := `
+		SELECT ` + privacyRequestColumns + `
+		FROM privacy_requests
+		WHERE user_id = $1 AND kind = 'erasure' AND status IN ('pending', 'processing')
+	`
+	request, err := scanPrivacyRequest(r.db.QueryRowContext(ctx, query, userId))
+	if err == sql.ErrNoRows {
+		return nil, errErasureNotPending
+	}
+	return request, err
+}
+
+// CancelErasure cancels the erasure of the user while it still waits for its grace period to end
+func (r *postgresRepository) CancelErasure(ctx context.Context, userId string) (*PrivacyRequest, error) {
+	query := `
+		UPDATE privacy_requests
+		SET status = 'cancelled', completed_at = NOW()
+		WHERE user_id = $1 AND kind = 'erasure' AND status = 'pending'
+		RETURNING ` + privacyRequestColumns
+	request, err := scanPrivacyRequest(r.db.QueryRowContext(ctx, query, userId))
+	if err == sql.ErrNoRows {
+		return nil, errErasureNotPending
+	}
+	return request, err
+}
 
+// ClaimDueErasure takes the oldest erasure whose grace period is over, or whose previous run
+// did not finish within its lease, and leases it to the caller as its next attempt. It returns
+// nil when none is due, SKIP LOCKED lets several auth replicas claim different erasures at the
+// same time
+func (r *postgresRepository) ClaimDueErasure(ctx context.Context, lease time.Duration) (*PrivacyRequest, error) {
+	query := `
+		UPDATE privacy_requests
+		SET status = 'processing', locked_until = $1, attempts = attempts + 1
+		WHERE id = (
+			SELECT id FROM privacy_requests
+			WHERE kind = 'erasure'
+			  AND ((status = 'pending' AND scheduled_for <= NOW()) OR (status = 'processing' AND locked_until < NOW()))
+			ORDER BY scheduled_for
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + privacyRequestColumns
+	request, err := scanPrivacyRequest(r.db.QueryRowContext(ctx, query, time.Now().Add(lease)))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return request, err
+}
+
+// RetryErasure puts a failed erasure back to pending, it is claimed again once retryAt passed
+func (r *postgresRepository) RetryErasure(ctx context.Context, requestId string, retryAt time.Time) error {
+	query := `UPDATE privacy_requests SET status = 'pending', scheduled_for = $2, locked_until = NULL WHERE id = $1`
+	_, err := r.db.ExecContext(ctx, query, requestId, retryAt)
+	return err
+}
+
+// ListEmailHistory returns the emails auth had sent to the user, newest first
+func (r *postgresRepository) ListEmailHistory(ctx context.Context, userId string) ([]EmailHistoryEntry, error) {
+	query := `
+		SELECT 'email_verification', '', sent_at, NULL FROM verification_emails WHERE user_id = $1
+		UNION ALL
+		SELECT 'password_reset', email, created_at, used_at FROM password_reset_tokens WHERE user_id = $1
+		ORDER BY 3 DESC
+	`
+	rows, err := r.db.QueryContext(ctx, query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []EmailHistoryEntry{}
+	for rows.Next() {
+		var entry EmailHistoryEntry
+		var usedAt sql.NullTime
+		if err := rows.Scan(&entry.Type, &entry.Email, &entry.SentAt, &usedAt); err != nil {
+			return nil, err
+		}
+		if usedAt.Valid {
+			entry.UsedAt = &usedAt.Time
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// EraseUserData deletes everything auth keeps about the user, login attempts and lockouts are
+// stored by email rather than by user. Privacy requests are kept as the record of the erasure
+func (r *postgresRepository) EraseUserData(ctx context.Context, userId string, emails []string) (err error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	for _, table := range []string{"refresh_tokens", "totp_recovery_codes", "totp_used_steps", "password_reset_tokens", "verification_emails", "oidc_identities", "security_events"} {
+		if _, err = tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE user_id = $1`, userId); err != nil {
+			return err
+		}
+	}
+	if _, err = tx.ExecContext(ctx, `DELETE FROM login_attempts WHERE email = ANY($1)`, pq.Array(emails)); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM login_lockouts WHERE subject_type = 'email' AND subject = ANY($1)`, pq.Array(emails))
+	return err
+}
@@ -0,0 +1,806 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	errDuplicateToken         = errors.New("a token with this hash already exists")
+	errDuplicateAPIKey        = errors.New("an API key with this ID or hash already exists")
+	errDuplicateOIDCState     = errors.New("a sign-in state with this hash already exists")
+	errDuplicatePrivacyID     = errors.New("a privacy request with this ID already exists")
+	errErasureAlreadyPending  = errors.New("an erasure is already pending for this account")
+	errPrivacyRequestNotFound = errors.New("privacy request not found")
+)
+
+// inMemoryRepository keeps the auth data in process memory, for tests and local runs. Every
+// method behaves like its postgres counterpart, including the conditional updates that make
+// refresh tokens, reset tokens and sign-in states usable once
+type inMemoryRepository struct {
+	mu                 sync.RWMutex
+	refreshTokens      map[string]*memoryRefreshToken // keyed by token hash
+	lastTokenID        int
+	securityEvents     []memorySecurityEvent
+	loginAttempts      []memoryLoginAttempt
+	lockouts           map[lockoutKey]*memoryLockout
+	recoveryCodes      []*memoryRecoveryCode
+	totpSteps          map[string]int64
+	resetTokens        []*memoryResetToken
+	verificationEmails []memoryVerificationEmail
+	apiKeys            map[string]*memoryAPIKey
+	oidcStates         map[string]*memoryOIDCState
+	oidcIdentities     map[oidcIdentityKey]*memoryOIDCIdentity
+	privacyRequests    map[string]*memoryPrivacyRequest
+}
+
+type memoryRefreshToken struct {
+	TokenData
+	id       int
+	parentID int
+}
+
+type memorySecurityEvent struct {
+	userID    string
+	eventType string
+	details   string
+	createdAt time.Time
+}
+
+type memoryLoginAttempt struct {
+	email       string
+	clientIP    string
+	success     bool
+	attemptedAt time.Time
+}
+
+type lockoutKey struct {
+	subjectType string
+	subject     string
+}
+
+type memoryLockout struct {
+	Lockout
+	lastFailedAt time.Time
+}
+
+type memoryRecoveryCode struct {
+	userID   string
+	codeHash string
+	usedAt   time.Time
+}
+
+type memoryResetToken struct {
+	userID    string
+	email     string
+	tokenHash string
+	createdAt time.Time
+	expiresAt time.Time
+	usedAt    time.Time
+}
+
+type memoryVerificationEmail struct {
+	userID string
+	sentAt time.Time
+}
+
+type memoryAPIKey struct {
+	APIKey
+	keyHash            string
+	previousKeyHash    string
+	previousValidUntil time.Time
+}
+
+type memoryOIDCState struct {
+	OIDCLoginState
+	usedAt time.Time
+}
+
+type oidcIdentityKey struct {
+	provider string
+	subject  string
+}
+
+type memoryOIDCIdentity struct {
+	userID      string
+	email       string
+	lastLoginAt time.Time
+}
+
+type memoryPrivacyRequest struct {
+	PrivacyRequest
+	lockedUntil time.Time
+}
+
+func NewInMemoryRepository() Repository {
+	return &inMemoryRepository{
+		refreshTokens:   make(map[string]*memoryRefreshToken),
+		lockouts:        make(map[lockoutKey]*memoryLockout),
+		totpSteps:       make(map[string]int64),
+		apiKeys:         make(map[string]*memoryAPIKey),
+		oidcStates:      make(map[string]*memoryOIDCState),
+		oidcIdentities:  make(map[oidcIdentityKey]*memoryOIDCIdentity),
+		privacyRequests: make(map[string]*memoryPrivacyRequest),
+	}
+}
+
+func (r *inMemoryRepository) Close() {}
+
+func (r *inMemoryRepository) Ping() error {
+	return nil
+}
+
+func (r *inMemoryRepository) StoreRefreshToken(ctx context.Context, refreshToken string, userId string, familyId string, expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.storeRefreshToken(hashRefreshToken(refreshToken), userId, familyId, 0, expiresAt)
+}
+
+func (r *inMemoryRepository) storeRefreshToken(tokenHash string, userId string, familyId string, parentID int, expiresAt time.Time) error {
+	if _, ok := r.refreshTokens[tokenHash]; ok {
+		return errDuplicateToken
+	}
+	r.lastTokenID++
+	r.refreshTokens[tokenHash] = &memoryRefreshToken{
+		TokenData: TokenData{UserID: userId, FamilyID: familyId, ExpiresAt: expiresAt},
+		id:        r.lastTokenID,
+		parentID:  parentID,
+	}
+	return nil
+}
+
+func (r *inMemoryRepository) GetRefreshToken(ctx context.Context, refreshToken string) (*TokenData, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	token, ok := r.refreshTokens[hashRefreshToken(refreshToken)]
+	if !ok {
+		return nil, errRefreshTokenNotFound
+	}
+	data := token.TokenData
+	return &data, nil
+}
+
+func (r *inMemoryRepository) RotateRefreshToken(ctx context.Context, oldRefreshToken string, newRefreshToken string, expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	old, ok := r.refreshTokens[hashRefreshToken(oldRefreshToken)]
+	if !ok || !old.RotatedAt.IsZero() || !old.RevokedAt.IsZero() {
+		return errRefreshTokenReused
+	}
+	if err := r.storeRefreshToken(hashRefreshToken(newRefreshToken), old.UserID, old.FamilyID, old.id, expiresAt); err != nil {
+		return err
+	}
+	old.RotatedAt = time.Now()
+	return nil
+}
+
+func (r *inMemoryRepository) RevokeTokenFamily(ctx context.Context, familyId string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for _, token := range r.refreshTokens {
+		if token.FamilyID == familyId && token.RevokedAt.IsZero() {
+			token.RevokedAt = now
+		}
+	}
+	return nil
+}
+
+func (r *inMemoryRepository) DeleteRefreshToken(ctx context.Context, userID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for tokenHash, token := range r.refreshTokens {
+		if token.UserID == userID {
+			delete(r.refreshTokens, tokenHash)
+		}
+	}
+	return nil
+}
+
+func (r *inMemoryRepository) RecordSecurityEvent(ctx context.Context, userId string, eventType string, details string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.securityEvents = append(r.securityEvents, memorySecurityEvent{userId, eventType, details, time.Now()})
+	return nil
+}
+
+func (r *inMemoryRepository) RecordLoginAttempt(ctx context.Context, email string, clientIP string, success bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.loginAttempts = append(r.loginAttempts, memoryLoginAttempt{email, clientIP, success, time.Now()})
+	return nil
+}
+
+func (r *inMemoryRepository) GetLockout(ctx context.Context, subjectType string, subject string) (*Lockout, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	lockout, ok := r.lockouts[lockoutKey{subjectType, subject}]
+	if !ok {
+		return &Lockout{SubjectType: subjectType, Subject: subject}, nil
+	}
+	copied := lockout.Lockout
+	return &copied, nil
+}
+
+func (r *inMemoryRepository) RegisterFailedLogin(ctx context.Context, subjectType string, subject string, window time.Duration) (*Lockout, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	key := lockoutKey{subjectType, subject}
+	lockout, ok := r.lockouts[key]
+	switch {
+	case !ok:
+		lockout = &memoryLockout{Lockout: Lockout{SubjectType: subjectType, Subject: subject, FailedAttempts: 1}}
+		r.lockouts[key] = lockout
+	case lockout.lastFailedAt.Before(now.Add(-window)):
+		lockout.FailedAttempts = 1
+	default:
+		lockout.FailedAttempts++
+	}
+	lockout.lastFailedAt = now
+	copied := lockout.Lockout
+	return &copied, nil
+}
+
+func (r *inMemoryRepository) LockSubject(ctx context.Context, subjectType string, subject string, lockedUntil time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if lockout, ok := r.lockouts[lockoutKey{subjectType, subject}]; ok {
+		lockout.FailedAttempts = 0
+		lockout.LockoutLevel++
+		lockout.LockedUntil = lockedUntil
+	}
+	return nil
+}
+
+func (r *inMemoryRepository) ClearLockout(ctx context.Context, subjectType string, subject string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.lockouts, lockoutKey{subjectType, subject})
+	return nil
+}
+
+func (r *inMemoryRepository) ReplaceRecoveryCodes(ctx context.Context, userId string, codeHashes []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	kept := r.recoveryCodes[:0]
+	for _, code := range r.recoveryCodes {
+		if code.userID != userId {
+			kept = append(kept, code)
+		}
+	}
+	r.recoveryCodes = kept
+	for _, codeHash := range codeHashes {
+		r.recoveryCodes = append(r.recoveryCodes, &memoryRecoveryCode{userID: userId, codeHash: codeHash})
+	}
+	return nil
+}
+
+// UseRecoveryCode burns every unused copy of the code, like the postgres update it only reports
+// success when exactly one was burnt
+func (r *inMemoryRepository) UseRecoveryCode(ctx context.Context, userId string, codeHash string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	count := 0
+	for _, code := range r.recoveryCodes {
+		if code.userID == userId && code.codeHash == codeHash && code.usedAt.IsZero() {
+			code.usedAt = time.Now()
+			count++
+		}
+	}
+	return count == 1, nil
+}
+
+func (r *inMemoryRepository) MarkTOTPStepUsed(ctx context.Context, userId string, step int64) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if last, ok := r.totpSteps[userId]; ok && last >= step {
+		return false, nil
+	}
+	r.totpSteps[userId] = step
+	return true, nil
+}
+
+func (r *inMemoryRepository) CreatePasswordResetToken(ctx context.Context, userId string, email string, tokenHash string, expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, token := range r.resetTokens {
+		if token.tokenHash == tokenHash {
+			return errDuplicateToken
+		}
+	}
+	now := time.Now()
+	for _, token := range r.resetTokens {
+		if token.userID == userId && token.usedAt.IsZero() {
+			token.usedAt = now
+		}
+	}
+	r.resetTokens = append(r.resetTokens, &memoryResetToken{
+		userID:    userId,
+		email:     email,
+		tokenHash: tokenHash,
+		createdAt: now,
+		expiresAt: expiresAt,
+	})
+	return nil
+}
+
+func (r *inMemoryRepository) GetPasswordResetToken(ctx context.Context, tokenHash string) (string, string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for _, token := range r.resetTokens {
+		if token.tokenHash == tokenHash && token.usedAt.IsZero() && token.expiresAt.After(now) {
+			return token.userID, token.email, nil
+		}
+	}
+	return "", "", errPasswordResetNotFound
+}
+
+func (r *inMemoryRepository) ConsumePasswordResetToken(ctx context.Context, tokenHash string) (string, string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for _, token := range r.resetTokens {
+		if token.tokenHash == tokenHash && token.usedAt.IsZero() && token.expiresAt.After(now) {
+			token.usedAt = now
+			return token.userID, token.email, nil
+		}
+	}
+	return "", "", errPasswordResetNotFound
+}
+
+func (r *inMemoryRepository) InvalidatePasswordResetTokens(ctx context.Context, userId string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for _, token := range r.resetTokens {
+		if token.userID == userId && token.usedAt.IsZero() {
+			token.usedAt = now
+		}
+	}
+	return nil
+}
+
+func (r *inMemoryRepository) ReserveVerificationEmail(ctx context.Context, userId string, interval time.Duration, maxPerDay int) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	count := 0
+	for _, email := range r.verificationEmails {
+		if email.userID != userId {
+			continue
+		}
+		if email.sentAt.After(now.Add(-interval)) {
+			return false, nil
+		}
+		if !email.sentAt.Before(now.Add(-24 * time.Hour)) {
+			count++
+		}
+	}
+	if count >= maxPerDay {
+		return false, nil
+	}
+	r.verificationEmails = append(r.verificationEmails, memoryVerificationEmail{userId, now})
+	return true, nil
+}
+
+// copyAPIKey returns the columns a query selects, so callers cannot change the stored key
+func copyAPIKey(key *memoryAPIKey) *APIKey {
+	copied := key.APIKey
+	copied.Scopes = append([]string{}, key.Scopes...)
+	return &copied
+}
+
+func (r *inMemoryRepository) CreateAPIKey(ctx context.Context, key *APIKey, keyHash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.apiKeys[key.ID]; ok {
+		return errDuplicateAPIKey
+	}
+	for _, existing := range r.apiKeys {
+		if existing.keyHash == keyHash {
+			return errDuplicateAPIKey
+		}
+	}
+	stored := &memoryAPIKey{APIKey: *key, keyHash: keyHash}
+	stored.Scopes = append([]string{}, key.Scopes...)
+	stored.LastUsedAt = time.Time{}
+	stored.RevokedAt = time.Time{}
+	r.apiKeys[key.ID] = stored
+	return nil
+}
+
+func (r *inMemoryRepository) ListAPIKeys(ctx context.Context) ([]*APIKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var keys []*APIKey
+	for _, key := range r.apiKeys {
+		keys = append(keys, copyAPIKey(key))
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (r *inMemoryRepository) RotateAPIKey(ctx context.Context, id string, prefix string, keyHash string, previousValidUntil time.Time) (*APIKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key, ok := r.apiKeys[id]
+	if !ok || !key.RevokedAt.IsZero() || !key.ExpiresAt.After(time.Now()) {
+		return nil, errAPIKeyNotFound
+	}
+	for _, existing := range r.apiKeys {
+		if existing != key && existing.keyHash == keyHash {
+			return nil, errDuplicateAPIKey
+		}
+	}
+	key.previousKeyHash = key.keyHash
+	key.previousValidUntil = previousValidUntil
+	key.keyHash = keyHash
+	key.Prefix = prefix
+	return copyAPIKey(key), nil
+}
+
+func (r *inMemoryRepository) RevokeAPIKey(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key, ok := r.apiKeys[id]
+	if !ok || !key.RevokedAt.IsZero() {
+		return errAPIKeyNotFound
+	}
+	key.RevokedAt = time.Now()
+	return nil
+}
+
+func (r *inMemoryRepository) UseAPIKey(ctx context.Context, keyHash string) (*APIKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for _, key := range r.apiKeys {
+		current := key.keyHash == keyHash
+		previous := key.previousKeyHash == keyHash && key.previousValidUntil.After(now)
+		if (current || previous) && key.RevokedAt.IsZero() && key.ExpiresAt.After(now) {
+			key.LastUsedAt = now
+			return copyAPIKey(key), nil
+		}
+	}
+	return nil, errAPIKeyNotFound
+}
+
+func (r *inMemoryRepository) CreateOIDCLoginState(ctx context.Context, stateHash string, state *OIDCLoginState) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cutoff := time.Now().Add(-24 * time.Hour)
+	for hash, stored := range r.oidcStates {
+		if stored.ExpiresAt.Before(cutoff) {
+			delete(r.oidcStates, hash)
+		}
+	}
+	if _, ok := r.oidcStates[stateHash]; ok {
+		return errDuplicateOIDCState
+	}
+	r.oidcStates[stateHash] = &memoryOIDCState{OIDCLoginState: *state}
+	return nil
+}
+
+func (r *inMemoryRepository) ConsumeOIDCLoginState(ctx context.Context, stateHash string) (*OIDCLoginState, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	state, ok := r.oidcStates[stateHash]
+	if !ok || !state.usedAt.IsZero() || !state.ExpiresAt.After(now) {
+		return nil, errInvalidOIDCState
+	}
+	state.usedAt = now
+	copied := state.OIDCLoginState
+	return &copied, nil
+}
+
+func (r *inMemoryRepository) GetOIDCIdentity(ctx context.Context, provider string, subject string) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	identity, ok := r.oidcIdentities[oidcIdentityKey{provider, subject}]
+	if !ok {
+		return "", errOIDCIdentityNotFound
+	}
+	return identity.userID, nil
+}
+
+// LinkOIDCIdentity keeps the account of a subject that is already linked, only the email and
+// the login time change
+func (r *inMemoryRepository) LinkOIDCIdentity(ctx context.Context, provider string, subject string, userId string, email string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := oidcIdentityKey{provider, subject}
+	identity, ok := r.oidcIdentities[key]
+	if !ok {
+		identity = &memoryOIDCIdentity{userID: userId}
+		r.oidcIdentities[key] = identity
+	}
+	identity.email = email
+	identity.lastLoginAt = time.Now()
+	return nil
+}
+
+// copyPrivacyRequest returns the columns a query selects, without the steps
+func copyPrivacyRequest(request *memoryPrivacyRequest) *PrivacyRequest {
+	copied := request.PrivacyRequest
+	copied.Steps = nil
+	return &copied
+}
+
+func openErasure(request *memoryPrivacyRequest) bool {
+	return request.Kind == PrivacyRequestErasure &&
+		(request.Status == PrivacyStatusPending || request.Status == PrivacyStatusProcessing)
+}
+
+func (r *inMemoryRepository) CreatePrivacyRequest(ctx context.Context, request *PrivacyRequest) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.privacyRequests[request.ID]; ok {
+		return errDuplicatePrivacyID
+	}
+	stored := &memoryPrivacyRequest{PrivacyRequest: *request}
+	stored.CompletedAt = time.Time{}
+	stored.Steps = []*PrivacyRequestStep{}
+	if openErasure(stored) {
+		for _, existing := range r.privacyRequests {
+			if existing.UserID == request.UserID && openErasure(existing) {
+				return errErasureAlreadyPending
+			}
+		}
+	}
+	r.privacyRequests[request.ID] = stored
+	return nil
+}
+
+func (r *inMemoryRepository) RecordPrivacyStep(ctx context.Context, requestId string, step *PrivacyRequestStep) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	request, ok := r.privacyRequests[requestId]
+	if !ok {
+		return errPrivacyRequestNotFound
+	}
+	copied := *step
+	request.Steps = append(request.Steps, &copied)
+	return nil
+}
+
+func (r *inMemoryRepository) FinishPrivacyRequest(ctx context.Context, requestId string, status string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if request, ok := r.privacyRequests[requestId]; ok {
+		request.Status = status
+		request.CompletedAt = time.Now()
+		request.lockedUntil = time.Time{}
+	}
+	return nil
+}
+
+func (r *inMemoryRepository) ListPrivacyRequests(ctx context.Context, userId string) ([]*PrivacyRequest, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	requests := []*PrivacyRequest{}
+	for _, stored := range r.privacyRequests {
+		if stored.UserID != userId {
+			continue
+		}
+		request := copyPrivacyRequest(stored)
+		request.Steps = []*PrivacyRequestStep{}
+		for _, step := range stored.Steps {
+			copied := *step
+			request.Steps = append(request.Steps, &copied)
+		}
+		requests = append(requests, request)
+	}
+	sort.Slice(requests, func(i, j int) bool { return requests[i].CreatedAt.After(requests[j].CreatedAt) })
+	return requests, nil
+}
+
+func (r *inMemoryRepository) GetPendingErasure(ctx context.Context, userId string) (*PrivacyRequest, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, request := range r.privacyRequests {
+		if request.UserID == userId && openErasure(request) {
+			return copyPrivacyRequest(request), nil
+		}
+	}
+	return nil, errErasureNotPending
+}
+
+func (r *inMemoryRepository) CancelErasure(ctx context.Context, userId string) (*PrivacyRequest, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, request := range r.privacyRequests {
+		if request.UserID == userId && request.Kind == PrivacyRequestErasure && request.Status == PrivacyStatusPending {
+			request.Status = PrivacyStatusCancelled
+			request.CompletedAt = time.Now()
+			return copyPrivacyRequest(request), nil
+		}
+	}
+	return nil, errErasureNotPending
+}
+
+// ClaimDueErasure takes the erasure scheduled first among the due ones, like the postgres query
+// erasures without a schedule are never due by their schedule
+func (r *inMemoryRepository) ClaimDueErasure(ctx context.Context, lease time.Duration) (*PrivacyRequest, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	var due *memoryPrivacyRequest
+	for _, request := range r.privacyRequests {
+		if request.Kind != PrivacyRequestErasure {
+			continue
+		}
+		scheduled := request.Status == PrivacyStatusPending && !request.ScheduledFor.IsZero() && !request.ScheduledFor.After(now)
+		abandoned := request.Status == PrivacyStatusProcessing && !request.lockedUntil.IsZero() && request.lockedUntil.Before(now)
+		if !scheduled && !abandoned {
+			continue
+		}
+		if due == nil || earlierSchedule(request, due) {
+			due = request
+		}
+	}
+	if due == nil {
+		return nil, nil
+	}
+	due.Status = PrivacyStatusProcessing
+	due.lockedUntil = now.Add(lease)
+	due.Attempts++
+	return copyPrivacyRequest(due), nil
+}
+
+// earlierSchedule orders requests by scheduled_for with the unscheduled ones last, as postgres
+// sorts NULLs, and by ID between equal schedules so the order is stable
+func earlierSchedule(a, b *memoryPrivacyRequest) bool {
+	if a.ScheduledFor.IsZero() != b.ScheduledFor.IsZero() {
+		return b.ScheduledFor.IsZero()
+	}
+	if !a.ScheduledFor.Equal(b.ScheduledFor) {
+		return a.ScheduledFor.Before(b.ScheduledFor)
+	}
+	return a.ID < b.ID
+}
+
+func (r *inMemoryRepository) RetryErasure(ctx context.Context, requestId string, retryAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if request, ok := r.privacyRequests[requestId]; ok {
+		request.Status = PrivacyStatusPending
+		request.ScheduledFor = retryAt
+		request.lockedUntil = time.Time{}
+	}
+	return nil
+}
+
+func (r *inMemoryRepository) ListEmailHistory(ctx context.Context, userId string) ([]EmailHistoryEntry, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	entries := []EmailHistoryEntry{}
+	for _, email := range r.verificationEmails {
+		if email.userID == userId {
+			entries = append(entries, EmailHistoryEntry{Type: "email_verification", SentAt: email.sentAt})
+		}
+	}
+	for _, token := range r.resetTokens {
+		if token.userID != userId {
+			continue
+		}
+		entry := EmailHistoryEntry{Type: "password_reset", Email: token.email, SentAt: token.createdAt}
+		if !token.usedAt.IsZero() {
+			usedAt := token.usedAt
+			entry.UsedAt = &usedAt
+		}
+		entries = append(entries, entry)
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].SentAt.After(entries[j].SentAt) })
+	return entries, nil
+}
+
+func (r *inMemoryRepository) EraseUserData(ctx context.Context, userId string, emails []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	erased := map[string]bool{}
+	for _, email := range emails {
+		erased[email] = true
+	}
+
+	for tokenHash, token := range r.refreshTokens {
+		if token.UserID == userId {
+			delete(r.refreshTokens, tokenHash)
+		}
+	}
+	delete(r.totpSteps, userId)
+	for key, identity := range r.oidcIdentities {
+		if identity.userID == userId {
+			delete(r.oidcIdentities, key)
+		}
+	}
+	for key := range r.lockouts {
+		if key.subjectType == "email" && erased[key.subject] {
+			delete(r.lockouts, key)
+		}
+	}
+
+	codes := r.recoveryCodes[:0]
+	for _, code := range r.recoveryCodes {
+		if code.userID != userId {
+			codes = append(codes, code)
+		}
+	}
+	r.recoveryCodes = codes
+
+	resetTokens := r.resetTokens[:0]
+	for _, token := range r.resetTokens {
+		if token.userID != userId {
+			resetTokens = append(resetTokens, token)
+		}
+	}
+	r.resetTokens = resetTokens
+
+	verificationEmails := r.verificationEmails[:0]
+	for _, email := range r.verificationEmails {
+		if email.userID != userId {
+			verificationEmails = append(verificationEmails, email)
+		}
+	}
+	r.verificationEmails = verificationEmails
+
+	events := r.securityEvents[:0]
+	for _, event := range r.securityEvents {
+		if event.userID != userId {
+			events = append(events, event)
+		}
+	}
+	r.securityEvents = events
+
+	attempts := r.loginAttempts[:0]
+	for _, attempt := range r.loginAttempts {
+		if !erased[attempt.email] {
+			attempts = append(attempts, attempt)
+		}
+	}
+	r.loginAttempts = attempts
+	return nil
+}
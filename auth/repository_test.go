@@ -0,0 +1,554 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"github.com/zenvisjr/building-scalable-microservices/migrate"
+)
+
+// TestInMemoryRepository and TestPostgresRepository run the same contract, so both
+// implementations stay interchangeable
+func TestInMemoryRepository(t *testing.T) {
+	testRepository(t, NewInMemoryRepository())
+	testSessionRepository(t, NewInMemorySessionRepository())
+}
+
+// TestPostgresRepository needs a database, AUTH_TEST_DATABASE_URL points to one. Every test
+// uses new user IDs, emails and hashes, so it can share a database with other runs
+func TestPostgresRepository(t *testing.T) {
+	url := os.Getenv("AUTH_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("AUTH_TEST_DATABASE_URL is not set")
+	}
+	if err := migrate.Run(context.Background(), url, Migrations, []string{"up"}); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	repo, err := NewPostgresRepository(url)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer repo.Close()
+	sessions, err := NewPostgresSessionRepository(url)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer sessions.Close()
+
+	testRepository(t, repo)
+	testSessionRepository(t, sessions)
+}
+
+// newHash returns a value shaped like the sha256 hashes the repositories store
+func newHash() string {
+	return hashRefreshToken(ksuid.New().String())
+}
+
+func testRepository(t *testing.T, repo Repository) {
+	ctx := context.Background()
+	hourAgo := time.Now().Add(-time.Hour)
+	inAnHour := time.Now().Add(time.Hour)
+
+	t.Run("RefreshTokens", func(t *testing.T) {
+		userID := ksuid.New().String()
+		family := ksuid.New().String()
+		first, second, third := ksuid.New().String(), ksuid.New().String(), ksuid.New().String()
+
+		if err := repo.StoreRefreshToken(ctx, first, userID, family, inAnHour); err != nil {
+			t.Fatalf("StoreRefreshToken: %v", err)
+		}
+		data, err := repo.GetRefreshToken(ctx, first)
+		if err != nil || data.UserID != userID || data.FamilyID != family || !data.RotatedAt.IsZero() {
+			t.Fatalf("GetRefreshToken = %+v, %v", data, err)
+		}
+		if _, err := repo.GetRefreshToken(ctx, ksuid.New().String()); err == nil {
+			t.Error("GetRefreshToken of an unknown token succeeded")
+		}
+
+		if err := repo.RotateRefreshToken(ctx, first, second, inAnHour); err != nil {
+			t.Fatalf("RotateRefreshToken: %v", err)
+		}
+		if err := repo.RotateRefreshToken(ctx, first, third, inAnHour); !errors.Is(err, errRefreshTokenReused) {
+			t.Errorf("RotateRefreshToken of a rotated token = %v, want errRefreshTokenReused", err)
+		}
+		if data, err := repo.GetRefreshToken(ctx, second); err != nil || data.FamilyID != family || data.UserID != userID {
+			t.Errorf("rotated token = %+v, %v", data, err)
+		}
+
+		// reuse revokes the family, its remaining token cannot be rotated any more
+		if err := repo.RevokeTokenFamily(ctx, family); err != nil {
+			t.Fatalf("RevokeTokenFamily: %v", err)
+		}
+		if data, err := repo.GetRefreshToken(ctx, second); err != nil || data.RevokedAt.IsZero() {
+			t.Errorf("token of a revoked family = %+v, %v", data, err)
+		}
+		if err := repo.RotateRefreshToken(ctx, second, third, inAnHour); !errors.Is(err, errRefreshTokenReused) {
+			t.Errorf("RotateRefreshToken of a revoked token = %v, want errRefreshTokenReused", err)
+		}
+
+		if err := repo.DeleteRefreshToken(ctx, userID); err != nil {
+			t.Fatalf("DeleteRefreshToken: %v", err)
+		}
+		if _, err := repo.GetRefreshToken(ctx, second); err == nil {
+			t.Error("GetRefreshToken after deleting the tokens of the user succeeded")
+		}
+	})
+
+	t.Run("Lockouts", func(t *testing.T) {
+		email := ksuid.New().String() + "@example.com"
+
+		lockout, err := repo.GetLockout(ctx, "email", email)
+		if err != nil || lockout.FailedAttempts != 0 || !lockout.LockedUntil.IsZero() {
+			t.Fatalf("GetLockout of a new subject = %+v, %v", lockout, err)
+		}
+		for want := 1; want <= 2; want++ {
+			lockout, err := repo.RegisterFailedLogin(ctx, "email", email, time.Hour)
+			if err != nil || lockout.FailedAttempts != want {
+				t.Fatalf("RegisterFailedLogin = %+v, %v, want %d failures", lockout, err, want)
+			}
+		}
+
+		lockedUntil := inAnHour.UTC().Truncate(time.Second)
+		if err := repo.LockSubject(ctx, "email", email, lockedUntil); err != nil {
+			t.Fatalf("LockSubject: %v", err)
+		}
+		lockout, err = repo.GetLockout(ctx, "email", email)
+		if err != nil || lockout.FailedAttempts != 0 || lockout.LockoutLevel != 1 || !lockout.LockedUntil.Equal(lockedUntil) {
+			t.Errorf("GetLockout after locking = %+v, %v", lockout, err)
+		}
+
+		// failures outside the window are forgotten
+		time.Sleep(10 * time.Millisecond)
+		if lockout, err := repo.RegisterFailedLogin(ctx, "email", email, time.Millisecond); err != nil || lockout.FailedAttempts != 1 || lockout.LockoutLevel != 1 {
+			t.Errorf("RegisterFailedLogin after the window = %+v, %v", lockout, err)
+		}
+
+		if err := repo.ClearLockout(ctx, "email", email); err != nil {
+			t.Fatalf("ClearLockout: %v", err)
+		}
+		if lockout, err := repo.GetLockout(ctx, "email", email); err != nil || lockout.LockoutLevel != 0 {
+			t.Errorf("GetLockout after clearing = %+v, %v", lockout, err)
+		}
+	})
+
+	t.Run("TwoFactor", func(t *testing.T) {
+		userID := ksuid.New().String()
+		first, second := newHash(), newHash()
+
+		if err := repo.ReplaceRecoveryCodes(ctx, userID, []string{first, second}); err != nil {
+			t.Fatalf("ReplaceRecoveryCodes: %v", err)
+		}
+		if ok, err := repo.UseRecoveryCode(ctx, userID, first); err != nil || !ok {
+			t.Errorf("UseRecoveryCode = %t, %v", ok, err)
+		}
+		if ok, err := repo.UseRecoveryCode(ctx, userID, first); err != nil || ok {
+			t.Errorf("UseRecoveryCode of a used code = %t, %v", ok, err)
+		}
+		if ok, err := repo.UseRecoveryCode(ctx, ksuid.New().String(), second); err != nil || ok {
+			t.Errorf("UseRecoveryCode of another user = %t, %v", ok, err)
+		}
+		if err := repo.ReplaceRecoveryCodes(ctx, userID, []string{newHash()}); err != nil {
+			t.Fatalf("ReplaceRecoveryCodes: %v", err)
+		}
+		if ok, err := repo.UseRecoveryCode(ctx, userID, second); err != nil || ok {
+			t.Errorf("UseRecoveryCode of a replaced code = %t, %v", ok, err)
+		}
+
+		for _, step := range []struct {
+			step int64
+			want bool
+		}{{5, true}, {5, false}, {4, false}, {6, true}} {
+			if ok, err := repo.MarkTOTPStepUsed(ctx, userID, step.step); err != nil || ok != step.want {
+				t.Errorf("MarkTOTPStepUsed(%d) = %t, %v, want %t", step.step, ok, err, step.want)
+			}
+		}
+	})
+
+	t.Run("Emails", func(t *testing.T) {
+		userID := ksuid.New().String()
+		email := userID + "@example.com"
+		first, second, expired := newHash(), newHash(), newHash()
+
+		if err := repo.CreatePasswordResetToken(ctx, userID, email, first, inAnHour); err != nil {
+			t.Fatalf("CreatePasswordResetToken: %v", err)
+		}
+		if err := repo.CreatePasswordResetToken(ctx, userID, email, second, inAnHour); err != nil {
+			t.Fatalf("CreatePasswordResetToken: %v", err)
+		}
+		// only the newest link works
+		if _, _, err := repo.GetPasswordResetToken(ctx, first); err == nil {
+			t.Error("GetPasswordResetToken of a replaced token succeeded")
+		}
+		if _, _, err := repo.ConsumePasswordResetToken(ctx, first); err == nil {
+			t.Error("ConsumePasswordResetToken of a replaced token succeeded")
+		}
+		gotUser, gotEmail, err := repo.GetPasswordResetToken(ctx, second)
+		if err != nil || gotUser != userID || gotEmail != email {
+			t.Errorf("GetPasswordResetToken = %q, %q, %v", gotUser, gotEmail, err)
+		}
+		gotUser, gotEmail, err = repo.ConsumePasswordResetToken(ctx, second)
+		if err != nil || gotUser != userID || gotEmail != email {
+			t.Errorf("ConsumePasswordResetToken = %q, %q, %v", gotUser, gotEmail, err)
+		}
+		if _, _, err := repo.ConsumePasswordResetToken(ctx, second); err == nil {
+			t.Error("ConsumePasswordResetToken of a used token succeeded")
+		}
+		if _, _, err := repo.GetPasswordResetToken(ctx, second); err == nil {
+			t.Error("GetPasswordResetToken of a used token succeeded")
+		}
+		if err := repo.CreatePasswordResetToken(ctx, userID, email, expired, hourAgo); err != nil {
+			t.Fatalf("CreatePasswordResetToken: %v", err)
+		}
+		if _, _, err := repo.ConsumePasswordResetToken(ctx, expired); err == nil {
+			t.Error("ConsumePasswordResetToken of an expired token succeeded")
+		}
+
+		for i := 0; i < 2; i++ {
+			if reserved, err := repo.ReserveVerificationEmail(ctx, userID, 0, 2); err != nil || !reserved {
+				t.Fatalf("ReserveVerificationEmail = %v, %v", reserved, err)
+			}
+		}
+		if reserved, err := repo.ReserveVerificationEmail(ctx, userID, 0, 2); err != nil || reserved {
+			t.Errorf("ReserveVerificationEmail past the daily cap = %v, %v", reserved, err)
+		}
+		if reserved, err := repo.ReserveVerificationEmail(ctx, userID, time.Hour, 5); err != nil || reserved {
+			t.Errorf("ReserveVerificationEmail within the interval = %v, %v", reserved, err)
+		}
+
+		history, err := repo.ListEmailHistory(ctx, userID)
+		if err != nil || len(history) != 5 {
+			t.Fatalf("ListEmailHistory = %+v, %v", history, err)
+		}
+		used := 0
+		for i, entry := range history {
+			if i > 0 && entry.SentAt.After(history[i-1].SentAt) {
+				t.Errorf("ListEmailHistory is not newest first: %+v", history)
+			}
+			if entry.Type == "password_reset" && entry.Email != email {
+				t.Errorf("reset email = %+v, want the address", entry)
+			}
+			if entry.UsedAt != nil {
+				used++
+			}
+		}
+		// the first token was invalidated by the second, the expired one was never used
+		if used != 2 {
+			t.Errorf("used entries = %d, want 2", used)
+		}
+	})
+
+	t.Run("APIKeys", func(t *testing.T) {
+		key := &APIKey{
+			ID:        ksuid.New().String(),
+			Name:      "batch-job",
+			Prefix:    "zk_first",
+			Scopes:    []string{"orders:read"},
+			CreatedBy: ksuid.New().String(),
+			CreatedAt: time.Now().UTC().Truncate(time.Microsecond),
+			ExpiresAt: inAnHour.UTC().Truncate(time.Microsecond),
+		}
+		first, second, third := newHash(), newHash(), newHash()
+		if err := repo.CreateAPIKey(ctx, key, first); err != nil {
+			t.Fatalf("CreateAPIKey: %v", err)
+		}
+		used, err := repo.UseAPIKey(ctx, first)
+		if err != nil || used.ID != key.ID || used.Name != key.Name || len(used.Scopes) != 1 || used.LastUsedAt.IsZero() {
+			t.Fatalf("UseAPIKey = %+v, %v", used, err)
+		}
+
+		keys, err := repo.ListAPIKeys(ctx)
+		if err != nil {
+			t.Fatalf("ListAPIKeys: %v", err)
+		}
+		found := false
+		for i, listed := range keys {
+			if listed.ID == key.ID {
+				found = true
+			}
+			if i > 0 && listed.CreatedAt.After(keys[i-1].CreatedAt) {
+				t.Error("ListAPIKeys is not newest first")
+			}
+		}
+		if !found {
+			t.Errorf("ListAPIKeys = %v, want the new key", keys)
+		}
+
+		// the previous key works during the grace period only
+		rotated, err := repo.RotateAPIKey(ctx, key.ID, "zk_secnd", second, inAnHour)
+		if err != nil || rotated.Prefix != "zk_secnd" {
+			t.Fatalf("RotateAPIKey = %+v, %v", rotated, err)
+		}
+		for _, hash := range []string{first, second} {
+			if _, err := repo.UseAPIKey(ctx, hash); err != nil {
+				t.Errorf("UseAPIKey during the grace period: %v", err)
+			}
+		}
+		if _, err := repo.RotateAPIKey(ctx, key.ID, "zk_third", third, hourAgo); err != nil {
+			t.Fatalf("RotateAPIKey: %v", err)
+		}
+		if _, err := repo.UseAPIKey(ctx, second); !errors.Is(err, errAPIKeyNotFound) {
+			t.Errorf("UseAPIKey after the grace period = %v, want errAPIKeyNotFound", err)
+		}
+
+		if err := repo.RevokeAPIKey(ctx, key.ID); err != nil {
+			t.Fatalf("RevokeAPIKey: %v", err)
+		}
+		if _, err := repo.UseAPIKey(ctx, third); !errors.Is(err, errAPIKeyNotFound) {
+			t.Errorf("UseAPIKey of a revoked key = %v, want errAPIKeyNotFound", err)
+		}
+		if err := repo.RevokeAPIKey(ctx, key.ID); !errors.Is(err, errAPIKeyNotFound) {
+			t.Errorf("RevokeAPIKey of a revoked key = %v, want errAPIKeyNotFound", err)
+		}
+		if _, err := repo.RotateAPIKey(ctx, key.ID, "zk_fourt", newHash(), inAnHour); !errors.Is(err, errAPIKeyNotFound) {
+			t.Errorf("RotateAPIKey of a revoked key = %v, want errAPIKeyNotFound", err)
+		}
+	})
+
+	t.Run("OIDC", func(t *testing.T) {
+		stateHash, expiredHash := newHash(), newHash()
+		state := &OIDCLoginState{Provider: "google", Nonce: "nonce", CodeVerifier: "verifier", ExpiresAt: inAnHour}
+		if err := repo.CreateOIDCLoginState(ctx, stateHash, state); err != nil {
+			t.Fatalf("CreateOIDCLoginState: %v", err)
+		}
+		got, err := repo.ConsumeOIDCLoginState(ctx, stateHash)
+		if err != nil || got.Provider != "google" || got.Nonce != "nonce" || got.CodeVerifier != "verifier" {
+			t.Errorf("ConsumeOIDCLoginState = %+v, %v", got, err)
+		}
+		if _, err := repo.ConsumeOIDCLoginState(ctx, stateHash); !errors.Is(err, errInvalidOIDCState) {
+			t.Errorf("ConsumeOIDCLoginState of a used state = %v, want errInvalidOIDCState", err)
+		}
+		expired := *state
+		expired.ExpiresAt = hourAgo
+		if err := repo.CreateOIDCLoginState(ctx, expiredHash, &expired); err != nil {
+			t.Fatalf("CreateOIDCLoginState: %v", err)
+		}
+		if _, err := repo.ConsumeOIDCLoginState(ctx, expiredHash); !errors.Is(err, errInvalidOIDCState) {
+			t.Errorf("ConsumeOIDCLoginState of an expired state = %v, want errInvalidOIDCState", err)
+		}
+
+		subject, userID := ksuid.New().String(), ksuid.New().String()
+		if _, err := repo.GetOIDCIdentity(ctx, "google", subject); !errors.Is(err, errOIDCIdentityNotFound) {
+			t.Errorf("GetOIDCIdentity of an unlinked subject = %v, want errOIDCIdentityNotFound", err)
+		}
+		if err := repo.LinkOIDCIdentity(ctx, "google", subject, userID, "a@example.com"); err != nil {
+			t.Fatalf("LinkOIDCIdentity: %v", err)
+		}
+		// linking again records a login, the subject stays with its account
+		if err := repo.LinkOIDCIdentity(ctx, "google", subject, ksuid.New().String(), "b@example.com"); err != nil {
+			t.Fatalf("LinkOIDCIdentity: %v", err)
+		}
+		if got, err := repo.GetOIDCIdentity(ctx, "google", subject); err != nil || got != userID {
+			t.Errorf("GetOIDCIdentity = %q, %v, want %q", got, err, userID)
+		}
+	})
+
+	t.Run("Privacy", func(t *testing.T) {
+		userID := ksuid.New().String()
+		created := time.Now().UTC().Truncate(time.Microsecond)
+		export := &PrivacyRequest{ID: ksuid.New().String(), UserID: userID, Kind: PrivacyRequestExport, Status: PrivacyStatusProcessing, RequestedBy: userID, CreatedAt: created.Add(-time.Minute)}
+		erasure := &PrivacyRequest{ID: ksuid.New().String(), UserID: userID, Kind: PrivacyRequestErasure, Status: PrivacyStatusPending, RequestedBy: userID, CreatedAt: created, ScheduledFor: hourAgo}
+
+		for _, request := range []*PrivacyRequest{export, erasure} {
+			if err := repo.CreatePrivacyRequest(ctx, request); err != nil {
+				t.Fatalf("CreatePrivacyRequest: %v", err)
+			}
+		}
+		second := *erasure
+		second.ID = ksuid.New().String()
+		if err := repo.CreatePrivacyRequest(ctx, &second); err == nil {
+			t.Error("CreatePrivacyRequest of a second open erasure succeeded")
+		}
+
+		step := &PrivacyRequestStep{Step: "account", Status: PrivacyStatusCompleted, Details: "exported", CreatedAt: created}
+		if err := repo.RecordPrivacyStep(ctx, export.ID, step); err != nil {
+			t.Fatalf("RecordPrivacyStep: %v", err)
+		}
+		if err := repo.FinishPrivacyRequest(ctx, export.ID, PrivacyStatusCompleted); err != nil {
+			t.Fatalf("FinishPrivacyRequest: %v", err)
+		}
+		requests, err := repo.ListPrivacyRequests(ctx, userID)
+		if err != nil || len(requests) != 2 {
+			t.Fatalf("ListPrivacyRequests = %v, %v", requests, err)
+		}
+		if requests[0].ID != erasure.ID || len(requests[0].Steps) != 0 {
+			t.Errorf("newest request = %+v, want the erasure without steps", requests[0])
+		}
+		if got := requests[1]; got.Status != PrivacyStatusCompleted || got.CompletedAt.IsZero() || len(got.Steps) != 1 || got.Steps[0].Details != "exported" {
+			t.Errorf("export = %+v", got)
+		}
+
+		pending, err := repo.GetPendingErasure(ctx, userID)
+		if err != nil || pending.ID != erasure.ID || pending.ScheduledFor.IsZero() {
+			t.Fatalf("GetPendingErasure = %+v, %v", pending, err)
+		}
+
+		// other runs sharing the database may have due erasures, they are leased and skipped
+		claim := func() *PrivacyRequest {
+			t.Helper()
+			for {
+				claimed, err := repo.ClaimDueErasure(ctx, time.Hour)
+				if err != nil {
+					t.Fatalf("ClaimDueErasure: %v", err)
+				}
+				if claimed == nil || claimed.ID == erasure.ID {
+					return claimed
+				}
+			}
+		}
+		claimed := claim()
+		if claimed == nil || claimed.Status != PrivacyStatusProcessing {
+			t.Fatalf("ClaimDueErasure = %+v, want the due erasure", claimed)
+		}
+		if again := claim(); again != nil {
+			t.Errorf("ClaimDueErasure of a leased erasure = %+v", again)
+		}
+		if _, err := repo.CancelErasure(ctx, userID); !errors.Is(err, errErasureNotPending) {
+			t.Errorf("CancelErasure of a running erasure = %v, want errErasureNotPending", err)
+		}
+
+		if err := repo.RetryErasure(ctx, erasure.ID, inAnHour); err != nil {
+			t.Fatalf("RetryErasure: %v", err)
+		}
+		if again := claim(); again != nil {
+			t.Errorf("ClaimDueErasure before the retry time = %+v", again)
+		}
+		cancelled, err := repo.CancelErasure(ctx, userID)
+		if err != nil || cancelled.Status != PrivacyStatusCancelled || cancelled.CompletedAt.IsZero() {
+			t.Errorf("CancelErasure = %+v, %v", cancelled, err)
+		}
+		if _, err := repo.GetPendingErasure(ctx, userID); !errors.Is(err, errErasureNotPending) {
+			t.Errorf("GetPendingErasure after cancelling = %v, want errErasureNotPending", err)
+		}
+	})
+
+	t.Run("EraseUserData", func(t *testing.T) {
+		userID := ksuid.New().String()
+		email := userID + "@example.com"
+		token, subject := ksuid.New().String(), ksuid.New().String()
+
+		if err := repo.StoreRefreshToken(ctx, token, userID, ksuid.New().String(), inAnHour); err != nil {
+			t.Fatalf("StoreRefreshToken: %v", err)
+		}
+		if _, err := repo.MarkTOTPStepUsed(ctx, userID, 10); err != nil {
+			t.Fatalf("MarkTOTPStepUsed: %v", err)
+		}
+		if err := repo.CreatePasswordResetToken(ctx, userID, email, newHash(), inAnHour); err != nil {
+			t.Fatalf("CreatePasswordResetToken: %v", err)
+		}
+		if err := repo.LinkOIDCIdentity(ctx, "google", subject, userID, email); err != nil {
+			t.Fatalf("LinkOIDCIdentity: %v", err)
+		}
+		if _, err := repo.RegisterFailedLogin(ctx, "email", email, time.Hour); err != nil {
+			t.Fatalf("RegisterFailedLogin: %v", err)
+		}
+		if err := repo.RecordLoginAttempt(ctx, email, "127.0.0.1", false); err != nil {
+			t.Fatalf("RecordLoginAttempt: %v", err)
+		}
+		if err := repo.RecordSecurityEvent(ctx, userID, "refresh_token_reuse", ""); err != nil {
+			t.Fatalf("RecordSecurityEvent: %v", err)
+		}
+
+		if err := repo.EraseUserData(ctx, userID, []string{email}); err != nil {
+			t.Fatalf("EraseUserData: %v", err)
+		}
+		if _, err := repo.GetRefreshToken(ctx, token); err == nil {
+			t.Error("refresh token survived the erasure")
+		}
+		if ok, err := repo.MarkTOTPStepUsed(ctx, userID, 10); err != nil || !ok {
+			t.Errorf("used TOTP step survived the erasure: %t, %v", ok, err)
+		}
+		if history, err := repo.ListEmailHistory(ctx, userID); err != nil || len(history) != 0 {
+			t.Errorf("email history after the erasure = %v, %v", history, err)
+		}
+		if _, err := repo.GetOIDCIdentity(ctx, "google", subject); !errors.Is(err, errOIDCIdentityNotFound) {
+			t.Errorf("GetOIDCIdentity after the erasure = %v, want errOIDCIdentityNotFound", err)
+		}
+		if lockout, err := repo.GetLockout(ctx, "email", email); err != nil || lockout.FailedAttempts != 0 {
+			t.Errorf("lockout after the erasure = %+v, %v", lockout, err)
+		}
+	})
+}
+
+func testSessionRepository(t *testing.T, repo SessionRepository) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	userID := ksuid.New().String()
+	newSession := func(createdAt time.Time) *Session {
+		return &Session{
+			ID:         ksuid.New().String(),
+			UserID:     userID,
+			FamilyID:   ksuid.New().String(),
+			Device:     "laptop",
+			CreatedAt:  createdAt,
+			LastSeenAt: createdAt,
+			ExpiresAt:  now.Add(time.Hour),
+		}
+	}
+
+	t.Run("Sessions", func(t *testing.T) {
+		older, newer := newSession(now.Add(-time.Minute)), newSession(now)
+		for _, session := range []*Session{older, newer} {
+			if err := repo.CreateSession(ctx, session); err != nil {
+				t.Fatalf("CreateSession: %v", err)
+			}
+		}
+		if err := repo.CreateSession(ctx, older); err == nil {
+			t.Error("CreateSession with a taken ID succeeded")
+		}
+		if _, err := repo.GetSession(ctx, ksuid.New().String()); !errors.Is(err, errSessionNotFound) {
+			t.Errorf("GetSession of an unknown ID = %v, want errSessionNotFound", err)
+		}
+
+		// a touched session was seen last and comes first
+		if err := repo.TouchSession(ctx, older.ID, now.Add(2*time.Hour)); err != nil {
+			t.Fatalf("TouchSession: %v", err)
+		}
+		sessions, err := repo.ListUserSessions(ctx, userID)
+		if err != nil || len(sessions) != 2 || sessions[0].ID != older.ID {
+			t.Fatalf("ListUserSessions = %+v, %v", sessions, err)
+		}
+		if !sessions[0].ExpiresAt.Equal(now.Add(2 * time.Hour)) {
+			t.Errorf("touched session expires at %v", sessions[0].ExpiresAt)
+		}
+
+		userIDs, err := repo.ListActiveUserIDs(ctx)
+		if err != nil {
+			t.Fatalf("ListActiveUserIDs: %v", err)
+		}
+		found := false
+		for _, id := range userIDs {
+			found = found || id == userID
+		}
+		if !found {
+			t.Errorf("ListActiveUserIDs = %v, want %s", userIDs, userID)
+		}
+
+		if err := repo.RevokeSessionByFamily(ctx, newer.FamilyID); err != nil {
+			t.Fatalf("RevokeSessionByFamily: %v", err)
+		}
+		if got, err := repo.GetSession(ctx, newer.ID); err != nil || got.Active() {
+			t.Errorf("session of a revoked family = %+v, %v", got, err)
+		}
+		if err := repo.RevokeUserSessions(ctx, userID); err != nil {
+			t.Fatalf("RevokeUserSessions: %v", err)
+		}
+		if sessions, err := repo.ListUserSessions(ctx, userID); err != nil || len(sessions) != 0 {
+			t.Errorf("ListUserSessions after revoking = %v, %v", sessions, err)
+		}
+		history, err := repo.ListUserSessionHistory(ctx, userID)
+		if err != nil || len(history) != 2 || history[0].ID != newer.ID {
+			t.Errorf("ListUserSessionHistory = %+v, %v", history, err)
+		}
+
+		if err := repo.DeleteUserSessions(ctx, userID); err != nil {
+			t.Fatalf("DeleteUserSessions: %v", err)
+		}
+		if history, err := repo.ListUserSessionHistory(ctx, userID); err != nil || len(history) != 0 {
+			t.Errorf("ListUserSessionHistory after deleting = %v, %v", history, err)
+		}
+	})
+}
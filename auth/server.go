@@ -2,20 +2,75 @@ package auth
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/zenvisjr/building-scalable-microservices/account"
 	"github.com/zenvisjr/building-scalable-microservices/auth/pb"
+	"github.com/nats-io/nats.go"
 	"github.com/zenvisjr/building-scalable-microservices/logger"
+	"github.com/zenvisjr/building-scalable-microservices/order"
+	"github.com/zenvisjr/building-scalable-microservices/svcauth"
+	"github.com/zenvisjr/building-scalable-microservices/tlsconfig"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/reflection"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type grpcServer struct {
 	pb.UnimplementedAuthServiceServer
 	accountClient *account.Client
+	orderClient   *order.Client
 	service       Service
+	netScan       Publisher
+}
+
+// Publisher sends the emails of the auth flows and announces revoked sessions to the gateways
+type Publisher interface {
+	Publish(subject string, data []byte) error
+}
+
+// callers lists the services allowed to call each RPC. Only the gateway talks to auth, except
+// for token introspection which any service handling user requests may use
+var callers = svcauth.Allowlist{
+	pb.AuthService_Signup_FullMethodName:                  {"gateway"},
+	pb.AuthService_Login_FullMethodName:                   {"gateway"},
+	pb.AuthService_RefreshToken_FullMethodName:            {"gateway"},
+	pb.AuthService_Verify_FullMethodName:                  {"gateway"},
+	pb.AuthService_Introspect_FullMethodName:              {"gateway", "order", "catalog"},
+	pb.AuthService_VerifyBatch_FullMethodName:             {"gateway", "order", "catalog"},
+	pb.AuthService_Logout_FullMethodName:                  {"gateway"},
+	pb.AuthService_GetCurrent_FullMethodName:              {"gateway"},
+	pb.AuthService_ResetPassword_FullMethodName:           {"gateway"},
+	pb.AuthService_DeactivateAccount_FullMethodName:       {"gateway"},
+	pb.AuthService_ReactivateAccount_FullMethodName:       {"gateway"},
+	pb.AuthService_DeleteAccount_FullMethodName:           {"gateway"},
+	pb.AuthService_UnlockAccount_FullMethodName:           {"gateway"},
+	pb.AuthService_GetJWKS_FullMethodName:                 {"gateway"},
+	pb.AuthService_ListSessions_FullMethodName:            {"gateway"},
+	pb.AuthService_RevokeSession_FullMethodName:           {"gateway"},
+	pb.AuthService_EnrollTOTP_FullMethodName:              {"gateway"},
+	pb.AuthService_ConfirmTOTP_FullMethodName:             {"gateway"},
+	pb.AuthService_VerifyLoginChallenge_FullMethodName:    {"gateway"},
+	pb.AuthService_RequestPasswordReset_FullMethodName:    {"gateway"},
+	pb.AuthService_ConfirmPasswordReset_FullMethodName:    {"gateway"},
+	pb.AuthService_VerifyEmail_FullMethodName:             {"gateway"},
+	pb.AuthService_ResendVerificationEmail_FullMethodName: {"gateway"},
+	pb.AuthService_UpdateProfile_FullMethodName:           {"gateway"},
+	pb.AuthService_CreateAPIKey_FullMethodName:            {"gateway"},
+	pb.AuthService_ListAPIKeys_FullMethodName:             {"gateway"},
+	pb.AuthService_RotateAPIKey_FullMethodName:            {"gateway"},
+	pb.AuthService_RevokeAPIKey_FullMethodName:            {"gateway"},
+	pb.AuthService_VerifyAPIKey_FullMethodName:            {"gateway"},
+	pb.AuthService_StartOIDCLogin_FullMethodName:          {"gateway"},
+	pb.AuthService_CompleteOIDCLogin_FullMethodName:       {"gateway"},
+	pb.AuthService_ExportAccountData_FullMethodName:       {"gateway"},
+	pb.AuthService_RequestErasure_FullMethodName:          {"gateway"},
+	pb.AuthService_CancelErasure_FullMethodName:           {"gateway"},
+	pb.AuthService_ListPrivacyRequests_FullMethodName:     {"gateway"},
 }
 
 func ListenGRPC(s Service, port int) error {
@@ -36,31 +91,122 @@ func ListenGRPC(s Service, port int) error {
 	}
 	Logs.LocalOnlyInfo("Connected to Account Service")
 
-	server := grpc.NewServer(
-		grpc.UnaryInterceptor(logger.UnaryLoggingInterceptor()),
-	)
+	// Data exports read the orders of an account and erasures anonymize them
+	orderClient, err := order.NewClient("order:8080")
+	if err != nil {
+		Logs.Error(context.Background(), "Failed to connect to Order Service: "+err.Error())
+		return err
+	}
+	Logs.LocalOnlyInfo("Connected to Order Service")
 
-	pb.RegisterAuthServiceServer(server, &grpcServer{
-		accountClient: accountClient,
-		service:       s,
+	// Emails such as password reset links are queued on NATS for the mail service
+	nc, err := nats.Connect("nats://nats:4222")
+	if err != nil {
+		Logs.Error(context.Background(), "Failed to connect to NATS: "+err.Error())
+		return err
+	}
+	Logs.LocalOnlyInfo("Connected to NATS in auth microservice")
+
+	// Drop cached token versions the account service bumped, and all of them after a reconnect
+	// since events may have been missed in between
+	nc.SetReconnectHandler(func(*nats.Conn) {
+		s.InvalidateTokenVersion("")
+	})
+	_, err = nc.Subscribe(account.TokenVersionChangedSubject, func(msg *nats.Msg) {
+		tokenVersionChanged(s, msg.Data)
 	})
+	if err != nil {
+		Logs.Error(context.Background(), "Failed to subscribe to token version events: "+err.Error())
+		return err
+	}
+
+	creds, err := tlsconfig.ServerOption()
+	if err != nil {
+		Logs.Error(context.Background(), "Failed to load TLS config: "+err.Error())
+		return err
+	}
+	server := NewGRPCServer(s, accountClient, orderClient, nc, creds)
+
+	// Erasures whose grace period is over are carried out in the background
+	go s.RunErasures(context.Background(), accountClient, orderClient)
 
-	reflection.Register(server)
 	Logs.LocalOnlyInfo("Auth gRPC server started on " + address)
 	Logs.Info(context.Background(), "Auth gRPC server started on "+address)
 	return server.Serve(lis)
 }
 
+// tokenVersionChanged drops the cached token version of the account a TokenVersionChanged
+// event names
+func tokenVersionChanged(s Service, data []byte) {
+	Logs := logger.GetGlobalLogger()
+
+	var event account.TokenVersionChanged
+	if err := json.Unmarshal(data, &event); err != nil || event.UserID == "" {
+		Logs.Error(context.Background(), "Invalid token version event: "+string(data))
+		return
+	}
+	s.InvalidateTokenVersion(event.UserID)
+}
+
+// NewGRPCServer builds the auth gRPC server, accountClient and orderClient are what its
+// handlers call on behalf of the gateway
+func NewGRPCServer(s Service, accountClient *account.Client, orderClient *order.Client, nc Publisher, opts ...grpc.ServerOption) *grpc.Server {
+	server := grpc.NewServer(append(opts,
+		grpc.ChainUnaryInterceptor(logger.UnaryLoggingInterceptor(), svcauth.UnaryServerInterceptor(callers)),
+	)...)
+	pb.RegisterAuthServiceServer(server, &grpcServer{
+		accountClient: accountClient,
+		orderClient:   orderClient,
+		service:       s,
+		netScan:       nc,
+	})
+	reflection.Register(server)
+	return server
+}
+
 func (g *grpcServer) Signup(ctx context.Context, req *pb.SignupRequest) (*pb.AuthResponse, error) {
-	return g.service.Signup(ctx, req.GetName(), req.GetEmail(), req.GetPassword(), req.GetRole(), g.accountClient)
+	info := SessionInfo{
+		Device:    req.GetDevice(),
+		IPAddress: clientIPFromRequest(ctx, req.GetClientIp()),
+		UserAgent: req.GetUserAgent(),
+	}
+	resp, err := g.service.Signup(ctx, req.GetName(), req.GetEmail(), req.GetPassword(), req.GetRole(), info, g.accountClient)
+	if err != nil {
+		return nil, err
+	}
+
+	// The account exists even if the email cannot be queued, the user can ask for it again
+	if err := g.sendVerificationEmail(ctx, resp.GetUserId()); err != nil {
+		logger.GetGlobalLogger().Error(ctx, "Failed to send verification email after signup: "+err.Error())
+	}
+	return resp, nil
 }
 
-func (g *grpcServer) Login(ctx context.Context, req *pb.LoginRequest) (*pb.AuthResponse, error) {
-	return g.service.Login(ctx, req.GetEmail(), req.GetPassword(), g.accountClient)
+func (g *grpcServer) Login(ctx context.Context, req *pb.LoginRequest) (*pb.LoginResponse, error) {
+	info := SessionInfo{
+		Device:    req.GetDevice(),
+		IPAddress: clientIPFromRequest(ctx, req.GetClientIp()),
+		UserAgent: req.GetUserAgent(),
+	}
+	return g.service.Login(ctx, req.GetEmail(), req.GetPassword(), info, g.accountClient)
+}
+
+// clientIPFromRequest uses the IP forwarded by the gateway and falls back to the gRPC peer
+// address when auth is called directly
+func clientIPFromRequest(ctx context.Context, clientIP string) string {
+	if clientIP != "" {
+		return clientIP
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			return host
+		}
+	}
+	return ""
 }
 
 func (g *grpcServer) RefreshToken(ctx context.Context, req *pb.RefreshRequest) (*pb.AuthResponse, error) {
-	return g.service.RefreshToken(ctx, req.GetUserId())
+	return g.service.RefreshToken(ctx, req.GetRefreshToken(), g.accountClient)
 }
 
 func (g *grpcServer) Verify(ctx context.Context, req *pb.VerifyRequest) (*pb.VerifyResponse, error) {
@@ -70,11 +216,56 @@ func (g *grpcServer) Verify(ctx context.Context, req *pb.VerifyRequest) (*pb.Ver
 		Logs.Error(ctx, "Failed to verify token in server: "+err.Error())
 		return nil, err
 	}
+	return verifyResponse(userClaims), nil
+}
+
+func verifyResponse(userClaims *UserClaims) *pb.VerifyResponse {
 	return &pb.VerifyResponse{
-		UserId: userClaims.ID,
-		Email:  userClaims.Email,
-		Role:   userClaims.Role,
-	}, nil
+		UserId:      userClaims.ID,
+		Email:       userClaims.Email,
+		Role:        userClaims.Role,
+		SessionId:   userClaims.SessionID,
+		Permissions: userClaims.Permissions,
+	}
+}
+
+func (g *grpcServer) Introspect(ctx context.Context, req *pb.IntrospectRequest) (*pb.IntrospectResponse, error) {
+	introspection := g.service.Introspect(ctx, req.GetToken(), g.accountClient)
+	if !introspection.Active {
+		return &pb.IntrospectResponse{Active: false}, nil
+	}
+
+	resp := &pb.IntrospectResponse{
+		Active:    true,
+		Scopes:    introspection.Claims.Permissions,
+		Sub:       introspection.Claims.ID,
+		Email:     introspection.Claims.Email,
+		Role:      introspection.Claims.Role,
+		SessionId: introspection.Claims.SessionID,
+		TokenType: introspection.TokenType,
+		Exp:       timestamppb.New(introspection.ExpiresAt),
+	}
+	if !introspection.IssuedAt.IsZero() {
+		resp.Iat = timestamppb.New(introspection.IssuedAt)
+	}
+	return resp, nil
+}
+
+func (g *grpcServer) VerifyBatch(ctx context.Context, req *pb.VerifyBatchRequest) (*pb.VerifyBatchResponse, error) {
+	verifications, err := g.service.VerifyBatch(ctx, req.GetAccessTokens(), g.accountClient)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &pb.VerifyBatchResponse{Results: make([]*pb.VerifyBatchResult, 0, len(verifications))}
+	for _, verification := range verifications {
+		if verification.Err != nil {
+			resp.Results = append(resp.Results, &pb.VerifyBatchResult{Valid: false, Error: verification.Err.Error()})
+			continue
+		}
+		resp.Results = append(resp.Results, &pb.VerifyBatchResult{Valid: true, User: verifyResponse(verification.Claims)})
+	}
+	return resp, nil
 }
 
 func (g *grpcServer) Logout(ctx context.Context, req *pb.LogoutRequest) (*pb.LogoutResponse, error) {
@@ -127,3 +318,349 @@ func (g *grpcServer) ReactivateAccount(ctx context.Context, req *pb.UpdateAccoun
 func (g *grpcServer) DeleteAccount(ctx context.Context, req *pb.UpdateAccountRequest) (*pb.UpdateAccountResponse, error) {
 	return g.service.DeleteAccount(ctx, req.GetUserId(), g.accountClient)
 }
+
+func (g *grpcServer) UnlockAccount(ctx context.Context, req *pb.UnlockAccountRequest) (*pb.UpdateAccountResponse, error) {
+	return g.service.UnlockAccount(ctx, req.GetEmail())
+}
+
+func (g *grpcServer) GetJWKS(ctx context.Context, req *pb.GetJWKSRequest) (*pb.GetJWKSResponse, error) {
+	jwks := g.service.GetJWKS(ctx)
+
+	keys := make([]*pb.JWK, 0, len(jwks.Keys))
+	for _, key := range jwks.Keys {
+		keys = append(keys, &pb.JWK{
+			Kid: key.Kid,
+			Kty: key.Kty,
+			Alg: key.Alg,
+			Use: key.Use,
+			N:   key.N,
+			E:   key.E,
+			Crv: key.Crv,
+			X:   key.X,
+		})
+	}
+	return &pb.GetJWKSResponse{Keys: keys}, nil
+}
+
+func (g *grpcServer) ListSessions(ctx context.Context, req *pb.ListSessionsRequest) (*pb.ListSessionsResponse, error) {
+	sessions, err := g.service.ListSessions(ctx, req.GetUserId())
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &pb.ListSessionsResponse{Sessions: make([]*pb.Session, 0, len(sessions))}
+	for _, session := range sessions {
+		resp.Sessions = append(resp.Sessions, &pb.Session{
+			Id:         session.ID,
+			Device:     session.Device,
+			IpAddress:  session.IPAddress,
+			UserAgent:  session.UserAgent,
+			CreatedAt:  timestamppb.New(session.CreatedAt),
+			LastSeenAt: timestamppb.New(session.LastSeenAt),
+			ExpiresAt:  timestamppb.New(session.ExpiresAt),
+		})
+	}
+	return resp, nil
+}
+
+func (g *grpcServer) RevokeSession(ctx context.Context, req *pb.RevokeSessionRequest) (*pb.UpdateAccountResponse, error) {
+	Logs := logger.GetGlobalLogger()
+
+	resp, err := g.service.RevokeSession(ctx, req.GetUserId(), req.GetSessionId())
+	if err != nil {
+		return nil, err
+	}
+
+	// Gateways verifying tokens locally drop the session from their revocation cache
+	payload, err := json.Marshal(SessionRevoked{UserID: req.GetUserId(), SessionID: req.GetSessionId()})
+	if err != nil {
+		Logs.Error(ctx, "Failed to marshal session revoked event: "+err.Error())
+		return resp, nil
+	}
+	if err := g.netScan.Publish(SessionRevokedSubject, payload); err != nil {
+		Logs.Error(ctx, "Failed to publish session revoked event: "+err.Error())
+	}
+	return resp, nil
+}
+
+func (g *grpcServer) EnrollTOTP(ctx context.Context, req *pb.EnrollTOTPRequest) (*pb.EnrollTOTPResponse, error) {
+	enrollment, err := g.service.EnrollTOTP(ctx, req.GetUserId(), g.accountClient)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.EnrollTOTPResponse{
+		Secret:     enrollment.Secret,
+		OtpauthUri: enrollment.OTPAuthURI,
+	}, nil
+}
+
+func (g *grpcServer) ConfirmTOTP(ctx context.Context, req *pb.ConfirmTOTPRequest) (*pb.ConfirmTOTPResponse, error) {
+	codes, err := g.service.ConfirmTOTP(ctx, req.GetUserId(), req.GetCode(), g.accountClient)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.ConfirmTOTPResponse{RecoveryCodes: codes}, nil
+}
+
+func (g *grpcServer) VerifyLoginChallenge(ctx context.Context, req *pb.VerifyLoginChallengeRequest) (*pb.AuthResponse, error) {
+	info := SessionInfo{
+		Device:    req.GetDevice(),
+		IPAddress: clientIPFromRequest(ctx, req.GetClientIp()),
+		UserAgent: req.GetUserAgent(),
+	}
+	return g.service.VerifyLoginChallenge(ctx, req.GetChallengeToken(), req.GetCode(), info, g.accountClient)
+}
+
+func (g *grpcServer) RequestPasswordReset(ctx context.Context, req *pb.RequestPasswordResetRequest) (*pb.UpdateAccountResponse, error) {
+	Logs := logger.GetGlobalLogger()
+
+	// Failures only happen for existing accounts, so they are logged and answered like every
+	// other request, an error would tell the caller the email has an account
+	response := &pb.UpdateAccountResponse{Message: passwordResetRequestedMessage}
+	reset, err := g.service.RequestPasswordReset(ctx, req.GetEmail(), g.accountClient)
+	if err != nil {
+		Logs.Error(ctx, "Password reset email was not created: "+err.Error())
+		return response, nil
+	}
+
+	// nil means there is no such account, answer exactly as if the email was sent
+	if reset != nil {
+		Logs.Info(ctx, "Publishing password reset email to NATS")
+		err := g.publishEmail(ctx, reset.Email, "Reset your Zenvis password", "password_reset", map[string]string{
+			"Name":      reset.Name,
+			"Link":      reset.Link,
+			"ExpiresAt": reset.ExpiresAt.UTC().Format(time.RFC1123),
+		})
+		if err != nil {
+			Logs.Error(ctx, "Password reset email was not sent: "+err.Error())
+		}
+	}
+
+	return response, nil
+}
+
+func (g *grpcServer) ConfirmPasswordReset(ctx context.Context, req *pb.ConfirmPasswordResetRequest) (*pb.UpdateAccountResponse, error) {
+	return g.service.ConfirmPasswordReset(ctx, req.GetToken(), req.GetNewPassword(), g.accountClient)
+}
+
+func (g *grpcServer) VerifyEmail(ctx context.Context, req *pb.VerifyEmailRequest) (*pb.UpdateAccountResponse, error) {
+	return g.service.VerifyEmail(ctx, req.GetToken(), g.accountClient)
+}
+
+func (g *grpcServer) ResendVerificationEmail(ctx context.Context, req *pb.UpdateAccountRequest) (*pb.UpdateAccountResponse, error) {
+	if err := g.sendVerificationEmail(ctx, req.GetUserId()); err != nil {
+		return nil, err
+	}
+	return &pb.UpdateAccountResponse{Message: "Verification email sent"}, nil
+}
+
+func (g *grpcServer) UpdateProfile(ctx context.Context, req *pb.UpdateProfileRequest) (*pb.UpdateAccountResponse, error) {
+	_, verification, err := g.service.UpdateProfile(ctx, req.GetUserId(), account.ProfileUpdate{
+		Name:  req.Name,
+		Email: req.Email,
+		Phone: req.Phone,
+	}, g.accountClient)
+	if err != nil {
+		return nil, err
+	}
+	if verification == nil {
+		return &pb.UpdateAccountResponse{Message: "Profile updated"}, nil
+	}
+
+	// The current email stays the login until the link is opened, a lost email can be resent
+	if err := g.publishVerificationEmail(ctx, verification); err != nil {
+		return nil, err
+	}
+	return &pb.UpdateAccountResponse{Message: "Profile updated, open the link sent to " + verification.Email + " to confirm the new email"}, nil
+}
+
+func (g *grpcServer) sendVerificationEmail(ctx context.Context, userId string) error {
+	verification, err := g.service.SendVerificationEmail(ctx, userId, g.accountClient)
+	if err != nil {
+		return err
+	}
+	return g.publishVerificationEmail(ctx, verification)
+}
+
+func (g *grpcServer) publishVerificationEmail(ctx context.Context, verification *EmailVerification) error {
+	return g.publishEmail(ctx, verification.Email, "Verify your Zenvis email", "email_verification", map[string]string{
+		"Name":      verification.Name,
+		"Link":      verification.Link,
+		"ExpiresAt": verification.ExpiresAt.UTC().Format(time.RFC1123),
+	})
+}
+
+// publishEmail queues an email job for the mail service
+func (g *grpcServer) publishEmail(ctx context.Context, to string, subject string, templateName string, templateData map[string]string) error {
+	Logs := logger.GetGlobalLogger()
+
+	emailJob := map[string]interface{}{
+		"to":           to,
+		"subject":      subject,
+		"templateName": templateName,
+		"templateData": templateData,
+	}
+
+	payload, err := json.Marshal(emailJob)
+	if err != nil {
+		Logs.Error(ctx, "Failed to marshal email job: "+err.Error())
+		return err
+	}
+
+	if err := g.netScan.Publish("emails.send", payload); err != nil {
+		Logs.Error(ctx, "Failed to publish "+templateName+" email job: "+err.Error())
+		return err
+	}
+	Logs.Info(ctx, "Email job "+templateName+" published to NATS")
+	return nil
+}
+
+func (g *grpcServer) CreateAPIKey(ctx context.Context, req *pb.CreateAPIKeyRequest) (*pb.APIKeySecretResponse, error) {
+	ttl := time.Duration(req.GetTtlSeconds()) * time.Second
+	key, secret, err := g.service.CreateAPIKey(ctx, req.GetUserId(), req.GetName(), req.GetScopes(), ttl, g.accountClient)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.APIKeySecretResponse{ApiKey: apiKeyToProto(key), Key: secret}, nil
+}
+
+func (g *grpcServer) ListAPIKeys(ctx context.Context, req *pb.ListAPIKeysRequest) (*pb.ListAPIKeysResponse, error) {
+	keys, err := g.service.ListAPIKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &pb.ListAPIKeysResponse{ApiKeys: make([]*pb.APIKey, 0, len(keys))}
+	for _, key := range keys {
+		resp.ApiKeys = append(resp.ApiKeys, apiKeyToProto(key))
+	}
+	return resp, nil
+}
+
+func (g *grpcServer) RotateAPIKey(ctx context.Context, req *pb.APIKeyRequest) (*pb.APIKeySecretResponse, error) {
+	key, secret, err := g.service.RotateAPIKey(ctx, req.GetUserId(), req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	return &pb.APIKeySecretResponse{ApiKey: apiKeyToProto(key), Key: secret}, nil
+}
+
+func (g *grpcServer) RevokeAPIKey(ctx context.Context, req *pb.APIKeyRequest) (*pb.UpdateAccountResponse, error) {
+	return g.service.RevokeAPIKey(ctx, req.GetUserId(), req.GetId())
+}
+
+func (g *grpcServer) VerifyAPIKey(ctx context.Context, req *pb.VerifyAPIKeyRequest) (*pb.VerifyResponse, error) {
+	claims, err := g.service.VerifyAPIKey(ctx, req.GetKey(), g.accountClient)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.VerifyResponse{
+		UserId:         claims.ID,
+		Role:           claims.Role,
+		Permissions:    claims.Permissions,
+		ServiceAccount: claims.ServiceAccount,
+	}, nil
+}
+
+func (g *grpcServer) StartOIDCLogin(ctx context.Context, req *pb.StartOIDCLoginRequest) (*pb.StartOIDCLoginResponse, error) {
+	authorization, err := g.service.StartOIDCLogin(ctx, req.GetProvider())
+	if err != nil {
+		return nil, err
+	}
+	return &pb.StartOIDCLoginResponse{
+		AuthorizationUrl: authorization.URL,
+		State:            authorization.State,
+	}, nil
+}
+
+func (g *grpcServer) CompleteOIDCLogin(ctx context.Context, req *pb.CompleteOIDCLoginRequest) (*pb.LoginResponse, error) {
+	info := SessionInfo{
+		Device:    req.GetDevice(),
+		IPAddress: clientIPFromRequest(ctx, req.GetClientIp()),
+		UserAgent: req.GetUserAgent(),
+	}
+	return g.service.CompleteOIDCLogin(ctx, req.GetProvider(), req.GetState(), req.GetCode(), info, g.accountClient)
+}
+
+func (g *grpcServer) ExportAccountData(ctx context.Context, req *pb.PrivacyActionRequest) (*pb.ExportAccountDataResponse, error) {
+	request, archive, err := g.service.ExportAccountData(ctx, req.GetUserId(), req.GetRequestedBy(), g.accountClient, g.orderClient)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.ExportAccountDataResponse{Request: privacyRequestToProto(request), Archive: archive}, nil
+}
+
+func (g *grpcServer) RequestErasure(ctx context.Context, req *pb.PrivacyActionRequest) (*pb.PrivacyRequestResponse, error) {
+	request, err := g.service.RequestErasure(ctx, req.GetUserId(), req.GetRequestedBy(), g.accountClient)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.PrivacyRequestResponse{Request: privacyRequestToProto(request)}, nil
+}
+
+func (g *grpcServer) CancelErasure(ctx context.Context, req *pb.PrivacyActionRequest) (*pb.PrivacyRequestResponse, error) {
+	request, err := g.service.CancelErasure(ctx, req.GetUserId(), req.GetRequestedBy())
+	if err != nil {
+		return nil, err
+	}
+	return &pb.PrivacyRequestResponse{Request: privacyRequestToProto(request)}, nil
+}
+
+func (g *grpcServer) ListPrivacyRequests(ctx context.Context, req *pb.UpdateAccountRequest) (*pb.ListPrivacyRequestsResponse, error) {
+	requests, err := g.service.ListPrivacyRequests(ctx, req.GetUserId())
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &pb.ListPrivacyRequestsResponse{Requests: make([]*pb.PrivacyRequest, 0, len(requests))}
+	for _, request := range requests {
+		resp.Requests = append(resp.Requests, privacyRequestToProto(request))
+	}
+	return resp, nil
+}
+
+func privacyRequestToProto(request *PrivacyRequest) *pb.PrivacyRequest {
+	result := &pb.PrivacyRequest{
+		Id:          request.ID,
+		UserId:      request.UserID,
+		Kind:        request.Kind,
+		Status:      request.Status,
+		RequestedBy: request.RequestedBy,
+		CreatedAt:   timestamppb.New(request.CreatedAt),
+		Steps:       make([]*pb.PrivacyRequestStep, 0, len(request.Steps)),
+	}
+	if !request.ScheduledFor.IsZero() {
+		result.ScheduledFor = timestamppb.New(request.ScheduledFor)
+	}
+	if !request.CompletedAt.IsZero() {
+		result.CompletedAt = timestamppb.New(request.CompletedAt)
+	}
+	for _, step := range request.Steps {
+		result.Steps = append(result.Steps, &pb.PrivacyRequestStep{
+			Step:      step.Step,
+			Status:    step.Status,
+			Details:   step.Details,
+			CreatedAt: timestamppb.New(step.CreatedAt),
+		})
+	}
+	return result
+}
+
+func apiKeyToProto(key *APIKey) *pb.APIKey {
+	apiKey := &pb.APIKey{
+		Id:        key.ID,
+		Name:      key.Name,
+		Prefix:    key.Prefix,
+		Scopes:    key.Scopes,
+		CreatedBy: key.CreatedBy,
+		CreatedAt: timestamppb.New(key.CreatedAt),
+		ExpiresAt: timestamppb.New(key.ExpiresAt),
+	}
+	if !key.LastUsedAt.IsZero() {
+		apiKey.LastUsedAt = timestamppb.New(key.LastUsedAt)
+	}
+	if !key.RevokedAt.IsZero() {
+		apiKey.RevokedAt = timestamppb.New(key.RevokedAt)
+	}
+	return apiKey
+}
@@ -0,0 +1,726 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"github.com/zenvisjr/building-scalable-microservices/account"
+	"github.com/zenvisjr/building-scalable-microservices/auth/fakeoidc"
+	"github.com/zenvisjr/building-scalable-microservices/auth/pb"
+	"github.com/zenvisjr/building-scalable-microservices/internal/servicetest"
+	"github.com/zenvisjr/building-scalable-microservices/internal/svcauthtest"
+	"github.com/zenvisjr/building-scalable-microservices/order"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMain(m *testing.M) {
+	servicetest.Main(m, "auth")
+}
+
+// emailLinkToken returns the token of the link in the last email sent with templateName
+func emailLinkToken(t *testing.T, publisher *servicetest.Publisher, templateName string) string {
+	t.Helper()
+	jobs := publisher.Messages("emails.send")
+	for i := len(jobs) - 1; i >= 0; i-- {
+		var job struct {
+			TemplateName string            `json:"templateName"`
+			TemplateData map[string]string `json:"templateData"`
+		}
+		if err := json.Unmarshal(jobs[i], &job); err != nil {
+			t.Fatalf("email job: %v", err)
+		}
+		if job.TemplateName != templateName {
+			continue
+		}
+		link, err := url.Parse(job.TemplateData["Link"])
+		if err != nil {
+			t.Fatalf("email link: %v", err)
+		}
+		return link.Query().Get("token")
+	}
+	t.Fatalf("no %s email was sent", templateName)
+	return ""
+}
+
+// testSigningKey signs the tokens of every test server, tests mint tokens they trust with it
+var testSigningKey = func() *SigningKey {
+	key, err := GenerateSigningKey()
+	if err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+// startServer serves an in-memory auth service over bufconn, backed by an in-memory account
+// service whose client is returned too. Exports and erasures are not served, they would need
+// the order service too
+func startServer(t *testing.T, lockout LockoutPolicy) (*Client, *account.Client, *servicetest.Publisher) {
+	t.Helper()
+	return startOIDCServer(t, lockout, OIDCConfig{})
+}
+
+// startOIDCServer is startServer with sign-in through the providers of oidc
+func startOIDCServer(t *testing.T, lockout LockoutPolicy, oidc OIDCConfig) (*Client, *account.Client, *servicetest.Publisher) {
+	t.Helper()
+	publisher := &servicetest.Publisher{}
+
+	accountDialer := servicetest.Serve(t, account.NewGRPCServer(account.NewAccountService(account.NewInMemoryRepository()), publisher))
+	accountClient, err := account.NewClient("passthrough:///account", accountDialer)
+	if err != nil {
+		t.Fatalf("account.NewClient: %v", err)
+	}
+	t.Cleanup(accountClient.Close)
+
+	jwtManager, err := NewJWTManager(15*time.Minute, time.Hour, testSigningKey)
+	if err != nil {
+		t.Fatalf("NewJWTManager: %v", err)
+	}
+	service := NewAuthService(ServiceOptions{
+		JWTManager:        jwtManager,
+		Repository:        NewInMemoryRepository(),
+		Sessions:          NewInMemorySessionRepository(),
+		LockoutPolicy:     lockout,
+		PasswordReset:     PasswordResetConfig{TokenTTL: time.Hour, ResetURL: "http://localhost/reset-password"},
+		EmailVerification: EmailVerificationConfig{TokenTTL: time.Hour, VerifyURL: "http://localhost/verify-email", MaxPerDay: 5},
+		APIKeys:           APIKeyConfig{DefaultTTL: time.Hour, MaxTTL: time.Hour, RotationGrace: time.Minute},
+		OIDC:              oidc,
+		TokenVersions:     NewTokenVersionCache(time.Minute),
+		Privacy:           PrivacyConfig{ErasureGracePeriod: time.Hour},
+	})
+
+	// account events reach the token version cache the way they do over NATS
+	publisher.Subscribe(account.TokenVersionChangedSubject, func(data []byte) {
+		tokenVersionChanged(service, data)
+	})
+
+	authDialer := servicetest.Serve(t, NewGRPCServer(service, accountClient, nil, publisher, svcauthtest.ServedAs("auth")))
+	client, err := NewClient("passthrough:///auth", authDialer)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(client.Close)
+	return client, accountClient, publisher
+}
+
+var testLockout = LockoutPolicy{
+	MaxFailedAttempts:   2,
+	MaxIPFailedAttempts: 100,
+	FailureWindow:       time.Hour,
+	BaseLockout:         time.Hour,
+	MaxLockout:          time.Hour,
+}
+
+func TestSignupAndRefresh(t *testing.T) {
+	client, _, publisher := startServer(t, testLockout)
+	ctx := context.Background()
+
+	signup, err := client.Signup(ctx, "alice", "alice@example.com", "secret123", "", SessionInfo{Device: "laptop"})
+	if err != nil {
+		t.Fatalf("Signup: %v", err)
+	}
+	if signup.GetUserId() == "" || signup.GetRole() != "user" || signup.GetAccessToken() == "" {
+		t.Fatalf("Signup = %+v", signup)
+	}
+	if token := emailLinkToken(t, publisher, "email_verification"); token == "" {
+		t.Error("verification email without a token")
+	}
+
+	claims, err := client.VerifyToken(ctx, signup.GetAccessToken())
+	if err != nil || claims.ID != signup.GetUserId() || claims.Email != "alice@example.com" {
+		t.Errorf("VerifyToken = %+v, %v", claims, err)
+	}
+
+	refreshed, err := client.RefreshToken(ctx, signup.GetRefreshToken())
+	if err != nil {
+		t.Fatalf("RefreshToken: %v", err)
+	}
+	if refreshed.GetRefreshToken() == signup.GetRefreshToken() {
+		t.Error("RefreshToken returned the same refresh token")
+	}
+
+	// presenting the rotated token again revokes the whole family
+	if _, err := client.RefreshToken(ctx, signup.GetRefreshToken()); err == nil {
+		t.Error("RefreshToken with a rotated token succeeded")
+	}
+	if _, err := client.RefreshToken(ctx, refreshed.GetRefreshToken()); err == nil {
+		t.Error("RefreshToken in a family revoked for reuse succeeded")
+	}
+}
+
+func TestRefreshFollowsAccount(t *testing.T) {
+	client, accounts, _ := startServer(t, testLockout)
+	ctx := context.Background()
+
+	dave, err := client.Signup(ctx, "dave", "dave@example.com", "secret123", "", SessionInfo{})
+	if err != nil {
+		t.Fatalf("Signup: %v", err)
+	}
+	erin, err := client.Signup(ctx, "erin", "erin@example.com", "secret123", "", SessionInfo{})
+	if err != nil {
+		t.Fatalf("Signup: %v", err)
+	}
+
+	// a role change bumps the token version, a refresh token issued before cannot mint tokens
+	// with the old role
+	if _, err := accounts.ChangeRole(ctx, dave.GetUserId(), "admin"); err != nil {
+		t.Fatalf("ChangeRole: %v", err)
+	}
+	if _, err := client.RefreshToken(ctx, dave.GetRefreshToken()); err == nil {
+		t.Error("RefreshToken issued before a role change succeeded")
+	}
+	login, err := client.Login(ctx, "dave@example.com", "secret123", SessionInfo{})
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	refreshed, err := client.RefreshToken(ctx, login.GetAuth().GetRefreshToken())
+	if err != nil || refreshed.GetRole() != "admin" {
+		t.Fatalf("RefreshToken after login = %+v, %v", refreshed, err)
+	}
+	if claims, err := client.VerifyToken(ctx, refreshed.GetAccessToken()); err != nil || claims.Role != "admin" {
+		t.Errorf("VerifyToken = %+v, %v", claims, err)
+	}
+
+	// nor can the refresh tokens of a deactivated account
+	svcauthtest.CallAs(t, "auth")
+	if err := accounts.DeactivateAccount(ctx, erin.GetUserId()); err != nil {
+		t.Fatalf("DeactivateAccount: %v", err)
+	}
+	if _, err := client.RefreshToken(ctx, erin.GetRefreshToken()); err == nil {
+		t.Error("RefreshToken of a deactivated account succeeded")
+	}
+}
+
+func TestDeviceSessions(t *testing.T) {
+	client, _, _ := startServer(t, testLockout)
+	ctx := context.Background()
+
+	signup, err := client.Signup(ctx, "erin", "erin@example.com", "secret123", "", SessionInfo{})
+	if err != nil {
+		t.Fatalf("Signup: %v", err)
+	}
+	// logins that do not identify their device never replace each other
+	if _, err := client.Login(ctx, "erin@example.com", "secret123", SessionInfo{}); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	sessions, err := client.ListSessions(ctx, signup.GetUserId())
+	if err != nil || len(sessions) != 2 {
+		t.Fatalf("ListSessions = %d sessions, %v", len(sessions), err)
+	}
+
+	laptop := SessionInfo{Device: "laptop", UserAgent: "firefox"}
+	for i := 0; i < 2; i++ {
+		if _, err := client.Login(ctx, "erin@example.com", "secret123", laptop); err != nil {
+			t.Fatalf("Login: %v", err)
+		}
+	}
+	sessions, err = client.ListSessions(ctx, signup.GetUserId())
+	if err != nil || len(sessions) != 3 {
+		t.Fatalf("ListSessions = %d sessions, %v", len(sessions), err)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	client, _, _ := startServer(t, testLockout)
+	ctx := context.Background()
+	if _, err := client.Signup(ctx, "bob", "bob@example.com", "secret123", "", SessionInfo{}); err != nil {
+		t.Fatalf("Signup: %v", err)
+	}
+
+	login, err := client.Login(ctx, "bob@example.com", "secret123", SessionInfo{})
+	if err != nil || login.GetAuth().GetAccessToken() == "" {
+		t.Fatalf("Login = %+v, %v", login, err)
+	}
+	for i := 0; i < testLockout.MaxFailedAttempts; i++ {
+		if _, err := client.Login(ctx, "bob@example.com", "wrong-password", SessionInfo{}); err == nil {
+			t.Fatal("Login with a wrong password succeeded")
+		}
+	}
+	if _, err := client.Login(ctx, "bob@example.com", "secret123", SessionInfo{}); err == nil {
+		t.Error("Login of a locked email succeeded")
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	client, _, publisher := startServer(t, testLockout)
+	ctx := context.Background()
+	if _, err := client.Signup(ctx, "carol", "carol@example.com", "secret123", "", SessionInfo{}); err != nil {
+		t.Fatalf("Signup: %v", err)
+	}
+
+	if _, err := client.RequestPasswordReset(ctx, "carol@example.com"); err != nil {
+		t.Fatalf("RequestPasswordReset: %v", err)
+	}
+	// unknown emails get the same answer and no email
+	if _, err := client.RequestPasswordReset(ctx, "nobody@example.com"); err != nil {
+		t.Fatalf("RequestPasswordReset of an unknown email: %v", err)
+	}
+	token := emailLinkToken(t, publisher, "password_reset")
+
+	if _, err := client.ConfirmPasswordReset(ctx, token, "new-secret456"); err != nil {
+		t.Fatalf("ConfirmPasswordReset: %v", err)
+	}
+	if _, err := client.ConfirmPasswordReset(ctx, token, "other-secret789"); err == nil {
+		t.Error("ConfirmPasswordReset with a used token succeeded")
+	}
+	if _, err := client.Login(ctx, "carol@example.com", "secret123", SessionInfo{}); err == nil {
+		t.Error("Login with the old password succeeded")
+	}
+	if _, err := client.Login(ctx, "carol@example.com", "new-secret456", SessionInfo{}); err != nil {
+		t.Errorf("Login with the new password: %v", err)
+	}
+}
+
+func TestPasswordResetAfterEmailChange(t *testing.T) {
+	client, _, publisher := startServer(t, testLockout)
+	ctx := context.Background()
+	signup, err := client.Signup(ctx, "ivy", "ivy@example.com", "secret123", "", SessionInfo{})
+	if err != nil {
+		t.Fatalf("Signup: %v", err)
+	}
+	if _, err := client.VerifyEmail(ctx, emailLinkToken(t, publisher, "email_verification")); err != nil {
+		t.Fatalf("VerifyEmail: %v", err)
+	}
+	if _, err := client.RequestPasswordReset(ctx, "ivy@example.com"); err != nil {
+		t.Fatalf("RequestPasswordReset: %v", err)
+	}
+	token := emailLinkToken(t, publisher, "password_reset")
+
+	// the link went to the old address, which may be someone else's by now
+	newEmail := "ivy.new@example.com"
+	if _, err := client.UpdateProfile(ctx, signup.GetUserId(), account.ProfileUpdate{Email: &newEmail}); err != nil {
+		t.Fatalf("UpdateProfile: %v", err)
+	}
+	if _, err := client.VerifyEmail(ctx, emailLinkToken(t, publisher, "email_verification")); err != nil {
+		t.Fatalf("VerifyEmail of the new email: %v", err)
+	}
+	if _, err := client.ConfirmPasswordReset(ctx, token, "new-secret456"); err == nil {
+		t.Error("ConfirmPasswordReset with a token for the old email succeeded")
+	}
+	if _, err := client.Login(ctx, newEmail, "secret123", SessionInfo{}); err != nil {
+		t.Errorf("Login with the unchanged password: %v", err)
+	}
+}
+
+func TestTokenVersionEvents(t *testing.T) {
+	client, accounts, publisher := startServer(t, testLockout)
+	ctx := context.Background()
+
+	signup, err := client.Signup(ctx, "ivan", "ivan@example.com", "secret123", "", SessionInfo{})
+	if err != nil {
+		t.Fatalf("Signup: %v", err)
+	}
+	if _, err := client.VerifyToken(ctx, signup.GetAccessToken()); err != nil {
+		t.Fatalf("VerifyToken: %v", err)
+	}
+
+	// the version just verified stays cached for a minute, only the event of the account
+	// service makes the bump visible right away
+	t.Run("bump", func(t *testing.T) {
+		svcauthtest.CallAs(t, "auth")
+		if err := accounts.IncrementTokenVersion(ctx, signup.GetUserId()); err != nil {
+			t.Fatalf("IncrementTokenVersion: %v", err)
+		}
+	})
+	if got := publisher.Count(account.TokenVersionChangedSubject); got != 1 {
+		t.Fatalf("published %d token version events, want 1", got)
+	}
+	if _, err := client.VerifyToken(ctx, signup.GetAccessToken()); err == nil {
+		t.Error("VerifyToken after the token version event succeeded")
+	}
+
+	// an unreadable event leaves the cache alone
+	login, err := client.Login(ctx, "ivan@example.com", "secret123", SessionInfo{})
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	publisher.Publish(account.TokenVersionChangedSubject, []byte("{"))
+	if _, err := client.VerifyToken(ctx, login.GetAuth().GetAccessToken()); err != nil {
+		t.Errorf("VerifyToken after an unreadable event: %v", err)
+	}
+}
+
+func TestVerifyBatch(t *testing.T) {
+	client, accounts, _ := startServer(t, testLockout)
+	ctx := context.Background()
+
+	judy, err := client.Signup(ctx, "judy", "judy@example.com", "secret123", "", SessionInfo{})
+	if err != nil {
+		t.Fatalf("Signup: %v", err)
+	}
+	karl, err := client.Signup(ctx, "karl", "karl@example.com", "secret123", "", SessionInfo{})
+	if err != nil {
+		t.Fatalf("Signup: %v", err)
+	}
+
+	// an expired token of a live session, signed with the key of the server
+	claims, err := client.VerifyToken(ctx, judy.GetAccessToken())
+	if err != nil {
+		t.Fatalf("VerifyToken: %v", err)
+	}
+	expiredManager, err := NewJWTManager(-time.Minute, time.Hour, testSigningKey)
+	if err != nil {
+		t.Fatalf("NewJWTManager: %v", err)
+	}
+	expired, err := expiredManager.GenerateAccessToken(claims.ID, claims.Email, claims.Role, nil, 0, claims.SessionID)
+	if err != nil {
+		t.Fatalf("GenerateAccessToken: %v", err)
+	}
+
+	// karl's token goes stale when his token version is bumped
+	t.Run("bump", func(t *testing.T) {
+		svcauthtest.CallAs(t, "auth")
+		if err := accounts.IncrementTokenVersion(ctx, karl.GetUserId()); err != nil {
+			t.Fatalf("IncrementTokenVersion: %v", err)
+		}
+	})
+
+	tokens := []string{judy.GetAccessToken(), expired, karl.GetAccessToken(), "not-a-token", judy.GetAccessToken()}
+	wantValid := []bool{true, false, false, false, true}
+
+	verifications, err := client.VerifyBatch(ctx, tokens)
+	if err != nil {
+		t.Fatalf("VerifyBatch: %v", err)
+	}
+	if len(verifications) != len(tokens) {
+		t.Fatalf("VerifyBatch returned %d results for %d tokens", len(verifications), len(tokens))
+	}
+	for i, verification := range verifications {
+		if valid := verification.Err == nil; valid != wantValid[i] {
+			t.Errorf("VerifyBatch result %d valid = %v (%v), want %v", i, valid, verification.Err, wantValid[i])
+			continue
+		}
+		if wantValid[i] && (verification.Claims == nil || verification.Claims.ID != judy.GetUserId()) {
+			t.Errorf("VerifyBatch result %d claims = %+v, want judy", i, verification.Claims)
+		}
+	}
+
+	for i, token := range tokens {
+		introspection, err := client.Introspect(ctx, token)
+		if err != nil {
+			t.Fatalf("Introspect: %v", err)
+		}
+		if introspection.Active != wantValid[i] {
+			t.Errorf("Introspect token %d active = %v, want %v", i, introspection.Active, wantValid[i])
+			continue
+		}
+		if wantValid[i] && (introspection.Claims.ID != judy.GetUserId() || introspection.TokenType != "access_token" || !introspection.ExpiresAt.After(time.Now())) {
+			t.Errorf("Introspect token %d = %+v", i, introspection)
+		}
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	client, _, _ := startServer(t, testLockout)
+	ctx := context.Background()
+	signup, err := client.Signup(ctx, "dave", "dave@example.com", "secret123", "", SessionInfo{})
+	if err != nil {
+		t.Fatalf("Signup: %v", err)
+	}
+
+	// services handling user requests may introspect tokens but not log users in
+	svcauthtest.Use("order")
+	defer svcauthtest.Use("gateway")
+	if _, err := client.Login(ctx, "dave@example.com", "secret123", SessionInfo{}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Login from order = %v, want PermissionDenied", err)
+	}
+	introspection, err := client.Introspect(ctx, signup.GetAccessToken())
+	if err != nil || !introspection.Active {
+		t.Errorf("Introspect from order = %+v, %v", introspection, err)
+	}
+}
+
+func TestAPIKeyFollowsCreator(t *testing.T) {
+	client, accounts, _ := startServer(t, testLockout)
+	ctx := context.Background()
+
+	admin, err := client.Signup(ctx, "carol", "carol@example.com", "secret123", "admin", SessionInfo{})
+	if err != nil {
+		t.Fatalf("Signup: %v", err)
+	}
+	if _, _, err := client.CreateAPIKey(ctx, admin.GetUserId(), "ci", []string{"apikey:manage"}, 0); err == nil {
+		t.Error("CreateAPIKey granting apikey:manage succeeded")
+	}
+	_, secret, err := client.CreateAPIKey(ctx, admin.GetUserId(), "ci", []string{"product:write", "order:create"}, 0)
+	if err != nil {
+		t.Fatalf("CreateAPIKey: %v", err)
+	}
+	principal, err := client.VerifyAPIKey(ctx, secret)
+	if err != nil || principal.Role != ServiceAccountRole || len(principal.Permissions) != 2 {
+		t.Fatalf("VerifyAPIKey = %+v, %v", principal, err)
+	}
+
+	// a demoted creator takes the scopes they lost away from the key
+	if _, err := accounts.ChangeRole(ctx, admin.GetUserId(), "user"); err != nil {
+		t.Fatalf("ChangeRole: %v", err)
+	}
+	principal, err = client.VerifyAPIKey(ctx, secret)
+	if err != nil || len(principal.Permissions) != 1 || principal.Permissions[0] != "order:create" {
+		t.Errorf("VerifyAPIKey after a demotion = %+v, %v", principal, err)
+	}
+
+	// and a deactivated or deleted one all of them
+	if _, err := client.DeactivateAccount(ctx, admin.GetUserId()); err != nil {
+		t.Fatalf("DeactivateAccount: %v", err)
+	}
+	if _, err := client.VerifyAPIKey(ctx, secret); err == nil {
+		t.Error("VerifyAPIKey of a deactivated creator succeeded")
+	}
+	if _, err := client.ReactivateAccount(ctx, admin.GetUserId()); err != nil {
+		t.Fatalf("ReactivateAccount: %v", err)
+	}
+	if _, err := client.VerifyAPIKey(ctx, secret); err != nil {
+		t.Errorf("VerifyAPIKey of a reactivated creator: %v", err)
+	}
+	if _, err := client.DeleteAccount(ctx, admin.GetUserId()); err != nil {
+		t.Fatalf("DeleteAccount: %v", err)
+	}
+	if _, err := client.VerifyAPIKey(ctx, secret); err == nil {
+		t.Error("VerifyAPIKey of a deleted creator succeeded")
+	}
+}
+
+// authorizeOIDC follows the login to the fake issuer and returns the code and state it redirects back with
+func authorizeOIDC(t *testing.T, authorization *OIDCAuthorization, loginHint string) (string, string) {
+	t.Helper()
+	authURL, err := url.Parse(authorization.URL)
+	if err != nil {
+		t.Fatalf("authorization URL: %v", err)
+	}
+	if loginHint != "" {
+		query := authURL.Query()
+		query.Set("login_hint", loginHint)
+		authURL.RawQuery = query.Encode()
+	}
+
+	browser := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := browser.Get(authURL.String())
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	resp.Body.Close()
+	callback, err := resp.Location()
+	if err != nil {
+		t.Fatalf("authorize answered %s without a redirect", resp.Status)
+	}
+	return callback.Query().Get("code"), callback.Query().Get("state")
+}
+
+func TestOIDCLogin(t *testing.T) {
+	issuer, err := fakeoidc.New("", "zenvis", "client-secret", fakeoidc.Identity{
+		Subject:       "fake|grace",
+		Email:         "grace@example.com",
+		EmailVerified: true,
+		Name:          "Grace",
+	})
+	if err != nil {
+		t.Fatalf("fakeoidc.New: %v", err)
+	}
+	provider := httptest.NewServer(issuer.Handler())
+	t.Cleanup(provider.Close)
+	issuer.URL = provider.URL
+
+	client, _, _ := startOIDCServer(t, testLockout, OIDCConfig{
+		Providers: map[string]*OIDCProvider{
+			"fake": NewOIDCProvider("fake", OIDCProviderConfig{
+				Issuer:       provider.URL,
+				ClientID:     "zenvis",
+				ClientSecret: "client-secret",
+				RedirectURL:  "http://localhost/oidc/callback",
+				Scopes:       []string{"openid", "email", "profile"},
+			}, provider.Client()),
+		},
+		StateTTL: time.Minute,
+	})
+	ctx := context.Background()
+
+	login := func(loginHint string) (*pb.LoginResponse, error) {
+		t.Helper()
+		authorization, err := client.StartOIDCLogin(ctx, "fake")
+		if err != nil {
+			t.Fatalf("StartOIDCLogin: %v", err)
+		}
+		code, state := authorizeOIDC(t, authorization, loginHint)
+		if state != authorization.State {
+			t.Fatalf("issuer returned state %q, want %q", state, authorization.State)
+		}
+		return client.CompleteOIDCLogin(ctx, "fake", state, code, SessionInfo{})
+	}
+
+	// the first sign-in creates the account, the next one finds it by subject
+	first, err := login("")
+	if err != nil || first.GetAuth().GetEmail() != "grace@example.com" {
+		t.Fatalf("CompleteOIDCLogin = %+v, %v", first, err)
+	}
+	second, err := login("")
+	if err != nil || second.GetAuth().GetUserId() != first.GetAuth().GetUserId() {
+		t.Fatalf("second CompleteOIDCLogin = %+v, %v", second, err)
+	}
+
+	// a state works once
+	authorization, err := client.StartOIDCLogin(ctx, "fake")
+	if err != nil {
+		t.Fatalf("StartOIDCLogin: %v", err)
+	}
+	code, state := authorizeOIDC(t, authorization, "")
+	if _, err := client.CompleteOIDCLogin(ctx, "fake", state, code, SessionInfo{}); err != nil {
+		t.Fatalf("CompleteOIDCLogin: %v", err)
+	}
+	if _, err := client.CompleteOIDCLogin(ctx, "fake", state, code, SessionInfo{}); err == nil {
+		t.Error("CompleteOIDCLogin with a used state succeeded")
+	}
+
+	// an account whose email was never verified is not taken over by the provider
+	if _, err := client.Signup(ctx, "henry", "henry@example.com", "secret123", "", SessionInfo{}); err != nil {
+		t.Fatalf("Signup: %v", err)
+	}
+	if _, err := login("henry@example.com"); status.Convert(err).Message() != errOIDCAccountExists.Error() {
+		t.Errorf("CompleteOIDCLogin of an unverified account = %v, want %v", err, errOIDCAccountExists)
+	}
+}
+
+func TestRemoteKeySetRevocation(t *testing.T) {
+	client, _, publisher := startServer(t, testLockout)
+	ctx := context.Background()
+
+	first, err := client.Signup(ctx, "dave", "dave@example.com", "secret123", "", SessionInfo{Device: "laptop"})
+	if err != nil {
+		t.Fatalf("Signup: %v", err)
+	}
+	second, err := client.Login(ctx, "dave@example.com", "secret123", SessionInfo{Device: "phone"})
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+
+	// without caching every request asks the auth service, a revoked session fails right away
+	uncached := NewRemoteKeySet(client, time.Minute, 0)
+	claims, err := uncached.VerifyToken(ctx, second.GetAuth().GetAccessToken())
+	if err != nil || claims.ID != first.GetUserId() {
+		t.Fatalf("VerifyToken = %+v, %v", claims, err)
+	}
+	cached := NewRemoteKeySet(client, time.Minute, time.Hour)
+	if _, err := cached.VerifyToken(ctx, second.GetAuth().GetAccessToken()); err != nil {
+		t.Fatalf("VerifyToken: %v", err)
+	}
+
+	if _, err := client.RevokeSession(ctx, first.GetUserId(), claims.SessionID); err != nil {
+		t.Fatalf("RevokeSession: %v", err)
+	}
+	if _, err := uncached.VerifyToken(ctx, second.GetAuth().GetAccessToken()); err == nil {
+		t.Error("VerifyToken of a revoked session succeeded")
+	}
+	events := publisher.Messages(SessionRevokedSubject)
+	var event SessionRevoked
+	if len(events) != 1 || json.Unmarshal(events[0], &event) != nil || event.SessionID != claims.SessionID {
+		t.Fatalf("session revoked events = %q", events)
+	}
+
+	// a cached session lasts until the event arrives
+	if _, err := cached.VerifyToken(ctx, second.GetAuth().GetAccessToken()); err != nil {
+		t.Errorf("VerifyToken of a cached session: %v", err)
+	}
+	cached.sessions.Invalidate(event.SessionID)
+	if _, err := cached.VerifyToken(ctx, second.GetAuth().GetAccessToken()); err == nil {
+		t.Error("VerifyToken after the revocation event succeeded")
+	}
+
+	// the other session ends with a logout, which bumps the token version
+	if _, err := uncached.VerifyToken(ctx, first.GetAccessToken()); err != nil {
+		t.Fatalf("VerifyToken of the other session: %v", err)
+	}
+	if _, err := client.Logout(ctx, first.GetUserId()); err != nil {
+		t.Fatalf("Logout: %v", err)
+	}
+	if _, err := uncached.VerifyToken(ctx, first.GetAccessToken()); err == nil {
+		t.Error("VerifyToken after a logout succeeded")
+	}
+}
+
+func TestErasureRetries(t *testing.T) {
+	_, accountClient, publisher := startServer(t, testLockout)
+	ctx := context.Background()
+
+	orderService, err := order.NewOrderService(order.NewInMemoryRepository())
+	if err != nil {
+		t.Fatalf("order.NewOrderService: %v", err)
+	}
+	orderDialer := servicetest.Serve(t, order.NewGRPCServer(orderService, accountClient, nil, publisher, account.UnverifiedPolicy{}, svcauthtest.ServedAs("order")))
+	orderClient, err := order.NewClient("passthrough:///order", orderDialer)
+	if err != nil {
+		t.Fatalf("order.NewClient: %v", err)
+	}
+	t.Cleanup(orderClient.Close)
+
+	// an order service that is down fails the orders step of every run
+	downServer := grpc.NewServer()
+	downDialer := servicetest.Serve(t, downServer)
+	downServer.Stop()
+	downOrderClient, err := order.NewClient("passthrough:///order", downDialer)
+	if err != nil {
+		t.Fatalf("order.NewClient: %v", err)
+	}
+	t.Cleanup(downOrderClient.Close)
+
+	repository := NewInMemoryRepository()
+	service := NewAuthService(ServiceOptions{
+		Repository:    repository,
+		Sessions:      NewInMemorySessionRepository(),
+		LockoutPolicy: testLockout,
+		TokenVersions: NewTokenVersionCache(time.Minute),
+		Privacy:       PrivacyConfig{MaxAttempts: 2},
+	}).(*authService)
+
+	// erasures run in the background of auth
+	svcauthtest.Use("auth")
+	defer svcauthtest.Use("gateway")
+
+	erase := func(userId string, oc *order.Client) *PrivacyRequest {
+		t.Helper()
+		err := repository.CreatePrivacyRequest(ctx, &PrivacyRequest{
+			ID:           ksuid.New().String(),
+			UserID:       userId,
+			Kind:         PrivacyRequestErasure,
+			Status:       PrivacyStatusPending,
+			RequestedBy:  userId,
+			CreatedAt:    time.Now(),
+			ScheduledFor: time.Now().Add(-time.Minute),
+		})
+		if err != nil {
+			t.Fatalf("CreatePrivacyRequest: %v", err)
+		}
+		service.processDueErasures(ctx, accountClient, oc)
+		requests, err := repository.ListPrivacyRequests(ctx, userId)
+		if err != nil || len(requests) != 1 {
+			t.Fatalf("ListPrivacyRequests = %v, %v", requests, err)
+		}
+		return requests[0]
+	}
+
+	// an account deleted before its erasure ran still gets the remaining steps
+	request := erase(ksuid.New().String(), orderClient)
+	if request.Status != PrivacyStatusCompleted || len(request.Steps) != 4 || request.Steps[0].Details != "account already deleted" {
+		t.Fatalf("erasure of a deleted account = %+v", request)
+	}
+
+	// an erasure that keeps failing is marked failed after MaxAttempts runs
+	request = erase(ksuid.New().String(), downOrderClient)
+	if request.Status != PrivacyStatusFailed || request.Attempts != 2 {
+		t.Fatalf("erasure without the order service = %+v", request)
+	}
+	failed := 0
+	for _, step := range request.Steps {
+		if step.Step == "orders" && step.Status == PrivacyStatusFailed {
+			failed++
+		}
+	}
+	if failed != 2 {
+		t.Errorf("failed orders steps = %d, want 2", failed)
+	}
+}
@@ -4,19 +4,21 @@ import (
 	"context"
 	"errors"
 	"log"
-	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/segmentio/ksuid"
 	"github.com/zenvisjr/building-scalable-microservices/account" // ← gRPC client for Account
 	"github.com/zenvisjr/building-scalable-microservices/auth/pb"
 	"github.com/zenvisjr/building-scalable-microservices/logger"
+	"github.com/zenvisjr/building-scalable-microservices/order"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type Service interface {
-	Signup(ctx context.Context, name string, email string, password string, role string, ac *account.Client) (*pb.AuthResponse, error)
-	Login(ctx context.Context, email string, password string, ac *account.Client) (*pb.AuthResponse, error)
-	RefreshToken(ctx context.Context, refreshToken string) (*pb.AuthResponse, error)
+	Signup(ctx context.Context, name string, email string, password string, role string, info SessionInfo, ac *account.Client) (*pb.AuthResponse, error)
+	Login(ctx context.Context, email string, password string, info SessionInfo, ac *account.Client) (*pb.LoginResponse, error)
+	RefreshToken(ctx context.Context, refreshToken string, ac *account.Client) (*pb.AuthResponse, error)
 	VerifyToken(ctx context.Context, token string, ac *account.Client) (*UserClaims, error)
 
 	Logout(ctx context.Context, userId string, ac *account.Client) error
@@ -26,6 +28,33 @@ type Service interface {
 	DeactivateAccount(ctx context.Context, userId string, ac *account.Client) (*pb.UpdateAccountResponse, error)
 	ReactivateAccount(ctx context.Context, userId string, ac *account.Client) (*pb.UpdateAccountResponse, error)
 	DeleteAccount(ctx context.Context, userId string, ac *account.Client) (*pb.UpdateAccountResponse, error)
+	UnlockAccount(ctx context.Context, email string) (*pb.UpdateAccountResponse, error)
+	GetJWKS(ctx context.Context) JWKS
+	ListSessions(ctx context.Context, userId string) ([]*Session, error)
+	RevokeSession(ctx context.Context, userId string, sessionId string) (*pb.UpdateAccountResponse, error)
+	EnrollTOTP(ctx context.Context, userId string, ac *account.Client) (*TOTPEnrollment, error)
+	ConfirmTOTP(ctx context.Context, userId string, code string, ac *account.Client) ([]string, error)
+	VerifyLoginChallenge(ctx context.Context, challengeToken string, code string, info SessionInfo, ac *account.Client) (*pb.AuthResponse, error)
+	RequestPasswordReset(ctx context.Context, email string, ac *account.Client) (*PasswordReset, error)
+	ConfirmPasswordReset(ctx context.Context, token string, newPassword string, ac *account.Client) (*pb.UpdateAccountResponse, error)
+	SendVerificationEmail(ctx context.Context, userId string, ac *account.Client) (*EmailVerification, error)
+	VerifyEmail(ctx context.Context, token string, ac *account.Client) (*pb.UpdateAccountResponse, error)
+	UpdateProfile(ctx context.Context, userId string, update account.ProfileUpdate, ac *account.Client) (*account.Account, *EmailVerification, error)
+	CreateAPIKey(ctx context.Context, userId string, name string, scopes []string, ttl time.Duration, ac *account.Client) (*APIKey, string, error)
+	ListAPIKeys(ctx context.Context) ([]*APIKey, error)
+	RotateAPIKey(ctx context.Context, userId string, id string) (*APIKey, string, error)
+	RevokeAPIKey(ctx context.Context, userId string, id string) (*pb.UpdateAccountResponse, error)
+	VerifyAPIKey(ctx context.Context, secret string, ac *account.Client) (*UserClaims, error)
+	Introspect(ctx context.Context, token string, ac *account.Client) *TokenIntrospection
+	VerifyBatch(ctx context.Context, tokens []string, ac *account.Client) ([]*TokenVerification, error)
+	InvalidateTokenVersion(userId string)
+	StartOIDCLogin(ctx context.Context, provider string) (*OIDCAuthorization, error)
+	CompleteOIDCLogin(ctx context.Context, provider string, state string, code string, info SessionInfo, ac *account.Client) (*pb.LoginResponse, error)
+	ExportAccountData(ctx context.Context, userId string, requestedBy string, ac *account.Client, oc *order.Client) (*PrivacyRequest, []byte, error)
+	RequestErasure(ctx context.Context, userId string, requestedBy string, ac *account.Client) (*PrivacyRequest, error)
+	CancelErasure(ctx context.Context, userId string, cancelledBy string) (*PrivacyRequest, error)
+	ListPrivacyRequests(ctx context.Context, userId string) ([]*PrivacyRequest, error)
+	RunErasures(ctx context.Context, ac *account.Client, oc *order.Client)
 }
 
 type User struct {
@@ -35,24 +64,110 @@ type User struct {
 	Role  string
 }
 type authService struct {
-	jwtManager    *JWTManager
-	repository    Repository
-	loggedInUsers map[string]bool
-	mu            sync.Mutex
+	jwtManager        *JWTManager
+	repository        Repository
+	sessions          SessionRepository
+	lockoutPolicy     LockoutPolicy
+	totp              TOTPConfig
+	passwordReset     PasswordResetConfig
+	emailVerification EmailVerificationConfig
+	apiKeys           APIKeyConfig
+	oidc              OIDCConfig
+	tokenVersions     *TokenVersionCache
+	privacy           PrivacyConfig
 }
 
-func NewAuthService(jwtManager *JWTManager, repository Repository) Service {
+// ServiceOptions holds the dependencies and settings of the auth service
+type ServiceOptions struct {
+	JWTManager        *JWTManager
+	Repository        Repository
+	Sessions          SessionRepository
+	LockoutPolicy     LockoutPolicy
+	TOTP              TOTPConfig
+	PasswordReset     PasswordResetConfig
+	EmailVerification EmailVerificationConfig
+	APIKeys           APIKeyConfig
+	OIDC              OIDCConfig
+	TokenVersions     *TokenVersionCache
+	Privacy           PrivacyConfig
+}
+
+func NewAuthService(opts ServiceOptions) Service {
 	Logs := logger.GetGlobalLogger()
 
 	Logs.LocalOnlyInfo("AuthService initialized")
 	return &authService{
-		jwtManager:    jwtManager,
-		repository:    repository,
-		loggedInUsers: make(map[string]bool),
+		jwtManager:        opts.JWTManager,
+		repository:        opts.Repository,
+		sessions:          opts.Sessions,
+		lockoutPolicy:     opts.LockoutPolicy,
+		totp:              opts.TOTP,
+		passwordReset:     opts.PasswordReset,
+		emailVerification: opts.EmailVerification,
+		apiKeys:           opts.APIKeys,
+		oidc:              opts.OIDC,
+		tokenVersions:     opts.TokenVersions,
+		privacy:           opts.Privacy,
 	}
 }
 
-func (s *authService) Signup(ctx context.Context, name string, email string, password string, role string, ac *account.Client) (*pb.AuthResponse, error) {
+// startSession opens a new session with its own refresh token family and issues the
+// first access and refresh token for it
+func (s *authService) startSession(ctx context.Context, ac *account.Client, userId string, email string, role string, tokenVersion int32, info SessionInfo) (string, string, error) {
+	Logs := logger.GetGlobalLogger()
+
+	sessionID := ksuid.New().String()
+	familyID := ksuid.New().String()
+
+	// Step 1: Generate Access Token, it carries the permissions of the role
+	permissions, err := ac.GetRolePermissions(ctx, role)
+	if err != nil {
+		Logs.Error(ctx, "Failed to fetch role permissions: "+err.Error())
+		return "", "", err
+	}
+	accessToken, err := s.jwtManager.GenerateAccessToken(userId, email, role, permissions, tokenVersion, sessionID)
+	if err != nil {
+		Logs.Error(ctx, "Failed to generate access token: "+err.Error())
+		return "", "", err
+	}
+
+	// Step 2: Generate Refresh Token
+	refreshToken, expiresAt, err := s.jwtManager.GenerateRefreshToken(userId, email, role, tokenVersion, sessionID, familyID)
+	if err != nil {
+		Logs.Error(ctx, "Failed to generate refresh token: "+err.Error())
+		return "", "", err
+	}
+
+	// Step 3: Store Refresh Token in DB
+	if err := s.repository.StoreRefreshToken(ctx, refreshToken, userId, familyID, expiresAt); err != nil {
+		Logs.Error(ctx, "Failed to store refresh token: "+err.Error())
+		return "", "", err
+	}
+	Logs.Info(ctx, "Refresh token stored successfully for user: "+email)
+	Logs.LocalOnlyInfo("Refresh token stored successfully for user: " + email)
+
+	// Step 4: Record the session so it shows up in the user's device list
+	now := time.Now()
+	session := &Session{
+		ID:         sessionID,
+		UserID:     userId,
+		FamilyID:   familyID,
+		Device:     info.Device,
+		IPAddress:  info.IPAddress,
+		UserAgent:  info.UserAgent,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  expiresAt,
+	}
+	if err := s.sessions.CreateSession(ctx, session); err != nil {
+		Logs.Error(ctx, "Failed to create session: "+err.Error())
+		return "", "", err
+	}
+
+	return accessToken, refreshToken, nil
+}
+
+func (s *authService) Signup(ctx context.Context, name string, email string, password string, role string, info SessionInfo, ac *account.Client) (*pb.AuthResponse, error) {
 
 	Logs := logger.GetGlobalLogger()
 
@@ -69,36 +184,15 @@ func (s *authService) Signup(ctx context.Context, name string, email string, pas
 		return nil, errors.New("failed to create account")
 	}
 
-	// Step 2: Generate Access Token
-	accessToken, err := s.jwtManager.GenerateAccessToken(account.ID, account.Email, account.Role, account.TokenVersion)
+	// Step 2: Open a session and issue its tokens
+	accessToken, refreshToken, err := s.startSession(ctx, ac, account.ID, account.Email, account.Role, account.TokenVersion, info)
 	if err != nil {
-		Logs.Error(ctx, "Failed to generate access token: "+err.Error())
 		return nil, err
 	}
 
-	// Step 3: Generate Refresh Token
-	refreshToken, err := s.jwtManager.GenerateRefreshToken(account.ID, account.Email, account.Role, account.TokenVersion)
-	if err != nil {
-		Logs.Error(ctx, "Failed to generate refresh token: "+err.Error())
-		return nil, err
-	}
-
-	// Step 5: Store Refresh Token in DB
-	if err := s.repository.StoreRefreshToken(ctx, refreshToken, account.ID); err != nil {
-		Logs.Error(ctx, "Failed to store refresh token: "+err.Error())
-		return nil, err
-	}
-	Logs.Info(ctx, "Refresh token stored successfully for user: "+email)
-	Logs.LocalOnlyInfo("Refresh token stored successfully for user: " + email)
-
 	Logs.Info(ctx, "Signup successful for user: "+account.Email)
 	Logs.LocalOnlyInfo("Signup successful for user: " + account.Email)
 
-	//add user to loggedInUser map to track it later
-	s.mu.Lock()
-	s.loggedInUsers[account.ID] = true
-	s.mu.Unlock()
-
 	return &pb.AuthResponse{
 		AccessToken:  accessToken,
 		RefreshToken: refreshToken,
@@ -108,108 +202,131 @@ func (s *authService) Signup(ctx context.Context, name string, email string, pas
 	}, nil
 }
 
-func (s *authService) Login(ctx context.Context, email string, password string, ac *account.Client) (*pb.AuthResponse, error) {
+func (s *authService) Login(ctx context.Context, email string, password string, info SessionInfo, ac *account.Client) (*pb.LoginResponse, error) {
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("Login called for email: " + email)
 
-	if _, ok := s.loggedInUsers[email]; ok {
-		Logs.Error(ctx, "User already logged in")
-		return nil, errors.New("user already logged in")
+	clientIP := info.IPAddress
+
+	// Step 1: Refuse early if the email or client IP is locked out
+	if err := s.checkLockout(ctx, email, clientIP); err != nil {
+		return nil, err
 	}
 
-	// Step 1: Call AccountService to validate user
+	// Step 2: Call AccountService to validate user
 	account, err := ac.GetEmailForAuth(ctx, email)
 	if err != nil {
 		Logs.Error(ctx, "Account validation failed: "+err.Error())
-		return nil, errors.New("failed to validate account")
+		s.registerFailedLogin(ctx, email, clientIP)
+		return nil, errInvalidCredentials
 	}
 
-	// Step 2: Check if account is active
+	// Step 3: Verify the password against the stored bcrypt hash
+	if !s.jwtManager.ValidatePassword(password, account.PasswordHash) {
+		Logs.Warn(ctx, "Invalid password for email: "+email+" from ip: "+clientIP)
+		s.registerFailedLogin(ctx, email, clientIP)
+		return nil, errInvalidCredentials
+	}
+
+	// Step 4: Check if account is active
 	if !account.IsActive {
 		Logs.Error(ctx, "Account is not active")
 		return nil, errors.New("account is not active")
 	}
 
-	// Step 4: Generate Access Token
-	accessToken, err := s.jwtManager.GenerateAccessToken(account.ID, account.Email, account.Role, account.TokenVersion)
+	// Step 5: With two-factor login the password only earns a challenge. The failure counter
+	// is left alone until the second factor is verified so codes cannot be brute forced
+	if account.TOTPEnabled {
+		Logs.Info(ctx, "Password accepted, waiting for second factor for user: "+email)
+		return s.loginChallenge(ctx, account)
+	}
+	s.registerSuccessfulLogin(ctx, email, clientIP)
+
+	// Step 6: Open a session and issue its tokens
+	authResponse, err := s.completeLogin(ctx, account, info, ac)
 	if err != nil {
-		Logs.Error(ctx, "Failed to generate access token: "+err.Error())
 		return nil, err
 	}
+	return &pb.LoginResponse{Auth: authResponse}, nil
+}
 
-	// Step 5: Generate Refresh Token
-	refreshToken, err := s.jwtManager.GenerateRefreshToken(account.ID, account.Email, account.Role, account.TokenVersion)
+// loginChallenge asks for the second factor of an account with two-factor login
+func (s *authService) loginChallenge(ctx context.Context, acc *account.Account) (*pb.LoginResponse, error) {
+	Logs := logger.GetGlobalLogger()
+
+	challengeToken, expiresAt, err := s.jwtManager.GenerateChallengeToken(acc.ID, acc.Email, acc.Role, acc.TokenVersion)
 	if err != nil {
-		Logs.Error(ctx, "Failed to generate refresh token: "+err.Error())
+		Logs.Error(ctx, "Failed to generate challenge token: "+err.Error())
 		return nil, err
 	}
+	return &pb.LoginResponse{
+		ChallengeToken:     challengeToken,
+		ChallengeExpiresAt: timestamppb.New(expiresAt),
+	}, nil
+}
 
-	// Step 6: Store Refresh Token in DB
-	if err := s.repository.StoreRefreshToken(ctx, refreshToken, account.ID); err != nil {
-		Logs.Error(ctx, "Failed to store refresh token: "+err.Error())
+// completeLogin opens the session once every factor has been verified
+func (s *authService) completeLogin(ctx context.Context, acc *account.Account, info SessionInfo, ac *account.Client) (*pb.AuthResponse, error) {
+	Logs := logger.GetGlobalLogger()
+
+	// Step 1: Logging in again from a device that already has a session replaces that session
+	s.replaceDeviceSession(ctx, acc.ID, info)
+
+	// Step 2: Open a session and issue its tokens
+	accessToken, refreshToken, err := s.startSession(ctx, ac, acc.ID, acc.Email, acc.Role, acc.TokenVersion, info)
+	if err != nil {
 		return nil, err
 	}
-	Logs.Info(ctx, "Refresh token stored successfully for user: "+email)
-	Logs.LocalOnlyInfo("Refresh token stored successfully for user: " + email)
-
-	Logs.Info(ctx, "Login successful for user: "+email)
-	Logs.LocalOnlyInfo("Login successful for user: " + email)
 
-	//add user to loggedInUser map to track it later
-	s.mu.Lock()
-	s.loggedInUsers[account.ID] = true
-	s.mu.Unlock()
+	Logs.Info(ctx, "Login successful for user: "+acc.Email)
+	Logs.LocalOnlyInfo("Login successful for user: " + acc.Email)
 
 	return &pb.AuthResponse{
 		AccessToken:  accessToken,
 		RefreshToken: refreshToken,
-		UserId:       account.ID,
-		Email:        account.Email,
-		Role:         account.Role,
+		UserId:       acc.ID,
+		Email:        acc.Email,
+		Role:         acc.Role,
 	}, nil
 }
 
-func (s *authService) RefreshToken(ctx context.Context, userId string) (*pb.AuthResponse, error) {
+func (s *authService) RefreshToken(ctx context.Context, refreshToken string, ac *account.Client) (*pb.AuthResponse, error) {
 
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("RefreshToken called")
 
-	// Step 1: Get refresh token from DB using userId
-	tokenData, err := s.repository.GetRefreshToken(ctx, userId)
+	// Step 1: Parse and validate refresh token
+	claims, err := s.jwtManager.VerifyRefreshToken(refreshToken)
 	if err != nil {
-		Logs.Error(ctx, "Failed to get refresh token: "+err.Error())
-		return nil, errors.New("failed to get refresh token")
+		Logs.Error(ctx, "Invalid or expired refresh token: "+err.Error())
+		return nil, errors.New("invalid or expired refresh token")
 	}
 
-	// Step 2: Check expiration from DB
-	if time.Now().After(tokenData.ExpiresAt) {
-		Logs.Error(ctx, "Refresh token has expired")
-		return nil, errors.New("refresh token expired, please login again")
+	// Step 2: Look the token up in DB, it is gone after logout or password reset
+	tokenData, err := s.repository.GetRefreshToken(ctx, refreshToken)
+	if err != nil {
+		Logs.Error(ctx, "Failed to get refresh token: "+err.Error())
+		return nil, errors.New("invalid or expired refresh token")
 	}
 
-	// Step 3: Parse and validate refresh token
-	token, err := jwt.Parse(tokenData.RefreshToken, func(token *jwt.Token) (interface{}, error) {
-		// Make sure it's signed with the expected method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.New("unexpected signing method")
-		}
-		return []byte(s.jwtManager.refreshSecret), nil
-	})
-	if err != nil || !token.Valid {
-		Logs.Error(ctx, "Invalid or expired refresh token: "+err.Error())
-		return nil, errors.New("invalid or expired refresh token")
+	// Step 3: Reject revoked families and detect reuse of an already rotated token
+	if !tokenData.RevokedAt.IsZero() {
+		Logs.Warn(ctx, "Refresh token from revoked family "+tokenData.FamilyID+" presented for user: "+tokenData.UserID)
+		return nil, errors.New("refresh token revoked, please login again")
+	}
+	if !tokenData.RotatedAt.IsZero() {
+		s.revokeReusedFamily(ctx, tokenData)
+		return nil, errors.New("refresh token revoked, please login again")
 	}
 
-	// Step 4: Extract claims
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		Logs.Error(ctx, "Failed to parse token claims")
-		return nil, errors.New("invalid token claims")
+	// Step 4: Check expiration from DB
+	if time.Now().After(tokenData.ExpiresAt) {
+		Logs.Error(ctx, "Refresh token has expired")
+		return nil, errors.New("refresh token expired, please login again")
 	}
 
+	// Step 5: Extract claims
 	sub, ok1 := claims["sub"].(string)
-	email, ok2 := claims["email"].(string)
-	role, ok3 := claims["role"].(string)
 
 	//numbers are float32 by default
 	tokenVersionFloat, ok4 := claims["token_version"].(float64)
@@ -219,34 +336,82 @@ func (s *authService) RefreshToken(ctx context.Context, userId string) (*pb.Auth
 	}
 	tokenVersion := int32(tokenVersionFloat) // convert safely
 
-	if !ok1 || !ok2 || !ok3 || !ok4 {
+	sessionID, ok5 := claims["sid"].(string)
+
+	if !ok1 || !ok4 || !ok5 || sub != tokenData.UserID {
 		Logs.Error(ctx, "Invalid claim format")
 		return nil, errors.New("invalid token claims")
 	}
 
-	// Step 5: Generate new access token
-	accessToken, err := s.jwtManager.GenerateAccessToken(sub, email, role, tokenVersion)
+	// Step 6: Load the account, the claims only tell who it was when the token was issued. The
+	// new tokens carry its current email and role, and only a current token version refreshes
+	acc, err := ac.GetAccount(ctx, sub)
+	if err != nil {
+		Logs.Error(ctx, "Failed to fetch account for refresh token: "+err.Error())
+		return nil, errors.New("invalid or expired refresh token")
+	}
+	if !acc.IsActive {
+		Logs.Warn(ctx, "Refresh token presented for inactive account: "+sub)
+		return nil, errors.New("account is not active")
+	}
+	currentVersion, err := s.tokenVersions.Lookup(sub, func() (int32, error) {
+		account, err := ac.GetEmailForAuth(ctx, acc.Email)
+		if err != nil {
+			return 0, err
+		}
+		if account.ID != sub {
+			return 0, errors.New("account was deleted")
+		}
+		return account.TokenVersion, nil
+	})
+	if err != nil {
+		Logs.Error(ctx, "Failed to fetch token version for refresh token: "+err.Error())
+		return nil, errors.New("invalid or expired refresh token")
+	}
+	if tokenVersion != currentVersion {
+		Logs.Warn(ctx, "Refresh token version mismatch for user: "+sub)
+		return nil, errors.New("refresh token revoked, please login again")
+	}
+	email, role := acc.Email, acc.Role
+
+	// Step 7: Generate new access token, permissions are looked up again so changes to the role apply
+	permissions, err := ac.GetRolePermissions(ctx, role)
+	if err != nil {
+		Logs.Error(ctx, "Failed to fetch role permissions: "+err.Error())
+		return nil, err
+	}
+	accessToken, err := s.jwtManager.GenerateAccessToken(sub, email, role, permissions, tokenVersion, sessionID)
 	if err != nil {
 		Logs.Error(ctx, "Failed to generate new access token: "+err.Error())
 		return nil, err
 	}
 
-	// Step 6: Generate new refresh token (rotation)
-	newRefreshToken, err := s.jwtManager.GenerateRefreshToken(sub, email, role, tokenVersion)
+	// Step 8: Generate new refresh token in the same family (rotation)
+	newRefreshToken, expiresAt, err := s.jwtManager.GenerateRefreshToken(sub, email, role, tokenVersion, sessionID, tokenData.FamilyID)
 	if err != nil {
 		Logs.Error(ctx, "Failed to rotate refresh token: "+err.Error())
 		return nil, err
 	}
 
-	// Step 7: Store new refresh token in DB
-	if err := s.repository.StoreRefreshToken(ctx, newRefreshToken, sub); err != nil {
+	// Step 9: Mark the old token as used and store the new one
+	if err := s.repository.RotateRefreshToken(ctx, refreshToken, newRefreshToken, expiresAt); err != nil {
+		if errors.Is(err, errRefreshTokenReused) {
+			// another request rotated the same token first
+			s.revokeReusedFamily(ctx, tokenData)
+			return nil, errors.New("refresh token revoked, please login again")
+		}
 		Logs.Error(ctx, "Failed to store new refresh token: "+err.Error())
 		return nil, err
 	}
 
+	// Step 10: Keep the session alive as long as its newest refresh token
+	if err := s.sessions.TouchSession(ctx, sessionID, expiresAt); err != nil {
+		Logs.Error(ctx, "Failed to update session: "+err.Error())
+	}
+
 	Logs.Info(ctx, "Refresh token rotated successfully for user: "+email)
 
-	// Step 8: Return tokens
+	// Step 11: Return tokens
 	return &pb.AuthResponse{
 		AccessToken:  accessToken,
 		RefreshToken: newRefreshToken,
@@ -256,13 +421,72 @@ func (s *authService) RefreshToken(ctx context.Context, userId string) (*pb.Auth
 	}, nil
 }
 
+// revokeReusedFamily handles a rotated refresh token being presented again. Either the
+// legitimate client or an attacker holds a stolen copy, so every token of the family is revoked
+func (s *authService) revokeReusedFamily(ctx context.Context, tokenData *TokenData) {
+	Logs := logger.GetGlobalLogger()
+	Logs.Warn(ctx, "SECURITY: refresh token reuse detected for user "+tokenData.UserID+", revoking token family "+tokenData.FamilyID)
+
+	if err := s.repository.RevokeTokenFamily(ctx, tokenData.FamilyID); err != nil {
+		Logs.Error(ctx, "Failed to revoke token family: "+err.Error())
+	}
+	if err := s.sessions.RevokeSessionByFamily(ctx, tokenData.FamilyID); err != nil {
+		Logs.Error(ctx, "Failed to revoke session: "+err.Error())
+	}
+	if err := s.repository.RecordSecurityEvent(ctx, tokenData.UserID, "refresh_token_reuse", "token family "+tokenData.FamilyID+" revoked"); err != nil {
+		Logs.Error(ctx, "Failed to record security event: "+err.Error())
+	}
+}
+
+// replaceDeviceSession revokes the active session of the same device, if any, so logging in
+// twice from one browser does not pile up sessions. Logins that do not identify their device
+// never replace anything
+func (s *authService) replaceDeviceSession(ctx context.Context, userId string, info SessionInfo) {
+	Logs := logger.GetGlobalLogger()
+
+	if info.Device == "" && info.UserAgent == "" {
+		return
+	}
+
+	sessions, err := s.sessions.ListUserSessions(ctx, userId)
+	if err != nil {
+		Logs.Error(ctx, "Failed to list sessions: "+err.Error())
+		return
+	}
+
+	for _, session := range sessions {
+		if session.Device != info.Device || session.UserAgent != info.UserAgent {
+			continue
+		}
+		Logs.Info(ctx, "User already logged in on this device, replacing session: "+session.ID)
+		if err := s.revokeSession(ctx, session); err != nil {
+			Logs.Error(ctx, "Failed to replace session: "+err.Error())
+		}
+	}
+}
+
+// revokeSession ends a session and its refresh token family
+func (s *authService) revokeSession(ctx context.Context, session *Session) error {
+	if err := s.sessions.RevokeSession(ctx, session.ID); err != nil {
+		return err
+	}
+	return s.repository.RevokeTokenFamily(ctx, session.FamilyID)
+}
+
 func (s *authService) VerifyToken(ctx context.Context, token string, ac *account.Client) (*UserClaims, error) {
+	userClaims, _, err := s.verifyAccessToken(ctx, token, ac)
+	return userClaims, err
+}
+
+// verifyAccessToken checks the token, its session and its token_version and also returns the raw
+// claims for callers that need more than the user, such as Introspect
+func (s *authService) verifyAccessToken(ctx context.Context, token string, ac *account.Client) (*UserClaims, jwt.MapClaims, error) {
 	Logs := logger.GetGlobalLogger()
 	// Step 1: Verify token
 	claims, err := s.jwtManager.VerifyAccessToken(token)
 	if err != nil {
 		Logs.Error(ctx, "Failed to verify token in service: "+err.Error())
-		return nil, err
+		return nil, nil, err
 	}
 
 	sub, ok := claims["sub"].(string)
@@ -271,34 +495,55 @@ func (s *authService) VerifyToken(ctx context.Context, token string, ac *account
 	tokenVersionFloat, ok4 := claims["token_version"].(float64)
 	log.Printf("tokenVersionFloat: %f", tokenVersionFloat)
 
-	if !ok || !ok2 || !ok3 || !ok4 {
-		return nil, errors.New("invalid token claims")
+	sessionID, ok5 := claims["sid"].(string)
+
+	if !ok || !ok2 || !ok3 || !ok4 || !ok5 {
+		return nil, nil, errors.New("invalid token claims")
 	}
 	tokenVersion := int32(tokenVersionFloat)
 
-	// Step 2: Get latest account info from DB
-	account, err := ac.GetEmailForAuth(ctx, email) // or use userID if you have it
+	// Step 2: Make sure the session was not revoked from another device
+	session, err := s.sessions.GetSession(ctx, sessionID)
+	if err != nil || !session.Active() {
+		Logs.Error(ctx, "Session "+sessionID+" is no longer active")
+		return nil, nil, errors.New("session revoked or expired, please login again")
+	}
+
+	// Step 3: Get the current token version, the account service is only asked on a cache miss
+	currentVersion, err := s.tokenVersions.Lookup(sub, func() (int32, error) {
+		account, err := ac.GetEmailForAuth(ctx, email)
+		if err != nil {
+			return 0, err
+		}
+		if account.ID != sub {
+			return 0, errors.New("account was deleted")
+		}
+		return account.TokenVersion, nil
+	})
 	if err != nil {
 		Logs.Error(ctx, "Failed to fetch account for token verification, account does not exist: "+err.Error())
-		return nil, err
+		return nil, nil, err
 	}
 
 	log.Printf("tokenVersion: %d", tokenVersion)
-	log.Printf("account.TokenVersion: %d", account.TokenVersion)
-	// Step 3: Compare token versions
-	if tokenVersion != account.TokenVersion {
+	log.Printf("account.TokenVersion: %d", currentVersion)
+	// Step 4: Compare token versions
+	if tokenVersion != currentVersion {
 		Logs.Error(ctx, "Token version mismatch - user logged out, please login again")
-		return nil, errors.New("token invalid or expired, please login again")
+		return nil, nil, errors.New("token invalid or expired, please login again")
 	}
 
 	Logs.Info(ctx, "User verified in service: "+sub+" | email = "+email+" | role = "+role)
 	Logs.LocalOnlyInfo("User verified in service: " + sub + " | email = " + email + " | role = " + role)
 
 	return &UserClaims{
-		ID:    sub,
-		Email: email,
-		Role:  role,
-	}, nil
+		ID:           sub,
+		Email:        email,
+		Role:         role,
+		TokenVersion: tokenVersion,
+		SessionID:    sessionID,
+		Permissions:  permissionsFromClaims(claims),
+	}, claims, nil
 }
 
 func (s *authService) Logout(ctx context.Context, userId string, ac *account.Client) error {
@@ -318,18 +563,25 @@ func (s *authService) Logout(ctx context.Context, userId string, ac *account.Cli
 			Logs.Error(ctx, "Failed to increment token version: "+err.Error())
 			return err
 		}
+		s.tokenVersions.Invalidate(userId)
 
-		// Step 3: Remove from cache
-		s.mu.Lock()
-		delete(s.loggedInUsers, userId)
-		s.mu.Unlock()
+		// Step 3: End every session of the user
+		if err := s.sessions.RevokeUserSessions(ctx, userId); err != nil {
+			Logs.Error(ctx, "Failed to revoke sessions: "+err.Error())
+			return err
+		}
 
 		Logs.Info(ctx, "User logged out successfully: "+userId)
 		return nil
 	}
 
 	Logs.Info(ctx, "Global logout initiated")
-	for userId := range s.loggedInUsers {
+	userIds, err := s.sessions.ListActiveUserIDs(ctx)
+	if err != nil {
+		Logs.Error(ctx, "Failed to list logged in users: "+err.Error())
+		return err
+	}
+	for _, userId := range userIds {
 		Logs.LocalOnlyInfo("Logout called for user: " + userId)
 
 		// Step 1: Delete all refresh tokens
@@ -343,14 +595,16 @@ func (s *authService) Logout(ctx context.Context, userId string, ac *account.Cli
 			Logs.Error(ctx, "Failed to increment token version: "+err.Error())
 			return err
 		}
+		s.tokenVersions.Invalidate(userId)
 
 		Logs.Info(ctx, "User logged out successfully: "+userId)
 
 	}
-	// Clear the entire map after logout
-	s.mu.Lock()
-	s.loggedInUsers = make(map[string]bool)
-	s.mu.Unlock()
+	// End every session after logout
+	if err := s.sessions.RevokeAllSessions(ctx); err != nil {
+		Logs.Error(ctx, "Failed to revoke sessions: "+err.Error())
+		return err
+	}
 
 	Logs.Info(ctx, "All users logged out successfully")
 
@@ -361,10 +615,16 @@ func (s *authService) GetCurrentUsers(ctx context.Context, ac *account.Client, s
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("CurrentUsers called")
 
+	userIds, err := s.sessions.ListActiveUserIDs(ctx)
+	if err != nil {
+		Logs.Error(ctx, "Failed to list logged in users: "+err.Error())
+		return nil, err
+	}
+
 	var users []*User
 	var count uint64 = 0
 
-	for userId := range s.loggedInUsers {
+	for _, userId := range userIds {
 		// Apply pagination skipping
 		if count < skip {
 			count++
@@ -401,62 +661,48 @@ func (s *authService) ResetPasswordForAccount(ctx context.Context, email string,
 	Logs := logger.GetGlobalLogger()
 	Logs.Info(ctx, "ResetPasswordForAccount called for email: "+email)
 
-	// Step 1: Call AccountService to create user (password will be hashed there)
+	// Step 1: Call AccountService to update the password (it will be hashed there)
 	err := ac.UpdatePassword(ctx, email, password)
 	if err != nil {
 		Logs.Error(ctx, "Password reset failed: "+err.Error())
 		return nil, err
 	}
 
-	// Step 1: Delete all refresh tokens
+	// Step 2: Delete all refresh tokens
 	if err := s.repository.DeleteRefreshToken(ctx, userId); err != nil {
 		Logs.Error(ctx, "Failed to delete refresh token: "+err.Error())
 		return nil, err
 	}
 
-	// Step 2: Increment token version to invalidate tokens
+	// Step 3: End every other session of the user
+	if err := s.sessions.RevokeUserSessions(ctx, userId); err != nil {
+		Logs.Error(ctx, "Failed to revoke sessions: "+err.Error())
+		return nil, err
+	}
+
+	// Step 4: Increment token version to invalidate tokens
 	if err := ac.IncrementTokenVersion(ctx, userId); err != nil {
 		Logs.Error(ctx, "Failed to increment token version: "+err.Error())
 		return nil, err
 	}
+	s.tokenVersions.Invalidate(userId)
 
-	// Step 2: Get latest account info from DB
+	// Step 5: Get latest account info from DB
 	account, err := ac.GetEmailForAuth(ctx, email)
 	if err != nil {
 		Logs.Error(ctx, "Failed to fetch account for auth: "+err.Error())
 		return nil, err
 	}
 
-	// Step 2: Generate Access Token
-	accessToken, err := s.jwtManager.GenerateAccessToken(account.ID, account.Email, account.Role, account.TokenVersion)
+	// Step 6: Open a session and issue its tokens
+	accessToken, refreshToken, err := s.startSession(ctx, ac, account.ID, account.Email, account.Role, account.TokenVersion, SessionInfo{})
 	if err != nil {
-		Logs.Error(ctx, "Failed to generate access token: "+err.Error())
 		return nil, err
 	}
 
-	// Step 3: Generate Refresh Token
-	refreshToken, err := s.jwtManager.GenerateRefreshToken(account.ID, account.Email, account.Role, account.TokenVersion)
-	if err != nil {
-		Logs.Error(ctx, "Failed to generate refresh token: "+err.Error())
-		return nil, err
-	}
-
-	// Step 5: Store Refresh Token in DB
-	if err := s.repository.StoreRefreshToken(ctx, refreshToken, account.ID); err != nil {
-		Logs.Error(ctx, "Failed to store refresh token: "+err.Error())
-		return nil, err
-	}
-	Logs.Info(ctx, "Refresh token stored successfully for user: "+email)
-	Logs.LocalOnlyInfo("Refresh token stored successfully for user: " + email)
-
 	Logs.Info(ctx, "Password reset successful for user: "+account.Email)
 	Logs.LocalOnlyInfo("Password reset successful for user: " + account.Email)
 
-	//add user to loggedInUser map to track it later
-	s.mu.Lock()
-	s.loggedInUsers[account.ID] = true
-	s.mu.Unlock()
-
 	return &pb.AuthResponse{
 		AccessToken:  accessToken,
 		RefreshToken: refreshToken,
@@ -499,6 +745,7 @@ func (s *authService) DeleteAccount(ctx context.Context, userId string, ac *acco
 		Logs.Error(ctx, "Failed to delete account: "+err.Error())
 		return nil, err
 	}
+	s.tokenVersions.Invalidate(userId)
 
 	// Step 1: Delete all refresh tokens
 	if err := s.repository.DeleteRefreshToken(ctx, userId); err != nil {
@@ -506,10 +753,69 @@ func (s *authService) DeleteAccount(ctx context.Context, userId string, ac *acco
 		return nil, err
 	}
 
-	// Step 2: Remove from cache
-	s.mu.Lock()
-	delete(s.loggedInUsers, userId)
-	s.mu.Unlock()
+	// Step 2: End every session of the user
+	if err := s.sessions.RevokeUserSessions(ctx, userId); err != nil {
+		Logs.Error(ctx, "Failed to revoke sessions: "+err.Error())
+		return nil, err
+	}
+
+	// Step 3: A pending erasure can no longer run without the account
+	if request, err := s.repository.CancelErasure(ctx, userId); err == nil {
+		_ = s.recordPrivacyStep(ctx, request, "cancelled", nil, "account deleted")
+	} else if !errors.Is(err, errErasureNotPending) {
+		Logs.Error(ctx, "Failed to cancel pending erasure: "+err.Error())
+	}
 
 	return &pb.UpdateAccountResponse{Message: "Account deleted successfully"}, nil
 }
+
+func (s *authService) UnlockAccount(ctx context.Context, email string) (*pb.UpdateAccountResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.Info(ctx, "Unlocking account for email: "+email)
+
+	if err := s.repository.ClearLockout(ctx, LockoutSubjectEmail, email); err != nil {
+		Logs.Error(ctx, "Failed to unlock account: "+err.Error())
+		return nil, err
+	}
+
+	return &pb.UpdateAccountResponse{Message: "Account unlocked successfully"}, nil
+}
+
+func (s *authService) GetJWKS(ctx context.Context) JWKS {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("GetJWKS called")
+
+	return s.jwtManager.JWKS()
+}
+
+func (s *authService) ListSessions(ctx context.Context, userId string) ([]*Session, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("ListSessions called for user: " + userId)
+
+	sessions, err := s.sessions.ListUserSessions(ctx, userId)
+	if err != nil {
+		Logs.Error(ctx, "Failed to list sessions: "+err.Error())
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (s *authService) RevokeSession(ctx context.Context, userId string, sessionId string) (*pb.UpdateAccountResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.Info(ctx, "Revoking session "+sessionId+" for user: "+userId)
+
+	// Step 1: Users can only revoke their own sessions
+	session, err := s.sessions.GetSession(ctx, sessionId)
+	if err != nil || session.UserID != userId {
+		Logs.Error(ctx, "Session "+sessionId+" not found for user: "+userId)
+		return nil, errSessionNotFound
+	}
+
+	// Step 2: End the session and its refresh token family
+	if err := s.revokeSession(ctx, session); err != nil {
+		Logs.Error(ctx, "Failed to revoke session: "+err.Error())
+		return nil, err
+	}
+
+	return &pb.UpdateAccountResponse{Message: "Session revoked successfully"}, nil
+}
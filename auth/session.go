@@ -0,0 +1,217 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/zenvisjr/building-scalable-microservices/logger"
+)
+
+// Session is one logged in device. It lives as long as its refresh token family
+type Session struct {
+	ID         string
+	UserID     string
+	FamilyID   string
+	Device     string
+	IPAddress  string
+	UserAgent  string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+	RevokedAt  time.Time // zero while the session is active
+}
+
+// SessionInfo describes the client a session is created for
+type SessionInfo struct {
+	Device    string
+	IPAddress string
+	UserAgent string
+}
+
+func (s *Session) Active() bool {
+	return s.RevokedAt.IsZero() && time.Now().Before(s.ExpiresAt)
+}
+
+var errSessionNotFound = errors.New("session not found")
+
+type SessionRepository interface {
+	CreateSession(ctx context.Context, session *Session) error
+	GetSession(ctx context.Context, sessionId string) (*Session, error)
+	ListUserSessions(ctx context.Context, userId string) ([]*Session, error)
+	ListActiveUserIDs(ctx context.Context) ([]string, error)
+	TouchSession(ctx context.Context, sessionId string, expiresAt time.Time) error
+	RevokeSession(ctx context.Context, sessionId string) error
+	RevokeSessionByFamily(ctx context.Context, familyId string) error
+	RevokeUserSessions(ctx context.Context, userId string) error
+	RevokeAllSessions(ctx context.Context) error
+	ListUserSessionHistory(ctx context.Context, userId string) ([]*Session, error)
+	DeleteUserSessions(ctx context.Context, userId string) error
+	Close()
+}
+
+type postgresSessionRepository struct {
+	db *sql.DB
+}
+
+func NewPostgresSessionRepository(url string) (SessionRepository, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Opening sessions PostgreSQL connection")
+
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		Logs.Error(context.Background(), "Failed to open DB: "+err.Error())
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
+		Logs.Error(context.Background(), "Failed to ping DB: "+err.Error())
+		return nil, err
+	}
+
+	Logs.Info(context.Background(), "Successfully connected to sessions PostgreSQL")
+	return &postgresSessionRepository{db: db}, nil
+}
+
+func (r *postgresSessionRepository) Close() {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Closing sessions DB connection")
+	r.db.Close()
+}
+
+const sessionColumns = `id, user_id, family_id, device, ip_address, user_agent, created_at, last_seen_at, expires_at, revoked_at`
+
+func scanSession(row interface{ Scan(...interface{}) error }) (*Session, error) {
+	s := &Session{}
+	var revokedAt sql.NullTime
+	if err := row.Scan(&s.ID, &s.UserID, &s.FamilyID, &s.Device, &s.IPAddress, &s.UserAgent, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt, &revokedAt); err != nil {
+		return nil, err
+	}
+	s.RevokedAt = revokedAt.Time
+	return s, nil
+}
+
+func (r *postgresSessionRepository) CreateSession(ctx context.Context, session *Session) error {
+	query := `
+		INSERT INTO sessions (id, user_id, family_id, device, ip_address, user_agent, created_at, last_seen_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`
+	_, err := r.db.ExecContext(ctx, query, session.ID, session.UserID, session.FamilyID, session.Device, session.IPAddress,
+		session.UserAgent, session.CreatedAt, session.LastSeenAt, session.ExpiresAt)
+	return err
+}
+
+func (r *postgresSessionRepository) GetSession(ctx context.Context, sessionId string) (*Session, error) {
+	query := `SELECT ` + sessionColumns + ` FROM sessions WHERE id = $1`
+	session, err := scanSession(r.db.QueryRowContext(ctx, query, sessionId))
+	if err == sql.ErrNoRows {
+		return nil, errSessionNotFound
+	}
+	return session, err
+}
+
+func (r *postgresSessionRepository) ListUserSessions(ctx context.Context, userId string) ([]*Session, error) {
+	query := `
+		SELECT ` + sessionColumns + `
+		FROM sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > NOW()
+		ORDER BY last_seen_at DESC
+	`
+	rows, err := r.db.QueryContext(ctx, query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (r *postgresSessionRepository) ListActiveUserIDs(ctx context.Context) ([]string, error) {
+	query := `
+		SELECT user_id
+		FROM sessions
+		WHERE revoked_at IS NULL AND expires_at > NOW()
+		GROUP BY user_id
+		ORDER BY MIN(created_at)
+	`
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	userIds := []string{}
+	for rows.Next() {
+		var userId string
+		if err := rows.Scan(&userId); err != nil {
+			return nil, err
+		}
+		userIds = append(userIds, userId)
+	}
+	return userIds, rows.Err()
+}
+
+func (r *postgresSessionRepository) TouchSession(ctx context.Context, sessionId string, expiresAt time.Time) error {
+	query := `UPDATE sessions SET last_seen_at = NOW(), expires_at = $2 WHERE id = $1 AND revoked_at IS NULL`
+	_, err := r.db.ExecContext(ctx, query, sessionId, expiresAt)
+	return err
+}
+
+func (r *postgresSessionRepository) RevokeSession(ctx context.Context, sessionId string) error {
+	query := `UPDATE sessions SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL`
+	_, err := r.db.ExecContext(ctx, query, sessionId)
+	return err
+}
+
+func (r *postgresSessionRepository) RevokeSessionByFamily(ctx context.Context, familyId string) error {
+	query := `UPDATE sessions SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL`
+	_, err := r.db.ExecContext(ctx, query, familyId)
+	return err
+}
+
+func (r *postgresSessionRepository) RevokeUserSessions(ctx context.Context, userId string) error {
+	query := `UPDATE sessions SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL`
+	_, err := r.db.ExecContext(ctx, query, userId)
+	return err
+}
+
+func (r *postgresSessionRepository) RevokeAllSessions(ctx context.Context) error {
+	query := `UPDATE sessions SET revoked_at = NOW() WHERE revoked_at IS NULL`
+	_, err := r.db.ExecContext(ctx, query)
+	return err
+}
+
+// ListUserSessionHistory returns every session of the user including revoked and expired ones,
+// newest first
+func (r *postgresSessionRepository) ListUserSessionHistory(ctx context.Context, userId string) ([]*Session, error) {
+	query := `SELECT ` + sessionColumns + ` FROM sessions WHERE user_id = $1 ORDER BY created_at DESC`
+	rows, err := r.db.QueryContext(ctx, query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (r *postgresSessionRepository) DeleteUserSessions(ctx context.Context, userId string) error {
+	_, err := r.db.ExecContext(ctx, `DELETE FROM sessions WHERE user_id = $1`, userId)
+	return err
+}
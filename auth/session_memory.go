@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errDuplicateSession = errors.New("a session with this ID or refresh token family already exists")
+
+// inMemorySessionRepository keeps sessions in process memory, for tests and local runs
+type inMemorySessionRepository struct {
+	mu       sync.RWMutex
+	sessions map[string]*Session
+}
+
+func NewInMemorySessionRepository() SessionRepository {
+	return &inMemorySessionRepository{
+		sessions: make(map[string]*Session),
+	}
+}
+
+func (r *inMemorySessionRepository) Close() {}
+
+func (r *inMemorySessionRepository) CreateSession(ctx context.Context, session *Session) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, existing := range r.sessions {
+		if existing.ID == session.ID || existing.FamilyID == session.FamilyID {
+			return errDuplicateSession
+		}
+	}
+	copied := *session
+	copied.RevokedAt = time.Time{}
+	r.sessions[session.ID] = &copied
+	return nil
+}
+
+func (r *inMemorySessionRepository) GetSession(ctx context.Context, sessionId string) (*Session, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	session, ok := r.sessions[sessionId]
+	if !ok {
+		return nil, errSessionNotFound
+	}
+	copied := *session
+	return &copied, nil
+}
+
+func (r *inMemorySessionRepository) ListUserSessions(ctx context.Context, userId string) ([]*Session, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	sessions := []*Session{}
+	for _, session := range r.sessions {
+		if session.UserID == userId && session.Active() {
+			copied := *session
+			sessions = append(sessions, &copied)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt) })
+	return sessions, nil
+}
+
+func (r *inMemorySessionRepository) ListActiveUserIDs(ctx context.Context) ([]string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	firstSeen := map[string]time.Time{}
+	for _, session := range r.sessions {
+		if !session.Active() {
+			continue
+		}
+		if created, ok := firstSeen[session.UserID]; !ok || session.CreatedAt.Before(created) {
+			firstSeen[session.UserID] = session.CreatedAt
+		}
+	}
+
+	userIds := make([]string, 0, len(firstSeen))
+	for userId := range firstSeen {
+		userIds = append(userIds, userId)
+	}
+	sort.Slice(userIds, func(i, j int) bool { return firstSeen[userIds[i]].Before(firstSeen[userIds[j]]) })
+	return userIds, nil
+}
+
+func (r *inMemorySessionRepository) TouchSession(ctx context.Context, sessionId string, expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if session, ok := r.sessions[sessionId]; ok && session.RevokedAt.IsZero() {
+		session.LastSeenAt = time.Now()
+		session.ExpiresAt = expiresAt
+	}
+	return nil
+}
+
+func (r *inMemorySessionRepository) RevokeSession(ctx context.Context, sessionId string) error {
+	return r.revokeWhere(func(s *Session) bool { return s.ID == sessionId })
+}
+
+func (r *inMemorySessionRepository) RevokeSessionByFamily(ctx context.Context, familyId string) error {
+	return r.revokeWhere(func(s *Session) bool { return s.FamilyID == familyId })
+}
+
+func (r *inMemorySessionRepository) RevokeUserSessions(ctx context.Context, userId string) error {
+	return r.revokeWhere(func(s *Session) bool { return s.UserID == userId })
+}
+
+func (r *inMemorySessionRepository) RevokeAllSessions(ctx context.Context) error {
+	return r.revokeWhere(func(s *Session) bool { return true })
+}
+
+func (r *inMemorySessionRepository) ListUserSessionHistory(ctx context.Context, userId string) ([]*Session, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	sessions := []*Session{}
+	for _, session := range r.sessions {
+		if session.UserID == userId {
+			copied := *session
+			sessions = append(sessions, &copied)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreatedAt.After(sessions[j].CreatedAt) })
+	return sessions, nil
+}
+
+func (r *inMemorySessionRepository) DeleteUserSessions(ctx context.Context, userId string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, session := range r.sessions {
+		if session.UserID == userId {
+			delete(r.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (r *inMemorySessionRepository) revokeWhere(match func(*Session) bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for _, session := range r.sessions {
+		if session.RevokedAt.IsZero() && match(session) {
+			session.RevokedAt = now
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenVersionCache keeps the current token_version of recently seen accounts so verifying an
+// access token does not need a round trip to the account service. Entries are dropped when the
+// account service announces a version bump on NATS, and expire after ttl in case an event is lost
+type TokenVersionCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]tokenVersionEntry
+	// generation is bumped by every invalidation, a lookup that raced with one does not store
+	// the version it fetched since it may predate the bump
+	generation uint64
+	lastSweep  time.Time
+}
+
+type tokenVersionEntry struct {
+	version   int32
+	expiresAt time.Time
+}
+
+// NewTokenVersionCache creates a cache, a ttl of zero disables caching
+func NewTokenVersionCache(ttl time.Duration) *TokenVersionCache {
+	return &TokenVersionCache{
+		ttl:       ttl,
+		entries:   make(map[string]tokenVersionEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+// Lookup returns the cached version of the user or calls fetch and caches its result
+func (c *TokenVersionCache) Lookup(userId string, fetch func() (int32, error)) (int32, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[userId]
+	generation := c.generation
+	c.mu.Unlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.version, nil
+	}
+
+	version, err := fetch()
+	if err != nil || c.ttl <= 0 {
+		return version, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation == generation {
+		c.entries[userId] = tokenVersionEntry{version: version, expiresAt: now.Add(c.ttl)}
+	}
+	c.sweep(now)
+	return version, nil
+}
+
+// Invalidate drops the cached version of the user, an empty userId drops every entry
+func (c *TokenVersionCache) Invalidate(userId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	if userId == "" {
+		c.entries = make(map[string]tokenVersionEntry)
+		return
+	}
+	delete(c.entries, userId)
+}
+
+// sweep removes expired entries once per ttl so accounts that stopped calling do not pile up
+func (c *TokenVersionCache) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < c.ttl {
+		return
+	}
+	for userId, entry := range c.entries {
+		if now.After(entry.expiresAt) {
+			delete(c.entries, userId)
+		}
+	}
+	c.lastSweep = now
+}
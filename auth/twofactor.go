@@ -0,0 +1,191 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/zenvisjr/building-scalable-microservices/account"
+	"github.com/zenvisjr/building-scalable-microservices/auth/pb"
+	"github.com/zenvisjr/building-scalable-microservices/logger"
+)
+
+// TOTPEnrollment is handed to the user once so they can add the account to an authenticator app
+type TOTPEnrollment struct {
+	Secret     string
+	OTPAuthURI string
+}
+
+func (s *authService) EnrollTOTP(ctx context.Context, userId string, ac *account.Client) (*TOTPEnrollment, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.Info(ctx, "EnrollTOTP called for user: "+userId)
+
+	// Step 1: Check the role is allowed to use two-factor login yet
+	acc, err := ac.GetAccount(ctx, userId)
+	if err != nil {
+		Logs.Error(ctx, "Failed to fetch account: "+err.Error())
+		return nil, err
+	}
+	if !s.totp.canEnroll(acc.Role) {
+		Logs.Warn(ctx, "Two-factor enrollment not available for role: "+acc.Role)
+		return nil, errors.New("two-factor authentication is not available for your role yet")
+	}
+
+	// Step 2: Refuse to silently replace a confirmed secret
+	_, enabled, err := ac.GetTOTP(ctx, userId)
+	if err != nil {
+		Logs.Error(ctx, "Failed to fetch TOTP state: "+err.Error())
+		return nil, err
+	}
+	if enabled {
+		return nil, errors.New("two-factor authentication is already enabled")
+	}
+
+	// Step 3: Generate a new secret and store it encrypted until it is confirmed
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		Logs.Error(ctx, "Failed to generate TOTP secret: "+err.Error())
+		return nil, err
+	}
+	sealed, err := s.totp.SecretBox.Seal(secret)
+	if err != nil {
+		Logs.Error(ctx, "Failed to encrypt TOTP secret: "+err.Error())
+		return nil, err
+	}
+	if err := ac.UpdateTOTP(ctx, userId, sealed, false); err != nil {
+		Logs.Error(ctx, "Failed to store TOTP secret: "+err.Error())
+		return nil, err
+	}
+
+	return &TOTPEnrollment{
+		Secret:     secret,
+		OTPAuthURI: totpURI(s.totp.Issuer, acc.Email, secret),
+	}, nil
+}
+
+func (s *authService) ConfirmTOTP(ctx context.Context, userId string, code string, ac *account.Client) ([]string, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.Info(ctx, "ConfirmTOTP called for user: "+userId)
+
+	// Step 1: Load the pending secret
+	sealed, enabled, err := ac.GetTOTP(ctx, userId)
+	if err != nil {
+		Logs.Error(ctx, "Failed to fetch TOTP state: "+err.Error())
+		return nil, err
+	}
+	if enabled {
+		return nil, errors.New("two-factor authentication is already enabled")
+	}
+	if sealed == "" {
+		return nil, errors.New("no pending two-factor enrollment, enroll first")
+	}
+
+	// Step 2: The first code proves the authenticator app was set up correctly
+	if err := s.checkTOTPCode(ctx, userId, sealed, code); err != nil {
+		return nil, err
+	}
+
+	// Step 3: Issue fresh recovery codes, only their hashes are kept
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		Logs.Error(ctx, "Failed to generate recovery codes: "+err.Error())
+		return nil, err
+	}
+	if err := s.repository.ReplaceRecoveryCodes(ctx, userId, hashes); err != nil {
+		Logs.Error(ctx, "Failed to store recovery codes: "+err.Error())
+		return nil, err
+	}
+
+	// Step 4: Turn on two-factor login
+	if err := ac.UpdateTOTP(ctx, userId, sealed, true); err != nil {
+		Logs.Error(ctx, "Failed to enable TOTP: "+err.Error())
+		return nil, err
+	}
+
+	Logs.Info(ctx, "Two-factor authentication enabled for user: "+userId)
+	return codes, nil
+}
+
+func (s *authService) VerifyLoginChallenge(ctx context.Context, challengeToken string, code string, info SessionInfo, ac *account.Client) (*pb.AuthResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("VerifyLoginChallenge called")
+
+	// Step 1: Validate the challenge issued by Login
+	claims, err := s.jwtManager.VerifyChallengeToken(challengeToken)
+	if err != nil {
+		Logs.Error(ctx, "Invalid login challenge: "+err.Error())
+		return nil, errors.New("invalid or expired login challenge, please login again")
+	}
+	userId := claims["sub"].(string)
+	email := claims["email"].(string)
+	tokenVersion, _ := claims["token_version"].(float64)
+
+	// Step 2: Second factor guesses count towards the same lockout as passwords
+	if err := s.checkLockout(ctx, email, info.IPAddress); err != nil {
+		return nil, err
+	}
+
+	// Step 3: Reload the account, it may have changed since the password was checked
+	acc, err := ac.GetEmailForAuth(ctx, email)
+	if err != nil {
+		Logs.Error(ctx, "Failed to fetch account for auth: "+err.Error())
+		return nil, err
+	}
+	if acc.ID != userId || acc.TokenVersion != int32(tokenVersion) || !acc.TOTPEnabled {
+		Logs.Warn(ctx, "Login challenge no longer matches account: "+userId)
+		return nil, errors.New("invalid or expired login challenge, please login again")
+	}
+	if !acc.IsActive {
+		Logs.Error(ctx, "Account is not active")
+		return nil, errors.New("account is not active")
+	}
+
+	// Step 4: Accept either a TOTP code or an unused recovery code
+	sealed, _, err := ac.GetTOTP(ctx, userId)
+	if err != nil {
+		Logs.Error(ctx, "Failed to fetch TOTP state: "+err.Error())
+		return nil, err
+	}
+	if err := s.checkTOTPCode(ctx, userId, sealed, code); err != nil {
+		used, useErr := s.repository.UseRecoveryCode(ctx, userId, hashRecoveryCode(code))
+		if useErr != nil {
+			Logs.Error(ctx, "Failed to check recovery code: "+useErr.Error())
+		}
+		if !used {
+			s.registerFailedLogin(ctx, email, info.IPAddress)
+			return nil, errInvalidTOTPCode
+		}
+		Logs.Warn(ctx, "Recovery code used to login for user: "+userId)
+	}
+	s.registerSuccessfulLogin(ctx, email, info.IPAddress)
+
+	// Step 5: Open a session and issue its tokens
+	return s.completeLogin(ctx, acc, info, ac)
+}
+
+// checkTOTPCode validates a code against the encrypted secret and burns its time step
+func (s *authService) checkTOTPCode(ctx context.Context, userId string, sealed string, code string) error {
+	Logs := logger.GetGlobalLogger()
+
+	secret, err := s.totp.SecretBox.Open(sealed)
+	if err != nil {
+		Logs.Error(ctx, "Failed to decrypt TOTP secret: "+err.Error())
+		return err
+	}
+
+	step, ok := validateTOTP(secret, code, time.Now())
+	if !ok {
+		return errInvalidTOTPCode
+	}
+
+	fresh, err := s.repository.MarkTOTPStepUsed(ctx, userId, step)
+	if err != nil {
+		Logs.Error(ctx, "Failed to record TOTP use: "+err.Error())
+		return err
+	}
+	if !fresh {
+		Logs.Warn(ctx, "Replayed TOTP code for user: "+userId)
+		return errInvalidTOTPCode
+	}
+	return nil
+}
@@ -5,8 +5,9 @@ import (
 
 	"github.com/zenvisjr/building-scalable-microservices/catalog/pb"
 	"github.com/zenvisjr/building-scalable-microservices/logger"
+	"github.com/zenvisjr/building-scalable-microservices/svcauth"
+	"github.com/zenvisjr/building-scalable-microservices/tlsconfig"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
 type Client struct {
@@ -15,11 +16,17 @@ type Client struct {
 	logs    *logger.Logs
 }
 
-func NewClient(address string) (*Client, error) {
+func NewClient(address string, opts ...grpc.DialOption) (*Client, error) {
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("Connecting to Catalog gRPC service at " + address)
 
-	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	creds, err := tlsconfig.DialOption()
+	if err != nil {
+		Logs.Warn(context.Background(), "Failed to load TLS config for Catalog gRPC: "+err.Error())
+		return nil, err
+	}
+
+	conn, err := grpc.NewClient(address, append([]grpc.DialOption{creds, svcauth.DialOption()}, opts...)...)
 	if err != nil {
 		Logs.Error(context.Background(), "Failed to connect to catalog gRPC: "+err.Error())
 		return nil, err
@@ -40,7 +47,40 @@ func (c *Client) Close() {
 	c.conn.Close()
 }
 
-func (c *Client) PostProduct(ctx context.Context, name, description string, price float64, stock int) (*Product, error) {
+func productFromPB(p *pb.Product) Product {
+	product := Product{
+		ID:           p.GetId(),
+		Name:         p.GetName(),
+		Description:  p.GetDescription(),
+		Price:        p.GetPrice(),
+		Stock:        p.GetStock(),
+		Sold:         p.GetSold(),
+		OutOfStock:   p.GetOutOfStock(),
+		Score:        p.GetScore(),
+		CategoryID:   p.GetCategoryId(),
+		CategoryPath: p.GetCategoryPath(),
+		Tags:         p.GetTags(),
+		Attributes:   make([]Attribute, len(p.GetAttributes())),
+	}
+	for i, a := range p.GetAttributes() {
+		product.Attributes[i] = Attribute{Key: a.GetKey(), Type: a.GetType(), Value: a.GetValue()}
+	}
+	if p.GetCreatedAt() != nil {
+		product.CreatedAt = p.GetCreatedAt().AsTime()
+	}
+	return product
+}
+
+func categoryFromPB(c *pb.Category) *Category {
+	return &Category{
+		ID:       c.GetId(),
+		Name:     c.GetName(),
+		ParentID: c.GetParentId(),
+		Path:     c.GetPath(),
+	}
+}
+
+func (c *Client) PostProduct(ctx context.Context, name, description string, price float64, stock int, categoryID string, tags []string, attributes []Attribute) (*Product, error) {
 	c.logs.Info(ctx, "Posting new product to catalog")
 
 	req := &pb.PostProductRequest{
@@ -48,6 +88,11 @@ func (c *Client) PostProduct(ctx context.Context, name, description string, pric
 		Description: description,
 		Price:       price,
 		Stock:       uint32(stock),
+		CategoryId:  categoryID,
+		Tags:        tags,
+	}
+	for _, a := range attributes {
+		req.Attributes = append(req.Attributes, &pb.Attribute{Key: a.Key, Type: a.Type, Value: a.Value})
 	}
 
 	resp, err := c.service.PostProduct(ctx, req)
@@ -58,14 +103,8 @@ func (c *Client) PostProduct(ctx context.Context, name, description string, pric
 
 	c.logs.Info(ctx, "Product posted successfully with ID: "+resp.Product.Id)
 
-	return &Product{
-		ID:          resp.Product.Id,
-		Name:        resp.Product.Name,
-		Description: resp.Product.Description,
-		Price:       resp.Product.Price,
-		Stock:       uint32(resp.Product.Stock),
-		Sold:        uint32(resp.Product.Sold),
-	}, nil
+	product := productFromPB(resp.Product)
+	return &product, nil
 }
 
 func (c *Client) GetProduct(ctx context.Context, id string) (*Product, error) {
@@ -80,17 +119,13 @@ func (c *Client) GetProduct(ctx context.Context, id string) (*Product, error) {
 
 	c.logs.Info(ctx, "Product fetched: " + resp.Product.Name)
 
-	return &Product{
-		ID:          resp.Product.Id,
-		Name:        resp.Product.Name,
-		Description: resp.Product.Description,
-		Price:       resp.Product.Price,
-		Stock:       uint32(resp.Product.Stock),
-		Sold:        uint32(resp.Product.Sold),
-	}, nil
+	product := productFromPB(resp.Product)
+	return &product, nil
 }
 
-func (c *Client) GetProducts(ctx context.Context, skip uint64, take uint64, ids []string, query string) ([]Product, error) {
+// GetProducts fetches products by ID, or lists the products in stock matching query, after the
+// cursor when one is given. Products fetched by ID have no cursors
+func (c *Client) GetProducts(ctx context.Context, skip uint64, take uint64, ids []string, query string, after string) (*ProductPage, error) {
 	c.logs.Info(ctx, "Fetching products with pagination")
 
 	req := &pb.GetProductsRequest{
@@ -98,6 +133,7 @@ func (c *Client) GetProducts(ctx context.Context, skip uint64, take uint64, ids
 		Take:  take,
 		Ids:   ids,
 		Query: query,
+		After: after,
 	}
 
 	resp, err := c.service.GetProducts(ctx, req)
@@ -108,20 +144,68 @@ func (c *Client) GetProducts(ctx context.Context, skip uint64, take uint64, ids
 
 	c.logs.Info(ctx, "Fetched products from catalog: count = "+logger.IntToStr(len(resp.Products)))
 
-	products := make([]Product, len(resp.Products))
+	page := &ProductPage{
+		Edges:       make([]ProductEdge, len(resp.Products)),
+		EndCursor:   resp.EndCursor,
+		HasNextPage: resp.HasNextPage,
+	}
 	for i, p := range resp.Products {
-		products[i] = Product{
-			ID:          p.Id,
-			Name:        p.Name,
-			Description: p.Description,
-			Price:       p.Price,
-			Stock:       uint32(p.Stock),
-			Sold:        uint32(p.Sold),
-			OutOfStock:  p.OutOfStock,
+		page.Edges[i].Product = productFromPB(p)
+		if i < len(resp.Cursors) {
+			page.Edges[i].Cursor = resp.Cursors[i]
 		}
 	}
 
-	return products, nil
+	return page, nil
+}
+
+func (c *Client) SearchProducts(ctx context.Context, query SearchQuery) (*SearchResult, error) {
+	c.logs.Info(ctx, "Searching products with query: "+query.Query)
+
+	req := &pb.SearchProductsRequest{
+		Query:       query.Query,
+		MinPrice:    query.MinPrice,
+		MaxPrice:    query.MaxPrice,
+		CategoryId:  query.CategoryID,
+		Tags:        query.Tags,
+		InStockOnly: query.InStockOnly,
+		Sort:        query.Sort,
+		Skip:        query.Skip,
+		Take:        query.Take,
+		After:       query.After,
+	}
+	for _, facet := range query.Facets {
+		req.Facets = append(req.Facets, &pb.FacetRequest{Field: facet.Field, Size: int32(facet.Size), Interval: facet.Interval})
+	}
+
+	resp, err := c.service.SearchProducts(ctx, req)
+	if err != nil {
+		c.logs.Error(ctx, "SearchProducts failed: "+err.Error())
+		return nil, err
+	}
+
+	result := &SearchResult{
+		ProductPage: ProductPage{
+			Edges:       make([]ProductEdge, len(resp.Products)),
+			EndCursor:   resp.EndCursor,
+			HasNextPage: resp.HasNextPage,
+		},
+		Total:  resp.Total,
+		Facets: make([]Facet, len(resp.Facets)),
+	}
+	for i, p := range resp.Products {
+		result.Edges[i].Product = productFromPB(p)
+		if i < len(resp.Cursors) {
+			result.Edges[i].Cursor = resp.Cursors[i]
+		}
+	}
+	for i, facet := range resp.Facets {
+		result.Facets[i] = Facet{Field: facet.Field, Buckets: make([]FacetBucket, len(facet.Buckets))}
+		for j, bucket := range facet.Buckets {
+			result.Facets[i].Buckets[j] = FacetBucket{Key: bucket.Key, Count: bucket.Count}
+		}
+	}
+	return result, nil
 }
 
 func (c *Client) UpdateStockAndSold(ctx context.Context, id string, quantity int) (bool, error) {
@@ -175,13 +259,13 @@ func (c *Client) RestockProduct(ctx context.Context, id string, newStock int) er
 	return nil
 }
 
-func (c *Client) SuggestProducts(ctx context.Context, prefix string, size int, useAI bool) ([]Product, error) {
+func (c *Client) SuggestProducts(ctx context.Context, prefix string, size int, mode string) ([]Product, error) {
 	c.logs.Info(ctx, "Suggesting products with prefix: "+prefix)
 
 	req := &pb.SuggestProductsRequest{
 		Query: prefix,
 		Size:  int32(size),
-		UseAi: useAI,
+		Mode:  mode,
 	}
 
 	resp, err := c.service.SuggestProducts(ctx, req)
@@ -194,16 +278,67 @@ func (c *Client) SuggestProducts(ctx context.Context, prefix string, size int, u
 
 	products := make([]Product, len(resp.Products))
 	for i, p := range resp.Products {
-		products[i] = Product{
-			ID:          p.Id,
-			Name:        p.Name,
-			Description: p.Description,
-			Price:       p.Price,
-			Stock:       uint32(p.Stock),
-			Sold:        uint32(p.Sold),
-			OutOfStock:  p.OutOfStock,
-		}
+		products[i] = productFromPB(p)
 	}
 
 	return products, nil
 }
+
+func (c *Client) CreateCategory(ctx context.Context, name, parentID string) (*Category, error) {
+	c.logs.Info(ctx, "Creating category: "+name)
+
+	resp, err := c.service.CreateCategory(ctx, &pb.CreateCategoryRequest{Name: name, ParentId: parentID})
+	if err != nil {
+		c.logs.Error(ctx, "CreateCategory failed: "+err.Error())
+		return nil, err
+	}
+	return categoryFromPB(resp.Category), nil
+}
+
+func (c *Client) GetCategory(ctx context.Context, id string) (*Category, error) {
+	c.logs.Info(ctx, "Fetching category by ID: "+id)
+
+	resp, err := c.service.GetCategory(ctx, &pb.GetCategoryRequest{Id: id})
+	if err != nil {
+		c.logs.Error(ctx, "GetCategory failed: "+err.Error())
+		return nil, err
+	}
+	return categoryFromPB(resp.Category), nil
+}
+
+func (c *Client) ListCategories(ctx context.Context) ([]Category, error) {
+	c.logs.Info(ctx, "Listing categories")
+
+	resp, err := c.service.ListCategories(ctx, &pb.ListCategoriesRequest{})
+	if err != nil {
+		c.logs.Error(ctx, "ListCategories failed: "+err.Error())
+		return nil, err
+	}
+
+	categories := make([]Category, len(resp.Categories))
+	for i, category := range resp.Categories {
+		categories[i] = *categoryFromPB(category)
+	}
+	return categories, nil
+}
+
+func (c *Client) UpdateCategory(ctx context.Context, id, name, parentID string) (*Category, error) {
+	c.logs.Info(ctx, "Updating category: "+id)
+
+	resp, err := c.service.UpdateCategory(ctx, &pb.UpdateCategoryRequest{Id: id, Name: name, ParentId: parentID})
+	if err != nil {
+		c.logs.Error(ctx, "UpdateCategory failed: "+err.Error())
+		return nil, err
+	}
+	return categoryFromPB(resp.Category), nil
+}
+
+func (c *Client) DeleteCategory(ctx context.Context, id string) error {
+	c.logs.Info(ctx, "Deleting category: "+id)
+
+	if _, err := c.service.DeleteCategory(ctx, &pb.DeleteCategoryRequest{Id: id}); err != nil {
+		c.logs.Error(ctx, "DeleteCategory failed: "+err.Error())
+		return err
+	}
+	return nil
+}
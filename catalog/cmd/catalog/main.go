@@ -11,10 +11,23 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/zenvisjr/building-scalable-microservices/catalog"
 	"github.com/zenvisjr/building-scalable-microservices/logger"
+	"github.com/zenvisjr/building-scalable-microservices/svcauth"
 )
 
 type Config struct {
-	DatabaseURL string `envconfig:"DATABASE_URL"`
+	DatabaseURL         string  `envconfig:"DATABASE_URL"`
+	HybridLexicalWeight float64 `envconfig:"HYBRID_LEXICAL_WEIGHT" default:"1"`
+	HybridVectorWeight  float64 `envconfig:"HYBRID_VECTOR_WEIGHT" default:"1"`
+	HybridRankConstant  int     `envconfig:"HYBRID_RANK_CONSTANT" default:"60"`
+	HybridCandidates    int     `envconfig:"HYBRID_CANDIDATES" default:"50"`
+
+	EmbeddingProvider   string        `envconfig:"EMBEDDING_PROVIDER" default:"http"` // http or local
+	EmbeddingURL        string        `envconfig:"EMBEDDING_URL" default:"http://embed_service:5005/embed/batch"`
+	EmbeddingDimensions int           `envconfig:"EMBEDDING_DIMENSIONS" default:"1536"`
+	EmbeddingBatchSize  int           `envconfig:"EMBEDDING_BATCH_SIZE" default:"64"`
+	EmbeddingTimeout    time.Duration `envconfig:"EMBEDDING_TIMEOUT" default:"10s"`
+	EmbeddingMaxRetries int           `envconfig:"EMBEDDING_MAX_RETRIES" default:"3"`
+	EmbeddingRetryDelay time.Duration `envconfig:"EMBEDDING_RETRY_DELAY" default:"200ms"`
 }
 
 var (
@@ -33,6 +46,11 @@ func main() {
 	}
 	defer Logs.Close()
 
+	// Identify this service to the others it calls
+	if err := svcauth.Init("catalog"); err != nil {
+		Logs.Fatal(ctx, "Failed to initialize service authentication: "+err.Error())
+	}
+
 	Logs.Info(ctx, "Starting catalog service...")
 
 	exposePrometheusMetrics(9002)
@@ -44,11 +62,18 @@ func main() {
 		Logs.Fatal(ctx, "Failed to load configuration: "+err.Error())
 	}
 
+	// The embedder decides the dimensions of the embedding field of a new catalog index
+	embedder, err := newEmbedder(config)
+	if err != nil {
+		Logs.Fatal(ctx, "Failed to create the embedder: "+err.Error())
+	}
+	Logs.Info(ctx, fmt.Sprintf("Embedding with the %s provider in %d dimensions", config.EmbeddingProvider, embedder.Dimensions()))
+
 	// Connect to Elastic DB with retry
 	var r catalog.Repository
 	err = retry.Do(
 		func() error {
-			r, err = catalog.NewElasticRepository(config.DatabaseURL)
+			r, err = catalog.NewElasticRepository(config.DatabaseURL, embedder)
 			if err != nil {
 				Logs.Error(ctx, "Failed to connect to Elasticsearch: "+err.Error())
 			} else {
@@ -72,13 +97,36 @@ func main() {
 
 	// Start gRPC server
 	Logs.Info(ctx, "Starting gRPC server for catalog microservice on port 8080")
-	s := catalog.NewCatalogService(r)
+	s := catalog.NewCatalogService(r, catalog.HybridConfig{
+		LexicalWeight: config.HybridLexicalWeight,
+		VectorWeight:  config.HybridVectorWeight,
+		RankConstant:  config.HybridRankConstant,
+		Candidates:    config.HybridCandidates,
+	})
 	if err := catalog.ListenGRPC(s, 8080); err != nil {
 		Logs.Fatal(ctx, "Failed to start gRPC server: "+err.Error())
 	}
 
 }
 
+func newEmbedder(config Config) (catalog.Embedder, error) {
+	switch config.EmbeddingProvider {
+	case "http":
+		return catalog.NewHTTPEmbedder(catalog.HTTPEmbedderConfig{
+			URL:        config.EmbeddingURL,
+			Dimensions: config.EmbeddingDimensions,
+			BatchSize:  config.EmbeddingBatchSize,
+			Timeout:    config.EmbeddingTimeout,
+			MaxRetries: config.EmbeddingMaxRetries,
+			RetryDelay: config.EmbeddingRetryDelay,
+		})
+	case "local":
+		return catalog.NewLocalEmbedder(config.EmbeddingDimensions)
+	default:
+		return nil, fmt.Errorf("unknown embedding provider %q", config.EmbeddingProvider)
+	}
+}
+
 func exposePrometheusMetrics(port int) {
 	go func() {
 		http.Handle("/metrics", promhttp.Handler())
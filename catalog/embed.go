@@ -4,55 +4,225 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"math"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/avast/retry-go"
 	"github.com/zenvisjr/building-scalable-microservices/logger"
 )
 
-type embeddingRequest struct {
-	Name        string `json:"name"`
-	Description string `json:"description"`
+// Embedder turns texts into vectors of Dimensions numbers, texts alike in meaning into vectors
+// with a high cosine similarity. The catalog index maps embeddings with the dimensions of the
+// embedder it was created with
+type Embedder interface {
+	// Embed returns the vectors of texts in their order
+	Embed(ctx context.Context, texts []string) ([][]float64, error)
+	Dimensions() int
 }
 
-type embeddingResponse struct {
-	Embedding []float64 `json:"embedding"`
+// embeddingText is the text a product is embedded by, a query is embedded as it is
+func embeddingText(name, description string) string {
+	return strings.TrimSpace(name + " " + description)
 }
 
-func GetEmbeddingFromPython(name, description string) ([]float64, error) {
-	payload := embeddingRequest{
-		Name:        name,
-		Description: description,
-	}
-
-	body, err := json.Marshal(payload)
+// embedOne embeds a single text
+func embedOne(ctx context.Context, embedder Embedder, text string) ([]float64, error) {
+	vectors, err := embedder.Embed(ctx, []string{text})
 	if err != nil {
 		return nil, err
 	}
+	return vectors[0], nil
+}
+
+// HTTPEmbedderConfig points an HTTPEmbedder to the batch endpoint of the embedding service
+type HTTPEmbedderConfig struct {
+	URL        string
+	Dimensions int
+	BatchSize  int           // texts per request, longer lists are split. 0 sends them all at once
+	Timeout    time.Duration // per request, retries get their own
+	MaxRetries int           // after the first attempt, for network errors, 429 and 5xx answers
+	RetryDelay time.Duration // before the first retry, doubled on every further one
+}
+
+type httpEmbedder struct {
+	config HTTPEmbedderConfig
+	client *http.Client
+}
+
+type embeddingBatchRequest struct {
+	Texts      []string `json:"texts"`
+	Dimensions int      `json:"dimensions"`
+}
+
+type embeddingBatchResponse struct {
+	Embeddings [][]float64 `json:"embeddings"`
+}
+
+// NewHTTPEmbedder returns an Embedder calling the embedding service of the repository, which
+// asks OpenAI for vectors of the configured dimensions
+func NewHTTPEmbedder(config HTTPEmbedderConfig) (Embedder, error) {
+	if config.Dimensions <= 0 {
+		return nil, errInvalidDimensions
+	}
+	return &httpEmbedder{config: config, client: &http.Client{Timeout: config.Timeout}}, nil
+}
+
+func (e *httpEmbedder) Dimensions() int {
+	return e.config.Dimensions
+}
 
+func (e *httpEmbedder) Embed(ctx context.Context, texts []string) ([][]float64, error) {
 	Logs := logger.GetGlobalLogger()
-	Logs.Info(context.Background(), "Inside GetEmbeddingFromPython: "+name)
-	resp, err := http.Post("http://embed_service:5005/embed", "application/json", bytes.NewBuffer(body))
+	Logs.LocalOnlyInfo("Embedding " + logger.IntToStr(len(texts)) + " texts over HTTP")
+
+	batchSize := e.config.BatchSize
+	if batchSize <= 0 {
+		batchSize = len(texts)
+	}
+	vectors := make([][]float64, 0, len(texts))
+	for start := 0; start < len(texts); start += batchSize {
+		batch := texts[start:min(start+batchSize, len(texts))]
+		var embedded [][]float64
+		err := retry.Do(
+			func() error {
+				var err error
+				embedded, err = e.post(ctx, batch)
+				return err
+			},
+			retry.Context(ctx),
+			retry.Attempts(uint(e.config.MaxRetries+1)),
+			retry.Delay(e.config.RetryDelay),
+			retry.DelayType(retry.BackOffDelay),
+			retry.LastErrorOnly(true),
+			retry.OnRetry(func(n uint, err error) {
+				Logs.LocalOnlyInfo("Retrying embedding batch after: " + err.Error())
+			}),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("embedding failed: %w", err)
+		}
+		vectors = append(vectors, embedded...)
+	}
+	return vectors, nil
+}
+
+// post sends one batch. Answers that another attempt cannot change are unrecoverable
+func (e *httpEmbedder) post(ctx context.Context, texts []string) ([][]float64, error) {
+	body, err := json.Marshal(embeddingBatchRequest{Texts: texts, Dimensions: e.config.Dimensions})
+	if err != nil {
+		return nil, retry.Unrecoverable(err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, retry.Unrecoverable(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	Logs.Info(context.Background(), "got response from embed_service: "+name)
 
 	if resp.StatusCode != http.StatusOK {
 		msg, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("embedding service error: %s", msg)
+		err := fmt.Errorf("embedding service error %d: %s", resp.StatusCode, msg)
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			return nil, err
+		}
+		return nil, retry.Unrecoverable(err)
 	}
-	Logs.Info(context.Background(), "got response from embed_service: "+name)
-	var result embeddingResponse
+	var result embeddingBatchResponse
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, err
+		return nil, retry.Unrecoverable(err)
 	}
-	Logs.Info(context.Background(), " response sent from embed_service: "+name)
+	if len(result.Embeddings) != len(texts) {
+		return nil, retry.Unrecoverable(fmt.Errorf("embedding service returned %d vectors for %d texts", len(result.Embeddings), len(texts)))
+	}
+	for _, vector := range result.Embeddings {
+		if len(vector) != e.config.Dimensions {
+			return nil, retry.Unrecoverable(fmt.Errorf("embedding service returned %d dimensions, want %d", len(vector), e.config.Dimensions))
+		}
+	}
+	return result.Embeddings, nil
+}
 
-	return result.Embedding, nil
+var (
+	errInvalidDimensions = errors.New("embedding dimensions must be positive")
+	errNothingToEmbed    = errors.New("text has no words to embed")
+)
+
+type localEmbedder struct {
+	dimensions int
+}
+
+// NewLocalEmbedder returns an Embedder that needs no service or network: it hashes the words of
+// a text and their character trigrams into buckets of a vector. Texts sharing words or parts of
+// words get close vectors, texts only alike in meaning do not, so it is meant for development
+// and tests. The same text always gets the same vector
+func NewLocalEmbedder(dimensions int) (Embedder, error) {
+	if dimensions <= 0 {
+		return nil, errInvalidDimensions
+	}
+	return &localEmbedder{dimensions: dimensions}, nil
+}
+
+func (e *localEmbedder) Dimensions() int {
+	return e.dimensions
+}
+
+// Embed refuses texts without words, as the embedding service does, since cosine similarity
+// is not defined for the zero vector they would get
+func (e *localEmbedder) Embed(ctx context.Context, texts []string) ([][]float64, error) {
+	vectors := make([][]float64, len(texts))
+	for i, text := range texts {
+		if len(words(text)) == 0 {
+			return nil, errNothingToEmbed
+		}
+		vectors[i] = e.vector(text)
+	}
+	return vectors, nil
+}
+
+// vector adds every feature of text to the bucket its hash picks, with a sign another bit of
+// the hash picks so collisions cancel out rather than pile up, and scales the vector to length 1
+func (e *localEmbedder) vector(text string) []float64 {
+	vector := make([]float64, e.dimensions)
+	add := func(feature string, weight float64) {
+		h := fnv.New64a()
+		h.Write([]byte(feature))
+		sum := h.Sum64()
+		if sum>>63 == 1 {
+			weight = -weight
+		}
+		vector[sum%uint64(e.dimensions)] += weight
+	}
+	for _, word := range words(text) {
+		add("w:"+word, 1)
+		runes := []rune("<" + word + ">")
+		for i := 0; i+3 <= len(runes); i++ {
+			add("g:"+string(runes[i:i+3]), 0.5)
+		}
+	}
+
+	var norm float64
+	for _, v := range vector {
+		norm += v * v
+	}
+	// features cancelling out to exactly 0 are all but impossible, but would divide by 0
+	if norm > 0 {
+		norm = math.Sqrt(norm)
+		for i := range vector {
+			vector[i] /= norm
+		}
+	}
+	return vector
 }
 
 func (p *elasticRepository) AddEmbeddingToProduct(product Product) {
@@ -61,9 +231,9 @@ func (p *elasticRepository) AddEmbeddingToProduct(product Product) {
 	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
-	Logs.Info(ctx, "Started embedding for product: " + product.ID)
+	Logs.Info(ctx, "Started embedding for product: "+product.ID)
 
-	embedding, err := GetEmbeddingFromPython(product.Name, product.Description)
+	embedding, err := embedOne(ctx, p.embedder, embeddingText(product.Name, product.Description))
 	if err != nil {
 		Logs.Error(ctx, "Embedding failed for "+product.ID+": "+err.Error())
 		return
@@ -80,6 +250,6 @@ func (p *elasticRepository) AddEmbeddingToProduct(product Product) {
 	if err != nil {
 		Logs.Error(ctx, "Failed to update product with embedding: "+err.Error())
 	} else {
-		Logs.Info(ctx, "Embedding added to product: " + product.ID)
+		Logs.Info(ctx, "Embedding added to product: "+product.ID)
 	}
 }
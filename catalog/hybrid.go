@@ -0,0 +1,95 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/zenvisjr/building-scalable-microservices/logger"
+)
+
+// Modes SuggestProducts can rank suggestions by
+const (
+	SuggestLexical  = "lexical"  // BM25 on the name, typos allowed, best sellers boosted
+	SuggestSemantic = "semantic" // nearest embeddings of name and description
+	SuggestHybrid   = "hybrid"   // both, merged by reciprocal rank fusion
+)
+
+var errInvalidSuggestMode = errors.New("invalid suggest mode")
+
+// HybridConfig tunes the fusion of hybrid suggestions. A product scores weight / (RankConstant
+// + rank) in every branch that returns it, ranks counting from 1, and the scores add up
+type HybridConfig struct {
+	LexicalWeight float64
+	VectorWeight  float64
+	RankConstant  int // the larger, the less the first ranks of a branch outweigh the rest
+	Candidates    int // products each branch ranks for the fusion, at least the size asked for
+}
+
+// fuseRanks merges ranked lists by weighted reciprocal rank fusion. Rank fusion only looks at
+// positions, so it needs no normalization of BM25 scores against vector similarities. Score
+// is set to the fused score, ties keep the product that ranked first in the earlier list. A
+// list weighted 0 or less is left out
+func fuseRanks(lists [][]Product, weights []float64, rankConstant int, size int) []Product {
+	scores := map[string]float64{}
+	products := []Product{}
+	for i, list := range lists {
+		if weights[i] <= 0 {
+			continue
+		}
+		for rank, p := range list {
+			if _, ok := scores[p.ID]; !ok {
+				products = append(products, p)
+			}
+			scores[p.ID] += weights[i] / float64(rankConstant+rank+1)
+		}
+	}
+	sort.SliceStable(products, func(i, j int) bool {
+		return scores[products[i].ID] > scores[products[j].ID]
+	})
+	if len(products) > size {
+		products = products[:size]
+	}
+	for i := range products {
+		products[i].Score = scores[products[i].ID]
+	}
+	return products
+}
+
+// hybridSuggest runs the lexical and the vector branch at the same time and fuses their ranks.
+// When one branch fails, say because the embedding service is down, the other one answers alone
+func (s *catalogService) hybridSuggest(ctx context.Context, query string, size int) ([]Product, error) {
+	Logs := logger.GetGlobalLogger()
+	candidates := max(size, s.hybrid.Candidates)
+
+	var (
+		wg                      sync.WaitGroup
+		lexical, semantic       []Product
+		lexicalErr, semanticErr error
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		lexical, lexicalErr = s.repo.SuggestProducts(ctx, query, candidates)
+	}()
+	go func() {
+		defer wg.Done()
+		semantic, semanticErr = s.repo.AISuggest(ctx, query, candidates)
+	}()
+	wg.Wait()
+
+	switch {
+	case lexicalErr != nil && semanticErr != nil:
+		Logs.Error(ctx, "Both branches of the hybrid suggestion failed: "+lexicalErr.Error()+" | "+semanticErr.Error())
+		return nil, lexicalErr
+	case lexicalErr != nil:
+		Logs.Error(ctx, "Lexical branch failed, suggesting by vectors only: "+lexicalErr.Error())
+	case semanticErr != nil:
+		Logs.Error(ctx, "Vector branch failed, suggesting by words only: "+semanticErr.Error())
+	}
+
+	Logs.LocalOnlyInfo("Fusing " + logger.IntToStr(len(lexical)) + " lexical and " + logger.IntToStr(len(semantic)) + " vector suggestions")
+	weights := []float64{s.hybrid.LexicalWeight, s.hybrid.VectorWeight}
+	return fuseRanks([][]Product{lexical, semantic}, weights, s.hybrid.RankConstant, size), nil
+}
@@ -4,6 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"slices"
+	"strconv"
+	"time"
 
 	"github.com/olivere/elastic/v7"
 	"github.com/zenvisjr/building-scalable-microservices/logger"
@@ -14,13 +17,21 @@ var (
 	errOutOfStock = fmt.Errorf("product is out of stock")
 )
 
+// Bounds of the candidates a kNN search considers per shard, more find closer neighbours slower
+const (
+	knnCandidatesPerResult = 10
+	minKNNCandidates       = 100
+	maxKNNCandidates       = 10000
+)
+
 type Repository interface {
 	// Close()
 	CreateProduct(ctx context.Context, product Product) error
 	GetProductByID(ctx context.Context, id string) (*Product, error)
-	ListProducts(ctx context.Context, skip uint64, take uint64) ([]Product, error)
 	ListProductsWithIDs(ctx context.Context, ids []string) ([]Product, error)
-	SearchProducts(ctx context.Context, query string, skip uint64, take uint64) ([]Product, error)
+	// SearchProducts expects a query normalizeSearchQuery has filled in, and continues after
+	// the cursor when it is not nil. Every edge gets a cursor, paging is left to the service
+	SearchProducts(ctx context.Context, query SearchQuery, after *productCursor) (*SearchResult, error)
 	UpdateStockAndSold(ctx context.Context, id string, quantity int) (bool, error)
 	DeleteProductByID(ctx context.Context, id string) error
 	RestockProduct(ctx context.Context, id string, newStock int) error
@@ -28,10 +39,18 @@ type Repository interface {
 	CreateCatalogIndexWithAutocomplete(ctx context.Context) error
 	SuggestProducts(ctx context.Context, prefix string, size int) ([]Product, error)
 	AISuggest(ctx context.Context, query string, size int) ([]Product, error)
+	CreateCategory(ctx context.Context, category Category) error
+	GetCategoryByID(ctx context.Context, id string) (*Category, error)
+	ListCategories(ctx context.Context) ([]Category, error)
+	// UpdateCategory stores the new name, parent and path of a category and rewrites oldPath
+	// to the new path in its subcategories and in the products filed under them
+	UpdateCategory(ctx context.Context, category Category, oldPath []string) error
+	DeleteCategory(ctx context.Context, id string) error
 }
 
 type elasticRepository struct {
-	client *elastic.Client
+	client   *elastic.Client
+	embedder Embedder
 }
 
 type productDocument struct {
@@ -41,10 +60,70 @@ type productDocument struct {
 	Stock       uint32    `json:"stock"`        // Available stock for order
 	Sold        uint32    `json:"sold"`         // Total units sold
 	OutOfStock  bool      `json:"out_of_stock"` // Product is out of stock
-	Embedding   []float64 `json:"embedding"`    // OpenAI embedding vector
+	Deleted     bool      `json:"deleted"`      // Product was deleted, searches never find it
+	Embedding   []float64 `json:"embedding"`    // Vector of the embedder, added after indexing
+
+	CategoryID   string              `json:"category_id,omitempty"`   // Category the product is filed under
+	CategoryPath []string            `json:"category_path,omitempty"` // IDs of the category and its ancestors
+	Tags         []string            `json:"tags,omitempty"`          // Normalized free-form tags
+	Attributes   []attributeDocument `json:"attributes,omitempty"`    // Typed key/value attributes
+	CreatedAt    *time.Time          `json:"created_at,omitempty"`    // Missing on products created before it was kept
+}
+
+// attributeDocument keeps the text form of every value for term filters and facets, and number
+// and boolean values again in fields of their type for range filters
+type attributeDocument struct {
+	Key     string   `json:"key"`
+	Type    string   `json:"type"`
+	Value   string   `json:"value"`
+	Number  *float64 `json:"number,omitempty"`
+	Boolean *bool    `json:"boolean,omitempty"`
+}
+
+func toAttributeDocuments(attributes []Attribute) []attributeDocument {
+	documents := make([]attributeDocument, len(attributes))
+	for i, a := range attributes {
+		documents[i] = attributeDocument{Key: a.Key, Type: a.Type, Value: a.Value}
+		switch a.Type {
+		case AttributeNumber:
+			if number, err := strconv.ParseFloat(a.Value, 64); err == nil {
+				documents[i].Number = &number
+			}
+		case AttributeBoolean:
+			if flag, err := strconv.ParseBool(a.Value); err == nil {
+				documents[i].Boolean = &flag
+			}
+		}
+	}
+	return documents
 }
 
-func NewElasticRepository(url string) (Repository, error) {
+// toProduct maps a stored document back to a product, Score is left to the search that ranked it
+func toProduct(id string, doc productDocument) Product {
+	product := Product{
+		ID:           id,
+		Name:         doc.Name,
+		Description:  doc.Description,
+		Price:        doc.Price,
+		Stock:        doc.Stock,
+		Sold:         doc.Sold,
+		OutOfStock:   doc.OutOfStock,
+		CategoryID:   doc.CategoryID,
+		CategoryPath: doc.CategoryPath,
+		Tags:         doc.Tags,
+		Attributes:   make([]Attribute, len(doc.Attributes)),
+	}
+	for i, a := range doc.Attributes {
+		product.Attributes[i] = Attribute{Key: a.Key, Type: a.Type, Value: a.Value}
+	}
+	if doc.CreatedAt != nil {
+		product.CreatedAt = *doc.CreatedAt
+	}
+	return product
+}
+
+// NewElasticRepository connects to Elasticsearch, products and queries are embedded by embedder
+func NewElasticRepository(url string, embedder Embedder) (Repository, error) {
 	ctx := context.Background()
 	//Default Connect to localhost:9200
 	//here we provide the url
@@ -61,7 +140,7 @@ func NewElasticRepository(url string) (Repository, error) {
 		return nil, err
 	}
 	Logs.Info(ctx, "Connected to Elasticsearch at "+url)
-	return &elasticRepository{client}, nil
+	return &elasticRepository{client: client, embedder: embedder}, nil
 }
 
 // func (p *elasticRepository) Close() {
@@ -190,6 +269,14 @@ func (p *elasticRepository) CreateProduct(ctx context.Context, product Product)
 		Stock:       product.Stock,
 		Sold:        0,
 		OutOfStock:  false,
+
+		CategoryID:   product.CategoryID,
+		CategoryPath: product.CategoryPath,
+		Tags:         product.Tags,
+		Attributes:   toAttributeDocuments(product.Attributes),
+	}
+	if !product.CreatedAt.IsZero() {
+		document.CreatedAt = &product.CreatedAt
 	}
 	Logs.Info(ctx, "Indexing product: "+product.ID)
 	response, err := p.client.Index().
@@ -238,48 +325,8 @@ func (p *elasticRepository) GetProductByID(ctx context.Context, id string) (*Pro
 		return nil, errOutOfStock
 	}
 	Logs.Info(ctx, "Product fetched: "+id)
-	return &Product{
-		ID:          id,
-		Name:        doc.Name,
-		Description: doc.Description,
-		Price:       doc.Price,
-		Stock:       doc.Stock,
-		Sold:        doc.Sold,
-	}, nil
-}
-
-func (p *elasticRepository) ListProducts(ctx context.Context, skip uint64, take uint64) ([]Product, error) {
-	Logs := logger.GetGlobalLogger()
-	Logs.Info(ctx, "Listing products")
-	res, err := p.client.Search().Index("catalog").Query(elastic.NewMatchAllQuery()).Size(int(take)).From(int(skip)).Do(ctx)
-	if err != nil {
-		Logs.Error(ctx, "Failed to list products: "+err.Error())
-		return nil, err
-	}
-	products := []Product{}
-	for _, hit := range res.Hits.Hits {
-		product := &productDocument{}
-		if err := json.Unmarshal(hit.Source, &product); err != nil {
-			continue
-		}
-		//checking if product is out of stock
-		if product.OutOfStock {
-			Logs.Error(ctx, "Product is out of stock: "+hit.Id)
-			continue
-		}
-
-		products = append(products, Product{
-			Name:        product.Name,
-			ID:          hit.Id,
-			Description: product.Description,
-			Price:       product.Price,
-			Stock:       product.Stock,
-			Sold:        product.Sold,
-			OutOfStock:  product.OutOfStock,
-		})
-	}
-	Logs.Info(ctx, "Products listed: "+logger.IntToStr(len(products)))
-	return products, nil
+	product := toProduct(id, doc)
+	return &product, nil
 }
 
 // func (p *elasticRepository) ListProductsWithIDs(ctx context.Context, ids []string) ([]Product, error) {
@@ -344,52 +391,192 @@ func (r *elasticRepository) ListProductsWithIDs(ctx context.Context, ids []strin
 			Logs.Error(ctx, "Product is out of stock: "+doc.Id)
 			continue
 		}
-		products = append(products, Product{
-			ID:          doc.Id,
-			Name:        p.Name,
-			Description: p.Description,
-			Price:       p.Price,
-			Stock:       p.Stock,
-			Sold:        p.Sold,
-		})
+		products = append(products, toProduct(doc.Id, p))
 	}
 
 	Logs.LocalOnlyInfo("Fetched " + logger.IntToStr(len(products)) + " products by ID")
 	return products, nil
 }
 
-func (p *elasticRepository) SearchProducts(ctx context.Context, query string, skip uint64, take uint64) ([]Product, error) {
-	//we are seraching product accross multiple fields by matching it against name
+// SearchProducts runs the filters in filter context so they do not change relevance, and counts
+// the facets over every product matching the query and the filters. Pages after the first are
+// read from a point in time, so they stay consistent while products change, and continue with
+// search_after, which unlike from and size works past the first 10,000 hits
+func (p *elasticRepository) SearchProducts(ctx context.Context, query SearchQuery, after *productCursor) (*SearchResult, error) {
 	Logs := logger.GetGlobalLogger()
-	Logs.Info(ctx, "Searching products | query: \""+query+"\", skip: "+logger.Uint64ToStr(skip)+", take: "+logger.Uint64ToStr(take))
-	res, err := p.client.Search().Index("catalog").Query(elastic.NewMultiMatchQuery(query, "name", "description")).Size(int(take)).From(int(skip)).Do(ctx)
+	Logs.Info(ctx, "Searching products | query: \""+query.Query+"\", sort: "+query.Sort+", skip: "+logger.Uint64ToStr(query.Skip)+", take: "+logger.Uint64ToStr(query.Take))
+
+	// Step 1: Match the words and apply the filters
+	boolQuery := elastic.NewBoolQuery()
+	if query.Query != "" {
+		boolQuery.Must(elastic.NewMultiMatchQuery(query.Query, "name", "description"))
+	} else {
+		boolQuery.Must(elastic.NewMatchAllQuery())
+	}
+	if query.MinPrice != nil || query.MaxPrice != nil {
+		priceRange := elastic.NewRangeQuery("price")
+		if query.MinPrice != nil {
+			priceRange.Gte(*query.MinPrice)
+		}
+		if query.MaxPrice != nil {
+			priceRange.Lte(*query.MaxPrice)
+		}
+		boolQuery.Filter(priceRange)
+	}
+	if query.CategoryID != "" {
+		boolQuery.Filter(elastic.NewTermQuery("category_path", query.CategoryID))
+	}
+	if len(query.Tags) > 0 {
+		tags := make([]interface{}, len(query.Tags))
+		for i, tag := range query.Tags {
+			tags[i] = tag
+		}
+		boolQuery.Filter(elastic.NewTermsQuery("tags", tags...))
+	}
+	// deleted products are never found, sold out ones only leave when in stock only is asked for.
+	// Products deleted before the field existed lack it and count as sold out
+	boolQuery.MustNot(elastic.NewTermQuery("deleted", true))
+	if query.InStockOnly {
+		boolQuery.Filter(elastic.NewRangeQuery("stock").Gt(0))
+	}
+
+	// Step 2: Only searches continued with a cursor read from a point in time, so lookups and
+	// listings nobody pages through leave none open. The first cursor carries the offset of its
+	// product, the point in time opened for it starts there, and later cursors read on from it
+	// with search_after. A search with a point in time names no index, the point in time does
+	search := p.client.Search().
+		Query(boolQuery).
+		Size(int(query.Take)).
+		TrackTotalHits(true)
+	pit := ""
+	switch {
+	case after == nil:
+		search = search.Index("catalog").From(int(query.Skip))
+	case after.PIT == "":
+		opened, err := p.openPointInTime(ctx)
+		if err != nil {
+			return nil, err
+		}
+		pit = opened
+		search = search.From(int(after.Offset))
+	default:
+		pit = after.PIT
+		search = search.SearchAfter(after.After...)
+	}
+	if pit != "" {
+		search = search.PointInTime(elastic.NewPointInTimeWithKeepAlive(pit, pitKeepAlive))
+	}
+
+	// Step 3: Sort, search_after needs an explicit sort even for relevance. Elasticsearch
+	// breaks ties with the implicit _shard_doc of the point in time. Products without a
+	// creation time sort as 0, so their sort values stay small enough for a float64
+	switch query.Sort {
+	case SortRelevance:
+		search = search.SortBy(elastic.NewScoreSort())
+	case SortPriceAsc:
+		search = search.Sort("price", true)
+	case SortPriceDesc:
+		search = search.Sort("price", false)
+	case SortBestSelling:
+		search = search.Sort("sold", false)
+	case SortNewest:
+		search = search.SortBy(elastic.NewFieldSort("created_at").Desc().Missing(0))
+	}
+
+	// Step 4: Ask for the facets as aggregations
+	for _, facet := range query.Facets {
+		switch facet.Field {
+		case FacetCategory:
+			search = search.Aggregation(facet.Field, elastic.NewTermsAggregation().Field("category_path").Size(facet.Size))
+		case FacetTags:
+			search = search.Aggregation(facet.Field, elastic.NewTermsAggregation().Field("tags").Size(facet.Size))
+		case FacetPrice:
+			search = search.Aggregation(facet.Field, elastic.NewHistogramAggregation().Field("price").Interval(facet.Interval).MinDocCount(1))
+		}
+	}
+
+	res, err := search.Do(ctx)
+	if err != nil && after != nil && after.PIT != "" && elastic.IsNotFound(err) {
+		// The point in time of the cursor is gone, its keep alive ran out or the last page closed
+		// it. The sort values still place the cursor, so read on from a new point in time, only
+		// products tied with it at the page boundary may repeat or be skipped
+		Logs.Warn(ctx, "Point in time of the cursor expired, continuing from a new one")
+		if pit, err = p.openPointInTime(ctx); err != nil {
+			return nil, err
+		}
+		res, err = search.PointInTime(elastic.NewPointInTimeWithKeepAlive(pit, pitKeepAlive)).Do(ctx)
+	}
 	if err != nil {
 		Logs.Error(ctx, "Failed to search products: "+err.Error())
 		return nil, err
 	}
-	products := []Product{}
-	for _, hit := range res.Hits.Hits {
-		product := &productDocument{}
-		if err := json.Unmarshal(hit.Source, &product); err != nil {
+
+	// Step 5: Parse the hits and the buckets, cursors read on from the point in time this
+	// response returned, which may differ from the one it was asked for
+	if res.PitId != "" {
+		pit = res.PitId
+	}
+	result := &SearchResult{ProductPage: ProductPage{Edges: []ProductEdge{}}, Total: res.TotalHits(), Facets: []Facet{}}
+	for i, hit := range res.Hits.Hits {
+		var doc productDocument
+		if err := json.Unmarshal(hit.Source, &doc); err != nil {
+			Logs.Error(ctx, "Unmarshal failed for ID: "+hit.Id+" | "+err.Error())
 			continue
 		}
-		//checking if product is out of stock
-		if product.OutOfStock {
-			Logs.Error(ctx, "Product is out of stock: "+hit.Id)
-			continue
+		product := toProduct(hit.Id, doc)
+		if hit.Score != nil {
+			product.Score = *hit.Score
 		}
-		products = append(products, Product{
-			Name:        product.Name,
-			ID:          hit.Id,
-			Description: product.Description,
-			Price:       product.Price,
-			Stock:       product.Stock,
-			Sold:        product.Sold,
-		})
+		position := productCursor{Sort: query.Sort, Query: searchQueryHash(query), PIT: pit, After: hit.Sort}
+		if pit == "" {
+			position.Offset = query.Skip + uint64(i) + 1
+		}
+		cursor := encodeProductCursor(position)
+		result.Edges = append(result.Edges, ProductEdge{Product: product, Cursor: cursor})
+	}
+	for _, facet := range query.Facets {
+		buckets := []FacetBucket{}
+		if facet.Field == FacetPrice {
+			if histogram, ok := res.Aggregations.Histogram(facet.Field); ok {
+				for _, bucket := range histogram.Buckets {
+					buckets = append(buckets, FacetBucket{Key: priceBucketKey(bucket.Key, facet.Interval), Count: bucket.DocCount})
+				}
+			}
+		} else if terms, ok := res.Aggregations.Terms(facet.Field); ok {
+			for _, bucket := range terms.Buckets {
+				buckets = append(buckets, FacetBucket{Key: fmt.Sprint(bucket.Key), Count: bucket.DocCount})
+			}
+		}
+		result.Facets = append(result.Facets, Facet{Field: facet.Field, Buckets: buckets})
 	}
 
-	Logs.Info(ctx, "Products searched: "+logger.IntToStr(len(products)))
-	return products, nil
+	// Step 6: Fewer hits than asked for is the last page, nothing reads from its point in time
+	// anymore, so it is closed rather than left to its keep alive
+	if pit != "" && len(res.Hits.Hits) < int(query.Take) {
+		if _, err := p.client.ClosePointInTime(pit).Do(ctx); err != nil {
+			Logs.Warn(ctx, "Failed to close the point in time: "+err.Error())
+		}
+	}
+
+	Logs.Info(ctx, "Products searched: "+logger.IntToStr(len(result.Edges))+" of "+strconv.FormatInt(result.Total, 10))
+	return result, nil
+}
+
+// openPointInTime opens a point in time on the catalog index for paging through a search
+func (p *elasticRepository) openPointInTime(ctx context.Context) (string, error) {
+	Logs := logger.GetGlobalLogger()
+
+	opened, err := p.client.OpenPointInTime("catalog").KeepAlive(pitKeepAlive).Do(ctx)
+	if err != nil {
+		Logs.Error(ctx, "Failed to open a point in time: "+err.Error())
+		return "", err
+	}
+	return opened.Id, nil
+}
+
+// priceBucketKey names the price bucket starting at from, e.g. 50-100
+func priceBucketKey(from, interval float64) string {
+	return strconv.FormatFloat(from, 'f', -1, 64) + "-" + strconv.FormatFloat(from+interval, 'f', -1, 64)
 }
 
 func (p *elasticRepository) UpdateStockAndSold(ctx context.Context, id string, quantity int) (bool, error) {
@@ -404,7 +591,7 @@ func (p *elasticRepository) UpdateStockAndSold(ctx context.Context, id string, q
 		ctx._source.stock -= params.qty;
 		ctx._source.sold += params.qty;
 		if (ctx._source.stock <= 0) {
-			ctx._source.outOfStock = true;
+			ctx._source.out_of_stock = true;
 		}
 	`).Lang("painless").Params(map[string]interface{}{
 		"qty": quantity,
@@ -444,9 +631,10 @@ func (p *elasticRepository) DeleteProductByID(ctx context.Context, id string) er
 		return errNotFound
 	}
 
-	// Step 2: Update outOfStock = true and stock = 0
+	// Step 2: Update outOfStock = true and stock = 0, deleted keeps it out of searches
 	script := elastic.NewScriptInline(`
 		ctx._source.out_of_stock = true;
+		ctx._source.deleted = true;
 		ctx._source.stock = 0;
 	`).Lang("painless")
 
@@ -481,10 +669,11 @@ func (p *elasticRepository) RestockProduct(ctx context.Context, id string, newSt
 		return errNotFound
 	}
 
-	// Prepare script to restock
+	// Prepare script to restock, restocking a deleted product brings it back
 	script := elastic.NewScriptInline(`
 		ctx._source.stock = params.newStock;
 		ctx._source.out_of_stock = false;
+		ctx._source.deleted = false;
 	`).Lang("painless").Params(map[string]interface{}{
 		"newStock": newStock,
 	})
@@ -523,11 +712,106 @@ func (p *elasticRepository) EnsureCatalogIndex(ctx context.Context) error {
 
 	if exists {
 		Logs.Info(ctx, "Catalog index already exists. Skipping creation.")
-		return nil // ✅ Already exists, skip
+		// indexes created before the later product fields get their mappings, adding
+		// fields to a mapping is allowed
+		if _, err := p.client.PutMapping().Index("catalog").
+			BodyJson(map[string]interface{}{"properties": addedProductMappings}).
+			Do(ctx); err != nil {
+			return fmt.Errorf("failed to add product mappings: %w", err)
+		}
+		if err := p.checkEmbeddingDimensions(ctx); err != nil {
+			return err
+		}
+	} else {
+		Logs.Info(ctx, "Catalog index does not exist. Creating...")
+		if err := p.CreateCatalogIndexWithAutocomplete(ctx); err != nil {
+			return err
+		}
+	}
+	return p.ensureCategoryIndex(ctx)
+}
+
+// embeddingMapping indexes vectors of dims dimensions for approximate kNN search. Indexes
+// created before Elasticsearch 8.11 left vectors unindexed by default and have to be reindexed
+// for AISuggest
+func embeddingMapping(dims int) map[string]interface{} {
+	return map[string]interface{}{
+		"type":       "dense_vector",
+		"dims":       dims,
+		"index":      true,
+		"similarity": "cosine",
+		"index_options": map[string]interface{}{
+			"type":            "hnsw",
+			"m":               16,
+			"ef_construction": 100,
+		},
 	}
+}
+
+// checkEmbeddingDimensions makes sure the embedder fills the embedding field of an existing
+// index. The dimensions of a vector field cannot change, a different embedder needs a new index
+func (p *elasticRepository) checkEmbeddingDimensions(ctx context.Context) error {
+	mappings, err := p.client.GetFieldMapping().Index("catalog").Field("embedding").Do(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read the embedding mapping: %w", err)
+	}
+	var field struct {
+		Mappings map[string]struct {
+			Mapping map[string]struct {
+				Dims int `json:"dims"`
+			} `json:"mapping"`
+		} `json:"mappings"`
+	}
+	raw, err := json.Marshal(mappings["catalog"])
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw, &field); err != nil {
+		return fmt.Errorf("failed to read the embedding mapping: %w", err)
+	}
+	dims := field.Mappings["embedding"].Mapping["embedding"].Dims
+	if dims == 0 {
+		// the field is mapped with the first vector indexed into it otherwise
+		_, err := p.client.PutMapping().Index("catalog").
+			BodyJson(map[string]interface{}{"properties": map[string]interface{}{"embedding": embeddingMapping(p.embedder.Dimensions())}}).
+			Do(ctx)
+		return err
+	}
+	if dims != p.embedder.Dimensions() {
+		return fmt.Errorf("catalog index holds embeddings of %d dimensions, the embedder makes %d: configure matching dimensions or reindex the catalog", dims, p.embedder.Dimensions())
+	}
+	return nil
+}
 
-	Logs.Info(ctx, "Catalog index does not exist. Creating...")
-	return p.CreateCatalogIndexWithAutocomplete(ctx)
+// addedProductMappings maps the fields products gained after the first catalog index. The
+// category, tags and attributes are exact values, attributes are nested so a filter on a key
+// and a value matches them in the same attribute
+var addedProductMappings = map[string]interface{}{
+	"deleted": map[string]interface{}{
+		"type": "boolean",
+	},
+	"created_at": map[string]interface{}{
+		"type": "date",
+	},
+	"category_id": map[string]interface{}{
+		"type": "keyword",
+	},
+	"category_path": map[string]interface{}{
+		"type": "keyword",
+	},
+	"tags": map[string]interface{}{
+		"type": "keyword",
+	},
+	"attributes": map[string]interface{}{
+		"type": "nested",
+		"properties": map[string]interface{}{
+			"key":     map[string]interface{}{"type": "keyword"},
+			"type":    map[string]interface{}{"type": "keyword"},
+			"value":   map[string]interface{}{"type": "keyword"},
+			"number":  map[string]interface{}{"type": "double"},
+			"boolean": map[string]interface{}{"type": "boolean"},
+		},
+	},
 }
 
 // CreateCatalogIndexWithAutocomplete creates the catalog index with autocomplete analyzer
@@ -548,6 +832,33 @@ func (p *elasticRepository) CreateCatalogIndexWithAutocomplete(ctx context.Conte
 	// 	Logs.Info(ctx, "Deleted existing catalog index")
 	// }
 
+	properties := map[string]interface{}{
+		"name": map[string]interface{}{
+			"type":            "text",
+			"analyzer":        "autocomplete_analyzer",
+			"search_analyzer": "standard",
+		},
+		"description": map[string]interface{}{
+			"type": "text",
+		},
+		"price": map[string]interface{}{
+			"type": "float",
+		},
+		"stock": map[string]interface{}{
+			"type": "integer",
+		},
+		"sold": map[string]interface{}{
+			"type": "integer",
+		},
+		"out_of_stock": map[string]interface{}{
+			"type": "boolean",
+		},
+		"embedding": embeddingMapping(p.embedder.Dimensions()),
+	}
+	for field, mapping := range addedProductMappings {
+		properties[field] = mapping
+	}
+
 	// Define settings with EdgeNGram analyzer
 	createIndex, err := p.client.CreateIndex("catalog").
 		BodyJson(map[string]interface{}{
@@ -570,32 +881,7 @@ func (p *elasticRepository) CreateCatalogIndexWithAutocomplete(ctx context.Conte
 				},
 			},
 			"mappings": map[string]interface{}{
-				"properties": map[string]interface{}{
-					"name": map[string]interface{}{
-						"type":            "text",
-						"analyzer":        "autocomplete_analyzer",
-						"search_analyzer": "standard",
-					},
-					"description": map[string]interface{}{
-						"type": "text",
-					},
-					"price": map[string]interface{}{
-						"type": "float",
-					},
-					"stock": map[string]interface{}{
-						"type": "integer",
-					},
-					"sold": map[string]interface{}{
-						"type": "integer",
-					},
-					"out_of_stock": map[string]interface{}{
-						"type": "boolean",
-					},
-					"embedding": map[string]interface{}{
-						"type": "dense_vector",
-						"dims": 1536,
-					},
-				},
+				"properties": properties,
 			},
 		}).Do(ctx)
 
@@ -662,62 +948,262 @@ func (p *elasticRepository) SuggestProducts(ctx context.Context, prefix string,
 			score = *hit.Score
 		}
 
-		suggestions = append(suggestions, Product{
-			ID:          hit.Id,
-			Name:        doc.Name,
-			Description: doc.Description,
-			Price:       doc.Price,
-			Stock:       doc.Stock,
-			Sold:        doc.Sold,
-			OutOfStock:  doc.OutOfStock,
-			Score:       score,
-		})
+		suggestion := toProduct(hit.Id, doc)
+		suggestion.Score = score
+		suggestions = append(suggestions, suggestion)
 	}
 
 	Logs.Info(ctx, "Suggestions found: "+logger.IntToStr(len(suggestions)))
 	return suggestions, nil
 }
 
+// AISuggest runs an approximate kNN search over the HNSW graph of the embeddings, out of stock
+// products are filtered out while the graph is searched, so they do not take places of the k
 func (p *elasticRepository) AISuggest(ctx context.Context, query string, size int) ([]Product, error) {
-	// 1. Call Python service for embedding
-	embedding, err := GetEmbeddingFromPython(query, "")
+	Logs := logger.GetGlobalLogger()
+
+	// 1. Embed the query
+	embedding, err := embedOne(ctx, p.embedder, query)
 	if err != nil {
 		return nil, fmt.Errorf("embedding fetch failed: %w", err)
 	}
 
-	// 2. Run vector search using script_score
+	// 2. Run the kNN search, olivere has no builder for it so the body is written out. More
+	// candidates per shard trade speed for recall
 	searchResult, err := p.client.Search().
 		Index("catalog").
-		Query(elastic.NewFunctionScoreQuery().
-			Query(elastic.NewMatchAllQuery()).
-			AddScoreFunc(elastic.NewScriptFunction(
-				elastic.NewScript("cosineSimilarity(params.query_vector, 'embedding') + 1.0").
-					Param("query_vector", embedding),
-			)),
-		).
-		Size(size).
+		Source(map[string]interface{}{
+			"knn": map[string]interface{}{
+				"field":          "embedding",
+				"query_vector":   embedding,
+				"k":              size,
+				"num_candidates": min(max(knnCandidatesPerResult*size, minKNNCandidates), maxKNNCandidates),
+				"filter":         map[string]interface{}{"term": map[string]interface{}{"out_of_stock": false}},
+			},
+			"size":    size,
+			"_source": map[string]interface{}{"excludes": []string{"embedding"}},
+		}).
 		Do(ctx)
 
 	if err != nil {
 		return nil, fmt.Errorf("elasticsearch search failed: %w", err)
 	}
 
-	// 3. Parse results
-	var results []Product
+	// 3. Parse results, the score of a cosine kNN hit is (1 + cosine) / 2
+	results := []Product{}
 	for _, hit := range searchResult.Hits.Hits {
 		var doc productDocument
 		if err := json.Unmarshal(hit.Source, &doc); err != nil {
 			continue
 		}
-		results = append(results, Product{
-			ID:          hit.Id,
-			Name:        doc.Name,
-			Description: doc.Description,
-			Price:       doc.Price,
-			Stock:       doc.Stock,
-			Sold:        doc.Sold,
-			OutOfStock:  doc.OutOfStock,
-		})
+		product := toProduct(hit.Id, doc)
+		if hit.Score != nil {
+			product.Score = *hit.Score
+		}
+		results = append(results, product)
 	}
+	Logs.Info(ctx, "Vector suggestions found: "+logger.IntToStr(len(results)))
 	return results, nil
 }
+
+type categoryDocument struct {
+	Name     string   `json:"name"`      // Category name
+	ParentID string   `json:"parent_id"` // Parent category, empty at the top level
+	Path     []string `json:"path"`      // IDs of the ancestors and the category itself, root first
+}
+
+// ensureCategoryIndex creates the categories index unless it exists
+func (p *elasticRepository) ensureCategoryIndex(ctx context.Context) error {
+	Logs := logger.GetGlobalLogger()
+
+	exists, err := p.client.IndexExists("categories").Do(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to check if categories index exists: %w", err)
+	}
+	if exists {
+		return nil
+	}
+
+	Logs.Info(ctx, "Categories index does not exist. Creating...")
+	createIndex, err := p.client.CreateIndex("categories").
+		BodyJson(map[string]interface{}{
+			"mappings": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"name": map[string]interface{}{
+						"type": "text",
+						"fields": map[string]interface{}{
+							"raw": map[string]interface{}{"type": "keyword"},
+						},
+					},
+					"parent_id": map[string]interface{}{
+						"type": "keyword",
+					},
+					"path": map[string]interface{}{
+						"type": "keyword",
+					},
+				},
+			},
+		}).Do(ctx)
+	if err != nil {
+		Logs.Error(ctx, "Failed to create categories index: "+err.Error())
+		return err
+	}
+	if !createIndex.Acknowledged {
+		return fmt.Errorf("categories index creation not acknowledged")
+	}
+	return nil
+}
+
+func (p *elasticRepository) CreateCategory(ctx context.Context, category Category) error {
+	Logs := logger.GetGlobalLogger()
+	Logs.Info(ctx, "Indexing category: "+category.ID)
+
+	_, err := p.client.Index().
+		Index("categories").
+		Id(category.ID).
+		BodyJson(categoryDocument{Name: category.Name, ParentID: category.ParentID, Path: category.Path}).
+		Refresh("true").
+		Do(ctx)
+	if err != nil {
+		Logs.Error(ctx, "Failed to index category: "+category.ID+": "+err.Error())
+		return err
+	}
+	return nil
+}
+
+func (p *elasticRepository) GetCategoryByID(ctx context.Context, id string) (*Category, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.Info(ctx, "Fetching category by ID: "+id)
+
+	res, err := p.client.Get().Index("categories").Id(id).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil, errNotFound
+	}
+	if err != nil {
+		Logs.Error(ctx, "Failed to fetch category by ID: "+err.Error())
+		return nil, err
+	}
+	if !res.Found {
+		return nil, errNotFound
+	}
+	var doc categoryDocument
+	if err := json.Unmarshal(res.Source, &doc); err != nil {
+		Logs.Error(ctx, "Failed to unmarshal category: "+err.Error())
+		return nil, err
+	}
+	return &Category{ID: id, Name: doc.Name, ParentID: doc.ParentID, Path: doc.Path}, nil
+}
+
+// ListCategories returns the whole tree sorted by name, catalogs have far fewer categories
+// than a search can return at once
+func (p *elasticRepository) ListCategories(ctx context.Context) ([]Category, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.Info(ctx, "Listing categories")
+
+	res, err := p.client.Search().
+		Index("categories").
+		Query(elastic.NewMatchAllQuery()).
+		Sort("name.raw", true).
+		Size(10000).
+		Do(ctx)
+	if err != nil {
+		Logs.Error(ctx, "Failed to list categories: "+err.Error())
+		return nil, err
+	}
+	categories := []Category{}
+	for _, hit := range res.Hits.Hits {
+		var doc categoryDocument
+		if err := json.Unmarshal(hit.Source, &doc); err != nil {
+			Logs.Error(ctx, "Unmarshal failed for category: "+hit.Id+" | "+err.Error())
+			continue
+		}
+		categories = append(categories, Category{ID: hit.Id, Name: doc.Name, ParentID: doc.ParentID, Path: doc.Path})
+	}
+	return categories, nil
+}
+
+// movePathScript replaces the part of a path up to and including params.id with params.path
+const movePathScript = `
+	def path = ctx._source[params.field];
+	if (path != null) {
+		int i = path.indexOf(params.id);
+		if (i >= 0) {
+			def moved = new ArrayList(params.path);
+			moved.addAll(path.subList(i + 1, path.size()));
+			ctx._source[params.field] = moved;
+		}
+	}
+`
+
+func (p *elasticRepository) UpdateCategory(ctx context.Context, category Category, oldPath []string) error {
+	Logs := logger.GetGlobalLogger()
+	Logs.Info(ctx, "Updating category: "+category.ID)
+
+	// Step 1: Store the new name, parent and path
+	_, err := p.client.Index().
+		Index("categories").
+		Id(category.ID).
+		BodyJson(categoryDocument{Name: category.Name, ParentID: category.ParentID, Path: category.Path}).
+		Refresh("true").
+		Do(ctx)
+	if err != nil {
+		Logs.Error(ctx, "Failed to update category: "+category.ID+": "+err.Error())
+		return err
+	}
+	if slices.Equal(oldPath, category.Path) {
+		return nil
+	}
+
+	// Step 2: Move the subcategories and the products under them along
+	for index, field := range map[string]string{"categories": "path", "catalog": "category_path"} {
+		script := elastic.NewScriptInline(movePathScript).Lang("painless").Params(map[string]interface{}{
+			"field": field,
+			"id":    category.ID,
+			"path":  category.Path,
+		})
+		_, err := p.client.UpdateByQuery(index).
+			Query(elastic.NewTermQuery(field, category.ID)).
+			Script(script).
+			Refresh("true").
+			Do(ctx)
+		if err != nil {
+			Logs.Error(ctx, "Failed to move "+index+" under category "+category.ID+": "+err.Error())
+			return err
+		}
+	}
+
+	Logs.Info(ctx, "Category updated: "+category.ID)
+	return nil
+}
+
+func (p *elasticRepository) DeleteCategory(ctx context.Context, id string) error {
+	Logs := logger.GetGlobalLogger()
+	Logs.Info(ctx, "Deleting category: "+id)
+
+	// Step 1: Refuse to orphan subcategories or products
+	children, err := p.client.Count("categories").Query(elastic.NewTermQuery("parent_id", id)).Do(ctx)
+	if err != nil {
+		Logs.Error(ctx, "Failed to count subcategories: "+err.Error())
+		return err
+	}
+	products, err := p.client.Count("catalog").Query(elastic.NewTermQuery("category_id", id)).Do(ctx)
+	if err != nil {
+		Logs.Error(ctx, "Failed to count products of category: "+err.Error())
+		return err
+	}
+	if children > 0 || products > 0 {
+		return errCategoryInUse
+	}
+
+	// Step 2: Delete the category
+	_, err = p.client.Delete().Index("categories").Id(id).Refresh("true").Do(ctx)
+	if elastic.IsNotFound(err) {
+		return errNotFound
+	}
+	if err != nil {
+		Logs.Error(ctx, "Failed to delete category: "+err.Error())
+		return err
+	}
+	Logs.Info(ctx, "Category deleted: "+id)
+	return nil
+}
@@ -0,0 +1,663 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+var errInsufficientStock = errors.New("insufficient stock")
+
+// Sizes of the edge n-grams the autocomplete analyzer indexes product names with
+const (
+	minNameGram = 2
+	maxNameGram = 20
+)
+
+// inMemoryRepository keeps products in process memory, for tests and local runs. It matches
+// queries the way the analyzers of the catalog index do: names are indexed as edge n-grams of
+// their words, descriptions as words, and both are searched word by word. Relevance scores
+// are simpler than the BM25 scores of Elasticsearch, so results tied on score may come back
+// in another order
+type inMemoryRepository struct {
+	mu       sync.RWMutex
+	products map[string]*memoryProduct
+	order    []string // IDs in the order they were created, match_all returns documents in this order
+	// embedder turns products and queries into vectors for AISuggest
+	embedder   Embedder
+	categories map[string]Category
+}
+
+type memoryProduct struct {
+	Product
+	embedding []float64
+	deleted   bool
+}
+
+// NewInMemoryRepository keeps the catalog in memory, products and queries are embedded by
+// embedder. NewLocalEmbedder needs no embedding service
+func NewInMemoryRepository(embedder Embedder) Repository {
+	return &inMemoryRepository{
+		products:   make(map[string]*memoryProduct),
+		embedder:   embedder,
+		categories: make(map[string]Category),
+	}
+}
+
+func (r *inMemoryRepository) CreateProduct(ctx context.Context, product Product) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// indexing a document with an existing ID replaces it, as Elasticsearch does
+	if _, ok := r.products[product.ID]; !ok {
+		r.order = append(r.order, product.ID)
+	}
+	r.products[product.ID] = &memoryProduct{Product: Product{
+		ID:           product.ID,
+		Name:         product.Name,
+		Description:  product.Description,
+		Price:        product.Price,
+		Stock:        product.Stock,
+		CategoryID:   product.CategoryID,
+		CategoryPath: slices.Clone(product.CategoryPath),
+		Tags:         slices.Clone(product.Tags),
+		Attributes:   slices.Clone(product.Attributes),
+		CreatedAt:    product.CreatedAt,
+	}}
+	return nil
+}
+
+// stored returns the fields a product document holds, without the request-only Quantity and Score
+func (p *memoryProduct) stored() Product {
+	return Product{
+		ID:           p.ID,
+		Name:         p.Name,
+		Description:  p.Description,
+		Price:        p.Price,
+		Stock:        p.Stock,
+		Sold:         p.Sold,
+		OutOfStock:   p.OutOfStock,
+		CategoryID:   p.CategoryID,
+		CategoryPath: slices.Clone(p.CategoryPath),
+		Tags:         slices.Clone(p.Tags),
+		Attributes:   slices.Clone(p.Attributes),
+		CreatedAt:    p.CreatedAt,
+	}
+}
+
+func (r *inMemoryRepository) GetProductByID(ctx context.Context, id string) (*Product, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	p, ok := r.products[id]
+	if !ok {
+		return nil, errNotFound
+	}
+	if p.OutOfStock {
+		return nil, errOutOfStock
+	}
+	product := p.stored()
+	return &product, nil
+}
+
+func (r *inMemoryRepository) ListProductsWithIDs(ctx context.Context, ids []string) ([]Product, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	products := []Product{}
+	for _, id := range ids {
+		if p, ok := r.products[id]; ok && !p.OutOfStock {
+			products = append(products, p.stored())
+		}
+	}
+	return products, nil
+}
+
+// words splits text like the standard analyzer: lowercased runs of letters and digits
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+}
+
+// nameGrams returns the edge n-grams the autocomplete analyzer indexes a name as
+func nameGrams(name string) map[string]bool {
+	grams := map[string]bool{}
+	for _, word := range words(name) {
+		runes := []rune(word)
+		for n := minNameGram; n <= len(runes) && n <= maxNameGram; n++ {
+			grams[string(runes[:n])] = true
+		}
+	}
+	return grams
+}
+
+type scoredProduct struct {
+	*memoryProduct
+	score float64
+}
+
+// rank sorts hits by score, best first, and breaks ties by ID so results are stable
+func rank(hits []scoredProduct) {
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].score != hits[j].score {
+			return hits[i].score > hits[j].score
+		}
+		return hits[i].ID < hits[j].ID
+	})
+}
+
+// textScore scores a product by the query words found in its name or in its description,
+// whichever field has more, like a best_fields multi_match. Any one word is enough to match
+func textScore(p *memoryProduct, terms []string) float64 {
+	grams := nameGrams(p.Name)
+	description := map[string]bool{}
+	for _, word := range words(p.Description) {
+		description[word] = true
+	}
+	var inName, inDescription float64
+	for _, term := range terms {
+		if grams[term] {
+			inName++
+		}
+		if description[term] {
+			inDescription++
+		}
+	}
+	return math.Max(inName, inDescription)
+}
+
+// matchesFilters applies the filters of a search, everything but the words
+func matchesFilters(p *memoryProduct, query SearchQuery) bool {
+	if query.MinPrice != nil && p.Price < *query.MinPrice {
+		return false
+	}
+	if query.MaxPrice != nil && p.Price > *query.MaxPrice {
+		return false
+	}
+	if query.CategoryID != "" && !slices.Contains(p.CategoryPath, query.CategoryID) {
+		return false
+	}
+	if len(query.Tags) > 0 && !slices.ContainsFunc(query.Tags, func(tag string) bool { return slices.Contains(p.Tags, tag) }) {
+		return false
+	}
+	if p.deleted {
+		return false
+	}
+	return !query.InStockOnly || p.Stock > 0
+}
+
+// sortKey places a hit in the order of a search, lower keys first. Products without a creation
+// time come last, as with missing: _last
+func sortKey(hit scoredProduct, order string) float64 {
+	switch order {
+	case SortPriceAsc:
+		return hit.Price
+	case SortPriceDesc:
+		return -hit.Price
+	case SortBestSelling:
+		return -float64(hit.Sold)
+	case SortNewest:
+		if hit.CreatedAt.IsZero() {
+			return math.MaxInt64
+		}
+		return -float64(hit.CreatedAt.UnixMilli())
+	default:
+		return -hit.score
+	}
+}
+
+// sortHits orders hits for a search and breaks ties by ID, so every page sees the same order
+// and a cursor of sort key and ID places a product in it
+func sortHits(hits []scoredProduct, order string) {
+	sort.Slice(hits, func(i, j int) bool {
+		if ki, kj := sortKey(hits[i], order), sortKey(hits[j], order); ki != kj {
+			return ki < kj
+		}
+		return hits[i].ID < hits[j].ID
+	})
+}
+
+// afterCursor tells whether a hit comes after the position of a cursor of sortHits
+func afterCursor(hit scoredProduct, order string, cursor *productCursor) (bool, error) {
+	if len(cursor.After) != 2 {
+		return false, errInvalidCursor
+	}
+	key, ok := cursor.After[0].(float64)
+	id, ok2 := cursor.After[1].(string)
+	if !ok || !ok2 {
+		return false, errInvalidCursor
+	}
+	if k := sortKey(hit, order); k != key {
+		return k > key, nil
+	}
+	return hit.ID > id, nil
+}
+
+// termBuckets returns the size most frequent values, ties by value, like a terms aggregation
+func termBuckets(counts map[string]int64, size int) []FacetBucket {
+	buckets := []FacetBucket{}
+	for key, count := range counts {
+		buckets = append(buckets, FacetBucket{Key: key, Count: count})
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		if buckets[i].Count != buckets[j].Count {
+			return buckets[i].Count > buckets[j].Count
+		}
+		return buckets[i].Key < buckets[j].Key
+	})
+	if len(buckets) > size {
+		buckets = buckets[:size]
+	}
+	return buckets
+}
+
+// priceBuckets counts prices in buckets of interval width, lowest first, leaving out empty ones
+// like a histogram aggregation with a min_doc_count of 1
+func priceBuckets(hits []scoredProduct, interval float64) []FacetBucket {
+	counts := map[float64]int64{}
+	for _, hit := range hits {
+		counts[math.Floor(hit.Price/interval)*interval]++
+	}
+	froms := make([]float64, 0, len(counts))
+	for from := range counts {
+		froms = append(froms, from)
+	}
+	sort.Float64s(froms)
+	buckets := make([]FacetBucket, len(froms))
+	for i, from := range froms {
+		buckets[i] = FacetBucket{Key: priceBucketKey(from, interval), Count: counts[from]}
+	}
+	return buckets
+}
+
+func (r *inMemoryRepository) SearchProducts(ctx context.Context, query SearchQuery, after *productCursor) (*SearchResult, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	// without words every product matches with the same score, like match_all
+	terms := words(query.Query)
+	hits := []scoredProduct{}
+	for _, id := range r.order {
+		p := r.products[id]
+		if !matchesFilters(p, query) {
+			continue
+		}
+		score := 1.0
+		if len(terms) > 0 {
+			if score = textScore(p, terms); score == 0 {
+				continue
+			}
+		}
+		hits = append(hits, scoredProduct{p, score})
+	}
+	sortHits(hits, query.Sort)
+
+	// a cursor takes the place of skip, the page starts at the first hit after it
+	start := query.Skip
+	if after != nil {
+		start = uint64(len(hits))
+		for i, hit := range hits {
+			ok, err := afterCursor(hit, query.Sort, after)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				start = uint64(i)
+				break
+			}
+		}
+	}
+
+	result := &SearchResult{ProductPage: ProductPage{Edges: []ProductEdge{}}, Total: int64(len(hits)), Facets: []Facet{}}
+	for i := start; i < uint64(len(hits)) && i < start+query.Take; i++ {
+		product := hits[i].stored()
+		// Elasticsearch only scores hits sorted by relevance
+		if query.Sort == SortRelevance {
+			product.Score = hits[i].score
+		}
+		cursor := encodeProductCursor(productCursor{Sort: query.Sort, Query: searchQueryHash(query), After: []interface{}{sortKey(hits[i], query.Sort), product.ID}})
+		result.Edges = append(result.Edges, ProductEdge{Product: product, Cursor: cursor})
+	}
+	for _, facet := range query.Facets {
+		var buckets []FacetBucket
+		switch facet.Field {
+		case FacetCategory, FacetTags:
+			counts := map[string]int64{}
+			for _, hit := range hits {
+				values := hit.Tags
+				if facet.Field == FacetCategory {
+					values = hit.CategoryPath
+				}
+				for _, value := range values {
+					counts[value]++
+				}
+			}
+			buckets = termBuckets(counts, facet.Size)
+		case FacetPrice:
+			buckets = priceBuckets(hits, facet.Interval)
+		}
+		result.Facets = append(result.Facets, Facet{Field: facet.Field, Buckets: buckets})
+	}
+	return result, nil
+}
+
+func (r *inMemoryRepository) UpdateStockAndSold(ctx context.Context, id string, quantity int) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p, ok := r.products[id]
+	if !ok {
+		return false, errNotFound
+	}
+	if int(p.Stock) < quantity {
+		return false, errInsufficientStock
+	}
+	p.Stock = uint32(int(p.Stock) - quantity)
+	p.Sold = uint32(int(p.Sold) + quantity)
+	if p.Stock == 0 {
+		p.OutOfStock = true
+	}
+	return true, nil
+}
+
+func (r *inMemoryRepository) DeleteProductByID(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p, ok := r.products[id]
+	if !ok {
+		return errNotFound
+	}
+	p.OutOfStock = true
+	p.deleted = true
+	p.Stock = 0
+	return nil
+}
+
+func (r *inMemoryRepository) RestockProduct(ctx context.Context, id string, newStock int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p, ok := r.products[id]
+	if !ok {
+		return errNotFound
+	}
+	p.Stock = uint32(newStock)
+	p.OutOfStock = false
+	p.deleted = false
+	return nil
+}
+
+func (r *inMemoryRepository) EnsureCatalogIndex(ctx context.Context) error {
+	return nil
+}
+
+func (r *inMemoryRepository) CreateCatalogIndexWithAutocomplete(ctx context.Context) error {
+	return nil
+}
+
+// fuzziness is the edit distance the AUTO fuzziness of Elasticsearch allows for a term
+func fuzziness(term string) int {
+	switch n := len([]rune(term)); {
+	case n <= 2:
+		return 0
+	case n <= 5:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// editDistance counts insertions, deletions, substitutions and swaps of neighbouring letters,
+// the edits fuzzy queries allow
+func editDistance(a, b string) int {
+	s, t := []rune(a), []rune(b)
+	d := make([][]int, len(s)+1)
+	for i := range d {
+		d[i] = make([]int, len(t)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(s)][len(t)]
+}
+
+// matchTerm scores a query term against the grams of a name, 1 for an exact gram and less for
+// a fuzzy one. The first letter has to match, as with a prefix length of 1
+func matchTerm(term string, grams map[string]bool) float64 {
+	if grams[term] {
+		return 1
+	}
+	best := 0.0
+	allowed := fuzziness(term)
+	for gram := range grams {
+		if allowed == 0 || []rune(gram)[0] != []rune(term)[0] {
+			continue
+		}
+		if d := editDistance(term, gram); d <= allowed {
+			best = math.Max(best, 1/float64(d+1))
+		}
+	}
+	return best
+}
+
+// SuggestProducts matches every word of prefix against the start of a word of the name, allowing
+// typos, and adds sqrt(1.5 * sold) to the score so best sellers come first
+func (r *inMemoryRepository) SuggestProducts(ctx context.Context, prefix string, size int) ([]Product, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	terms := words(prefix)
+	hits := []scoredProduct{}
+	for _, id := range r.order {
+		p := r.products[id]
+		if p.OutOfStock || len(terms) == 0 {
+			continue
+		}
+		grams := nameGrams(p.Name)
+		score := 0.0
+		for _, term := range terms {
+			s := matchTerm(term, grams)
+			if s == 0 {
+				score = 0
+				break
+			}
+			score += s
+		}
+		if score > 0 {
+			hits = append(hits, scoredProduct{p, score + math.Sqrt(1.5*float64(p.Sold))})
+		}
+	}
+	rank(hits)
+
+	suggestions := []Product{}
+	for i := 0; i < len(hits) && i < size; i++ {
+		product := hits[i].stored()
+		product.Score = hits[i].score
+		suggestions = append(suggestions, product)
+	}
+	return suggestions, nil
+}
+
+func cosineSimilarity(a, b []float64) float64 {
+	var dot, normA, normB float64
+	for i := range a {
+		dot += a[i] * b[i]
+		normA += a[i] * a[i]
+		normB += b[i] * b[i]
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+// embedMissing embeds the products without a vector in one batch. If the batch fails they are
+// embedded one by one, and the products that still fail are left without a vector
+func (r *inMemoryRepository) embedMissing(ctx context.Context, products []*memoryProduct) {
+	texts := make([]string, len(products))
+	for i, p := range products {
+		texts[i] = embeddingText(p.Name, p.Description)
+	}
+	vectors, err := r.embedder.Embed(ctx, texts)
+	if err == nil {
+		for i, p := range products {
+			p.embedding = vectors[i]
+		}
+		return
+	}
+	for i, p := range products {
+		if vector, err := embedOne(ctx, r.embedder, texts[i]); err == nil {
+			p.embedding = vector
+		}
+	}
+}
+
+// AISuggest ranks products in stock by the cosine similarity of their embedding to the query's,
+// scored (1 + cosine) / 2 like a kNN search. Products are embedded the first time a query needs
+// them, where the Elasticsearch repository embeds them in the background once they are created
+func (r *inMemoryRepository) AISuggest(ctx context.Context, query string, size int) ([]Product, error) {
+	embedding, err := embedOne(ctx, r.embedder, query)
+	if err != nil {
+		return nil, fmt.Errorf("embedding fetch failed: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	missing := []*memoryProduct{}
+	for _, id := range r.order {
+		if p := r.products[id]; !p.OutOfStock && p.embedding == nil {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) > 0 {
+		r.embedMissing(ctx, missing)
+	}
+
+	hits := []scoredProduct{}
+	for _, id := range r.order {
+		p := r.products[id]
+		if p.OutOfStock || p.embedding == nil {
+			continue
+		}
+		if len(p.embedding) != len(embedding) {
+			return nil, fmt.Errorf("embedding of %s has %d dimensions, the query %d", id, len(p.embedding), len(embedding))
+		}
+		hits = append(hits, scoredProduct{p, (1 + cosineSimilarity(embedding, p.embedding)) / 2})
+	}
+	rank(hits)
+
+	results := []Product{}
+	for i := 0; i < len(hits) && i < size; i++ {
+		product := hits[i].stored()
+		product.Score = hits[i].score
+		results = append(results, product)
+	}
+	return results, nil
+}
+
+func (r *inMemoryRepository) CreateCategory(ctx context.Context, category Category) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	category.Path = slices.Clone(category.Path)
+	r.categories[category.ID] = category
+	return nil
+}
+
+func (r *inMemoryRepository) GetCategoryByID(ctx context.Context, id string) (*Category, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	category, ok := r.categories[id]
+	if !ok {
+		return nil, errNotFound
+	}
+	category.Path = slices.Clone(category.Path)
+	return &category, nil
+}
+
+func (r *inMemoryRepository) ListCategories(ctx context.Context) ([]Category, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	categories := []Category{}
+	for _, category := range r.categories {
+		category.Path = slices.Clone(category.Path)
+		categories = append(categories, category)
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		if categories[i].Name != categories[j].Name {
+			return categories[i].Name < categories[j].Name
+		}
+		return categories[i].ID < categories[j].ID
+	})
+	return categories, nil
+}
+
+// movePath replaces the part of path up to and including id with moved, as movePathScript does
+func movePath(path []string, id string, moved []string) []string {
+	i := slices.Index(path, id)
+	if i < 0 {
+		return path
+	}
+	return append(slices.Clone(moved), path[i+1:]...)
+}
+
+func (r *inMemoryRepository) UpdateCategory(ctx context.Context, category Category, oldPath []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	category.Path = slices.Clone(category.Path)
+	r.categories[category.ID] = category
+	for id, c := range r.categories {
+		c.Path = movePath(c.Path, category.ID, category.Path)
+		r.categories[id] = c
+	}
+	for _, p := range r.products {
+		p.CategoryPath = movePath(p.CategoryPath, category.ID, category.Path)
+	}
+	return nil
+}
+
+func (r *inMemoryRepository) DeleteCategory(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.categories[id]; !ok {
+		return errNotFound
+	}
+	for _, c := range r.categories {
+		if c.ParentID == id {
+			return errCategoryInUse
+		}
+	}
+	for _, p := range r.products {
+		if p.CategoryID == id {
+			return errCategoryInUse
+		}
+	}
+	delete(r.categories, id)
+	return nil
+}
@@ -0,0 +1,658 @@
+package catalog
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ksuid"
+)
+
+func TestInMemoryRepository(t *testing.T) {
+	testRepository(t, NewInMemoryRepository(newTestEmbedder(t)), func() {})
+}
+
+func newTestEmbedder(t testing.TB) Embedder {
+	t.Helper()
+	embedder, err := NewLocalEmbedder(64)
+	if err != nil {
+		t.Fatalf("NewLocalEmbedder: %v", err)
+	}
+	return embedder
+}
+
+// vectorEmbedder embeds the texts it has a vector for, any case, and fails on the rest
+type vectorEmbedder map[string][]float64
+
+func (e vectorEmbedder) Dimensions() int {
+	return 3
+}
+
+func (e vectorEmbedder) Embed(ctx context.Context, texts []string) ([][]float64, error) {
+	vectors := [][]float64{}
+	for _, text := range texts {
+		v, ok := e[strings.ToLower(text)]
+		if !ok {
+			return nil, errors.New("no vector for " + text)
+		}
+		vectors = append(vectors, v)
+	}
+	return vectors, nil
+}
+
+// TestElasticRepository needs Elasticsearch, CATALOG_TEST_ELASTICSEARCH_URL points to it. The
+// products go to the catalog index with words no other product has, so runs do not see each other
+func TestElasticRepository(t *testing.T) {
+	url := os.Getenv("CATALOG_TEST_ELASTICSEARCH_URL")
+	if url == "" {
+		t.Skip("CATALOG_TEST_ELASTICSEARCH_URL is not set")
+	}
+	repo, err := NewElasticRepository(url, newTestEmbedder(t))
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	if err := repo.EnsureCatalogIndex(context.Background()); err != nil {
+		t.Fatalf("EnsureCatalogIndex: %v", err)
+	}
+	client := repo.(*elasticRepository).client
+	// searches only see documents indexed before the last refresh
+	testRepository(t, repo, func() {
+		if _, err := client.Refresh("catalog").Do(context.Background()); err != nil {
+			t.Fatalf("refresh: %v", err)
+		}
+	})
+}
+
+// testMarker returns a lowercase word no product of another test or run has
+func testMarker() string {
+	return "zq" + strings.ToLower(ksuid.New().String()[20:])
+}
+
+func productIDs(products []Product) map[string]bool {
+	ids := map[string]bool{}
+	for _, p := range products {
+		ids[p.ID] = true
+	}
+	return ids
+}
+
+func testRepository(t *testing.T, repo Repository, refresh func()) {
+	ctx := context.Background()
+	search := func(query SearchQuery) *SearchResult {
+		t.Helper()
+		query, err := normalizeSearchQuery(query)
+		if err != nil {
+			t.Fatalf("normalizeSearchQuery: %v", err)
+		}
+		var after *productCursor
+		if query.After != "" {
+			if after, err = decodeProductCursor(query.After); err != nil {
+				t.Fatalf("decodeProductCursor: %v", err)
+			}
+		}
+		result, err := repo.SearchProducts(ctx, query, after)
+		if err != nil {
+			t.Fatalf("SearchProducts: %v", err)
+		}
+		return result
+	}
+	create := func(name, description string, stock uint32) Product {
+		t.Helper()
+		p := Product{ID: ksuid.New().String(), Name: name, Description: description, Price: 9.99, Stock: stock}
+		if err := repo.CreateProduct(ctx, p); err != nil {
+			t.Fatalf("CreateProduct: %v", err)
+		}
+		return p
+	}
+
+	t.Run("CreateAndGet", func(t *testing.T) {
+		p := create("Desk Lamp", "A lamp for the desk", 5)
+		got, err := repo.GetProductByID(ctx, p.ID)
+		if err != nil {
+			t.Fatalf("GetProductByID: %v", err)
+		}
+		if got.Name != p.Name || got.Description != p.Description || got.Price != p.Price || got.Stock != 5 || got.Sold != 0 {
+			t.Errorf("GetProductByID = %+v", got)
+		}
+		if _, err := repo.GetProductByID(ctx, ksuid.New().String()); err == nil {
+			t.Error("GetProductByID of an unknown ID succeeded")
+		}
+
+		missing := ksuid.New().String()
+		list, err := repo.ListProductsWithIDs(ctx, []string{p.ID, missing})
+		if err != nil || len(list) != 1 || list[0].ID != p.ID {
+			t.Errorf("ListProductsWithIDs = %v, %v", list, err)
+		}
+	})
+
+	t.Run("Stock", func(t *testing.T) {
+		p := create("Stock Mug", "", 3)
+
+		if ok, err := repo.UpdateStockAndSold(ctx, p.ID, 2); err != nil || !ok {
+			t.Fatalf("UpdateStockAndSold = %t, %v", ok, err)
+		}
+		if ok, err := repo.UpdateStockAndSold(ctx, p.ID, 2); err == nil || ok {
+			t.Errorf("UpdateStockAndSold beyond the stock = %t, %v", ok, err)
+		}
+		got, err := repo.GetProductByID(ctx, p.ID)
+		if err != nil || got.Stock != 1 || got.Sold != 2 {
+			t.Fatalf("after a sale = %+v, %v", got, err)
+		}
+
+		// selling the last unit takes the product out of stock
+		if _, err := repo.UpdateStockAndSold(ctx, p.ID, 1); err != nil {
+			t.Fatalf("UpdateStockAndSold: %v", err)
+		}
+		if _, err := repo.GetProductByID(ctx, p.ID); !errors.Is(err, errOutOfStock) {
+			t.Errorf("GetProductByID of a sold out product = %v, want errOutOfStock", err)
+		}
+		if list, err := repo.ListProductsWithIDs(ctx, []string{p.ID}); err != nil || len(list) != 0 {
+			t.Errorf("ListProductsWithIDs of a sold out product = %v, %v", list, err)
+		}
+
+		if err := repo.RestockProduct(ctx, p.ID, 10); err != nil {
+			t.Fatalf("RestockProduct: %v", err)
+		}
+		got, err = repo.GetProductByID(ctx, p.ID)
+		if err != nil || got.Stock != 10 || got.Sold != 3 {
+			t.Errorf("after a restock = %+v, %v", got, err)
+		}
+
+		if err := repo.DeleteProductByID(ctx, p.ID); err != nil {
+			t.Fatalf("DeleteProductByID: %v", err)
+		}
+		if _, err := repo.GetProductByID(ctx, p.ID); !errors.Is(err, errOutOfStock) {
+			t.Errorf("GetProductByID of a deleted product = %v, want errOutOfStock", err)
+		}
+
+		unknown := ksuid.New().String()
+		if err := repo.DeleteProductByID(ctx, unknown); !errors.Is(err, errNotFound) {
+			t.Errorf("DeleteProductByID of an unknown ID = %v, want errNotFound", err)
+		}
+		if err := repo.RestockProduct(ctx, unknown, 1); !errors.Is(err, errNotFound) {
+			t.Errorf("RestockProduct of an unknown ID = %v, want errNotFound", err)
+		}
+		if _, err := repo.UpdateStockAndSold(ctx, unknown, 1); err == nil {
+			t.Error("UpdateStockAndSold of an unknown ID succeeded")
+		}
+	})
+
+	t.Run("Search", func(t *testing.T) {
+		marker := testMarker()
+		chair := create(marker+" Office Chair", "Ergonomic seat", 4)
+		stool := create("Bar Stool", "A tall seat for the "+marker+" kitchen", 4)
+		table := create(marker+" Table", "Solid oak", 4)
+		gone := create(marker+" Sofa", "Sold out seat", 1)
+		if err := repo.DeleteProductByID(ctx, gone.ID); err != nil {
+			t.Fatalf("DeleteProductByID: %v", err)
+		}
+		refresh()
+
+		// whole words of the description match, and the start of a word of the name
+		found := search(SearchQuery{Query: marker, InStockOnly: true})
+		ids := productIDs(found.Products())
+		if len(found.Edges) != 3 || found.Total != 3 || !ids[chair.ID] || !ids[stool.ID] || !ids[table.ID] {
+			t.Errorf("SearchProducts(%q) = %+v", marker, found)
+		}
+		found = search(SearchQuery{Query: marker[:6], InStockOnly: true})
+		if ids := productIDs(found.Products()); len(found.Edges) != 2 || !ids[chair.ID] || !ids[table.ID] {
+			t.Errorf("SearchProducts by the start of a name = %+v", found)
+		}
+
+		// deleted products are never found, sold out ones are only left out on request
+		soldOut := create(marker+" Bench", "The last seat", 1)
+		if _, err := repo.UpdateStockAndSold(ctx, soldOut.ID, 1); err != nil {
+			t.Fatalf("UpdateStockAndSold: %v", err)
+		}
+		refresh()
+		found = search(SearchQuery{Query: marker + " sofa bench", Take: 1})
+		if products := found.Products(); len(products) != 1 || products[0].ID != soldOut.ID || !products[0].OutOfStock || found.Total != 4 {
+			t.Errorf("search ranking a sold out product first = %+v", found)
+		}
+		found = search(SearchQuery{Query: marker + " sofa bench", InStockOnly: true, Take: 1})
+		if products := found.Products(); len(products) != 1 || products[0].ID == soldOut.ID || products[0].ID == gone.ID || found.Total != 3 {
+			t.Errorf("in stock search = %+v", found)
+		}
+	})
+
+	t.Run("Facets", func(t *testing.T) {
+		// the products share a category no other run has, which keeps the counts to them
+		category := ksuid.New().String()
+		sub := ksuid.New().String()
+		createdAt := time.Now().UTC().Truncate(time.Millisecond)
+		add := func(name string, price float64, path []string, tags []string, age time.Duration) Product {
+			t.Helper()
+			p := Product{
+				ID: ksuid.New().String(), Name: name, Price: price, Stock: 5,
+				CategoryID: path[len(path)-1], CategoryPath: path, Tags: tags, CreatedAt: createdAt.Add(-age),
+			}
+			if err := repo.CreateProduct(ctx, p); err != nil {
+				t.Fatalf("CreateProduct: %v", err)
+			}
+			return p
+		}
+		mug := add("Facet Mug", 8, []string{category}, []string{"kitchen", "gift"}, 3*time.Hour)
+		kettle := add("Facet Kettle", 45, []string{category, sub}, []string{"kitchen"}, 2*time.Hour)
+		lamp := add("Facet Lamp", 120, []string{category, sub}, []string{"gift"}, time.Hour)
+		if _, err := repo.UpdateStockAndSold(ctx, kettle.ID, 3); err != nil {
+			t.Fatalf("UpdateStockAndSold: %v", err)
+		}
+		refresh()
+
+		order := func(result *SearchResult) []string {
+			ids := []string{}
+			for _, p := range result.Products() {
+				ids = append(ids, p.ID)
+			}
+			return ids
+		}
+		for sort, want := range map[string][]string{
+			SortNewest:      {lamp.ID, kettle.ID, mug.ID},
+			SortPriceAsc:    {mug.ID, kettle.ID, lamp.ID},
+			SortPriceDesc:   {lamp.ID, kettle.ID, mug.ID},
+			SortBestSelling: {kettle.ID},
+		} {
+			got := order(search(SearchQuery{CategoryID: category, Sort: sort}))
+			if !slices.Equal(got[:len(want)], want) {
+				t.Errorf("sorted by %s = %v, want %v first", sort, got, want)
+			}
+		}
+
+		minPrice, maxPrice := 10.0, 100.0
+		found := search(SearchQuery{CategoryID: category, MinPrice: &minPrice, MaxPrice: &maxPrice})
+		if ids := order(found); len(ids) != 1 || ids[0] != kettle.ID {
+			t.Errorf("price range = %v", ids)
+		}
+		found = search(SearchQuery{CategoryID: sub, Tags: []string{"GIFT", "travel"}})
+		if ids := order(found); len(ids) != 1 || ids[0] != lamp.ID {
+			t.Errorf("subcategory and tags = %v", ids)
+		}
+
+		found = search(SearchQuery{CategoryID: category, Take: 1, Facets: []FacetRequest{
+			{Field: FacetCategory}, {Field: FacetTags, Size: 1}, {Field: FacetPrice, Interval: 50},
+		}})
+		if len(found.Edges) != 1 || found.Total != 3 || len(found.Facets) != 3 {
+			t.Fatalf("faceted search = %+v", found)
+		}
+		wantFacets := []Facet{
+			{Field: FacetCategory, Buckets: []FacetBucket{{Key: category, Count: 3}, {Key: sub, Count: 2}}},
+			{Field: FacetTags, Buckets: []FacetBucket{{Key: "gift", Count: 2}}},
+			{Field: FacetPrice, Buckets: []FacetBucket{{Key: "0-50", Count: 2}, {Key: "100-150", Count: 1}}},
+		}
+		for i, want := range wantFacets {
+			if got := found.Facets[i]; got.Field != want.Field || !slices.Equal(got.Buckets, want.Buckets) {
+				t.Errorf("facet %s = %+v, want %+v", want.Field, got.Buckets, want.Buckets)
+			}
+		}
+	})
+
+	t.Run("Pages", func(t *testing.T) {
+		createdAt := time.Now().UTC().Truncate(time.Millisecond)
+		for _, sort := range []string{SortNewest, SortPriceAsc} {
+			// every sort pages its own products, in a category no other run has
+			category := ksuid.New().String()
+			add := func(name string, price float64, age time.Duration) Product {
+				t.Helper()
+				p := Product{
+					ID: ksuid.New().String(), Name: name, Price: price, Stock: 5,
+					CategoryID: category, CategoryPath: []string{category}, CreatedAt: createdAt.Add(-age),
+				}
+				if err := repo.CreateProduct(ctx, p); err != nil {
+					t.Fatalf("CreateProduct: %v", err)
+				}
+				return p
+			}
+			// two products tie on price, the tiebreaker keeps them on one side of a cursor each
+			products := []Product{
+				add("Page One", 10, 5*time.Hour),
+				add("Page Two", 20, 4*time.Hour),
+				add("Page Three", 20, 3*time.Hour),
+				add("Page Four", 30, 2*time.Hour),
+				add("Page Five", 40, time.Hour),
+			}
+			refresh()
+
+			seen := map[string]bool{}
+			after := ""
+			for pages := 0; ; pages++ {
+				if pages > len(products) {
+					t.Fatalf("sorted by %s, paging does not end", sort)
+				}
+				page := search(SearchQuery{CategoryID: category, Sort: sort, Take: 2, After: after})
+				for _, edge := range page.Edges {
+					if seen[edge.Product.ID] {
+						t.Errorf("sorted by %s, %s came twice", sort, edge.Product.Name)
+					}
+					seen[edge.Product.ID] = true
+				}
+				if len(page.Edges) < 2 {
+					break
+				}
+				after = page.Edges[len(page.Edges)-1].Cursor
+				if pages == 0 {
+					// a product created after the first page sorts before it, and does not
+					// shift the pages after it
+					add("Page Late", 0, 0)
+					refresh()
+				}
+			}
+			if len(seen) != len(products) {
+				t.Errorf("sorted by %s, paging saw %d products, want %d", sort, len(seen), len(products))
+			}
+		}
+	})
+
+	t.Run("Suggest", func(t *testing.T) {
+		marker := testMarker()
+		lamp := create(marker+" Lantern", "", 10)
+		lampPopular := create(marker+" Lanterns", "", 10)
+		create(marker+" Blanket", "", 10)
+		gone := create(marker+" Lantern Sold Out", "", 1)
+		if _, err := repo.UpdateStockAndSold(ctx, lampPopular.ID, 8); err != nil {
+			t.Fatalf("UpdateStockAndSold: %v", err)
+		}
+		if _, err := repo.UpdateStockAndSold(ctx, gone.ID, 1); err != nil {
+			t.Fatalf("UpdateStockAndSold: %v", err)
+		}
+		refresh()
+
+		// every word has to match, the last one may be the start of a word and have a typo
+		suggestions, err := repo.SuggestProducts(ctx, marker+" lantren", 10)
+		if err != nil {
+			t.Fatalf("SuggestProducts: %v", err)
+		}
+		if len(suggestions) != 2 || suggestions[0].ID != lampPopular.ID || suggestions[1].ID != lamp.ID {
+			t.Fatalf("SuggestProducts = %v, want the best seller first and no sold out product", suggestions)
+		}
+		if suggestions[0].Score <= suggestions[1].Score {
+			t.Errorf("scores = %f, %f", suggestions[0].Score, suggestions[1].Score)
+		}
+
+		suggestions, err = repo.SuggestProducts(ctx, marker+" lan", 1)
+		if err != nil || len(suggestions) != 1 {
+			t.Errorf("SuggestProducts with size 1 = %v, %v", suggestions, err)
+		}
+		suggestions, err = repo.SuggestProducts(ctx, marker+" xylophone", 10)
+		if err != nil || len(suggestions) != 0 {
+			t.Errorf("SuggestProducts without a match = %v, %v", suggestions, err)
+		}
+	})
+
+	t.Run("Categories", func(t *testing.T) {
+		home := Category{ID: ksuid.New().String(), Name: "Home"}
+		home.Path = []string{home.ID}
+		lighting := Category{ID: ksuid.New().String(), Name: "Lighting", ParentID: home.ID}
+		lighting.Path = []string{home.ID, lighting.ID}
+		for _, c := range []Category{home, lighting} {
+			if err := repo.CreateCategory(ctx, c); err != nil {
+				t.Fatalf("CreateCategory: %v", err)
+			}
+		}
+		lamp := Product{
+			ID: ksuid.New().String(), Name: "Category Lamp", Price: 9.99, Stock: 1,
+			CategoryID: lighting.ID, CategoryPath: lighting.Path,
+			Tags:       []string{"desk", "led"},
+			Attributes: []Attribute{{Key: "brand", Type: AttributeText, Value: "Lumo"}, {Key: "watts", Type: AttributeNumber, Value: "7.5"}},
+		}
+		if err := repo.CreateProduct(ctx, lamp); err != nil {
+			t.Fatalf("CreateProduct: %v", err)
+		}
+
+		got, err := repo.GetProductByID(ctx, lamp.ID)
+		if err != nil {
+			t.Fatalf("GetProductByID: %v", err)
+		}
+		if got.CategoryID != lighting.ID || !slices.Equal(got.CategoryPath, lighting.Path) || !slices.Equal(got.Tags, lamp.Tags) || !slices.Equal(got.Attributes, lamp.Attributes) {
+			t.Errorf("GetProductByID = %+v, want the category, tags and attributes", got)
+		}
+		listed, err := repo.ListCategories(ctx)
+		if err != nil {
+			t.Fatalf("ListCategories: %v", err)
+		}
+		if ids := categoryIDs(listed); !ids[home.ID] || !ids[lighting.ID] {
+			t.Errorf("ListCategories = %v, want both categories", listed)
+		}
+
+		// moving a category moves its subcategories and their products along
+		rooms := Category{ID: ksuid.New().String(), Name: "Rooms"}
+		rooms.Path = []string{rooms.ID}
+		if err := repo.CreateCategory(ctx, rooms); err != nil {
+			t.Fatalf("CreateCategory: %v", err)
+		}
+		oldPath := home.Path
+		home.ParentID = rooms.ID
+		home.Path = []string{rooms.ID, home.ID}
+		if err := repo.UpdateCategory(ctx, home, oldPath); err != nil {
+			t.Fatalf("UpdateCategory: %v", err)
+		}
+		refresh()
+		moved, err := repo.GetCategoryByID(ctx, lighting.ID)
+		if want := []string{rooms.ID, home.ID, lighting.ID}; err != nil || !slices.Equal(moved.Path, want) {
+			t.Errorf("subcategory after the move = %+v, %v, want path %v", moved, err, want)
+		}
+		got, err = repo.GetProductByID(ctx, lamp.ID)
+		if want := []string{rooms.ID, home.ID, lighting.ID}; err != nil || !slices.Equal(got.CategoryPath, want) {
+			t.Errorf("product after the move = %+v, %v, want path %v", got, err, want)
+		}
+
+		if err := repo.DeleteCategory(ctx, home.ID); !errors.Is(err, errCategoryInUse) {
+			t.Errorf("DeleteCategory with a subcategory = %v, want errCategoryInUse", err)
+		}
+		if err := repo.DeleteCategory(ctx, lighting.ID); !errors.Is(err, errCategoryInUse) {
+			t.Errorf("DeleteCategory with a product = %v, want errCategoryInUse", err)
+		}
+		empty := Category{ID: ksuid.New().String(), Name: "Empty"}
+		empty.Path = []string{empty.ID}
+		if err := repo.CreateCategory(ctx, empty); err != nil {
+			t.Fatalf("CreateCategory: %v", err)
+		}
+		if err := repo.DeleteCategory(ctx, empty.ID); err != nil {
+			t.Fatalf("DeleteCategory: %v", err)
+		}
+		if _, err := repo.GetCategoryByID(ctx, empty.ID); !errors.Is(err, errNotFound) {
+			t.Errorf("GetCategoryByID of a deleted category = %v, want errNotFound", err)
+		}
+	})
+}
+
+func categoryIDs(categories []Category) map[string]bool {
+	ids := map[string]bool{}
+	for _, c := range categories {
+		ids[c.ID] = true
+	}
+	return ids
+}
+
+// AISuggest needs an embedding service, only the in-memory repository can replace it
+func TestInMemoryAISuggest(t *testing.T) {
+	repo := NewInMemoryRepository(vectorEmbedder{
+		"red":     {1, 0, 0},
+		"green":   {0, 1, 0},
+		"crimson": {0.9, 0.1, 0},
+	}).(*inMemoryRepository)
+
+	ctx := context.Background()
+	for _, name := range []string{"Green", "Red", "Crimson"} {
+		if err := repo.CreateProduct(ctx, Product{ID: ksuid.New().String(), Name: name, Stock: 1}); err != nil {
+			t.Fatalf("CreateProduct: %v", err)
+		}
+	}
+	// deleted products are left out, however close they are
+	for _, p := range repo.products {
+		if p.Name == "Crimson" {
+			if err := repo.DeleteProductByID(ctx, p.ID); err != nil {
+				t.Fatalf("DeleteProductByID: %v", err)
+			}
+		}
+	}
+	results, err := repo.AISuggest(ctx, "crimson", 1)
+	if err != nil {
+		t.Fatalf("AISuggest: %v", err)
+	}
+	if len(results) != 1 || results[0].Name != "Red" {
+		t.Errorf("AISuggest = %v, want the closest product in stock", results)
+	}
+	if _, err := repo.AISuggest(ctx, "blue", 1); err == nil {
+		t.Error("AISuggest without a query embedding succeeded")
+	}
+}
+
+func TestHybridSuggest(t *testing.T) {
+	repo := NewInMemoryRepository(vectorEmbedder{
+		"red mug":     {1, 0, 0},
+		"green mug":   {0, 1, 0},
+		"ruby scarf":  {0.9, 0.1, 0},
+		"cherry vase": {0.8, 0.2, 0},
+		"red":         {1, 0, 0},
+	}).(*inMemoryRepository)
+	ctx := context.Background()
+	for _, name := range []string{"Red Mug", "Green Mug", "Ruby Scarf", "Cherry Vase"} {
+		if err := repo.CreateProduct(ctx, Product{ID: ksuid.New().String(), Name: name, Stock: 1}); err != nil {
+			t.Fatalf("CreateProduct: %v", err)
+		}
+	}
+	names := func(products []Product) []string {
+		result := []string{}
+		for _, p := range products {
+			result = append(result, p.Name)
+		}
+		return result
+	}
+
+	// the mug found by both branches leads, the products only close in meaning follow
+	service := NewCatalogService(repo, HybridConfig{LexicalWeight: 1, VectorWeight: 1, RankConstant: 60, Candidates: 10})
+	got, err := service.SuggestProducts(ctx, "red", 3, SuggestHybrid)
+	if err != nil {
+		t.Fatalf("SuggestProducts: %v", err)
+	}
+	if want := []string{"Red Mug", "Ruby Scarf", "Cherry Vase"}; !slices.Equal(names(got), want) {
+		t.Errorf("hybrid suggestions = %v, want %v", names(got), want)
+	}
+
+	// a branch weighted 0 does not count
+	lexicalOnly := NewCatalogService(repo, HybridConfig{LexicalWeight: 1, RankConstant: 60, Candidates: 10})
+	if got, err := lexicalOnly.SuggestProducts(ctx, "red", 3, SuggestHybrid); err != nil || !slices.Equal(names(got), []string{"Red Mug"}) {
+		t.Errorf("hybrid suggestions without the vector branch = %v, %v", names(got), err)
+	}
+
+	// without a query embedding the lexical branch answers alone
+	if got, err := service.SuggestProducts(ctx, "green", 3, SuggestHybrid); err != nil || !slices.Equal(names(got), []string{"Green Mug"}) {
+		t.Errorf("hybrid suggestions without a vector = %v, %v", names(got), err)
+	}
+	if _, err := service.SuggestProducts(ctx, "red", 3, "random"); !errors.Is(err, errInvalidSuggestMode) {
+		t.Errorf("SuggestProducts with an unknown mode = %v, want errInvalidSuggestMode", err)
+	}
+}
+
+func TestLocalEmbedder(t *testing.T) {
+	if _, err := NewLocalEmbedder(0); !errors.Is(err, errInvalidDimensions) {
+		t.Errorf("NewLocalEmbedder(0) = %v, want errInvalidDimensions", err)
+	}
+	embedder := newTestEmbedder(t)
+	ctx := context.Background()
+	vectors, err := embedder.Embed(ctx, []string{"Red Coffee Mug", "red coffee mug", "red mugs", "garden hose"})
+	if err != nil {
+		t.Fatalf("Embed: %v", err)
+	}
+	if len(vectors) != 4 || len(vectors[0]) != embedder.Dimensions() {
+		t.Fatalf("Embed returned %d vectors of %d dimensions", len(vectors), len(vectors[0]))
+	}
+	if !slices.Equal(vectors[0], vectors[1]) {
+		t.Error("the same words in another case got another vector")
+	}
+	if similarity := cosineSimilarity(vectors[0], vectors[0]); similarity < 0.999 || similarity > 1.001 {
+		t.Errorf("a vector is %v similar to itself, want 1", similarity)
+	}
+	// shared words and trigrams count, so the mugs are closer to each other than to the hose
+	if mugs, hose := cosineSimilarity(vectors[0], vectors[2]), cosineSimilarity(vectors[0], vectors[3]); mugs <= hose {
+		t.Errorf("similarity of the mugs %v, of a mug and the hose %v", mugs, hose)
+	}
+	if _, err := embedder.Embed(ctx, []string{"mug", " ,. "}); !errors.Is(err, errNothingToEmbed) {
+		t.Errorf("Embed of a text without words = %v, want errNothingToEmbed", err)
+	}
+}
+
+func TestHTTPEmbedder(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		batches   []int
+		failures  = 1
+		wrongDims bool
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req embeddingBatchRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		batches = append(batches, len(req.Texts))
+		dims := req.Dimensions
+		if wrongDims {
+			dims--
+		}
+		resp := embeddingBatchResponse{}
+		for i := range req.Texts {
+			vector := make([]float64, dims)
+			vector[i%dims] = 1
+			resp.Embeddings = append(resp.Embeddings, vector)
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	embedder, err := NewHTTPEmbedder(HTTPEmbedderConfig{
+		URL:        server.URL,
+		Dimensions: 4,
+		BatchSize:  2,
+		Timeout:    time.Second,
+		MaxRetries: 2,
+		RetryDelay: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewHTTPEmbedder: %v", err)
+	}
+	ctx := context.Background()
+
+	// the first answer is a 503, the retry gets through, and 5 texts go in batches of 2
+	vectors, err := embedder.Embed(ctx, []string{"a", "b", "c", "d", "e"})
+	if err != nil {
+		t.Fatalf("Embed: %v", err)
+	}
+	if len(vectors) != 5 || !slices.Equal(batches, []int{2, 2, 1}) {
+		t.Errorf("Embed returned %d vectors in batches %v, want 5 in [2 2 1]", len(vectors), batches)
+	}
+
+	// vectors of other dimensions than asked for are refused without retrying
+	mu.Lock()
+	wrongDims = true
+	mu.Unlock()
+	if _, err := embedOne(ctx, embedder, "a"); err == nil || !strings.Contains(err.Error(), "dimensions") {
+		t.Errorf("Embed with wrong dimensions = %v", err)
+	}
+	mu.Lock()
+	if len(batches) != 4 {
+		t.Errorf("a wrong answer was retried, requests %v", batches)
+	}
+	mu.Unlock()
+
+	// a service that stays down fails after the retries
+	server.Close()
+	if _, err := embedOne(ctx, embedder, "a"); err == nil {
+		t.Error("Embed without a service succeeded")
+	}
+}
@@ -0,0 +1,251 @@
+package catalog
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/zenvisjr/building-scalable-microservices/logger"
+)
+
+const (
+	// maxSearchPageSize caps how many products one SearchProducts page can hold, it is also
+	// the page size when the caller does not ask for one
+	maxSearchPageSize = 100
+	// defaultFacetSize is the number of most frequent values a category or tags facet returns
+	defaultFacetSize = 10
+	// maxFacetSize caps the values of one facet
+	maxFacetSize = 100
+	// defaultPriceInterval is the width of the buckets of a price facet
+	defaultPriceInterval = 50
+	// pitKeepAlive is how long a point in time stays open after a page was read from it. A
+	// cursor used later reads on from a new point in time. Only continued searches open one
+	pitKeepAlive = "1m"
+)
+
+// Orders SearchProducts can sort by. Relevance is the default with a query, newest without
+const (
+	SortRelevance   = "relevance"
+	SortPriceAsc    = "price_asc"
+	SortPriceDesc   = "price_desc"
+	SortBestSelling = "best_selling"
+	SortNewest      = "newest"
+)
+
+// Fields SearchProducts can count products by
+const (
+	FacetCategory = "category" // buckets keyed by category ID, a product counts for every ancestor
+	FacetTags     = "tags"
+	FacetPrice    = "price" // buckets keyed "from-to", from inclusive and to exclusive
+)
+
+var (
+	errInvalidSort       = errors.New("invalid sort")
+	errInvalidFacet      = errors.New("invalid facet")
+	errInvalidPriceRange = errors.New("min price is above max price")
+	errInvalidCursor     = errors.New("invalid cursor")
+)
+
+// SearchQuery filters, sorts and pages SearchProducts, zero fields match every product
+type SearchQuery struct {
+	Query       string   // words of the name or the description
+	MinPrice    *float64 // inclusive
+	MaxPrice    *float64 // inclusive
+	CategoryID  string   // the category and its subcategories
+	Tags        []string // any of the tags
+	InStockOnly bool     // leaves out sold out products, deleted products are never found
+	Sort        string
+	Facets      []FacetRequest
+	Skip        uint64
+	Take        uint64
+	After       string // cursor of the product to continue after, Skip is ignored with it
+}
+
+// FacetRequest asks SearchProducts to count the matching products by a field
+type FacetRequest struct {
+	Field    string
+	Size     int     // values returned for category and tags, the most frequent first
+	Interval float64 // bucket width for price
+}
+
+// Facet holds the buckets of a field, counted over all products matching the search
+type Facet struct {
+	Field   string
+	Buckets []FacetBucket
+}
+
+type FacetBucket struct {
+	Key   string
+	Count int64
+}
+
+// ProductEdge is a product of a page and the cursor to continue after it
+type ProductEdge struct {
+	Product Product
+	Cursor  string
+}
+
+// ProductPage is one page of a product listing
+type ProductPage struct {
+	Edges       []ProductEdge
+	EndCursor   string // empty for an empty page
+	HasNextPage bool
+}
+
+// Products returns the products of the page in order
+func (p *ProductPage) Products() []Product {
+	products := make([]Product, len(p.Edges))
+	for i, edge := range p.Edges {
+		products[i] = edge.Product
+	}
+	return products
+}
+
+// SearchResult is a page of products, the number of products on all pages and the facets
+type SearchResult struct {
+	ProductPage
+	Total  int64
+	Facets []Facet
+}
+
+// productCursor is the position of a product in a search: the sort values of the product and,
+// for Elasticsearch, the point in time the search reads or, on a first page read without one, the
+// number of products up to and including it. Cursors carry all their state, so they outlive the
+// catalog process that handed them out. Query is the hash of the search they were taken from
+type productCursor struct {
+	Sort   string        `json:"sort"`
+	Query  string        `json:"query"`
+	PIT    string        `json:"pit,omitempty"`
+	Offset uint64        `json:"offset,omitempty"`
+	After  []interface{} `json:"after"`
+}
+
+// encodeProductCursor keeps cursors opaque to clients, they are only ever passed back as is
+func encodeProductCursor(cursor productCursor) string {
+	raw, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// searchQueryHash identifies the products and the order of a normalized query, a cursor only
+// places a product among the results of the query it was taken from. Facets and paging leave the
+// results as they are, and so does the order of the tags
+func searchQueryHash(query SearchQuery) string {
+	tags := slices.Clone(query.Tags)
+	slices.Sort(tags)
+	raw, _ := json.Marshal(struct {
+		Query       string   `json:"query"`
+		MinPrice    *float64 `json:"min_price"`
+		MaxPrice    *float64 `json:"max_price"`
+		CategoryID  string   `json:"category_id"`
+		Tags        []string `json:"tags"`
+		InStockOnly bool     `json:"in_stock_only"`
+		Sort        string   `json:"sort"`
+	}{query.Query, query.MinPrice, query.MaxPrice, query.CategoryID, tags, query.InStockOnly, query.Sort})
+	sum := sha256.Sum256(raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
+
+func decodeProductCursor(cursor string) (*productCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	decoded := &productCursor{}
+	if err := json.Unmarshal(raw, decoded); err != nil || decoded.Sort == "" || len(decoded.After) == 0 {
+		return nil, errInvalidCursor
+	}
+	return decoded, nil
+}
+
+// normalizeSearchQuery fills in the defaults of a query and rejects sorts and facets the
+// repositories do not know
+func normalizeSearchQuery(query SearchQuery) (SearchQuery, error) {
+	query.Query = strings.TrimSpace(query.Query)
+	query.Tags = normalizeTags(query.Tags)
+	if query.MinPrice != nil && query.MaxPrice != nil && *query.MinPrice > *query.MaxPrice {
+		return query, errInvalidPriceRange
+	}
+	if query.Take == 0 || query.Take > maxSearchPageSize {
+		query.Take = maxSearchPageSize
+	}
+
+	switch query.Sort {
+	case "":
+		query.Sort = SortNewest
+		if query.Query != "" {
+			query.Sort = SortRelevance
+		}
+	case SortRelevance, SortPriceAsc, SortPriceDesc, SortBestSelling, SortNewest:
+	default:
+		return query, errInvalidSort
+	}
+
+	facets := make([]FacetRequest, 0, len(query.Facets))
+	seen := map[string]bool{}
+	for _, facet := range query.Facets {
+		switch facet.Field {
+		case FacetCategory, FacetTags:
+			if facet.Size <= 0 {
+				facet.Size = defaultFacetSize
+			}
+			facet.Size = min(facet.Size, maxFacetSize)
+		case FacetPrice:
+			if facet.Interval <= 0 {
+				facet.Interval = defaultPriceInterval
+			}
+		default:
+			return query, errInvalidFacet
+		}
+		if seen[facet.Field] {
+			return query, errInvalidFacet
+		}
+		seen[facet.Field] = true
+		facets = append(facets, facet)
+	}
+	query.Facets = facets
+	return query, nil
+}
+
+func (s *catalogService) SearchProducts(ctx context.Context, query SearchQuery) (*SearchResult, error) {
+	Logs := logger.GetGlobalLogger()
+
+	query, err := normalizeSearchQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	Logs.LocalOnlyInfo("Searching products | query: \"" + query.Query + "\", sort: " + query.Sort + ", skip: " + logger.Uint64ToStr(query.Skip) + ", take: " + logger.Uint64ToStr(query.Take))
+
+	// Step 1: Continue after the cursor, if one was given. Its sort values only place it in
+	// the results and the order it was taken from
+	var cursor *productCursor
+	if query.After != "" {
+		if cursor, err = decodeProductCursor(query.After); err != nil {
+			return nil, err
+		}
+		if cursor.Sort != query.Sort || cursor.Query != searchQueryHash(query) {
+			return nil, errInvalidCursor
+		}
+		query.Skip = 0
+	}
+
+	// Step 2: One product more than asked for tells whether there is a next page
+	take := query.Take
+	query.Take++
+	result, err := s.repo.SearchProducts(ctx, query, cursor)
+	if err != nil {
+		Logs.Error(ctx, "Search failed: "+err.Error())
+		return nil, err
+	}
+	if uint64(len(result.Edges)) > take {
+		result.Edges = result.Edges[:take]
+		result.HasNextPage = true
+	}
+	if len(result.Edges) > 0 {
+		result.EndCursor = result.Edges[len(result.Edges)-1].Cursor
+	}
+	return result, nil
+}
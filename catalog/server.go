@@ -2,13 +2,19 @@ package catalog
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 
 	"github.com/zenvisjr/building-scalable-microservices/catalog/pb"
 	"github.com/zenvisjr/building-scalable-microservices/logger"
+	"github.com/zenvisjr/building-scalable-microservices/svcauth"
+	"github.com/zenvisjr/building-scalable-microservices/tlsconfig"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type grpcServer struct {
@@ -16,6 +22,23 @@ type grpcServer struct {
 	pb.UnimplementedCatalogServiceServer
 }
 
+// callers lists the services allowed to call each RPC
+var callers = svcauth.Allowlist{
+	pb.CatalogService_PostProduct_FullMethodName:        {"gateway"},
+	pb.CatalogService_GetProduct_FullMethodName:         {"gateway", "order"},
+	pb.CatalogService_GetProducts_FullMethodName:        {"gateway", "order"},
+	pb.CatalogService_SearchProducts_FullMethodName:     {"gateway"},
+	pb.CatalogService_UpdateStockAndSold_FullMethodName: {"order"},
+	pb.CatalogService_DeleteProduct_FullMethodName:      {"gateway"},
+	pb.CatalogService_RestockProduct_FullMethodName:     {"gateway"},
+	pb.CatalogService_SuggestProducts_FullMethodName:    {"gateway"},
+	pb.CatalogService_CreateCategory_FullMethodName:     {"gateway"},
+	pb.CatalogService_GetCategory_FullMethodName:        {"gateway"},
+	pb.CatalogService_ListCategories_FullMethodName:     {"gateway"},
+	pb.CatalogService_UpdateCategory_FullMethodName:     {"gateway"},
+	pb.CatalogService_DeleteCategory_FullMethodName:     {"gateway"},
+}
+
 func ListenGRPC(s Service, port int) error {
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("Initializing gRPC listener for catalog microservice on " + fmt.Sprintf(":%d", port))
@@ -26,21 +49,75 @@ func ListenGRPC(s Service, port int) error {
 		return err
 	}
 
-	server := grpc.NewServer(
-		grpc.UnaryInterceptor(logger.UnaryLoggingInterceptor()),
-	)
-	pb.RegisterCatalogServiceServer(server, &grpcServer{service: s})
-	reflection.Register(server)
+	creds, err := tlsconfig.ServerOption()
+	if err != nil {
+		Logs.Error(context.Background(), "Failed to load TLS config: "+err.Error())
+		return err
+	}
+	server := NewGRPCServer(s, creds)
 
 	Logs.LocalOnlyInfo("Catalog gRPC server started on port " + fmt.Sprintf("%d", port))
 	return server.Serve(lis)
 }
 
+// NewGRPCServer builds the catalog gRPC server without starting it
+func NewGRPCServer(s Service, opts ...grpc.ServerOption) *grpc.Server {
+	server := grpc.NewServer(append(opts,
+		grpc.ChainUnaryInterceptor(logger.UnaryLoggingInterceptor(), svcauth.UnaryServerInterceptor(callers)),
+	)...)
+	pb.RegisterCatalogServiceServer(server, &grpcServer{service: s})
+	reflection.Register(server)
+	return server
+}
+
+func productToPB(p Product) *pb.Product {
+	attributes := make([]*pb.Attribute, len(p.Attributes))
+	for i, a := range p.Attributes {
+		attributes[i] = &pb.Attribute{Key: a.Key, Type: a.Type, Value: a.Value}
+	}
+	product := &pb.Product{
+		Id:           p.ID,
+		Name:         p.Name,
+		Description:  p.Description,
+		Price:        p.Price,
+		Stock:        p.Stock,
+		Sold:         p.Sold,
+		OutOfStock:   p.OutOfStock,
+		Score:        p.Score,
+		CategoryId:   p.CategoryID,
+		CategoryPath: p.CategoryPath,
+		Tags:         p.Tags,
+		Attributes:   attributes,
+	}
+	if !p.CreatedAt.IsZero() {
+		product.CreatedAt = timestamppb.New(p.CreatedAt)
+	}
+	return product
+}
+
+func attributesFromPB(attributes []*pb.Attribute) []Attribute {
+	result := make([]Attribute, len(attributes))
+	for i, a := range attributes {
+		result[i] = Attribute{Key: a.GetKey(), Type: a.GetType(), Value: a.GetValue()}
+	}
+	return result
+}
+
+func categoryToPB(c Category) *pb.Category {
+	return &pb.Category{
+		Id:       c.ID,
+		Name:     c.Name,
+		ParentId: c.ParentID,
+		Path:     c.Path,
+	}
+}
+
 func (g *grpcServer) PostProduct(ctx context.Context, req *pb.PostProductRequest) (*pb.PostProductResponse, error) {
 	Logs := logger.GetGlobalLogger()
 	Logs.Info(ctx, "Received PostProduct request")
 
-	product, err := g.service.PostProduct(ctx, req.GetName(), req.GetDescription(), req.GetPrice(), int(req.GetStock()))
+	product, err := g.service.PostProduct(ctx, req.GetName(), req.GetDescription(), req.GetPrice(), int(req.GetStock()),
+		req.GetCategoryId(), req.GetTags(), attributesFromPB(req.GetAttributes()))
 	if err != nil {
 		Logs.Error(ctx, "PostProduct failed: "+err.Error())
 		return nil, err
@@ -49,14 +126,7 @@ func (g *grpcServer) PostProduct(ctx context.Context, req *pb.PostProductRequest
 	Logs.Info(ctx, "Product created successfully: "+product.ID)
 
 	return &pb.PostProductResponse{
-		Product: &pb.Product{
-			Id:          product.ID,
-			Name:        product.Name,
-			Description: product.Description,
-			Price:       product.Price,
-			Stock:       product.Stock,
-			Sold:        product.Sold,
-		},
+		Product: productToPB(*product),
 	}, nil
 }
 
@@ -73,14 +143,7 @@ func (g *grpcServer) GetProduct(ctx context.Context, req *pb.GetProductRequest)
 	Logs.Info(ctx, "Product fetched: "+product.ID)
 
 	return &pb.GetProductResponse{
-		Product: &pb.Product{
-			Id:          product.ID,
-			Name:        product.Name,
-			Description: product.Description,
-			Price:       product.Price,
-			Stock:       product.Stock,
-			Sold:        product.Sold,
-		},
+		Product: productToPB(*product),
 	}, nil
 }
 
@@ -89,48 +152,110 @@ func (g *grpcServer) GetProducts(ctx context.Context, req *pb.GetProductsRequest
 
 	Logs.Info(ctx, "Received GetProducts request")
 
-	var (
-		err  error
-		resp []Product
-	)
-
+	page := &ProductPage{}
 	switch {
-	case len(req.GetQuery()) > 0:
-		Logs.Info(ctx, "Searching products with query: "+req.GetQuery())
-		resp, err = g.service.SearchProducts(ctx, req.GetQuery(), req.GetSkip(), req.GetTake())
-
-	case len(req.GetIds()) > 0:
+	case len(req.GetQuery()) == 0 && len(req.GetIds()) > 0:
 		Logs.Info(ctx, "Fetching products by IDs")
-		resp, err = g.service.GetProductsByIDs(ctx, req.GetIds())
+		products, err := g.service.GetProductsByIDs(ctx, req.GetIds())
+		if err != nil {
+			Logs.Error(ctx, "GetProducts failed: "+err.Error())
+			return nil, err
+		}
+		for _, p := range products {
+			page.Edges = append(page.Edges, ProductEdge{Product: p})
+		}
 
 	default:
-		Logs.Info(ctx, "Fetching all products with pagination")
-		resp, err = g.service.GetProducts(ctx, req.GetSkip(), req.GetTake())
+		// without a query the search lists the products newest first
+		Logs.Info(ctx, "Listing products with query: "+req.GetQuery())
+		result, err := g.service.SearchProducts(ctx, SearchQuery{
+			Query:       req.GetQuery(),
+			InStockOnly: true,
+			Skip:        req.GetSkip(),
+			Take:        req.GetTake(),
+			After:       req.GetAfter(),
+		})
+		if err != nil {
+			Logs.Error(ctx, "GetProducts failed: "+err.Error())
+			return nil, searchError(err)
+		}
+		page = &result.ProductPage
 	}
 
-	if err != nil {
-		Logs.Error(ctx, "GetProducts failed: "+err.Error())
-		return nil, err
+	Logs.Info(ctx, fmt.Sprintf("Fetched %d products", len(page.Edges)))
+
+	resp := &pb.GetProductsResponse{
+		Products:    make([]*pb.Product, len(page.Edges)),
+		EndCursor:   page.EndCursor,
+		HasNextPage: page.HasNextPage,
+	}
+	for i, edge := range page.Edges {
+		resp.Products[i] = productToPB(edge.Product)
+		if edge.Cursor != "" {
+			resp.Cursors = append(resp.Cursors, edge.Cursor)
+		}
+	}
+	return resp, nil
+}
+
+// searchError tells callers that a search they sent can never succeed as it is
+func searchError(err error) error {
+	switch {
+	case errors.Is(err, errInvalidCursor), errors.Is(err, errInvalidSort),
+		errors.Is(err, errInvalidFacet), errors.Is(err, errInvalidPriceRange):
+		return status.Error(codes.InvalidArgument, err.Error())
 	}
+	return err
+}
 
-	Logs.Info(ctx, fmt.Sprintf("Fetched %d products", len(resp)))
+func (g *grpcServer) SearchProducts(ctx context.Context, req *pb.SearchProductsRequest) (*pb.SearchProductsResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.Info(ctx, "Received SearchProducts request with query: "+req.GetQuery())
+
+	query := SearchQuery{
+		Query:       req.GetQuery(),
+		MinPrice:    req.MinPrice,
+		MaxPrice:    req.MaxPrice,
+		CategoryID:  req.GetCategoryId(),
+		Tags:        req.GetTags(),
+		InStockOnly: req.GetInStockOnly(),
+		Sort:        req.GetSort(),
+		Facets:      make([]FacetRequest, len(req.GetFacets())),
+		Skip:        req.GetSkip(),
+		Take:        req.GetTake(),
+		After:       req.GetAfter(),
+	}
+	for i, facet := range req.GetFacets() {
+		query.Facets[i] = FacetRequest{Field: facet.GetField(), Size: int(facet.GetSize()), Interval: facet.GetInterval()}
+	}
 
-	products := make([]*pb.Product, len(resp))
-	for i, p := range resp {
-		products[i] = &pb.Product{
-			Id:          p.ID,
-			Name:        p.Name,
-			Description: p.Description,
-			Price:       p.Price,
-			Stock:       p.Stock,
-			Sold:        p.Sold,
-			OutOfStock:  p.OutOfStock,
+	result, err := g.service.SearchProducts(ctx, query)
+	if err != nil {
+		Logs.Error(ctx, "SearchProducts failed: "+err.Error())
+		return nil, searchError(err)
+	}
+
+	resp := &pb.SearchProductsResponse{
+		Products:    make([]*pb.Product, len(result.Edges)),
+		Total:       result.Total,
+		Facets:      make([]*pb.Facet, len(result.Facets)),
+		Cursors:     make([]string, len(result.Edges)),
+		EndCursor:   result.EndCursor,
+		HasNextPage: result.HasNextPage,
+	}
+	for i, edge := range result.Edges {
+		resp.Products[i] = productToPB(edge.Product)
+		resp.Cursors[i] = edge.Cursor
+	}
+	for i, facet := range result.Facets {
+		resp.Facets[i] = &pb.Facet{Field: facet.Field, Buckets: make([]*pb.FacetBucket, len(facet.Buckets))}
+		for j, bucket := range facet.Buckets {
+			resp.Facets[i].Buckets[j] = &pb.FacetBucket{Key: bucket.Key, Count: bucket.Count}
 		}
 	}
 
-	return &pb.GetProductsResponse{
-		Products: products,
-	}, nil
+	Logs.Info(ctx, fmt.Sprintf("Searched %d of %d products", len(resp.Products), resp.Total))
+	return resp, nil
 }
 
 func(g *grpcServer) UpdateStockAndSold(ctx context.Context, req *pb.UpdateStockRequest) (*pb.UpdateStockResponse, error) {
@@ -185,7 +310,12 @@ func (g *grpcServer) SuggestProducts(ctx context.Context, req *pb.SuggestProduct
 	Logs := logger.GetGlobalLogger()
 	Logs.Info(ctx, "Received SuggestProducts request for prefix: "+req.GetQuery())
 
-	resp, err := g.service.SuggestProducts(ctx, req.GetQuery(), int(req.GetSize()), req.GetUseAi())
+	// use_ai predates the modes and asks for semantic suggestions
+	mode := req.GetMode()
+	if mode == "" && req.GetUseAi() {
+		mode = SuggestSemantic
+	}
+	resp, err := g.service.SuggestProducts(ctx, req.GetQuery(), int(req.GetSize()), mode)
 	if err != nil {
 		Logs.Error(ctx, "SuggestProducts failed: "+err.Error())
 		return nil, err
@@ -195,18 +325,80 @@ func (g *grpcServer) SuggestProducts(ctx context.Context, req *pb.SuggestProduct
 
 	products := make([]*pb.Product, len(resp))
 	for i, p := range resp {
-		products[i] = &pb.Product{
-			Id:          p.ID,
-			Name:        p.Name,
-			Description: p.Description,
-			Price:       p.Price,
-			Stock:       p.Stock,
-			Sold:        p.Sold,
-			OutOfStock:  p.OutOfStock,
-		}
+		products[i] = productToPB(p)
 	}
 
 	return &pb.SuggestProductsResponse{
 		Products: products,
 	}, nil
 }
+
+func (g *grpcServer) CreateCategory(ctx context.Context, req *pb.CreateCategoryRequest) (*pb.CreateCategoryResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.Info(ctx, "Received CreateCategory request: "+req.GetName())
+
+	category, err := g.service.CreateCategory(ctx, req.GetName(), req.GetParentId())
+	if err != nil {
+		Logs.Error(ctx, "CreateCategory failed: "+err.Error())
+		return nil, err
+	}
+
+	Logs.Info(ctx, "Category created: "+category.ID)
+	return &pb.CreateCategoryResponse{Category: categoryToPB(*category)}, nil
+}
+
+func (g *grpcServer) GetCategory(ctx context.Context, req *pb.GetCategoryRequest) (*pb.GetCategoryResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.Info(ctx, "Received GetCategory request for ID: "+req.GetId())
+
+	category, err := g.service.GetCategory(ctx, req.GetId())
+	if err != nil {
+		Logs.Error(ctx, "GetCategory failed: "+err.Error())
+		return nil, err
+	}
+	return &pb.GetCategoryResponse{Category: categoryToPB(*category)}, nil
+}
+
+func (g *grpcServer) ListCategories(ctx context.Context, req *pb.ListCategoriesRequest) (*pb.ListCategoriesResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.Info(ctx, "Received ListCategories request")
+
+	resp, err := g.service.ListCategories(ctx)
+	if err != nil {
+		Logs.Error(ctx, "ListCategories failed: "+err.Error())
+		return nil, err
+	}
+
+	categories := make([]*pb.Category, len(resp))
+	for i, c := range resp {
+		categories[i] = categoryToPB(c)
+	}
+	return &pb.ListCategoriesResponse{Categories: categories}, nil
+}
+
+func (g *grpcServer) UpdateCategory(ctx context.Context, req *pb.UpdateCategoryRequest) (*pb.UpdateCategoryResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.Info(ctx, "Received UpdateCategory request for ID: "+req.GetId())
+
+	category, err := g.service.UpdateCategory(ctx, req.GetId(), req.GetName(), req.GetParentId())
+	if err != nil {
+		Logs.Error(ctx, "UpdateCategory failed: "+err.Error())
+		return nil, err
+	}
+
+	Logs.Info(ctx, "Category updated: "+category.ID)
+	return &pb.UpdateCategoryResponse{Category: categoryToPB(*category)}, nil
+}
+
+func (g *grpcServer) DeleteCategory(ctx context.Context, req *pb.DeleteCategoryRequest) (*pb.DeleteCategoryResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.Info(ctx, "Received DeleteCategory request for ID: "+req.GetId())
+
+	if err := g.service.DeleteCategory(ctx, req.GetId()); err != nil {
+		Logs.Error(ctx, "DeleteCategory failed: "+err.Error())
+		return nil, err
+	}
+
+	Logs.Info(ctx, "Category deleted: "+req.GetId())
+	return &pb.DeleteCategoryResponse{Ok: true}, nil
+}
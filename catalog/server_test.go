@@ -0,0 +1,248 @@
+package catalog
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/zenvisjr/building-scalable-microservices/internal/servicetest"
+	"github.com/zenvisjr/building-scalable-microservices/internal/svcauthtest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMain(m *testing.M) {
+	servicetest.Main(m, "catalog")
+}
+
+// startServer serves a fresh in-memory catalog over bufconn and returns a client connected to it
+func startServer(t *testing.T) *Client {
+	t.Helper()
+	dialer := servicetest.Serve(t, NewGRPCServer(NewCatalogService(NewInMemoryRepository(newTestEmbedder(t)), HybridConfig{})))
+	client, err := NewClient("passthrough:///catalog", dialer)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(client.Close)
+	return client
+}
+
+func TestProductLifecycle(t *testing.T) {
+	client := startServer(t)
+	ctx := context.Background()
+
+	lamp, err := client.PostProduct(ctx, "Desk Lamp", "Warm light for the desk", 24.5, 2, "", nil, nil)
+	if err != nil {
+		t.Fatalf("PostProduct: %v", err)
+	}
+	if _, err := client.PostProduct(ctx, "Floor Lamp", "Tall and bright", 60, 5, "", nil, nil); err != nil {
+		t.Fatalf("PostProduct: %v", err)
+	}
+
+	all, err := client.GetProducts(ctx, 0, 0, nil, "", "")
+	if err != nil || len(all.Edges) != 2 || all.HasNextPage {
+		t.Fatalf("GetProducts = %+v, %v", all, err)
+	}
+	found, err := client.GetProducts(ctx, 0, 0, nil, "desk", "")
+	if err != nil || len(found.Edges) != 1 || found.Edges[0].Product.ID != lamp.ID {
+		t.Errorf("GetProducts by query = %+v, %v", found, err)
+	}
+
+	// newest first, a page at a time
+	first, err := client.GetProducts(ctx, 0, 1, nil, "", "")
+	if err != nil || len(first.Edges) != 1 || !first.HasNextPage || first.EndCursor != first.Edges[0].Cursor {
+		t.Fatalf("GetProducts of the first page = %+v, %v", first, err)
+	}
+	next, err := client.GetProducts(ctx, 0, 1, nil, "", first.EndCursor)
+	if err != nil || len(next.Edges) != 1 || next.HasNextPage || next.Edges[0].Product.ID == first.Edges[0].Product.ID {
+		t.Errorf("GetProducts after the first page = %+v, %v", next, err)
+	}
+	if _, err := client.GetProducts(ctx, 0, 1, nil, "", "not-a-cursor"); err == nil {
+		t.Error("GetProducts after an invalid cursor succeeded")
+	}
+	suggested, err := client.SuggestProducts(ctx, "lam", 5, SuggestLexical)
+	if err != nil || len(suggested) != 2 {
+		t.Errorf("SuggestProducts = %v, %v", suggested, err)
+	}
+
+	// the order service sells the stock, the gateway restocks
+	svcauthtest.CallAs(t, "order")
+	if ok, err := client.UpdateStockAndSold(ctx, lamp.ID, 2); err != nil || !ok {
+		t.Fatalf("UpdateStockAndSold = %t, %v", ok, err)
+	}
+	byID, err := client.GetProducts(ctx, 0, 0, []string{lamp.ID}, "", "")
+	if err != nil || len(byID.Edges) != 0 {
+		t.Errorf("GetProducts of a sold out product = %+v, %v", byID, err)
+	}
+
+	svcauthtest.Use("gateway")
+	if err := client.RestockProduct(ctx, lamp.ID, 3); err != nil {
+		t.Fatalf("RestockProduct: %v", err)
+	}
+	got, err := client.GetProduct(ctx, lamp.ID)
+	if err != nil || got.Stock != 3 || got.Sold != 2 {
+		t.Errorf("GetProduct after a restock = %+v, %v", got, err)
+	}
+	if err := client.DeleteProduct(ctx, lamp.ID); err != nil {
+		t.Fatalf("DeleteProduct: %v", err)
+	}
+	if _, err := client.GetProduct(ctx, lamp.ID); err == nil {
+		t.Error("GetProduct of a deleted product succeeded")
+	}
+}
+
+func TestCategories(t *testing.T) {
+	client := startServer(t)
+	ctx := context.Background()
+
+	home, err := client.CreateCategory(ctx, "Home", "")
+	if err != nil {
+		t.Fatalf("CreateCategory: %v", err)
+	}
+	lighting, err := client.CreateCategory(ctx, "Lighting", home.ID)
+	if err != nil {
+		t.Fatalf("CreateCategory: %v", err)
+	}
+	if len(lighting.Path) != 2 || lighting.Path[0] != home.ID || lighting.Path[1] != lighting.ID {
+		t.Errorf("subcategory path = %v", lighting.Path)
+	}
+	if _, err := client.CreateCategory(ctx, "Orphan", "unknown-category-id"); err == nil {
+		t.Error("CreateCategory under an unknown parent succeeded")
+	}
+
+	// tags and attribute keys are normalized, values rewritten in their canonical form
+	lamp, err := client.PostProduct(ctx, "Desk Lamp", "Warm light", 24.5, 2, lighting.ID, []string{" LED", "desk", "led"}, []Attribute{
+		{Key: "Brand", Type: AttributeText, Value: "Lumo"},
+		{Key: "watts", Type: AttributeNumber, Value: "7.50"},
+		{Key: "dimmable", Type: AttributeBoolean, Value: "TRUE"},
+	})
+	if err != nil {
+		t.Fatalf("PostProduct: %v", err)
+	}
+	wantAttributes := []Attribute{
+		{Key: "brand", Type: AttributeText, Value: "Lumo"},
+		{Key: "watts", Type: AttributeNumber, Value: "7.5"},
+		{Key: "dimmable", Type: AttributeBoolean, Value: "true"},
+	}
+	if !slices.Equal(lamp.Tags, []string{"led", "desk"}) || !slices.Equal(lamp.Attributes, wantAttributes) || !slices.Equal(lamp.CategoryPath, lighting.Path) {
+		t.Errorf("PostProduct = %+v", lamp)
+	}
+	for _, attributes := range [][]Attribute{
+		{{Key: "watts", Type: AttributeNumber, Value: "bright"}},
+		{{Key: "colour", Type: "colour", Value: "red"}},
+		{{Key: "size", Type: AttributeText, Value: "S"}, {Key: "Size", Type: AttributeText, Value: "M"}},
+	} {
+		if _, err := client.PostProduct(ctx, "Bad Lamp", "", 1, 1, "", nil, attributes); err == nil {
+			t.Errorf("PostProduct with attributes %v succeeded", attributes)
+		}
+	}
+
+	// a category cannot move under its own subcategory
+	if _, err := client.UpdateCategory(ctx, home.ID, "Home", lighting.ID); err == nil {
+		t.Error("UpdateCategory into a subcategory succeeded")
+	}
+	rooms, err := client.CreateCategory(ctx, "Rooms", "")
+	if err != nil {
+		t.Fatalf("CreateCategory: %v", err)
+	}
+	if _, err := client.UpdateCategory(ctx, home.ID, "Home & Living", rooms.ID); err != nil {
+		t.Fatalf("UpdateCategory: %v", err)
+	}
+	got, err := client.GetProduct(ctx, lamp.ID)
+	if err != nil || !slices.Equal(got.CategoryPath, []string{rooms.ID, home.ID, lighting.ID}) {
+		t.Errorf("GetProduct after the move = %+v, %v", got, err)
+	}
+	categories, err := client.ListCategories(ctx)
+	if err != nil || len(categories) != 3 || categories[0].Name != "Home & Living" {
+		t.Errorf("ListCategories = %v, %v", categories, err)
+	}
+	if err := client.DeleteCategory(ctx, lighting.ID); err == nil {
+		t.Error("DeleteCategory of a category with products succeeded")
+	}
+}
+
+func TestSearchProducts(t *testing.T) {
+	client := startServer(t)
+	ctx := context.Background()
+
+	kitchen, err := client.CreateCategory(ctx, "Kitchen", "")
+	if err != nil {
+		t.Fatalf("CreateCategory: %v", err)
+	}
+	for _, p := range []struct {
+		name  string
+		price float64
+		tags  []string
+	}{
+		{"Steel Kettle", 45, []string{"steel"}},
+		{"Glass Kettle", 30, []string{"glass"}},
+		{"Steel Pan", 80, []string{"steel"}},
+	} {
+		if _, err := client.PostProduct(ctx, p.name, "For the kitchen", p.price, 1, kitchen.ID, p.tags, nil); err != nil {
+			t.Fatalf("PostProduct: %v", err)
+		}
+	}
+
+	maxPrice := 50.0
+	result, err := client.SearchProducts(ctx, SearchQuery{
+		Query:      "kettle",
+		CategoryID: kitchen.ID,
+		MaxPrice:   &maxPrice,
+		Sort:       SortPriceAsc,
+		Facets:     []FacetRequest{{Field: FacetTags}},
+	})
+	if err != nil {
+		t.Fatalf("SearchProducts: %v", err)
+	}
+	if products := result.Products(); result.Total != 2 || len(products) != 2 || products[0].Name != "Glass Kettle" {
+		t.Errorf("SearchProducts = %+v", result)
+	}
+	want := []FacetBucket{{Key: "glass", Count: 1}, {Key: "steel", Count: 1}}
+	if len(result.Facets) != 1 || result.Facets[0].Field != FacetTags || !slices.Equal(result.Facets[0].Buckets, want) {
+		t.Errorf("facets = %+v, want %v", result.Facets, want)
+	}
+
+	// cursors only place a product in the results and the order they were taken from, facets
+	// do not change either
+	cursor := result.Edges[0].Cursor
+	next, err := client.SearchProducts(ctx, SearchQuery{Query: "kettle", CategoryID: kitchen.ID, MaxPrice: &maxPrice, Sort: SortPriceAsc, After: cursor})
+	if err != nil {
+		t.Fatalf("SearchProducts after a cursor without facets: %v", err)
+	}
+	if products := next.Products(); len(products) != 1 || products[0].Name != "Steel Kettle" {
+		t.Errorf("SearchProducts after a cursor = %+v", products)
+	}
+	for name, query := range map[string]SearchQuery{
+		"another sort":     {Query: "kettle", CategoryID: kitchen.ID, MaxPrice: &maxPrice, Sort: SortPriceDesc, After: cursor},
+		"another query":    {Query: "pan", CategoryID: kitchen.ID, MaxPrice: &maxPrice, Sort: SortPriceAsc, After: cursor},
+		"another filter":   {Query: "kettle", CategoryID: kitchen.ID, Sort: SortPriceAsc, After: cursor},
+		"a garbled cursor": {Query: "kettle", CategoryID: kitchen.ID, MaxPrice: &maxPrice, Sort: SortPriceAsc, After: "garbled"},
+		"an unknown sort":  {Sort: "cheapest"},
+		"an unknown facet": {Facets: []FacetRequest{{Field: "colour"}}},
+	} {
+		if _, err := client.SearchProducts(ctx, query); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("SearchProducts with %s = %v, want InvalidArgument", name, err)
+		}
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	client := startServer(t)
+	ctx := context.Background()
+
+	lamp, err := client.PostProduct(ctx, "Desk Lamp", "", 24.5, 2, "", nil, nil)
+	if err != nil {
+		t.Fatalf("PostProduct: %v", err)
+	}
+
+	// only the order service takes stock, the gateway cannot sell around an order
+	_, err = client.UpdateStockAndSold(ctx, lamp.ID, 1)
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("UpdateStockAndSold from the gateway = %v, want PermissionDenied", err)
+	}
+
+	svcauthtest.CallAs(t, "order")
+	if _, err := client.PostProduct(ctx, "Stolen Lamp", "", 1, 1, "", nil, nil); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("PostProduct from order = %v, want PermissionDenied", err)
+	}
+}
@@ -2,6 +2,11 @@ package catalog
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/segmentio/ksuid"
 	"github.com/zenvisjr/building-scalable-microservices/logger"
@@ -17,38 +22,98 @@ type Product struct {
 	Sold        uint32  `json:"sold"`
 	OutOfStock  bool    `json:"out_of_stock"`
 	Score       float64 `json:"score"`
+	// CategoryPath holds the IDs of the category and its ancestors, root first, so filtering
+	// on a category also finds the products of its subcategories
+	CategoryID   string      `json:"category_id"`
+	CategoryPath []string    `json:"category_path"`
+	Tags         []string    `json:"tags"`
+	Attributes   []Attribute `json:"attributes"`
+	CreatedAt    time.Time   `json:"created_at"`
 }
 
+// Types an attribute value can have
+const (
+	AttributeText    = "text"
+	AttributeNumber  = "number"
+	AttributeBoolean = "boolean"
+)
+
+// Attribute is a typed key/value pair such as brand, colour or size. Value is the text form
+// of the value and parses as Type
+type Attribute struct {
+	Key   string `json:"key"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// Category is a node of the category tree, Path holds the IDs of its ancestors and itself,
+// root first
+type Category struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	ParentID string   `json:"parent_id"`
+	Path     []string `json:"path"`
+}
+
+var (
+	errCategoryNameRequired = errors.New("category name is required")
+	errCategoryCycle        = errors.New("a category cannot be moved under itself or its subcategories")
+	errCategoryInUse        = errors.New("category has subcategories or products")
+	errInvalidAttribute     = errors.New("invalid attribute")
+)
+
 type Service interface {
-	PostProduct(ctx context.Context, name, description string, price float64, stock int) (*Product, error)
+	PostProduct(ctx context.Context, name, description string, price float64, stock int, categoryID string, tags []string, attributes []Attribute) (*Product, error)
 	GetProduct(ctx context.Context, id string) (*Product, error)
-	GetProducts(ctx context.Context, skip uint64, take uint64) ([]Product, error)
 	GetProductsByIDs(ctx context.Context, ids []string) ([]Product, error)
-	SearchProducts(ctx context.Context, query string, skip uint64, take uint64) ([]Product, error)
+	SearchProducts(ctx context.Context, query SearchQuery) (*SearchResult, error)
 	UpdateStockAndSold(ctx context.Context, id string, quantity int) (bool, error)
 	DeleteProduct(ctx context.Context, id string) error
 	RestockProduct(ctx context.Context, id string, newStock int) error
-	SuggestProducts(ctx context.Context, prefix string, size int, useAI bool) ([]Product, error)
+	SuggestProducts(ctx context.Context, prefix string, size int, mode string) ([]Product, error)
+	CreateCategory(ctx context.Context, name, parentID string) (*Category, error)
+	GetCategory(ctx context.Context, id string) (*Category, error)
+	ListCategories(ctx context.Context) ([]Category, error)
+	UpdateCategory(ctx context.Context, id, name, parentID string) (*Category, error)
+	DeleteCategory(ctx context.Context, id string) error
 }
 
 type catalogService struct {
-	repo Repository
+	repo   Repository
+	hybrid HybridConfig
 }
 
-func NewCatalogService(repo Repository) Service {
-	return &catalogService{repo: repo}
+func NewCatalogService(repo Repository, hybrid HybridConfig) Service {
+	return &catalogService{repo: repo, hybrid: hybrid}
 }
 
-func (s *catalogService) PostProduct(ctx context.Context, name, description string, price float64, stock int) (*Product, error) {
+func (s *catalogService) PostProduct(ctx context.Context, name, description string, price float64, stock int, categoryID string, tags []string, attributes []Attribute) (*Product, error) {
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("Creating new product")
 
+	attributes, err := normalizeAttributes(attributes)
+	if err != nil {
+		Logs.Error(ctx, "Invalid product attributes: "+err.Error())
+		return nil, err
+	}
 	product := Product{
 		ID:          ksuid.New().String(),
 		Name:        name,
 		Description: description,
 		Price:       price,
 		Stock:       uint32(stock),
+		CreatedAt:   time.Now().UTC(),
+		Tags:        normalizeTags(tags),
+		Attributes:  attributes,
+	}
+	if categoryID != "" {
+		category, err := s.repo.GetCategoryByID(ctx, categoryID)
+		if err != nil {
+			Logs.Error(ctx, "Failed to find category "+categoryID+": "+err.Error())
+			return nil, err
+		}
+		product.CategoryID = category.ID
+		product.CategoryPath = category.Path
 	}
 	if err := s.repo.CreateProduct(ctx, product); err != nil {
 		Logs.Error(ctx, "Failed to store new product: "+err.Error())
@@ -71,20 +136,6 @@ func (s *catalogService) GetProduct(ctx context.Context, id string) (*Product, e
 	return product, nil
 }
 
-func (s *catalogService) GetProducts(ctx context.Context, skip uint64, take uint64) ([]Product, error) {
-	Logs := logger.GetGlobalLogger()
-	if take > 100 || (take == 0 && skip == 0) {
-		take = 100
-	}
-	Logs.LocalOnlyInfo("Listing products | skip: " + logger.Uint64ToStr(skip) + ", take: " + logger.Uint64ToStr(take))
-
-	products, err := s.repo.ListProducts(ctx, skip, take)
-	if err != nil {
-		Logs.Error(ctx, "Failed to list products: "+err.Error())
-	}
-	return products, err
-}
-
 func (s *catalogService) GetProductsByIDs(ctx context.Context, ids []string) ([]Product, error) {
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("Fetching products by multiple IDs (count: " + logger.IntToStr(len(ids)) + ")")
@@ -96,20 +147,6 @@ func (s *catalogService) GetProductsByIDs(ctx context.Context, ids []string) ([]
 	return products, err
 }
 
-func (s *catalogService) SearchProducts(ctx context.Context, query string, skip uint64, take uint64) ([]Product, error) {
-	Logs := logger.GetGlobalLogger()
-	if take > 100 || (take == 0 && skip == 0) {
-		take = 100
-	}
-	Logs.LocalOnlyInfo("Searching products | query: \"" + query + "\", skip: " + logger.Uint64ToStr(skip) + ", take: " + logger.Uint64ToStr(take))
-
-	products, err := s.repo.SearchProducts(ctx, query, skip, take)
-	if err != nil {
-		Logs.Error(ctx, "Search failed: "+err.Error())
-	}
-	return products, err
-}
-
 func (s *catalogService) UpdateStockAndSold(ctx context.Context, id string, quantity int) (bool, error) {
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("Updating stock and sold for product: " + id)
@@ -138,17 +175,24 @@ func (s *catalogService) RestockProduct(ctx context.Context, id string, newStock
 }
 
 
-func (s *catalogService) SuggestProducts(ctx context.Context, prefix string, size int, useAI bool) ([]Product, error) {
+// SuggestProducts ranks suggestions lexically unless mode asks for semantic or hybrid ranking
+func (s *catalogService) SuggestProducts(ctx context.Context, prefix string, size int, mode string) ([]Product, error) {
 	Logs := logger.GetGlobalLogger()
-	Logs.LocalOnlyInfo("Suggesting products with prefix: " + prefix)
+	Logs.LocalOnlyInfo("Suggesting products with prefix: " + prefix + ", mode: " + mode)
 
-	if useAI {
+	switch mode {
+	case "", SuggestLexical:
+	case SuggestSemantic:
 		products, err := s.repo.AISuggest(ctx, prefix, size)
 		if err != nil {
 			Logs.Error(ctx, "Failed to suggest products using AI: "+err.Error())
 			return nil, err
 		}
 		return products, nil
+	case SuggestHybrid:
+		return s.hybridSuggest(ctx, prefix, size)
+	default:
+		return nil, errInvalidSuggestMode
 	}
 	products, err := s.repo.SuggestProducts(ctx, prefix, size)
 	if err != nil {
@@ -156,3 +200,163 @@ func (s *catalogService) SuggestProducts(ctx context.Context, prefix string, siz
 	}
 	return products, err
 }
+
+// normalizeTags lowercases and trims tags and drops empty and repeated ones, so filters match
+// them exactly
+func normalizeTags(tags []string) []string {
+	normalized := []string{}
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	return normalized
+}
+
+// normalizeAttributes checks every value parses as its type and rewrites it in one canonical
+// form, keys are lowercased and may appear once
+func normalizeAttributes(attributes []Attribute) ([]Attribute, error) {
+	normalized := []Attribute{}
+	seen := map[string]bool{}
+	for _, a := range attributes {
+		key := strings.ToLower(strings.TrimSpace(a.Key))
+		if key == "" {
+			return nil, fmt.Errorf("%w: key is required", errInvalidAttribute)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("%w: %s is repeated", errInvalidAttribute, key)
+		}
+		seen[key] = true
+
+		value := strings.TrimSpace(a.Value)
+		switch a.Type {
+		case AttributeText:
+			if value == "" {
+				return nil, fmt.Errorf("%w: %s has no value", errInvalidAttribute, key)
+			}
+		case AttributeNumber:
+			number, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s is not a number", errInvalidAttribute, key)
+			}
+			value = strconv.FormatFloat(number, 'f', -1, 64)
+		case AttributeBoolean:
+			flag, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s is not a boolean", errInvalidAttribute, key)
+			}
+			value = strconv.FormatBool(flag)
+		default:
+			return nil, fmt.Errorf("%w: %s has unknown type %q", errInvalidAttribute, key, a.Type)
+		}
+		normalized = append(normalized, Attribute{Key: key, Type: a.Type, Value: value})
+	}
+	return normalized, nil
+}
+
+func (s *catalogService) CreateCategory(ctx context.Context, name, parentID string) (*Category, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Creating category: " + name)
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, errCategoryNameRequired
+	}
+	category := Category{
+		ID:       ksuid.New().String(),
+		Name:     name,
+		ParentID: parentID,
+	}
+	if parentID != "" {
+		parent, err := s.repo.GetCategoryByID(ctx, parentID)
+		if err != nil {
+			Logs.Error(ctx, "Failed to find parent category "+parentID+": "+err.Error())
+			return nil, err
+		}
+		category.Path = append(category.Path, parent.Path...)
+	}
+	category.Path = append(category.Path, category.ID)
+
+	if err := s.repo.CreateCategory(ctx, category); err != nil {
+		Logs.Error(ctx, "Failed to store category: "+err.Error())
+		return nil, err
+	}
+	return &category, nil
+}
+
+func (s *catalogService) GetCategory(ctx context.Context, id string) (*Category, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Retrieving category by ID: " + id)
+
+	category, err := s.repo.GetCategoryByID(ctx, id)
+	if err != nil {
+		Logs.Error(ctx, "Failed to retrieve category ID "+id+": "+err.Error())
+		return nil, err
+	}
+	return category, nil
+}
+
+func (s *catalogService) ListCategories(ctx context.Context) ([]Category, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Listing categories")
+
+	categories, err := s.repo.ListCategories(ctx)
+	if err != nil {
+		Logs.Error(ctx, "Failed to list categories: "+err.Error())
+	}
+	return categories, err
+}
+
+// UpdateCategory renames a category and moves it under parentID. The paths of its
+// subcategories and of the products filed under them follow the move
+func (s *catalogService) UpdateCategory(ctx context.Context, id, name, parentID string) (*Category, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Updating category: " + id)
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, errCategoryNameRequired
+	}
+	category, err := s.repo.GetCategoryByID(ctx, id)
+	if err != nil {
+		Logs.Error(ctx, "Failed to retrieve category ID "+id+": "+err.Error())
+		return nil, err
+	}
+	updated := Category{ID: id, Name: name, ParentID: parentID}
+	if parentID != "" {
+		parent, err := s.repo.GetCategoryByID(ctx, parentID)
+		if err != nil {
+			Logs.Error(ctx, "Failed to find parent category "+parentID+": "+err.Error())
+			return nil, err
+		}
+		for _, ancestor := range parent.Path {
+			if ancestor == id {
+				return nil, errCategoryCycle
+			}
+		}
+		updated.Path = append(updated.Path, parent.Path...)
+	}
+	updated.Path = append(updated.Path, id)
+
+	if err := s.repo.UpdateCategory(ctx, updated, category.Path); err != nil {
+		Logs.Error(ctx, "Failed to update category "+id+": "+err.Error())
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// DeleteCategory removes a category that has no subcategories and no products
+func (s *catalogService) DeleteCategory(ctx context.Context, id string) error {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Deleting category: " + id)
+
+	if err := s.repo.DeleteCategory(ctx, id); err != nil {
+		Logs.Error(ctx, "Failed to delete category "+id+": "+err.Error())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+#!/bin/sh
+# Creates a development CA and one certificate per service for mutual TLS between the
+# services. Each service gets certs/<service>/{ca.crt,tls.crt,tls.key}, which docker-compose
+# mounts at /app/tls. Run it again to rotate the service certificates, running services pick
+# the new files up without a restart. The CA is kept unless certs/ca.key is deleted.
+#
+# Each service also gets certs/<service>/service.key, the Ed25519 key it signs its service
+# tokens with, and certs/<service>/service-keys/ with the public keys of every service. These
+# keys are kept unless deleted, services only read them on startup.
+set -eu
+
+cd "$(dirname "$0")"
+
+SERVICES="account auth catalog order mail logger gateway"
+DAYS="${DAYS:-365}"
+
+if [ ! -f ca.key ]; then
+	openssl req -x509 -newkey rsa:4096 -nodes -days 3650 \
+		-subj "/CN=zenvis-internal-ca" -keyout ca.key -out ca.crt
+fi
+
+for service in $SERVICES; do
+	mkdir -p "$service"
+
+	# The common name is the identity the other services see, the SAN is the host they dial
+	openssl req -newkey rsa:2048 -nodes -subj "/CN=$service" \
+		-keyout "$service/tls.key.new" -out "$service/tls.csr"
+	printf 'subjectAltName=DNS:%s,DNS:localhost\nextendedKeyUsage=serverAuth,clientAuth\nkeyUsage=digitalSignature,keyEncipherment\nbasicConstraints=CA:FALSE\n' \
+		"$service" >"$service/tls.ext"
+	openssl x509 -req -in "$service/tls.csr" -CA ca.crt -CAkey ca.key -CAcreateserial \
+		-days "$DAYS" -extfile "$service/tls.ext" -out "$service/tls.crt.new"
+
+	# Replace the files by rename so a reloading service never reads a half written file
+	cp ca.crt "$service/ca.crt.new"
+	mv "$service/ca.crt.new" "$service/ca.crt"
+	mv "$service/tls.key.new" "$service/tls.key"
+	mv "$service/tls.crt.new" "$service/tls.crt"
+	rm "$service/tls.csr" "$service/tls.ext"
+
+	if [ ! -f "$service/service.key" ]; then
+		openssl genpkey -algorithm ed25519 -out "$service/service.key"
+	fi
+	mkdir -p service-keys
+	openssl pkey -in "$service/service.key" -pubout -out "service-keys/$service.pub"
+done
+
+for service in $SERVICES; do
+	mkdir -p "$service/service-keys"
+	cp service-keys/*.pub "$service/service-keys/"
+done
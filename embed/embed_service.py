@@ -28,5 +28,30 @@ def embed():
     except Exception as e:
         return jsonify({"error": str(e)}), 500
 
+@app.route("/embed/batch", methods=["POST"])
+def embed_batch():
+    data = request.get_json()
+    texts = data.get("texts") or []
+    dimensions = data.get("dimensions")
+
+    if not texts or any(not text.strip() for text in texts):
+        return jsonify({"error": "Empty input"}), 400
+
+    try:
+        client = openai.OpenAI(api_key=os.getenv("OPENAI_API_KEY"))
+
+        options = {"model": MODEL, "input": texts}
+        if dimensions:
+            options["dimensions"] = dimensions
+        res = client.embeddings.create(**options)
+        embeddings = [item.embedding for item in sorted(res.data, key=lambda item: item.index)]
+        return jsonify({"embeddings": embeddings})
+    except openai.RateLimitError as e:
+        return jsonify({"error": str(e)}), 429
+    except openai.BadRequestError as e:
+        return jsonify({"error": str(e)}), 400
+    except Exception as e:
+        return jsonify({"error": str(e)}), 500
+
 if __name__ == "__main__":
     app.run(host="0.0.0.0", port=5005)
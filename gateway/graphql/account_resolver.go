@@ -5,7 +5,9 @@ import (
 	"log"
 	"time"
 
+	"github.com/zenvisjr/building-scalable-microservices/account"
 	"github.com/zenvisjr/building-scalable-microservices/logger"
+	"github.com/zenvisjr/building-scalable-microservices/order"
 )
 
 type accountResolver struct {
@@ -17,13 +19,13 @@ func (a *accountResolver) Orders(ctx context.Context, obj *Account) ([]*Order, e
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	user, err := RequireAdmin(ctx)
+	// @hasPermission(order:read:own) lets users see their own orders, others need order:read:any
+	user, err := RequireSelfOrPermission(ctx, obj.ID, "order:read:any")
 	if err != nil {
-		Logs.Error(ctx, "No admin in incoming ctx before wrapping")
 		return nil, err
 	}
 
-	Logs.Info(ctx, "Admin "+user.Email+" is fetching orders for account "+obj.Email)
+	Logs.Info(ctx, "User "+user.Email+" is fetching orders for account "+obj.Email)
 
 	orderList, err := a.server.orderClient.GetOrdersForAccount(ctx, obj.ID)
 	if err != nil {
@@ -47,9 +49,65 @@ func (a *accountResolver) Orders(ctx context.Context, obj *Account) ([]*Order, e
 			CreatedAt: order.CreatedAt.UTC().Format(time.RFC1123),
 			TotalPrice: order.TotalPrice,
 			Products: orderedProduct,
+			ShippingAddress: toShippingAddress(order.ShippingAddress),
 		})
 	}
 	Logs.Info(ctx, "Fetched orders for account "+obj.Email)
 
 	return orders, nil
 }
+
+func (a *accountResolver) Addresses(ctx context.Context, obj *Account) ([]*Address, error) {
+	Logs := logger.GetGlobalLogger()
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// Users see their own address book, others need account:read:any
+	if _, err := RequireSelfOrPermission(ctx, obj.ID, "account:read:any"); err != nil {
+		return nil, err
+	}
+
+	addressList, err := a.server.accountClient.ListAddresses(ctx, obj.ID)
+	if err != nil {
+		Logs.Error(ctx, "Error from accountClient.ListAddresses: "+err.Error())
+		return nil, err
+	}
+	addresses := make([]*Address, len(addressList))
+	for i := range addressList {
+		addresses[i] = toAddress(&addressList[i])
+	}
+	return addresses, nil
+}
+
+func toAddress(address *account.Address) *Address {
+	return &Address{
+		ID:         address.ID,
+		Label:      address.Label,
+		Recipient:  address.Recipient,
+		Line1:      address.Line1,
+		Line2:      address.Line2,
+		City:       address.City,
+		State:      address.State,
+		PostalCode: address.PostalCode,
+		Country:    address.Country,
+		Phone:      address.Phone,
+		IsDefault:  address.IsDefault,
+	}
+}
+
+func toShippingAddress(address *order.ShippingAddress) *ShippingAddress {
+	if address == nil {
+		return nil
+	}
+	return &ShippingAddress{
+		Label:      address.Label,
+		Recipient:  address.Recipient,
+		Line1:      address.Line1,
+		Line2:      address.Line2,
+		City:       address.City,
+		State:      address.State,
+		PostalCode: address.PostalCode,
+		Country:    address.Country,
+		Phone:      address.Phone,
+	}
+}
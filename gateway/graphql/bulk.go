@@ -0,0 +1,182 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zenvisjr/building-scalable-microservices/account"
+	"github.com/zenvisjr/building-scalable-microservices/auth"
+	"github.com/zenvisjr/building-scalable-microservices/internal/validation"
+	"github.com/zenvisjr/building-scalable-microservices/logger"
+)
+
+const (
+	// bulkTimeout bounds one import or export, both are far longer than a GraphQL call
+	bulkTimeout = 10 * time.Minute
+	// maxImportBodySize caps the file an import uploads
+	maxImportBodySize = 64 << 20
+)
+
+// ImportReport is the JSON body ImportAccountsHandler answers with
+type ImportReport struct {
+	Rows     int              `json:"rows"`
+	Imported int              `json:"imported"`
+	DryRun   bool             `json:"dryRun"`
+	Errors   []ImportRowError `json:"errors"`
+}
+
+type ImportRowError struct {
+	Row   int    `json:"row"`
+	Email string `json:"email"`
+	Error string `json:"error"`
+}
+
+// ImportAccountsHandler creates accounts from the CSV or JSONL file in the request body. Files
+// are streamed to the account service, which checks every row like a signup. Query parameters:
+// format (csv or jsonl), dryRun and sendWelcomeEmail
+func (s *Server) ImportAccountsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Logs := logger.GetGlobalLogger()
+		Logs.LocalOnlyInfo("ImportAccountsHandler called")
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Step 1: Validate the options
+		query := r.URL.Query()
+		input := validation.ImportAccountsInput{Format: query.Get("format")}
+		if err := validation.ValidateStruct(input); err != nil {
+			Logs.Error(r.Context(), "Validation failed: "+err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		dryRun, err := parseBoolParam(query.Get("dryRun"))
+		if err != nil {
+			http.Error(w, "dryRun must be true or false", http.StatusBadRequest)
+			return
+		}
+		sendWelcomeEmail, err := parseBoolParam(query.Get("sendWelcomeEmail"))
+		if err != nil {
+			http.Error(w, "sendWelcomeEmail must be true or false", http.StatusBadRequest)
+			return
+		}
+
+		// Step 2: Check the caller, roles other than user need role:assign like a signup does
+		user, ok := requireHTTPPermission(w, r, "account:import")
+		if !ok {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), bulkTimeout)
+		defer cancel()
+
+		// Step 3: Stream the file to the account service
+		body := http.MaxBytesReader(w, r.Body, maxImportBodySize)
+		report, err := s.accountClient.ImportAccounts(ctx, body, account.ImportOptions{
+			Format:     input.Format,
+			DryRun:     dryRun,
+			AllowRoles: user.HasPermission("role:assign"),
+		}, sendWelcomeEmail)
+		if err != nil {
+			Logs.Error(ctx, "Failed to import accounts: "+err.Error())
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		resp := ImportReport{
+			Rows:     report.Rows,
+			Imported: report.Imported,
+			DryRun:   report.DryRun,
+			Errors:   make([]ImportRowError, len(report.Errors)),
+		}
+		for i, rowErr := range report.Errors {
+			resp.Errors[i] = ImportRowError{Row: rowErr.Row, Email: rowErr.Email, Error: rowErr.Error}
+		}
+		Logs.Info(ctx, "Imported "+logger.IntToStr(report.Imported)+" of "+logger.IntToStr(report.Rows)+" accounts")
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+}
+
+// ExportAccountsHandler downloads all accounts as CSV or JSONL for backups, streamed as the
+// account service reads them. Query parameters: format (csv or jsonl), role and isActive
+func (s *Server) ExportAccountsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Logs := logger.GetGlobalLogger()
+		Logs.LocalOnlyInfo("ExportAccountsHandler called")
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Step 1: Validate the filter
+		query := r.URL.Query()
+		input := validation.ExportAccountsInput{Format: query.Get("format"), Role: query.Get("role")}
+		if err := validation.ValidateStruct(input); err != nil {
+			Logs.Error(r.Context(), "Validation failed: "+err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter := account.AccountFilter{Role: input.Role}
+		if isActive := query.Get("isActive"); isActive != "" {
+			value, err := strconv.ParseBool(isActive)
+			if err != nil {
+				http.Error(w, "isActive must be true or false", http.StatusBadRequest)
+				return
+			}
+			filter.IsActive = &value
+		}
+
+		// Step 2: Check the caller
+		if _, ok := requireHTTPPermission(w, r, "account:export"); !ok {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), bulkTimeout)
+		defer cancel()
+
+		// Step 3: Stream the export, once data went out a failure can only cut the download short
+		contentType := "text/csv"
+		if input.Format == account.BulkFormatJSONL {
+			contentType = "application/x-ndjson"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", `attachment; filename="accounts-`+time.Now().UTC().Format("20060102-150405")+"."+input.Format+`"`)
+		if err := s.accountClient.ExportAccounts(ctx, filter, input.Format, w); err != nil {
+			Logs.Error(ctx, "Failed to export accounts: "+err.Error())
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		Logs.Info(ctx, "Exported accounts as "+input.Format)
+	})
+}
+
+// requireHTTPPermission is RequirePermission for plain HTTP handlers, it answers 401 or 403
+// itself when the caller is not allowed
+func requireHTTPPermission(w http.ResponseWriter, r *http.Request, permission string) (*auth.UserClaims, bool) {
+	user, err := RequirePermission(r.Context(), permission)
+	if err != nil {
+		status := http.StatusForbidden
+		if _, ok := GetUserFromContext(r.Context()); !ok {
+			status = http.StatusUnauthorized
+		}
+		http.Error(w, err.Error(), status)
+		return nil, false
+	}
+	return user, true
+}
+
+// parseBoolParam reads an optional true or false query parameter
+func parseBoolParam(value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
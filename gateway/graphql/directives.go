@@ -0,0 +1,99 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/zenvisjr/building-scalable-microservices/logger"
+)
+
+// policyDirectives are the directives that declare who may call a field, see schema.graphql
+var policyDirectives = []string{"public", "auth", "hasPermission", "selfOrPermission"}
+
+// public implements the @public schema directive, the field is open to guests
+func public(ctx context.Context, obj interface{}, next graphql.Resolver) (interface{}, error) {
+	return next(ctx)
+}
+
+// authenticated implements the @auth schema directive, the field only resolves for a logged
+// in caller, who acts on their own account
+func authenticated(ctx context.Context, obj interface{}, next graphql.Resolver) (interface{}, error) {
+	Logs := logger.GetGlobalLogger()
+	if user, ok := GetUserFromContext(ctx); !ok || user == nil {
+		Logs.Error(ctx, "Unauthorized: no valid token for "+graphql.GetFieldContext(ctx).Field.Name)
+		return nil, fmt.Errorf("unauthenticated: please login")
+	}
+	return next(ctx)
+}
+
+// hasPermission implements the @hasPermission schema directive, the field only resolves
+// when the caller's access token grants permission
+func hasPermission(ctx context.Context, obj interface{}, next graphql.Resolver, permission string) (interface{}, error) {
+	if _, err := RequirePermission(ctx, permission); err != nil {
+		return nil, err
+	}
+	return next(ctx)
+}
+
+// selfOrPermission implements the @selfOrPermission schema directive. The account is the arg
+// field of the input argument, an input without it stands for every account
+func selfOrPermission(ctx context.Context, obj interface{}, next graphql.Resolver, permission string, arg string) (interface{}, error) {
+	if _, err := RequireSelfOrPermission(ctx, inputField(ctx, arg), permission); err != nil {
+		return nil, err
+	}
+	return next(ctx)
+}
+
+// inputField returns a string field of the input argument of the field being resolved, by its
+// name in the schema, or "" when the input or the field is left out
+func inputField(ctx context.Context, name string) string {
+	input, ok := graphql.GetFieldContext(ctx).Args["input"]
+	if !ok {
+		return ""
+	}
+	// the generated input types carry the schema names as JSON tags
+	raw, err := json.Marshal(input)
+	if err != nil {
+		return ""
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return ""
+	}
+	value, _ := fields[name].(string)
+	return value
+}
+
+// CheckAccessPolicy makes sure every Query and Mutation field declares who may call it, so a
+// field added without a directive fails at startup instead of being open to everyone
+func CheckAccessPolicy(schema *ast.Schema) error {
+	missing := []string{}
+	for _, root := range []*ast.Definition{schema.Query, schema.Mutation} {
+		if root == nil {
+			continue
+		}
+		for _, field := range root.Fields {
+			if strings.HasPrefix(field.Name, "__") {
+				continue
+			}
+			declared := false
+			for _, name := range policyDirectives {
+				if field.Directives.ForName(name) != nil {
+					declared = true
+					break
+				}
+			}
+			if !declared {
+				missing = append(missing, root.Name+"."+field.Name)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("fields without an access policy: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -81,6 +81,12 @@ func NewGraphQLServer(accountUrl, catalogURL, orderURL, authURL string) (*Server
 	}, nil
 }
 
+// WatchRevocations has keySet drop sessions revoked by the auth service as soon as NATS
+// announces it
+func (s *Server) WatchRevocations(keySet *auth.RemoteKeySet) error {
+	return keySet.WatchRevocations(s.nats)
+}
+
 func (s *Server) Mutation() MutationResolver {
 	return &mutationResolver{
 		server: s,
@@ -108,5 +114,11 @@ func (s *Server) Subscription() SubscriptionResolver {
 func (s *Server) ToExecutableSchema() graphql.ExecutableSchema {
 	return NewExecutableSchema(Config{
 		Resolvers: s,
+		Directives: DirectiveRoot{
+			Public:           public,
+			Auth:             authenticated,
+			HasPermission:    hasPermission,
+			SelfOrPermission: selfOrPermission,
+		},
 	})
 }
@@ -3,22 +3,147 @@ package graphql
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"strings"
 
+	"github.com/segmentio/ksuid"
 	"github.com/zenvisjr/building-scalable-microservices/auth"
 	"github.com/zenvisjr/building-scalable-microservices/logger"
+	"github.com/zenvisjr/building-scalable-microservices/svcauth"
 )
 
 type contextKey string
 
 const UserCtxKey = contextKey("user")
+const ClientIPCtxKey = contextKey("client_ip")
+const UserAgentCtxKey = contextKey("user_agent")
 
-func AuthMiddleware(authClient *auth.Client) func(http.Handler) http.Handler {
+// TokenVerifier turns a bearer token into user claims, either with a Verify call to the
+// auth service (*auth.Client) or locally against its published keys (*auth.RemoteKeySet)
+type TokenVerifier interface {
+	VerifyToken(ctx context.Context, token string) (*auth.UserClaims, error)
+}
+
+// APIKeyVerifier turns an X-API-Key header into the claims of its service account
+type APIKeyVerifier interface {
+	VerifyAPIKey(ctx context.Context, key string) (*auth.UserClaims, error)
+}
+
+// apiKeyHeader lets machine clients authenticate without a user's access token
+const apiKeyHeader = "X-API-Key"
+
+// requestIDHeader names the request in logs and audit records of every service it reaches.
+// Clients may send their own, otherwise one is generated, the response always echoes it
+const requestIDHeader = "X-Request-ID"
+
+// TrustedProxies are the networks of the load balancers in front of the gateway. Only their
+// X-Forwarded-For headers are believed, anyone else could put any address in one
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies reads CIDRs like 10.0.0.0/8, a single address stands for itself
+func ParseTrustedProxies(entries []string) (TrustedProxies, error) {
+	proxies := TrustedProxies{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func (t TrustedProxies) trusts(ip net.IP) bool {
+	for _, network := range t {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the remote address, unless a trusted proxy sent the request. Then X-Forwarded-For
+// is walked from the right, where the proxies appended what they saw, past the trusted hops, and
+// the first untrusted one is the client. Hops further left were written by the client itself
+func (t TrustedProxies) clientIP(r *http.Request) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	ip := net.ParseIP(remote)
+	if ip == nil || !t.trusts(ip) {
+		return remote
+	}
+
+	hops := []string{}
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// garbage is not an address, the last proxy that wrote a valid one is all we know
+			break
+		}
+		client = hop.String()
+		if !t.trusts(hop) {
+			break
+		}
+	}
+	return client
+}
+
+func AuthMiddleware(verifier TokenVerifier, apiKeys APIKeyVerifier, proxies TrustedProxies) func(http.Handler) http.Handler {
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("AuthMiddleware called")
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Remember the caller IP and user agent so auth can track failed logins and sessions per client
+			ctx := context.WithValue(r.Context(), ClientIPCtxKey, proxies.clientIP(r))
+			ctx = context.WithValue(ctx, UserAgentCtxKey, r.UserAgent())
+
+			requestID := strings.TrimSpace(r.Header.Get(requestIDHeader))
+			if requestID == "" {
+				requestID = ksuid.New().String()
+			}
+			ctx = svcauth.ContextWithRequestID(ctx, requestID)
+			w.Header().Set(requestIDHeader, svcauth.RequestIDFromContext(ctx))
+			r = r.WithContext(ctx)
+
+			// API keys act as their service account, the scopes of the key are its permissions
+			if apiKey := r.Header.Get(apiKeyHeader); apiKey != "" {
+				principal, err := apiKeys.VerifyAPIKey(r.Context(), apiKey)
+				if err != nil {
+					Logs.Error(r.Context(), "API key verification failed: "+err.Error())
+					http.Error(w, "Unauthorized: Invalid API key", http.StatusUnauthorized)
+					return
+				}
+				Logs.Info(r.Context(), "Service account authenticated: "+principal.ServiceAccount+" | key: "+principal.ID)
+
+				ctx = context.WithValue(r.Context(), UserCtxKey, principal)
+				ctx = svcauth.ContextWithUser(ctx, &svcauth.User{ID: principal.ID, Role: principal.Role})
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+
 			authHeader := r.Header.Get("Authorization")
 			Logs.LocalOnlyInfo("AuthHeader: " + authHeader)
 			// Case 1: No token → proceed as guest
@@ -29,10 +154,9 @@ func AuthMiddleware(authClient *auth.Client) func(http.Handler) http.Handler {
 
 			// Case 2: Token present → verify
 			token := strings.TrimPrefix(authHeader, "Bearer ")
-			Logs.LocalOnlyInfo("Calling authClient.VerifyToken from middleware with token: " + token)
-			Logs.Info(r.Context(), "Calling authClient.VerifyToken from middleware with token: "+token)
-			user, err := authClient.VerifyToken(r.Context(), token)
-			Logs.Info(r.Context(), "User verified in middleware: "+user.Email+" | role: "+user.Role)
+			Logs.LocalOnlyInfo("Calling VerifyToken from middleware with token: " + token)
+			Logs.Info(r.Context(), "Calling VerifyToken from middleware with token: "+token)
+			user, err := verifier.VerifyToken(r.Context(), token)
 
 			// If token is invalid → reject
 			if err != nil {
@@ -40,12 +164,14 @@ func AuthMiddleware(authClient *auth.Client) func(http.Handler) http.Handler {
 				http.Error(w, "Unauthorized: Invalid token", http.StatusUnauthorized)
 				return
 			}
+			Logs.Info(r.Context(), "User verified in middleware: "+user.Email+" | role: "+user.Role)
 
 			// ✅ Token is valid, now log and inject
 			Logs.Info(r.Context(), "User authenticated: " + user.Email + " | role: " + user.Role + " | token: " + token)
 
-			// Token is valid → inject user into context
-			ctx := context.WithValue(r.Context(), UserCtxKey, user)
+			// Token is valid → inject user into context, and forward it on calls to the services
+			ctx = context.WithValue(r.Context(), UserCtxKey, user)
+			ctx = svcauth.ContextWithUser(ctx, &svcauth.User{ID: user.ID, Email: user.Email, Role: user.Role})
 			r = r.WithContext(ctx)
 			Logs.Info(r.Context(), "Injected user into context: " + user.Email + " | role: " + user.Role + " | token: " + token)
 
@@ -54,6 +180,16 @@ func AuthMiddleware(authClient *auth.Client) func(http.Handler) http.Handler {
 	}
 }
 
+// GetSessionInfoFromContext returns the caller IP and user agent injected by AuthMiddleware
+func GetSessionInfoFromContext(ctx context.Context) auth.SessionInfo {
+	ip, _ := ctx.Value(ClientIPCtxKey).(string)
+	userAgent, _ := ctx.Value(UserAgentCtxKey).(string)
+	return auth.SessionInfo{
+		IPAddress: ip,
+		UserAgent: userAgent,
+	}
+}
+
 type UserClaims struct {
 	UserID string
 	Email  string
@@ -66,20 +202,33 @@ func GetUserFromContext(ctx context.Context) (*auth.UserClaims, bool) {
 	return user, ok
 }
 
-func RequireAdmin(ctx context.Context) (*auth.UserClaims, error) {
+// RequirePermission returns the caller if their access token grants permission
+func RequirePermission(ctx context.Context, permission string) (*auth.UserClaims, error) {
 	Logs := logger.GetGlobalLogger()
 	user, ok := GetUserFromContext(ctx)
-	if !ok {
-		Logs.Error(ctx, "Unauthorized: Invalid token")
-		return nil, fmt.Errorf("ctx is not valid")
+	if !ok || user == nil {
+		Logs.Error(ctx, "Unauthorized: no valid token for "+permission)
+		return nil, fmt.Errorf("unauthenticated: please login")
+	}
+	if !user.HasPermission(permission) {
+		Logs.Error(ctx, "Forbidden: user "+user.ID+" lacks permission "+permission)
+		return nil, fmt.Errorf("forbidden: missing permission %s", permission)
 	}
-	if user == nil {
-		Logs.Error(ctx, "Unauthorized: Invalid token")
-		return nil, fmt.Errorf("user is not valid")
+	return user, nil
+}
+
+// RequireSelfOrPermission lets callers act on their own account, and on others only if they
+// hold anyPermission. It is the resolver half of the :own permissions in the schema
+func RequireSelfOrPermission(ctx context.Context, userID string, anyPermission string) (*auth.UserClaims, error) {
+	Logs := logger.GetGlobalLogger()
+	user, ok := GetUserFromContext(ctx)
+	if !ok || user == nil {
+		Logs.Error(ctx, "Unauthorized: no valid token")
+		return nil, fmt.Errorf("unauthenticated: please login")
 	}
-	if user.Role != "admin" {
-		Logs.Error(ctx, "Forbidden: Admin only")
-		return nil, fmt.Errorf("forbidden: admin only")
+	if user.ID != userID && !user.HasPermission(anyPermission) {
+		Logs.Error(ctx, "Forbidden: user "+user.ID+" may not act for account "+userID)
+		return nil, fmt.Errorf("forbidden: you can only do this for your own account")
 	}
 	return user, nil
 }
@@ -1,9 +1,156 @@
 package graphql
 
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zenvisjr/building-scalable-microservices/account"
+	"github.com/zenvisjr/building-scalable-microservices/catalog"
+)
+
 type Account struct {
-	ID    string `json:"id"`
-	Name  string `json:"name"`
-	Email string `json:"email"`
-	Role  string `json:"role"`
-	IsActive bool `json:"isActive"`
+	ID            string  `json:"id"`
+	Name          string  `json:"name"`
+	Email         string  `json:"email"`
+	Role          string  `json:"role"`
+	IsActive      bool    `json:"isActive"`
+	EmailVerified bool    `json:"emailVerified"`
+	PendingEmail  *string `json:"pendingEmail"`
+	Phone         string  `json:"phone"`
+	CreatedAt     string  `json:"createdAt"`
+}
+
+func toAccount(acc *account.Account) *Account {
+	result := &Account{
+		ID:            acc.ID,
+		Name:          acc.Name,
+		Email:         acc.Email,
+		Role:          acc.Role,
+		IsActive:      acc.IsActive,
+		EmailVerified: acc.EmailVerified,
+		Phone:         acc.Phone,
+		CreatedAt:     acc.CreatedAt.UTC().Format(time.RFC1123),
+	}
+	if acc.PendingEmail != "" {
+		result.PendingEmail = &acc.PendingEmail
+	}
+	return result
+}
+
+func toAccountEvent(event account.AccountEvent) (*AccountEvent, error) {
+	result := &AccountEvent{
+		ID:           strconv.FormatInt(event.ID, 10),
+		AccountID:    event.AccountID,
+		Action:       event.Action,
+		ActorID:      event.ActorID,
+		ActorService: event.ActorService,
+		RequestID:    event.RequestID,
+		CreatedAt:    event.CreatedAt.UTC().Format(time.RFC1123),
+	}
+	if event.Before != nil {
+		before, err := json.Marshal(event.Before)
+		if err != nil {
+			return nil, err
+		}
+		beforeJSON := string(before)
+		result.Before = &beforeJSON
+	}
+	if event.After != nil {
+		after, err := json.Marshal(event.After)
+		if err != nil {
+			return nil, err
+		}
+		afterJSON := string(after)
+		result.After = &afterJSON
+	}
+	return result, nil
+}
+
+func toProduct(p catalog.Product) *Product {
+	result := &Product{
+		ID:           p.ID,
+		Name:         p.Name,
+		Description:  p.Description,
+		Price:        p.Price,
+		Stock:        int(p.Stock),
+		Sold:         int(p.Sold),
+		OutOfStock:   p.OutOfStock,
+		Score:        p.Score,
+		CategoryPath: p.CategoryPath,
+		Tags:         p.Tags,
+		Attributes:   make([]*ProductAttribute, len(p.Attributes)),
+	}
+	if result.CategoryPath == nil {
+		result.CategoryPath = []string{}
+	}
+	if result.Tags == nil {
+		result.Tags = []string{}
+	}
+	if p.CategoryID != "" {
+		result.CategoryID = &p.CategoryID
+	}
+	for i, a := range p.Attributes {
+		result.Attributes[i] = &ProductAttribute{
+			Key:   a.Key,
+			Type:  AttributeType(strings.ToUpper(a.Type)),
+			Value: a.Value,
+		}
+	}
+	return result
+}
+
+// toAttributes maps the GraphQL enum to the attribute types of the catalog, which are lowercase
+func toAttributes(attributes []*ProductAttributeInput) []catalog.Attribute {
+	result := make([]catalog.Attribute, len(attributes))
+	for i, a := range attributes {
+		result[i] = catalog.Attribute{
+			Key:   a.Key,
+			Type:  strings.ToLower(string(a.Type)),
+			Value: a.Value,
+		}
+	}
+	return result
+}
+
+// toProductConnection maps the lowercase facet fields of the catalog to the GraphQL enum
+func toProductConnection(result *catalog.SearchResult) *ProductConnection {
+	converted := &ProductConnection{
+		Edges:      make([]*ProductEdge, len(result.Edges)),
+		PageInfo:   &PageInfo{HasNextPage: result.HasNextPage},
+		TotalCount: int(result.Total),
+		Facets:     make([]*Facet, len(result.Facets)),
+	}
+	for i, edge := range result.Edges {
+		converted.Edges[i] = &ProductEdge{Cursor: edge.Cursor, Node: toProduct(edge.Product)}
+	}
+	if result.EndCursor != "" {
+		converted.PageInfo.EndCursor = &result.EndCursor
+	}
+	for i, facet := range result.Facets {
+		converted.Facets[i] = &Facet{
+			Field:   FacetField(strings.ToUpper(facet.Field)),
+			Buckets: make([]*FacetBucket, len(facet.Buckets)),
+		}
+		for j, bucket := range facet.Buckets {
+			converted.Facets[i].Buckets[j] = &FacetBucket{Key: bucket.Key, Count: int(bucket.Count)}
+		}
+	}
+	return converted
+}
+
+func toCategory(c *catalog.Category) *Category {
+	result := &Category{
+		ID:   c.ID,
+		Name: c.Name,
+		Path: c.Path,
+	}
+	if c.ParentID != "" {
+		result.ParentID = &c.ParentID
+	}
+	if result.Path == nil {
+		result.Path = []string{}
+	}
+	return result
 }
@@ -2,6 +2,47 @@
 
 package graphql
 
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+type AccountConnection struct {
+	Edges      []*AccountEdge `json:"edges"`
+	PageInfo   *PageInfo      `json:"pageInfo"`
+	TotalCount int            `json:"totalCount"`
+}
+
+type AccountDataExport struct {
+	Request  *PrivacyRequest `json:"request"`
+	FileName string          `json:"fileName"`
+	Data     string          `json:"data"`
+}
+
+type AccountEdge struct {
+	Cursor string   `json:"cursor"`
+	Node   *Account `json:"node"`
+}
+
+type AccountEvent struct {
+	ID           string  `json:"id"`
+	AccountID    string  `json:"accountId"`
+	Action       string  `json:"action"`
+	ActorID      string  `json:"actorId"`
+	ActorService string  `json:"actorService"`
+	RequestID    string  `json:"requestId"`
+	Before       *string `json:"before,omitempty"`
+	After        *string `json:"after,omitempty"`
+	CreatedAt    string  `json:"createdAt"`
+}
+
+type AccountHistoryInput struct {
+	UserID string `json:"userId"`
+	Limit  *int   `json:"limit,omitempty"`
+}
+
 type AccountInput struct {
 	Name     string  `json:"name"`
 	Email    string  `json:"email"`
@@ -10,9 +51,67 @@ type AccountInput struct {
 }
 
 type AccountsQueryInput struct {
-	ID         *string     `json:"id,omitempty"`
-	Name       *string     `json:"name,omitempty"`
-	Pagination *Pagination `json:"pagination,omitempty"`
+	ID            *string `json:"id,omitempty"`
+	Name          *string `json:"name,omitempty"`
+	Email         *string `json:"email,omitempty"`
+	Role          *string `json:"role,omitempty"`
+	IsActive      *bool   `json:"isActive,omitempty"`
+	CreatedAfter  *string `json:"createdAfter,omitempty"`
+	CreatedBefore *string `json:"createdBefore,omitempty"`
+	First         *int    `json:"first,omitempty"`
+	After         *string `json:"after,omitempty"`
+}
+
+type Address struct {
+	ID         string `json:"id"`
+	Label      string `json:"label"`
+	Recipient  string `json:"recipient"`
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2"`
+	City       string `json:"city"`
+	State      string `json:"state"`
+	PostalCode string `json:"postalCode"`
+	Country    string `json:"country"`
+	Phone      string `json:"phone"`
+	IsDefault  bool   `json:"isDefault"`
+}
+
+type AddressIDInput struct {
+	ID string `json:"id"`
+}
+
+type AddressInput struct {
+	Label      *string `json:"label,omitempty"`
+	Recipient  string  `json:"recipient"`
+	Line1      string  `json:"line1"`
+	Line2      *string `json:"line2,omitempty"`
+	City       string  `json:"city"`
+	State      *string `json:"state,omitempty"`
+	PostalCode string  `json:"postalCode"`
+	Country    string  `json:"country"`
+	Phone      *string `json:"phone,omitempty"`
+	IsDefault  *bool   `json:"isDefault,omitempty"`
+}
+
+type APIKey struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Prefix     string   `json:"prefix"`
+	Scopes     []string `json:"scopes"`
+	CreatedBy  string   `json:"createdBy"`
+	CreatedAt  string   `json:"createdAt"`
+	ExpiresAt  string   `json:"expiresAt"`
+	LastUsedAt *string  `json:"lastUsedAt,omitempty"`
+	Revoked    bool     `json:"revoked"`
+}
+
+type APIKeyIDInput struct {
+	ID string `json:"id"`
+}
+
+type APIKeySecret struct {
+	APIKey *APIKey `json:"apiKey"`
+	Key    string  `json:"key"`
 }
 
 type AuthResponse struct {
@@ -23,14 +122,81 @@ type AuthResponse struct {
 	Role         string `json:"role"`
 }
 
+type Category struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	ParentID *string  `json:"parentId,omitempty"`
+	Path     []string `json:"path"`
+}
+
+type CategoryIDInput struct {
+	CategoryID string `json:"categoryId"`
+}
+
+type CategoryInput struct {
+	Name     string  `json:"name"`
+	ParentID *string `json:"parentId,omitempty"`
+}
+
+type ChangeRoleInput struct {
+	UserID string `json:"userId"`
+	Role   string `json:"role"`
+}
+
+type CompleteOidcLoginInput struct {
+	Provider string  `json:"provider"`
+	State    string  `json:"state"`
+	Code     string  `json:"code"`
+	Device   *string `json:"device,omitempty"`
+}
+
+type ConfirmPasswordResetInput struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"newPassword"`
+}
+
+type ConfirmTotpInput struct {
+	Code string `json:"code"`
+}
+
+type CreateAPIKeyInput struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays *int     `json:"expiresInDays,omitempty"`
+}
+
 type CurrentUsersQueryInput struct {
 	Role       *string     `json:"role,omitempty"`
 	Pagination *Pagination `json:"pagination,omitempty"`
 }
 
+type Facet struct {
+	Field   FacetField     `json:"field"`
+	Buckets []*FacetBucket `json:"buckets"`
+}
+
+type FacetBucket struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+type FacetInput struct {
+	Field    FacetField `json:"field"`
+	Size     *int       `json:"size,omitempty"`
+	Interval *float64   `json:"interval,omitempty"`
+}
+
 type LoginInput struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email    string  `json:"email"`
+	Password string  `json:"password"`
+	Device   *string `json:"device,omitempty"`
+}
+
+type LoginResult struct {
+	MfaRequired        bool          `json:"mfaRequired"`
+	ChallengeToken     *string       `json:"challengeToken,omitempty"`
+	ChallengeExpiresAt *string       `json:"challengeExpiresAt,omitempty"`
+	Auth               *AuthResponse `json:"auth,omitempty"`
 }
 
 type LogoutInput struct {
@@ -45,16 +211,23 @@ type LogoutResponse struct {
 type Mutation struct {
 }
 
+type OidcAuthorization struct {
+	AuthorizationURL string `json:"authorizationUrl"`
+	State            string `json:"state"`
+}
+
 type Order struct {
-	ID         string            `json:"id"`
-	CreatedAt  string            `json:"createdAt"`
-	TotalPrice float64           `json:"totalPrice"`
-	Products   []*OrderedProduct `json:"products"`
+	ID              string            `json:"id"`
+	CreatedAt       string            `json:"createdAt"`
+	TotalPrice      float64           `json:"totalPrice"`
+	Products        []*OrderedProduct `json:"products"`
+	ShippingAddress *ShippingAddress  `json:"shippingAddress,omitempty"`
 }
 
 type OrderInput struct {
 	AccountID string                 `json:"accountId"`
 	Products  []*OrderedProductInput `json:"products,omitempty"`
+	AddressID *string                `json:"addressId,omitempty"`
 }
 
 type OrderStatusUpdate struct {
@@ -77,20 +250,71 @@ type OrderedProductInput struct {
 	Quantity int    `json:"quantity"`
 }
 
+type PageInfo struct {
+	HasNextPage bool    `json:"hasNextPage"`
+	EndCursor   *string `json:"endCursor,omitempty"`
+}
+
 type Pagination struct {
 	Skip *int `json:"skip,omitempty"`
 	Take *int `json:"take,omitempty"`
 }
 
+type PrivacyRequest struct {
+	ID           string                `json:"id"`
+	Kind         string                `json:"kind"`
+	Status       string                `json:"status"`
+	RequestedBy  string                `json:"requestedBy"`
+	CreatedAt    string                `json:"createdAt"`
+	ScheduledFor *string               `json:"scheduledFor,omitempty"`
+	CompletedAt  *string               `json:"completedAt,omitempty"`
+	Steps        []*PrivacyRequestStep `json:"steps"`
+}
+
+type PrivacyRequestStep struct {
+	Step      string `json:"step"`
+	Status    string `json:"status"`
+	Details   string `json:"details"`
+	CreatedAt string `json:"createdAt"`
+}
+
 type Product struct {
-	ID          string  `json:"id"`
-	Name        string  `json:"name"`
-	Description string  `json:"description"`
-	Price       float64 `json:"price"`
-	Stock       int     `json:"stock"`
-	Sold        int     `json:"sold"`
-	OutOfStock  bool    `json:"outOfStock"`
-	Score       float64 `json:"score"`
+	ID           string              `json:"id"`
+	Name         string              `json:"name"`
+	Description  string              `json:"description"`
+	Price        float64             `json:"price"`
+	Stock        int                 `json:"stock"`
+	Sold         int                 `json:"sold"`
+	OutOfStock   bool                `json:"outOfStock"`
+	Score        float64             `json:"score"`
+	CategoryID   *string             `json:"categoryId,omitempty"`
+	CategoryPath []string            `json:"categoryPath"`
+	Tags         []string            `json:"tags"`
+	Attributes   []*ProductAttribute `json:"attributes"`
+}
+
+type ProductAttribute struct {
+	Key   string        `json:"key"`
+	Type  AttributeType `json:"type"`
+	Value string        `json:"value"`
+}
+
+type ProductAttributeInput struct {
+	Key   string        `json:"key"`
+	Type  AttributeType `json:"type"`
+	Value string        `json:"value"`
+}
+
+type ProductConnection struct {
+	Edges      []*ProductEdge `json:"edges"`
+	PageInfo   *PageInfo      `json:"pageInfo"`
+	TotalCount int            `json:"totalCount"`
+	Facets     []*Facet       `json:"facets"`
+}
+
+type ProductEdge struct {
+	Cursor string   `json:"cursor"`
+	Node   *Product `json:"node"`
 }
 
 type ProductIDInput struct {
@@ -98,23 +322,38 @@ type ProductIDInput struct {
 }
 
 type ProductInput struct {
-	Name        string  `json:"name"`
-	Description string  `json:"description"`
-	Price       float64 `json:"price"`
-	Stock       int     `json:"stock"`
+	Name        string                   `json:"name"`
+	Description string                   `json:"description"`
+	Price       float64                  `json:"price"`
+	Stock       int                      `json:"stock"`
+	CategoryID  *string                  `json:"categoryId,omitempty"`
+	Tags        []string                 `json:"tags,omitempty"`
+	Attributes  []*ProductAttributeInput `json:"attributes,omitempty"`
 }
 
 type ProductsQueryInput struct {
-	Query      *string     `json:"query,omitempty"`
-	ID         *string     `json:"id,omitempty"`
-	Pagination *Pagination `json:"pagination,omitempty"`
+	Query       *string       `json:"query,omitempty"`
+	ID          *string       `json:"id,omitempty"`
+	First       *int          `json:"first,omitempty"`
+	After       *string       `json:"after,omitempty"`
+	MinPrice    *float64      `json:"minPrice,omitempty"`
+	MaxPrice    *float64      `json:"maxPrice,omitempty"`
+	CategoryID  *string       `json:"categoryId,omitempty"`
+	Tags        []string      `json:"tags,omitempty"`
+	InStockOnly *bool         `json:"inStockOnly,omitempty"`
+	Sort        *ProductSort  `json:"sort,omitempty"`
+	Facets      []*FacetInput `json:"facets,omitempty"`
 }
 
 type Query struct {
 }
 
 type RefreshTokenInput struct {
-	UserID string `json:"userId"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+type RequestPasswordResetInput struct {
+	Email string `json:"email"`
 }
 
 type ResetPasswordInput struct {
@@ -132,15 +371,318 @@ type RestockProductInput struct {
 	NewStock  int    `json:"newStock"`
 }
 
+type RevokeSessionInput struct {
+	SessionID string `json:"sessionId"`
+}
+
+type Session struct {
+	ID         string `json:"id"`
+	Device     string `json:"device"`
+	IPAddress  string `json:"ipAddress"`
+	UserAgent  string `json:"userAgent"`
+	CreatedAt  string `json:"createdAt"`
+	LastSeenAt string `json:"lastSeenAt"`
+	Current    bool   `json:"current"`
+}
+
+type ShippingAddress struct {
+	Label      string `json:"label"`
+	Recipient  string `json:"recipient"`
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2"`
+	City       string `json:"city"`
+	State      string `json:"state"`
+	PostalCode string `json:"postalCode"`
+	Country    string `json:"country"`
+	Phone      string `json:"phone"`
+}
+
+type StartOidcLoginInput struct {
+	Provider string `json:"provider"`
+}
+
 type Subscription struct {
 }
 
 type SuggestProductsQueryInput struct {
-	Query string `json:"query"`
-	Size  *int   `json:"size,omitempty"`
-	UseAi *bool  `json:"useAI,omitempty"`
+	Query string       `json:"query"`
+	Size  *int         `json:"size,omitempty"`
+	UseAi *bool        `json:"useAI,omitempty"`
+	Mode  *SuggestMode `json:"mode,omitempty"`
+}
+
+type TotpConfirmation struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+type TotpEnrollment struct {
+	Secret     string `json:"secret"`
+	OtpauthURI string `json:"otpauthUri"`
+}
+
+type UnlockAccountInput struct {
+	Email string `json:"email"`
+}
+
+type UpdateAddressInput struct {
+	ID      string        `json:"id"`
+	Address *AddressInput `json:"address"`
+}
+
+type UpdateCategoryInput struct {
+	ID       string  `json:"id"`
+	Name     string  `json:"name"`
+	ParentID *string `json:"parentId,omitempty"`
+}
+
+type UpdateProfileInput struct {
+	Name  *string `json:"name,omitempty"`
+	Email *string `json:"email,omitempty"`
+	Phone *string `json:"phone,omitempty"`
 }
 
 type UserIDInput struct {
 	UserID string `json:"userId"`
 }
+
+type VerifyEmailInput struct {
+	Token string `json:"token"`
+}
+
+type VerifyLoginChallengeInput struct {
+	ChallengeToken string  `json:"challengeToken"`
+	Code           string  `json:"code"`
+	Device         *string `json:"device,omitempty"`
+}
+
+type AttributeType string
+
+const (
+	AttributeTypeText    AttributeType = "TEXT"
+	AttributeTypeNumber  AttributeType = "NUMBER"
+	AttributeTypeBoolean AttributeType = "BOOLEAN"
+)
+
+var AllAttributeType = []AttributeType{
+	AttributeTypeText,
+	AttributeTypeNumber,
+	AttributeTypeBoolean,
+}
+
+func (e AttributeType) IsValid() bool {
+	switch e {
+	case AttributeTypeText, AttributeTypeNumber, AttributeTypeBoolean:
+		return true
+	}
+	return false
+}
+
+func (e AttributeType) String() string {
+	return string(e)
+}
+
+func (e *AttributeType) UnmarshalGQL(v any) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = AttributeType(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid AttributeType", str)
+	}
+	return nil
+}
+
+func (e AttributeType) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+func (e *AttributeType) UnmarshalJSON(b []byte) error {
+	s, err := strconv.Unquote(string(b))
+	if err != nil {
+		return err
+	}
+	return e.UnmarshalGQL(s)
+}
+
+func (e AttributeType) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	e.MarshalGQL(&buf)
+	return buf.Bytes(), nil
+}
+
+type FacetField string
+
+const (
+	FacetFieldCategory FacetField = "CATEGORY"
+	FacetFieldTags     FacetField = "TAGS"
+	FacetFieldPrice    FacetField = "PRICE"
+)
+
+var AllFacetField = []FacetField{
+	FacetFieldCategory,
+	FacetFieldTags,
+	FacetFieldPrice,
+}
+
+func (e FacetField) IsValid() bool {
+	switch e {
+	case FacetFieldCategory, FacetFieldTags, FacetFieldPrice:
+		return true
+	}
+	return false
+}
+
+func (e FacetField) String() string {
+	return string(e)
+}
+
+func (e *FacetField) UnmarshalGQL(v any) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = FacetField(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid FacetField", str)
+	}
+	return nil
+}
+
+func (e FacetField) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+func (e *FacetField) UnmarshalJSON(b []byte) error {
+	s, err := strconv.Unquote(string(b))
+	if err != nil {
+		return err
+	}
+	return e.UnmarshalGQL(s)
+}
+
+func (e FacetField) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	e.MarshalGQL(&buf)
+	return buf.Bytes(), nil
+}
+
+type ProductSort string
+
+const (
+	ProductSortRelevance   ProductSort = "RELEVANCE"
+	ProductSortPriceAsc    ProductSort = "PRICE_ASC"
+	ProductSortPriceDesc   ProductSort = "PRICE_DESC"
+	ProductSortBestSelling ProductSort = "BEST_SELLING"
+	ProductSortNewest      ProductSort = "NEWEST"
+)
+
+var AllProductSort = []ProductSort{
+	ProductSortRelevance,
+	ProductSortPriceAsc,
+	ProductSortPriceDesc,
+	ProductSortBestSelling,
+	ProductSortNewest,
+}
+
+func (e ProductSort) IsValid() bool {
+	switch e {
+	case ProductSortRelevance, ProductSortPriceAsc, ProductSortPriceDesc, ProductSortBestSelling, ProductSortNewest:
+		return true
+	}
+	return false
+}
+
+func (e ProductSort) String() string {
+	return string(e)
+}
+
+func (e *ProductSort) UnmarshalGQL(v any) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = ProductSort(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid ProductSort", str)
+	}
+	return nil
+}
+
+func (e ProductSort) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+func (e *ProductSort) UnmarshalJSON(b []byte) error {
+	s, err := strconv.Unquote(string(b))
+	if err != nil {
+		return err
+	}
+	return e.UnmarshalGQL(s)
+}
+
+func (e ProductSort) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	e.MarshalGQL(&buf)
+	return buf.Bytes(), nil
+}
+
+type SuggestMode string
+
+const (
+	SuggestModeLexical  SuggestMode = "LEXICAL"
+	SuggestModeSemantic SuggestMode = "SEMANTIC"
+	SuggestModeHybrid   SuggestMode = "HYBRID"
+)
+
+var AllSuggestMode = []SuggestMode{
+	SuggestModeLexical,
+	SuggestModeSemantic,
+	SuggestModeHybrid,
+}
+
+func (e SuggestMode) IsValid() bool {
+	switch e {
+	case SuggestModeLexical, SuggestModeSemantic, SuggestModeHybrid:
+		return true
+	}
+	return false
+}
+
+func (e SuggestMode) String() string {
+	return string(e)
+}
+
+func (e *SuggestMode) UnmarshalGQL(v any) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = SuggestMode(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid SuggestMode", str)
+	}
+	return nil
+}
+
+func (e SuggestMode) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+func (e *SuggestMode) UnmarshalJSON(b []byte) error {
+	s, err := strconv.Unquote(string(b))
+	if err != nil {
+		return err
+	}
+	return e.UnmarshalGQL(s)
+}
+
+func (e SuggestMode) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	e.MarshalGQL(&buf)
+	return buf.Bytes(), nil
+}
@@ -5,7 +5,10 @@ import (
 	"errors"
 	"time"
 
-	"github.com/zenvisjr/building-scalable-microservices/gateway/graphql/internal/validation"
+	"github.com/zenvisjr/building-scalable-microservices/account"
+	"github.com/zenvisjr/building-scalable-microservices/auth"
+	"github.com/zenvisjr/building-scalable-microservices/auth/pb"
+	"github.com/zenvisjr/building-scalable-microservices/internal/validation"
 	"github.com/zenvisjr/building-scalable-microservices/logger"
 	"github.com/zenvisjr/building-scalable-microservices/order"
 )
@@ -37,18 +40,22 @@ type mutationResolver struct {
 func (m *mutationResolver) CreateProduct(ctx context.Context, input ProductInput) (*Product, error) {
 	Logs := logger.GetGlobalLogger()
 
-	// user, ok := GetUserFromContext(ctx)
-	// if !ok {
-	// 	Logs.Error(ctx, "No user in incoming ctx before wrapping")
-	// 	return nil, errors.New("unauthenticated: please login to create a product")
-	// }
-	// Logs.Info(ctx, "User "+user.Email+" is creating a product.")
-
 	validatedInput := validation.ProductInput{
 		Name:        input.Name,
 		Description: input.Description,
 		Price:       input.Price,
 		Stock:       input.Stock,
+		Tags:        input.Tags,
+		Attributes:  make([]*validation.ProductAttributeInput, len(input.Attributes)),
+	}
+	if input.CategoryID != nil {
+		validatedInput.CategoryID = *input.CategoryID
+	}
+	for i, a := range input.Attributes {
+		validatedInput.Attributes[i] = &validation.ProductAttributeInput{
+			Key:   a.Key,
+			Value: a.Value,
+		}
 	}
 
 	if err := validation.ValidateStruct(validatedInput); err != nil {
@@ -59,27 +66,14 @@ func (m *mutationResolver) CreateProduct(ctx context.Context, input ProductInput
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	// user, err := RequireAdmin(ctx)
-	// if err != nil {
-	// 	return nil, err
-	// }
-
-	// Logs.Info(ctx, "Admin "+user.Email+" is creating a product.")
-
-	product, err := m.server.catalogClient.PostProduct(ctx, input.Name, input.Description, input.Price, input.Stock)
+	product, err := m.server.catalogClient.PostProduct(ctx, input.Name, input.Description, input.Price, input.Stock,
+		validatedInput.CategoryID, input.Tags, toAttributes(input.Attributes))
 	if err != nil {
 		Logs.Error(ctx, "Error from catalogClient.PostProduct: "+err.Error())
 		return nil, err
 	}
-	newProduct := &Product{
-		ID:          product.ID,
-		Name:        product.Name,
-		Description: product.Description,
-		Price:       product.Price,
-		Stock:       int(product.Stock),
-	}
 
-	return newProduct, nil
+	return toProduct(*product), nil
 }
 
 	
@@ -91,6 +85,9 @@ func (m *mutationResolver) CreateOrder(ctx context.Context, input OrderInput) (*
 		AccountID: input.AccountID,
 		Products:  make([]*validation.OrderedProductInput, len(input.Products)),
 	}
+	if input.AddressID != nil {
+		validatedInput.AddressID = *input.AddressID
+	}
 	for i, product := range input.Products {
 		validatedInput.Products[i] = &validation.OrderedProductInput{
 			ID:       product.ID,
@@ -106,15 +103,8 @@ func (m *mutationResolver) CreateOrder(ctx context.Context, input OrderInput) (*
 	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
-	// user, ok := GetUserFromContext(ctx)
-	// if !ok {
-	// 	return nil, errors.New("unauthenticated: please login to place an order")
-	// }
-
-	// if user.ID != input.AccountID {
-	// 	Logs.Error(ctx, "Unauthorized: you can only place order for your account")
-	// 	return nil, errors.New("unauthorized: you can only place order for your account")
-	// }
+	// @selfOrPermission already checked an order for another account against order:create:any
+	user, _ := GetUserFromContext(ctx)
 
 	var products []order.OrderedProduct
 	for _, p := range input.Products {
@@ -126,18 +116,19 @@ func (m *mutationResolver) CreateOrder(ctx context.Context, input OrderInput) (*
 			Quantity:  uint32(p.Quantity),
 		})
 	}
-	// Logs.Info(ctx, "User "+user.Email+" is creating an order.")
-	order, err := m.server.orderClient.PostOrder(ctx, input.AccountID, products)
+	Logs.Info(ctx, "User "+user.Email+" is creating an order.")
+	order, err := m.server.orderClient.PostOrder(ctx, input.AccountID, validatedInput.AddressID, products)
 	if err != nil {
 		Logs.Error(ctx, "Error from orderClient.PostOrder: "+err.Error())
 		return nil, err
 	}
 
 	newOrder := &Order{
-		ID:         order.ID,
-		CreatedAt:  order.CreatedAt.Format(time.RFC1123),
-		TotalPrice: order.TotalPrice,
-		Products:   []*OrderedProduct{},
+		ID:              order.ID,
+		CreatedAt:       order.CreatedAt.Format(time.RFC1123),
+		TotalPrice:      order.TotalPrice,
+		Products:        []*OrderedProduct{},
+		ShippingAddress: toShippingAddress(order.ShippingAddress),
 	}
 	for _, p := range order.Products {
 		newOrder.Products = append(newOrder.Products, &OrderedProduct{
@@ -156,20 +147,31 @@ func (m *mutationResolver) CreateOrder(ctx context.Context, input OrderInput) (*
 func (m *mutationResolver) Signup(ctx context.Context, input AccountInput) (*AuthResponse, error) {
 	Logs := logger.GetGlobalLogger()
 
+	var role string
+	if input.Role != nil {
+		role = *input.Role
+	}
 	validatedInput := validation.AccountInput{
 		Name:     input.Name,
 		Email:    input.Email,
 		Password: input.Password,
-		Role:     *input.Role,
+		Role:     role,
 	}
 
 	if err := validation.ValidateStruct(validatedInput); err != nil {
 		Logs.Error(ctx, "Validation failed: "+err.Error())
 		return nil, errors.New("invalid input: " + err.Error())
 	}
+	// Anyone can sign up as a user, any other role has to be handed out by someone allowed to
+	if role != "" && role != "user" {
+		if _, err := RequirePermission(ctx, "role:assign"); err != nil {
+			return nil, err
+		}
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
-	authResp, err := m.server.AuthClient.Signup(ctx, input.Name, input.Email, input.Password, *input.Role)
+	authResp, err := m.server.AuthClient.Signup(ctx, input.Name, input.Email, input.Password, role, GetSessionInfoFromContext(ctx))
 	if err != nil {
 		Logs.Error(ctx, "Error from AuthClient.Signup: "+err.Error())
 		return nil, err
@@ -184,13 +186,16 @@ func (m *mutationResolver) Signup(ctx context.Context, input AccountInput) (*Aut
 	}, nil
 }
 
-func (m *mutationResolver) Login(ctx context.Context, input LoginInput) (*AuthResponse, error) {
+func (m *mutationResolver) Login(ctx context.Context, input LoginInput) (*LoginResult, error) {
 	Logs := logger.GetGlobalLogger()
 
 	validatedInput := validation.LoginInput{
 		Email:    input.Email,
 		Password: input.Password,
 	}
+	if input.Device != nil {
+		validatedInput.Device = *input.Device
+	}
 
 	if err := validation.ValidateStruct(validatedInput); err != nil {
 		Logs.Error(ctx, "Validation failed: "+err.Error())
@@ -199,12 +204,124 @@ func (m *mutationResolver) Login(ctx context.Context, input LoginInput) (*AuthRe
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	authResp, err := m.server.AuthClient.Login(ctx, input.Email, input.Password)
+	info := GetSessionInfoFromContext(ctx)
+	info.Device = validatedInput.Device
+	loginResp, err := m.server.AuthClient.Login(ctx, input.Email, input.Password, info)
 	if err != nil {
 		Logs.Error(ctx, "Error from AuthClient.Login: "+err.Error())
 		return nil, err
 	}
 
+	return toLoginResult(loginResp), nil
+}
+
+func (m *mutationResolver) StartOidcLogin(ctx context.Context, input StartOidcLoginInput) (*OidcAuthorization, error) {
+	Logs := logger.GetGlobalLogger()
+
+	validatedInput := validation.StartOIDCLoginInput{
+		Provider: input.Provider,
+	}
+
+	if err := validation.ValidateStruct(validatedInput); err != nil {
+		Logs.Error(ctx, "Validation failed: "+err.Error())
+		return nil, errors.New("invalid input: " + err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	authorization, err := m.server.AuthClient.StartOIDCLogin(ctx, input.Provider)
+	if err != nil {
+		Logs.Error(ctx, "Error from AuthClient.StartOIDCLogin: "+err.Error())
+		return nil, err
+	}
+	return &OidcAuthorization{
+		AuthorizationURL: authorization.URL,
+		State:            authorization.State,
+	}, nil
+}
+
+func (m *mutationResolver) CompleteOidcLogin(ctx context.Context, input CompleteOidcLoginInput) (*LoginResult, error) {
+	Logs := logger.GetGlobalLogger()
+
+	validatedInput := validation.CompleteOIDCLoginInput{
+		Provider: input.Provider,
+		State:    input.State,
+		Code:     input.Code,
+	}
+	if input.Device != nil {
+		validatedInput.Device = *input.Device
+	}
+
+	if err := validation.ValidateStruct(validatedInput); err != nil {
+		Logs.Error(ctx, "Validation failed: "+err.Error())
+		return nil, errors.New("invalid input: " + err.Error())
+	}
+
+	// the code exchange and key discovery add round trips to the provider
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+
+	info := GetSessionInfoFromContext(ctx)
+	info.Device = validatedInput.Device
+	loginResp, err := m.server.AuthClient.CompleteOIDCLogin(ctx, input.Provider, input.State, input.Code, info)
+	if err != nil {
+		Logs.Error(ctx, "Error from AuthClient.CompleteOIDCLogin: "+err.Error())
+		return nil, err
+	}
+	return toLoginResult(loginResp), nil
+}
+
+// toLoginResult maps the tokens, or the two-factor challenge accounts with TOTP get instead
+func toLoginResult(loginResp *pb.LoginResponse) *LoginResult {
+	if loginResp.ChallengeToken != "" {
+		challengeExpiresAt := loginResp.ChallengeExpiresAt.AsTime().UTC().Format(time.RFC1123)
+		return &LoginResult{
+			MfaRequired:        true,
+			ChallengeToken:     &loginResp.ChallengeToken,
+			ChallengeExpiresAt: &challengeExpiresAt,
+		}
+	}
+
+	authResp := loginResp.Auth
+	return &LoginResult{
+		MfaRequired: false,
+		Auth: &AuthResponse{
+			AccessToken:  authResp.AccessToken,
+			RefreshToken: authResp.RefreshToken,
+			UserID:       authResp.UserId,
+			Email:        authResp.Email,
+			Role:         authResp.Role,
+		},
+	}
+}
+
+func (m *mutationResolver) VerifyLoginChallenge(ctx context.Context, input VerifyLoginChallengeInput) (*AuthResponse, error) {
+	Logs := logger.GetGlobalLogger()
+
+	validatedInput := validation.VerifyLoginChallengeInput{
+		ChallengeToken: input.ChallengeToken,
+		Code:           input.Code,
+	}
+	if input.Device != nil {
+		validatedInput.Device = *input.Device
+	}
+
+	if err := validation.ValidateStruct(validatedInput); err != nil {
+		Logs.Error(ctx, "Validation failed: "+err.Error())
+		return nil, errors.New("invalid input: " + err.Error())
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	info := GetSessionInfoFromContext(ctx)
+	info.Device = validatedInput.Device
+	authResp, err := m.server.AuthClient.VerifyLoginChallenge(ctx, input.ChallengeToken, input.Code, info)
+	if err != nil {
+		Logs.Error(ctx, "Error from AuthClient.VerifyLoginChallenge: "+err.Error())
+		return nil, err
+	}
+
 	return &AuthResponse{
 		AccessToken:  authResp.AccessToken,
 		RefreshToken: authResp.RefreshToken,
@@ -212,14 +329,63 @@ func (m *mutationResolver) Login(ctx context.Context, input LoginInput) (*AuthRe
 		Email:        authResp.Email,
 		Role:         authResp.Role,
 	}, nil
+}
+
+func (m *mutationResolver) EnrollTotp(ctx context.Context) (*TotpEnrollment, error) {
+	Logs := logger.GetGlobalLogger()
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// @auth already checked the caller
+	user, _ := GetUserFromContext(ctx)
+
+	resp, err := m.server.AuthClient.EnrollTOTP(ctx, user.ID)
+	if err != nil {
+		Logs.Error(ctx, "Error from AuthClient.EnrollTOTP: "+err.Error())
+		return nil, err
+	}
+
+	return &TotpEnrollment{
+		Secret:     resp.Secret,
+		OtpauthURI: resp.OtpauthUri,
+	}, nil
+}
+
+func (m *mutationResolver) ConfirmTotp(ctx context.Context, input ConfirmTotpInput) (*TotpConfirmation, error) {
+	Logs := logger.GetGlobalLogger()
+
+	validatedInput := validation.ConfirmTotpInput{
+		Code: input.Code,
+	}
+
+	if err := validation.ValidateStruct(validatedInput); err != nil {
+		Logs.Error(ctx, "Validation failed: "+err.Error())
+		return nil, errors.New("invalid input: " + err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// @auth already checked the caller
+	user, _ := GetUserFromContext(ctx)
+
+	resp, err := m.server.AuthClient.ConfirmTOTP(ctx, user.ID, input.Code)
+	if err != nil {
+		Logs.Error(ctx, "Error from AuthClient.ConfirmTOTP: "+err.Error())
+		return nil, err
+	}
 
+	return &TotpConfirmation{
+		RecoveryCodes: resp.RecoveryCodes,
+	}, nil
 }
 
 func (m *mutationResolver) RefreshToken(ctx context.Context, input RefreshTokenInput) (*AuthResponse, error) {
 	Logs := logger.GetGlobalLogger()
 
 	validatedInput := validation.RefreshTokenInput{
-		UserID: input.UserID,
+		RefreshToken: input.RefreshToken,
 	}
 
 	if err := validation.ValidateStruct(validatedInput); err != nil {
@@ -230,7 +396,7 @@ func (m *mutationResolver) RefreshToken(ctx context.Context, input RefreshTokenI
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	authResp, err := m.server.AuthClient.RefreshToken(ctx, input.UserID)
+	authResp, err := m.server.AuthClient.RefreshToken(ctx, input.RefreshToken)
 	if err != nil {
 		Logs.Error(ctx, "Error from AuthClient.RefreshToken: "+err.Error())
 		return nil, err
@@ -248,24 +414,24 @@ func (m *mutationResolver) RefreshToken(ctx context.Context, input RefreshTokenI
 func (m *mutationResolver) Logout(ctx context.Context, input *LogoutInput) (*LogoutResponse, error) {
 	Logs := logger.GetGlobalLogger()
 
-	validatedInput := validation.LogoutInput{
-		UserID: input.UserID,
-	}
+	// without an input every user is logged out
+	if input != nil {
+		validatedInput := validation.LogoutInput{
+			UserID: input.UserID,
+		}
 
-	if err := validation.ValidateStruct(validatedInput); err != nil {
-		Logs.Error(ctx, "Validation failed: "+err.Error())
-		return nil, errors.New("invalid input: " + err.Error())
+		if err := validation.ValidateStruct(validatedInput); err != nil {
+			Logs.Error(ctx, "Validation failed: "+err.Error())
+			return nil, errors.New("invalid input: " + err.Error())
+		}
 	}
 
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	// Step 1: Get claims from context
-	user, ok := GetUserFromContext(ctx)
-	if !ok {
-		Logs.Error(ctx, "Failed to get user claims: unauthorized")
-		return nil, errors.New("unauthorized")
-	}
+	// Step 1: Get claims from context, @selfOrPermission already checked logging out others or
+	// everyone against session:revoke:any
+	user, _ := GetUserFromContext(ctx)
 
 	userId := user.ID
 	role := user.Role
@@ -276,16 +442,8 @@ func (m *mutationResolver) Logout(ctx context.Context, input *LogoutInput) (*Log
 	if input != nil && input.UserID != "" {
 		targetUserId := input.UserID
 
-		// Check if user is trying to logout someone else
 		if userId != targetUserId {
-			// Only admin can logout other users
-			if role != "admin" {
-				Logs.Warn(ctx, "Unauthorized logout attempt by user: "+userId)
-				return &LogoutResponse{
-					Message: "unauthorized: only admin can logout other users",
-				}, nil
-			}
-			Logs.Info(ctx, "Admin "+userId+" initiated logout for user: "+targetUserId)
+			Logs.Info(ctx, "User "+userId+" initiated logout for user: "+targetUserId)
 		} else {
 			Logs.Info(ctx, "User "+userId+" initiated self logout")
 		}
@@ -303,12 +461,7 @@ func (m *mutationResolver) Logout(ctx context.Context, input *LogoutInput) (*Log
 	}
 
 	// Step 3: Handle global logout (when no input provided)
-	if role != "admin" {
-		Logs.Error(ctx, "Unauthorized global logout attempt by user: "+userId)
-		return nil, errors.New("unauthorized: only admin can logout all users from system")
-	}
-
-	Logs.Info(ctx, "Admin "+userId+" initiated global logout")
+	Logs.Info(ctx, "User "+userId+" initiated global logout")
 	_, err := m.server.AuthClient.Logout(ctx, "") // Empty string for global logout
 	if err != nil {
 		Logs.Error(ctx, "Error from AuthClient.Logout: "+err.Error())
@@ -336,11 +489,8 @@ func (m *mutationResolver) ResetPassword(ctx context.Context, input ResetPasswor
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	user, ok := GetUserFromContext(ctx)
-	if !ok {
-		Logs.Error(ctx, "Failed to get user claims: unauthorized")
-		return nil, errors.New("unauthorized")
-	}
+	// @auth already checked the caller
+	user, _ := GetUserFromContext(ctx)
 	if user.Email != input.Email {
 		Logs.Error(ctx, "Unauthorized reset password attempt by user: "+user.Email)
 		return nil, errors.New("unauthorized: only user can reset their own password")
@@ -357,58 +507,65 @@ func (m *mutationResolver) ResetPassword(ctx context.Context, input ResetPasswor
 	}, nil
 }
 
-func (m *mutationResolver) DeleteProduct(ctx context.Context, input ProductIDInput) (bool, error) {
+func (m *mutationResolver) RequestPasswordReset(ctx context.Context, input RequestPasswordResetInput) (*ResetPasswordResponse, error) {
 	Logs := logger.GetGlobalLogger()
 
-	validatedInput := validation.ProductIDInput{
-		ProductID: input.ProductID,
+	validatedInput := validation.RequestPasswordResetInput{
+		Email: input.Email,
 	}
 
 	if err := validation.ValidateStruct(validatedInput); err != nil {
 		Logs.Error(ctx, "Validation failed: "+err.Error())
-		return false, errors.New("invalid input: " + err.Error())
+		return nil, errors.New("invalid input: " + err.Error())
 	}
 
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	err := m.server.catalogClient.DeleteProduct(ctx, input.ProductID)
+	// The answer is the same whether or not the email has an account
+	resp, err := m.server.AuthClient.RequestPasswordReset(ctx, input.Email)
 	if err != nil {
-		Logs.Error(ctx, "Error from catalogClient.DeleteProduct: "+err.Error())
-		return false, err
+		Logs.Error(ctx, "Error from AuthClient.RequestPasswordReset: "+err.Error())
+		return nil, errors.New("failed to request password reset, please try again later")
 	}
-	return true, nil
+	return &ResetPasswordResponse{
+		Message: resp.Message,
+		Success: true,
+	}, nil
 }
 
-func (m *mutationResolver) RestockProduct(ctx context.Context, input RestockProductInput) (bool, error) {
+func (m *mutationResolver) ConfirmPasswordReset(ctx context.Context, input ConfirmPasswordResetInput) (*ResetPasswordResponse, error) {
 	Logs := logger.GetGlobalLogger()
 
-	validatedInput := validation.RestockProductInput{
-		ProductID: input.ProductID,
-		NewStock:  input.NewStock,
+	validatedInput := validation.ConfirmPasswordResetInput{
+		Token:       input.Token,
+		NewPassword: input.NewPassword,
 	}
 
 	if err := validation.ValidateStruct(validatedInput); err != nil {
 		Logs.Error(ctx, "Validation failed: "+err.Error())
-		return false, errors.New("invalid input: " + err.Error())
+		return nil, errors.New("invalid input: " + err.Error())
 	}
 
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	err := m.server.catalogClient.RestockProduct(ctx, input.ProductID, input.NewStock)
+	resp, err := m.server.AuthClient.ConfirmPasswordReset(ctx, input.Token, input.NewPassword)
 	if err != nil {
-		Logs.Error(ctx, "Error from catalogClient.RestockProduct: "+err.Error())
-		return false, err
+		Logs.Error(ctx, "Error from AuthClient.ConfirmPasswordReset: "+err.Error())
+		return nil, err
 	}
-	return true, nil
+	return &ResetPasswordResponse{
+		Message: resp.Message,
+		Success: true,
+	}, nil
 }
 
-func (m *mutationResolver) DeactivateAccount(ctx context.Context, input UserIDInput) (string, error) {
+func (m *mutationResolver) VerifyEmail(ctx context.Context, input VerifyEmailInput) (string, error) {
 	Logs := logger.GetGlobalLogger()
 
-	validatedInput := validation.UserIDInput{
-		UserID: input.UserID,
+	validatedInput := validation.VerifyEmailInput{
+		Token: input.Token,
 	}
 
 	if err := validation.ValidateStruct(validatedInput); err != nil {
@@ -419,76 +576,689 @@ func (m *mutationResolver) DeactivateAccount(ctx context.Context, input UserIDIn
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	// user, ok := GetUserFromContext(ctx)
-	// if !ok {
-	// 	return "", errors.New("unauthenticated: please login to deactivate account")
-	// }
+	resp, err := m.server.AuthClient.VerifyEmail(ctx, input.Token)
+	if err != nil {
+		Logs.Error(ctx, "Error from AuthClient.VerifyEmail: "+err.Error())
+		return "", err
+	}
+	return resp.Message, nil
+}
 
-	// if user.ID != id {
-	// 	Logs.Error(ctx, "Unauthorized: you can only deactivate your account")
-	// 	return "", errors.New("unauthorized: you can only deactivate your account")
-	// }
+func (m *mutationResolver) ResendVerificationEmail(ctx context.Context) (string, error) {
+	Logs := logger.GetGlobalLogger()
 
-	resp, err := m.server.AuthClient.DeactivateAccount(ctx, input.UserID)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// @auth already checked the caller
+	user, _ := GetUserFromContext(ctx)
+
+	resp, err := m.server.AuthClient.ResendVerificationEmail(ctx, user.ID)
 	if err != nil {
-		Logs.Error(ctx, "Error from AuthClient.DeactivateAccount: "+err.Error())
+		Logs.Error(ctx, "Error from AuthClient.ResendVerificationEmail: "+err.Error())
 		return "", err
 	}
 	return resp.Message, nil
 }
 
-func (m *mutationResolver) ReactivateAccount(ctx context.Context, input UserIDInput) (string, error) {
+func (m *mutationResolver) UpdateProfile(ctx context.Context, input UpdateProfileInput) (*Account, error) {
 	Logs := logger.GetGlobalLogger()
 
-	validatedInput := validation.UserIDInput{
-		UserID: input.UserID,
+	validatedInput := validation.UpdateProfileInput{
+		Name:  input.Name,
+		Email: input.Email,
+	}
+	if input.Phone != nil {
+		validatedInput.Phone = *input.Phone
 	}
 
 	if err := validation.ValidateStruct(validatedInput); err != nil {
 		Logs.Error(ctx, "Validation failed: "+err.Error())
-		return "", errors.New("invalid input: " + err.Error())
+		return nil, errors.New("invalid input: " + err.Error())
 	}
 
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	resp, err := m.server.AuthClient.ReactivateAccount(ctx, input.UserID)
+	// @auth already checked the caller
+	user, _ := GetUserFromContext(ctx)
+
+	// Auth sends the verification email when the email changes
+	_, err := m.server.AuthClient.UpdateProfile(ctx, user.ID, account.ProfileUpdate{
+		Name:  input.Name,
+		Email: input.Email,
+		Phone: input.Phone,
+	})
 	if err != nil {
-		Logs.Error(ctx, "Error from AuthClient.ReactivateAccount: "+err.Error())
-		return "", err
+		Logs.Error(ctx, "Error from AuthClient.UpdateProfile: "+err.Error())
+		return nil, err
 	}
-	return resp.Message, nil
+
+	acc, err := m.server.accountClient.GetAccount(ctx, user.ID)
+	if err != nil {
+		Logs.Error(ctx, "Error from accountClient.GetAccount: "+err.Error())
+		return nil, err
+	}
+	return toAccount(acc), nil
 }
 
-func (m *mutationResolver) DeleteAccount(ctx context.Context, input UserIDInput) (string, error) {
+// validateAddressInput copies the optional fields of the input and validates the address
+func validateAddressInput(input *AddressInput) (*validation.AddressInput, error) {
+	validatedInput := &validation.AddressInput{
+		Recipient:  input.Recipient,
+		Line1:      input.Line1,
+		City:       input.City,
+		PostalCode: input.PostalCode,
+		Country:    input.Country,
+	}
+	if input.Label != nil {
+		validatedInput.Label = *input.Label
+	}
+	if input.Line2 != nil {
+		validatedInput.Line2 = *input.Line2
+	}
+	if input.State != nil {
+		validatedInput.State = *input.State
+	}
+	if input.Phone != nil {
+		validatedInput.Phone = *input.Phone
+	}
+	if input.IsDefault != nil {
+		validatedInput.IsDefault = *input.IsDefault
+	}
+
+	if err := validation.ValidateStruct(validatedInput); err != nil {
+		return nil, errors.New("invalid input: " + err.Error())
+	}
+	return validatedInput, nil
+}
+
+func toAccountAddress(id string, input *validation.AddressInput) account.Address {
+	return account.Address{
+		ID:         id,
+		Label:      input.Label,
+		Recipient:  input.Recipient,
+		Line1:      input.Line1,
+		Line2:      input.Line2,
+		City:       input.City,
+		State:      input.State,
+		PostalCode: input.PostalCode,
+		Country:    input.Country,
+		Phone:      input.Phone,
+		IsDefault:  input.IsDefault,
+	}
+}
+
+func (m *mutationResolver) AddAddress(ctx context.Context, input AddressInput) (*Address, error) {
 	Logs := logger.GetGlobalLogger()
 
-	validatedInput := validation.UserIDInput{
-		UserID: input.UserID,
+	validatedInput, err := validateAddressInput(&input)
+	if err != nil {
+		Logs.Error(ctx, "Validation failed: "+err.Error())
+		return nil, err
 	}
 
-	if err := validation.ValidateStruct(validatedInput); err != nil {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// @auth already checked the caller
+	user, _ := GetUserFromContext(ctx)
+
+	address, err := m.server.accountClient.AddAddress(ctx, user.ID, toAccountAddress("", validatedInput))
+	if err != nil {
+		Logs.Error(ctx, "Error from accountClient.AddAddress: "+err.Error())
+		return nil, err
+	}
+	return toAddress(address), nil
+}
+
+func (m *mutationResolver) UpdateAddress(ctx context.Context, input UpdateAddressInput) (*Address, error) {
+	Logs := logger.GetGlobalLogger()
+
+	if err := validation.ValidateStruct(validation.AddressIDInput{ID: input.ID}); err != nil {
 		Logs.Error(ctx, "Validation failed: "+err.Error())
-		return "", errors.New("invalid input: " + err.Error())
+		return nil, errors.New("invalid input: " + err.Error())
+	}
+	validatedInput, err := validateAddressInput(input.Address)
+	if err != nil {
+		Logs.Error(ctx, "Validation failed: "+err.Error())
+		return nil, err
 	}
 
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	user, ok := GetUserFromContext(ctx)
-	if !ok {
-		return "", errors.New("unauthenticated: please login to delete account")
+	// @auth already checked the caller
+	user, _ := GetUserFromContext(ctx)
+
+	address, err := m.server.accountClient.UpdateAddress(ctx, user.ID, toAccountAddress(input.ID, validatedInput))
+	if err != nil {
+		Logs.Error(ctx, "Error from accountClient.UpdateAddress: "+err.Error())
+		return nil, err
 	}
+	return toAddress(address), nil
+}
 
-	if user.ID != input.UserID {
-		Logs.Error(ctx, "Unauthorized: you can only delete your account")
-		return "", errors.New("unauthorized: you can only delete your account")
+func (m *mutationResolver) DeleteAddress(ctx context.Context, input AddressIDInput) (bool, error) {
+	Logs := logger.GetGlobalLogger()
+
+	if err := validation.ValidateStruct(validation.AddressIDInput{ID: input.ID}); err != nil {
+		Logs.Error(ctx, "Validation failed: "+err.Error())
+		return false, errors.New("invalid input: " + err.Error())
 	}
 
-	resp, err := m.server.AuthClient.DeleteAccount(ctx, input.UserID)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// @auth already checked the caller
+	user, _ := GetUserFromContext(ctx)
+
+	if err := m.server.accountClient.DeleteAddress(ctx, user.ID, input.ID); err != nil {
+		Logs.Error(ctx, "Error from accountClient.DeleteAddress: "+err.Error())
+		return false, err
+	}
+	return true, nil
+}
+
+func (m *mutationResolver) SetDefaultAddress(ctx context.Context, input AddressIDInput) (*Address, error) {
+	Logs := logger.GetGlobalLogger()
+
+	if err := validation.ValidateStruct(validation.AddressIDInput{ID: input.ID}); err != nil {
+		Logs.Error(ctx, "Validation failed: "+err.Error())
+		return nil, errors.New("invalid input: " + err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// @auth already checked the caller
+	user, _ := GetUserFromContext(ctx)
+
+	address, err := m.server.accountClient.SetDefaultAddress(ctx, user.ID, input.ID)
 	if err != nil {
-		Logs.Error(ctx, "Error from AuthClient.DeleteAccount: "+err.Error())
-		return "", err
+		Logs.Error(ctx, "Error from accountClient.SetDefaultAddress: "+err.Error())
+		return nil, err
 	}
-	return resp.Message, nil
+	return toAddress(address), nil
+}
+
+func (m *mutationResolver) DeleteProduct(ctx context.Context, input ProductIDInput) (bool, error) {
+	Logs := logger.GetGlobalLogger()
+
+	validatedInput := validation.ProductIDInput{
+		ProductID: input.ProductID,
+	}
+
+	if err := validation.ValidateStruct(validatedInput); err != nil {
+		Logs.Error(ctx, "Validation failed: "+err.Error())
+		return false, errors.New("invalid input: " + err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	err := m.server.catalogClient.DeleteProduct(ctx, input.ProductID)
+	if err != nil {
+		Logs.Error(ctx, "Error from catalogClient.DeleteProduct: "+err.Error())
+		return false, err
+	}
+	return true, nil
+}
+
+func (m *mutationResolver) RestockProduct(ctx context.Context, input RestockProductInput) (bool, error) {
+	Logs := logger.GetGlobalLogger()
+
+	validatedInput := validation.RestockProductInput{
+		ProductID: input.ProductID,
+		NewStock:  input.NewStock,
+	}
+
+	if err := validation.ValidateStruct(validatedInput); err != nil {
+		Logs.Error(ctx, "Validation failed: "+err.Error())
+		return false, errors.New("invalid input: " + err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	err := m.server.catalogClient.RestockProduct(ctx, input.ProductID, input.NewStock)
+	if err != nil {
+		Logs.Error(ctx, "Error from catalogClient.RestockProduct: "+err.Error())
+		return false, err
+	}
+	return true, nil
+}
+
+func (m *mutationResolver) CreateCategory(ctx context.Context, input CategoryInput) (*Category, error) {
+	Logs := logger.GetGlobalLogger()
+
+	validatedInput := validation.CategoryInput{
+		Name: input.Name,
+	}
+	if input.ParentID != nil {
+		validatedInput.ParentID = *input.ParentID
+	}
+
+	if err := validation.ValidateStruct(validatedInput); err != nil {
+		Logs.Error(ctx, "Validation failed: "+err.Error())
+		return nil, errors.New("invalid input: " + err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	category, err := m.server.catalogClient.CreateCategory(ctx, validatedInput.Name, validatedInput.ParentID)
+	if err != nil {
+		Logs.Error(ctx, "Error from catalogClient.CreateCategory: "+err.Error())
+		return nil, err
+	}
+	return toCategory(category), nil
+}
+
+func (m *mutationResolver) UpdateCategory(ctx context.Context, input UpdateCategoryInput) (*Category, error) {
+	Logs := logger.GetGlobalLogger()
+
+	validatedInput := validation.UpdateCategoryInput{
+		ID:   input.ID,
+		Name: input.Name,
+	}
+	if input.ParentID != nil {
+		validatedInput.ParentID = *input.ParentID
+	}
+
+	if err := validation.ValidateStruct(validatedInput); err != nil {
+		Logs.Error(ctx, "Validation failed: "+err.Error())
+		return nil, errors.New("invalid input: " + err.Error())
+	}
+
+	// moving a category rewrites the paths of its subcategories and products
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	category, err := m.server.catalogClient.UpdateCategory(ctx, validatedInput.ID, validatedInput.Name, validatedInput.ParentID)
+	if err != nil {
+		Logs.Error(ctx, "Error from catalogClient.UpdateCategory: "+err.Error())
+		return nil, err
+	}
+	return toCategory(category), nil
+}
+
+func (m *mutationResolver) DeleteCategory(ctx context.Context, input CategoryIDInput) (bool, error) {
+	Logs := logger.GetGlobalLogger()
+
+	validatedInput := validation.CategoryIDInput{
+		CategoryID: input.CategoryID,
+	}
+
+	if err := validation.ValidateStruct(validatedInput); err != nil {
+		Logs.Error(ctx, "Validation failed: "+err.Error())
+		return false, errors.New("invalid input: " + err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if err := m.server.catalogClient.DeleteCategory(ctx, input.CategoryID); err != nil {
+		Logs.Error(ctx, "Error from catalogClient.DeleteCategory: "+err.Error())
+		return false, err
+	}
+	return true, nil
+}
+
+func (m *mutationResolver) DeactivateAccount(ctx context.Context, input UserIDInput) (string, error) {
+	Logs := logger.GetGlobalLogger()
+
+	validatedInput := validation.UserIDInput{
+		UserID: input.UserID,
+	}
+
+	if err := validation.ValidateStruct(validatedInput); err != nil {
+		Logs.Error(ctx, "Validation failed: "+err.Error())
+		return "", errors.New("invalid input: " + err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	resp, err := m.server.AuthClient.DeactivateAccount(ctx, input.UserID)
+	if err != nil {
+		Logs.Error(ctx, "Error from AuthClient.DeactivateAccount: "+err.Error())
+		return "", err
+	}
+	return resp.Message, nil
+}
+
+func (m *mutationResolver) ReactivateAccount(ctx context.Context, input UserIDInput) (string, error) {
+	Logs := logger.GetGlobalLogger()
+
+	validatedInput := validation.UserIDInput{
+		UserID: input.UserID,
+	}
+
+	if err := validation.ValidateStruct(validatedInput); err != nil {
+		Logs.Error(ctx, "Validation failed: "+err.Error())
+		return "", errors.New("invalid input: " + err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	resp, err := m.server.AuthClient.ReactivateAccount(ctx, input.UserID)
+	if err != nil {
+		Logs.Error(ctx, "Error from AuthClient.ReactivateAccount: "+err.Error())
+		return "", err
+	}
+	return resp.Message, nil
+}
+
+func (m *mutationResolver) ChangeRole(ctx context.Context, input ChangeRoleInput) (*Account, error) {
+	Logs := logger.GetGlobalLogger()
+
+	validatedInput := validation.ChangeRoleInput{
+		UserID: input.UserID,
+		Role:   input.Role,
+	}
+
+	if err := validation.ValidateStruct(validatedInput); err != nil {
+		Logs.Error(ctx, "Validation failed: "+err.Error())
+		return nil, errors.New("invalid input: " + err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	acc, err := m.server.accountClient.ChangeRole(ctx, input.UserID, input.Role)
+	if err != nil {
+		Logs.Error(ctx, "Error from accountClient.ChangeRole: "+err.Error())
+		return nil, err
+	}
+	return toAccount(acc), nil
+}
+
+func (m *mutationResolver) DeleteAccount(ctx context.Context, input UserIDInput) (string, error) {
+	Logs := logger.GetGlobalLogger()
+
+	validatedInput := validation.UserIDInput{
+		UserID: input.UserID,
+	}
+
+	if err := validation.ValidateStruct(validatedInput); err != nil {
+		Logs.Error(ctx, "Validation failed: "+err.Error())
+		return "", errors.New("invalid input: " + err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	resp, err := m.server.AuthClient.DeleteAccount(ctx, input.UserID)
+	if err != nil {
+		Logs.Error(ctx, "Error from AuthClient.DeleteAccount: "+err.Error())
+		return "", err
+	}
+	return resp.Message, nil
+}
+
+// ExportAccountData is open to every user for their own account, privacy:manage exports any account
+func (m *mutationResolver) ExportAccountData(ctx context.Context, input UserIDInput) (*AccountDataExport, error) {
+	Logs := logger.GetGlobalLogger()
+
+	validatedInput := validation.UserIDInput{
+		UserID: input.UserID,
+	}
+
+	if err := validation.ValidateStruct(validatedInput); err != nil {
+		Logs.Error(ctx, "Validation failed: "+err.Error())
+		return nil, errors.New("invalid input: " + err.Error())
+	}
+
+	// Gathering the data calls the account and order services, give it more time
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+
+	// @selfOrPermission already checked the caller against privacy:manage
+	user, _ := GetUserFromContext(ctx)
+
+	request, archive, err := m.server.AuthClient.ExportAccountData(ctx, input.UserID, user.ID)
+	if err != nil {
+		Logs.Error(ctx, "Error from AuthClient.ExportAccountData: "+err.Error())
+		return nil, err
+	}
+	return &AccountDataExport{
+		Request:  toPrivacyRequest(request),
+		FileName: "account-" + input.UserID + "-" + request.CreatedAt.UTC().Format("20060102") + ".json",
+		Data:     string(archive),
+	}, nil
+}
+
+func (m *mutationResolver) RequestAccountErasure(ctx context.Context, input UserIDInput) (*PrivacyRequest, error) {
+	Logs := logger.GetGlobalLogger()
+
+	validatedInput := validation.UserIDInput{
+		UserID: input.UserID,
+	}
+
+	if err := validation.ValidateStruct(validatedInput); err != nil {
+		Logs.Error(ctx, "Validation failed: "+err.Error())
+		return nil, errors.New("invalid input: " + err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// @selfOrPermission already checked the caller against privacy:manage
+	user, _ := GetUserFromContext(ctx)
+
+	request, err := m.server.AuthClient.RequestErasure(ctx, input.UserID, user.ID)
+	if err != nil {
+		Logs.Error(ctx, "Error from AuthClient.RequestErasure: "+err.Error())
+		return nil, err
+	}
+	return toPrivacyRequest(request), nil
+}
+
+func (m *mutationResolver) CancelAccountErasure(ctx context.Context, input UserIDInput) (*PrivacyRequest, error) {
+	Logs := logger.GetGlobalLogger()
+
+	validatedInput := validation.UserIDInput{
+		UserID: input.UserID,
+	}
+
+	if err := validation.ValidateStruct(validatedInput); err != nil {
+		Logs.Error(ctx, "Validation failed: "+err.Error())
+		return nil, errors.New("invalid input: " + err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// @selfOrPermission already checked the caller against privacy:manage
+	user, _ := GetUserFromContext(ctx)
+
+	request, err := m.server.AuthClient.CancelErasure(ctx, input.UserID, user.ID)
+	if err != nil {
+		Logs.Error(ctx, "Error from AuthClient.CancelErasure: "+err.Error())
+		return nil, err
+	}
+	return toPrivacyRequest(request), nil
+}
+
+func toPrivacyRequest(request *auth.PrivacyRequest) *PrivacyRequest {
+	result := &PrivacyRequest{
+		ID:          request.ID,
+		Kind:        request.Kind,
+		Status:      request.Status,
+		RequestedBy: request.RequestedBy,
+		CreatedAt:   request.CreatedAt.UTC().Format(time.RFC1123),
+		Steps:       make([]*PrivacyRequestStep, 0, len(request.Steps)),
+	}
+	if !request.ScheduledFor.IsZero() {
+		scheduledFor := request.ScheduledFor.UTC().Format(time.RFC1123)
+		result.ScheduledFor = &scheduledFor
+	}
+	if !request.CompletedAt.IsZero() {
+		completedAt := request.CompletedAt.UTC().Format(time.RFC1123)
+		result.CompletedAt = &completedAt
+	}
+	for _, step := range request.Steps {
+		result.Steps = append(result.Steps, &PrivacyRequestStep{
+			Step:      step.Step,
+			Status:    step.Status,
+			Details:   step.Details,
+			CreatedAt: step.CreatedAt.UTC().Format(time.RFC1123),
+		})
+	}
+	return result
+}
+
+func (m *mutationResolver) UnlockAccount(ctx context.Context, input UnlockAccountInput) (string, error) {
+	Logs := logger.GetGlobalLogger()
+
+	validatedInput := validation.UnlockAccountInput{
+		Email: input.Email,
+	}
+
+	if err := validation.ValidateStruct(validatedInput); err != nil {
+		Logs.Error(ctx, "Validation failed: "+err.Error())
+		return "", errors.New("invalid input: " + err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// @hasPermission(account:unlock) already checked the caller
+	user, _ := GetUserFromContext(ctx)
+	Logs.Info(ctx, "User "+user.Email+" is unlocking account: "+input.Email)
+
+	resp, err := m.server.AuthClient.UnlockAccount(ctx, input.Email)
+	if err != nil {
+		Logs.Error(ctx, "Error from AuthClient.UnlockAccount: "+err.Error())
+		return "", err
+	}
+	return resp.Message, nil
+}
+
+func (m *mutationResolver) RevokeSession(ctx context.Context, input RevokeSessionInput) (string, error) {
+	Logs := logger.GetGlobalLogger()
+
+	validatedInput := validation.RevokeSessionInput{
+		SessionID: input.SessionID,
+	}
+
+	if err := validation.ValidateStruct(validatedInput); err != nil {
+		Logs.Error(ctx, "Validation failed: "+err.Error())
+		return "", errors.New("invalid input: " + err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// @auth already checked the caller
+	user, _ := GetUserFromContext(ctx)
+
+	resp, err := m.server.AuthClient.RevokeSession(ctx, user.ID, input.SessionID)
+	if err != nil {
+		Logs.Error(ctx, "Error from AuthClient.RevokeSession: "+err.Error())
+		return "", err
+	}
+	return resp.Message, nil
+}
+
+func (m *mutationResolver) CreateAPIKey(ctx context.Context, input CreateAPIKeyInput) (*APIKeySecret, error) {
+	Logs := logger.GetGlobalLogger()
+
+	validatedInput := validation.CreateAPIKeyInput{
+		Name:   input.Name,
+		Scopes: input.Scopes,
+	}
+	if input.ExpiresInDays != nil {
+		validatedInput.ExpiresInDays = *input.ExpiresInDays
+	}
+
+	if err := validation.ValidateStruct(validatedInput); err != nil {
+		Logs.Error(ctx, "Validation failed: "+err.Error())
+		return nil, errors.New("invalid input: " + err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// @hasPermission(apikey:manage) already checked the caller
+	user, _ := GetUserFromContext(ctx)
+
+	// zero lets the auth service apply its default expiry
+	ttl := time.Duration(validatedInput.ExpiresInDays) * 24 * time.Hour
+	key, secret, err := m.server.AuthClient.CreateAPIKey(ctx, user.ID, input.Name, input.Scopes, ttl)
+	if err != nil {
+		Logs.Error(ctx, "Error from AuthClient.CreateAPIKey: "+err.Error())
+		return nil, err
+	}
+	return &APIKeySecret{APIKey: toAPIKey(key), Key: secret}, nil
+}
+
+func (m *mutationResolver) RotateAPIKey(ctx context.Context, input APIKeyIDInput) (*APIKeySecret, error) {
+	Logs := logger.GetGlobalLogger()
+
+	validatedInput := validation.APIKeyIDInput{
+		ID: input.ID,
+	}
+
+	if err := validation.ValidateStruct(validatedInput); err != nil {
+		Logs.Error(ctx, "Validation failed: "+err.Error())
+		return nil, errors.New("invalid input: " + err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	user, _ := GetUserFromContext(ctx)
+
+	key, secret, err := m.server.AuthClient.RotateAPIKey(ctx, user.ID, input.ID)
+	if err != nil {
+		Logs.Error(ctx, "Error from AuthClient.RotateAPIKey: "+err.Error())
+		return nil, err
+	}
+	return &APIKeySecret{APIKey: toAPIKey(key), Key: secret}, nil
+}
+
+func (m *mutationResolver) RevokeAPIKey(ctx context.Context, input APIKeyIDInput) (string, error) {
+	Logs := logger.GetGlobalLogger()
+
+	validatedInput := validation.APIKeyIDInput{
+		ID: input.ID,
+	}
+
+	if err := validation.ValidateStruct(validatedInput); err != nil {
+		Logs.Error(ctx, "Validation failed: "+err.Error())
+		return "", errors.New("invalid input: " + err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	user, _ := GetUserFromContext(ctx)
+
+	resp, err := m.server.AuthClient.RevokeAPIKey(ctx, user.ID, input.ID)
+	if err != nil {
+		Logs.Error(ctx, "Error from AuthClient.RevokeAPIKey: "+err.Error())
+		return "", err
+	}
+	return resp.Message, nil
+}
+
+func toAPIKey(key *auth.APIKey) *APIKey {
+	result := &APIKey{
+		ID:        key.ID,
+		Name:      key.Name,
+		Prefix:    key.Prefix,
+		Scopes:    key.Scopes,
+		CreatedBy: key.CreatedBy,
+		CreatedAt: key.CreatedAt.UTC().Format(time.RFC1123),
+		ExpiresAt: key.ExpiresAt.UTC().Format(time.RFC1123),
+		Revoked:   !key.RevokedAt.IsZero(),
+	}
+	if !key.LastUsedAt.IsZero() {
+		lastUsedAt := key.LastUsedAt.UTC().Format(time.RFC1123)
+		result.LastUsedAt = &lastUsedAt
+	}
+	return result
 }
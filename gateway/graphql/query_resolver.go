@@ -3,9 +3,12 @@ package graphql
 import (
 	"context"
 	"errors"
+	"strings"
 	"time"
 
-	"github.com/zenvisjr/building-scalable-microservices/gateway/graphql/internal/validation"
+	"github.com/zenvisjr/building-scalable-microservices/account"
+	"github.com/zenvisjr/building-scalable-microservices/catalog"
+	"github.com/zenvisjr/building-scalable-microservices/internal/validation"
 	"github.com/zenvisjr/building-scalable-microservices/logger"
 )
 
@@ -26,22 +29,35 @@ func (p *Pagination) bounds() (uint64, uint64) {
 
 }
 
-func safeBounds(p *Pagination) (uint64, uint64) {
-	if p != nil {
-		return p.bounds()
-	}
-	return 0, 100
-}
-
-func (q *queryResolver) Accounts(ctx context.Context, input *AccountsQueryInput) ([]*Account, error) {
+func (q *queryResolver) Accounts(ctx context.Context, input *AccountsQueryInput) (*AccountConnection, error) {
 	Logs := logger.GetGlobalLogger()
-	validatedInput := validation.AccountsQueryInput{
-		ID:         *input.ID,
-		Name:       *input.Name,
-		Pagination: &validation.Pagination{
-			Skip: *input.Pagination.Skip,
-			Take: *input.Pagination.Take,
-		},
+	if input == nil {
+		input = &AccountsQueryInput{}
+	}
+	validatedInput := validation.AccountsQueryInput{}
+	if input.ID != nil {
+		validatedInput.ID = *input.ID
+	}
+	if input.Name != nil {
+		validatedInput.Name = *input.Name
+	}
+	if input.Email != nil {
+		validatedInput.Email = *input.Email
+	}
+	if input.Role != nil {
+		validatedInput.Role = *input.Role
+	}
+	if input.CreatedAfter != nil {
+		validatedInput.CreatedAfter = *input.CreatedAfter
+	}
+	if input.CreatedBefore != nil {
+		validatedInput.CreatedBefore = *input.CreatedBefore
+	}
+	if input.First != nil {
+		validatedInput.First = *input.First
+	}
+	if input.After != nil {
+		validatedInput.After = *input.After
 	}
 
 	if err := validation.ValidateStruct(validatedInput); err != nil {
@@ -49,79 +65,82 @@ func (q *queryResolver) Accounts(ctx context.Context, input *AccountsQueryInput)
 		return nil, errors.New("invalid input: " + err.Error())
 	}
 
-	// user, ok := GetUserFromContext(ctx)
-	// if !ok {
-	// 	Logs.Error(ctx, "No user in incoming ctx before wrapping")
-	// }
-	// Logs.Info(ctx, "User in incoming ctx before wrapping: "+user.Email)
-	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
-	defer cancel()
-
-	// user, err := RequireAdmin(ctx)
-	// if err != nil {
-	// 	return nil, err
-	// }
-
-	// Logs.Info(ctx, "Admin "+user.Email+" is fetching accounts.")
-
-	if input.ID != nil {
-		res, err := q.server.accountClient.GetAccount(ctx, *input.ID)
-		if err != nil {
-			Logs.Error(ctx, "Error from accountClient.GetAccount: "+err.Error())
-			return nil, err
-		}
-		return []*Account{{
-			ID:       res.ID,
-			Name:     res.Name,
-			Email:    res.Email,
-			Role:     res.Role,
-			IsActive: res.IsActive,
-		}}, nil
+	filter := account.AccountFilter{
+		ID:       validatedInput.ID,
+		Name:     validatedInput.Name,
+		Email:    validatedInput.Email,
+		Role:     validatedInput.Role,
+		IsActive: input.IsActive,
 	}
-
-	if input.Name != nil {
-		res, err := q.server.accountClient.GetEmail(ctx, *input.Name)
-		if err != nil {
-			Logs.Error(ctx, "Error from accountClient.GetEmail: "+err.Error())
-			return nil, err
-		}
-		return []*Account{
-			{
-				Email: res.Email,
-			},
-		}, nil
+	// The validation above already made sure both dates parse
+	if validatedInput.CreatedAfter != "" {
+		filter.CreatedAfter, _ = time.Parse(time.RFC3339, validatedInput.CreatedAfter)
+	}
+	if validatedInput.CreatedBefore != "" {
+		filter.CreatedBefore, _ = time.Parse(time.RFC3339, validatedInput.CreatedBefore)
 	}
 
-	skip, take := safeBounds(input.Pagination)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
 
-	accountList, err := q.server.accountClient.GetAccounts(ctx, skip, take)
+	page, err := q.server.accountClient.SearchAccounts(ctx, filter, validatedInput.First, validatedInput.After)
 	if err != nil {
-		Logs.Error(ctx, "Error from accountClient.GetAccounts: "+err.Error())
+		Logs.Error(ctx, "Error from accountClient.SearchAccounts: "+err.Error())
 		return nil, err
 	}
-	var accounts []*Account
-	for _, account := range accountList {
-		accounts = append(accounts, &Account{
-			ID:       account.ID,
-			Name:     account.Name,
-			Email:    account.Email,
-			Role:     account.Role,
-			IsActive: account.IsActive,
-		})
+
+	connection := &AccountConnection{
+		Edges:      make([]*AccountEdge, len(page.Edges)),
+		PageInfo:   &PageInfo{HasNextPage: page.HasNextPage},
+		TotalCount: int(page.TotalCount),
 	}
-	return accounts, nil
+	for i := range page.Edges {
+		connection.Edges[i] = &AccountEdge{
+			Cursor: page.Edges[i].Cursor,
+			Node:   toAccount(&page.Edges[i].Account),
+		}
+	}
+	if page.EndCursor != "" {
+		connection.PageInfo.EndCursor = &page.EndCursor
+	}
+	return connection, nil
 }
 
-func (q *queryResolver) Products(ctx context.Context, input *ProductsQueryInput) ([]*Product, error) {
+func (q *queryResolver) Products(ctx context.Context, input *ProductsQueryInput) (*ProductConnection, error) {
 	Logs := logger.GetGlobalLogger()
+	if input == nil {
+		input = &ProductsQueryInput{}
+	}
 
 	validatedInput := validation.ProductsQueryInput{
-		Query:      *input.Query,
-		ID:         *input.ID,
-		Pagination: &validation.Pagination{
-			Skip: *input.Pagination.Skip,
-			Take: *input.Pagination.Take,
-		},
+		MinPrice: input.MinPrice,
+		MaxPrice: input.MaxPrice,
+		Tags:     input.Tags,
+		Facets:   make([]*validation.FacetInput, len(input.Facets)),
+	}
+	if input.Query != nil {
+		validatedInput.Query = *input.Query
+	}
+	if input.ID != nil {
+		validatedInput.ID = *input.ID
+	}
+	if input.CategoryID != nil {
+		validatedInput.CategoryID = *input.CategoryID
+	}
+	if input.First != nil {
+		validatedInput.First = *input.First
+	}
+	if input.After != nil {
+		validatedInput.After = *input.After
+	}
+	for i, facet := range input.Facets {
+		validatedInput.Facets[i] = &validation.FacetInput{}
+		if facet.Size != nil {
+			validatedInput.Facets[i].Size = *facet.Size
+		}
+		if facet.Interval != nil {
+			validatedInput.Facets[i].Interval = *facet.Interval
+		}
 	}
 
 	if err := validation.ValidateStruct(validatedInput); err != nil {
@@ -132,60 +151,50 @@ func (q *queryResolver) Products(ctx context.Context, input *ProductsQueryInput)
 	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	// user, err := RequireAdmin(ctx)
-	// if err != nil {
-	// 	return nil, err
-	// }
-
-	// Logs.Info(ctx, "Admin "+user.Email+" is fetching products.")
-
 	if input.ID != nil {
 		res, err := q.server.catalogClient.GetProduct(ctx, *input.ID)
 		if err != nil {
 			Logs.Error(ctx, "Error from catalogClient.GetProduct: "+err.Error())
 			return nil, err
 		}
-		return []*Product{{
-			ID:          res.ID,
-			Name:        res.Name,
-			Description: res.Description,
-			Price:       res.Price,
-			Stock:       int(res.Stock),
-			Sold:        int(res.Sold),
-			OutOfStock:  res.OutOfStock,
-		}}, nil
+		return &ProductConnection{
+			Edges:      []*ProductEdge{{Node: toProduct(*res)}},
+			PageInfo:   &PageInfo{},
+			TotalCount: 1,
+			Facets:     []*Facet{},
+		}, nil
 	}
 
-	skip, take := safeBounds(input.Pagination)
-
-	var qu string
-	if input.Query != nil {
-		qu = *input.Query
+	query := catalog.SearchQuery{
+		Query:       validatedInput.Query,
+		MinPrice:    input.MinPrice,
+		MaxPrice:    input.MaxPrice,
+		CategoryID:  validatedInput.CategoryID,
+		Tags:        input.Tags,
+		InStockOnly: input.InStockOnly == nil || *input.InStockOnly,
+		Facets:      make([]catalog.FacetRequest, len(input.Facets)),
+		Take:        uint64(validatedInput.First),
+		After:       validatedInput.After,
+	}
+	if input.Sort != nil {
+		query.Sort = strings.ToLower(string(*input.Sort))
+	}
+	for i, facet := range input.Facets {
+		query.Facets[i] = catalog.FacetRequest{
+			Field:    strings.ToLower(string(facet.Field)),
+			Size:     validatedInput.Facets[i].Size,
+			Interval: validatedInput.Facets[i].Interval,
+		}
 	}
 
-	productList, err := q.server.catalogClient.GetProducts(ctx, skip, take, nil, qu)
+	result, err := q.server.catalogClient.SearchProducts(ctx, query)
 	if err != nil {
-		Logs.Error(ctx, "Error from catalogClient.GetProducts: "+err.Error())
+		Logs.Error(ctx, "Error from catalogClient.SearchProducts: "+err.Error())
 		return nil, err
 	}
-	var products []*Product
-	for _, product := range productList {
-		products = append(products, &Product{
-			ID:          product.ID,
-			Name:        product.Name,
-			Description: product.Description,
-			Price:       product.Price,
-			Stock:       int(product.Stock),
-			Sold:        int(product.Sold),
-			OutOfStock:  product.OutOfStock,
-		})
-	}
-	return products, nil
-
+	return toProductConnection(result), nil
 }
 
-
-
 func (q *queryResolver) CurrentUsers(ctx context.Context, input *CurrentUsersQueryInput) ([]*Account, error) {
 	Logs := logger.GetGlobalLogger()
 
@@ -205,12 +214,9 @@ func (q *queryResolver) CurrentUsers(ctx context.Context, input *CurrentUsersQue
 	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	user, err := RequireAdmin(ctx)
-	if err != nil {
-		return nil, err
-	}
-
-	Logs.Info(ctx, "Admin "+user.Email+" is fetching current users.")
+	// @hasPermission(account:read:any) already checked the caller
+	user, _ := GetUserFromContext(ctx)
+	Logs.Info(ctx, "User "+user.Email+" is fetching current users.")
 
 	var (
 		skip uint64
@@ -250,7 +256,9 @@ func (q *queryResolver) SuggestProducts(ctx context.Context, input *SuggestProdu
 	Logs := logger.GetGlobalLogger()
 	validatedInput := validation.SuggestProductsQueryInput{
 		Query:  input.Query,
-		Size:   *input.Size,
+	}
+	if input.Size != nil {
+		validatedInput.Size = *input.Size
 	}
 
 	if err := validation.ValidateStruct(validatedInput); err != nil {
@@ -266,28 +274,175 @@ func (q *queryResolver) SuggestProducts(ctx context.Context, input *SuggestProdu
 		s = *input.Size
 	}
 
-	ai := false
-	if input.UseAi != nil {
-		ai = *input.UseAi
+	// the catalog modes are the lowercase enum values
+	mode := ""
+	if input.Mode != nil {
+		mode = strings.ToLower(string(*input.Mode))
+	} else if input.UseAi != nil && *input.UseAi {
+		mode = catalog.SuggestSemantic
 	}
-	res, err := q.server.catalogClient.SuggestProducts(ctx, input.Query, s, ai)
+	res, err := q.server.catalogClient.SuggestProducts(ctx, input.Query, s, mode)
 	if err != nil {
 		Logs.Error(ctx, "Error from catalogClient.SuggestProducts: "+err.Error())
 		return nil, err
 	}
 	var products []*Product
 	for _, product := range res {
-		products = append(products, &Product{
-			ID:          product.ID,
-			Name:        product.Name,
-			Description: product.Description,
-			Price:       product.Price,
-			Stock:       int(product.Stock),
-			Sold:        int(product.Sold),
-			OutOfStock:  product.OutOfStock,
-			Score:       product.Score,
-		})
+		products = append(products, toProduct(product))
 	}
 	return products, nil
 
 }
+
+func (q *queryResolver) Categories(ctx context.Context) ([]*Category, error) {
+	Logs := logger.GetGlobalLogger()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	list, err := q.server.catalogClient.ListCategories(ctx)
+	if err != nil {
+		Logs.Error(ctx, "Error from catalogClient.ListCategories: "+err.Error())
+		return nil, err
+	}
+	categories := make([]*Category, len(list))
+	for i := range list {
+		categories[i] = toCategory(&list[i])
+	}
+	return categories, nil
+}
+
+func (q *queryResolver) Category(ctx context.Context, input CategoryIDInput) (*Category, error) {
+	Logs := logger.GetGlobalLogger()
+
+	validatedInput := validation.CategoryIDInput{
+		CategoryID: input.CategoryID,
+	}
+
+	if err := validation.ValidateStruct(validatedInput); err != nil {
+		Logs.Error(ctx, "Validation failed: "+err.Error())
+		return nil, errors.New("invalid input: " + err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	category, err := q.server.catalogClient.GetCategory(ctx, input.CategoryID)
+	if err != nil {
+		Logs.Error(ctx, "Error from catalogClient.GetCategory: "+err.Error())
+		return nil, err
+	}
+	return toCategory(category), nil
+}
+
+func (q *queryResolver) MySessions(ctx context.Context) ([]*Session, error) {
+	Logs := logger.GetGlobalLogger()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	// @auth already checked the caller
+	user, _ := GetUserFromContext(ctx)
+
+	sessions, err := q.server.AuthClient.ListSessions(ctx, user.ID)
+	if err != nil {
+		Logs.Error(ctx, "Error from AuthClient.ListSessions: "+err.Error())
+		return nil, err
+	}
+
+	result := make([]*Session, 0, len(sessions))
+	for _, session := range sessions {
+		result = append(result, &Session{
+			ID:         session.ID,
+			Device:     session.Device,
+			IPAddress:  session.IPAddress,
+			UserAgent:  session.UserAgent,
+			CreatedAt:  session.CreatedAt.UTC().Format(time.RFC1123),
+			LastSeenAt: session.LastSeenAt.UTC().Format(time.RFC1123),
+			Current:    session.ID == user.SessionID,
+		})
+	}
+	return result, nil
+}
+
+func (q *queryResolver) PrivacyRequests(ctx context.Context, input UserIDInput) ([]*PrivacyRequest, error) {
+	Logs := logger.GetGlobalLogger()
+
+	validatedInput := validation.UserIDInput{
+		UserID: input.UserID,
+	}
+
+	if err := validation.ValidateStruct(validatedInput); err != nil {
+		Logs.Error(ctx, "Validation failed: "+err.Error())
+		return nil, errors.New("invalid input: " + err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	requests, err := q.server.AuthClient.ListPrivacyRequests(ctx, input.UserID)
+	if err != nil {
+		Logs.Error(ctx, "Error from AuthClient.ListPrivacyRequests: "+err.Error())
+		return nil, err
+	}
+
+	result := make([]*PrivacyRequest, 0, len(requests))
+	for _, request := range requests {
+		result = append(result, toPrivacyRequest(request))
+	}
+	return result, nil
+}
+
+func (q *queryResolver) AccountHistory(ctx context.Context, input AccountHistoryInput) ([]*AccountEvent, error) {
+	Logs := logger.GetGlobalLogger()
+
+	validatedInput := validation.AccountHistoryInput{
+		UserID: input.UserID,
+	}
+	if input.Limit != nil {
+		validatedInput.Limit = *input.Limit
+	}
+
+	if err := validation.ValidateStruct(validatedInput); err != nil {
+		Logs.Error(ctx, "Validation failed: "+err.Error())
+		return nil, errors.New("invalid input: " + err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	events, err := q.server.accountClient.GetAccountHistory(ctx, input.UserID, validatedInput.Limit)
+	if err != nil {
+		Logs.Error(ctx, "Error from accountClient.GetAccountHistory: "+err.Error())
+		return nil, err
+	}
+
+	result := make([]*AccountEvent, 0, len(events))
+	for _, event := range events {
+		e, err := toAccountEvent(event)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, e)
+	}
+	return result, nil
+}
+
+func (q *queryResolver) APIKeys(ctx context.Context) ([]*APIKey, error) {
+	Logs := logger.GetGlobalLogger()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	keys, err := q.server.AuthClient.ListAPIKeys(ctx)
+	if err != nil {
+		Logs.Error(ctx, "Error from AuthClient.ListAPIKeys: "+err.Error())
+		return nil, err
+	}
+
+	result := make([]*APIKey, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, toAPIKey(key))
+	}
+	return result, nil
+}
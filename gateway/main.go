@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/99designs/gqlgen/graphql/handler"
 	"github.com/99designs/gqlgen/graphql/handler/extension"
@@ -12,8 +13,11 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/zenvisjr/building-scalable-microservices/auth"
 	"github.com/zenvisjr/building-scalable-microservices/gateway/graphql"
 	"github.com/zenvisjr/building-scalable-microservices/logger"
+	"github.com/zenvisjr/building-scalable-microservices/svcauth"
+	"github.com/zenvisjr/building-scalable-microservices/tlsconfig"
 )
 
 type AppConfig struct {
@@ -21,6 +25,18 @@ type AppConfig struct {
 	CatalogURL string `envconfig:"CATALOG_SERVICE_URL"`
 	OrderURL   string `envconfig:"ORDER_SERVICE_URL"`
 	AuthURL    string `envconfig:"AUTH_SERVICE_URL"`
+	// Verify access tokens against the auth service JWKS instead of calling Verify per request
+	VerifyTokensLocally bool          `envconfig:"AUTH_VERIFY_LOCALLY" default:"true"`
+	JWKSRefreshInterval time.Duration `envconfig:"AUTH_JWKS_REFRESH_INTERVAL" default:"1m"`
+	// How long a session the auth service confirmed is trusted without asking again, revocations
+	// announced on NATS end it right away. 0 asks on every request
+	RevocationCheckTTL time.Duration `envconfig:"AUTH_REVOCATION_CHECK_TTL" default:"30s"`
+	// Also serve HTTPS on :8443 when a certificate is given, it is reloaded when the files change
+	TLSCertFile       string        `envconfig:"GATEWAY_TLS_CERT_FILE"`
+	TLSKeyFile        string        `envconfig:"GATEWAY_TLS_KEY_FILE"`
+	TLSReloadInterval time.Duration `envconfig:"TLS_RELOAD_INTERVAL" default:"30s"`
+	// Load balancers whose X-Forwarded-For is believed, comma separated CIDRs or addresses
+	TrustedProxies []string `envconfig:"TRUSTED_PROXIES"`
 }
 
 var (
@@ -38,6 +54,11 @@ func main() {
 	}
 	defer Logs.Close()
 
+	// Identify this service to the others it calls
+	if err := svcauth.Init("gateway"); err != nil {
+		Logs.Fatal(ctx, "Failed to initialize service authentication: "+err.Error())
+	}
+
 	Logs.Info(ctx, "Starting GraphQL gateway service...")
 
 	exposePrometheusMetrics(9004)
@@ -59,6 +80,9 @@ func main() {
 	if es == nil {
 		Logs.Fatal(ctx, "Failed to create executable schema")
 	}
+	if err := graphql.CheckAccessPolicy(es.Schema()); err != nil {
+		Logs.Fatal(ctx, "Refusing to serve the schema: "+err.Error())
+	}
 
 	// Setup GraphQL handler
 	h := handler.New(es)
@@ -77,14 +101,39 @@ func main() {
 
 	//added auth middleware
 	// Wrap GraphQL server in context-aware auth middleware
-	wrappedHandler := graphql.AuthMiddleware(server.AuthClient)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	var verifier graphql.TokenVerifier = server.AuthClient
+	if config.VerifyTokensLocally {
+		keySet := auth.NewRemoteKeySet(server.AuthClient, config.JWKSRefreshInterval, config.RevocationCheckTTL)
+		if err := keySet.Refresh(ctx); err != nil {
+			// not fatal, the key set fetches the keys again on the first token it sees
+			Logs.Warn(ctx, "Failed to fetch auth JWKS: "+err.Error())
+		}
+		if err := server.WatchRevocations(keySet); err != nil {
+			Logs.Fatal(ctx, "Failed to subscribe to revocation events: "+err.Error())
+		}
+		verifier = keySet
+	}
+	proxies, err := graphql.ParseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		Logs.Fatal(ctx, "Failed to parse trusted proxies: "+err.Error())
+	}
+	authMiddleware := graphql.AuthMiddleware(verifier, server.AuthClient, proxies)
+	wrappedHandler := authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		h.ServeHTTP(w, r)
 	}))
 
 	http.Handle("/graphql", wrappedHandler)
 
+	// Bulk account files do not fit GraphQL, they are plain uploads and downloads
+	http.Handle("/admin/accounts/import", authMiddleware(server.ImportAccountsHandler()))
+	http.Handle("/admin/accounts/export", authMiddleware(server.ExportAccountsHandler()))
+
 	http.Handle("/playground", playground.Handler("zenvis", "/graphql"))
 
+	if config.TLSCertFile != "" {
+		serveHTTPS(config.TLSCertFile, config.TLSKeyFile, config.TLSReloadInterval)
+	}
+
 	Logs.Info(ctx, "GraphQL gateway listening on :8080")
 	if err := http.ListenAndServe(":8080", nil); err != nil {
 		Logs.Fatal(ctx, "Failed to start HTTP server: "+err.Error())
@@ -92,6 +141,23 @@ func main() {
 
 }
 
+func serveHTTPS(certFile, keyFile string, reloadInterval time.Duration) {
+	reloader, err := tlsconfig.NewReloader(certFile, keyFile, "", reloadInterval)
+	if err != nil {
+		Logs.Fatal(ctx, "Failed to load gateway TLS certificate: "+err.Error())
+	}
+	server := &http.Server{
+		Addr:      ":8443",
+		TLSConfig: reloader.HTTPServerConfig(),
+	}
+	go func() {
+		Logs.Info(ctx, "GraphQL gateway listening on :8443 (HTTPS)")
+		if err := server.ListenAndServeTLS("", ""); err != nil {
+			Logs.Fatal(ctx, "Failed to start HTTPS server: "+err.Error())
+		}
+	}()
+}
+
 func exposePrometheusMetrics(port int) {
 	go func() {
 		http.Handle("/metrics", promhttp.Handler())
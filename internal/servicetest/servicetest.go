@@ -0,0 +1,83 @@
+// Package servicetest holds what the server tests of the services share: a TestMain, a NATS
+// stand-in and in-memory gRPC listeners. It cannot start the services themselves, their tests
+// live inside their packages and would import them in a cycle.
+package servicetest
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/zenvisjr/building-scalable-microservices/internal/svcauthtest"
+	"github.com/zenvisjr/building-scalable-microservices/logger"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// Main runs the tests of service without TLS or logging, calls are made as the gateway
+// unless a test switches to another service
+func Main(m *testing.M, service string) {
+	os.Setenv("TLS_INSECURE_DEV", "true")
+	logger.InitNopLogger(service)
+	svcauthtest.Use("gateway")
+	os.Exit(m.Run())
+}
+
+// Publisher stands in for NATS and keeps every message
+type Publisher struct {
+	mu          sync.Mutex
+	messages    map[string][][]byte
+	subscribers map[string][]func(data []byte)
+}
+
+func (p *Publisher) Publish(subject string, data []byte) error {
+	p.mu.Lock()
+	if p.messages == nil {
+		p.messages = map[string][][]byte{}
+	}
+	p.messages[subject] = append(p.messages[subject], data)
+	subscribers := p.subscribers[subject]
+	p.mu.Unlock()
+
+	for _, handler := range subscribers {
+		handler(data)
+	}
+	return nil
+}
+
+// Subscribe hands every message published on subject from now on to handler, before Publish
+// returns
+func (p *Publisher) Subscribe(subject string, handler func(data []byte)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.subscribers == nil {
+		p.subscribers = map[string][]func(data []byte){}
+	}
+	p.subscribers[subject] = append(p.subscribers[subject], handler)
+}
+
+// Messages returns the messages published on subject, oldest first
+func (p *Publisher) Messages(subject string) [][]byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([][]byte(nil), p.messages[subject]...)
+}
+
+// Count returns how many messages were published on subject
+func (p *Publisher) Count(subject string) int {
+	return len(p.Messages(subject))
+}
+
+// Serve starts server on a new bufconn listener until the test ends and returns a dial option
+// that connects to it
+func Serve(t testing.TB, server *grpc.Server) grpc.DialOption {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	return grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	})
+}
@@ -0,0 +1,57 @@
+// Package svcauthtest gives the tests of the services a service identity. A test process plays
+// every service: each one has a key derived from its name, every service trusts the public keys
+// of all of them, and the test switches the identity to the service a call has to come from.
+package svcauthtest
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/zenvisjr/building-scalable-microservices/svcauth"
+	"google.golang.org/grpc"
+)
+
+// services are the names a test can play
+var services = []string{"account", "auth", "catalog", "gateway", "mail", "order"}
+
+// privateKey derives the key of service, it is the same in every test run
+func privateKey(service string) ed25519.PrivateKey {
+	seed := sha256.Sum256([]byte("svcauthtest:" + service))
+	return ed25519.NewKeyFromSeed(seed[:])
+}
+
+// Use makes the calls that follow come from service
+func Use(service string) {
+	keys := svcauth.Keys{
+		Private: privateKey(service),
+		Public:  map[string]ed25519.PublicKey{},
+	}
+	for _, name := range services {
+		keys.Public[name] = privateKey(name).Public().(ed25519.PublicKey)
+	}
+	if err := svcauth.InitWithKeys(service, keys, time.Minute); err != nil {
+		panic("svcauthtest: " + err.Error())
+	}
+}
+
+// CallAs makes the calls of the rest of the test come from service
+func CallAs(t testing.TB, service string) {
+	t.Helper()
+	caller := svcauth.ServiceName()
+	Use(service)
+	t.Cleanup(func() { Use(caller) })
+}
+
+// ServedAs makes a server handle its calls as service, so the calls it makes to other
+// services of the test process come from it rather than from the caller
+func ServedAs(service string) grpc.ServerOption {
+	return grpc.ChainUnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		caller := svcauth.ServiceName()
+		Use(service)
+		defer Use(caller)
+		return handler(ctx, req)
+	})
+}
@@ -0,0 +1,175 @@
+package validation
+
+type AccountInput struct {
+	Name     string `json:"name" validate:"required,min=2"`
+	Email    string `json:"email" validate:"required,email"`
+	Password string `json:"password" validate:"required,min=6"`
+	Role     string `json:"role" validate:"omitempty,oneof=user admin"`
+}
+
+type ProductInput struct {
+	Name        string                   `json:"name" validate:"required,min=2"`
+	Description string                   `json:"description" validate:"required,min=5"`
+	Price       float64                  `json:"price" validate:"required,gte=0"`
+	Stock       int                      `json:"stock" validate:"required,gte=0"`
+	CategoryID  string                   `json:"categoryId" validate:"omitempty,alphanum,min=10,max=40"`
+	Tags        []string                 `json:"tags" validate:"max=20,dive,required,max=32"`
+	Attributes  []*ProductAttributeInput `json:"attributes" validate:"max=30,dive"`
+}
+
+type ProductAttributeInput struct {
+	Key   string `json:"key" validate:"required,max=32"`
+	Value string `json:"value" validate:"required,max=128"`
+}
+
+type CategoryInput struct {
+	Name     string `json:"name" validate:"required,max=64"`
+	ParentID string `json:"parentId" validate:"omitempty,alphanum,min=10,max=40"`
+}
+
+type UpdateCategoryInput struct {
+	ID       string `json:"id" validate:"required,alphanum,min=10,max=40"`
+	Name     string `json:"name" validate:"required,max=64"`
+	ParentID string `json:"parentId" validate:"omitempty,alphanum,min=10,max=40"`
+}
+
+type CategoryIDInput struct {
+	CategoryID string `json:"categoryId" validate:"required,alphanum,min=10,max=40"`
+}
+
+type OrderedProductInput struct {
+	ID       string `json:"id" validate:"required,alphanum,min=10,max=40"`
+	Quantity int    `json:"quantity" validate:"required,gt=0"`
+}
+
+type OrderInput struct {
+	AccountID string                 `json:"accountId" validate:"required,alphanum,min=10,max=40"`
+	Products  []*OrderedProductInput `json:"products" validate:"required,min=1,dive"`
+	AddressID string                 `json:"addressId" validate:"omitempty,alphanum,min=10,max=40"`
+}
+
+type UpdateProfileInput struct {
+	Name  *string `json:"name" validate:"omitnil,min=2,max=24"`
+	Email *string `json:"email" validate:"omitnil,email,max=254"`
+	Phone string  `json:"phone" validate:"omitempty,e164"` // empty clears the phone
+}
+
+type AddressInput struct {
+	Label      string `json:"label" validate:"omitempty,max=32"`
+	Recipient  string `json:"recipient" validate:"required,max=64"`
+	Line1      string `json:"line1" validate:"required,max=128"`
+	Line2      string `json:"line2" validate:"omitempty,max=128"`
+	City       string `json:"city" validate:"required,max=64"`
+	State      string `json:"state" validate:"omitempty,max=64"`
+	PostalCode string `json:"postalCode" validate:"required,max=20"`
+	Country    string `json:"country" validate:"required,iso3166_1_alpha2"`
+	Phone      string `json:"phone" validate:"omitempty,e164"`
+	IsDefault  bool   `json:"isDefault"`
+}
+
+type UpdateAddressInput struct {
+	ID      string        `json:"id" validate:"required,alphanum,min=10,max=40"`
+	Address *AddressInput `json:"address" validate:"required"`
+}
+
+type AddressIDInput struct {
+	ID string `json:"id" validate:"required,alphanum,min=10,max=40"`
+}
+
+type LoginInput struct {
+	Email    string `json:"email" validate:"required,email"`
+	Password string `json:"password" validate:"required,min=6"`
+	Device   string `json:"device" validate:"omitempty,max=100"`
+}
+
+type StartOIDCLoginInput struct {
+	Provider string `json:"provider" validate:"required,alphanum,max=64"`
+}
+
+type CompleteOIDCLoginInput struct {
+	Provider string `json:"provider" validate:"required,alphanum,max=64"`
+	State    string `json:"state" validate:"required,max=128"`
+	Code     string `json:"code" validate:"required,max=2048"`
+	Device   string `json:"device" validate:"omitempty,max=100"`
+}
+
+type VerifyLoginChallengeInput struct {
+	ChallengeToken string `json:"challengeToken" validate:"required,jwt"`
+	Code           string `json:"code" validate:"required,min=6,max=20"`
+	Device         string `json:"device" validate:"omitempty,max=100"`
+}
+
+type ConfirmTotpInput struct {
+	Code string `json:"code" validate:"required,numeric,len=6"`
+}
+
+type RefreshTokenInput struct {
+	RefreshToken string `json:"refreshToken" validate:"required,jwt"`
+}
+
+type ResetPasswordInput struct {
+	Email    string `json:"email" validate:"required,email"`
+	Password string `json:"password" validate:"required,min=6"`
+}
+
+type RequestPasswordResetInput struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type VerifyEmailInput struct {
+	Token string `json:"token" validate:"required,jwt"`
+}
+
+type ConfirmPasswordResetInput struct {
+	Token       string `json:"token" validate:"required,base64rawurl,len=43"`
+	NewPassword string `json:"newPassword" validate:"required,min=6"`
+}
+
+type LogoutInput struct {
+	UserID string `json:"userId" validate:"required,alphanum,min=10,max=40"`
+}
+
+type Pagination struct {
+	Skip int `json:"skip" validate:"omitempty,gte=0"`
+	Take int `json:"take" validate:"omitempty,gte=1,lte=100"`
+}
+
+type ProductIDInput struct {
+	ProductID string `json:"productId" validate:"required,alphanum,min=10,max=40"`
+}
+
+type RestockProductInput struct {
+	ProductID string `json:"productId" validate:"required,alphanum,min=10,max=40"`
+	NewStock  int    `json:"newStock" validate:"required,gt=0"`
+}
+
+type UserIDInput struct {
+	UserID string `json:"userId" validate:"required,alphanum,min=10,max=40"`
+}
+
+type ChangeRoleInput struct {
+	UserID string `json:"userId" validate:"required,alphanum,min=10,max=40"`
+	Role   string `json:"role" validate:"required,max=32"`
+}
+
+type UnlockAccountInput struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type RevokeSessionInput struct {
+	SessionID string `json:"sessionId" validate:"required,alphanum,min=10,max=40"`
+}
+
+type CreateAPIKeyInput struct {
+	Name          string   `json:"name" validate:"required,min=3,max=64"`
+	Scopes        []string `json:"scopes" validate:"required,min=1,dive,required,max=64"`
+	ExpiresInDays int      `json:"expiresInDays" validate:"omitempty,gte=1,lte=365"`
+}
+
+type APIKeyIDInput struct {
+	ID string `json:"id" validate:"required,alphanum,min=10,max=40"`
+}
+
+type ImportAccountsInput struct {
+	Format string `json:"format" validate:"required,oneof=csv jsonl"`
+}
@@ -0,0 +1,54 @@
+package validation
+
+type AccountsQueryInput struct {
+	ID            string `json:"id" validate:"omitempty,alphanum,min=10,max=40"`
+	Name          string `json:"name" validate:"omitempty,max=24"`
+	Email         string `json:"email" validate:"omitempty,max=254"`
+	Role          string `json:"role" validate:"omitempty,max=32"`
+	CreatedAfter  string `json:"createdAfter" validate:"omitempty,datetime=2006-01-02T15:04:05Z07:00"`
+	CreatedBefore string `json:"createdBefore" validate:"omitempty,datetime=2006-01-02T15:04:05Z07:00"`
+	First         int    `json:"first" validate:"omitempty,gte=1,lte=100"`
+	After         string `json:"after" validate:"omitempty,max=200"`
+}
+
+type AccountHistoryInput struct {
+	UserID string `json:"userId" validate:"required,alphanum,min=10,max=40"`
+	Limit  int    `json:"limit" validate:"omitempty,gte=1,lte=500"`
+}
+
+type ProductsQueryInput struct {
+	Query      string        `json:"query" validate:"omitempty,min=2"`
+	ID         string        `json:"id" validate:"omitempty,alphanum,min=10,max=40"`
+	First      int           `json:"first" validate:"omitempty,gte=1,lte=100"`
+	After      string        `json:"after" validate:"omitempty,max=2000"`
+	MinPrice   *float64      `json:"minPrice" validate:"omitnil,gte=0"`
+	MaxPrice   *float64      `json:"maxPrice" validate:"omitnil,gte=0"`
+	CategoryID string        `json:"categoryId" validate:"omitempty,alphanum,min=10,max=40"`
+	Tags       []string      `json:"tags" validate:"max=20,dive,required,max=32"`
+	Facets     []*FacetInput `json:"facets" validate:"max=3,dive"`
+}
+
+type FacetInput struct {
+	Size     int     `json:"size" validate:"omitempty,gte=1,lte=100"`
+	Interval float64 `json:"interval" validate:"omitempty,gt=0"`
+}
+
+
+type CurrentUsersQueryInput struct {
+	Role       string      `json:"role" validate:"omitempty,oneof=user admin"`
+	Pagination *Pagination `json:"pagination" validate:"omitempty,dive"`
+}
+
+type SuggestProductsQueryInput struct {
+	Query  string `json:"query" validate:"required,min=2"`
+	Size   int    `json:"size" validate:"omitempty,gte=1,lte=20"`
+	// UseAI  bool   `json:"useAI"` // no validation needed for boolean
+}
+
+
+
+
+type ExportAccountsInput struct {
+	Format string `json:"format" validate:"required,oneof=csv jsonl"`
+	Role   string `json:"role" validate:"omitempty,max=32"`
+}
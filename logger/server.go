@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/zenvisjr/building-scalable-microservices/logger/pb"
+	"github.com/zenvisjr/building-scalable-microservices/tlsconfig"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/reflection"
 )
@@ -29,7 +30,11 @@ func ListenGRPC(port int) error {
 		panic(err)
 	}
 	// defer lf.Close()
-	server := grpc.NewServer()
+	creds, err := tlsconfig.ServerOption()
+	if err != nil {
+		return err
+	}
+	server := grpc.NewServer(creds)
 	pb.RegisterLoggerServiceServer(server, &grpcServer{
 		logFile: lf,
 	})
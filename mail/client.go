@@ -5,8 +5,9 @@ import (
 
 	"github.com/zenvisjr/building-scalable-microservices/logger"
 	"github.com/zenvisjr/building-scalable-microservices/mail/pb"
+	"github.com/zenvisjr/building-scalable-microservices/svcauth"
+	"github.com/zenvisjr/building-scalable-microservices/tlsconfig"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
 type Mail struct {
@@ -18,7 +19,13 @@ func NewMailClient(address string) (*Mail, error) {
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("Connecting to Mail gRPC service at " + address)
 
-	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	creds, err := tlsconfig.DialOption()
+	if err != nil {
+		Logs.Warn(context.Background(), "Failed to load TLS config for Mail gRPC: "+err.Error())
+		return nil, err
+	}
+
+	conn, err := grpc.NewClient(address, creds, svcauth.DialOption())
 	if err != nil {
 		Logs.Warn(context.Background(), "Failed to connect to Mail gRPC: "+err.Error())
 		return nil, err
@@ -7,6 +7,7 @@ import (
 	"github.com/zenvisjr/building-scalable-microservices/logger"
 	"github.com/zenvisjr/building-scalable-microservices/mail"
 	"github.com/nats-io/nats.go"
+	"github.com/zenvisjr/building-scalable-microservices/svcauth"
 )
 
 func main() {
@@ -19,6 +20,11 @@ func main() {
 	}
 	defer Logs.Close()
 
+	// Identify this service to the others it calls
+	if err := svcauth.Init("mail"); err != nil {
+		Logs.Fatal(ctx, "Failed to initialize service authentication: "+err.Error())
+	}
+
 	// Local trace of service start
 	Logs.LocalOnlyInfo("Mail service bootstrapping...")
 
@@ -7,6 +7,8 @@ import (
 
 	"github.com/zenvisjr/building-scalable-microservices/logger"
 	"github.com/zenvisjr/building-scalable-microservices/mail/pb"
+	"github.com/zenvisjr/building-scalable-microservices/svcauth"
+	"github.com/zenvisjr/building-scalable-microservices/tlsconfig"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/reflection"
 )
@@ -16,6 +18,11 @@ type MailServer struct {
 	pb.UnimplementedMailServiceServer
 }
 
+// callers lists the services allowed to call each RPC
+var callers = svcauth.Allowlist{
+	pb.MailService_SendEmail_FullMethodName: {"account", "auth", "order"},
+}
+
 
 func InitMailGRPC(service Service, port int) error {
 	Logs := logger.GetGlobalLogger()
@@ -28,8 +35,14 @@ func InitMailGRPC(service Service, port int) error {
 		return err
 	}
 
+	creds, err := tlsconfig.ServerOption()
+	if err != nil {
+		Logs.Error(context.Background(), "Failed to load TLS config: "+err.Error())
+		return err
+	}
 	server := grpc.NewServer(
-		grpc.UnaryInterceptor(logger.UnaryLoggingInterceptor()),
+		creds,
+		grpc.ChainUnaryInterceptor(logger.UnaryLoggingInterceptor(), svcauth.UnaryServerInterceptor(callers)),
 	)
 
 	pb.RegisterMailServiceServer(server, &MailServer{service: service})
@@ -0,0 +1,76 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strconv"
+
+	"github.com/zenvisjr/building-scalable-microservices/logger"
+)
+
+// Usage describes the arguments of the migrate subcommand
+const Usage = "migrate [up | down [steps] | status]"
+
+// Run carries out the migrate subcommand of a service binary. args are the arguments after
+// "migrate": up (the default) applies pending migrations, down rolls back the given number of
+// migrations (one by default) and status prints every migration and whether it is applied
+func Run(ctx context.Context, databaseURL string, fsys fs.FS, args []string) error {
+	Logs := logger.GetGlobalLogger()
+
+	db, err := sql.Open("postgres", databaseURL)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	m, err := New(db, fsys)
+	if err != nil {
+		return err
+	}
+
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+	switch command {
+	case "up":
+		count, err := m.Up(ctx)
+		if err != nil {
+			return err
+		}
+		Logs.Info(ctx, "Applied "+logger.IntToStr(count)+" migrations")
+		return nil
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return errors.New("steps must be a positive number, usage: " + Usage)
+			}
+		}
+		count, err := m.Down(ctx, steps)
+		if err != nil {
+			return err
+		}
+		Logs.Info(ctx, "Rolled back "+logger.IntToStr(count)+" migrations")
+		return nil
+
+	case "status":
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.Applied {
+				state = "applied " + status.AppliedAt.UTC().Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, state)
+		}
+		return nil
+	}
+	return errors.New("unknown migrate command " + command + ", usage: " + Usage)
+}
@@ -0,0 +1,410 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/zenvisjr/building-scalable-microservices/logger"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNopLogger("migrate")
+	os.Exit(m.Run())
+}
+
+// fakeDB stands in for Postgres: it keeps schema_migrations, runs the advisory lock as a mutex
+// and records the statements of the migration files in the order they were committed
+type fakeDB struct {
+	lock chan struct{} // holds a token while a connection has the advisory lock
+
+	mu       sync.Mutex
+	applied  map[int64]string // version to name
+	executed []string
+	unlocked []string // statements run by a connection without the lock
+}
+
+func newFakeDB() *fakeDB {
+	return &fakeDB{lock: make(chan struct{}, 1), applied: map[int64]string{}}
+}
+
+func (db *fakeDB) Connect(context.Context) (driver.Conn, error) { return &fakeConn{db: db}, nil }
+func (db *fakeDB) Driver() driver.Driver                        { return nil }
+
+func (db *fakeDB) versions() []int64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	versions := make([]int64, 0, len(db.applied))
+	for version := range db.applied {
+		versions = append(versions, version)
+	}
+	slices.Sort(versions)
+	return versions
+}
+
+func (db *fakeDB) statements() []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return slices.Clone(db.executed)
+}
+
+type fakeConn struct {
+	db     *fakeDB
+	locked bool
+	tx     []func() // changes of the open transaction, applied on commit
+	inTx   bool
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *fakeConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	c.inTx, c.tx = true, nil
+	return c, nil
+}
+
+func (c *fakeConn) Commit() error {
+	c.db.mu.Lock()
+	for _, change := range c.tx {
+		change()
+	}
+	c.db.mu.Unlock()
+	c.inTx, c.tx = false, nil
+	return nil
+}
+
+func (c *fakeConn) Rollback() error {
+	c.inTx, c.tx = false, nil
+	return nil
+}
+
+// Close ends the session, which releases its advisory lock like Postgres does
+func (c *fakeConn) Close() error {
+	if c.locked {
+		c.locked = false
+		<-c.db.lock
+	}
+	return nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	var change func()
+	switch {
+	case strings.Contains(query, "pg_advisory_lock"):
+		select {
+		case c.db.lock <- struct{}{}:
+			c.locked = true
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		return driver.RowsAffected(0), nil
+	case strings.Contains(query, "pg_advisory_unlock"):
+		if c.locked {
+			c.locked = false
+			<-c.db.lock
+		}
+		return driver.RowsAffected(0), nil
+	case strings.Contains(query, "CREATE TABLE IF NOT EXISTS schema_migrations"):
+		return driver.RowsAffected(0), nil
+	case strings.HasPrefix(query, "INSERT INTO schema_migrations"):
+		version, name := args[0].Value.(int64), args[1].Value.(string)
+		change = func() { c.db.applied[version] = name }
+	case strings.HasPrefix(query, "DELETE FROM schema_migrations"):
+		version := args[0].Value.(int64)
+		change = func() { delete(c.db.applied, version) }
+	case strings.Contains(query, "FAIL"):
+		return nil, errors.New("syntax error at FAIL")
+	default:
+		// give a concurrent migrator the chance to run into the lock
+		time.Sleep(time.Millisecond)
+		change = func() { c.db.executed = append(c.db.executed, query) }
+	}
+
+	if !c.locked {
+		c.db.mu.Lock()
+		c.db.unlocked = append(c.db.unlocked, query)
+		c.db.mu.Unlock()
+	}
+	if c.inTx {
+		c.tx = append(c.tx, change)
+		return driver.RowsAffected(1), nil
+	}
+	c.db.mu.Lock()
+	change()
+	c.db.mu.Unlock()
+	return driver.RowsAffected(1), nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if !strings.HasPrefix(query, "SELECT version, applied_at FROM schema_migrations") {
+		return nil, errors.New("unexpected query: " + query)
+	}
+	rows := &fakeRows{}
+	for _, version := range c.db.versions() {
+		rows.values = append(rows.values, []driver.Value{version, time.Now()})
+	}
+	return rows, nil
+}
+
+type fakeRows struct {
+	values [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return []string{"version", "applied_at"} }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// migrations builds the embedded file system of a service from file name to content
+func migrations(files map[string]string) fstest.MapFS {
+	fsys := fstest.MapFS{}
+	for name, content := range files {
+		fsys[Dir+"/"+name] = &fstest.MapFile{Data: []byte(content)}
+	}
+	return fsys
+}
+
+func TestLoad(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		fsys     fstest.MapFS
+		want     []int64
+		wantDown []bool
+		wantErr  bool
+	}{
+		{
+			name: "ordered by version number with gaps",
+			fsys: migrations(map[string]string{
+				"10_orders.up.sql":   "CREATE TABLE orders ()",
+				"2_index.up.sql":     "CREATE INDEX accounts_email ON accounts (email)",
+				"2_index.down.sql":   "DROP INDEX accounts_email",
+				"0001_init.up.sql":   "CREATE TABLE accounts ()",
+				"10_orders.down.sql": "DROP TABLE orders",
+			}),
+			want:     []int64{1, 2, 10},
+			wantDown: []bool{false, true, true},
+		},
+		{
+			name: "files outside the migrations directory",
+			fsys: fstest.MapFS{
+				Dir + "/1_init.up.sql": {Data: []byte("CREATE TABLE accounts ()")},
+				"seed/2_seed.up.sql":   {Data: []byte("INSERT INTO accounts DEFAULT VALUES")},
+			},
+			want:     []int64{1},
+			wantDown: []bool{false},
+		},
+		{name: "duplicate version", fsys: migrations(map[string]string{"1_init.up.sql": "SELECT 1", "0001_other.up.sql": "SELECT 2"}), wantErr: true},
+		{name: "down without up", fsys: migrations(map[string]string{"1_init.up.sql": "SELECT 1", "2_index.down.sql": "SELECT 2"}), wantErr: true},
+		{name: "no direction", fsys: migrations(map[string]string{"1_init.sql": "SELECT 1"}), wantErr: true},
+		{name: "no version", fsys: migrations(map[string]string{"init.up.sql": "SELECT 1"}), wantErr: true},
+		{name: "version zero", fsys: migrations(map[string]string{"0_init.up.sql": "SELECT 1"}), wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			loaded, err := Load(tc.fsys)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Load = %+v, want an error", loaded)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			versions := make([]int64, len(loaded))
+			downs := make([]bool, len(loaded))
+			for i, m := range loaded {
+				versions[i], downs[i] = m.Version, m.Down != ""
+			}
+			if !slices.Equal(versions, tc.want) || !slices.Equal(downs, tc.wantDown) {
+				t.Errorf("Load versions = %v with down %v, want %v with %v", versions, downs, tc.want, tc.wantDown)
+			}
+		})
+	}
+}
+
+func TestUpDown(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeDB()
+	db := sql.OpenDB(fake)
+	defer db.Close()
+
+	fsys := migrations(map[string]string{
+		"1_init.up.sql":      "up 1",
+		"2_index.up.sql":     "up 2",
+		"2_index.down.sql":   "down 2",
+		"10_orders.up.sql":   "up 10",
+		"10_orders.down.sql": "down 10",
+	})
+	m, err := New(db, fsys)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	// pending migrations are applied in version order and recorded
+	if count, err := m.Up(ctx); err != nil || count != 3 {
+		t.Fatalf("Up = %d, %v, want 3", count, err)
+	}
+	if got := fake.statements(); !slices.Equal(got, []string{"up 1", "up 2", "up 10"}) {
+		t.Errorf("executed %v", got)
+	}
+	if got := fake.versions(); !slices.Equal(got, []int64{1, 2, 10}) {
+		t.Errorf("schema_migrations = %v", got)
+	}
+	if fake.applied[2] != "index" {
+		t.Errorf("schema_migrations name of version 2 = %q, want index", fake.applied[2])
+	}
+	if count, err := m.Up(ctx); err != nil || count != 0 {
+		t.Errorf("second Up = %d, %v, want 0", count, err)
+	}
+
+	// rolling back goes newest first and drops the records
+	if count, err := m.Down(ctx, 2); err != nil || count != 2 {
+		t.Fatalf("Down = %d, %v, want 2", count, err)
+	}
+	if got := fake.statements()[3:]; !slices.Equal(got, []string{"down 10", "down 2"}) {
+		t.Errorf("rolled back with %v", got)
+	}
+	if got := fake.versions(); !slices.Equal(got, []int64{1}) {
+		t.Errorf("schema_migrations after Down = %v", got)
+	}
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	var applied []bool
+	for _, status := range statuses {
+		applied = append(applied, status.Applied)
+	}
+	if !slices.Equal(applied, []bool{true, false, false}) {
+		t.Errorf("Status applied = %v", applied)
+	}
+
+	// a migration without a down file stops the rollback and stays applied
+	if _, err := m.Down(ctx, 1); !errors.Is(err, errNoDownMigration) {
+		t.Errorf("Down of a migration without a down file = %v, want errNoDownMigration", err)
+	}
+	if got := fake.versions(); !slices.Equal(got, []int64{1}) {
+		t.Errorf("schema_migrations after a refused Down = %v", got)
+	}
+	if len(fake.unlocked) > 0 {
+		t.Errorf("ran without the advisory lock: %v", fake.unlocked)
+	}
+}
+
+func TestUpGapsAndFailures(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeDB()
+	db := sql.OpenDB(fake)
+	defer db.Close()
+
+	m, err := New(db, migrations(map[string]string{"1_init.up.sql": "up 1", "10_orders.up.sql": "up 10"}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, err := m.Up(ctx); err != nil {
+		t.Fatalf("Up: %v", err)
+	}
+
+	// a migration merged into the gap after later ones were applied still runs
+	m, err = New(db, migrations(map[string]string{
+		"1_init.up.sql":    "up 1",
+		"5_index.up.sql":   "up 5",
+		"10_orders.up.sql": "up 10",
+		"11_broken.up.sql": "up 11; FAIL",
+		"12_after.up.sql":  "up 12",
+	}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	// a failing migration is rolled back and stops the run, the ones before it stay applied
+	count, err := m.Up(ctx)
+	if err == nil || !strings.Contains(err.Error(), "11_broken") || count != 1 {
+		t.Fatalf("Up = %d, %v, want 1 and an error naming 11_broken", count, err)
+	}
+	if got := fake.versions(); !slices.Equal(got, []int64{1, 5, 10}) {
+		t.Errorf("schema_migrations = %v, want 1, 5 and 10", got)
+	}
+	if got := fake.statements(); !slices.Equal(got, []string{"up 1", "up 10", "up 5"}) {
+		t.Errorf("executed %v", got)
+	}
+}
+
+func TestUpLock(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeDB()
+	db := sql.OpenDB(fake)
+	defer db.Close()
+
+	files := map[string]string{}
+	for _, name := range []string{"1_a", "2_b", "3_c", "4_d", "5_e", "6_f"} {
+		files[name+".up.sql"] = "up " + name
+	}
+	fsys := migrations(files)
+
+	// replicas starting together apply every migration once between them
+	const replicas = 4
+	counts := make(chan int, replicas)
+	var wg sync.WaitGroup
+	for i := 0; i < replicas; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m, err := New(db, fsys)
+			if err != nil {
+				t.Errorf("New: %v", err)
+				return
+			}
+			count, err := m.Up(ctx)
+			if err != nil {
+				t.Errorf("Up: %v", err)
+			}
+			counts <- count
+		}()
+	}
+	wg.Wait()
+	close(counts)
+
+	total := 0
+	for count := range counts {
+		total += count
+	}
+	if total != len(files) {
+		t.Errorf("replicas applied %d migrations, want %d", total, len(files))
+	}
+	if got := fake.statements(); len(got) != len(files) {
+		t.Errorf("executed %v, want every migration once", got)
+	}
+	if len(fake.unlocked) > 0 {
+		t.Errorf("ran without the advisory lock: %v", fake.unlocked)
+	}
+
+	// the lock is released afterwards, a later run does not wait for it
+	timeout, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	m, err := New(db, fsys)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, err := m.Status(timeout); err != nil {
+		t.Errorf("Status after the replicas: %v", err)
+	}
+}
@@ -5,8 +5,9 @@ import (
 
 	"github.com/zenvisjr/building-scalable-microservices/logger"
 	"github.com/zenvisjr/building-scalable-microservices/order/pb"
+	"github.com/zenvisjr/building-scalable-microservices/svcauth"
+	"github.com/zenvisjr/building-scalable-microservices/tlsconfig"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
 type Client struct {
@@ -14,11 +15,17 @@ type Client struct {
 	service pb.OrderServiceClient
 }
 
-func NewClient(address string) (*Client, error) {
+func NewClient(address string, opts ...grpc.DialOption) (*Client, error) {
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("Connecting to OrderService at " + address)
 
-	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	creds, err := tlsconfig.DialOption()
+	if err != nil {
+		Logs.Warn(context.Background(), "Failed to load TLS config for Order gRPC: "+err.Error())
+		return nil, err
+	}
+
+	conn, err := grpc.NewClient(address, append([]grpc.DialOption{creds, svcauth.DialOption()}, opts...)...)
 	if err != nil {
 		Logs.Error(context.Background(), "Failed to create gRPC connection: "+err.Error())
 		return nil, err
@@ -37,7 +44,8 @@ func (c *Client) Close() {
 	c.conn.Close()
 }
 
-func (c *Client) PostOrder(ctx context.Context, id string, products []OrderedProduct) (*Order, error) {
+// PostOrder places an order shipped to addressID, or to the default address of the account when it is empty
+func (c *Client) PostOrder(ctx context.Context, id string, addressID string, products []OrderedProduct) (*Order, error) {
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo("Entered PostOrder()")
 
@@ -55,6 +63,7 @@ func (c *Client) PostOrder(ctx context.Context, id string, products []OrderedPro
 	grpcReq := &pb.PostOrderRequest{
 		AccountId: id,
 		Products:  productList,
+		AddressId: addressID,
 	}
 
 	Logs.LocalOnlyInfo("Sending PostOrder RPC")
@@ -85,11 +94,12 @@ func (c *Client) PostOrder(ctx context.Context, id string, products []OrderedPro
 	Logs.Info(ctx, "Order created with ID: "+newOrder.Id+" for AccountID: "+id)
 
 	return &Order{
-		ID:         newOrder.Id,
-		CreatedAt:  newOrder.CreatedAt.AsTime(),
-		AccountID:  newOrder.AccountId,
-		TotalPrice: newOrder.TotalPrice,
-		Products:   ordered,
+		ID:              newOrder.Id,
+		CreatedAt:       newOrder.CreatedAt.AsTime(),
+		AccountID:       newOrder.AccountId,
+		TotalPrice:      newOrder.TotalPrice,
+		Products:        ordered,
+		ShippingAddress: fromShippingAddressProto(newOrder.ShippingAddress),
 	}, nil
 }
 
@@ -114,11 +124,12 @@ func (c *Client) GetOrdersForAccount(ctx context.Context, id string) ([]Order, e
 	orders := []Order{}
 	for _, o := range resp.Orders {
 		order := Order{
-			ID:         o.Id,
-			AccountID:  o.AccountId,
-			TotalPrice: o.TotalPrice,
-			CreatedAt:  o.CreatedAt.AsTime(),
-			Products:   []OrderedProduct{},
+			ID:              o.Id,
+			AccountID:       o.AccountId,
+			TotalPrice:      o.TotalPrice,
+			CreatedAt:       o.CreatedAt.AsTime(),
+			Products:        []OrderedProduct{},
+			ShippingAddress: fromShippingAddressProto(o.ShippingAddress),
 		}
 		for _, op := range o.Products {
 			order.Products = append(order.Products, OrderedProduct{
@@ -137,3 +148,34 @@ func (c *Client) GetOrdersForAccount(ctx context.Context, id string) ([]Order, e
 	Logs.Info(ctx, "Fetched "+logger.IntToStr(len(resp.Orders))+" orders for AccountID: "+id)
 	return orders, nil
 }
+
+func fromShippingAddressProto(address *pb.ShippingAddress) *ShippingAddress {
+	if address == nil {
+		return nil
+	}
+	return &ShippingAddress{
+		Label:      address.Label,
+		Recipient:  address.Recipient,
+		Line1:      address.Line1,
+		Line2:      address.Line2,
+		City:       address.City,
+		State:      address.State,
+		PostalCode: address.PostalCode,
+		Country:    address.Country,
+		Phone:      address.Phone,
+	}
+}
+
+// AnonymizeOrdersForAccount removes the personal data of an erased account from its orders and
+// returns how many orders were changed
+func (c *Client) AnonymizeOrdersForAccount(ctx context.Context, accountID string) (int, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.LocalOnlyInfo("Sending AnonymizeOrdersForAccount RPC for ID: " + accountID)
+
+	resp, err := c.service.AnonymizeOrdersForAccount(ctx, &pb.GetOrdersForAccountRequest{AccountId: accountID})
+	if err != nil {
+		Logs.Error(ctx, "AnonymizeOrdersForAccount RPC failed: "+err.Error())
+		return 0, err
+	}
+	return int(resp.Orders), nil
+}
@@ -4,20 +4,27 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/avast/retry-go"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/zenvisjr/building-scalable-microservices/account"
 	"github.com/zenvisjr/building-scalable-microservices/logger"
+	"github.com/zenvisjr/building-scalable-microservices/migrate"
 	"github.com/zenvisjr/building-scalable-microservices/order"
+	"github.com/zenvisjr/building-scalable-microservices/svcauth"
 )
 
 type Config struct {
-	DatabaseURL string `envconfig:"DATABASE_URL"`
-	AccountURL  string `envconfig:"ACCOUNT_SERVICE_URL"`
-	CatalogURL  string `envconfig:"CATALOG_SERVICE_URL"`
-	MailURL     string `envconfig:"MAIL_SERVICE_URL"`
+	DatabaseURL    string `envconfig:"DATABASE_URL"`
+	MigrateOnStart bool   `envconfig:"MIGRATE_ON_START" default:"true"`
+	AccountURL     string `envconfig:"ACCOUNT_SERVICE_URL"`
+	CatalogURL     string `envconfig:"CATALOG_SERVICE_URL"`
+	MailURL        string `envconfig:"MAIL_SERVICE_URL"`
+	// actions accounts may take before verifying their email, e.g. "place_order"
+	UnverifiedAllowedActions []string `envconfig:"UNVERIFIED_ALLOWED_ACTIONS"`
 }
 
 var (
@@ -37,6 +44,11 @@ func main() {
 	}
 	defer Logs.Close()
 
+	// Identify this service to the others it calls
+	if err := svcauth.Init("order"); err != nil {
+		Logs.Fatal(ctx, "Failed to initialize service authentication: "+err.Error())
+	}
+
 	Logs.Info(ctx, "Starting order service...")
 
 	exposePrometheusMetrics(9003)
@@ -47,7 +59,14 @@ func main() {
 	if err := envconfig.Process("", &config); err != nil {
 		Logs.Fatal(ctx, "Failed to load configuration: "+err.Error())
 	}
-	
+
+	// "app migrate ..." only migrates the database and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate.Run(ctx, config.DatabaseURL, order.Migrations, os.Args[2:]); err != nil {
+			Logs.Fatal(ctx, "Migration failed: "+err.Error())
+		}
+		return
+	}
 
 	// Connect to Postgres with retry
 	var r order.Repository
@@ -71,6 +90,13 @@ func main() {
 	}
 	defer r.Close()
 
+	// Bring the schema up to date before serving
+	if config.MigrateOnStart {
+		if err := migrate.Run(ctx, config.DatabaseURL, order.Migrations, []string{"up"}); err != nil {
+			Logs.Fatal(ctx, "Failed to migrate database: "+err.Error())
+		}
+	}
+
 	// Create OrderService
 	Logs.Info(ctx, "Creating order service with dependencies")
 	s, err := order.NewOrderService(r)
@@ -80,7 +106,8 @@ func main() {
 
 	// Start gRPC server
 	Logs.Info(ctx, "Starting gRPC server for order service on port 8080")
-	if err := order.ListenGRPC(s, config.AccountURL, config.CatalogURL, config.MailURL, 8080); err != nil {
+	unverified := account.UnverifiedPolicy{AllowedActions: config.UnverifiedAllowedActions}
+	if err := order.ListenGRPC(s, config.AccountURL, config.CatalogURL, config.MailURL, unverified, 8080); err != nil {
 		Logs.Fatal(ctx, "Failed to start gRPC server: "+err.Error())
 	}
 }
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS order_products;
+DROP TABLE IF EXISTS orders;
@@ -1,3 +1,5 @@
+-- Orders as they were before migrations, IF NOT EXISTS makes this version a no-op on databases
+-- created then
 CREATE TABLE IF NOT EXISTS orders (
   id CHAR(27) PRIMARY KEY,
   created_at TIMESTAMP WITH TIME ZONE NOT NULL,
@@ -10,4 +12,4 @@ CREATE TABLE IF NOT EXISTS order_products (
   product_id CHAR(27),
   quantity INT NOT NULL,
   PRIMARY KEY (product_id, order_id)
-);
\ No newline at end of file
+);
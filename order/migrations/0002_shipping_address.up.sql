@@ -0,0 +1,2 @@
+-- copy of the account address at order time, NULL without one
+ALTER TABLE orders ADD COLUMN shipping_address JSONB;
@@ -3,6 +3,7 @@ package order
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"time"
 
@@ -14,6 +15,7 @@ type Repository interface {
 	Close()
 	CreateOrder(ctx context.Context, order Order) error
 	ListOrdersForAccount(ctx context.Context, accountID string) ([]Order, error)
+	AnonymizeOrdersForAccount(ctx context.Context, accountID string) (int, error)
 }
 
 type postgresRepository struct {
@@ -68,10 +70,20 @@ func (p *postgresRepository) CreateOrder(ctx context.Context, order Order) (err
 		}
 	}()
 
+	// The shipping address is kept as a JSON copy, NULL for orders without one
+	var shipping []byte
+	if order.ShippingAddress != nil {
+		shipping, err = json.Marshal(order.ShippingAddress)
+		if err != nil {
+			Logs.Error(ctx, "Failed to marshal shipping address: "+err.Error())
+			return err
+		}
+	}
+
 	// Insert order metadata
 	_, err = tx.ExecContext(ctx,
-		"INSERT INTO orders(id, created_at, account_id, total_price) VALUES($1, $2, $3, $4)",
-		order.ID, order.CreatedAt, order.AccountID, order.TotalPrice)
+		"INSERT INTO orders(id, created_at, account_id, total_price, shipping_address) VALUES($1, $2, $3, $4, $5)",
+		order.ID, order.CreatedAt, order.AccountID, order.TotalPrice, shipping)
 	if err != nil {
 		Logs.Error(ctx, "Failed to insert order record: "+err.Error())
 		return err
@@ -111,7 +123,7 @@ func (p *postgresRepository) ListOrdersForAccount(ctx context.Context, accountID
 		ctx,
 		`SELECT 
 			o.id, o.created_at, o.account_id, 
-			o.total_price::money::numeric::float8, 
+			o.total_price::money::numeric::float8, o.shipping_address,
 			op.product_id, op.quantity
 		FROM orders o
 		JOIN order_products op ON o.id = op.order_id
@@ -138,12 +150,12 @@ func (p *postgresRepository) ListOrdersForAccount(ctx context.Context, accountID
 			createdAt  time.Time
 			accID      string
 			totalPrice float64
+			shipping   []byte
 			productID  string
 			quantity   uint32
-			stock      uint32
 		)
 
-		if err := rows.Scan(&orderID, &createdAt, &accID, &totalPrice, &productID, &quantity, &stock); err != nil {
+		if err := rows.Scan(&orderID, &createdAt, &accID, &totalPrice, &shipping, &productID, &quantity); err != nil {
 			Logs.Error(ctx, "Failed to scan order row: "+err.Error())
 			return nil, err
 		}
@@ -161,6 +173,13 @@ func (p *postgresRepository) ListOrdersForAccount(ctx context.Context, accountID
 				TotalPrice: totalPrice,
 				Products:   []OrderedProduct{},
 			}
+			if shipping != nil {
+				currentOrder.ShippingAddress = &ShippingAddress{}
+				if err := json.Unmarshal(shipping, currentOrder.ShippingAddress); err != nil {
+					Logs.Error(ctx, "Failed to decode shipping address: "+err.Error())
+					return nil, err
+				}
+			}
 			lastOrderID = orderID
 		}
 
@@ -169,7 +188,6 @@ func (p *postgresRepository) ListOrdersForAccount(ctx context.Context, accountID
 		currentOrder.Products = append(currentOrder.Products, OrderedProduct{
 			ProductID: productID,
 			Quantity:  quantity,
-			Stock:     stock,
 		})
 	}
 
@@ -185,3 +203,13 @@ func (p *postgresRepository) ListOrdersForAccount(ctx context.Context, accountID
 	Logs.Info(ctx, fmt.Sprintf("Returning %d orders for account: %s", len(orders), accountID))
 	return orders, nil
 }
+
+// AnonymizeOrdersForAccount drops the shipping address copies, the only personal data orders hold
+func (p *postgresRepository) AnonymizeOrdersForAccount(ctx context.Context, accountID string) (int, error) {
+	res, err := p.db.ExecContext(ctx, `UPDATE orders SET shipping_address = NULL WHERE account_id = $1`, accountID)
+	if err != nil {
+		return 0, err
+	}
+	count, err := res.RowsAffected()
+	return int(count), err
+}
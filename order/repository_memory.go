@@ -0,0 +1,97 @@
+package order
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"sync"
+)
+
+var (
+	errDuplicateOrder   = errors.New("an order with this ID already exists")
+	errDuplicateProduct = errors.New("a product appears more than once in the order")
+)
+
+// inMemoryRepository keeps orders in process memory, for tests and local runs. Like the
+// postgres repository it only keeps the product IDs and quantities of an order
+type inMemoryRepository struct {
+	mu     sync.RWMutex
+	orders map[string]*Order
+}
+
+func NewInMemoryRepository() Repository {
+	return &inMemoryRepository{
+		orders: make(map[string]*Order),
+	}
+}
+
+func (r *inMemoryRepository) Close() {}
+
+func (r *inMemoryRepository) CreateOrder(ctx context.Context, order Order) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.orders[order.ID]; ok {
+		return errDuplicateOrder
+	}
+	stored := Order{
+		ID:        order.ID,
+		CreatedAt: order.CreatedAt,
+		AccountID: order.AccountID,
+		// the money column keeps cents
+		TotalPrice: math.Round(order.TotalPrice*100) / 100,
+		Products:   []OrderedProduct{},
+	}
+	seen := map[string]bool{}
+	for _, p := range order.Products {
+		if seen[p.ProductID] {
+			return errDuplicateProduct
+		}
+		seen[p.ProductID] = true
+		stored.Products = append(stored.Products, OrderedProduct{ProductID: p.ProductID, Quantity: p.Quantity})
+	}
+	if order.ShippingAddress != nil {
+		shipping := *order.ShippingAddress
+		stored.ShippingAddress = &shipping
+	}
+	r.orders[order.ID] = &stored
+	return nil
+}
+
+// ListOrdersForAccount returns the orders by ID, orders without products are left out as the
+// join of the postgres query leaves them out
+func (r *inMemoryRepository) ListOrdersForAccount(ctx context.Context, accountID string) ([]Order, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var orders []Order
+	for _, order := range r.orders {
+		if order.AccountID != accountID || len(order.Products) == 0 {
+			continue
+		}
+		copied := *order
+		copied.Products = append([]OrderedProduct{}, order.Products...)
+		if order.ShippingAddress != nil {
+			shipping := *order.ShippingAddress
+			copied.ShippingAddress = &shipping
+		}
+		orders = append(orders, copied)
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].ID < orders[j].ID })
+	return orders, nil
+}
+
+func (r *inMemoryRepository) AnonymizeOrdersForAccount(ctx context.Context, accountID string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	count := 0
+	for _, order := range r.orders {
+		if order.AccountID == accountID {
+			order.ShippingAddress = nil
+			count++
+		}
+	}
+	return count, nil
+}
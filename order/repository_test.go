@@ -0,0 +1,132 @@
+package order
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"github.com/zenvisjr/building-scalable-microservices/migrate"
+)
+
+// TestInMemoryRepository and TestPostgresRepository run the same contract, so both
+// implementations stay interchangeable
+func TestInMemoryRepository(t *testing.T) {
+	testRepository(t, NewInMemoryRepository())
+}
+
+// TestPostgresRepository needs a database, ORDER_TEST_DATABASE_URL points to one. Every test
+// orders for a new account ID, so it can share a database with other runs
+func TestPostgresRepository(t *testing.T) {
+	url := os.Getenv("ORDER_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("ORDER_TEST_DATABASE_URL is not set")
+	}
+	if err := migrate.Run(context.Background(), url, Migrations, []string{"up"}); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	repo, err := NewPostgresRepository(url)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer repo.Close()
+	testRepository(t, repo)
+}
+
+// newTestOrder returns an order with a unique ID, postgres keeps timestamps to the microsecond
+// so CreatedAt is truncated to compare equal after a round trip
+func newTestOrder(accountID string, products ...OrderedProduct) Order {
+	return Order{
+		ID:         ksuid.New().String(),
+		CreatedAt:  time.Now().UTC().Truncate(time.Microsecond),
+		AccountID:  accountID,
+		TotalPrice: 12.345,
+		Products:   products,
+	}
+}
+
+func testRepository(t *testing.T, repo Repository) {
+	ctx := context.Background()
+
+	t.Run("CreateAndList", func(t *testing.T) {
+		accountID := ksuid.New().String()
+		first := newTestOrder(accountID,
+			OrderedProduct{ProductID: "p1", Name: "Lamp", Price: 10, Quantity: 2},
+			OrderedProduct{ProductID: "p2", Quantity: 1},
+		)
+		first.ShippingAddress = &ShippingAddress{Recipient: "Alice", Line1: "Main Street 1", City: "Berlin", Country: "DE"}
+		second := newTestOrder(accountID, OrderedProduct{ProductID: "p3", Quantity: 5})
+		for _, order := range []Order{first, second} {
+			if err := repo.CreateOrder(ctx, order); err != nil {
+				t.Fatalf("CreateOrder: %v", err)
+			}
+		}
+		if err := repo.CreateOrder(ctx, first); err == nil {
+			t.Error("CreateOrder with a taken ID succeeded")
+		}
+		if err := repo.CreateOrder(ctx, newTestOrder(accountID, OrderedProduct{ProductID: "p1", Quantity: 1}, OrderedProduct{ProductID: "p1", Quantity: 1})); err == nil {
+			t.Error("CreateOrder with a product twice succeeded")
+		}
+
+		orders, err := repo.ListOrdersForAccount(ctx, accountID)
+		if err != nil {
+			t.Fatalf("ListOrdersForAccount: %v", err)
+		}
+		if len(orders) != 2 {
+			t.Fatalf("ListOrdersForAccount = %+v, want 2 orders", orders)
+		}
+		byID := map[string]Order{}
+		for _, order := range orders {
+			byID[order.ID] = order
+		}
+		got := byID[first.ID]
+		if !got.CreatedAt.Equal(first.CreatedAt) || got.TotalPrice != 12.35 || len(got.Products) != 2 {
+			t.Errorf("stored order = %+v", got)
+		}
+		// only the product IDs and quantities are kept, the catalog has the rest
+		for _, p := range got.Products {
+			if p.Name != "" || p.Price != 0 {
+				t.Errorf("stored product = %+v, want only the ID and quantity", p)
+			}
+		}
+		if got.ShippingAddress == nil || *got.ShippingAddress != *first.ShippingAddress {
+			t.Errorf("shipping address = %+v", got.ShippingAddress)
+		}
+		if byID[second.ID].ShippingAddress != nil {
+			t.Errorf("shipping address of an order without one = %+v", byID[second.ID].ShippingAddress)
+		}
+
+		if orders, err := repo.ListOrdersForAccount(ctx, ksuid.New().String()); err != nil || len(orders) != 0 {
+			t.Errorf("ListOrdersForAccount of an account without orders = %v, %v", orders, err)
+		}
+	})
+
+	t.Run("Anonymize", func(t *testing.T) {
+		accountID := ksuid.New().String()
+		for i := 0; i < 2; i++ {
+			order := newTestOrder(accountID, OrderedProduct{ProductID: "p1", Quantity: 1})
+			order.ShippingAddress = &ShippingAddress{Recipient: "Bob", Line1: "Side Street 2"}
+			if err := repo.CreateOrder(ctx, order); err != nil {
+				t.Fatalf("CreateOrder: %v", err)
+			}
+		}
+
+		count, err := repo.AnonymizeOrdersForAccount(ctx, accountID)
+		if err != nil || count != 2 {
+			t.Fatalf("AnonymizeOrdersForAccount = %d, %v", count, err)
+		}
+		orders, err := repo.ListOrdersForAccount(ctx, accountID)
+		if err != nil || len(orders) != 2 {
+			t.Fatalf("ListOrdersForAccount = %v, %v", orders, err)
+		}
+		for _, order := range orders {
+			if order.ShippingAddress != nil {
+				t.Errorf("shipping address after anonymizing = %+v", order.ShippingAddress)
+			}
+		}
+		if count, err := repo.AnonymizeOrdersForAccount(ctx, ksuid.New().String()); err != nil || count != 0 {
+			t.Errorf("AnonymizeOrdersForAccount of an account without orders = %d, %v", count, err)
+		}
+	})
+}
@@ -16,6 +16,8 @@ import (
 	"github.com/zenvisjr/building-scalable-microservices/logger"
 	"github.com/zenvisjr/building-scalable-microservices/mail"
 	"github.com/zenvisjr/building-scalable-microservices/order/pb"
+	"github.com/zenvisjr/building-scalable-microservices/svcauth"
+	"github.com/zenvisjr/building-scalable-microservices/tlsconfig"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/reflection"
 	"google.golang.org/protobuf/types/known/timestamppb"
@@ -26,11 +28,24 @@ type grpcServer struct {
 	accountClient *account.Client
 	catalogClient *catalog.Client
 	mailClient    *mail.Mail
-	netScan       *nats.Conn
+	netScan       Publisher
+	unverified    account.UnverifiedPolicy
 	pb.UnimplementedOrderServiceServer
 }
 
-func ListenGRPC(s Service, accountURL, catalogURL, mailURL string, port int) error {
+// Publisher sends order confirmations to the mail service and status changes to subscribers
+type Publisher interface {
+	Publish(subject string, data []byte) error
+}
+
+// callers lists the services allowed to call each RPC
+var callers = svcauth.Allowlist{
+	pb.OrderService_PostOrder_FullMethodName:                 {"gateway"},
+	pb.OrderService_GetOrdersForAccount_FullMethodName:       {"gateway", "auth"},
+	pb.OrderService_AnonymizeOrdersForAccount_FullMethodName: {"auth"},
+}
+
+func ListenGRPC(s Service, accountURL, catalogURL, mailURL string, unverified account.UnverifiedPolicy, port int) error {
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo(fmt.Sprintf("Initializing Order gRPC server on port %d", port))
 
@@ -87,21 +102,33 @@ func ListenGRPC(s Service, accountURL, catalogURL, mailURL string, port int) err
 	}
 	Logs.LocalOnlyInfo(fmt.Sprintf("Successfully listening on port %d", port))
 
-	server := grpc.NewServer(
-		grpc.UnaryInterceptor(logger.UnaryLoggingInterceptor()),
-	)
+	creds, err := tlsconfig.ServerOption()
+	if err != nil {
+		Logs.Error(context.Background(), "Failed to load TLS config: "+err.Error())
+		return err
+	}
+	server := NewGRPCServer(s, accountClient, catalogClient, nc, unverified, creds)
+	Logs.Info(context.Background(), fmt.Sprintf("Order gRPC server started on port %d", port))
+
+	return server.Serve(conn)
+}
+
+// NewGRPCServer builds the order gRPC server. Placing an order checks the account against
+// unverified and the stock through catalogClient
+func NewGRPCServer(s Service, accountClient *account.Client, catalogClient *catalog.Client, nc Publisher, unverified account.UnverifiedPolicy, opts ...grpc.ServerOption) *grpc.Server {
+	server := grpc.NewServer(append(opts,
+		grpc.ChainUnaryInterceptor(logger.UnaryLoggingInterceptor(), svcauth.UnaryServerInterceptor(callers)),
+	)...)
 	pb.RegisterOrderServiceServer(server, &grpcServer{
 		service:       s,
 		accountClient: accountClient,
 		catalogClient: catalogClient,
 		// mailClient:    mailClient,
-		netScan: nc,
+		netScan:    nc,
+		unverified: unverified,
 	})
-
 	reflection.Register(server)
-	Logs.Info(context.Background(), fmt.Sprintf("Order gRPC server started on port %d", port))
-
-	return server.Serve(conn)
+	return server
 }
 
 // Take an order creation request from a client (with account ID and product list), fetch account
@@ -122,6 +149,18 @@ func (g *grpcServer) PostOrder(ctx context.Context, req *pb.PostOrderRequest) (*
 	}
 	Logs.LocalOnlyInfo("Account validated: " + req.GetAccountId())
 
+	// Unverified accounts can only order if the policy allows it
+	if err := g.unverified.CheckPlaceOrder(account); err != nil {
+		Logs.Warn(ctx, "Order refused for unverified account: "+req.GetAccountId())
+		return nil, err
+	}
+
+	// Snapshot the shipping address, the chosen one or else the default of the account
+	shipping, err := g.shippingAddress(ctx, req.GetAccountId(), req.GetAddressId())
+	if err != nil {
+		return nil, err
+	}
+
 	// STEP 2: Collect product IDs
 	productID := []string{}
 	for _, product := range req.GetProducts() {
@@ -134,11 +173,12 @@ func (g *grpcServer) PostOrder(ctx context.Context, req *pb.PostOrderRequest) (*
 	Logs.LocalOnlyInfo(fmt.Sprintf("Collected %d product IDs: %v", len(productID), productID))
 
 	// STEP 3: Fetch product details
-	products, err := g.catalogClient.GetProducts(ctx, 0, 0, productID, "")
+	page, err := g.catalogClient.GetProducts(ctx, 0, 0, productID, "", "")
 	if err != nil {
 		Logs.Error(ctx, "Failed to fetch products from catalog: "+err.Error())
 		return nil, errors.Errorf("Product not found")
 	}
+	products := page.Products()
 	Logs.LocalOnlyInfo(fmt.Sprintf("Catalog returned %d products", len(products)))
 	for i, p := range products {
 		Logs.LocalOnlyInfo(fmt.Sprintf("Catalog Product %d: ID=%s, Name=%s, Price=%f", i, p.ID, p.Name, p.Price))
@@ -187,7 +227,7 @@ func (g *grpcServer) PostOrder(ctx context.Context, req *pb.PostOrderRequest) (*
 	Logs.LocalOnlyInfo(fmt.Sprintf("Final ordered product list has %d items", len(orderedProduct)))
 
 	// STEP 5: Create the order
-	orderproto, err := g.service.PostOrder(ctx, req.GetAccountId(), orderedProduct)
+	orderproto, err := g.service.PostOrder(ctx, req.GetAccountId(), orderedProduct, shipping)
 	if err != nil {
 		Logs.Error(ctx, "Failed to post order: "+err.Error())
 		return nil, errors.Errorf("could not post order")
@@ -245,11 +285,12 @@ func (g *grpcServer) PostOrder(ctx context.Context, req *pb.PostOrderRequest) (*
 
 	// STEP 6: Build gRPC response
 	resProduct := &pb.Order{
-		Id:         orderproto.ID,
-		AccountId:  orderproto.AccountID,
-		TotalPrice: orderproto.TotalPrice,
-		CreatedAt:  timestamppb.New(orderproto.CreatedAt),
-		Products:   []*pb.Order_OrderedProduct{},
+		Id:              orderproto.ID,
+		AccountId:       orderproto.AccountID,
+		TotalPrice:      orderproto.TotalPrice,
+		CreatedAt:       timestamppb.New(orderproto.CreatedAt),
+		Products:        []*pb.Order_OrderedProduct{},
+		ShippingAddress: toShippingAddressProto(orderproto.ShippingAddress),
 	}
 
 	// STEP 7: Simulate order status changes
@@ -301,11 +342,12 @@ func (g *grpcServer) GetOrdersForAccount(ctx context.Context, req *pb.GetOrdersF
 	}
 
 	// Step 4: Fetch full product details from the catalog service using collected IDs
-	productList, err := g.catalogClient.GetProducts(ctx, 0, 0, productIds, "")
+	page, err := g.catalogClient.GetProducts(ctx, 0, 0, productIds, "", "")
 	if err != nil {
 		Logs.Error(ctx, "Error getting product list from catalog service: "+err.Error())
 		return nil, err
 	}
+	productList := page.Products()
 	Logs.Info(ctx, "Fetched "+strconv.Itoa(len(productList))+" products from catalog service")
 
 	// Step 5: Initialize the final response list of protobuf orders
@@ -314,11 +356,12 @@ func (g *grpcServer) GetOrdersForAccount(ctx context.Context, req *pb.GetOrdersF
 	// Step 6: Loop through all domain orders and map them to protobuf orders
 	for _, order := range orders {
 		resProduct := &pb.Order{
-			Id:         order.ID,
-			AccountId:  order.AccountID,
-			TotalPrice: order.TotalPrice,
-			CreatedAt:  timestamppb.New(order.CreatedAt),
-			Products:   []*pb.Order_OrderedProduct{},
+			Id:              order.ID,
+			AccountId:       order.AccountID,
+			TotalPrice:      order.TotalPrice,
+			CreatedAt:       timestamppb.New(order.CreatedAt),
+			Products:        []*pb.Order_OrderedProduct{},
+			ShippingAddress: toShippingAddressProto(order.ShippingAddress),
 		}
 		Logs.Info(ctx, "Processing order ID: "+order.ID+" with "+strconv.Itoa(len(order.Products))+" products")
 
@@ -356,7 +399,62 @@ func (g *grpcServer) GetOrdersForAccount(ctx context.Context, req *pb.GetOrdersF
 	}, nil
 }
 
-func simulateOrderStatus(ctx context.Context, orderID string, nc *nats.Conn) {
+// shippingAddress copies the address of the account an order is shipped to. Without an addressID
+// the default address is used, and an account without one orders without an address
+func (g *grpcServer) AnonymizeOrdersForAccount(ctx context.Context, req *pb.GetOrdersForAccountRequest) (*pb.AnonymizeOrdersForAccountResponse, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.Info(ctx, "Anonymizing orders for account ID: "+req.GetAccountId())
+
+	count, err := g.service.AnonymizeOrdersForAccount(ctx, req.GetAccountId())
+	if err != nil {
+		return nil, err
+	}
+	return &pb.AnonymizeOrdersForAccountResponse{Orders: uint32(count)}, nil
+}
+
+func (g *grpcServer) shippingAddress(ctx context.Context, accountID string, addressID string) (*ShippingAddress, error) {
+	Logs := logger.GetGlobalLogger()
+
+	address, err := g.accountClient.GetAddress(ctx, accountID, addressID)
+	if err != nil {
+		Logs.Error(ctx, "Failed to fetch shipping address: "+err.Error())
+		return nil, errors.Errorf("shipping address not found")
+	}
+	if address == nil {
+		Logs.LocalOnlyInfo("No default address for account: " + accountID)
+		return nil, nil
+	}
+	return &ShippingAddress{
+		Label:      address.Label,
+		Recipient:  address.Recipient,
+		Line1:      address.Line1,
+		Line2:      address.Line2,
+		City:       address.City,
+		State:      address.State,
+		PostalCode: address.PostalCode,
+		Country:    address.Country,
+		Phone:      address.Phone,
+	}, nil
+}
+
+func toShippingAddressProto(address *ShippingAddress) *pb.ShippingAddress {
+	if address == nil {
+		return nil
+	}
+	return &pb.ShippingAddress{
+		Label:      address.Label,
+		Recipient:  address.Recipient,
+		Line1:      address.Line1,
+		Line2:      address.Line2,
+		City:       address.City,
+		State:      address.State,
+		PostalCode: address.PostalCode,
+		Country:    address.Country,
+		Phone:      address.Phone,
+	}
+}
+
+func simulateOrderStatus(ctx context.Context, orderID string, nc Publisher) {
 	statuses := []string{"✅ Confirmed", "📦 Packed", "🚚 Shipped", "📦 Delivered"}
 	Logs := logger.GetGlobalLogger()
 
@@ -0,0 +1,185 @@
+package order
+
+import (
+	"context"
+	"testing"
+
+	"github.com/zenvisjr/building-scalable-microservices/account"
+	"github.com/zenvisjr/building-scalable-microservices/catalog"
+	"github.com/zenvisjr/building-scalable-microservices/internal/servicetest"
+	"github.com/zenvisjr/building-scalable-microservices/internal/svcauthtest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMain(m *testing.M) {
+	servicetest.Main(m, "order")
+}
+
+type testServices struct {
+	orders    *Client
+	accounts  *account.Client
+	catalog   *catalog.Client
+	publisher *servicetest.Publisher
+}
+
+// startServer serves an in-memory order service over bufconn, backed by in-memory account and
+// catalog services, and returns clients of all three
+func startServer(t *testing.T, unverified account.UnverifiedPolicy) *testServices {
+	t.Helper()
+	publisher := &servicetest.Publisher{}
+	services := &testServices{publisher: publisher}
+	var err error
+
+	accountDialer := servicetest.Serve(t, account.NewGRPCServer(account.NewAccountService(account.NewInMemoryRepository()), publisher))
+	if services.accounts, err = account.NewClient("passthrough:///account", accountDialer); err != nil {
+		t.Fatalf("account.NewClient: %v", err)
+	}
+	t.Cleanup(services.accounts.Close)
+
+	embedder, err := catalog.NewLocalEmbedder(64)
+	if err != nil {
+		t.Fatalf("catalog.NewLocalEmbedder: %v", err)
+	}
+	catalogDialer := servicetest.Serve(t, catalog.NewGRPCServer(catalog.NewCatalogService(catalog.NewInMemoryRepository(embedder), catalog.HybridConfig{})))
+	if services.catalog, err = catalog.NewClient("passthrough:///catalog", catalogDialer); err != nil {
+		t.Fatalf("catalog.NewClient: %v", err)
+	}
+	t.Cleanup(services.catalog.Close)
+
+	orderService, err := NewOrderService(NewInMemoryRepository())
+	if err != nil {
+		t.Fatalf("NewOrderService: %v", err)
+	}
+	orderDialer := servicetest.Serve(t, NewGRPCServer(orderService, services.accounts, services.catalog, publisher, unverified, svcauthtest.ServedAs("order")))
+	if services.orders, err = NewClient("passthrough:///order", orderDialer); err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(services.orders.Close)
+	return services
+}
+
+// signUp creates an account the way the auth service does
+func signUp(t *testing.T, services *testServices, name string) *account.Account {
+	t.Helper()
+	svcauthtest.Use("auth")
+	defer svcauthtest.Use("gateway")
+	acc, err := services.accounts.PostAccount(context.Background(), name, name+"@example.com", "secret123", "user")
+	if err != nil {
+		t.Fatalf("PostAccount: %v", err)
+	}
+	return acc
+}
+
+func TestPostOrder(t *testing.T) {
+	services := startServer(t, account.UnverifiedPolicy{AllowedActions: []string{account.ActionPlaceOrder}})
+	ctx := context.Background()
+	acc := signUp(t, services, "alice")
+
+	address, err := services.accounts.AddAddress(ctx, acc.ID, account.Address{Recipient: "Alice", Line1: "Main Street 1", City: "Berlin", PostalCode: "10115", Country: "DE", IsDefault: true})
+	if err != nil {
+		t.Fatalf("AddAddress: %v", err)
+	}
+	lamp, err := services.catalog.PostProduct(ctx, "Desk Lamp", "Warm light", 20, 3, "", nil, nil)
+	if err != nil {
+		t.Fatalf("PostProduct: %v", err)
+	}
+	mug, err := services.catalog.PostProduct(ctx, "Mug", "Holds coffee", 4.5, 10, "", nil, nil)
+	if err != nil {
+		t.Fatalf("PostProduct: %v", err)
+	}
+
+	order, err := services.orders.PostOrder(ctx, acc.ID, "", []OrderedProduct{
+		{ProductID: lamp.ID, Quantity: 2},
+		{ProductID: mug.ID, Quantity: 1},
+	})
+	if err != nil {
+		t.Fatalf("PostOrder: %v", err)
+	}
+	if order.AccountID != acc.ID || order.TotalPrice != 44.5 || len(order.Products) != 2 {
+		t.Errorf("PostOrder = %+v", order)
+	}
+	if order.ShippingAddress == nil || order.ShippingAddress.Line1 != address.Line1 {
+		t.Errorf("shipping address = %+v, want the default address", order.ShippingAddress)
+	}
+	if got := services.publisher.Count("emails.send"); got != 2 {
+		t.Errorf("emails published = %d, want the welcome and the confirmation", got)
+	}
+
+	// the order took the stock from the catalog
+	left, err := services.catalog.GetProduct(ctx, lamp.ID)
+	if err != nil || left.Stock != 1 || left.Sold != 2 {
+		t.Errorf("lamp after the order = %+v, %v", left, err)
+	}
+
+	orders, err := services.orders.GetOrdersForAccount(ctx, acc.ID)
+	if err != nil {
+		t.Fatalf("GetOrdersForAccount: %v", err)
+	}
+	if len(orders) != 1 || orders[0].ID != order.ID || len(orders[0].Products) != 2 {
+		t.Fatalf("GetOrdersForAccount = %+v", orders)
+	}
+	for _, p := range orders[0].Products {
+		if p.Name == "" || p.Price == 0 {
+			t.Errorf("ordered product = %+v, want the catalog details", p)
+		}
+	}
+
+	if _, err := services.orders.PostOrder(ctx, acc.ID, "", nil); err == nil {
+		t.Error("PostOrder without products succeeded")
+	}
+}
+
+func TestPostOrderUnverified(t *testing.T) {
+	services := startServer(t, account.UnverifiedPolicy{})
+	ctx := context.Background()
+	acc := signUp(t, services, "bob")
+	mug, err := services.catalog.PostProduct(ctx, "Mug", "Holds coffee", 4.5, 10, "", nil, nil)
+	if err != nil {
+		t.Fatalf("PostProduct: %v", err)
+	}
+
+	if _, err := services.orders.PostOrder(ctx, acc.ID, "", []OrderedProduct{{ProductID: mug.ID, Quantity: 1}}); err == nil {
+		t.Fatal("PostOrder of an unverified account succeeded")
+	}
+
+	svcauthtest.CallAs(t, "auth")
+	if err := services.accounts.MarkEmailVerified(ctx, acc.ID, acc.Email); err != nil {
+		t.Fatalf("MarkEmailVerified: %v", err)
+	}
+	svcauthtest.Use("gateway")
+	if _, err := services.orders.PostOrder(ctx, acc.ID, "", []OrderedProduct{{ProductID: mug.ID, Quantity: 1}}); err != nil {
+		t.Errorf("PostOrder after verifying: %v", err)
+	}
+}
+
+func TestAnonymizeOrders(t *testing.T) {
+	services := startServer(t, account.UnverifiedPolicy{AllowedActions: []string{account.ActionPlaceOrder}})
+	ctx := context.Background()
+	acc := signUp(t, services, "carol")
+	if _, err := services.accounts.AddAddress(ctx, acc.ID, account.Address{Recipient: "Carol", Line1: "Side Street 2", City: "Hamburg", PostalCode: "20095", Country: "DE", IsDefault: true}); err != nil {
+		t.Fatalf("AddAddress: %v", err)
+	}
+	mug, err := services.catalog.PostProduct(ctx, "Mug", "Holds coffee", 4.5, 10, "", nil, nil)
+	if err != nil {
+		t.Fatalf("PostProduct: %v", err)
+	}
+	if _, err := services.orders.PostOrder(ctx, acc.ID, "", []OrderedProduct{{ProductID: mug.ID, Quantity: 1}}); err != nil {
+		t.Fatalf("PostOrder: %v", err)
+	}
+
+	// only the auth service erases accounts
+	if _, err := services.orders.AnonymizeOrdersForAccount(ctx, acc.ID); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("AnonymizeOrdersForAccount from the gateway = %v, want PermissionDenied", err)
+	}
+
+	svcauthtest.CallAs(t, "auth")
+	count, err := services.orders.AnonymizeOrdersForAccount(ctx, acc.ID)
+	if err != nil || count != 1 {
+		t.Fatalf("AnonymizeOrdersForAccount = %d, %v", count, err)
+	}
+	orders, err := services.orders.GetOrdersForAccount(ctx, acc.ID)
+	if err != nil || len(orders) != 1 || orders[0].ShippingAddress != nil {
+		t.Errorf("orders after anonymizing = %+v, %v", orders, err)
+	}
+}
@@ -10,8 +10,9 @@ import (
 )
 
 type Service interface {
-	PostOrder(ctx context.Context, accountID string, orders []OrderedProduct) (*Order, error)
+	PostOrder(ctx context.Context, accountID string, orders []OrderedProduct, shipping *ShippingAddress) (*Order, error)
 	GetOrdersByAccount(ctx context.Context, accountid string) ([]Order, error)
+	AnonymizeOrdersForAccount(ctx context.Context, accountID string) (int, error)
 }
 
 type Order struct {
@@ -20,6 +21,20 @@ type Order struct {
 	AccountID  string           `json:"account_id"`
 	TotalPrice float64          `json:"price"`
 	Products   []OrderedProduct `json:"orderedproducts"`
+	// ShippingAddress is copied from the account when the order is placed, nil if it had none
+	ShippingAddress *ShippingAddress `json:"shipping_address"`
+}
+
+type ShippingAddress struct {
+	Label      string `json:"label"`
+	Recipient  string `json:"recipient"`
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2"`
+	City       string `json:"city"`
+	State      string `json:"state"`
+	PostalCode string `json:"postal_code"`
+	Country    string `json:"country"`
+	Phone      string `json:"phone"`
 }
 
 type OrderedProduct struct {
@@ -39,15 +54,16 @@ func NewOrderService(r Repository) (Service, error) {
 	return &orderService{r}, nil
 }
 
-func (o *orderService) PostOrder(ctx context.Context, accountID string, orders []OrderedProduct) (*Order, error) {
+func (o *orderService) PostOrder(ctx context.Context, accountID string, orders []OrderedProduct, shipping *ShippingAddress) (*Order, error) {
 	Logs := logger.GetGlobalLogger()
 	Logs.LocalOnlyInfo(fmt.Sprintf("PostOrder called with %d products", len(orders)))
 
 	order := &Order{
-		ID:        ksuid.New().String(),
-		CreatedAt: time.Now().UTC(),
-		AccountID: accountID,
-		Products:  orders,
+		ID:              ksuid.New().String(),
+		CreatedAt:       time.Now().UTC(),
+		AccountID:       accountID,
+		Products:        orders,
+		ShippingAddress: shipping,
 	}
 
 	order.TotalPrice = 0.0
@@ -80,3 +96,20 @@ func (o *orderService) GetOrdersByAccount(ctx context.Context, accountID string)
 	Logs.LocalOnlyInfo(fmt.Sprintf("Fetched %d orders for account %s", len(orders), accountID))
 	return orders, nil
 }
+
+// AnonymizeOrdersForAccount removes the personal data of an erased account from its orders.
+// The orders themselves are kept for bookkeeping, the account ID no longer leads to a person
+// once the account service erased the account
+func (o *orderService) AnonymizeOrdersForAccount(ctx context.Context, accountID string) (int, error) {
+	Logs := logger.GetGlobalLogger()
+	Logs.Info(ctx, "Anonymizing orders for account: "+accountID)
+
+	count, err := o.repo.AnonymizeOrdersForAccount(ctx, accountID)
+	if err != nil {
+		Logs.Error(ctx, "Failed to anonymize orders: "+err.Error())
+		return 0, err
+	}
+
+	Logs.LocalOnlyInfo(fmt.Sprintf("Anonymized %d orders for account %s", count, accountID))
+	return count, nil
+}
@@ -0,0 +1,168 @@
+// Package svcauth authenticates calls between the microservices. Every outgoing call carries a
+// short-lived token signed with the Ed25519 key of the calling service that names the service,
+// the RPC it is meant for and the end user the call is made on behalf of. Servers check the
+// token against the public key of the named service (or the mTLS peer certificate) and an
+// allowlist of which services may call which RPC. A service only holds its own private key, so
+// it cannot mint tokens in the name of another one.
+// The ID of the request the gateway received is forwarded along with every call.
+package svcauth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/kelseyhightower/envconfig"
+)
+
+type Config struct {
+	KeyFile       string        `envconfig:"SERVICE_AUTH_KEY_FILE" default:"/app/tls/service.key"`
+	PublicKeysDir string        `envconfig:"SERVICE_AUTH_PUBLIC_KEYS_DIR" default:"/app/tls/service-keys"`
+	TokenTTL      time.Duration `envconfig:"SERVICE_TOKEN_TTL" default:"1m"`
+}
+
+// Keys are the private key the running service signs its tokens with and the public keys of
+// the services, by name, whose tokens it accepts
+type Keys struct {
+	Private ed25519.PrivateKey
+	Public  map[string]ed25519.PublicKey
+}
+
+// identity is the name and the keys of the running service
+type identity struct {
+	service  string
+	keys     Keys
+	tokenTTL time.Duration
+}
+
+// self is the identity of the running service, nil until Init
+var self atomic.Pointer[identity]
+
+// Init loads the key of the service and the public keys of the others from the files named in
+// the environment and records the name this service uses when calling others. It must be
+// called in main before any client is created
+func Init(service string) error {
+	var config Config
+	if err := envconfig.Process("", &config); err != nil {
+		return err
+	}
+	keys, err := loadKeys(config.KeyFile, config.PublicKeysDir)
+	if err != nil {
+		return err
+	}
+	return InitWithKeys(service, keys, config.TokenTTL)
+}
+
+// InitWithKeys sets the identity of the running service from keys already in memory. Calling
+// it again replaces the identity, which is how tests play one service after the other
+func InitWithKeys(service string, keys Keys, tokenTTL time.Duration) error {
+	if len(keys.Private) != ed25519.PrivateKeySize {
+		return errors.New("service auth private key is missing or not an Ed25519 key")
+	}
+	self.Store(&identity{
+		service:  service,
+		keys:     keys,
+		tokenTTL: tokenTTL,
+	})
+	return nil
+}
+
+// loadKeys reads the PEM private key in keyFile and every <service>.pub PEM public key in publicKeysDir
+func loadKeys(keyFile string, publicKeysDir string) (Keys, error) {
+	pemKey, err := os.ReadFile(keyFile)
+	if err != nil {
+		return Keys{}, errors.New("failed to read SERVICE_AUTH_KEY_FILE (run certs/generate.sh): " + err.Error())
+	}
+	privateKey, err := jwt.ParseEdPrivateKeyFromPEM(pemKey)
+	if err != nil {
+		return Keys{}, errors.New("invalid service auth private key: " + err.Error())
+	}
+	keys := Keys{Public: map[string]ed25519.PublicKey{}}
+	keys.Private, _ = privateKey.(ed25519.PrivateKey)
+
+	files, err := filepath.Glob(filepath.Join(publicKeysDir, "*.pub"))
+	if err != nil {
+		return Keys{}, err
+	}
+	if len(files) == 0 {
+		return Keys{}, errors.New("no service public keys found in SERVICE_AUTH_PUBLIC_KEYS_DIR " + publicKeysDir)
+	}
+	for _, file := range files {
+		pemKey, err := os.ReadFile(file)
+		if err != nil {
+			return Keys{}, err
+		}
+		publicKey, err := jwt.ParseEdPublicKeyFromPEM(pemKey)
+		if err != nil {
+			return Keys{}, errors.New("invalid service public key " + file + ": " + err.Error())
+		}
+		service := strings.TrimSuffix(filepath.Base(file), ".pub")
+		keys.Public[service], _ = publicKey.(ed25519.PublicKey)
+	}
+	return keys, nil
+}
+
+// ServiceName returns the name given to Init
+func ServiceName() string {
+	id := self.Load()
+	if id == nil {
+		return ""
+	}
+	return id.service
+}
+
+// User is the end user a call is made on behalf of, as verified by the gateway
+type User struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+type ctxKey string
+
+const (
+	userCtxKey      = ctxKey("svcauth_user")
+	callerCtxKey    = ctxKey("svcauth_caller")
+	requestIDCtxKey = ctxKey("svcauth_request_id")
+)
+
+// maxRequestIDLength keeps request IDs sent by clients from filling logs and audit records
+const maxRequestIDLength = 64
+
+// ContextWithUser attaches the end user to ctx, outgoing calls made with it forward the user
+func ContextWithUser(ctx context.Context, user *User) context.Context {
+	return context.WithValue(ctx, userCtxKey, user)
+}
+
+// UserFromContext returns the end user forwarded by the calling service, if any
+func UserFromContext(ctx context.Context) (*User, bool) {
+	user, ok := ctx.Value(userCtxKey).(*User)
+	return user, ok && user != nil
+}
+
+// CallerFromContext returns the name of the service that made the current call
+func CallerFromContext(ctx context.Context) string {
+	caller, _ := ctx.Value(callerCtxKey).(string)
+	return caller
+}
+
+// ContextWithRequestID attaches the ID of the request being served, outgoing calls made with
+// ctx forward it. IDs longer than 64 bytes are cut
+func ContextWithRequestID(ctx context.Context, requestID string) context.Context {
+	if len(requestID) > maxRequestIDLength {
+		requestID = requestID[:maxRequestIDLength]
+	}
+	return context.WithValue(ctx, requestIDCtxKey, requestID)
+}
+
+// RequestIDFromContext returns the ID of the request being served, "" when there is none
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDCtxKey).(string)
+	return requestID
+}
@@ -0,0 +1,208 @@
+package svcauth
+
+import (
+	"context"
+	"crypto/tls"
+
+	"github.com/zenvisjr/building-scalable-microservices/logger"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// tokenMetadataKey carries the service token, user tokens keep using authorization
+const tokenMetadataKey = "x-service-token"
+
+// requestIDMetadataKey carries the request ID, it is sent next to the token so calls
+// authenticated by their mTLS certificate alone keep it too
+const requestIDMetadataKey = "x-request-id"
+
+// Allowlist maps the full gRPC method name to the services allowed to call it.
+// Methods that are not listed cannot be called by anyone
+type Allowlist map[string][]string
+
+func (a Allowlist) allows(method string, caller string) bool {
+	for _, service := range a[method] {
+		if service == caller {
+			return true
+		}
+	}
+	return false
+}
+
+// DialOption makes a client attach a service token to every call
+func DialOption() grpc.DialOption {
+	return grpc.WithChainUnaryInterceptor(UnaryClientInterceptor())
+}
+
+// StreamDialOption makes a client attach a service token to every stream it opens, clients of
+// services with streaming RPCs pass it next to DialOption
+func StreamDialOption() grpc.DialOption {
+	return grpc.WithChainStreamInterceptor(StreamClientInterceptor())
+}
+
+// UnaryClientInterceptor signs a token for the called method and the user found in ctx
+func UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		id := self.Load()
+		if id == nil {
+			return status.Error(codes.Unauthenticated, "service identity not initialized, call svcauth.Init first")
+		}
+
+		ctx, err := outgoingContext(ctx, id, method)
+		if err != nil {
+			return err
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// StreamClientInterceptor signs a token for the streaming method and the user found in ctx.
+// The token is only checked when the stream is opened, so it may expire while the stream lasts
+func StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		id := self.Load()
+		if id == nil {
+			return nil, status.Error(codes.Unauthenticated, "service identity not initialized, call svcauth.Init first")
+		}
+
+		ctx, err := outgoingContext(ctx, id, method)
+		if err != nil {
+			return nil, err
+		}
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+}
+
+// outgoingContext adds the service token and the request ID to the metadata of a call
+func outgoingContext(ctx context.Context, id *identity, method string) (context.Context, error) {
+	user, _ := UserFromContext(ctx)
+	token, err := id.signToken(method, user)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to sign service token: "+err.Error())
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, tokenMetadataKey, token)
+	if requestID := RequestIDFromContext(ctx); requestID != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, requestIDMetadataKey, requestID)
+	}
+	return ctx, nil
+}
+
+// UnaryServerInterceptor identifies the calling service from its token or its mTLS
+// certificate, rejects callers the allowlist does not name and puts the caller, the
+// forwarded user and the request ID into the context of the handler
+func UnaryServerInterceptor(allowlist Allowlist) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := authorize(ctx, info.FullMethod, allowlist)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor checks streaming RPCs the way UnaryServerInterceptor checks unary
+// ones, the handler sees the caller, user and request ID in the context of the stream
+func StreamServerInterceptor(allowlist Allowlist) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authorize(ss.Context(), info.FullMethod, allowlist)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// serverStream replaces the context of a stream with the one authorize returned
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+// authorize authenticates the caller of method, checks it against the allowlist and returns
+// ctx with the caller, the forwarded user and the request ID
+func authorize(ctx context.Context, method string, allowlist Allowlist) (context.Context, error) {
+	Logs := logger.GetGlobalLogger()
+
+	caller, user, err := authenticate(ctx, method)
+	if err != nil {
+		Logs.Warn(ctx, "Rejected call to "+method+": "+err.Error())
+		return nil, status.Error(codes.Unauthenticated, "service authentication failed")
+	}
+
+	if !allowlist.allows(method, caller) {
+		Logs.Warn(ctx, "Service "+caller+" is not allowed to call "+method)
+		return nil, status.Error(codes.PermissionDenied, "service "+caller+" may not call "+method)
+	}
+
+	ctx = context.WithValue(ctx, callerCtxKey, caller)
+	if user != nil {
+		ctx = ContextWithUser(ctx, user)
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(requestIDMetadataKey); len(values) > 0 {
+			ctx = ContextWithRequestID(ctx, values[0])
+		}
+	}
+	return ctx, nil
+}
+
+// authenticate returns the calling service and the user it forwarded. A verified client
+// certificate is enough on its own, a token presented over mTLS must name the same service
+func authenticate(ctx context.Context, method string) (string, *User, error) {
+	id := self.Load()
+	if id == nil {
+		return "", nil, status.Error(codes.Internal, "service identity not initialized")
+	}
+
+	peerService := peerIdentity(ctx)
+
+	var token string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(tokenMetadataKey); len(values) > 0 {
+			token = values[0]
+		}
+	}
+	if token == "" {
+		if peerService == "" {
+			return "", nil, status.Error(codes.Unauthenticated, "no service token or client certificate")
+		}
+		return peerService, nil, nil
+	}
+
+	claims, err := id.parseToken(token, method)
+	if err != nil {
+		return "", nil, err
+	}
+	if peerService != "" && peerService != claims.Issuer {
+		return "", nil, status.Error(codes.Unauthenticated, "service token issuer "+claims.Issuer+" does not match client certificate "+peerService)
+	}
+	return claims.Issuer, claims.User, nil
+}
+
+// peerIdentity returns the common name of a verified client certificate, or "" without mTLS
+func peerIdentity(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.AuthInfo == nil {
+		return ""
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return ""
+	}
+	return verifiedCommonName(tlsInfo.State)
+}
+
+func verifiedCommonName(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
@@ -0,0 +1,135 @@
+package svcauth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// use makes id the identity of the running service until the test ends
+func use(t *testing.T, id *identity) {
+	t.Helper()
+	previous := self.Load()
+	self.Store(id)
+	t.Cleanup(func() { self.Store(previous) })
+}
+
+// withClientCert makes ctx look like a call over mTLS from a verified certificate for service
+func withClientCert(ctx context.Context, service string) context.Context {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: service}}
+	return peer.NewContext(ctx, &peer.Peer{AuthInfo: credentials.TLSInfo{
+		State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+	}})
+}
+
+func TestAuthorize(t *testing.T) {
+	use(t, testIdentity("catalog", time.Minute))
+	allowlist := Allowlist{testMethod: {"gateway"}}
+	user := &User{ID: "u1", Email: "alice@example.com", Role: "user"}
+
+	// incoming is a call to testMethod carrying a token signed by service
+	incoming := func(service string, tokenTTL time.Duration, pairs ...string) context.Context {
+		token, err := testIdentity(service, tokenTTL).signToken(testMethod, user)
+		if err != nil {
+			t.Fatalf("signToken: %v", err)
+		}
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(append(pairs, tokenMetadataKey, token)...))
+	}
+
+	for _, tc := range []struct {
+		name       string
+		ctx        context.Context
+		wantCode   codes.Code
+		wantCaller string
+		wantUser   bool
+	}{
+		{name: "allowed service", ctx: incoming("gateway", time.Minute), wantCaller: "gateway", wantUser: true},
+		{name: "service not on the allowlist", ctx: incoming("order", time.Minute), wantCode: codes.PermissionDenied},
+		{name: "expired token", ctx: incoming("gateway", -time.Second), wantCode: codes.Unauthenticated},
+		{name: "untrusted key", ctx: incoming("mallory", time.Minute), wantCode: codes.Unauthenticated},
+		{name: "no credentials", ctx: context.Background(), wantCode: codes.Unauthenticated},
+		{name: "client certificate alone", ctx: withClientCert(context.Background(), "gateway"), wantCaller: "gateway"},
+		{name: "client certificate not on the allowlist", ctx: withClientCert(context.Background(), "order"), wantCode: codes.PermissionDenied},
+		{name: "token of another service than the certificate", ctx: withClientCert(incoming("gateway", time.Minute), "order"), wantCode: codes.Unauthenticated},
+		{name: "token and certificate of the same service", ctx: withClientCert(incoming("gateway", time.Minute), "gateway"), wantCaller: "gateway", wantUser: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, err := authorize(tc.ctx, testMethod, allowlist)
+			if status.Code(err) != tc.wantCode {
+				t.Fatalf("authorize = %v, want %v", err, tc.wantCode)
+			}
+			if err != nil {
+				return
+			}
+			if caller := CallerFromContext(ctx); caller != tc.wantCaller {
+				t.Errorf("caller = %q, want %q", caller, tc.wantCaller)
+			}
+			if got, ok := UserFromContext(ctx); ok != tc.wantUser || ok && *got != *user {
+				t.Errorf("user = %+v, %v, want %v", got, ok, tc.wantUser)
+			}
+		})
+	}
+
+	// methods missing from the allowlist cannot be called by anyone
+	if _, err := authorize(incoming("gateway", time.Minute), "/catalog.CatalogService/DeleteProduct", allowlist); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("authorize with a token for another method = %v, want Unauthenticated", err)
+	}
+	if _, err := authorize(withClientCert(context.Background(), "gateway"), "/catalog.CatalogService/DeleteProduct", allowlist); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("authorize of a method missing from the allowlist = %v, want PermissionDenied", err)
+	}
+}
+
+func TestForwarding(t *testing.T) {
+	use(t, testIdentity("gateway", time.Minute))
+	user := &User{ID: "u1", Email: "alice@example.com", Role: "admin"}
+	requestID := strings.Repeat("r", 100)
+
+	// the gateway calls with the user and the request ID in its context
+	var outgoing metadata.MD
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		outgoing, _ = metadata.FromOutgoingContext(ctx)
+		return nil
+	}
+	ctx := ContextWithRequestID(ContextWithUser(context.Background(), user), requestID)
+	if err := UnaryClientInterceptor()(ctx, testMethod, nil, nil, nil, invoker); err != nil {
+		t.Fatalf("UnaryClientInterceptor: %v", err)
+	}
+
+	// the server hands both to its handler
+	use(t, testIdentity("catalog", time.Minute))
+	var handled context.Context
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		handled = ctx
+		return nil, nil
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: testMethod}
+	if _, err := UnaryServerInterceptor(Allowlist{testMethod: {"gateway"}})(metadata.NewIncomingContext(context.Background(), outgoing), nil, info, handler); err != nil {
+		t.Fatalf("UnaryServerInterceptor: %v", err)
+	}
+	if got, ok := UserFromContext(handled); !ok || *got != *user {
+		t.Errorf("user = %+v, want %+v", got, user)
+	}
+	if caller := CallerFromContext(handled); caller != "gateway" {
+		t.Errorf("caller = %q, want gateway", caller)
+	}
+	if got := RequestIDFromContext(handled); got != requestID[:maxRequestIDLength] {
+		t.Errorf("request ID = %q, want the first %d bytes", got, maxRequestIDLength)
+	}
+
+	// without an identity no token can be signed
+	self.Store(nil)
+	if err := UnaryClientInterceptor()(ctx, testMethod, nil, nil, nil, invoker); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("UnaryClientInterceptor without Init = %v, want Unauthenticated", err)
+	}
+}
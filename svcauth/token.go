@@ -0,0 +1,65 @@
+package svcauth
+
+import (
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// audience keeps service tokens apart from user tokens issued by the auth service
+const audience = "zenvis-internal"
+
+type serviceClaims struct {
+	Method string `json:"mth"`
+	User   *User  `json:"usr,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// signToken issues a token for one call of method, it is only valid for that RPC
+func (id *identity) signToken(method string, user *User) (string, error) {
+	now := time.Now()
+	claims := serviceClaims{
+		Method: method,
+		User:   user,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    id.service,
+			Audience:  jwt.ClaimStrings{audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(id.tokenTTL)),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims).SignedString(id.keys.Private)
+}
+
+// parseToken checks the signature against the public key of the issuing service, and the
+// expiry, audience and method of a service token
+func (id *identity) parseToken(tokenString string, method string) (*serviceClaims, error) {
+	claims := &serviceClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodEdDSA {
+			return nil, errors.New("unexpected signing method")
+		}
+		publicKey, ok := id.keys.Public[claims.Issuer]
+		if !ok {
+			return nil, errors.New("no public key for service " + claims.Issuer)
+		}
+		return publicKey, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid service token")
+	}
+	if !claims.VerifyAudience(audience, true) {
+		return nil, errors.New("service token has the wrong audience")
+	}
+	if claims.Method != method {
+		return nil, errors.New("service token was issued for another method")
+	}
+	if claims.Issuer == "" {
+		return nil, errors.New("service token has no issuer")
+	}
+	return claims, nil
+}
@@ -0,0 +1,114 @@
+package svcauth
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/zenvisjr/building-scalable-microservices/logger"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNopLogger("svcauth")
+	os.Exit(m.Run())
+}
+
+const testMethod = "/catalog.CatalogService/GetProduct"
+
+// testKey derives the key of service, "mallory" is a service nobody trusts
+func testKey(service string) ed25519.PrivateKey {
+	seed := sha256.Sum256([]byte("svcauth:" + service))
+	return ed25519.NewKeyFromSeed(seed[:])
+}
+
+// testIdentity is service with its own key, trusting the gateway and the order service
+func testIdentity(service string, tokenTTL time.Duration) *identity {
+	return &identity{
+		service: service,
+		keys: Keys{
+			Private: testKey(service),
+			Public: map[string]ed25519.PublicKey{
+				"gateway": testKey("gateway").Public().(ed25519.PublicKey),
+				"order":   testKey("order").Public().(ed25519.PublicKey),
+			},
+		},
+		tokenTTL: tokenTTL,
+	}
+}
+
+func TestParseToken(t *testing.T) {
+	server := testIdentity("catalog", time.Minute)
+	user := &User{ID: "u1", Email: "alice@example.com", Role: "user"}
+
+	// signedAs signs a token for testMethod claiming to come from service, with the key of signer
+	signedAs := func(service, signer string, claims serviceClaims) string {
+		claims.Issuer = service
+		token, err := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims).SignedString(testKey(signer))
+		if err != nil {
+			t.Fatalf("SignedString: %v", err)
+		}
+		return token
+	}
+	valid := func(ttl time.Duration) jwt.RegisteredClaims {
+		now := time.Now()
+		return jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		}
+	}
+	sign := func(id *identity, method string, user *User) string {
+		token, err := id.signToken(method, user)
+		if err != nil {
+			t.Fatalf("signToken: %v", err)
+		}
+		return token
+	}
+	hmacToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, serviceClaims{
+		Method:           testMethod,
+		RegisteredClaims: jwt.RegisteredClaims{Issuer: "gateway", Audience: jwt.ClaimStrings{audience}},
+	}).SignedString([]byte("shared secret"))
+	if err != nil {
+		t.Fatalf("SignedString: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		token    string
+		wantErr  bool
+		wantUser *User
+	}{
+		{name: "with user", token: sign(testIdentity("gateway", time.Minute), testMethod, user), wantUser: user},
+		{name: "without user", token: sign(testIdentity("order", time.Minute), testMethod, nil)},
+		{name: "other method", token: sign(testIdentity("gateway", time.Minute), "/catalog.CatalogService/DeleteProduct", user), wantErr: true},
+		{name: "expired", token: sign(testIdentity("gateway", -time.Second), testMethod, user), wantErr: true},
+		{name: "unknown service", token: sign(testIdentity("mallory", time.Minute), testMethod, user), wantErr: true},
+		{name: "key of another service", token: signedAs("gateway", "mallory", serviceClaims{Method: testMethod, RegisteredClaims: valid(time.Minute)}), wantErr: true},
+		{name: "key of the wrong trusted service", token: signedAs("gateway", "order", serviceClaims{Method: testMethod, RegisteredClaims: valid(time.Minute)}), wantErr: true},
+		{name: "user token audience", token: signedAs("gateway", "gateway", serviceClaims{Method: testMethod, RegisteredClaims: jwt.RegisteredClaims{Audience: jwt.ClaimStrings{"zenvis"}, ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))}}), wantErr: true},
+		{name: "HMAC", token: hmacToken, wantErr: true},
+		{name: "garbage", token: "not.a.token", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			claims, err := server.parseToken(tc.token, testMethod)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("parseToken = %+v, want an error", claims)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseToken: %v", err)
+			}
+			if claims.Method != testMethod || claims.Issuer == "" {
+				t.Errorf("claims = %+v", claims)
+			}
+			if (claims.User == nil) != (tc.wantUser == nil) || claims.User != nil && *claims.User != *tc.wantUser {
+				t.Errorf("user = %+v, want %+v", claims.User, tc.wantUser)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+// Package tlsconfig loads the certificates the services use for mutual TLS. Every service
+// presents its own certificate, signed by the internal CA, both as a gRPC server and as a
+// client, and only accepts peers whose certificate chains up to that CA. Certificates and the
+// CA bundle are reloaded when the files change, so they can be rotated without a restart.
+//
+// It does not log through the logger package because the logger client itself uses it.
+package tlsconfig
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+type Config struct {
+	// InsecureDev turns TLS off entirely, it is meant for local development only
+	InsecureDev    bool          `envconfig:"TLS_INSECURE_DEV" default:"false"`
+	CAFile         string        `envconfig:"TLS_CA_FILE" default:"/app/tls/ca.crt"`
+	CertFile       string        `envconfig:"TLS_CERT_FILE" default:"/app/tls/tls.crt"`
+	KeyFile        string        `envconfig:"TLS_KEY_FILE" default:"/app/tls/tls.key"`
+	ReloadInterval time.Duration `envconfig:"TLS_RELOAD_INTERVAL" default:"30s"`
+}
+
+// settings is the TLS setup of the running process, shared by its server and all its clients
+type settings struct {
+	insecureDev bool
+	reloader    *Reloader
+}
+
+var (
+	current  *settings
+	loadErr  error
+	loadOnce sync.Once
+)
+
+// load reads the config from the environment and the certificates from disk the first time it is called
+func load() (*settings, error) {
+	loadOnce.Do(func() {
+		var config Config
+		if err := envconfig.Process("", &config); err != nil {
+			loadErr = err
+			return
+		}
+
+		if config.InsecureDev {
+			log.Println("WARNING: TLS_INSECURE_DEV is set, gRPC traffic is sent unencrypted and unauthenticated")
+			current = &settings{insecureDev: true}
+			return
+		}
+
+		if config.CAFile == "" || config.CertFile == "" || config.KeyFile == "" {
+			loadErr = errors.New("TLS_CA_FILE, TLS_CERT_FILE and TLS_KEY_FILE are required unless TLS_INSECURE_DEV is set")
+			return
+		}
+		reloader, err := NewReloader(config.CertFile, config.KeyFile, config.CAFile, config.ReloadInterval)
+		if err != nil {
+			loadErr = errors.New("failed to load TLS certificates (set TLS_INSECURE_DEV=true to run without TLS): " + err.Error())
+			return
+		}
+		current = &settings{reloader: reloader}
+	})
+	return current, loadErr
+}
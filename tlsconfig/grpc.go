@@ -0,0 +1,33 @@
+package tlsconfig
+
+import (
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// ServerOption returns the transport credentials for a gRPC server: mTLS, or plaintext
+// when TLS_INSECURE_DEV is set
+func ServerOption() (grpc.ServerOption, error) {
+	s, err := load()
+	if err != nil {
+		return nil, err
+	}
+	if s.insecureDev {
+		return grpc.Creds(insecure.NewCredentials()), nil
+	}
+	return grpc.Creds(credentials.NewTLS(s.reloader.ServerConfig())), nil
+}
+
+// DialOption returns the transport credentials for a gRPC client. The server certificate
+// must be valid for the host part of the address the client dials
+func DialOption() (grpc.DialOption, error) {
+	s, err := load()
+	if err != nil {
+		return nil, err
+	}
+	if s.insecureDev {
+		return grpc.WithTransportCredentials(insecure.NewCredentials()), nil
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(s.reloader.ClientConfig())), nil
+}
@@ -0,0 +1,188 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reloader holds a certificate, its key and optionally a CA bundle and loads them again
+// whenever one of the files changes on disk
+type Reloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	roots    *x509.CertPool
+	modTimes []time.Time
+}
+
+// NewReloader loads the files once and, if interval is positive, checks them for changes
+// at that interval for the life of the process. caFile may be empty when no peer
+// certificates have to be verified
+func NewReloader(certFile, keyFile, caFile string, interval time.Duration) (*Reloader, error) {
+	r := &Reloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+	}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	if interval > 0 {
+		go r.watch(interval)
+	}
+	return r, nil
+}
+
+func (r *Reloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.caFile != "" {
+		files = append(files, r.caFile)
+	}
+	return files
+}
+
+// reload reads the files again if any of them changed since the last successful load.
+// On error the previous certificates stay in use
+func (r *Reloader) reload() (bool, error) {
+	// Step 1: Compare modification times with the last load
+	modTimes := make([]time.Time, 0, 3)
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, err
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+
+	r.mu.RLock()
+	unchanged := len(modTimes) == len(r.modTimes)
+	for i := range r.modTimes {
+		unchanged = unchanged && modTimes[i].Equal(r.modTimes[i])
+	}
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	// Step 2: Parse the new key pair and CA bundle, a half written pair fails here and is retried next time
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	var roots *x509.CertPool
+	if r.caFile != "" {
+		pem, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return false, err
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return false, errors.New("no certificates found in " + r.caFile)
+		}
+	}
+
+	// Step 3: Swap them in, new handshakes use them from now on
+	r.mu.Lock()
+	r.cert = &cert
+	r.roots = roots
+	r.modTimes = modTimes
+	r.mu.Unlock()
+	return true, nil
+}
+
+func (r *Reloader) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		changed, err := r.reload()
+		if err != nil {
+			log.Printf("tlsconfig: failed to reload certificates, keeping the previous ones: %v", err)
+			continue
+		}
+		if changed {
+			log.Printf("tlsconfig: reloaded certificate %s", r.certFile)
+		}
+	}
+}
+
+// GetCertificate returns the current certificate, it plugs into tls.Config.GetCertificate
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// GetClientCertificate returns the current certificate, it plugs into tls.Config.GetClientCertificate
+func (r *Reloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Roots returns the current CA pool, nil if the reloader has no CA file
+func (r *Reloader) Roots() *x509.CertPool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.roots
+}
+
+// ServerConfig requires clients to present a certificate signed by the current CA
+func (r *Reloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return &tls.Config{
+				MinVersion:     tls.VersionTLS12,
+				GetCertificate: r.GetCertificate,
+				ClientAuth:     tls.RequireAndVerifyClientCert,
+				ClientCAs:      r.Roots(),
+			}, nil
+		},
+	}
+}
+
+// ClientConfig presents the current certificate and verifies the server against the current CA
+func (r *Reloader) ClientConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:           tls.VersionTLS12,
+		GetClientCertificate: r.GetClientCertificate,
+		// RootCAs would pin the CA bundle loaded at dial time, the chain is checked
+		// against the current pool in verifyServer instead
+		InsecureSkipVerify: true,
+		VerifyConnection:   r.verifyServer,
+	}
+}
+
+// HTTPServerConfig serves the current certificate without asking clients for one
+func (r *Reloader) HTTPServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+}
+
+// verifyServer does what crypto/tls does with RootCAs, using the CA pool of this moment
+func (r *Reloader) verifyServer(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("server presented no certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       state.ServerName,
+		Roots:         r.Roots(),
+		Intermediates: intermediates,
+	})
+	return err
+}
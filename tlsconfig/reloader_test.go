@@ -0,0 +1,284 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA signs the certificates of a test
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "zenvis test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// writeCA writes the CA bundle into dir and returns its path
+func (ca *testCA) writeCA(t *testing.T, dir string) string {
+	t.Helper()
+	file := filepath.Join(dir, "ca.crt")
+	writePEM(t, file, "CERTIFICATE", ca.cert.Raw)
+	return file
+}
+
+// issue writes a certificate for service with the given serial number and its key into dir,
+// the certificate is valid for the service name as a host, the way the services dial each other
+func (ca *testCA) issue(t *testing.T, dir string, service string, serial int64) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: service},
+		DNSNames:     []string{service},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %v", err)
+	}
+	certFile, keyFile := filepath.Join(dir, service+".crt"), filepath.Join(dir, service+".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+// writePEM replaces file and moves its modification time forward, so a rewrite within the
+// timestamp resolution of the file system is still seen as a change
+func writePEM(t *testing.T, file string, blockType string, der []byte) {
+	t.Helper()
+	modTime := time.Now()
+	if info, err := os.Stat(file); err == nil && !info.ModTime().Before(modTime) {
+		modTime = info.ModTime().Add(time.Second)
+	}
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+}
+
+// handshake connects a client using client to a server using server over loopback and returns
+// the connection state each side ended up with
+func handshake(t *testing.T, server *tls.Config, client *tls.Config, serverName string) (tls.ConnectionState, tls.ConnectionState, error) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer lis.Close()
+
+	type result struct {
+		state tls.ConnectionState
+		err   error
+	}
+	accepted := make(chan result, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			accepted <- result{err: err}
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		tlsConn := tls.Server(conn, server)
+		err = tlsConn.Handshake()
+		accepted <- result{state: tlsConn.ConnectionState(), err: err}
+	}()
+
+	client = client.Clone()
+	client.ServerName = serverName
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", lis.Addr().String(), client)
+	var clientState tls.ConnectionState
+	if err == nil {
+		clientState = conn.ConnectionState()
+		conn.Close()
+	}
+	serverResult := <-accepted
+	if err != nil {
+		return tls.ConnectionState{}, tls.ConnectionState{}, err
+	}
+	if serverResult.err != nil {
+		return tls.ConnectionState{}, tls.ConnectionState{}, serverResult.err
+	}
+	return serverResult.state, clientState, nil
+}
+
+func TestReloaderRotation(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile := ca.writeCA(t, dir)
+	serverCert, serverKey := ca.issue(t, dir, "catalog", 10)
+	clientCert, clientKey := ca.issue(t, dir, "gateway", 20)
+
+	server, err := NewReloader(serverCert, serverKey, caFile, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewReloader: %v", err)
+	}
+	client, err := NewReloader(clientCert, clientKey, caFile, 0)
+	if err != nil {
+		t.Fatalf("NewReloader: %v", err)
+	}
+
+	_, clientState, err := handshake(t, server.ServerConfig(), client.ClientConfig(), "catalog")
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	if serial := clientState.PeerCertificates[0].SerialNumber.Int64(); serial != 10 {
+		t.Fatalf("server presented serial %d, want 10", serial)
+	}
+
+	// the watcher picks the rotated pair up, the next handshake presents it
+	ca.issue(t, dir, "catalog", 11)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, clientState, err := handshake(t, server.ServerConfig(), client.ClientConfig(), "catalog")
+		if err != nil {
+			t.Fatalf("handshake after rotation: %v", err)
+		}
+		if clientState.PeerCertificates[0].SerialNumber.Int64() == 11 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server still presents the old certificate after rotation")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a reloader without a watcher sees the rotation on its next reload
+	ca.issue(t, dir, "gateway", 21)
+	if changed, err := client.reload(); err != nil || !changed {
+		t.Fatalf("reload = %v, %v, want a change", changed, err)
+	}
+	serverState, _, err := handshake(t, server.ServerConfig(), client.ClientConfig(), "catalog")
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	if serial := serverState.PeerCertificates[0].SerialNumber.Int64(); serial != 21 {
+		t.Errorf("client presented serial %d, want 21", serial)
+	}
+	if changed, err := client.reload(); err != nil || changed {
+		t.Errorf("reload of unchanged files = %v, %v, want no change", changed, err)
+	}
+}
+
+func TestReloaderKeepsCertificateOnBadRotation(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile := ca.writeCA(t, dir)
+	certFile, keyFile := ca.issue(t, dir, "catalog", 10)
+
+	r, err := NewReloader(certFile, keyFile, caFile, 0)
+	if err != nil {
+		t.Fatalf("NewReloader: %v", err)
+	}
+
+	// a certificate written without its key yet does not replace the working pair
+	writePEM(t, certFile, "CERTIFICATE", newTestCA(t).cert.Raw)
+	if _, err := r.reload(); err == nil {
+		t.Fatal("reload of a mismatched pair succeeded")
+	}
+	cert, _ := r.GetCertificate(nil)
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err != nil || leaf.SerialNumber.Int64() != 10 {
+		t.Errorf("certificate after a failed reload = %v, %v, want serial 10", leaf, err)
+	}
+}
+
+func TestPeerIdentity(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile := ca.writeCA(t, dir)
+	serverCert, serverKey := ca.issue(t, dir, "catalog", 10)
+	server, err := NewReloader(serverCert, serverKey, caFile, 0)
+	if err != nil {
+		t.Fatalf("NewReloader: %v", err)
+	}
+
+	otherDir := t.TempDir()
+	other := newTestCA(t)
+	other.writeCA(t, otherDir)
+	foreignCert, foreignKey := other.issue(t, otherDir, "gateway", 30)
+	foreign, err := NewReloader(foreignCert, foreignKey, caFile, 0)
+	if err != nil {
+		t.Fatalf("NewReloader: %v", err)
+	}
+	clientCert, clientKey := ca.issue(t, dir, "order", 20)
+	client, err := NewReloader(clientCert, clientKey, caFile, 0)
+	if err != nil {
+		t.Fatalf("NewReloader: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		client     *Reloader
+		serverName string
+		wantPeer   string // common name of the verified client chain, "" when the handshake fails
+	}{
+		{name: "certificate of the CA", client: client, serverName: "catalog", wantPeer: "order"},
+		{name: "certificate of another CA", client: foreign, serverName: "catalog"},
+		{name: "server certificate for another host", client: client, serverName: "account"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			serverState, _, err := handshake(t, server.ServerConfig(), tc.client.ClientConfig(), tc.serverName)
+			if tc.wantPeer == "" {
+				if err == nil {
+					t.Fatal("handshake succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("handshake: %v", err)
+			}
+			// the services take the caller from the leaf of the verified chain, never from
+			// the unverified peer certificates
+			if len(serverState.VerifiedChains) == 0 || serverState.VerifiedChains[0][0].Subject.CommonName != tc.wantPeer {
+				t.Errorf("verified chains = %v, want a chain for %s", serverState.VerifiedChains, tc.wantPeer)
+			}
+		})
+	}
+}